@@ -0,0 +1,286 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package analysis computes statistics over mapping configs, e.g. to take an inventory of a large
+// config before refactoring it.
+package analysis
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+const (
+	// RootNode is the name of the call graph node of the root mappings.
+	RootNode = "root"
+
+	// postProcessNode is the name of the call graph node of an inline post process projector without
+	// a name.
+	postProcessNode = "post"
+)
+
+// Call is an edge of the call graph: Caller calls Callee in Count places.
+type Call struct {
+	Caller string
+	Callee string
+	Count  int
+}
+
+// Report holds the statistics of a mapping config.
+type Report struct {
+	// ProjectorCount is the number of projectors defined in the config, including those generated by
+	// the transpiler (e.g. for anonymous blocks) and the inline post process projector.
+	ProjectorCount int
+
+	// RootMappingCount is the number of root mappings.
+	RootMappingCount int
+
+	// FieldMappingCounts is the number of field mappings of each defined projector.
+	FieldMappingCounts map[string]int
+
+	// BuiltinUsage is the number of places each builtin (a projector starting with $ that is not
+	// defined in the config) is called in.
+	BuiltinUsage map[string]int
+
+	// Calls are the edges of the call graph between the root mappings (see RootNode), the defined
+	// projectors, and external projectors, sorted by caller and callee. Calls to builtins are only
+	// counted in BuiltinUsage.
+	Calls []Call
+
+	// ExternalProjectors are the projectors that are called but not defined in the config (and are
+	// not builtins), e.g. those from libraries or code harmonization, sorted.
+	ExternalProjectors []string
+
+	// UnreachableProjectors are the defined projectors that can not be reached from the root
+	// mappings, the pre process projectors or the post process projector, sorted.
+	UnreachableProjectors []string
+
+	// MaxNestingDepth is the maximum number of projector calls nested within each other in a single
+	// value source, e.g. 3 for $A($B($C(x))). Nesting through other projectors is not counted.
+	MaxNestingDepth int
+}
+
+// Analyze computes the statistics of the given config. Conditions, arguments and nested value
+// sources are all traversed.
+func Analyze(cfg *mappb.MappingConfig) Report {
+	a := &analyzer{
+		report: Report{
+			FieldMappingCounts: make(map[string]int),
+			BuiltinUsage:       make(map[string]int),
+		},
+		defined: make(map[string]bool),
+		calls:   make(map[string]map[string]int),
+	}
+
+	var projectors []*mappb.ProjectorDefinition
+	projectors = append(projectors, cfg.GetProjector()...)
+
+	roots := []string{RootNode}
+	roots = append(roots, cfg.GetPreProcessProjectorName()...)
+	if name := cfg.GetPostProcessProjectorName(); name != "" {
+		roots = append(roots, name)
+	}
+	if pd := cfg.GetPostProcessProjectorDefinition(); pd != nil {
+		if pd.GetName() == "" {
+			pd = &mappb.ProjectorDefinition{Name: postProcessNode, Mapping: pd.GetMapping()}
+		}
+		projectors = append(projectors, pd)
+		roots = append(roots, pd.GetName())
+	}
+
+	for _, p := range projectors {
+		a.defined[p.GetName()] = true
+	}
+
+	a.report.RootMappingCount = len(cfg.GetRootMapping())
+	a.mappings(RootNode, cfg.GetRootMapping())
+
+	a.report.ProjectorCount = len(projectors)
+	for _, p := range projectors {
+		a.report.FieldMappingCounts[p.GetName()] += len(p.GetMapping())
+		a.mappings(p.GetName(), p.GetMapping())
+		a.valueSource(p.GetName(), p.GetEnsures())
+	}
+
+	for _, name := range roots[1:] {
+		if !a.defined[name] && !isBuiltin(name) {
+			a.external(name)
+		}
+	}
+
+	a.report.Calls = a.sortedCalls()
+	a.report.UnreachableProjectors = a.unreachable(roots)
+	sort.Strings(a.report.ExternalProjectors)
+
+	return a.report
+}
+
+type analyzer struct {
+	report    Report
+	defined   map[string]bool
+	calls     map[string]map[string]int
+	externals map[string]bool
+}
+
+func isBuiltin(name string) bool {
+	return strings.HasPrefix(name, "$")
+}
+
+func (a *analyzer) mappings(caller string, maps []*mappb.FieldMapping) {
+	for _, m := range maps {
+		a.valueSource(caller, m.GetCondition())
+		a.valueSource(caller, m.GetValueSource())
+		a.valueSource(caller, m.GetTargetKey())
+		a.valueSource(caller, m.GetTargetDynamicObject())
+	}
+}
+
+// valueSource records the calls in the given value source (and the ones nested in it), returning
+// its nesting depth.
+func (a *analyzer) valueSource(caller string, vs *mappb.ValueSource) int {
+	if vs == nil {
+		return 0
+	}
+
+	depth := 0
+	if pv := vs.GetProjectedValue(); pv != nil {
+		depth = a.valueSource(caller, pv)
+	}
+	for _, arg := range vs.GetAdditionalArg() {
+		if d := a.valueSource(caller, arg); d > depth {
+			depth = d
+		}
+	}
+
+	if p := vs.GetProjector(); p != "" {
+		a.call(caller, p)
+		depth++
+	}
+
+	if depth > a.report.MaxNestingDepth {
+		a.report.MaxNestingDepth = depth
+	}
+	return depth
+}
+
+func (a *analyzer) call(caller, callee string) {
+	if isBuiltin(callee) && !a.defined[callee] {
+		a.report.BuiltinUsage[callee]++
+		return
+	}
+	if !a.defined[callee] {
+		a.external(callee)
+	}
+
+	if a.calls[caller] == nil {
+		a.calls[caller] = make(map[string]int)
+	}
+	a.calls[caller][callee]++
+}
+
+func (a *analyzer) external(name string) {
+	if a.externals == nil {
+		a.externals = make(map[string]bool)
+	}
+	if !a.externals[name] {
+		a.externals[name] = true
+		a.report.ExternalProjectors = append(a.report.ExternalProjectors, name)
+	}
+}
+
+func (a *analyzer) sortedCalls() []Call {
+	var calls []Call
+	for caller, callees := range a.calls {
+		for callee, count := range callees {
+			calls = append(calls, Call{Caller: caller, Callee: callee, Count: count})
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].Caller != calls[j].Caller {
+			return calls[i].Caller < calls[j].Caller
+		}
+		return calls[i].Callee < calls[j].Callee
+	})
+	return calls
+}
+
+func (a *analyzer) unreachable(roots []string) []string {
+	reached := make(map[string]bool)
+	queue := append([]string{}, roots...)
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if reached[n] {
+			continue
+		}
+		reached[n] = true
+		for callee := range a.calls[n] {
+			queue = append(queue, callee)
+		}
+	}
+
+	var unreachable []string
+	for name := range a.defined {
+		if !reached[name] {
+			unreachable = append(unreachable, name)
+		}
+	}
+	sort.Strings(unreachable)
+	return unreachable
+}
+
+// WriteDOT writes the call graph of the report in the DOT format of Graphviz, e.g. for rendering
+// with `dot -Tsvg`. Every defined projector is a node, even if it is not called. Edges are
+// labelled with their call counts (if more than 1), unreachable projectors are dashed and external
+// projectors are grey.
+func (r Report) WriteDOT(w io.Writer) error {
+	unreachable := make(map[string]bool)
+	for _, name := range r.UnreachableProjectors {
+		unreachable[name] = true
+	}
+	defined := make([]string, 0, len(r.FieldMappingCounts))
+	for name := range r.FieldMappingCounts {
+		defined = append(defined, name)
+	}
+	sort.Strings(defined)
+
+	var b strings.Builder
+	b.WriteString("digraph calls {\n")
+	fmt.Fprintf(&b, "  %q [shape=box];\n", RootNode)
+	for _, name := range defined {
+		if unreachable[name] {
+			fmt.Fprintf(&b, "  %q [style=dashed];\n", name)
+		} else {
+			fmt.Fprintf(&b, "  %q;\n", name)
+		}
+	}
+	for _, name := range r.ExternalProjectors {
+		fmt.Fprintf(&b, "  %q [color=grey, fontcolor=grey];\n", name)
+	}
+	for _, c := range r.Calls {
+		if c.Count > 1 {
+			fmt.Fprintf(&b, "  %q -> %q [label=%d];\n", c.Caller, c.Callee, c.Count)
+		} else {
+			fmt.Fprintf(&b, "  %q -> %q;\n", c.Caller, c.Callee)
+		}
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,309 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package analysis
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/transpiler" /* copybara-comment: transpiler */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+func input(arg int32) *mappb.ValueSource {
+	return &mappb.ValueSource{Source: &mappb.ValueSource_FromInput{FromInput: &mappb.ValueSource_InputSource{Arg: arg}}}
+}
+
+func call(projector string, args ...*mappb.ValueSource) *mappb.ValueSource {
+	vs := &mappb.ValueSource{Projector: projector}
+	if len(args) == 0 {
+		return vs
+	}
+	if args[0].GetProjector() != "" {
+		vs.Source = &mappb.ValueSource_ProjectedValue{ProjectedValue: args[0]}
+	} else {
+		vs.Source = args[0].Source
+	}
+	vs.AdditionalArg = args[1:]
+	return vs
+}
+
+func field(target string, vs *mappb.ValueSource) *mappb.FieldMapping {
+	return &mappb.FieldMapping{ValueSource: vs, Target: &mappb.FieldMapping_TargetField{TargetField: target}}
+}
+
+func TestAnalyze(t *testing.T) {
+	cfg := &mappb.MappingConfig{
+		RootMapping: []*mappb.FieldMapping{
+			{
+				ValueSource: call("Patient", input(1)),
+				Target:      &mappb.FieldMapping_TargetRootField{TargetRootField: "Patient"},
+				Condition:   call("$IsNotNil", input(1)),
+			},
+			{
+				ValueSource: call("Encounter", input(1)),
+				Target:      &mappb.FieldMapping_TargetObject{TargetObject: "Encounter"},
+			},
+		},
+		Projector: []*mappb.ProjectorDefinition{
+			{
+				Name: "Patient",
+				Mapping: []*mappb.FieldMapping{
+					field("name", call("$ToUpper", call("$StrCat", call("$Trim", input(1)), &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: " "}}))),
+					field("id", call("$UUID")),
+					{
+						ValueSource: call("Identifier", input(1)),
+						Target:      &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "ids"},
+						Condition:   call("$Eq", input(1), call("HasMRN", input(1))),
+					},
+				},
+			},
+			{
+				Name: "Identifier",
+				Mapping: []*mappb.FieldMapping{
+					field("value", &mappb.ValueSource{Source: &mappb.ValueSource_FromSource{FromSource: "mrn"}}),
+					field("system", call("$anonblock_3_4")),
+				},
+			},
+			{
+				Name: "$anonblock_3_4",
+				Mapping: []*mappb.FieldMapping{
+					field("$this", call("HarmonizeSystem", &mappb.ValueSource{Source: &mappb.ValueSource_FromArg{FromArg: 0}})),
+				},
+			},
+			{
+				Name: "Encounter",
+				Mapping: []*mappb.FieldMapping{
+					field("subject", call("Identifier", input(1))),
+					field("partOf", call("Encounter", input(1))),
+				},
+			},
+			{
+				Name: "Unused",
+				Mapping: []*mappb.FieldMapping{
+					field("x", call("AlsoUnused", input(1))),
+				},
+			},
+			{
+				Name: "AlsoUnused",
+			},
+			{
+				Name: "Unwrap",
+				Mapping: []*mappb.FieldMapping{
+					field("$this", call("$Type", input(1))),
+				},
+			},
+		},
+		PostProcess: &mappb.MappingConfig_PostProcessProjectorDefinition{
+			PostProcessProjectorDefinition: &mappb.ProjectorDefinition{
+				Mapping: []*mappb.FieldMapping{
+					field("$this", call("$StrCat", input(1))),
+				},
+			},
+		},
+		PreProcessProjectorName: []string{"Unwrap", "LibraryUnwrap"},
+	}
+
+	want := Report{
+		ProjectorCount:   8,
+		RootMappingCount: 2,
+		FieldMappingCounts: map[string]int{
+			"Patient":        3,
+			"Identifier":     2,
+			"$anonblock_3_4": 1,
+			"Encounter":      2,
+			"Unused":         1,
+			"AlsoUnused":     0,
+			"Unwrap":         1,
+			"post":           1,
+		},
+		BuiltinUsage: map[string]int{
+			"$IsNotNil": 1,
+			"$ToUpper":  1,
+			"$StrCat":   2,
+			"$Trim":     1,
+			"$UUID":     1,
+			"$Eq":       1,
+			"$Type":     1,
+		},
+		Calls: []Call{
+			{Caller: "$anonblock_3_4", Callee: "HarmonizeSystem", Count: 1},
+			{Caller: "Encounter", Callee: "Encounter", Count: 1},
+			{Caller: "Encounter", Callee: "Identifier", Count: 1},
+			{Caller: "Identifier", Callee: "$anonblock_3_4", Count: 1},
+			{Caller: "Patient", Callee: "HasMRN", Count: 1},
+			{Caller: "Patient", Callee: "Identifier", Count: 1},
+			{Caller: "Unused", Callee: "AlsoUnused", Count: 1},
+			{Caller: "root", Callee: "Encounter", Count: 1},
+			{Caller: "root", Callee: "Patient", Count: 1},
+		},
+		ExternalProjectors:    []string{"HarmonizeSystem", "HasMRN", "LibraryUnwrap"},
+		UnreachableProjectors: []string{"AlsoUnused", "Unused"},
+		MaxNestingDepth:       3,
+	}
+
+	if diff := cmp.Diff(want, Analyze(cfg)); diff != "" {
+		t.Errorf("Analyze() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAnalyze_Empty(t *testing.T) {
+	want := Report{
+		FieldMappingCounts: map[string]int{},
+		BuiltinUsage:       map[string]int{},
+	}
+	if diff := cmp.Diff(want, Analyze(&mappb.MappingConfig{})); diff != "" {
+		t.Errorf("Analyze() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestAnalyze_DynamicObjectReachability(t *testing.T) {
+	// ResourceType is only called to name the output object of the root mapping, and Kind only from
+	// ResourceType.
+	cfg := &mappb.MappingConfig{
+		RootMapping: []*mappb.FieldMapping{
+			{
+				ValueSource: input(1),
+				Target:      &mappb.FieldMapping_TargetDynamicObject{TargetDynamicObject: call("ResourceType", input(1))},
+			},
+		},
+		Projector: []*mappb.ProjectorDefinition{
+			{
+				Name:    "ResourceType",
+				Mapping: []*mappb.FieldMapping{field("$this", call("$ToUpper", call("Kind", input(1))))},
+			},
+			{
+				Name:    "Kind",
+				Mapping: []*mappb.FieldMapping{field("$this", input(1))},
+			},
+			{
+				Name: "Unused",
+			},
+		},
+	}
+
+	r := Analyze(cfg)
+	if want := []string{"Unused"}; !cmp.Equal(want, r.UnreachableProjectors) {
+		t.Errorf("UnreachableProjectors = %v, want %v", r.UnreachableProjectors, want)
+	}
+	for _, c := range []Call{
+		{Caller: RootNode, Callee: "ResourceType", Count: 1},
+		{Caller: "ResourceType", Callee: "Kind", Count: 1},
+	} {
+		found := false
+		for _, got := range r.Calls {
+			found = found || got == c
+		}
+		if !found {
+			t.Errorf("Calls = %v, want it to contain %v", r.Calls, c)
+		}
+	}
+}
+
+func TestAnalyze_Transpiled(t *testing.T) {
+	whistle := `
+Patient: Patient_Patient($root.patient)
+out Observation: Observation_Observation($root.observations[])
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: $UUID()
+  name[0].family: $ToUpper($StrCat($Trim(p.last), " "))
+  identifier[]: Identifier(p.mrn)
+}
+
+def Observation_Observation(o) {
+  resourceType: "Observation"
+  subject.reference: $StrCat("Patient/", o.patientId)
+  code: $HarmonizeCode("$Local", o.code, "local", "observations")
+  performer: LibraryPerformer(o.performer)
+}
+
+def Identifier(mrn) {
+  system: "urn:mrn"
+  value: mrn
+}
+
+def Unused(x) {
+  y: Identifier(x)
+}`
+
+	cfg, err := transpiler.TranspileSource(whistle)
+	if err != nil {
+		t.Fatalf("TranspileSource() returned unexpected error: %v", err)
+	}
+	r := Analyze(cfg)
+
+	if r.RootMappingCount != 2 {
+		t.Errorf("RootMappingCount = %d, want 2", r.RootMappingCount)
+	}
+	if want := map[string]int{"$UUID": 1, "$ToUpper": 1, "$StrCat": 2, "$Trim": 1, "$HarmonizeCode": 1}; !cmp.Equal(want, r.BuiltinUsage) {
+		t.Errorf("BuiltinUsage = %v, want %v", r.BuiltinUsage, want)
+	}
+	for _, c := range []Call{
+		{Caller: RootNode, Callee: "Patient_Patient", Count: 1},
+		{Caller: RootNode, Callee: "Observation_Observation", Count: 1},
+		{Caller: "Patient_Patient", Callee: "Identifier", Count: 1},
+		{Caller: "Observation_Observation", Callee: "LibraryPerformer", Count: 1},
+		{Caller: "Unused", Callee: "Identifier", Count: 1},
+	} {
+		found := false
+		for _, got := range r.Calls {
+			found = found || got == c
+		}
+		if !found {
+			t.Errorf("Calls = %v, want it to contain %v", r.Calls, c)
+		}
+	}
+	if want := []string{"Unused"}; !cmp.Equal(want, r.UnreachableProjectors) {
+		t.Errorf("UnreachableProjectors = %v, want %v", r.UnreachableProjectors, want)
+	}
+	if want := []string{"LibraryPerformer"}; !cmp.Equal(want, r.ExternalProjectors) {
+		t.Errorf("ExternalProjectors = %v, want %v", r.ExternalProjectors, want)
+	}
+	if r.MaxNestingDepth != 3 {
+		t.Errorf("MaxNestingDepth = %d, want 3", r.MaxNestingDepth)
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	r := Report{
+		FieldMappingCounts:    map[string]int{"A": 1, "B": 2, "Unused": 1},
+		Calls:                 []Call{{Caller: "A", Callee: "B", Count: 2}, {Caller: "A", Callee: "Lib", Count: 1}, {Caller: "root", Callee: "A", Count: 1}},
+		ExternalProjectors:    []string{"Lib"},
+		UnreachableProjectors: []string{"Unused"},
+	}
+
+	want := `digraph calls {
+  "root" [shape=box];
+  "A";
+  "B";
+  "Unused" [style=dashed];
+  "Lib" [color=grey, fontcolor=grey];
+  "A" -> "B" [label=2];
+  "A" -> "Lib";
+  "root" -> "A";
+}
+`
+	var b strings.Builder
+	if err := r.WriteDOT(&b); err != nil {
+		t.Fatalf("WriteDOT() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("WriteDOT() returned diff (-want +got):\n%s", diff)
+	}
+}
@@ -16,44 +16,74 @@
 package builtins
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"log"
 	"math"
+	"math/rand"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
 	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
-	"bitbucket.org/creachadair/stringset" /* copybara-comment: stringset */
 	"github.com/google/uuid" /* copybara-comment: uuid */
 )
 
 // When adding a built-in, remember to add it to the map below with its name as the key.
 var BuiltinFunctions = map[string]interface{}{
 	// Arithmetic
-	"$Div": Div,
-	"$Mod": Mod,
-	"$Mul": Mul,
-	"$Sub": Sub,
-	"$Sum": Sum,
+	"$Div":        Div,
+	"$FormatNum":  FormatNum,
+	"$FromBase36": FromBase36,
+	"$FromRadix":  FromRadix,
+	"$IsInteger":  IsInteger,
+	"$Mod":        Mod,
+	"$Mul":        Mul,
+	"$Sub":        Sub,
+	"$Sum":        Sum,
+	"$ToBase36":   ToBase36,
+	"$ToFixedInt": ToFixedInt,
+	"$ToRadix":    ToRadix,
 
 	// Collections
+	"$CompactList":    CompactList,
 	"$Flatten":        Flatten,
 	"$ListCat":        ListCat,
 	"$ListLen":        ListLen,
 	"$ListOf":         ListOf,
+	"$MaxBy":          MaxBy,
+	"$MinBy":          MinBy,
+	"$PadList":        PadList,
+	"$Repeat":         Repeat,
+	"$Sample":         Sample,
+	"$Shuffle":        Shuffle,
 	"$SortAndTakeTop": SortAndTakeTop,
+	"$Transpose":      Transpose,
 	"$UnionBy":        UnionBy,
 	"$Unique":         Unique,
 	"$UnnestArrays":   UnnestArrays,
 
+	// Codes
+	"$NormalizeICD10": NormalizeICD10,
+	"$NormalizeNDC":   NormalizeNDC,
+
 	// Date/Time
 	"$CurrentTime":          CurrentTime,
+	"$FormatISOWeekDate":    FormatISOWeekDate,
+	"$ISOWeek":              ISOWeek,
 	"$MultiFormatParseTime": MultiFormatParseTime,
 	"$ParseTime":            ParseTime,
 	"$ParseUnixTime":        ParseUnixTime,
@@ -61,40 +91,80 @@ var BuiltinFunctions = map[string]interface{}{
 	"$SplitTime":            SplitTime,
 
 	// Data operations
-	"$Hash":      Hash,
-	"$IntHash":   IntHash,
-	"$IsNil":     IsNil,
-	"$IsNotNil":  IsNotNil,
-	"$MergeJSON": MergeJSON,
-	"$UUID":      UUID,
-	"$Type":      Type,
+	"$GenerateNarrative": GenerateNarrative,
+	"$Hash":              Hash,
+	"$IntHash":           IntHash,
+	"$IsEmpty":           IsEmpty,
+	"$IsNil":             IsNil,
+	"$IsNotEmpty":        IsNotEmpty,
+	"$IsNotNil":          IsNotNil,
+	"$JoinPath":          JoinPath,
+	"$MergeDuplicates":   MergeDuplicates,
+	"$MergeJSON":         MergeJSON,
+	"$ObjOf":             ObjOf,
+	"$ParseYAML":         ParseYAML,
+	"$RedactExcept":      RedactExcept,
+	"$SplitPath":         SplitPath,
+	"$UUID":              UUID,
+	"$Type":              Type,
 
 	// Debugging
 	"$DebugString": DebugString,
 	"$Void":        Void,
 
+	// FHIR
+	"$CodeableConcept":   CodeableConcept,
+	"$Coding":            Coding,
+	"$CodingToCWE":       CodingToCWE,
+	"$CWEToCoding":       CWEToCoding,
+	"$GetExtension":      GetExtension,
+	"$GetExtensionValue": GetExtensionValue,
+	"$Identifier":        Identifier,
+	"$IsValidFHIRId":     IsValidFHIRId,
+	"$Period":            Period,
+	"$Quantity":          Quantity,
+	"$Reference":         Reference,
+	"$SanitizeFHIRId":    SanitizeFHIRId,
+	"$SetExtension":      SetExtension,
+	"$SigToTiming":       SigToTiming,
+	"$SortBundleEntries": SortBundleEntries,
+
 	// Logic
-	"$And":  And,
-	"$Eq":   Eq,
-	"$Gt":   Gt,
-	"$GtEq": GtEq,
-	"$Lt":   Lt,
-	"$LtEq": LtEq,
-	"$NEq":  NEq,
-	"$Not":  Not,
-	"$Or":   Or,
+	"$And":        And,
+	"$AtMostOne":  AtMostOne,
+	"$Eq":         Eq,
+	"$ExactlyOne": ExactlyOne,
+	"$Gt":         Gt,
+	"$GtEq":       GtEq,
+	"$If":         If,
+	"$Lt":         Lt,
+	"$LtEq":       LtEq,
+	"$NEq":        NEq,
+	"$Not":        Not,
+	"$Or":         Or,
+	"$Xor":        Xor,
 
 	// Strings
-	"$MatchesRegex": MatchesRegex,
-	"$ParseFloat":   ParseFloat,
-	"$ParseInt":     ParseInt,
-	"$SubStr":       SubStr,
-	"$StrCat":       StrCat,
-	"$StrFmt":       StrFmt,
-	"$StrJoin":      StrJoin,
-	"$StrSplit":     StrSplit,
-	"$ToLower":      ToLower,
-	"$ToUpper":      ToUpper,
+	"$BuildQueryString":     BuildQueryString,
+	"$EscapeXML":            EscapeXML,
+	"$MaskString":           MaskString,
+	"$MatchesRegex":         MatchesRegex,
+	"$ParseCSVLine":         ParseCSVLine,
+	"$ParseFloat":           ParseFloat,
+	"$ParseInt":             ParseInt,
+	"$ParseQueryString":     ParseQueryString,
+	"$SplitByLength":        SplitByLength,
+	"$SubStr":               SubStr,
+	"$StrCat":               StrCat,
+	"$StrCount":             StrCount,
+	"$StrFmt":               StrFmt,
+	"$StrJoin":              StrJoin,
+	"$StrOccurrenceIndexes": StrOccurrenceIndexes,
+	"$StrReplace":           StrReplace,
+	"$StrSplit":             StrSplit,
+	"$ToLower":              ToLower,
+	"$ToUpper":              ToUpper,
+	"$WordWrap":             WordWrap,
 }
 
 const (
@@ -192,6 +262,198 @@ func Sum(operands ...jsonutil.JSONNum) (jsonutil.JSONNum, error) {
 	return res, nil
 }
 
+// maxSafeInteger is the largest integer n such that all integers up to n can be represented exactly
+// by a JSONNum, i.e. 2^53 - 1.
+const maxSafeInteger = 1<<53 - 1
+
+// integerTolerance is how far a JSONNum can be from an integer, relative to its magnitude, and still
+// be considered integral, to absorb floating point artifacts like 0.1 * 3 * 10 =
+// 3.0000000000000004. It is relative so that small numbers like 1e-10 are not taken for 0.
+const integerTolerance = 1e-14
+
+// isInteger returns true iff the given number is integral (within integerTolerance). It is for
+// where an integer is required; numbers are only rendered as integers if they are exactly integral
+// (see formatNum).
+func isInteger(n jsonutil.JSONNum) bool {
+	f := float64(n)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return false
+	}
+	return math.Abs(f-math.Round(f)) <= integerTolerance*math.Abs(f)
+}
+
+// IsInteger returns true iff the given number is integral, allowing for floating point artifacts
+// (e.g. 3.0000000000000004 is an integer).
+func IsInteger(n jsonutil.JSONNum) (jsonutil.JSONBool, error) {
+	return jsonutil.JSONBool(isInteger(n)), nil
+}
+
+// ToFixedInt returns the given number as an exact integer, removing floating point artifacts (e.g.
+// 3.0000000000000004 becomes 3). It returns an error if the number has a fractional part, or is
+// outside of the range of integers that can be represented exactly (-(2^53 - 1) to 2^53 - 1).
+func ToFixedInt(n jsonutil.JSONNum) (jsonutil.JSONNum, error) {
+	if !isInteger(n) {
+		return 0, fmt.Errorf("%v is not an integer", formatNum(n))
+	}
+	i := math.Round(float64(n))
+	if math.Abs(i) > maxSafeInteger {
+		return 0, fmt.Errorf("%v is outside of the safe integer range [-%d, %d]", formatNum(n), int64(maxSafeInteger), int64(maxSafeInteger))
+	}
+	return jsonutil.JSONNum(i), nil
+}
+
+// formatNum renders the given number as text: integers in the safe integer range are rendered
+// without a fractional part or exponent, other numbers in their shortest exact decimal form without
+// an exponent. Numbers that are only close to an integer (see isInteger) are not rounded, so that no
+// precision is lost; use ToFixedInt for that.
+func formatNum(n jsonutil.JSONNum) string {
+	if f := float64(n); f == math.Trunc(f) && math.Abs(f) <= maxSafeInteger {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(float64(n), 'f', -1, 64)
+}
+
+// maxFormatDecimals is the largest number of decimals FormatNum renders, well beyond the precision
+// of a JSONNum.
+const maxFormatDecimals = 20
+
+// FormatNum renders the given number with exactly the given number of decimals, rounding half away
+// from zero, e.g. for FHIR decimals or human readable outputs. The digits of the integer part are
+// grouped by three with thousandsSep unless it is empty, and the decimals are separated with
+// decimalSep. Numbers are never rendered with an exponent, however large. Rounding applies to the
+// shortest decimal form of the number (e.g. 1.005 rounds to 1.01 with 2 decimals, although its
+// binary value is slightly below 1.005). Numbers beyond the safe integer range (see ToFixedInt) are
+// rendered as is, so their trailing digits are not exact.
+func FormatNum(n jsonutil.JSONNum, decimals jsonutil.JSONNum, thousandsSep, decimalSep jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	f := float64(n)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("can not format %v", f)
+	}
+	if !isInteger(decimals) || decimals < 0 || decimals > maxFormatDecimals {
+		return "", fmt.Errorf("decimals must be an integer between 0 and %d but got %v", maxFormatDecimals, formatNum(decimals))
+	}
+	d := int(math.Round(float64(decimals)))
+	if d > 0 && decimalSep == "" {
+		return "", errors.New("decimalSep must not be empty when formatting with decimals")
+	}
+
+	digits := strconv.FormatFloat(math.Abs(f), 'f', -1, 64)
+	intPart, frac := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		intPart, frac = digits[:i], digits[i+1:]
+	}
+
+	if len(frac) > d {
+		roundUp := frac[d] >= '5'
+		frac = frac[:d]
+		if roundUp {
+			rounded := incrementDigits(intPart + frac)
+			intPart, frac = rounded[:len(rounded)-d], rounded[len(rounded)-d:]
+		}
+	} else {
+		frac += strings.Repeat("0", d-len(frac))
+	}
+
+	var sb strings.Builder
+	if f < 0 && strings.Trim(intPart+frac, "0") != "" {
+		sb.WriteByte('-')
+	}
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			sb.WriteString(string(thousandsSep))
+		}
+		sb.WriteRune(c)
+	}
+	if d > 0 {
+		sb.WriteString(string(decimalSep))
+		sb.WriteString(frac)
+	}
+	return jsonutil.JSONStr(sb.String()), nil
+}
+
+// incrementDigits adds one to the given string of decimal digits, e.g. "0999" becomes "1000" and
+// "99" becomes "100".
+func incrementDigits(digits string) string {
+	b := []byte(digits)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < '9' {
+			b[i]++
+			return string(b)
+		}
+		b[i] = '0'
+	}
+	return "1" + string(b)
+}
+
+// radixDigits are the digits of the bases ToRadix and FromRadix support, in order of their values.
+const radixDigits = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// radix returns the given base as an int, or an error if it is not an integer between 2 and 36.
+func radix(base jsonutil.JSONNum) (int, error) {
+	if !isInteger(base) || base < 2 || base > jsonutil.JSONNum(len(radixDigits)) {
+		return 0, fmt.Errorf("base must be an integer between 2 and %d but got %v", len(radixDigits), formatNum(base))
+	}
+	return int(math.Round(float64(base))), nil
+}
+
+// ToRadix renders the given non-negative integer in the given base (2 to 36), with the letters a to
+// z as the digits from 10 on, e.g. 255 is "ff" in base 16. It returns an error if the number is not
+// an integer, is negative or is larger than the largest safe integer (see ToFixedInt).
+func ToRadix(n jsonutil.JSONNum, base jsonutil.JSONNum) (jsonutil.JSONStr, error) {
+	b, err := radix(base)
+	if err != nil {
+		return "", err
+	}
+	if !isInteger(n) {
+		return "", fmt.Errorf("%v is not an integer", formatNum(n))
+	}
+	i := math.Round(float64(n))
+	if i < 0 {
+		return "", fmt.Errorf("%v is negative", formatNum(n))
+	}
+	if i > maxSafeInteger {
+		return "", fmt.Errorf("%v is larger than the largest safe integer %d", formatNum(n), int64(maxSafeInteger))
+	}
+	return jsonutil.JSONStr(strconv.FormatInt(int64(i), b)), nil
+}
+
+// FromRadix parses the given string of digits in the given base (2 to 36) as a non-negative
+// integer, with the letters a to z (in either case) as the digits from 10 on, e.g. "FF" in base 16
+// is 255. It returns an error naming the first character that is not a digit of the base, or if the
+// number is larger than the largest safe integer (see ToFixedInt).
+func FromRadix(str jsonutil.JSONStr, base jsonutil.JSONNum) (jsonutil.JSONNum, error) {
+	b, err := radix(base)
+	if err != nil {
+		return 0, err
+	}
+	if str == "" {
+		return 0, fmt.Errorf("could not parse an empty string in base %d", b)
+	}
+	var n int64
+	for i, r := range []rune(string(str)) {
+		d := strings.IndexRune(radixDigits[:b], unicode.ToLower(r))
+		if d < 0 {
+			return 0, fmt.Errorf("could not parse %q in base %d: invalid character %q at position %d", truncateForError(string(str)), b, r, i)
+		}
+		n = n*int64(b) + int64(d)
+		if n > maxSafeInteger {
+			return 0, fmt.Errorf("could not parse %q in base %d: larger than the largest safe integer %d", truncateForError(string(str)), b, int64(maxSafeInteger))
+		}
+	}
+	return jsonutil.JSONNum(n), nil
+}
+
+// ToBase36 renders the given non-negative integer in base 36, e.g. 1295 is "zz" (see ToRadix).
+func ToBase36(n jsonutil.JSONNum) (jsonutil.JSONStr, error) {
+	return ToRadix(n, 36)
+}
+
+// FromBase36 parses the given base 36 string (in either case) as a non-negative integer, e.g. "ZZ"
+// is 1295 (see FromRadix).
+func FromBase36(str jsonutil.JSONStr) (jsonutil.JSONNum, error) {
+	return FromRadix(str, 36)
+}
+
 // Unique returns the unique elements in the array by comparing their hashes.
 func Unique(array jsonutil.JSONArr) (jsonutil.JSONArr, error) {
 	arr := make(jsonutil.JSONArr, 0)
@@ -211,6 +473,21 @@ func Unique(array jsonutil.JSONArr) (jsonutil.JSONArr, error) {
 	return arr, nil
 }
 
+// CompactList removes all nil elements from the given array. Other empty values (like empty
+// strings, objects or arrays) are kept, and nested arrays are not compacted.
+func CompactList(arr jsonutil.JSONArr) (jsonutil.JSONArr, error) {
+	// This needs to always return an empty array, not a nil value.
+	res := make(jsonutil.JSONArr, 0, len(arr))
+
+	for _, item := range arr {
+		if item != nil {
+			res = append(res, item)
+		}
+	}
+
+	return res, nil
+}
+
 // Flatten turns a nested array of arrays (of any depth) into a single array.
 // Item ordering is preserved, depth first.
 func Flatten(array jsonutil.JSONArr) (jsonutil.JSONArr, error) {
@@ -261,6 +538,86 @@ func ListOf(args ...jsonutil.JSONToken) (jsonutil.JSONArr, error) {
 	return jsonutil.JSONArr(args), nil
 }
 
+// maxRepeatCount is the largest number of elements $Repeat and $PadList create, to catch runaway
+// lengths before they exhaust memory.
+const maxRepeatCount = 1000000
+
+// repeatCount validates the given number of elements for Repeat and PadList.
+func repeatCount(n jsonutil.JSONNum) (int, error) {
+	if n < 0 || n != jsonutil.JSONNum(math.Trunc(float64(n))) {
+		return 0, fmt.Errorf("n must be a non-negative integer but got %v", n)
+	}
+	if n > maxRepeatCount {
+		return 0, fmt.Errorf("n must be at most %d but got %v", maxRepeatCount, n)
+	}
+	return int(n), nil
+}
+
+// PadList appends copies of filler to the given array until it has n elements. Arrays that already
+// have n or more elements are returned as is (they are not truncated).
+func PadList(arr jsonutil.JSONArr, n jsonutil.JSONNum, filler jsonutil.JSONToken) (jsonutil.JSONArr, error) {
+	count, err := repeatCount(n)
+	if err != nil {
+		return nil, err
+	}
+
+	// This needs to always return an empty array, not a nil value.
+	res := make(jsonutil.JSONArr, 0, len(arr))
+	res = append(res, arr...)
+	for len(res) < count {
+		res = append(res, jsonutil.Deepcopy(filler))
+	}
+	return res, nil
+}
+
+// Repeat creates an array of n copies of the given item. Each element is a separate copy, so
+// modifying one of them does not affect the others.
+func Repeat(item jsonutil.JSONToken, n jsonutil.JSONNum) (jsonutil.JSONArr, error) {
+	count, err := repeatCount(n)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(jsonutil.JSONArr, 0, count)
+	for i := 0; i < count; i++ {
+		res = append(res, jsonutil.Deepcopy(item))
+	}
+	return res, nil
+}
+
+// Sample returns an element of the given array, chosen pseudo-randomly based on the given seed. The
+// same seed and array always yield the same element. Returns null if the array is empty. This is
+// not cryptographically secure, and is not to be used for de-identification.
+func Sample(arr jsonutil.JSONArr, seed jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+	if len(arr) == 0 {
+		return nil, nil
+	}
+	return arr[seededRand(seed).Intn(len(arr))], nil
+}
+
+// Shuffle returns a pseudo-random permutation of the given array based on the given seed. The same
+// seed and array always yield the same permutation. This is not cryptographically secure, and is
+// not to be used for de-identification.
+func Shuffle(arr jsonutil.JSONArr, seed jsonutil.JSONStr) (jsonutil.JSONArr, error) {
+	res := make(jsonutil.JSONArr, len(arr))
+	copy(res, arr)
+
+	// Fisher-Yates, rather than rand.Shuffle, so the permutation only depends on the source.
+	r := seededRand(seed)
+	for i := len(res) - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		res[i], res[j] = res[j], res[i]
+	}
+	return res, nil
+}
+
+// seededRand returns a PRNG seeded from the given string.
+func seededRand(seed jsonutil.JSONStr) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
 // SortAndTakeTop sorts the elements in the array by the key in the specified direction and returns the top element.
 func SortAndTakeTop(arr jsonutil.JSONArr, key jsonutil.JSONStr, desc jsonutil.JSONBool) (jsonutil.JSONToken, error) {
 	if len(arr) == 0 {
@@ -289,6 +646,140 @@ func SortAndTakeTop(arr jsonutil.JSONArr, key jsonutil.JSONStr, desc jsonutil.JS
 	return tm[keys[0]], nil
 }
 
+// MaxBy returns the element of the array with the greatest value of the given key, or null if the
+// array is empty or no element has the key. Unlike SortAndTakeTop, it scans the array once and
+// compares numbers numerically and strings lexically, unless both are RFC3339 timestamps, which
+// are compared chronologically. Elements without the key (or with a null value for it) are
+// skipped, and of elements with equal values the first one is returned.
+func MaxBy(arr jsonutil.JSONArr, key jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+	return selectBy(arr, key, func(c int) bool { return c > 0 })
+}
+
+// MinBy returns the element of the array with the least value of the given key, like MaxBy.
+func MinBy(arr jsonutil.JSONArr, key jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+	return selectBy(arr, key, func(c int) bool { return c < 0 })
+}
+
+// byKey is the value of the key of an element being compared by selectBy.
+type byKey struct {
+	val    jsonutil.JSONToken
+	time   time.Time
+	isTime bool
+}
+
+// selectBy returns the first element of the array whose key value is better than those of all the
+// elements before it, where better is given the comparison of the new and best key values.
+func selectBy(arr jsonutil.JSONArr, key jsonutil.JSONStr, better func(c int) bool) (jsonutil.JSONToken, error) {
+	var best jsonutil.JSONToken
+	var bestKey byKey
+	found := false
+	for i, item := range arr {
+		v, err := jsonutil.GetField(item, string(key))
+		if err != nil {
+			return nil, fmt.Errorf("error reading key %q of element %d: %v", key, i, err)
+		}
+		if v == nil {
+			continue
+		}
+
+		k := byKey{val: v}
+		switch kv := v.(type) {
+		case jsonutil.JSONNum:
+		case jsonutil.JSONStr:
+			if t, err := time.Parse(time.RFC3339Nano, string(kv)); err == nil {
+				k.time, k.isTime = t, true
+			}
+		default:
+			return nil, fmt.Errorf("key %q of element %d is %T, but only numbers and strings can be compared", key, i, v)
+		}
+
+		if found {
+			c, err := compareByKeys(k, bestKey)
+			if err != nil {
+				return nil, fmt.Errorf("error comparing key %q of element %d: %v", key, i, err)
+			}
+			if !better(c) {
+				continue
+			}
+		}
+		best, bestKey, found = item, k, true
+	}
+	return best, nil
+}
+
+// compareByKeys returns -1, 0 or 1 if a is less than, equal to or greater than b respectively.
+func compareByKeys(a, b byKey) (int, error) {
+	switch av := a.val.(type) {
+	case jsonutil.JSONNum:
+		bv, ok := b.val.(jsonutil.JSONNum)
+		if !ok {
+			return 0, fmt.Errorf("can not compare a number to %T", b.val)
+		}
+		if av < bv {
+			return -1, nil
+		} else if av > bv {
+			return 1, nil
+		}
+		return 0, nil
+	case jsonutil.JSONStr:
+		bv, ok := b.val.(jsonutil.JSONStr)
+		if !ok {
+			return 0, fmt.Errorf("can not compare a string to %T", b.val)
+		}
+		if a.isTime && b.isTime {
+			if a.time.Before(b.time) {
+				return -1, nil
+			} else if a.time.After(b.time) {
+				return 1, nil
+			}
+			return 0, nil
+		}
+		return strings.Compare(string(av), string(bv)), nil
+	}
+	return 0, fmt.Errorf("can not compare %T", a.val)
+}
+
+// Transpose turns the given array of rows (arrays) into an array of columns, i.e. the i-th element
+// of the j-th row becomes the j-th element of the i-th column. A null row is an empty row. All rows
+// must have the same length, unless allowRagged is true, in which case shorter rows are padded with
+// nulls to the length of the longest row. The elements are copied, so modifying the result does not
+// affect the input.
+func Transpose(arr jsonutil.JSONArr, allowRagged ...jsonutil.JSONBool) (jsonutil.JSONArr, error) {
+	if len(allowRagged) > 1 {
+		return nil, fmt.Errorf("expected at most 1 allowRagged argument, got %d", len(allowRagged))
+	}
+	ragged := len(allowRagged) == 1 && bool(allowRagged[0])
+
+	rows := make([]jsonutil.JSONArr, 0, len(arr))
+	width := 0
+	for i, item := range arr {
+		row, ok := item.(jsonutil.JSONArr)
+		if !ok && item != nil {
+			return nil, fmt.Errorf("row %d is not an array but %T", i, item)
+		}
+		if i > 0 && len(row) != width && !ragged {
+			return nil, fmt.Errorf("row %d has %d elements but row 0 has %d (set allowRagged to pad shorter rows with nulls)", i, len(row), width)
+		}
+		if len(row) > width {
+			width = len(row)
+		}
+		rows = append(rows, row)
+	}
+
+	// This needs to always return an empty array, not a nil value.
+	res := make(jsonutil.JSONArr, 0, width)
+	for j := 0; j < width; j++ {
+		col := make(jsonutil.JSONArr, len(rows))
+		for i, row := range rows {
+			if j < len(row) {
+				col[i] = jsonutil.Deepcopy(row[j])
+			}
+		}
+		res = append(res, col)
+	}
+	return res, nil
+}
+
 // UnionBy unions the items in the given array by the given keys, such that each item
 // in the resulting array has a unique combination of those keys. The first unique element
 // is picked when deduplicating. The items in the resulting array are ordered
@@ -299,11 +790,16 @@ func SortAndTakeTop(arr jsonutil.JSONArr, key jsonutil.JSONStr, desc jsonutil.JS
 // Arguments: items: `[{"id": 1}, {"id": 2}, {"id": 1, "foo": "hello"}]`, keys: "id"
 // Return: [{"id": 1}, {"id": 2}]
 func UnionBy(items jsonutil.JSONArr, keys ...jsonutil.JSONStr) (jsonutil.JSONArr, error) {
-	set := make(map[jsonutil.JSONStr]jsonutil.JSONToken)
-	var orderedKeys []jsonutil.JSONStr
-
+	// Each item is keyed by the concatenation of the raw hashes of its key values. The map is keyed
+	// by a fixed size digest of that concatenation, and the concatenation itself is kept (once per
+	// unique key) to order the output.
+	set := make(map[hashKey]jsonutil.JSONToken)
+	composites := make(map[hashKey][]byte)
+	var orderedKeys []hashKey
+
+	composite := make([]byte, 0, hashKeySize*len(keys))
 	for _, i := range items {
-		var key jsonutil.JSONStr
+		composite = composite[:0]
 
 		for _, k := range keys {
 			v, err := jsonutil.GetField(i, string(k))
@@ -311,22 +807,24 @@ func UnionBy(items jsonutil.JSONArr, keys ...jsonutil.JSONStr) (jsonutil.JSONArr
 				return nil, err
 			}
 
-			h, err := Hash(v)
+			h, err := jsonutil.Hash(v, false)
 			if err != nil {
 				return nil, err
 			}
 
-			key += h
+			composite = append(composite, h...)
 		}
 
+		key := newHashKey(composite)
 		if _, ok := set[key]; !ok {
 			orderedKeys = append(orderedKeys, key)
 			set[key] = i
+			composites[key] = append([]byte(nil), composite...)
 		}
 	}
 
 	sort.Slice(orderedKeys, func(i int, j int) bool {
-		return orderedKeys[i] < orderedKeys[j]
+		return bytes.Compare(composites[orderedKeys[i]], composites[orderedKeys[j]]) < 0
 	})
 
 	var arr jsonutil.JSONArr
@@ -389,10 +887,22 @@ func UnnestArrays(c jsonutil.JSONContainer) (jsonutil.JSONArr, error) {
 // time is returned. A default layout of '2006-01-02 03:04:05'and a default
 // time zone of 'UTC' will be used if not provided.
 func CurrentTime(format jsonutil.JSONStr, tz jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	return currentTime(time.Now, format, tz)
+}
+
+// NewCurrentTime returns the $CurrentTime builtin reading the time from the given clock instead of
+// time.Now, e.g. a fixed time for reproducible outputs.
+func NewCurrentTime(now func() time.Time) func(format jsonutil.JSONStr, tz jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	return func(format jsonutil.JSONStr, tz jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+		return currentTime(now, format, tz)
+	}
+}
+
+func currentTime(now func() time.Time, format jsonutil.JSONStr, tz jsonutil.JSONStr) (jsonutil.JSONStr, error) {
 	if len(format) == 0 {
 		format = defaultTimeFormat
 	}
-	tm := time.Now().UTC()
+	tm := now().UTC()
 	loc, err := time.LoadLocation(string(tz))
 	if err != nil {
 		return jsonutil.JSONStr(""), err
@@ -548,6 +1058,95 @@ func SplitTime(format jsonutil.JSONStr, date jsonutil.JSONStr) (jsonutil.JSONArr
 	return jsonutil.JSONArr(c), nil
 }
 
+// ISOWeek returns the ISO 8601 week of the given date, parsed with the given Go
+// (https://golang.org/pkg/time/#Time.Format) or Python time format, as an object with the fields
+// isoYear and isoWeek (1 to 53). The ISO year differs from the calendar year for the days around
+// New Year that belong to a week of the other year, e.g. 2019-12-30 is in week 1 of 2020 and
+// 2021-01-03 in week 53 of 2020. An empty date returns an empty object.
+func ISOWeek(date, format jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	d, err := parseTime(format, date)
+	if err != nil {
+		return nil, err
+	}
+	if d.IsZero() {
+		return jsonutil.JSONContainer{}, nil
+	}
+	year, week := d.ISOWeek()
+	y, w := jsonutil.JSONToken(jsonutil.JSONNum(year)), jsonutil.JSONToken(jsonutil.JSONNum(week))
+	return jsonutil.JSONContainer{"isoYear": &y, "isoWeek": &w}, nil
+}
+
+// FormatISOWeekDate returns the ISO 8601 week of the given date, parsed with the given Go or Python
+// time format, in the form "2020-W05" (see ISOWeek). An empty date returns an empty string.
+func FormatISOWeekDate(date, format jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	d, err := parseTime(format, date)
+	if err != nil {
+		return jsonutil.JSONStr(""), err
+	}
+	if d.IsZero() {
+		return jsonutil.JSONStr(""), nil
+	}
+	year, week := d.ISOWeek()
+	return jsonutil.JSONStr(fmt.Sprintf("%04d-W%02d", year, week)), nil
+}
+
+// shiftDateFloor is the earliest date ShiftDate shifts dates on or after it to.
+var shiftDateFloor = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// NewShiftDate returns the $ShiftDate builtin, keyed with the given secret. It is not part of
+// BuiltinFunctions since the secret must come from the engine configuration (never the mapping).
+//
+// $ShiftDate(date, format, key, maxDays) parses the date with the given Go or Python time format,
+// shifts it by a whole number of days in [-maxDays, maxDays] derived from an HMAC-SHA256 of the key
+// (e.g. a patient identifier) and the secret, and formats it in the same format. The same key
+// always gets the same shift, so dates of a patient keep their intervals. Shifted dates are clamped
+// so that a date on or after 1900-01-01 is never shifted before it, and a date that is not in the
+// future is never shifted into it. An empty date returns an empty string.
+func NewShiftDate(secret []byte) func(date, format, key jsonutil.JSONStr, maxDays jsonutil.JSONNum) (jsonutil.JSONStr, error) {
+	return NewShiftDateWithClock(secret, time.Now)
+}
+
+// NewShiftDateWithClock returns the $ShiftDate builtin like NewShiftDate, reading the time dates are
+// not shifted past from the given clock instead of time.Now.
+func NewShiftDateWithClock(secret []byte, now func() time.Time) func(date, format, key jsonutil.JSONStr, maxDays jsonutil.JSONNum) (jsonutil.JSONStr, error) {
+	return func(date, format, key jsonutil.JSONStr, maxDays jsonutil.JSONNum) (jsonutil.JSONStr, error) {
+		if len(secret) == 0 {
+			return jsonutil.JSONStr(""), errors.New("no date shifting secret is configured in the engine")
+		}
+		if maxDays < 0 || maxDays != jsonutil.JSONNum(math.Trunc(float64(maxDays))) {
+			return jsonutil.JSONStr(""), fmt.Errorf("maxDays must be a non-negative integer but got %v", maxDays)
+		}
+		if key == "" {
+			return jsonutil.JSONStr(""), errors.New("key must not be empty")
+		}
+
+		format = convertTimeFormatToGo(format)
+		d, err := parseTime(format, date)
+		if err != nil {
+			return jsonutil.JSONStr(""), err
+		}
+		if d.IsZero() {
+			return jsonutil.JSONStr(""), nil
+		}
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(key))
+		sum := binary.BigEndian.Uint64(mac.Sum(nil))
+		days := int64(sum%uint64(2*int64(maxDays)+1)) - int64(maxDays)
+
+		shifted := d.AddDate(0, 0, int(days))
+		floor := shiftDateFloor.In(d.Location())
+		if !d.Before(floor) && shifted.Before(floor) {
+			shifted = floor
+		}
+		if n := now().In(d.Location()); !d.After(n) && shifted.After(n) {
+			shifted = n
+		}
+
+		return jsonutil.JSONStr(shifted.Format(string(format))), nil
+	}
+}
+
 // Hash converts the given item into a hash. Key order is not considered (array item order is).
 // This is not cryptographically secure, and is not to be used for secure hashing.
 func Hash(obj jsonutil.JSONToken) (jsonutil.JSONStr, error) {
@@ -572,6 +1171,28 @@ func IntHash(obj jsonutil.JSONToken) (jsonutil.JSONNum, error) {
 	return jsonutil.JSONNum(h32.Sum32()), nil
 }
 
+// hashKeySize is the size in bytes of the hashes produced by jsonutil.Hash.
+const hashKeySize = 16
+
+// hashKey is a fixed size, comparable digest of one or more jsonutil.Hash values, used to key maps
+// without converting the hashes to strings.
+type hashKey [hashKeySize]byte
+
+// newHashKey returns the given hash as a hashKey. Hashes of exactly hashKeySize bytes are used as
+// is, anything else (e.g. several concatenated hashes) is digested down to hashKeySize bytes.
+func newHashKey(h []byte) hashKey {
+	var k hashKey
+	if len(h) == hashKeySize {
+		copy(k[:], h)
+		return k
+	}
+
+	d := fnv.New128a()
+	d.Write(h)
+	d.Sum(k[:0])
+	return k
+}
+
 // IsNil returns true iff the given object is nil or empty.
 func IsNil(object jsonutil.JSONToken) (jsonutil.JSONBool, error) {
 	switch t := object.(type) {
@@ -588,6 +1209,45 @@ func IsNil(object jsonutil.JSONToken) (jsonutil.JSONBool, error) {
 	return false, nil
 }
 
+// IsEmpty returns true iff the given object is deeply empty, i.e. nil, a string that is empty or
+// only whitespace, or an array or container whose items or values are all deeply empty. Unlike
+// IsNil, this means that objects like {"family": null} or [" "] are empty. Numbers and booleans
+// (including 0 and false) are never empty.
+func IsEmpty(object jsonutil.JSONToken) (jsonutil.JSONBool, error) {
+	return jsonutil.JSONBool(isEmpty(object)), nil
+}
+
+func isEmpty(object jsonutil.JSONToken) bool {
+	switch t := object.(type) {
+	case nil:
+		return true
+	case jsonutil.JSONStr:
+		return strings.TrimSpace(string(t)) == ""
+	case jsonutil.JSONArr:
+		for _, i := range t {
+			if !isEmpty(i) {
+				return false
+			}
+		}
+		return true
+	case jsonutil.JSONContainer:
+		for _, v := range t {
+			if v != nil && !isEmpty(*v) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// IsNotEmpty returns true iff the given object is not deeply empty (see IsEmpty).
+func IsNotEmpty(object jsonutil.JSONToken) (jsonutil.JSONBool, error) {
+	isEmpty, err := IsEmpty(object)
+	return !isEmpty, err
+}
+
 // IsNotNil returns true iff the given object is not nil or empty.
 func IsNotNil(object jsonutil.JSONToken) (jsonutil.JSONBool, error) {
 	isNil, err := IsNil(object)
@@ -612,11 +1272,286 @@ func MergeJSON(arr jsonutil.JSONArr, overwriteArrays jsonutil.JSONBool) (jsonuti
 	return out, nil
 }
 
+// defaultDuplicateKeys are the key paths MergeDuplicates groups resources by if none are given.
+var defaultDuplicateKeys = []string{"resourceType", "identifier"}
+
+// MergeDuplicates merges the resources in the given array that have the same values at all the
+// given key paths (resourceType and identifier if none are given) into one resource each. The
+// merged resources are in the order in which each group first appears. Resources that are missing
+// (or have an empty value at) any of the key paths are kept as they are, without being merged.
+// Objects are merged field by field, arrays are unioned (keeping their first occurrence of equal
+// elements, like Unique) and conflicting primitives are overwritten by the last resource in the
+// array that has them. Arrays are compared without regard to their order when grouping, so that
+// e.g. identifiers can be listed in any order.
+func MergeDuplicates(resources jsonutil.JSONArr, keyPaths jsonutil.JSONArr) (jsonutil.JSONArr, error) {
+	paths := defaultDuplicateKeys
+	if len(keyPaths) > 0 {
+		paths = make([]string, 0, len(keyPaths))
+		for i, kp := range keyPaths {
+			str, ok := kp.(jsonutil.JSONStr)
+			if !ok {
+				return nil, fmt.Errorf("key path at index %d must be a string but was %T", i, kp)
+			}
+			paths = append(paths, string(str))
+		}
+	}
+
+	out := make(jsonutil.JSONArr, 0, len(resources))
+	// groups holds the index in out and in resources of the first resource of each group.
+	type group struct{ out, first int }
+	groups := make(map[hashKey]group)
+	composite := make([]byte, 0, hashKeySize*len(paths))
+	for i, r := range resources {
+		composite = composite[:0]
+		keyed := true
+		for _, p := range paths {
+			v, err := jsonutil.GetField(r, p)
+			if err != nil {
+				return nil, fmt.Errorf("could not get key %q of resource at index %d: %v", p, i, err)
+			}
+			if isEmpty(v) {
+				keyed = false
+				break
+			}
+			h, err := jsonutil.Hash(v, true)
+			if err != nil {
+				return nil, err
+			}
+			composite = append(composite, h...)
+		}
+		if !keyed {
+			out = append(out, r)
+			continue
+		}
+
+		key := newHashKey(composite)
+		g, ok := groups[key]
+		if !ok {
+			groups[key] = group{out: len(out), first: i}
+			out = append(out, jsonutil.Deepcopy(r))
+			continue
+		}
+		merged, err := mergeDuplicate(out[g.out], r, "")
+		if err != nil {
+			return nil, fmt.Errorf("could not merge resource at index %d into its duplicate at index %d: %v", i, g.first, err)
+		}
+		out[g.out] = merged
+	}
+	return out, nil
+}
+
+// mergeDuplicate merges src into dest (which it may modify) for MergeDuplicates, and returns the
+// result. The path of dest within the resource is used in errors.
+func mergeDuplicate(dest, src jsonutil.JSONToken, path string) (jsonutil.JSONToken, error) {
+	if src == nil {
+		return dest, nil
+	}
+	if dest == nil {
+		return jsonutil.Deepcopy(src), nil
+	}
+
+	switch d := dest.(type) {
+	case jsonutil.JSONContainer:
+		s, ok := src.(jsonutil.JSONContainer)
+		if !ok {
+			return nil, fmt.Errorf("can not merge %T into %T at %q", src, dest, path)
+		}
+		for k, v := range s {
+			var cur jsonutil.JSONToken
+			if d[k] != nil {
+				cur = *d[k]
+			}
+			merged, err := mergeDuplicate(cur, *v, strings.TrimPrefix(path+"."+k, "."))
+			if err != nil {
+				return nil, err
+			}
+			d[k] = &merged
+		}
+		return d, nil
+	case jsonutil.JSONArr:
+		s, ok := src.(jsonutil.JSONArr)
+		if !ok {
+			return nil, fmt.Errorf("can not merge %T into %T at %q", src, dest, path)
+		}
+		return Unique(append(d, jsonutil.Deepcopy(s).(jsonutil.JSONArr)...))
+	default:
+		switch src.(type) {
+		case jsonutil.JSONContainer, jsonutil.JSONArr:
+			return nil, fmt.Errorf("can not merge %T into %T at %q", src, dest, path)
+		}
+		return src, nil
+	}
+}
+
+// ObjOf builds an object from the given alternating keys and values, e.g.
+// $ObjOf("system", sys, "code", code). Pairs whose value is nil or an empty string are left out, so
+// that optional fields do not need a condition each. Keys must be strings, and may only be given
+// once.
+func ObjOf(pairs ...jsonutil.JSONToken) (jsonutil.JSONContainer, error) {
+	if len(pairs)%2 != 0 {
+		return nil, fmt.Errorf("keys and values must be given in pairs but got %d arguments, the last key (argument %d) has no value", len(pairs), len(pairs))
+	}
+
+	out := make(jsonutil.JSONContainer, len(pairs)/2)
+	seen := make(map[string]bool, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, ok := pairs[i].(jsonutil.JSONStr)
+		if !ok {
+			return nil, fmt.Errorf("key at argument %d must be a string but got %v", i+1, pairs[i])
+		}
+		if seen[string(key)] {
+			return nil, fmt.Errorf("key %q at argument %d is given more than once", key, i+1)
+		}
+		seen[string(key)] = true
+
+		v := pairs[i+1]
+		if s, ok := v.(jsonutil.JSONStr); v == nil || ok && s == "" {
+			continue
+		}
+		out[string(key)] = &v
+	}
+	return out, nil
+}
+
+// ParseYAML parses the given YAML string (e.g. a field holding an embedded configuration) into
+// JSON. See jsonutil.UnmarshalYAML for how YAML values are converted. An empty string parses to nil.
+func ParseYAML(str jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+	return jsonutil.UnmarshalYAML([]byte(str))
+}
+
+// RedactionMarker is the value that RedactExcept writes in place of every leaf it does not keep.
+const RedactionMarker = "[REDACTED]"
+
+// RedactExcept returns a copy of the given resource in which every primitive leaf (strings,
+// numbers and booleans alike) is replaced with RedactionMarker, unless its path is covered by one
+// of the given keep paths. Keep paths are dotted paths like "name[0].family", and may use [*] to
+// match any array index, e.g. "name[*].family". Keeping a container keeps everything within it.
+// The structure of the resource (fields, array lengths and nulls) is left intact. Keep paths that
+// do not match anything in the resource are logged as warnings rather than failing.
+func RedactExcept(resource jsonutil.JSONContainer, keepPaths jsonutil.JSONArr) (jsonutil.JSONContainer, error) {
+	keep := make([][]string, 0, len(keepPaths))
+	for i, kp := range keepPaths {
+		str, ok := kp.(jsonutil.JSONStr)
+		if !ok {
+			return nil, fmt.Errorf("keep path at index %d must be a string but was %T", i, kp)
+		}
+		segs, err := jsonutil.SegmentPath(string(str))
+		if err != nil {
+			return nil, fmt.Errorf("invalid keep path %q: %v", str, err)
+		}
+		keep = append(keep, segs)
+	}
+
+	used := make([]bool, len(keep))
+	out := redact(resource, nil, keep, used)
+
+	for i, u := range used {
+		if !u {
+			log.Printf("Warning: $RedactExcept keep path %q did not match anything", keepPaths[i])
+		}
+	}
+
+	return out.(jsonutil.JSONContainer), nil
+}
+
+// redact copies the given token, replacing any leaves not covered by the keep paths. The path is
+// the segmented path of the token within the resource being redacted. Any keep path that matches
+// the token (or one of its ancestors) is marked in used.
+func redact(tok jsonutil.JSONToken, path []string, keep [][]string, used []bool) jsonutil.JSONToken {
+	kept := false
+	for i, k := range keep {
+		if keepPathCovers(k, path) {
+			used[i] = true
+			kept = true
+		}
+	}
+
+	switch t := tok.(type) {
+	case jsonutil.JSONContainer:
+		out := make(jsonutil.JSONContainer, len(t))
+		for f, v := range t {
+			r := redact(*v, append(path[:len(path):len(path)], f), keep, used)
+			out[f] = &r
+		}
+		return out
+	case jsonutil.JSONArr:
+		out := make(jsonutil.JSONArr, len(t))
+		for i, v := range t {
+			out[i] = redact(v, append(path[:len(path):len(path)], fmt.Sprintf("[%d]", i)), keep, used)
+		}
+		return out
+	case nil:
+		return nil
+	}
+
+	if kept {
+		return jsonutil.Deepcopy(tok)
+	}
+	return jsonutil.JSONStr(RedactionMarker)
+}
+
+// keepPathCovers returns true iff the keep path is the given path or one of its ancestors.
+func keepPathCovers(keep, path []string) bool {
+	if len(keep) > len(path) {
+		return false
+	}
+	for i, k := range keep {
+		if k != path[i] && !(k == "[*]" && jsonutil.IsIndex(path[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// JoinPath joins the given path segments into a path, the same way the engine does (see
+// jsonutil.JoinPath). Empty segments are skipped, leading and trailing dots and spaces are trimmed
+// from each segment, and array index segments like [2] are appended without a dot. The joined path
+// must be valid, i.e. accepted by jsonutil.SegmentPath.
+func JoinPath(segments ...jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	segs := make([]string, len(segments))
+	for i, s := range segments {
+		segs[i] = string(s)
+	}
+	path := jsonutil.JoinPath(segs...)
+	if _, err := jsonutil.SegmentPath(path); err != nil {
+		return jsonutil.JSONStr(""), fmt.Errorf("invalid path %q: %v", path, err)
+	}
+	return jsonutil.JSONStr(path), nil
+}
+
+// SplitPath splits the given path into its segments, the same way the engine does (see
+// jsonutil.SegmentPath). Array indices are separate segments, boxed in brackets like "[2]" or
+// "[*]", so that a numeric field key like the 3 in foo.3 is kept apart from an index like foo[3].
+// Escaped dots (\.) are unescaped. Joining the segments with JoinPath gives back an equivalent
+// path.
+func SplitPath(path jsonutil.JSONStr) (jsonutil.JSONArr, error) {
+	segs, err := jsonutil.SegmentPath(string(path))
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %v", path, err)
+	}
+	arr := make(jsonutil.JSONArr, 0, len(segs))
+	for _, s := range segs {
+		arr = append(arr, jsonutil.JSONStr(s))
+	}
+	return arr, nil
+}
+
 // UUID generates a RFC4122 (https://tools.ietf.org/html/rfc4122) UUID.
 func UUID() (jsonutil.JSONStr, error) {
 	return jsonutil.JSONStr(uuid.New().String()), nil
 }
 
+// RandomUUID generates a RFC4122 version 4 UUID from the bytes read from the given source of
+// randomness, e.g. a seeded one for reproducible outputs. It is not part of BuiltinFunctions since
+// the source must come from the engine (see $UUID).
+func RandomUUID(random io.Reader) (jsonutil.JSONStr, error) {
+	id, err := uuid.NewRandomFromReader(random)
+	if err != nil {
+		return jsonutil.JSONStr(""), fmt.Errorf("could not generate UUID: %v", err)
+	}
+	return jsonutil.JSONStr(id.String()), nil
+}
+
 // Type returns the type of the given JSON Token as a string.
 func Type(object jsonutil.JSONToken) (jsonutil.JSONStr, error) {
 
@@ -665,6 +1600,13 @@ func And(args ...jsonutil.JSONToken) (jsonutil.JSONBool, error) {
 	return true, nil
 }
 
+// AtMostOne returns true iff at most one of the given arguments is true, e.g. for fields that are
+// optional but exclusive. Like with And and Or, null and empty arguments are false, and other
+// non-boolean ones are true.
+func AtMostOne(args ...jsonutil.JSONToken) (jsonutil.JSONBool, error) {
+	return countTrue(args) <= 1, nil
+}
+
 // Eq returns true iff all given arguments are equal.
 func Eq(args ...jsonutil.JSONToken) (jsonutil.JSONBool, error) {
 	if len(args) < 2 {
@@ -680,6 +1622,13 @@ func Eq(args ...jsonutil.JSONToken) (jsonutil.JSONBool, error) {
 	return true, nil
 }
 
+// ExactlyOne returns true iff exactly one of the given arguments is true, e.g. for the alternatives
+// of a FHIR choice type like deceased[x]. Like with And and Or, null and empty arguments are false,
+// and other non-boolean ones are true.
+func ExactlyOne(args ...jsonutil.JSONToken) (jsonutil.JSONBool, error) {
+	return countTrue(args) == 1, nil
+}
+
 // Gt returns true iff the first argument is greater than the second.
 func Gt(left jsonutil.JSONNum, right jsonutil.JSONNum) (jsonutil.JSONBool, error) {
 	return left > right, nil
@@ -690,6 +1639,16 @@ func GtEq(left jsonutil.JSONNum, right jsonutil.JSONNum) (jsonutil.JSONBool, err
 	return left >= right, nil
 }
 
+// If returns thenVal if cond is true, and elseVal otherwise. A nil cond is false. Note that, like
+// the arguments of any function, both values are evaluated before If is called, regardless of
+// cond, so they must not have side effects or fail; use an if block for that.
+func If(cond jsonutil.JSONBool, thenVal, elseVal jsonutil.JSONToken) (jsonutil.JSONToken, error) {
+	if cond {
+		return thenVal, nil
+	}
+	return elseVal, nil
+}
+
 // Lt returns true iff the first argument is less than the second.
 func Lt(left jsonutil.JSONNum, right jsonutil.JSONNum) (jsonutil.JSONBool, error) {
 	return left < right, nil
@@ -706,16 +1665,37 @@ func NEq(args ...jsonutil.JSONToken) (jsonutil.JSONBool, error) {
 		return true, nil
 	}
 
-	hashSet := stringset.NewSize(len(args))
+	// Two primitives of the same type can be compared directly without hashing. Numbers are compared
+	// by their bits, which is what hashing them would do.
+	if len(args) == 2 {
+		switch l := args[0].(type) {
+		case jsonutil.JSONStr:
+			if r, ok := args[1].(jsonutil.JSONStr); ok {
+				return l != r, nil
+			}
+		case jsonutil.JSONBool:
+			if r, ok := args[1].(jsonutil.JSONBool); ok {
+				return l != r, nil
+			}
+		case jsonutil.JSONNum:
+			if r, ok := args[1].(jsonutil.JSONNum); ok {
+				return math.Float64bits(float64(l)) != math.Float64bits(float64(r)), nil
+			}
+		}
+	}
+
+	hashSet := make(map[hashKey]struct{}, len(args))
 	for _, a := range args {
-		h, err := Hash(a)
+		h, err := jsonutil.Hash(a, false)
 		if err != nil {
 			return false, err
 		}
 
-		if !hashSet.Add(string(h)) {
+		key := newHashKey(h)
+		if _, ok := hashSet[key]; ok {
 			return false, nil
 		}
+		hashSet[key] = struct{}{}
 	}
 
 	return true, nil
@@ -745,6 +1725,100 @@ func Or(args ...jsonutil.JSONToken) (jsonutil.JSONBool, error) {
 	return false, nil
 }
 
+// Xor is a logical exclusive OR of the two given arguments, i.e. returns true iff exactly one of
+// them is true (see ExactlyOne).
+func Xor(left, right jsonutil.JSONToken) (jsonutil.JSONBool, error) {
+	return ExactlyOne(left, right)
+}
+
+// countTrue returns the number of the given arguments that are true, with non-boolean arguments
+// being true iff they are not nil or empty, as in And and Or.
+func countTrue(args []jsonutil.JSONToken) int {
+	n := 0
+	for _, a := range args {
+		boolVal, ok := a.(jsonutil.JSONBool)
+		if !ok {
+			boolVal, _ = IsNotNil(a)
+		}
+		if boolVal {
+			n++
+		}
+	}
+	return n
+}
+
+// EscapeXML escapes the given string for use as XML (or XHTML) text or attribute values, e.g. in
+// the narrative of a FHIR resource: &, <, >, " and ' are replaced by their entities. Characters
+// that XML 1.0 does not allow at all, like most ASCII control characters (e.g. the vertical tab
+// and the file, group, record and unit separators 0x1C-0x1F, which are common in HL7v2 free text),
+// are dropped, as are invalid UTF-8 bytes. Tabs, newlines and carriage returns are kept.
+func EscapeXML(str jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	var b strings.Builder
+	b.Grow(len(str))
+	for s := string(str); s != ""; {
+		r, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		if r == utf8.RuneError && size == 1 {
+			continue
+		}
+		switch r {
+		case '&':
+			b.WriteString("&amp;")
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '"':
+			b.WriteString("&quot;")
+		case '\'':
+			b.WriteString("&apos;")
+		default:
+			if isXMLChar(r) {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return jsonutil.JSONStr(b.String()), nil
+}
+
+// isXMLChar returns true iff the given rune matches the Char production of XML 1.0, i.e. can appear
+// in an XML document.
+func isXMLChar(r rune) bool {
+	return r == '\t' || r == '\n' || r == '\r' ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+// MaskString replaces all but the last keepTail runes of the string with the mask character (or
+// "*" if maskChar is empty), e.g. for displaying identifiers. Only letters and digits are masked,
+// so separators stay in place: "123-45-6789" with keepTail 4 becomes "***-**-6789". If keepTail is
+// at least the length of the string, the string is returned unchanged.
+func MaskString(str jsonutil.JSONStr, keepTail jsonutil.JSONNum, maskChar jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	if keepTail < 0 || keepTail != jsonutil.JSONNum(math.Trunc(float64(keepTail))) {
+		return "", fmt.Errorf("keepTail must be a non-negative integer but got %v", keepTail)
+	}
+	mask := []rune(maskChar)
+	switch len(mask) {
+	case 0:
+		mask = []rune{'*'}
+	case 1:
+	default:
+		return "", fmt.Errorf("maskChar must be a single character but got %q", maskChar)
+	}
+
+	runes := []rune(str)
+	if float64(keepTail) >= float64(len(runes)) {
+		return str, nil
+	}
+	for i := range runes[:len(runes)-int(keepTail)] {
+		if unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) {
+			runes[i] = mask[0]
+		}
+	}
+	return jsonutil.JSONStr(runes), nil
+}
+
 // MatchesRegex returns true iff the string matches the regex pattern.
 func MatchesRegex(str jsonutil.JSONStr, regex jsonutil.JSONStr) (jsonutil.JSONBool, error) {
 	// TODO: Consider compiling and caching these regexes.
@@ -752,6 +1826,150 @@ func MatchesRegex(str jsonutil.JSONStr, regex jsonutil.JSONStr) (jsonutil.JSONBo
 	return jsonutil.JSONBool(m), err
 }
 
+// ParseCSVLine splits a single line of delimited values into its fields, following the quoting rules
+// of RFC 4180: a field wrapped in double quotes may contain the delimiter, and a doubled double quote
+// within it stands for a single one. All fields are returned (including empty ones), and quoted
+// fields are returned verbatim (i.e. not trimmed). The delimiter must be a single character. An
+// empty line has no fields.
+func ParseCSVLine(line jsonutil.JSONStr, delim jsonutil.JSONStr) (jsonutil.JSONArr, error) {
+	d := []rune(string(delim))
+	if len(d) != 1 || d[0] == '"' || d[0] == '\n' || d[0] == '\r' {
+		return nil, fmt.Errorf("delimiter must be a single character other than a quote or newline, got %q", delim)
+	}
+
+	res := jsonutil.JSONArr{}
+	if line == "" {
+		return res, nil
+	}
+
+	l := []rune(string(line))
+	var field strings.Builder
+	for i := 0; ; i++ {
+		if i < len(l) && l[i] == '"' {
+			// Quoted field; column numbers in errors are 1-based.
+			open := i
+			for i++; ; i++ {
+				if i >= len(l) {
+					return nil, fmt.Errorf("quote opened at column %d is never closed", open+1)
+				}
+				if l[i] != '"' {
+					field.WriteRune(l[i])
+					continue
+				}
+				if i+1 < len(l) && l[i+1] == '"' {
+					field.WriteRune('"')
+					i++
+					continue
+				}
+				break
+			}
+			i++
+			if i < len(l) && l[i] != d[0] {
+				return nil, fmt.Errorf("unexpected %q after closing quote at column %d", l[i], i+1)
+			}
+		} else {
+			for ; i < len(l) && l[i] != d[0]; i++ {
+				if l[i] == '"' {
+					return nil, fmt.Errorf("unexpected quote in unquoted field at column %d", i+1)
+				}
+				field.WriteRune(l[i])
+			}
+		}
+
+		res = append(res, jsonutil.JSONStr(field.String()))
+		field.Reset()
+
+		if i >= len(l) {
+			return res, nil
+		}
+	}
+}
+
+// ParseQueryString parses the parameters of the given URL query string (e.g. "code=a|b&code=c"),
+// returning an object with an array of the (percent-decoded) values of each parameter name, in the
+// order they appear. The query may be preceded by the URL it belongs to (up to and including the
+// first ?), and a trailing #fragment is ignored. A parameter without = has an empty value.
+func ParseQueryString(qs jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	q := string(qs)
+	if i := strings.Index(q, "?"); i >= 0 {
+		q = q[i+1:]
+	}
+	if i := strings.Index(q, "#"); i >= 0 {
+		q = q[:i]
+	}
+
+	res := jsonutil.JSONContainer{}
+	for _, param := range strings.Split(q, "&") {
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+
+		n, err := url.QueryUnescape(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter name %q: %v", name, err)
+		}
+		v, err := url.QueryUnescape(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q of parameter %q: %v", value, n, err)
+		}
+
+		var values jsonutil.JSONArr
+		if prev, ok := res[n]; ok {
+			values = (*prev).(jsonutil.JSONArr)
+		}
+		var t jsonutil.JSONToken = append(values, jsonutil.JSONStr(v))
+		res[n] = &t
+	}
+	return res, nil
+}
+
+// BuildQueryString builds a URL query string (without a leading ?) from the given object of
+// parameters, the reverse of ParseQueryString. Each field is a parameter, whose value is either a
+// single primitive or an array of them, for repeated parameters; null values are left out.
+// Parameters are written in sorted order of their names (and the values of each name in order), and
+// names and values are percent-encoded, so values with e.g. & or = in them read back the same.
+func BuildQueryString(c jsonutil.JSONContainer) (jsonutil.JSONStr, error) {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		var values jsonutil.JSONArr
+		if v := c[name]; v != nil {
+			if arr, ok := (*v).(jsonutil.JSONArr); ok {
+				values = arr
+			} else {
+				values = jsonutil.JSONArr{*v}
+			}
+		}
+
+		for _, value := range values {
+			var str string
+			switch v := value.(type) {
+			case nil:
+				continue
+			case jsonutil.JSONStr:
+				str = string(v)
+			case jsonutil.JSONNum:
+				str = formatNum(v)
+			case jsonutil.JSONBool:
+				str = strconv.FormatBool(bool(v))
+			default:
+				return "", fmt.Errorf("value of parameter %q must be a primitive or an array of primitives, got %s", name, jsonutil.MarshalJSON(value))
+			}
+			params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(str))
+		}
+	}
+	return jsonutil.JSONStr(strings.Join(params, "&")), nil
+}
+
 // ParseFloat parses a string into a float.
 func ParseFloat(str jsonutil.JSONStr) (jsonutil.JSONNum, error) {
 	f, err := strconv.ParseFloat(string(str), 64)
@@ -761,28 +1979,59 @@ func ParseFloat(str jsonutil.JSONStr) (jsonutil.JSONNum, error) {
 	return jsonutil.JSONNum(f), nil
 }
 
-// ParseInt parses a string into an int.
+// maxParseErrorInput is the number of characters of an unparseable string that parse errors
+// include.
+const maxParseErrorInput = 32
+
+// ParseInt parses a string of decimal digits, with an optional sign, into an int. Strings that are
+// not, like ones with underscores or a decimal point, and integers that do not fit in 64 bits are an
+// error, which includes the string.
 func ParseInt(str jsonutil.JSONStr) (jsonutil.JSONNum, error) {
-	i, err := strconv.Atoi(string(str))
+	s := string(str)
+	if strings.Contains(s, "_") {
+		return 0, fmt.Errorf("could not parse %q as an integer: %v", truncateForError(s), strconv.ErrSyntax)
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
-		return -1, err
+		// The error of strconv includes the whole string, which may be long.
+		var numErr *strconv.NumError
+		if errors.As(err, &numErr) {
+			err = numErr.Err
+		}
+		return 0, fmt.Errorf("could not parse %q as an integer: %v", truncateForError(s), err)
 	}
 	return jsonutil.JSONNum(i), nil
 }
 
+// truncateForError truncates the given string to maxParseErrorInput characters, marking it with an
+// ellipsis if it was truncated.
+func truncateForError(s string) string {
+	r := []rune(s)
+	if len(r) <= maxParseErrorInput {
+		return s
+	}
+	return string(r[:maxParseErrorInput]) + "..."
+}
+
 // SubStr returns a part of the string that is between the start index (inclusive) and the
-// end index (exclusive). If the end index is greater than the length of the string, the end
-// index is truncated to the length.
+// end index (exclusive). Indices are in characters, not bytes. Indices out of the bounds of the
+// string are clamped to them, and a negative end index means the end of the string, so
+// SubStr("Zoë", 1, -1) is "oë". If the start index is not before the end index, the result is
+// empty.
 func SubStr(str jsonutil.JSONStr, start, end jsonutil.JSONNum) (jsonutil.JSONStr, error) {
-	e := int(end)
-	l := len(str)
-	if e > l {
+	runes := []rune(string(str))
+	l := len(runes)
+	s, e := int(start), int(end)
+	if e < 0 || e > l {
 		e = l
 	}
-	if int(start) > l {
-		return jsonutil.JSONStr(""), fmt.Errorf("start index %v is greater string length %v", start, l)
+	if s < 0 {
+		s = 0
 	}
-	return jsonutil.JSONStr(string(str)[int(start):e]), nil
+	if s >= e {
+		return jsonutil.JSONStr(""), nil
+	}
+	return jsonutil.JSONStr(string(runes[s:e])), nil
 }
 
 // StrCat joins the input strings with the separator.
@@ -790,6 +2039,36 @@ func StrCat(args ...jsonutil.JSONToken) (jsonutil.JSONStr, error) {
 	return StrJoin(jsonutil.JSONStr(""), args...)
 }
 
+// StrCount returns the number of non-overlapping occurrences of substr in str, e.g. the number of
+// component separators in a composite field. An empty substr is an error.
+func StrCount(str, substr jsonutil.JSONStr) (jsonutil.JSONNum, error) {
+	if substr == "" {
+		return 0, fmt.Errorf("can not count occurrences of an empty string")
+	}
+	return jsonutil.JSONNum(strings.Count(string(str), string(substr))), nil
+}
+
+// StrOccurrenceIndexes returns the indexes (in characters, not bytes) at which the non-overlapping
+// occurrences of substr in str start. An empty substr is an error.
+func StrOccurrenceIndexes(str, substr jsonutil.JSONStr) (jsonutil.JSONArr, error) {
+	if substr == "" {
+		return nil, fmt.Errorf("can not find occurrences of an empty string")
+	}
+	res := jsonutil.JSONArr{}
+	s, sub := string(str), string(substr)
+	runes := 0
+	for {
+		i := strings.Index(s, sub)
+		if i < 0 {
+			return res, nil
+		}
+		runes += utf8.RuneCountInString(s[:i])
+		res = append(res, jsonutil.JSONNum(runes))
+		runes += utf8.RuneCountInString(sub)
+		s = s[i+len(sub):]
+	}
+}
+
 // StrFmt formats the given item using the given Go format specifier (https://golang.org/pkg/fmt/).
 func StrFmt(format jsonutil.JSONStr, item jsonutil.JSONToken) (jsonutil.JSONStr, error) {
 	// This cast avoids formatting issues with numbers (since JSONNum is not detected as a number by the formatter)
@@ -804,17 +2083,43 @@ func StrFmt(format jsonutil.JSONStr, item jsonutil.JSONToken) (jsonutil.JSONStr,
 }
 
 // StrJoin joins the inputs together and adds the separator between them. Non-string arguments
-// are converted to strings before joining.
+// are converted to strings before joining; numbers are rendered exactly and without an exponent,
+// e.g. 1000000 instead of 1e+06.
 func StrJoin(sep jsonutil.JSONStr, args ...jsonutil.JSONToken) (jsonutil.JSONStr, error) {
 	var o []string
 	for _, token := range args {
-		if token != nil {
+		switch t := token.(type) {
+		case nil:
+		case jsonutil.JSONNum:
+			o = append(o, formatNum(t))
+		default:
 			o = append(o, fmt.Sprintf("%v", token))
 		}
 	}
 	return jsonutil.JSONStr(strings.Join(o, string(sep))), nil
 }
 
+// StrReplace replaces the non-overlapping occurrences of old in str with repl, like
+// strings.ReplaceAll. The optional count limits the number of replacements, which are made from
+// the start of the string; a negative count replaces all of them. An empty old is an error, while
+// an empty repl removes the occurrences.
+func StrReplace(str, old, repl jsonutil.JSONStr, count ...jsonutil.JSONNum) (jsonutil.JSONStr, error) {
+	if old == "" {
+		return jsonutil.JSONStr(""), fmt.Errorf("can not replace occurrences of an empty string")
+	}
+	if len(count) > 1 {
+		return jsonutil.JSONStr(""), fmt.Errorf("expected at most 1 count argument, got %d", len(count))
+	}
+	n := -1
+	if len(count) == 1 {
+		if !isInteger(count[0]) {
+			return jsonutil.JSONStr(""), fmt.Errorf("count must be an integer but got %v", count[0])
+		}
+		n = int(math.Round(float64(count[0])))
+	}
+	return jsonutil.JSONStr(strings.Replace(string(str), string(old), string(repl), n)), nil
+}
+
 // StrSplit splits a string by the separator and ignores empty entries.
 func StrSplit(str jsonutil.JSONStr, sep jsonutil.JSONStr) (jsonutil.JSONArr, error) {
 	outs := strings.Split(string(str), string(sep))
@@ -829,6 +2134,64 @@ func StrSplit(str jsonutil.JSONStr, sep jsonutil.JSONStr) (jsonutil.JSONArr, err
 	return res, nil
 }
 
+// SplitByLength splits a string into consecutive chunks of at most n runes, e.g. for targets that
+// limit the length of a field and continue long text in repeated fields. If wordSafe is true, chunks
+// end at the last whitespace that keeps them within n runes instead, and the whitespace between
+// chunks is dropped, so that words are not split unless a single word is longer than n. Chunks are
+// never empty (an empty string has no chunks). n must be a positive integer.
+func SplitByLength(str jsonutil.JSONStr, n jsonutil.JSONNum, wordSafe ...jsonutil.JSONBool) (jsonutil.JSONArr, error) {
+	if n <= 0 || n != jsonutil.JSONNum(math.Trunc(float64(n))) {
+		return nil, fmt.Errorf("n must be a positive integer but got %v", n)
+	}
+	if len(wordSafe) > 1 {
+		return nil, fmt.Errorf("expected at most 1 wordSafe argument, got %d", len(wordSafe))
+	}
+	words := len(wordSafe) == 1 && bool(wordSafe[0])
+
+	runes := []rune(string(str))
+	// n is clamped before it is converted, as it may not fit in an int.
+	size := len(runes)
+	if n < jsonutil.JSONNum(size) {
+		size = int(n)
+	}
+	// This needs to always return an empty array, not a nil value.
+	res := jsonutil.JSONArr{}
+	for start := 0; start < len(runes); {
+		if words {
+			for start < len(runes) && unicode.IsSpace(runes[start]) {
+				start++
+			}
+			if start == len(runes) {
+				break
+			}
+		}
+
+		end := start + size
+		if end >= len(runes) {
+			end = len(runes)
+		} else if words {
+			// The whitespace right after a full chunk ends it too. If there is no whitespace, the word
+			// is longer than n and is split.
+			for cut := end; cut > start; cut-- {
+				if unicode.IsSpace(runes[cut]) {
+					end = cut
+					break
+				}
+			}
+		}
+
+		chunk := string(runes[start:end])
+		if words {
+			chunk = strings.TrimRightFunc(chunk, unicode.IsSpace)
+		}
+		if chunk != "" {
+			res = append(res, jsonutil.JSONStr(chunk))
+		}
+		start = end
+	}
+	return res, nil
+}
+
 // ToLower converts the given string with all unicode characters mapped to their lowercase.
 func ToLower(str jsonutil.JSONStr) (jsonutil.JSONStr, error) {
 	return jsonutil.JSONStr(strings.ToLower(string(str))), nil
@@ -838,3 +2201,58 @@ func ToLower(str jsonutil.JSONStr) (jsonutil.JSONStr, error) {
 func ToUpper(str jsonutil.JSONStr) (jsonutil.JSONStr, error) {
 	return jsonutil.JSONStr(strings.ToUpper(string(str))), nil
 }
+
+// WordWrap inserts the given newline (e.g. "\n" or "<br/>") into the string so that its lines are at
+// most width runes long, breaking at whitespace. The whitespace at a break is replaced by the
+// newline, and words longer than width are put on their own line rather than split. Line breaks
+// ("\n") already in the string are kept, and start a new line.
+func WordWrap(str jsonutil.JSONStr, width jsonutil.JSONNum, newline jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	if width <= 0 || width != jsonutil.JSONNum(math.Trunc(float64(width))) {
+		return "", fmt.Errorf("width must be a positive integer but got %v", width)
+	}
+
+	lines := strings.Split(string(str), "\n")
+	for i, line := range lines {
+		lines[i] = wrapLine(line, int(width), string(newline))
+	}
+	return jsonutil.JSONStr(strings.Join(lines, "\n")), nil
+}
+
+// wrapLine wraps a single line (without line breaks) for WordWrap.
+func wrapLine(line string, width int, newline string) string {
+	var b strings.Builder
+	// length is the number of runes written since the last break, and space the whitespace before
+	// the next word, which is only written if the word fits on the line after it.
+	length := 0
+	space := ""
+	for line != "" {
+		i := strings.IndexFunc(line, unicode.IsSpace)
+		if i == 0 {
+			j := strings.IndexFunc(line, func(r rune) bool { return !unicode.IsSpace(r) })
+			if j < 0 {
+				j = len(line)
+			}
+			space, line = line[:j], line[j:]
+			continue
+		}
+		if i < 0 {
+			i = len(line)
+		}
+		word := line[:i]
+		line = line[i:]
+
+		spaceLen, wordLen := utf8.RuneCountInString(space), utf8.RuneCountInString(word)
+		if length > 0 && length+spaceLen+wordLen > width {
+			b.WriteString(newline)
+			length = 0
+		} else {
+			b.WriteString(space)
+			length += spaceLen
+		}
+		b.WriteString(word)
+		length += wordLen
+		space = ""
+	}
+	b.WriteString(space)
+	return b.String()
+}
@@ -19,8 +19,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
 	"github.com/google/go-cmp/cmp/cmpopts" /* copybara-comment: cmpopts */
@@ -28,6 +31,16 @@ import (
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
 )
 
+func mustParseBenchmarkInput(json json.RawMessage, b *testing.B) jsonutil.JSONToken {
+	b.Helper()
+
+	tkn, err := jsonutil.UnmarshalJSON(json)
+	if err != nil {
+		b.Fatalf("failed to parse benchmark input %s: %v", json, err)
+	}
+	return tkn
+}
+
 func mustParseContainer(json json.RawMessage, t *testing.T) jsonutil.JSONContainer {
 	t.Helper()
 	c := make(jsonutil.JSONContainer)
@@ -350,6 +363,114 @@ func TestIsNil(t *testing.T) {
 	}
 }
 
+func TestIsEmpty(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  json.RawMessage
+		want jsonutil.JSONBool
+	}{
+		{
+			name: "nil",
+			arg:  json.RawMessage(`null`),
+			want: true,
+		},
+		{
+			name: "empty string",
+			arg:  json.RawMessage(`""`),
+			want: true,
+		},
+		{
+			name: "whitespace string",
+			arg:  json.RawMessage(`"    "`),
+			want: true,
+		},
+		{
+			name: "string",
+			arg:  json.RawMessage(`" a "`),
+			want: false,
+		},
+		{
+			name: "zero",
+			arg:  json.RawMessage(`0`),
+			want: false,
+		},
+		{
+			name: "false",
+			arg:  json.RawMessage(`false`),
+			want: false,
+		},
+		{
+			name: "empty array",
+			arg:  json.RawMessage(`[]`),
+			want: true,
+		},
+		{
+			name: "array of empty items",
+			arg:  json.RawMessage(`[null, "", " ", [], {}, [null, {"a": " "}]]`),
+			want: true,
+		},
+		{
+			name: "mixed array",
+			arg:  json.RawMessage(`[null, "", 0]`),
+			want: false,
+		},
+		{
+			name: "array with false",
+			arg:  json.RawMessage(`[null, false]`),
+			want: false,
+		},
+		{
+			name: "empty container",
+			arg:  json.RawMessage(`{}`),
+			want: true,
+		},
+		{
+			name: "container of nil",
+			arg:  json.RawMessage(`{"family": null}`),
+			want: true,
+		},
+		{
+			name: "nested empty containers",
+			arg:  json.RawMessage(`{"name": [{"family": null, "given": ["  "]}], "telecom": {}}`),
+			want: true,
+		},
+		{
+			name: "nested non-empty value",
+			arg:  json.RawMessage(`{"name": [{"family": null, "given": ["  ", "Jo"]}]}`),
+			want: false,
+		},
+		{
+			name: "nested zero",
+			arg:  json.RawMessage(`{"a": {"b": {"c": 0}}}`),
+			want: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			arg, err := jsonutil.UnmarshalJSON(test.arg)
+			if err != nil {
+				t.Fatalf("UnmarshalJSON(%s) returned unexpected error %v", test.arg, err)
+			}
+
+			got, err := IsEmpty(arg)
+			if err != nil {
+				t.Fatalf("IsEmpty(%v) returned unexpected error %v", arg, err)
+			}
+			if got != test.want {
+				t.Errorf("IsEmpty(%v) = %v, want %v", arg, got, test.want)
+			}
+
+			gotNot, err := IsNotEmpty(arg)
+			if err != nil {
+				t.Fatalf("IsNotEmpty(%v) returned unexpected error %v", arg, err)
+			}
+			if gotNot != !test.want {
+				t.Errorf("IsNotEmpty(%v) = %v, want %v", arg, gotNot, !test.want)
+			}
+		})
+	}
+}
+
 func TestType(t *testing.T) {
 	var v jsonutil.JSONToken = jsonutil.JSONNum(0)
 	tests := []struct {
@@ -456,6 +577,55 @@ func TestSubStr(t *testing.T) {
 			end:   jsonutil.JSONNum(10),
 			want:  jsonutil.JSONStr("test"),
 		},
+		{
+			name:  "start and end index bigger than string size",
+			in:    jsonutil.JSONStr("test"),
+			start: jsonutil.JSONNum(10),
+			end:   jsonutil.JSONNum(15),
+			want:  jsonutil.JSONStr(""),
+		},
+		{
+			name:  "negative start index",
+			in:    jsonutil.JSONStr("test"),
+			start: jsonutil.JSONNum(-2),
+			end:   jsonutil.JSONNum(2),
+			want:  jsonutil.JSONStr("te"),
+		},
+		{
+			name:  "negative end index",
+			in:    jsonutil.JSONStr("test"),
+			start: jsonutil.JSONNum(1),
+			end:   jsonutil.JSONNum(-1),
+			want:  jsonutil.JSONStr("est"),
+		},
+		{
+			name:  "start after end",
+			in:    jsonutil.JSONStr("test"),
+			start: jsonutil.JSONNum(3),
+			end:   jsonutil.JSONNum(1),
+			want:  jsonutil.JSONStr(""),
+		},
+		{
+			name:  "empty string",
+			in:    jsonutil.JSONStr(""),
+			start: jsonutil.JSONNum(0),
+			end:   jsonutil.JSONNum(5),
+			want:  jsonutil.JSONStr(""),
+		},
+		{
+			name:  "multi-byte characters",
+			in:    jsonutil.JSONStr("Zoë Ñúñez"),
+			start: jsonutil.JSONNum(2),
+			end:   jsonutil.JSONNum(6),
+			want:  jsonutil.JSONStr("ë Ñú"),
+		},
+		{
+			name:  "multi-byte characters clamped",
+			in:    jsonutil.JSONStr("José"),
+			start: jsonutil.JSONNum(0),
+			end:   jsonutil.JSONNum(6),
+			want:  jsonutil.JSONStr("José"),
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -470,1023 +640,3083 @@ func TestSubStr(t *testing.T) {
 	}
 }
 
-func TestSubStrErrs(t *testing.T) {
+func TestSplitByLength(t *testing.T) {
 	tests := []struct {
-		name  string
-		in    jsonutil.JSONStr
-		start jsonutil.JSONNum
-		end   jsonutil.JSONNum
+		name     string
+		str      jsonutil.JSONStr
+		n        jsonutil.JSONNum
+		wordSafe []jsonutil.JSONBool
+		want     []string
 	}{
 		{
-			name:  "start and end index bigger than string size",
-			in:    jsonutil.JSONStr("test"),
-			start: jsonutil.JSONNum(10),
-			end:   jsonutil.JSONNum(15),
+			name: "hard split",
+			str:  "abcdefgh",
+			n:    3,
+			want: []string{"abc", "def", "gh"},
 		},
-	}
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			got, err := SubStr(test.in, test.start, test.end)
-			if err == nil {
-				t.Errorf("SubStr(%v, %v, %v) = %v, want error", test.in, test.start, test.end, got)
-			}
-		})
-	}
-}
-
-func TestStrJoin(t *testing.T) {
-	tests := []struct {
-		name string
-		sep  jsonutil.JSONStr
-		arg  []jsonutil.JSONToken
-		want jsonutil.JSONToken
-	}{
 		{
-			name: "multiple arguments",
-			sep:  jsonutil.JSONStr("."),
-			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONStr("def"), jsonutil.JSONStr("ghi")},
-			want: jsonutil.JSONStr("abc.def.ghi"),
+			name: "hard split keeps whitespace",
+			str:  "ab cd ef",
+			n:    3,
+			want: []string{"ab ", "cd ", "ef"},
 		},
 		{
-			name: "single argument",
-			sep:  jsonutil.JSONStr("."),
-			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("GET")},
-			want: jsonutil.JSONStr("GET"),
+			name: "exact multiple",
+			str:  "abcdef",
+			n:    3,
+			want: []string{"abc", "def"},
 		},
 		{
-			name: "empty argument",
-			sep:  jsonutil.JSONStr("."),
-			arg:  []jsonutil.JSONToken{},
-			want: jsonutil.JSONStr(""),
+			name: "shorter than n",
+			str:  "ab",
+			n:    200,
+			want: []string{"ab"},
 		},
 		{
-			name: "multiple arguments including a nil",
-			sep:  jsonutil.JSONStr("."),
-			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONToken(nil)},
-			want: jsonutil.JSONStr("abc"),
+			name: "longer than an int",
+			str:  "hello world foo",
+			n:    1e19,
+			want: []string{"hello world foo"},
 		},
 		{
-			name: "multiple arguments including a nil within list",
-			sep:  jsonutil.JSONStr("."),
-			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONToken(nil), jsonutil.JSONStr("def")},
-			want: jsonutil.JSONStr("abc.def"),
+			name:     "longer than an int word safe",
+			str:      "hello world foo",
+			n:        1e19,
+			wordSafe: []jsonutil.JSONBool{true},
+			want:     []string{"hello world foo"},
+		},
+		{
+			name: "empty",
+			str:  "",
+			n:    3,
+			want: []string{},
+		},
+		{
+			name: "multibyte",
+			str:  "日本語のテキスト",
+			n:    3,
+			want: []string{"日本語", "のテキ", "スト"},
+		},
+		{
+			name:     "multibyte word safe",
+			str:      "Grüße aus Köln",
+			n:        9,
+			wordSafe: []jsonutil.JSONBool{true},
+			want:     []string{"Grüße aus", "Köln"},
+		},
+		{
+			name:     "word safe",
+			str:      "the quick brown fox",
+			n:        10,
+			wordSafe: []jsonutil.JSONBool{true},
+			want:     []string{"the quick", "brown fox"},
+		},
+		{
+			name:     "word safe false",
+			str:      "the quick brown fox",
+			n:        10,
+			wordSafe: []jsonutil.JSONBool{false},
+			want:     []string{"the quick ", "brown fox"},
+		},
+		{
+			name:     "word ends at the boundary",
+			str:      "abc def ghi",
+			n:        3,
+			wordSafe: []jsonutil.JSONBool{true},
+			want:     []string{"abc", "def", "ghi"},
+		},
+		{
+			name:     "word longer than n",
+			str:      "a verylongword b",
+			n:        4,
+			wordSafe: []jsonutil.JSONBool{true},
+			want:     []string{"a", "very", "long", "word", "b"},
+		},
+		{
+			name:     "whitespace between chunks is dropped",
+			str:      "  one   two\nthree  ",
+			n:        5,
+			wordSafe: []jsonutil.JSONBool{true},
+			want:     []string{"one", "two", "three"},
+		},
+		{
+			name:     "only whitespace",
+			str:      "   ",
+			n:        2,
+			wordSafe: []jsonutil.JSONBool{true},
+			want:     []string{},
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := StrJoin(test.sep, test.arg...)
+			got, err := SplitByLength(test.str, test.n, test.wordSafe...)
 			if err != nil {
-				t.Fatalf("Test %s returned unexpected error %v", test.name, err)
+				t.Fatalf("SplitByLength(%q, %v, %v) returned unexpected error %v", test.str, test.n, test.wordSafe, err)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("StrJoin(%v) = %v, want %v", test.arg, got, test.want)
+			want := jsonutil.JSONArr{}
+			for _, w := range test.want {
+				want = append(want, jsonutil.JSONStr(w))
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("SplitByLength(%q, %v, %v) returned diff (-want +got):\n%s", test.str, test.n, test.wordSafe, diff)
 			}
 		})
 	}
 }
 
-func TestStrCat(t *testing.T) {
+func TestSplitByLength_Errors(t *testing.T) {
 	tests := []struct {
-		name string
-		arg  []jsonutil.JSONToken
-		want jsonutil.JSONToken
+		name     string
+		n        jsonutil.JSONNum
+		wordSafe []jsonutil.JSONBool
+	}{
+		{name: "zero", n: 0},
+		{name: "negative", n: -1},
+		{name: "fraction", n: 1.5},
+		{name: "too many arguments", n: 3, wordSafe: []jsonutil.JSONBool{true, false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := SplitByLength("abc", test.n, test.wordSafe...); err == nil {
+				t.Errorf("SplitByLength(abc, %v, %v) = %v, want error", test.n, test.wordSafe, got)
+			}
+		})
+	}
+}
+
+func TestStrCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		str    jsonutil.JSONStr
+		substr jsonutil.JSONStr
+		want   jsonutil.JSONNum
 	}{
 		{
-			name: "multiple arguments",
-			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONStr("def"), jsonutil.JSONStr("ghi")},
-			want: jsonutil.JSONStr("abcdefghi"),
+			name:   "composite field",
+			str:    "DOE^JOHN^A^JR",
+			substr: "^",
+			want:   3,
 		},
 		{
-			name: "single argument",
-			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("GET")},
-			want: jsonutil.JSONStr("GET"),
+			name:   "no occurrences",
+			str:    "DOE",
+			substr: "^",
+			want:   0,
 		},
 		{
-			name: "empty argument",
-			arg:  []jsonutil.JSONToken{},
-			want: jsonutil.JSONStr(""),
+			name:   "non-overlapping",
+			str:    "aaaa",
+			substr: "aa",
+			want:   2,
+		},
+		{
+			name:   "empty string",
+			str:    "",
+			substr: "^",
+			want:   0,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := StrCat(test.arg...)
+			got, err := StrCount(test.str, test.substr)
 			if err != nil {
-				t.Fatalf("Test %s returned unexpected error %v", test.name, err)
+				t.Fatalf("StrCount(%q, %q) returned unexpected error %v", test.str, test.substr, err)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("StrCat(%v) = %v, want %v", test.arg, got, test.want)
+			if got != test.want {
+				t.Errorf("StrCount(%q, %q) = %v, want %v", test.str, test.substr, got, test.want)
 			}
 		})
 	}
+
+	if got, err := StrCount("abc", ""); err == nil {
+		t.Errorf("StrCount(%q, %q) = %v, want error", "abc", "", got)
+	}
 }
 
-func TestParseTime(t *testing.T) {
+func TestStrOccurrenceIndexes(t *testing.T) {
 	tests := []struct {
-		name, format, date, want string
-		wantErr                  bool
+		name   string
+		str    jsonutil.JSONStr
+		substr jsonutil.JSONStr
+		want   jsonutil.JSONArr
 	}{
 		{
-			name:   "matching format and date",
-			format: "2006_01_02 15:04:05.000",
-			date:   "2019_04_10 10:20:49.123",
-			want:   "2019-04-10T10:20:49.123Z",
-		},
-		{
-			name:   "unpadded day and month",
-			format: "1/2/06",
-			date:   "1/8/17",
-			want:   "2017-01-08T00:00:00Z",
+			name:   "composite field",
+			str:    "DOE^JOHN^A",
+			substr: "^",
+			want:   jsonutil.JSONArr{jsonutil.JSONNum(3), jsonutil.JSONNum(8)},
 		},
 		{
-			name:   "unpadded two digit day and month",
-			format: "1/2/06",
-			date:   "11/18/17",
-			want:   "2017-11-18T00:00:00Z",
+			name:   "no occurrences",
+			str:    "DOE",
+			substr: "^",
+			want:   jsonutil.JSONArr{},
 		},
 		{
-			name:   "padded one digit year",
-			format: "1/2/06",
-			date:   "11/8/07",
-			want:   "2007-11-08T00:00:00Z",
+			name:   "non-overlapping",
+			str:    "aaaaa",
+			substr: "aa",
+			want:   jsonutil.JSONArr{jsonutil.JSONNum(0), jsonutil.JSONNum(2)},
 		},
 		{
-			name:    "date format mismatch",
-			format:  "2006_01_02",
-			date:    "2019 04 10",
-			wantErr: true,
+			name:   "multibyte characters",
+			str:    "Müller^Jürgen^ö",
+			substr: "^",
+			want:   jsonutil.JSONArr{jsonutil.JSONNum(6), jsonutil.JSONNum(13)},
 		},
 		{
-			name:    "bad date",
-			format:  "2006_01_02 15:04:05.000",
-			date:    "2019_0",
-			wantErr: true,
+			name:   "multibyte substring",
+			str:    "aéébéé",
+			substr: "éé",
+			want:   jsonutil.JSONArr{jsonutil.JSONNum(1), jsonutil.JSONNum(4)},
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := ParseTime(jsonutil.JSONStr(test.format), jsonutil.JSONStr(test.date))
-			if err != nil != test.wantErr {
-				var wantErrStr string
-				if !test.wantErr {
-					wantErrStr = "no "
-				}
-				t.Errorf("ParseTime(%s, %s) expected %serror, got %v %v", test.format, test.date, wantErrStr, got, err)
+			got, err := StrOccurrenceIndexes(test.str, test.substr)
+			if err != nil {
+				t.Fatalf("StrOccurrenceIndexes(%q, %q) returned unexpected error %v", test.str, test.substr, err)
 			}
-
-			if string(got) != test.want {
-				t.Errorf("ParseTime(%s, %s) = %s, want %s", test.format, test.date, got, test.want)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("StrOccurrenceIndexes(%q, %q) returned diff (-want +got):\n%s", test.str, test.substr, diff)
 			}
 		})
 	}
+
+	if got, err := StrOccurrenceIndexes("abc", ""); err == nil {
+		t.Errorf("StrOccurrenceIndexes(%q, %q) = %v, want error", "abc", "", got)
+	}
 }
 
-func TestMultiFormatParseTime(t *testing.T) {
+func TestStrReplace(t *testing.T) {
 	tests := []struct {
-		name, date, want string
-		format           []string
-		wantErr          bool
-	}{
-		{
-			name:   "first match",
-			format: []string{"2006_01_02 15:04:05.000", "1/2/06", "2006_01_02"},
-			date:   "2019_04_10 10:20:49.123",
-			want:   "2019-04-10T10:20:49.123Z",
+		name  string
+		str   jsonutil.JSONStr
+		old   jsonutil.JSONStr
+		repl  jsonutil.JSONStr
+		count []jsonutil.JSONNum
+		want  jsonutil.JSONStr
+	}{
+		{
+			name: "composite field",
+			str:  "DOE^JOHN^A^JR",
+			old:  "^",
+			repl: " ",
+			want: "DOE JOHN A JR",
 		},
 		{
-			name:   "second match",
-			format: []string{"2006_01_02 15:04:05.000", "1/2/06", "2006_01_02"},
-			date:   "1/8/17",
-			want:   "2017-01-08T00:00:00Z",
+			name: "strip characters",
+			str:  "(555) 123-4567",
+			old:  "-",
+			repl: "",
+			want: "(555) 1234567",
 		},
 		{
-			name:    "date format mismatch",
-			format:  []string{"2006_01_02 15:04:05.000", "1/2/06", "2006_01_02"},
-			date:    "2019 04 10",
-			wantErr: true,
+			name: "no occurrences",
+			str:  "DOE",
+			old:  "^",
+			repl: " ",
+			want: "DOE",
+		},
+		{
+			name: "overlapping pattern",
+			str:  "aaaaa",
+			old:  "aa",
+			repl: "b",
+			want: "bba",
+		},
+		{
+			name: "replacement contains old",
+			str:  "a^b",
+			old:  "^",
+			repl: "^^",
+			want: "a^^b",
+		},
+		{
+			name: "multibyte characters",
+			str:  "Müller^Jürgen",
+			old:  "ü",
+			repl: "ue",
+			want: "Mueller^Juergen",
+		},
+		{
+			name:  "limited count",
+			str:   "DOE^JOHN^A^JR",
+			old:   "^",
+			repl:  ", ",
+			count: []jsonutil.JSONNum{2},
+			want:  "DOE, JOHN, A^JR",
+		},
+		{
+			name:  "zero count",
+			str:   "DOE^JOHN",
+			old:   "^",
+			repl:  " ",
+			count: []jsonutil.JSONNum{0},
+			want:  "DOE^JOHN",
+		},
+		{
+			name:  "negative count",
+			str:   "DOE^JOHN^A",
+			old:   "^",
+			repl:  " ",
+			count: []jsonutil.JSONNum{-1},
+			want:  "DOE JOHN A",
+		},
+		{
+			name:  "count greater than occurrences",
+			str:   "DOE^JOHN",
+			old:   "^",
+			repl:  " ",
+			count: []jsonutil.JSONNum{5},
+			want:  "DOE JOHN",
+		},
+		{
+			name: "empty string",
+			str:  "",
+			old:  "^",
+			repl: " ",
+			want: "",
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			var arr jsonutil.JSONArr
-			for _, s := range test.format {
-				arr = append(arr, jsonutil.JSONStr(s))
+			got, err := StrReplace(test.str, test.old, test.repl, test.count...)
+			if err != nil {
+				t.Fatalf("StrReplace(%q, %q, %q, %v) returned unexpected error %v", test.str, test.old, test.repl, test.count, err)
 			}
-			got, err := MultiFormatParseTime(arr, jsonutil.JSONStr(test.date))
-			if err != nil != test.wantErr {
-				var wantErrStr string
-				if !test.wantErr {
-					wantErrStr = "no "
-				}
-				t.Errorf("MultiFormatParseTime(%s, %s) expected %serror, got %v %v", test.format, test.date, wantErrStr, got, err)
+			if got != test.want {
+				t.Errorf("StrReplace(%q, %q, %q, %v) = %q, want %q", test.str, test.old, test.repl, test.count, got, test.want)
 			}
+		})
+	}
+}
 
-			if string(got) != test.want {
-				t.Errorf("MultiFormatParseTime(%s, %s) = %s, want %s", test.format, test.date, got, test.want)
+func TestStrReplace_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		old   jsonutil.JSONStr
+		count []jsonutil.JSONNum
+	}{
+		{name: "empty old", old: ""},
+		{name: "empty old with count", old: "", count: []jsonutil.JSONNum{1}},
+		{name: "non-integer count", old: "^", count: []jsonutil.JSONNum{1.5}},
+		{name: "too many counts", old: "^", count: []jsonutil.JSONNum{1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := StrReplace("a^b", test.old, "x", test.count...); err == nil {
+				t.Errorf("StrReplace(a^b, %q, x, %v) = %q, want error", test.old, test.count, got)
 			}
 		})
 	}
 }
 
-func TestSplitTime(t *testing.T) {
+func TestEscapeXML(t *testing.T) {
 	tests := []struct {
-		name, format, date string
-		want               []string
+		name string
+		in   jsonutil.JSONStr
+		want jsonutil.JSONStr
 	}{
 		{
-			name:   "only year",
-			format: "2006",
-			date:   "2019",
-			want:   []string{"2019", "1", "1", "0", "0", "0", "0"},
+			name: "special characters",
+			in:   `<div class="a">Tom & Jerry's</div>`,
+			want: "&lt;div class=&quot;a&quot;&gt;Tom &amp; Jerry&apos;s&lt;/div&gt;",
 		},
 		{
-			name:   "only month",
-			format: "01",
-			date:   "05",
-			want:   []string{"0", "5", "1", "0", "0", "0", "0"},
+			name: "entities are escaped again",
+			in:   "&amp;",
+			want: "&amp;amp;",
 		},
 		{
-			name:   "only day",
-			format: "02",
-			date:   "28",
-			want:   []string{"0", "1", "28", "0", "0", "0", "0"},
+			name: "tab, newline and carriage return are kept",
+			in:   "a\tb\r\nc",
+			want: "a\tb\r\nc",
 		},
 		{
-			name:   "date",
-			format: "2006-01-02",
-			date:   "2019-05-28",
-			want:   []string{"2019", "5", "28", "0", "0", "0", "0"},
+			name: "vertical tab and form feed are dropped",
+			in:   "a\x0Bb\x0Cc",
+			want: "abc",
 		},
 		{
-			name:   "datetime",
-			format: "2006-01-02 15:04:05.000",
-			date:   "2019-05-28 13:48:25.123",
-			want:   []string{"2019", "5", "28", "13", "48", "25", "123000000"},
+			name: "HL7v2 separators are dropped",
+			in:   "\x1CMSH\x1Dfield\x1Erecord\x1Funit",
+			want: "MSHfieldrecordunit",
+		},
+		{
+			name: "other C0 controls are dropped",
+			in:   "\x00a\x01\x08b\x0E\x1Bc\x1F",
+			want: "abc",
+		},
+		{
+			name: "delete and C1 controls are allowed",
+			in:   "a\x7F\u0085b",
+			want: "a\x7F\u0085b",
+		},
+		{
+			name: "invalid UTF-8 is dropped",
+			in:   "a\xffb\xc3",
+			want: "ab",
+		},
+		{
+			name: "non-characters are dropped",
+			in:   "a\uFFFEb\uFFFFc",
+			want: "abc",
+		},
+		{
+			name: "multi-byte runes",
+			in:   "日本 < 語 \U0001F600 \uFFFD",
+			want: "日本 &lt; 語 \U0001F600 \uFFFD",
+		},
+		{
+			name: "empty string",
+			in:   "",
+			want: "",
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			ja, err := SplitTime(jsonutil.JSONStr(test.format), jsonutil.JSONStr(test.date))
+			got, err := EscapeXML(test.in)
 			if err != nil {
-				t.Fatalf("SplitTime(%s, %s) returned error: %v", test.format, test.date, err)
-			}
-			got := []jsonutil.JSONToken(ja)
-			if len(got) != len(test.want) {
-				t.Fatalf("SplitTime(%s, %s) returned %d components, want %d", test.format, test.date, len(got), len(test.want))
+				t.Fatalf("EscapeXML(%q) returned unexpected error %v", test.in, err)
 			}
-			for i := range got {
-				c, ok := got[i].(jsonutil.JSONStr)
-				if !ok {
-					t.Errorf("SplitTime(%s, %s) = %dth component %v in wrong type, want JSONStr", test.format, test.date, i+1, got[i])
-				}
-				if string(c) != test.want[i] {
-					t.Errorf("SplitTime(%s, %s) = %dth component %s, want %s", test.format, test.date, i+1, c, test.want[i])
-				}
+			if got != test.want {
+				t.Errorf("EscapeXML(%q) = %q, want %q", test.in, got, test.want)
 			}
 		})
 	}
 }
 
-func TestReformatTime(t *testing.T) {
+func TestMaskString(t *testing.T) {
 	tests := []struct {
-		name, inFormat, outFormat, date, want string
-		wantErr                               bool
+		name     string
+		in       jsonutil.JSONStr
+		keepTail jsonutil.JSONNum
+		maskChar jsonutil.JSONStr
+		want     jsonutil.JSONStr
 	}{
 		{
-			name:      "identity operation",
-			inFormat:  "2006_01_02 15:04:05.000",
-			date:      "2019_04_10 10:20:49.123",
-			outFormat: "2006_01_02 15:04:05.000",
-			want:      "2019_04_10 10:20:49.123",
+			name:     "separators are kept in place",
+			in:       "123-45-6789",
+			keepTail: 4,
+			maskChar: "*",
+			want:     "***-**-6789",
 		},
 		{
-			name:      "less precise output format",
-			inFormat:  "2006_01_02 15:04:05.000",
-			date:      "2019_04_10 10:20:49.123",
-			outFormat: "2006_01_02",
-			want:      "2019_04_10",
+			name:     "separator in the kept tail",
+			in:       "123-45-6789",
+			keepTail: 7,
+			maskChar: "#",
+			want:     "###-45-6789",
 		},
 		{
-			name:      "date format mismatch",
-			inFormat:  "2006_01_02",
-			date:      "2019 04 10",
-			outFormat: "2006_01_02",
-			wantErr:   true,
+			name:     "spaces and letters",
+			in:       "AB 12 CD",
+			keepTail: 2,
+			maskChar: "x",
+			want:     "xx xx CD",
 		},
 		{
-			name:      "python format to python format",
-			inFormat:  "%Y-%m-%dT%H:%M:%S%z",
-			date:      "2019-04-05T05:06:07+10:00",
-			outFormat: "%e/%m/%y:%H-%M-%S",
-			want:      "5/04/19:05-06-07",
+			name:     "no separators",
+			in:       "123456789",
+			keepTail: 4,
+			maskChar: "*",
+			want:     "*****6789",
 		},
 		{
-			name:      "python format to go format",
-			inFormat:  "%Y-%m-%dT%H:%M:%S%z",
-			date:      "2019-04-05T05:06:07+10:00",
-			outFormat: "2/01/06:15-04-05",
-			want:      "5/04/19:05-06-07",
+			name:     "empty mask char defaults to *",
+			in:       "1234",
+			keepTail: 1,
+			maskChar: "",
+			want:     "***4",
 		},
 		{
-			name:      "go format to python format",
-			inFormat:  "2006_01_02 15:04:05.000",
-			date:      "2019_04_10 10:20:49.123",
-			outFormat: "%e/%m/%y:%H-%M-%S",
-			want:      "10/04/19:10-20-49",
+			name:     "keep nothing",
+			in:       "12-34",
+			keepTail: 0,
+			maskChar: "*",
+			want:     "**-**",
 		},
 		{
-			name:     "implicitly illegal python format",
-			inFormat: "%bu%H-%M-%s",
-			date:     "Febu16:17:28",
-			wantErr:  true,
+			name:     "keepTail equal to length",
+			in:       "1234",
+			keepTail: 4,
+			maskChar: "*",
+			want:     "1234",
+		},
+		{
+			name:     "keepTail larger than length",
+			in:       "1234",
+			keepTail: 10,
+			maskChar: "*",
+			want:     "1234",
+		},
+		{
+			name:     "multi-byte runes",
+			in:       "日本-語ab",
+			keepTail: 2,
+			maskChar: "●",
+			want:     "●●-●ab",
+		},
+		{
+			name:     "empty string",
+			in:       "",
+			keepTail: 2,
+			maskChar: "*",
+			want:     "",
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := ReformatTime(jsonutil.JSONStr(test.inFormat), jsonutil.JSONStr(test.date), jsonutil.JSONStr(test.outFormat))
-			if err != nil != test.wantErr {
-				var wantErrStr string
-				if !test.wantErr {
-					wantErrStr = "no "
-				}
-				t.Errorf("ReformatTime(%s, %s, %s) expected %serror, got %v %v", test.inFormat, test.date, test.outFormat, wantErrStr, got, err)
+			got, err := MaskString(test.in, test.keepTail, test.maskChar)
+			if err != nil {
+				t.Fatalf("MaskString(%q, %v, %q) returned unexpected error %v", test.in, test.keepTail, test.maskChar, err)
 			}
-
-			if string(got) != test.want {
-				t.Errorf("ReformatTime(%s, %s, %s) = %s, want %s", test.inFormat, test.date, test.outFormat, got, test.want)
+			if got != test.want {
+				t.Errorf("MaskString(%q, %v, %q) = %q, want %q", test.in, test.keepTail, test.maskChar, got, test.want)
 			}
 		})
 	}
 }
 
-func TestCurrentTime(t *testing.T) {
+func TestMaskStringErrs(t *testing.T) {
 	tests := []struct {
-		name, inFormat, timeZone, wantRegex string
-		wantError                           bool
+		name     string
+		keepTail jsonutil.JSONNum
+		maskChar jsonutil.JSONStr
 	}{
 		{
-			name:      "date and empty timezone",
-			inFormat:  "2006-01-02",
-			timeZone:  "",
-			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2}",
-		},
-		{
-			name:      "date, time and empty timezone",
-			inFormat:  "2007-01-02 03:04:05-0700 MST",
-			timeZone:  "",
-			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}[+-][0-9]{4} UTC",
-		},
-		{
-			name:      "date and timezone",
-			inFormat:  "2007-01-02 MST",
-			timeZone:  "Europe/Berlin",
-			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2} CE[S]T",
-		},
-		{
-			name:      "date, time and timezone",
-			inFormat:  "2007-01-02 03:04:05-0700 MST",
-			timeZone:  "America/Chicago",
-			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}[+-][0-9]{4} C[S|D]T",
-		},
-		{
-			name:      "invalid layout",
-			inFormat:  "InvalidValue",
-			wantRegex: "InvalidValue",
+			name:     "negative keepTail",
+			keepTail: -1,
+			maskChar: "*",
 		},
 		{
-			name:      "empty layout",
-			inFormat:  "",
-			timeZone:  "Europe/Berlin",
-			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}",
+			name:     "fractional keepTail",
+			keepTail: 1.5,
+			maskChar: "*",
 		},
 		{
-			name:      "Invalid IANA Time Zone value",
-			inFormat:  "",
-			timeZone:  "Europe/Unknown",
-			wantError: true,
+			name:     "multiple mask characters",
+			keepTail: 4,
+			maskChar: "**",
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			wantRegExp := regexp.MustCompile(test.wantRegex)
-			got, err := CurrentTime(jsonutil.JSONStr(test.inFormat), jsonutil.JSONStr(test.timeZone))
-			if err != nil && !test.wantError {
-				t.Errorf("CurrentTime(%s) = Error - %v", test.inFormat, err)
-			}
-			if !wantRegExp.MatchString(string(got)) && !test.wantError {
-				t.Errorf("CurrentTime(%s) = got %s, doesn't conform to %s", test.inFormat, got, wantRegExp)
-			}
-			if err == nil && test.wantError {
-				t.Errorf("Received unexpected error (%v)", err)
+			if got, err := MaskString("123-45-6789", test.keepTail, test.maskChar); err == nil {
+				t.Errorf("MaskString(%v, %q) = %q, want error", test.keepTail, test.maskChar, got)
 			}
 		})
 	}
 }
 
-func TestListOf(t *testing.T) {
+func TestStrJoin(t *testing.T) {
 	tests := []struct {
 		name string
+		sep  jsonutil.JSONStr
 		arg  []jsonutil.JSONToken
+		want jsonutil.JSONToken
 	}{
 		{
 			name: "multiple arguments",
+			sep:  jsonutil.JSONStr("."),
 			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONStr("def"), jsonutil.JSONStr("ghi")},
+			want: jsonutil.JSONStr("abc.def.ghi"),
 		},
 		{
 			name: "single argument",
+			sep:  jsonutil.JSONStr("."),
 			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("GET")},
+			want: jsonutil.JSONStr("GET"),
 		},
 		{
 			name: "empty argument",
+			sep:  jsonutil.JSONStr("."),
 			arg:  []jsonutil.JSONToken{},
+			want: jsonutil.JSONStr(""),
+		},
+		{
+			name: "multiple arguments including a nil",
+			sep:  jsonutil.JSONStr("."),
+			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONToken(nil)},
+			want: jsonutil.JSONStr("abc"),
+		},
+		{
+			name: "multiple arguments including a nil within list",
+			sep:  jsonutil.JSONStr("."),
+			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONToken(nil), jsonutil.JSONStr("def")},
+			want: jsonutil.JSONStr("abc.def"),
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			want := jsonutil.JSONArr(test.arg)
-			got, err := ListOf(test.arg...)
+			got, err := StrJoin(test.sep, test.arg...)
 			if err != nil {
 				t.Fatalf("Test %s returned unexpected error %v", test.name, err)
 			}
-			if !cmp.Equal(got, want) {
-				t.Errorf("ListOf(%v) = %v, want %v", test.arg, got, want)
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("StrJoin(%v) = %v, want %v", test.arg, got, test.want)
 			}
 		})
 	}
 }
 
-func TestListCat(t *testing.T) {
+func TestStrCat(t *testing.T) {
 	tests := []struct {
 		name string
-		arg  []jsonutil.JSONArr
-		want jsonutil.JSONArr
+		arg  []jsonutil.JSONToken
+		want jsonutil.JSONToken
 	}{
 		{
-			name: "no arguments",
-			arg:  []jsonutil.JSONArr{},
-			want: jsonutil.JSONArr{},
-		},
+			name: "multiple arguments",
+			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONStr("def"), jsonutil.JSONStr("ghi")},
+			want: jsonutil.JSONStr("abcdefghi"),
+		},
+		{
+			name: "single argument",
+			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("GET")},
+			want: jsonutil.JSONStr("GET"),
+		},
+		{
+			name: "empty argument",
+			arg:  []jsonutil.JSONToken{},
+			want: jsonutil.JSONStr(""),
+		},
+		{
+			name: "numbers",
+			arg: []jsonutil.JSONToken{
+				jsonutil.JSONNum(1000000), jsonutil.JSONStr(" "),
+				jsonutil.JSONNum(3.0000000000000004), jsonutil.JSONStr(" "),
+				jsonutil.JSONNum(-2.5), jsonutil.JSONStr(" "),
+				jsonutil.JSONNum(1e-7), jsonutil.JSONStr(" "),
+				jsonutil.JSONNum(1e21),
+			},
+			want: jsonutil.JSONStr("1000000 3.0000000000000004 -2.5 0.0000001 1000000000000000000000"),
+		},
+		{
+			name: "numbers close to integers",
+			arg: []jsonutil.JSONToken{
+				jsonutil.JSONNum(1e-10), jsonutil.JSONStr(" "),
+				jsonutil.JSONNum(2.0000000001), jsonutil.JSONStr(" "),
+				jsonutil.JSONNum(-0.0),
+			},
+			want: jsonutil.JSONStr("0.0000000001 2.0000000001 0"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := StrCat(test.arg...)
+			if err != nil {
+				t.Fatalf("Test %s returned unexpected error %v", test.name, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("StrCat(%v) = %v, want %v", test.arg, got, test.want)
+			}
+		})
+	}
+}
+
+func BenchmarkStrCat(b *testing.B) {
+	args := []jsonutil.JSONToken{jsonutil.JSONStr("Patient/"), jsonutil.JSONNum(12345), jsonutil.JSONStr("-"), jsonutil.JSONBool(true)}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := StrCat(args...); err != nil {
+			b.Fatalf("StrCat(%v) returned unexpected error %v", args, err)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		name, format, date, want string
+		wantErr                  bool
+	}{
+		{
+			name:   "matching format and date",
+			format: "2006_01_02 15:04:05.000",
+			date:   "2019_04_10 10:20:49.123",
+			want:   "2019-04-10T10:20:49.123Z",
+		},
+		{
+			name:   "unpadded day and month",
+			format: "1/2/06",
+			date:   "1/8/17",
+			want:   "2017-01-08T00:00:00Z",
+		},
+		{
+			name:   "unpadded two digit day and month",
+			format: "1/2/06",
+			date:   "11/18/17",
+			want:   "2017-11-18T00:00:00Z",
+		},
+		{
+			name:   "padded one digit year",
+			format: "1/2/06",
+			date:   "11/8/07",
+			want:   "2007-11-08T00:00:00Z",
+		},
+		{
+			name:    "date format mismatch",
+			format:  "2006_01_02",
+			date:    "2019 04 10",
+			wantErr: true,
+		},
+		{
+			name:    "bad date",
+			format:  "2006_01_02 15:04:05.000",
+			date:    "2019_0",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseTime(jsonutil.JSONStr(test.format), jsonutil.JSONStr(test.date))
+			if err != nil != test.wantErr {
+				var wantErrStr string
+				if !test.wantErr {
+					wantErrStr = "no "
+				}
+				t.Errorf("ParseTime(%s, %s) expected %serror, got %v %v", test.format, test.date, wantErrStr, got, err)
+			}
+
+			if string(got) != test.want {
+				t.Errorf("ParseTime(%s, %s) = %s, want %s", test.format, test.date, got, test.want)
+			}
+		})
+	}
+}
+
+func BenchmarkParseTime(b *testing.B) {
+	tests := []struct {
+		name   string
+		format jsonutil.JSONStr
+		date   jsonutil.JSONStr
+	}{
+		{
+			name:   "go format",
+			format: "2006-01-02 15:04:05",
+			date:   "2020-03-17 13:37:00",
+		},
+		{
+			name:   "python format",
+			format: "%Y%m%d%H%M%S",
+			date:   "20200317133700",
+		},
+	}
+
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseTime(test.format, test.date); err != nil {
+					b.Fatalf("ParseTime(%s, %s) returned unexpected error %v", test.format, test.date, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMultiFormatParseTime(t *testing.T) {
+	tests := []struct {
+		name, date, want string
+		format           []string
+		wantErr          bool
+	}{
+		{
+			name:   "first match",
+			format: []string{"2006_01_02 15:04:05.000", "1/2/06", "2006_01_02"},
+			date:   "2019_04_10 10:20:49.123",
+			want:   "2019-04-10T10:20:49.123Z",
+		},
+		{
+			name:   "second match",
+			format: []string{"2006_01_02 15:04:05.000", "1/2/06", "2006_01_02"},
+			date:   "1/8/17",
+			want:   "2017-01-08T00:00:00Z",
+		},
+		{
+			name:    "date format mismatch",
+			format:  []string{"2006_01_02 15:04:05.000", "1/2/06", "2006_01_02"},
+			date:    "2019 04 10",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var arr jsonutil.JSONArr
+			for _, s := range test.format {
+				arr = append(arr, jsonutil.JSONStr(s))
+			}
+			got, err := MultiFormatParseTime(arr, jsonutil.JSONStr(test.date))
+			if err != nil != test.wantErr {
+				var wantErrStr string
+				if !test.wantErr {
+					wantErrStr = "no "
+				}
+				t.Errorf("MultiFormatParseTime(%s, %s) expected %serror, got %v %v", test.format, test.date, wantErrStr, got, err)
+			}
+
+			if string(got) != test.want {
+				t.Errorf("MultiFormatParseTime(%s, %s) = %s, want %s", test.format, test.date, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSplitTime(t *testing.T) {
+	tests := []struct {
+		name, format, date string
+		want               []string
+	}{
+		{
+			name:   "only year",
+			format: "2006",
+			date:   "2019",
+			want:   []string{"2019", "1", "1", "0", "0", "0", "0"},
+		},
+		{
+			name:   "only month",
+			format: "01",
+			date:   "05",
+			want:   []string{"0", "5", "1", "0", "0", "0", "0"},
+		},
+		{
+			name:   "only day",
+			format: "02",
+			date:   "28",
+			want:   []string{"0", "1", "28", "0", "0", "0", "0"},
+		},
+		{
+			name:   "date",
+			format: "2006-01-02",
+			date:   "2019-05-28",
+			want:   []string{"2019", "5", "28", "0", "0", "0", "0"},
+		},
+		{
+			name:   "datetime",
+			format: "2006-01-02 15:04:05.000",
+			date:   "2019-05-28 13:48:25.123",
+			want:   []string{"2019", "5", "28", "13", "48", "25", "123000000"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ja, err := SplitTime(jsonutil.JSONStr(test.format), jsonutil.JSONStr(test.date))
+			if err != nil {
+				t.Fatalf("SplitTime(%s, %s) returned error: %v", test.format, test.date, err)
+			}
+			got := []jsonutil.JSONToken(ja)
+			if len(got) != len(test.want) {
+				t.Fatalf("SplitTime(%s, %s) returned %d components, want %d", test.format, test.date, len(got), len(test.want))
+			}
+			for i := range got {
+				c, ok := got[i].(jsonutil.JSONStr)
+				if !ok {
+					t.Errorf("SplitTime(%s, %s) = %dth component %v in wrong type, want JSONStr", test.format, test.date, i+1, got[i])
+				}
+				if string(c) != test.want[i] {
+					t.Errorf("SplitTime(%s, %s) = %dth component %s, want %s", test.format, test.date, i+1, c, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestISOWeek(t *testing.T) {
+	tests := []struct {
+		name, format, date string
+		wantYear, wantWeek int
+		wantStr            string
+	}{
+		{name: "mid year", format: "2006-01-02", date: "2020-01-30", wantYear: 2020, wantWeek: 5, wantStr: "2020-W05"},
+		{name: "sunday before week 1", format: "2006-01-02", date: "2019-12-29", wantYear: 2019, wantWeek: 52, wantStr: "2019-W52"},
+		{name: "december in next year", format: "2006-01-02", date: "2019-12-30", wantYear: 2020, wantWeek: 1, wantStr: "2020-W01"},
+		{name: "december 31 in next year", format: "2006-01-02", date: "2008-12-31", wantYear: 2009, wantWeek: 1, wantStr: "2009-W01"},
+		{name: "january 1 in week 1", format: "2006-01-02", date: "2020-01-01", wantYear: 2020, wantWeek: 1, wantStr: "2020-W01"},
+		{name: "january 1 in previous year", format: "2006-01-02", date: "2021-01-01", wantYear: 2020, wantWeek: 53, wantStr: "2020-W53"},
+		{name: "january 3 in previous year", format: "2006-01-02", date: "2021-01-03", wantYear: 2020, wantWeek: 53, wantStr: "2020-W53"},
+		{name: "monday of week 1", format: "2006-01-02", date: "2021-01-04", wantYear: 2021, wantWeek: 1, wantStr: "2021-W01"},
+		{name: "december 31 in week 53", format: "2006-01-02", date: "2015-12-31", wantYear: 2015, wantWeek: 53, wantStr: "2015-W53"},
+		{name: "january 2 in week 52", format: "2006-01-02", date: "2022-01-02", wantYear: 2021, wantWeek: 52, wantStr: "2021-W52"},
+		{name: "datetime", format: time.RFC3339, date: "2019-12-30T23:59:59Z", wantYear: 2020, wantWeek: 1, wantStr: "2020-W01"},
+		{name: "python format", format: "%Y-%m-%d", date: "2021-01-03", wantYear: 2020, wantWeek: 53, wantStr: "2020-W53"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ISOWeek(jsonutil.JSONStr(test.date), jsonutil.JSONStr(test.format))
+			if err != nil {
+				t.Fatalf("ISOWeek(%s, %s) returned error: %v", test.date, test.format, err)
+			}
+			y, w := jsonutil.JSONToken(jsonutil.JSONNum(test.wantYear)), jsonutil.JSONToken(jsonutil.JSONNum(test.wantWeek))
+			want := jsonutil.JSONContainer{"isoYear": &y, "isoWeek": &w}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("ISOWeek(%s, %s) returned diff (-want +got):\n%s", test.date, test.format, diff)
+			}
+
+			gotStr, err := FormatISOWeekDate(jsonutil.JSONStr(test.date), jsonutil.JSONStr(test.format))
+			if err != nil {
+				t.Fatalf("FormatISOWeekDate(%s, %s) returned error: %v", test.date, test.format, err)
+			}
+			if string(gotStr) != test.wantStr {
+				t.Errorf("FormatISOWeekDate(%s, %s) = %s, want %s", test.date, test.format, gotStr, test.wantStr)
+			}
+		})
+	}
+}
+
+func TestISOWeek_EmptyAndInvalid(t *testing.T) {
+	if got, err := ISOWeek("", "2006-01-02"); err != nil || len(got) != 0 {
+		t.Errorf("ISOWeek(\"\", 2006-01-02) = %v, %v, want an empty object", got, err)
+	}
+	if got, err := FormatISOWeekDate("", "2006-01-02"); err != nil || got != "" {
+		t.Errorf("FormatISOWeekDate(\"\", 2006-01-02) = %q, %v, want an empty string", got, err)
+	}
+	if got, err := ISOWeek("2020/01/30", "2006-01-02"); err == nil {
+		t.Errorf("ISOWeek(2020/01/30, 2006-01-02) = %v, want error", got)
+	}
+	if got, err := FormatISOWeekDate("2020/01/30", "2006-01-02"); err == nil {
+		t.Errorf("FormatISOWeekDate(2020/01/30, 2006-01-02) = %q, want error", got)
+	}
+}
+
+func TestReformatTime(t *testing.T) {
+	tests := []struct {
+		name, inFormat, outFormat, date, want string
+		wantErr                               bool
+	}{
+		{
+			name:      "identity operation",
+			inFormat:  "2006_01_02 15:04:05.000",
+			date:      "2019_04_10 10:20:49.123",
+			outFormat: "2006_01_02 15:04:05.000",
+			want:      "2019_04_10 10:20:49.123",
+		},
+		{
+			name:      "less precise output format",
+			inFormat:  "2006_01_02 15:04:05.000",
+			date:      "2019_04_10 10:20:49.123",
+			outFormat: "2006_01_02",
+			want:      "2019_04_10",
+		},
+		{
+			name:      "date format mismatch",
+			inFormat:  "2006_01_02",
+			date:      "2019 04 10",
+			outFormat: "2006_01_02",
+			wantErr:   true,
+		},
+		{
+			name:      "python format to python format",
+			inFormat:  "%Y-%m-%dT%H:%M:%S%z",
+			date:      "2019-04-05T05:06:07+10:00",
+			outFormat: "%e/%m/%y:%H-%M-%S",
+			want:      "5/04/19:05-06-07",
+		},
+		{
+			name:      "python format to go format",
+			inFormat:  "%Y-%m-%dT%H:%M:%S%z",
+			date:      "2019-04-05T05:06:07+10:00",
+			outFormat: "2/01/06:15-04-05",
+			want:      "5/04/19:05-06-07",
+		},
+		{
+			name:      "go format to python format",
+			inFormat:  "2006_01_02 15:04:05.000",
+			date:      "2019_04_10 10:20:49.123",
+			outFormat: "%e/%m/%y:%H-%M-%S",
+			want:      "10/04/19:10-20-49",
+		},
+		{
+			name:     "implicitly illegal python format",
+			inFormat: "%bu%H-%M-%s",
+			date:     "Febu16:17:28",
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ReformatTime(jsonutil.JSONStr(test.inFormat), jsonutil.JSONStr(test.date), jsonutil.JSONStr(test.outFormat))
+			if err != nil != test.wantErr {
+				var wantErrStr string
+				if !test.wantErr {
+					wantErrStr = "no "
+				}
+				t.Errorf("ReformatTime(%s, %s, %s) expected %serror, got %v %v", test.inFormat, test.date, test.outFormat, wantErrStr, got, err)
+			}
+
+			if string(got) != test.want {
+				t.Errorf("ReformatTime(%s, %s, %s) = %s, want %s", test.inFormat, test.date, test.outFormat, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCurrentTime(t *testing.T) {
+	tests := []struct {
+		name, inFormat, timeZone, wantRegex string
+		wantError                           bool
+	}{
+		{
+			name:      "date and empty timezone",
+			inFormat:  "2006-01-02",
+			timeZone:  "",
+			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2}",
+		},
+		{
+			name:      "date, time and empty timezone",
+			inFormat:  "2007-01-02 03:04:05-0700 MST",
+			timeZone:  "",
+			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}[+-][0-9]{4} UTC",
+		},
+		{
+			name:      "date and timezone",
+			inFormat:  "2007-01-02 MST",
+			timeZone:  "Europe/Berlin",
+			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2} CE[S]T",
+		},
+		{
+			name:      "date, time and timezone",
+			inFormat:  "2007-01-02 03:04:05-0700 MST",
+			timeZone:  "America/Chicago",
+			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}[+-][0-9]{4} C[S|D]T",
+		},
+		{
+			name:      "invalid layout",
+			inFormat:  "InvalidValue",
+			wantRegex: "InvalidValue",
+		},
+		{
+			name:      "empty layout",
+			inFormat:  "",
+			timeZone:  "Europe/Berlin",
+			wantRegex: "[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2}",
+		},
+		{
+			name:      "Invalid IANA Time Zone value",
+			inFormat:  "",
+			timeZone:  "Europe/Unknown",
+			wantError: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wantRegExp := regexp.MustCompile(test.wantRegex)
+			got, err := CurrentTime(jsonutil.JSONStr(test.inFormat), jsonutil.JSONStr(test.timeZone))
+			if err != nil && !test.wantError {
+				t.Errorf("CurrentTime(%s) = Error - %v", test.inFormat, err)
+			}
+			if !wantRegExp.MatchString(string(got)) && !test.wantError {
+				t.Errorf("CurrentTime(%s) = got %s, doesn't conform to %s", test.inFormat, got, wantRegExp)
+			}
+			if err == nil && test.wantError {
+				t.Errorf("Received unexpected error (%v)", err)
+			}
+		})
+	}
+}
+
+func TestNewCurrentTime(t *testing.T) {
+	now := func() time.Time { return time.Date(2021, time.March, 4, 15, 30, 0, 0, time.UTC) }
+	got, err := NewCurrentTime(now)("2006-01-02 15:04 MST", "Europe/Berlin")
+	if err != nil {
+		t.Fatalf("CurrentTime returned unexpected error %v", err)
+	}
+	if want := jsonutil.JSONStr("2021-03-04 16:30 CET"); got != want {
+		t.Errorf("CurrentTime = %q, want %q", got, want)
+	}
+}
+
+func TestRandomUUID(t *testing.T) {
+	uuids := func(seed int64) []jsonutil.JSONStr {
+		r := rand.New(rand.NewSource(seed))
+		var ids []jsonutil.JSONStr
+		for i := 0; i < 3; i++ {
+			id, err := RandomUUID(r)
+			if err != nil {
+				t.Fatalf("RandomUUID returned unexpected error %v", err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	got := uuids(42)
+	if diff := cmp.Diff(got, uuids(42)); diff != "" {
+		t.Errorf("RandomUUID returned different UUIDs for the same seed (-first +second):\n%s", diff)
+	}
+	if got[0] == got[1] || got[1] == got[2] {
+		t.Errorf("RandomUUID returned repeated UUIDs %v", got)
+	}
+	if cmp.Equal(got, uuids(43)) {
+		t.Errorf("RandomUUID returned the same UUIDs %v for different seeds", got)
+	}
+	for _, id := range got {
+		if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(string(id)) {
+			t.Errorf("RandomUUID returned %q, want a version 4 UUID", id)
+		}
+	}
+
+	if _, err := RandomUUID(strings.NewReader("short")); err == nil {
+		t.Errorf("RandomUUID of a short reader returned no error, want one")
+	}
+}
+
+func TestListOf(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  []jsonutil.JSONToken
+	}{
+		{
+			name: "multiple arguments",
+			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("abc"), jsonutil.JSONStr("def"), jsonutil.JSONStr("ghi")},
+		},
+		{
+			name: "single argument",
+			arg:  []jsonutil.JSONToken{jsonutil.JSONStr("GET")},
+		},
+		{
+			name: "empty argument",
+			arg:  []jsonutil.JSONToken{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := jsonutil.JSONArr(test.arg)
+			got, err := ListOf(test.arg...)
+			if err != nil {
+				t.Fatalf("Test %s returned unexpected error %v", test.name, err)
+			}
+			if !cmp.Equal(got, want) {
+				t.Errorf("ListOf(%v) = %v, want %v", test.arg, got, want)
+			}
+		})
+	}
+}
+
+func TestRepeat(t *testing.T) {
+	tests := []struct {
+		name string
+		item jsonutil.JSONToken
+		n    jsonutil.JSONNum
+		want jsonutil.JSONArr
+	}{
+		{
+			name: "zero",
+			item: jsonutil.JSONStr("a"),
+			n:    0,
+			want: jsonutil.JSONArr{},
+		},
+		{
+			name: "primitive",
+			item: jsonutil.JSONStr("a"),
+			n:    3,
+			want: mustParseArray(json.RawMessage(`["a", "a", "a"]`), t),
+		},
+		{
+			name: "null",
+			item: nil,
+			n:    2,
+			want: mustParseArray(json.RawMessage(`[null, null]`), t),
+		},
+		{
+			name: "object",
+			item: mustParseContainer(json.RawMessage(`{"code": {"text": "unknown"}}`), t),
+			n:    2,
+			want: mustParseArray(json.RawMessage(`[{"code": {"text": "unknown"}}, {"code": {"text": "unknown"}}]`), t),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Repeat(test.item, test.n)
+			if err != nil {
+				t.Fatalf("Repeat(%v, %v) returned unexpected error %v", test.item, test.n, err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Repeat(%v, %v) returned diff (-want +got):\n%s", test.item, test.n, diff)
+			}
+		})
+	}
+}
+
+func TestRepeat_Copies(t *testing.T) {
+	item := mustParseContainer(json.RawMessage(`{"code": {"text": "unknown"}}`), t)
+	got, err := Repeat(item, 2)
+	if err != nil {
+		t.Fatalf("Repeat(%v, 2) returned unexpected error %v", item, err)
+	}
+
+	var changed jsonutil.JSONToken = jsonutil.JSONStr("changed")
+	code := (*got[0].(jsonutil.JSONContainer)["code"]).(jsonutil.JSONContainer)
+	code["text"] = &changed
+
+	want := mustParseArray(json.RawMessage(`[{"code": {"text": "changed"}}, {"code": {"text": "unknown"}}]`), t)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("modifying one element of Repeat(%v, 2) returned diff (-want +got):\n%s", item, diff)
+	}
+	if diff := cmp.Diff(mustParseContainer(json.RawMessage(`{"code": {"text": "unknown"}}`), t), item); diff != "" {
+		t.Errorf("modifying one element of Repeat(%v, 2) modified the item (-want +got):\n%s", item, diff)
+	}
+}
+
+func TestPadList(t *testing.T) {
+	tests := []struct {
+		name   string
+		arr    jsonutil.JSONArr
+		n      jsonutil.JSONNum
+		filler jsonutil.JSONToken
+		want   jsonutil.JSONArr
+	}{
+		{
+			name:   "nil array",
+			arr:    nil,
+			n:      2,
+			filler: jsonutil.JSONStr("x"),
+			want:   mustParseArray(json.RawMessage(`["x", "x"]`), t),
+		},
+		{
+			name:   "padded",
+			arr:    mustParseArray(json.RawMessage(`[{"code": "A01"}]`), t),
+			n:      3,
+			filler: mustParseContainer(json.RawMessage(`{"code": null}`), t),
+			want:   mustParseArray(json.RawMessage(`[{"code": "A01"}, {"code": null}, {"code": null}]`), t),
+		},
+		{
+			name:   "already long enough",
+			arr:    mustParseArray(json.RawMessage(`[1, 2, 3]`), t),
+			n:      3,
+			filler: jsonutil.JSONNum(0),
+			want:   mustParseArray(json.RawMessage(`[1, 2, 3]`), t),
+		},
+		{
+			name:   "longer is not truncated",
+			arr:    mustParseArray(json.RawMessage(`[1, 2, 3, 4]`), t),
+			n:      2,
+			filler: jsonutil.JSONNum(0),
+			want:   mustParseArray(json.RawMessage(`[1, 2, 3, 4]`), t),
+		},
+		{
+			name:   "zero",
+			arr:    jsonutil.JSONArr{},
+			n:      0,
+			filler: jsonutil.JSONNum(0),
+			want:   jsonutil.JSONArr{},
+		},
+		{
+			name:   "null filler",
+			arr:    mustParseArray(json.RawMessage(`[1]`), t),
+			n:      2,
+			filler: nil,
+			want:   mustParseArray(json.RawMessage(`[1, null]`), t),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := PadList(test.arr, test.n, test.filler)
+			if err != nil {
+				t.Fatalf("PadList(%v, %v, %v) returned unexpected error %v", test.arr, test.n, test.filler, err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("PadList(%v, %v, %v) returned diff (-want +got):\n%s", test.arr, test.n, test.filler, diff)
+			}
+		})
+	}
+}
+
+func TestRepeatAndPadList_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       jsonutil.JSONNum
+		wantErr string
+	}{
+		{
+			name:    "negative",
+			n:       -1,
+			wantErr: "non-negative integer",
+		},
+		{
+			name:    "fractional",
+			n:       1.5,
+			wantErr: "non-negative integer",
+		},
+		{
+			name:    "over the cap",
+			n:       1000001,
+			wantErr: "at most 1000000",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Repeat(jsonutil.JSONStr("a"), test.n); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Repeat(a, %v) returned error %v, want error containing %q", test.n, err, test.wantErr)
+			}
+			if _, err := PadList(jsonutil.JSONArr{}, test.n, jsonutil.JSONStr("a")); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("PadList([], %v, a) returned error %v, want error containing %q", test.n, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestListCat(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  []jsonutil.JSONArr
+		want jsonutil.JSONArr
+	}{
+		{
+			name: "no arguments",
+			arg:  []jsonutil.JSONArr{},
+			want: jsonutil.JSONArr{},
+		},
+		{
+			name: "one empty argument",
+			arg:  []jsonutil.JSONArr{{}},
+			want: jsonutil.JSONArr{},
+		},
+		{
+			name: "one argument",
+			arg:  []jsonutil.JSONArr{{jsonutil.JSONStr("foo")}},
+			want: jsonutil.JSONArr{jsonutil.JSONStr("foo")},
+		},
+		{
+			name: "multiple arguments",
+			arg:  []jsonutil.JSONArr{{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar")}, {jsonutil.JSONStr("baz"), jsonutil.JSONStr("quip")}},
+			want: jsonutil.JSONArr{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar"), jsonutil.JSONStr("baz"), jsonutil.JSONStr("quip")},
+		},
+		{
+			name: "multiple arguments with empties",
+			arg:  []jsonutil.JSONArr{{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar")}, {}, {jsonutil.JSONStr("baz"), jsonutil.JSONStr("quip")}},
+			want: jsonutil.JSONArr{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar"), jsonutil.JSONStr("baz"), jsonutil.JSONStr("quip")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ListCat(test.arg...)
+			if err != nil {
+				t.Fatalf("ListCat(%v) returned unexpected error %v", test.arg, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("ListCat(%v) = %v, want %v", test.arg, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSample(t *testing.T) {
+	arr := mustParseArray(json.RawMessage(`["a", "b", "c", "d", "e"]`), t)
+	tests := []struct {
+		name string
+		arr  jsonutil.JSONArr
+		seed jsonutil.JSONStr
+		want jsonutil.JSONToken
+	}{
+		{
+			name: "empty",
+			arr:  jsonutil.JSONArr{},
+			seed: "seed",
+			want: nil,
+		},
+		{
+			name: "single",
+			arr:  mustParseArray(json.RawMessage(`["a"]`), t),
+			seed: "seed",
+			want: jsonutil.JSONStr("a"),
+		},
+		{
+			name: "seed",
+			arr:  arr,
+			seed: "seed",
+			want: jsonutil.JSONStr("c"),
+		},
+		{
+			name: "other seed",
+			arr:  arr,
+			seed: "patient-1",
+			want: jsonutil.JSONStr("d"),
+		},
+		{
+			name: "empty seed",
+			arr:  arr,
+			seed: "",
+			want: jsonutil.JSONStr("a"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				got, err := Sample(test.arr, test.seed)
+				if err != nil {
+					t.Fatalf("Sample(%v, %q) returned unexpected error %v", test.arr, test.seed, err)
+				}
+				if diff := cmp.Diff(test.want, got); diff != "" {
+					t.Errorf("Sample(%v, %q) returned diff (-want +got):\n%s", test.arr, test.seed, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestShuffle(t *testing.T) {
+	arr := mustParseArray(json.RawMessage(`[1, 2, 3, 4, 5, 6]`), t)
+	tests := []struct {
+		name string
+		arr  jsonutil.JSONArr
+		seed jsonutil.JSONStr
+		want jsonutil.JSONArr
+	}{
+		{
+			name: "empty",
+			arr:  jsonutil.JSONArr{},
+			seed: "seed",
+			want: jsonutil.JSONArr{},
+		},
+		{
+			name: "single",
+			arr:  mustParseArray(json.RawMessage(`[1]`), t),
+			seed: "seed",
+			want: mustParseArray(json.RawMessage(`[1]`), t),
+		},
+		{
+			name: "seed",
+			arr:  arr,
+			seed: "seed",
+			want: mustParseArray(json.RawMessage(`[2, 6, 3, 4, 1, 5]`), t),
+		},
+		{
+			name: "other seed",
+			arr:  arr,
+			seed: "patient-1",
+			want: mustParseArray(json.RawMessage(`[2, 5, 4, 1, 6, 3]`), t),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				got, err := Shuffle(test.arr, test.seed)
+				if err != nil {
+					t.Fatalf("Shuffle(%v, %q) returned unexpected error %v", test.arr, test.seed, err)
+				}
+				if diff := cmp.Diff(test.want, got); diff != "" {
+					t.Errorf("Shuffle(%v, %q) returned diff (-want +got):\n%s", test.arr, test.seed, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestShuffle_DoesNotModifyInput(t *testing.T) {
+	arr := mustParseArray(json.RawMessage(`[1, 2, 3, 4, 5, 6]`), t)
+	want := mustParseArray(json.RawMessage(`[1, 2, 3, 4, 5, 6]`), t)
+	if _, err := Shuffle(arr, "seed"); err != nil {
+		t.Fatalf("Shuffle(%v, \"seed\") returned unexpected error %v", arr, err)
+	}
+	if diff := cmp.Diff(want, arr); diff != "" {
+		t.Errorf("Shuffle modified its input, diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranspose(t *testing.T) {
+	row := func(items ...jsonutil.JSONToken) jsonutil.JSONArr {
+		return jsonutil.JSONArr(items)
+	}
+	n := func(f float64) jsonutil.JSONToken {
+		return jsonutil.JSONNum(f)
+	}
+	tests := []struct {
+		name        string
+		arr         jsonutil.JSONArr
+		allowRagged []jsonutil.JSONBool
+		want        jsonutil.JSONArr
+	}{
+		{
+			name: "3x2 into 2x3",
+			arr:  row(row(n(1), n(2)), row(n(3), n(4)), row(n(5), n(6))),
+			want: row(row(n(1), n(3), n(5)), row(n(2), n(4), n(6))),
+		},
+		{
+			name:        "3x2 into 2x3 with allowRagged",
+			arr:         row(row(n(1), n(2)), row(n(3), n(4)), row(n(5), n(6))),
+			allowRagged: []jsonutil.JSONBool{true},
+			want:        row(row(n(1), n(3), n(5)), row(n(2), n(4), n(6))),
+		},
+		{
+			name:        "ragged rows are padded",
+			arr:         row(row(n(1)), row(n(2), n(3), n(4)), nil, row(n(5), n(6))),
+			allowRagged: []jsonutil.JSONBool{true},
+			want:        row(row(n(1), n(2), nil, n(5)), row(nil, n(3), nil, n(6)), row(nil, n(4), nil, nil)),
+		},
+		{
+			name: "empty",
+			arr:  row(),
+			want: jsonutil.JSONArr{},
+		},
+		{
+			name: "empty rows",
+			arr:  row(row(), row()),
+			want: jsonutil.JSONArr{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Transpose(test.arr, test.allowRagged...)
+			if err != nil {
+				t.Fatalf("Transpose(%v, %v) returned unexpected error %v", test.arr, test.allowRagged, err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Transpose(%v, %v) returned diff (-want +got):\n%s", test.arr, test.allowRagged, diff)
+			}
+		})
+	}
+}
+
+func TestTranspose_Copies(t *testing.T) {
+	var v jsonutil.JSONToken = jsonutil.JSONStr("a")
+	in := jsonutil.JSONArr{jsonutil.JSONArr{jsonutil.JSONContainer{"v": &v}}}
+
+	got, err := Transpose(in)
+	if err != nil {
+		t.Fatalf("Transpose(%v) returned unexpected error %v", in, err)
+	}
+	var changed jsonutil.JSONToken = jsonutil.JSONStr("b")
+	got[0].(jsonutil.JSONArr)[0].(jsonutil.JSONContainer)["v"] = &changed
+
+	if want := (jsonutil.JSONArr{jsonutil.JSONArr{jsonutil.JSONContainer{"v": &v}}}); !cmp.Equal(in, want) {
+		t.Errorf("modifying the result of Transpose changed the input to %v", in)
+	}
+}
+
+func TestTranspose_Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		arr         jsonutil.JSONArr
+		allowRagged []jsonutil.JSONBool
+		wantErr     string
+	}{
+		{
+			name:    "ragged rows",
+			arr:     jsonutil.JSONArr{jsonutil.JSONArr{jsonutil.JSONNum(1), jsonutil.JSONNum(2)}, jsonutil.JSONArr{jsonutil.JSONNum(3)}},
+			wantErr: "row 1 has 1 elements but row 0 has 2",
+		},
+		{
+			name:        "ragged rows not allowed",
+			arr:         jsonutil.JSONArr{jsonutil.JSONArr{jsonutil.JSONNum(1)}, jsonutil.JSONArr{jsonutil.JSONNum(2), jsonutil.JSONNum(3)}},
+			allowRagged: []jsonutil.JSONBool{false},
+			wantErr:     "row 1 has 2 elements but row 0 has 1",
+		},
+		{
+			name:    "row is not an array",
+			arr:     jsonutil.JSONArr{jsonutil.JSONArr{jsonutil.JSONNum(1)}, jsonutil.JSONNum(2)},
+			wantErr: "row 1 is not an array",
+		},
+		{
+			name:        "too many arguments",
+			arr:         jsonutil.JSONArr{},
+			allowRagged: []jsonutil.JSONBool{true, true},
+			wantErr:     "at most 1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := Transpose(test.arr, test.allowRagged...); err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Transpose(%v, %v) = %v, %v, want error containing %q", test.arr, test.allowRagged, got, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestUnionBy(t *testing.T) {
+	tests := []struct {
+		name  string
+		items jsonutil.JSONArr
+		keys  []jsonutil.JSONStr
+		want  jsonutil.JSONArr
+	}{
+		{
+			name:  "one item no keys",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			keys:  []jsonutil.JSONStr{},
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+		},
+		{
+			name:  "multiple items no keys",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}]`), t),
+			keys:  []jsonutil.JSONStr{},
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+		},
+		{
+			name:  "one item one key",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			keys:  []jsonutil.JSONStr{"id"},
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+		},
+		{
+			name:  "one item one non-existent key",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			keys:  []jsonutil.JSONStr{"nonexistentkey"},
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+		},
+		{
+			name:  "multiple items one occasionally non-existent key",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2, "foo": "hello"}]`), t),
+			keys:  []jsonutil.JSONStr{"foo"},
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2, "foo": "hello"}]`), t),
+		},
+		{
+			name:  "multiple items with one often non-existent key",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}, {"id": 3, "foo": "hello"}]`), t),
+			keys:  []jsonutil.JSONStr{"foo"},
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 3, "foo": "hello"}]`), t),
+		},
+		{
+			name:  "multiple items with shared key",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 3}]`), t),
+			keys:  []jsonutil.JSONStr{"id"},
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}, {"id": 3}]`), t),
+		},
+		{
+			name:  "multiple items with multiple keys",
+			items: mustParseArray(json.RawMessage(`[{"id": 1, "foo": "hello"}, {"id": 2, "foo": "hello"}, {"id": 3, "foo": "world"}, {"id": 3, "foo": "world"}, {"id": 4, "foo": "world"}]`), t),
+			keys:  []jsonutil.JSONStr{"id", "foo"},
+			want:  mustParseArray(json.RawMessage(`[{"id": 1, "foo": "hello"}, {"id": 2, "foo": "hello"}, {"id": 3, "foo": "world"}, {"id": 4, "foo": "world"}]`), t),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := UnionBy(test.items, test.keys...)
+			if err != nil {
+				t.Fatalf("UnionBy(%v, %v) returned unexpected error %v", test.items, test.keys, err)
+			}
+
+			sliceLessFn := func(a, b jsonutil.JSONToken) bool {
+				t.Helper()
+				ah, err := jsonutil.Hash(a, false)
+				if err != nil {
+					t.Fatalf("error hashing %v: %v", a, err)
+				}
+				bh, err := jsonutil.Hash(b, false)
+				if err != nil {
+					t.Fatalf("error hashing %v: %v", b, err)
+				}
+				return hex.EncodeToString(ah) < hex.EncodeToString(bh)
+			}
+
+			mapLessFn := func(a, b string) bool {
+				return a < b
+			}
+
+			if !cmp.Equal(got, test.want, cmpopts.SortSlices(sliceLessFn), cmpopts.SortMaps(mapLessFn)) {
+				t.Errorf("UnionBy(%v, %v) = %v, want %v", test.items, test.keys, got, test.want)
+			}
+		})
+	}
+}
+
+func BenchmarkUnionBy(b *testing.B) {
+	b.ReportAllocs()
+	items := make(jsonutil.JSONArr, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		system := jsonutil.JSONToken(jsonutil.JSONStr(fmt.Sprintf("system-%d", i%10)))
+		code := jsonutil.JSONToken(jsonutil.JSONStr(fmt.Sprintf("code-%d", i%1000)))
+		version := jsonutil.JSONToken(jsonutil.JSONNum(i % 3))
+		items = append(items, jsonutil.JSONContainer{
+			"system":  &system,
+			"code":    &code,
+			"version": &version,
+		})
+	}
+	keys := []jsonutil.JSONStr{"system", "code", "version"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := UnionBy(items, keys...); err != nil {
+			b.Fatalf("UnionBy(...) returned unexpected error %v", err)
+		}
+	}
+}
+
+func TestNEq(t *testing.T) {
+	tests := []struct {
+		name string
+		args []jsonutil.JSONToken
+		want jsonutil.JSONBool
+	}{
+		{
+			name: "no args",
+			args: []jsonutil.JSONToken{},
+			want: true,
+		},
+		{
+			name: "different strings",
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("a"), jsonutil.JSONStr("b")},
+			want: true,
+		},
+		{
+			name: "same strings",
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("a"), jsonutil.JSONStr("a")},
+			want: false,
+		},
+		{
+			name: "same numbers",
+			args: []jsonutil.JSONToken{jsonutil.JSONNum(1), jsonutil.JSONNum(1)},
+			want: false,
+		},
+		{
+			name: "string and number",
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("1"), jsonutil.JSONNum(1)},
+			want: true,
+		},
+		{
+			name: "same bools",
+			args: []jsonutil.JSONToken{jsonutil.JSONBool(true), jsonutil.JSONBool(true)},
+			want: false,
+		},
+		{
+			name: "nils",
+			args: []jsonutil.JSONToken{nil, nil},
+			want: false,
+		},
+		{
+			name: "containers with different key order",
+			args: []jsonutil.JSONToken{
+				mustParseContainer(json.RawMessage(`{"a": 1, "b": 2}`), t),
+				mustParseContainer(json.RawMessage(`{"b": 2, "a": 1}`), t),
+			},
+			want: false,
+		},
+		{
+			name: "many different args",
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("a"), jsonutil.JSONNum(1), mustParseContainer(json.RawMessage(`{"a": 1}`), t)},
+			want: true,
+		},
+		{
+			name: "many args with one repeat",
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("a"), jsonutil.JSONNum(1), jsonutil.JSONStr("a")},
+			want: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NEq(test.args...)
+			if err != nil {
+				t.Fatalf("NEq(%v) returned unexpected error %v", test.args, err)
+			}
+			if got != test.want {
+				t.Errorf("NEq(%v) = %v, want %v", test.args, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNEq_Allocs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []jsonutil.JSONToken
+	}{
+		{
+			name: "strings",
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("a"), jsonutil.JSONStr("b")},
+		},
+		{
+			name: "numbers",
+			args: []jsonutil.JSONToken{jsonutil.JSONNum(1), jsonutil.JSONNum(1)},
+		},
+		{
+			name: "bools",
+			args: []jsonutil.JSONToken{jsonutil.JSONBool(true), jsonutil.JSONBool(false)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allocs := testing.AllocsPerRun(100, func() {
+				if _, err := NEq(test.args...); err != nil {
+					t.Fatalf("NEq(%v) returned unexpected error %v", test.args, err)
+				}
+			})
+			if allocs != 0 {
+				t.Errorf("NEq(%v) made %v allocations, want 0", test.args, allocs)
+			}
+		})
+	}
+}
+
+func TestUnique(t *testing.T) {
+	tests := []struct {
+		name  string
+		items jsonutil.JSONArr
+		want  jsonutil.JSONArr
+	}{
+		{
+			name:  "nil",
+			items: nil,
+			want:  mustParseArray(json.RawMessage(`[]`), t),
+		},
+		{
+			name:  "no items",
+			items: mustParseArray(json.RawMessage(`[]`), t),
+			want:  mustParseArray(json.RawMessage(`[]`), t),
+		},
+		{
+			name:  "one item",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+		},
+		{
+			name:  "multiple items all unique",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}]`), t),
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}]`), t),
+		},
+		{
+			name:  "multiple items some unique - same key order",
+			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 1}]`), t),
+			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+		},
+		{
+			name:  "multiple items some unique - different key order",
+			items: mustParseArray(json.RawMessage(`[{"key": "val", "id": 1}, {"id": 1, "key": "val"}]`), t),
+			want:  mustParseArray(json.RawMessage(`[{"id": 1, "key": "val"}]`), t),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Unique(test.items)
+			if err != nil {
+				t.Fatalf("Unique(%v) returned unexpected error %v", test.items, err)
+			}
+
+			sliceLessFn := func(a, b jsonutil.JSONToken) bool {
+				t.Helper()
+				ah, err := jsonutil.Hash(a, false)
+				if err != nil {
+					t.Fatalf("error hashing %v: %v", a, err)
+				}
+				bh, err := jsonutil.Hash(b, false)
+				if err != nil {
+					t.Fatalf("error hashing %v: %v", b, err)
+				}
+				return hex.EncodeToString(ah) < hex.EncodeToString(bh)
+			}
+
+			mapLessFn := func(a, b string) bool {
+				return a < b
+			}
+
+			if !cmp.Equal(got, test.want, cmpopts.SortSlices(sliceLessFn), cmpopts.SortMaps(mapLessFn)) {
+				t.Errorf("Unique(%v) = %v, want %v", test.items, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchesRegex(t *testing.T) {
+	tests := []struct {
+		name  string
+		str   jsonutil.JSONStr
+		regex jsonutil.JSONStr
+		want  jsonutil.JSONBool
+	}{
+		{
+			name:  "matches",
+			str:   jsonutil.JSONStr("123"),
+			regex: jsonutil.JSONStr("\\d+"),
+			want:  jsonutil.JSONBool(true),
+		},
+		{
+			name:  "not matches",
+			str:   jsonutil.JSONStr("abc"),
+			regex: jsonutil.JSONStr("\\d+"),
+			want:  jsonutil.JSONBool(false),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := MatchesRegex(test.str, test.regex)
+			if err != nil {
+				t.Fatalf("MatchesRegex(%v, %v) returned unexpected error %v", test.str, test.regex, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("MatchesRegex(%v, %v) = %v, want %v", test.str, test.regex, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseInt(t *testing.T) {
+	tests := []struct {
+		name string
+		in   jsonutil.JSONStr
+		want jsonutil.JSONNum
+	}{
+		{
+			name: "single test",
+			in:   jsonutil.JSONStr("123"),
+			want: jsonutil.JSONNum(123),
+		},
+		{
+			name: "negative one",
+			in:   jsonutil.JSONStr("-1"),
+			want: jsonutil.JSONNum(-1),
+		},
+		{
+			name: "leading plus sign",
+			in:   jsonutil.JSONStr("+42"),
+			want: jsonutil.JSONNum(42),
+		},
+		{
+			name: "leading zeros",
+			in:   jsonutil.JSONStr("007"),
+			want: jsonutil.JSONNum(7),
+		},
+		{
+			name: "beyond 32 bits",
+			in:   jsonutil.JSONStr("12345678901"),
+			want: jsonutil.JSONNum(12345678901),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseInt(test.in)
+			if err != nil {
+				t.Fatalf("ParseInt(%v) returned unexpected error %v", test.in, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("ParseInt(%v) = %v, want %v", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseInt_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      jsonutil.JSONStr
+		wantErr string
+	}{
+		{
+			name:    "overflow",
+			in:      jsonutil.JSONStr("92233720368547758070"),
+			wantErr: `could not parse "92233720368547758070" as an integer: value out of range`,
+		},
+		{
+			name:    "negative overflow",
+			in:      jsonutil.JSONStr("-92233720368547758090"),
+			wantErr: `could not parse "-92233720368547758090" as an integer: value out of range`,
+		},
+		{
+			name:    "underscores",
+			in:      jsonutil.JSONStr("1_000"),
+			wantErr: `could not parse "1_000" as an integer: invalid syntax`,
+		},
+		{
+			name:    "decimal",
+			in:      jsonutil.JSONStr("1.5"),
+			wantErr: `could not parse "1.5" as an integer: invalid syntax`,
+		},
+		{
+			name:    "hexadecimal",
+			in:      jsonutil.JSONStr("0x1F"),
+			wantErr: `could not parse "0x1F" as an integer: invalid syntax`,
+		},
+		{
+			name:    "empty",
+			in:      jsonutil.JSONStr(""),
+			wantErr: `could not parse "" as an integer: invalid syntax`,
+		},
+		{
+			name:    "long input is truncated",
+			in:      jsonutil.JSONStr(strings.Repeat("1234567890", 10)),
+			wantErr: `could not parse "12345678901234567890123456789012..." as an integer: value out of range`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseInt(test.in)
+			if err == nil {
+				t.Fatalf("ParseInt(%v) = %v, want error", test.in, got)
+			}
+			if err.Error() != test.wantErr {
+				t.Errorf("ParseInt(%v) returned error %q, want %q", test.in, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseFloat(t *testing.T) {
+	tests := []struct {
+		name string
+		in   jsonutil.JSONStr
+		want jsonutil.JSONNum
+	}{
+		{
+			name: "with floating point",
+			in:   jsonutil.JSONStr("123.123"),
+			want: jsonutil.JSONNum(123.123),
+		},
+		{
+			name: "without floating point",
+			in:   jsonutil.JSONStr("123"),
+			want: jsonutil.JSONNum(123),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseFloat(test.in)
+			if err != nil {
+				t.Fatalf("ParseFloat(%v) returned unexpected error %v", test.in, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("ParseFloat(%v) = %v, want %v", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStrFmt(t *testing.T) {
+	tests := []struct {
+		name string
+		in   jsonutil.JSONToken
+		fmt  jsonutil.JSONStr
+		want jsonutil.JSONStr
+	}{
+		{
+			name: "boolean",
+			in:   jsonutil.JSONBool(true),
+			fmt:  jsonutil.JSONStr("%v"),
+			want: jsonutil.JSONStr("true"),
+		},
+		{
+			name: "string",
+			in:   jsonutil.JSONStr("this is a string"),
+			fmt:  jsonutil.JSONStr("%s"),
+			want: jsonutil.JSONStr("this is a string"),
+		},
+		{
+			name: "quoted string",
+			in:   jsonutil.JSONStr("this is a string"),
+			fmt:  jsonutil.JSONStr("%q"),
+			want: jsonutil.JSONStr(`"this is a string"`),
+		},
+		{
+			name: "integer",
+			in:   jsonutil.JSONNum(123),
+			fmt:  jsonutil.JSONStr("%d"),
+			want: jsonutil.JSONStr("123"),
+		},
+		{
+			name: "binary integer",
+			in:   jsonutil.JSONNum(3),
+			fmt:  jsonutil.JSONStr("%b"),
+			want: jsonutil.JSONStr("11"),
+		},
+		{
+			name: "float",
+			in:   jsonutil.JSONNum(123.456),
+			fmt:  jsonutil.JSONStr("%f"),
+			want: jsonutil.JSONStr("123.456000"),
+		},
+		{
+			name: "array",
+			in:   jsonutil.JSONArr{jsonutil.JSONStr("a"), jsonutil.JSONStr("b")},
+			fmt:  jsonutil.JSONStr("%v"),
+			want: jsonutil.JSONStr(`["a","b"]`),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := StrFmt(test.fmt, test.in)
+			if err != nil {
+				t.Fatalf("StrFmt(%v) returned unexpected error %v", test.in, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("StrFmt(%v) = %v, want %v", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestToLower(t *testing.T) {
+	tests := []struct {
+		name string
+		in   jsonutil.JSONStr
+		want jsonutil.JSONStr
+	}{
 		{
-			name: "one empty argument",
-			arg:  []jsonutil.JSONArr{{}},
-			want: jsonutil.JSONArr{},
+			name: "english",
+			in:   jsonutil.JSONStr("ABCdef"),
+			want: jsonutil.JSONStr("abcdef"),
 		},
 		{
-			name: "one argument",
-			arg:  []jsonutil.JSONArr{{jsonutil.JSONStr("foo")}},
-			want: jsonutil.JSONArr{jsonutil.JSONStr("foo")},
+			name: "not english",
+			in:   jsonutil.JSONStr("АБСдеф"),
+			want: jsonutil.JSONStr("абсдеф"),
 		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ToLower(test.in)
+			if err != nil {
+				t.Fatalf("ToLower(%v) returned unexpected error %v", test.in, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("ToLower(%v) = %v, want %v", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestToUpper(t *testing.T) {
+	tests := []struct {
+		name string
+		in   jsonutil.JSONStr
+		want jsonutil.JSONStr
+	}{
 		{
-			name: "multiple arguments",
-			arg:  []jsonutil.JSONArr{{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar")}, {jsonutil.JSONStr("baz"), jsonutil.JSONStr("quip")}},
-			want: jsonutil.JSONArr{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar"), jsonutil.JSONStr("baz"), jsonutil.JSONStr("quip")},
+			name: "english",
+			in:   jsonutil.JSONStr("abcDEF"),
+			want: jsonutil.JSONStr("ABCDEF"),
 		},
 		{
-			name: "multiple arguments with empties",
-			arg:  []jsonutil.JSONArr{{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar")}, {}, {jsonutil.JSONStr("baz"), jsonutil.JSONStr("quip")}},
-			want: jsonutil.JSONArr{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar"), jsonutil.JSONStr("baz"), jsonutil.JSONStr("quip")},
+			name: "not english",
+			in:   jsonutil.JSONStr("АБСдеф"),
+			want: jsonutil.JSONStr("АБСДЕФ"),
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := ListCat(test.arg...)
+			got, err := ToUpper(test.in)
 			if err != nil {
-				t.Fatalf("ListCat(%v) returned unexpected error %v", test.arg, err)
+				t.Fatalf("ToUpper(%v) returned unexpected error %v", test.in, err)
 			}
 			if !cmp.Equal(got, test.want) {
-				t.Errorf("ListCat(%v) = %v, want %v", test.arg, got, test.want)
+				t.Errorf("ToUpper(%v) = %v, want %v", test.in, got, test.want)
 			}
 		})
 	}
 }
 
-func TestUnionBy(t *testing.T) {
+func TestWordWrap(t *testing.T) {
 	tests := []struct {
-		name  string
-		items jsonutil.JSONArr
-		keys  []jsonutil.JSONStr
-		want  jsonutil.JSONArr
+		name    string
+		in      jsonutil.JSONStr
+		width   jsonutil.JSONNum
+		newline jsonutil.JSONStr
+		want    jsonutil.JSONStr
 	}{
 		{
-			name:  "one item no keys",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
-			keys:  []jsonutil.JSONStr{},
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			name:    "breaks at whitespace",
+			in:      "the quick brown fox jumps",
+			width:   10,
+			newline: "\n",
+			want:    "the quick\nbrown fox\njumps",
 		},
 		{
-			name:  "multiple items no keys",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}]`), t),
-			keys:  []jsonutil.JSONStr{},
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			name:    "line of exactly width",
+			in:      "abcde fghij",
+			width:   5,
+			newline: "\n",
+			want:    "abcde\nfghij",
 		},
 		{
-			name:  "one item one key",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
-			keys:  []jsonutil.JSONStr{"id"},
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			name:    "custom newline",
+			in:      "one two three",
+			width:   7,
+			newline: "<br/>",
+			want:    "one two<br/>three",
 		},
 		{
-			name:  "one item one non-existent key",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
-			keys:  []jsonutil.JSONStr{"nonexistentkey"},
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			name:    "long words are not split",
+			in:      "a verylongword b",
+			width:   4,
+			newline: "\n",
+			want:    "a\nverylongword\nb",
 		},
 		{
-			name:  "multiple items one occasionally non-existent key",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2, "foo": "hello"}]`), t),
-			keys:  []jsonutil.JSONStr{"foo"},
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2, "foo": "hello"}]`), t),
+			name:    "whitespace runs at breaks are replaced",
+			in:      "ab  \t cd  ef",
+			width:   6,
+			newline: "\n",
+			want:    "ab\ncd  ef",
 		},
 		{
-			name:  "multiple items with one often non-existent key",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}, {"id": 3, "foo": "hello"}]`), t),
-			keys:  []jsonutil.JSONStr{"foo"},
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 3, "foo": "hello"}]`), t),
+			name:    "existing line breaks are kept",
+			in:      "aaa bbb\nccc ddd eee",
+			width:   7,
+			newline: "<br/>",
+			want:    "aaa bbb\nccc ddd<br/>eee",
 		},
 		{
-			name:  "multiple items with shared key",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 3}]`), t),
-			keys:  []jsonutil.JSONStr{"id"},
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}, {"id": 3}]`), t),
+			name:    "leading and trailing whitespace are kept",
+			in:      "  ab cd ",
+			width:   10,
+			newline: "\n",
+			want:    "  ab cd ",
 		},
 		{
-			name:  "multiple items with multiple keys",
-			items: mustParseArray(json.RawMessage(`[{"id": 1, "foo": "hello"}, {"id": 2, "foo": "hello"}, {"id": 3, "foo": "world"}, {"id": 3, "foo": "world"}, {"id": 4, "foo": "world"}]`), t),
-			keys:  []jsonutil.JSONStr{"id", "foo"},
-			want:  mustParseArray(json.RawMessage(`[{"id": 1, "foo": "hello"}, {"id": 2, "foo": "hello"}, {"id": 3, "foo": "world"}, {"id": 4, "foo": "world"}]`), t),
+			name:    "multi-byte runes",
+			in:      "日本語 日本語 日本語",
+			width:   7,
+			newline: "\n",
+			want:    "日本語 日本語\n日本語",
+		},
+		{
+			name:    "short string",
+			in:      "short",
+			width:   80,
+			newline: "\n",
+			want:    "short",
+		},
+		{
+			name:    "empty string",
+			in:      "",
+			width:   5,
+			newline: "\n",
+			want:    "",
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := UnionBy(test.items, test.keys...)
+			got, err := WordWrap(test.in, test.width, test.newline)
 			if err != nil {
-				t.Fatalf("UnionBy(%v, %v) returned unexpected error %v", test.items, test.keys, err)
-			}
-
-			sliceLessFn := func(a, b jsonutil.JSONToken) bool {
-				t.Helper()
-				ah, err := jsonutil.Hash(a, false)
-				if err != nil {
-					t.Fatalf("error hashing %v: %v", a, err)
-				}
-				bh, err := jsonutil.Hash(b, false)
-				if err != nil {
-					t.Fatalf("error hashing %v: %v", b, err)
-				}
-				return hex.EncodeToString(ah) < hex.EncodeToString(bh)
-			}
-
-			mapLessFn := func(a, b string) bool {
-				return a < b
+				t.Fatalf("WordWrap(%q, %v, %q) returned unexpected error %v", test.in, test.width, test.newline, err)
 			}
-
-			if !cmp.Equal(got, test.want, cmpopts.SortSlices(sliceLessFn), cmpopts.SortMaps(mapLessFn)) {
-				t.Errorf("UnionBy(%v, %v) = %v, want %v", test.items, test.keys, got, test.want)
+			if got != test.want {
+				t.Errorf("WordWrap(%q, %v, %q) = %q, want %q", test.in, test.width, test.newline, got, test.want)
 			}
 		})
 	}
 }
 
-func TestUnique(t *testing.T) {
+func TestWordWrap_Errors(t *testing.T) {
+	for _, width := range []jsonutil.JSONNum{0, -1, 2.5} {
+		if _, err := WordWrap("a b", width, "\n"); err == nil {
+			t.Errorf("WordWrap(a b, %v, \\n) returned no error, want one for the invalid width", width)
+		}
+	}
+}
+
+func TestDebugString(t *testing.T) {
 	tests := []struct {
-		name  string
-		items jsonutil.JSONArr
-		want  jsonutil.JSONArr
+		name string
+		in   jsonutil.JSONToken
+		want jsonutil.JSONStr
 	}{
 		{
-			name:  "nil",
-			items: nil,
-			want:  mustParseArray(json.RawMessage(`[]`), t),
-		},
-		{
-			name:  "no items",
-			items: mustParseArray(json.RawMessage(`[]`), t),
-			want:  mustParseArray(json.RawMessage(`[]`), t),
+			name: "boolean",
+			in:   jsonutil.JSONBool(true),
+			want: jsonutil.JSONStr("true"),
 		},
 		{
-			name:  "one item",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			name: "string",
+			in:   jsonutil.JSONStr("this is a string"),
+			want: jsonutil.JSONStr("this is a string"),
 		},
 		{
-			name:  "multiple items all unique",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}]`), t),
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 2}]`), t),
+			name: "integer",
+			in:   jsonutil.JSONNum(123),
+			want: jsonutil.JSONStr("123"),
 		},
 		{
-			name:  "multiple items some unique - same key order",
-			items: mustParseArray(json.RawMessage(`[{"id": 1}, {"id": 1}]`), t),
-			want:  mustParseArray(json.RawMessage(`[{"id": 1}]`), t),
+			name: "float",
+			in:   jsonutil.JSONNum(123.456),
+			want: jsonutil.JSONStr("123.456"),
 		},
 		{
-			name:  "multiple items some unique - different key order",
-			items: mustParseArray(json.RawMessage(`[{"key": "val", "id": 1}, {"id": 1, "key": "val"}]`), t),
-			want:  mustParseArray(json.RawMessage(`[{"id": 1, "key": "val"}]`), t),
+			name: "array",
+			in:   jsonutil.JSONArr{jsonutil.JSONStr("a"), jsonutil.JSONStr("b")},
+			want: jsonutil.JSONStr(`["a","b"]`),
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := Unique(test.items)
+			got, err := DebugString(test.in)
 			if err != nil {
-				t.Fatalf("Unique(%v) returned unexpected error %v", test.items, err)
-			}
-
-			sliceLessFn := func(a, b jsonutil.JSONToken) bool {
-				t.Helper()
-				ah, err := jsonutil.Hash(a, false)
-				if err != nil {
-					t.Fatalf("error hashing %v: %v", a, err)
-				}
-				bh, err := jsonutil.Hash(b, false)
-				if err != nil {
-					t.Fatalf("error hashing %v: %v", b, err)
-				}
-				return hex.EncodeToString(ah) < hex.EncodeToString(bh)
-			}
-
-			mapLessFn := func(a, b string) bool {
-				return a < b
+				t.Fatalf("DebugString(%v) returned unexpected error %v", test.in, err)
 			}
-
-			if !cmp.Equal(got, test.want, cmpopts.SortSlices(sliceLessFn), cmpopts.SortMaps(mapLessFn)) {
-				t.Errorf("Unique(%v) = %v, want %v", test.items, got, test.want)
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("DebugString(%v) = %v, want %v", test.in, got, test.want)
 			}
 		})
 	}
 }
 
-func TestMatchesRegex(t *testing.T) {
+func TestMergeJSON(t *testing.T) {
 	tests := []struct {
-		name  string
-		str   jsonutil.JSONStr
-		regex jsonutil.JSONStr
-		want  jsonutil.JSONBool
+		name            string
+		in              jsonutil.JSONArr
+		want            jsonutil.JSONToken
+		overwriteArrays jsonutil.JSONBool
 	}{
 		{
-			name:  "matches",
-			str:   jsonutil.JSONStr("123"),
-			regex: jsonutil.JSONStr("\\d+"),
-			want:  jsonutil.JSONBool(true),
+			name: "empty array",
+			in:   mustParseArray(json.RawMessage(`[]`), t),
+			want: nil,
 		},
 		{
-			name:  "not matches",
-			str:   jsonutil.JSONStr("abc"),
-			regex: jsonutil.JSONStr("\\d+"),
-			want:  jsonutil.JSONBool(false),
+			name: "empty objects",
+			in:   mustParseArray(json.RawMessage(`[{}]`), t),
+			want: mustParseContainer(json.RawMessage(`{}`), t),
+		},
+		{
+			name: "no matching keys",
+			in:   mustParseArray(json.RawMessage(`[{"key1":"val1"}, {"key2":"val2"}]`), t),
+			want: mustParseContainer(json.RawMessage(`{"key1":"val1", "key2":"val2"}`), t),
+		},
+		{
+			name: "primitives only",
+			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}, {"key":"val2"}]`), t),
+			want: mustParseContainer(json.RawMessage(`{"key":"val2"}`), t),
+		},
+		{
+			name: "primitives only",
+			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}, {"key":"val2"}, {"key":"val3"}]`), t),
+			want: mustParseContainer(json.RawMessage(`{"key":"val3"}`), t),
+		},
+		{
+			name: "arrays only",
+			in:   mustParseArray(json.RawMessage(`[{"key":["val1"]}, {"key":["val2"]}]`), t),
+			want: mustParseContainer(json.RawMessage(`{"key":["val1","val2"]}`), t),
+		},
+		{
+			name: "primitives and arrays",
+			in:   mustParseArray(json.RawMessage(`[{"key":"val1", "arr": ["aval1"]}, {"key":"val2", "arr": ["aval2"]}]`), t),
+			want: mustParseContainer(json.RawMessage(`{"key":"val2", "arr": ["aval1", "aval2"]}`), t),
+		},
+		{
+			name: "complex type in array",
+			in:   mustParseArray(json.RawMessage(`[{"arr": [{"key":"aval1"}]}, {"arr": [{"key":"aval2"}]}]`), t),
+			want: mustParseContainer(json.RawMessage(`{"arr": [{"key":"aval1"}, {"key":"aval2"}]}`), t),
+		},
+		{
+			name:            "array overwrite",
+			in:              mustParseArray(json.RawMessage(`[{"arr": [{"key":"aval1"}]}, {"arr": [{"key":"aval2"}]}]`), t),
+			want:            mustParseContainer(json.RawMessage(`{"arr": [{"key":"aval2"}]}`), t),
+			overwriteArrays: true,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := MatchesRegex(test.str, test.regex)
+			got, err := MergeJSON(test.in, test.overwriteArrays)
 			if err != nil {
-				t.Fatalf("MatchesRegex(%v, %v) returned unexpected error %v", test.str, test.regex, err)
+				t.Fatalf("MergeJSON(%v) returned unexpected error %v", test.in, err)
 			}
 			if !cmp.Equal(got, test.want) {
-				t.Errorf("MatchesRegex(%v, %v) = %v, want %v", test.str, test.regex, got, test.want)
+				t.Errorf("MergeJSON(%v) = %v, want %v", test.in, got, test.want)
 			}
 		})
 	}
 }
 
-func TestParseInt(t *testing.T) {
+func TestMergeDuplicates(t *testing.T) {
 	tests := []struct {
-		name string
-		in   jsonutil.JSONStr
-		want jsonutil.JSONNum
+		name      string
+		resources string
+		keyPaths  jsonutil.JSONArr
+		want      string
 	}{
 		{
-			name: "single test",
-			in:   jsonutil.JSONStr("123"),
-			want: jsonutil.JSONNum(123),
+			name:      "empty",
+			resources: `[]`,
+			want:      `[]`,
+		},
+		{
+			name: "default keys",
+			resources: `[
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "gender": "male", "name": [{"family": "Doe"}]},
+				{"resourceType": "Patient", "identifier": [{"value": "2"}], "gender": "female"},
+				{"resourceType": "Encounter", "identifier": [{"value": "1"}]},
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "birthDate": "1970-01-01", "name": [{"family": "Doe"}, {"given": ["John"]}]}
+			]`,
+			want: `[
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "gender": "male", "birthDate": "1970-01-01", "name": [{"family": "Doe"}, {"given": ["John"]}]},
+				{"resourceType": "Patient", "identifier": [{"value": "2"}], "gender": "female"},
+				{"resourceType": "Encounter", "identifier": [{"value": "1"}]}
+			]`,
+		},
+		{
+			name: "identifiers in any order",
+			resources: `[
+				{"resourceType": "Patient", "identifier": [{"value": "1"}, {"value": "2"}]},
+				{"resourceType": "Patient", "identifier": [{"value": "2"}, {"value": "1"}], "active": true}
+			]`,
+			want: `[
+				{"resourceType": "Patient", "identifier": [{"value": "1"}, {"value": "2"}], "active": true}
+			]`,
+		},
+		{
+			name: "last primitive wins",
+			resources: `[
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "gender": "male", "contact": {"name": {"text": "A"}}},
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "gender": "unknown", "contact": {"name": {"text": "B"}}}
+			]`,
+			want: `[
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "gender": "unknown", "contact": {"name": {"text": "B"}}}
+			]`,
+		},
+		{
+			name: "missing keys are not merged",
+			resources: `[
+				{"resourceType": "Patient", "gender": "male"},
+				{"resourceType": "Patient", "identifier": [], "gender": "female"},
+				{"resourceType": "Patient", "gender": "male"}
+			]`,
+			want: `[
+				{"resourceType": "Patient", "gender": "male"},
+				{"resourceType": "Patient", "identifier": [], "gender": "female"},
+				{"resourceType": "Patient", "gender": "male"}
+			]`,
+		},
+		{
+			name: "custom keys",
+			resources: `[
+				{"resourceType": "Observation", "subject": {"reference": "Patient/1"}, "code": {"text": "bp"}, "note": [{"text": "a"}]},
+				{"resourceType": "Observation", "subject": {"reference": "Patient/2"}, "code": {"text": "bp"}},
+				{"resourceType": "Observation", "subject": {"reference": "Patient/1"}, "code": {"text": "bp"}, "note": [{"text": "a"}, {"text": "b"}]}
+			]`,
+			keyPaths: jsonutil.JSONArr{jsonutil.JSONStr("subject.reference"), jsonutil.JSONStr("code.text")},
+			want: `[
+				{"resourceType": "Observation", "subject": {"reference": "Patient/1"}, "code": {"text": "bp"}, "note": [{"text": "a"}, {"text": "b"}]},
+				{"resourceType": "Observation", "subject": {"reference": "Patient/2"}, "code": {"text": "bp"}}
+			]`,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := ParseInt(test.in)
+			resources := mustParseArray(json.RawMessage(test.resources), t)
+			want := mustParseArray(json.RawMessage(test.want), t)
+			got, err := MergeDuplicates(resources, test.keyPaths)
 			if err != nil {
-				t.Fatalf("ParseInt(%v) returned unexpected error %v", test.in, err)
+				t.Fatalf("MergeDuplicates(%v, %v) returned unexpected error %v", resources, test.keyPaths, err)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("ParseInt(%v) = %v, want %v", test.in, got, test.want)
+			if !cmp.Equal(got, want) {
+				t.Errorf("MergeDuplicates(%v, %v) = %v, want %v", resources, test.keyPaths, got, want)
 			}
 		})
 	}
 }
 
-func TestParseFloat(t *testing.T) {
+func TestMergeDuplicates_DoesNotModifyInput(t *testing.T) {
+	resources := mustParseArray(json.RawMessage(`[
+		{"resourceType": "Patient", "identifier": [{"value": "1"}], "name": [{"family": "Doe"}]},
+		{"resourceType": "Patient", "identifier": [{"value": "1"}], "name": [{"given": ["John"]}]}
+	]`), t)
+	want := jsonutil.Deepcopy(resources)
+	if _, err := MergeDuplicates(resources, nil); err != nil {
+		t.Fatalf("MergeDuplicates(%v, nil) returned unexpected error %v", resources, err)
+	}
+	if !cmp.Equal(resources, want) {
+		t.Errorf("MergeDuplicates modified its input to %v, want %v", resources, want)
+	}
+}
+
+func TestMergeDuplicates_Errors(t *testing.T) {
 	tests := []struct {
-		name string
-		in   jsonutil.JSONStr
-		want jsonutil.JSONNum
+		name      string
+		resources string
+		keyPaths  jsonutil.JSONArr
+		wantErr   string
 	}{
 		{
-			name: "with floating point",
-			in:   jsonutil.JSONStr("123.123"),
-			want: jsonutil.JSONNum(123.123),
+			name:      "non string key path",
+			resources: `[]`,
+			keyPaths:  jsonutil.JSONArr{jsonutil.JSONNum(1)},
+			wantErr:   "key path at index 0 must be a string but was jsonutil.JSONNum",
 		},
 		{
-			name: "without floating point",
-			in:   jsonutil.JSONStr("123"),
-			want: jsonutil.JSONNum(123),
+			name: "type mismatch",
+			resources: `[
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "name": {"text": "John"}},
+				{"resourceType": "Patient", "identifier": [{"value": "2"}]},
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "name": [{"text": "John"}]}
+			]`,
+			wantErr: `could not merge resource at index 2 into its duplicate at index 0: can not merge jsonutil.JSONArr into jsonutil.JSONContainer at "name"`,
+		},
+		{
+			name: "nested type mismatch",
+			resources: `[
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "contact": {"name": "John"}},
+				{"resourceType": "Patient", "identifier": [{"value": "1"}], "contact": {"name": {"text": "John"}}}
+			]`,
+			wantErr: `could not merge resource at index 1 into its duplicate at index 0: can not merge jsonutil.JSONContainer into jsonutil.JSONStr at "contact.name"`,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := ParseFloat(test.in)
-			if err != nil {
-				t.Fatalf("ParseFloat(%v) returned unexpected error %v", test.in, err)
-			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("ParseFloat(%v) = %v, want %v", test.in, got, test.want)
+			resources := mustParseArray(json.RawMessage(test.resources), t)
+			_, err := MergeDuplicates(resources, test.keyPaths)
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("MergeDuplicates(%v, %v) returned error %v, want %q", resources, test.keyPaths, err, test.wantErr)
 			}
 		})
 	}
 }
 
-func TestStrFmt(t *testing.T) {
+func TestObjOf(t *testing.T) {
 	tests := []struct {
-		name string
-		in   jsonutil.JSONToken
-		fmt  jsonutil.JSONStr
-		want jsonutil.JSONStr
+		name    string
+		args    []jsonutil.JSONToken
+		want    jsonutil.JSONContainer
+		wantErr bool
 	}{
 		{
-			name: "boolean",
-			in:   jsonutil.JSONBool(true),
-			fmt:  jsonutil.JSONStr("%v"),
-			want: jsonutil.JSONStr("true"),
-		},
-		{
-			name: "string",
-			in:   jsonutil.JSONStr("this is a string"),
-			fmt:  jsonutil.JSONStr("%s"),
-			want: jsonutil.JSONStr("this is a string"),
+			name: "no pairs",
+			want: jsonutil.JSONContainer{},
 		},
 		{
-			name: "quoted string",
-			in:   jsonutil.JSONStr("this is a string"),
-			fmt:  jsonutil.JSONStr("%q"),
-			want: jsonutil.JSONStr(`"this is a string"`),
+			name: "pairs",
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("system"), jsonutil.JSONStr("http://loinc.org"), jsonutil.JSONStr("rank"), jsonutil.JSONNum(1)},
+			want: mustParseContainer(json.RawMessage(`{"system": "http://loinc.org", "rank": 1}`), t),
 		},
 		{
-			name: "integer",
-			in:   jsonutil.JSONNum(123),
-			fmt:  jsonutil.JSONStr("%d"),
-			want: jsonutil.JSONStr("123"),
+			name: "nil and empty values are skipped",
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("gender"), nil, jsonutil.JSONStr("code"), jsonutil.JSONStr(""), jsonutil.JSONStr("active"), jsonutil.JSONBool(false)},
+			want: mustParseContainer(json.RawMessage(`{"active": false}`), t),
 		},
 		{
-			name: "binary integer",
-			in:   jsonutil.JSONNum(3),
-			fmt:  jsonutil.JSONStr("%b"),
-			want: jsonutil.JSONStr("11"),
+			name:    "odd number of arguments",
+			args:    []jsonutil.JSONToken{jsonutil.JSONStr("system"), jsonutil.JSONStr("x"), jsonutil.JSONStr("code")},
+			wantErr: true,
 		},
 		{
-			name: "float",
-			in:   jsonutil.JSONNum(123.456),
-			fmt:  jsonutil.JSONStr("%f"),
-			want: jsonutil.JSONStr("123.456000"),
+			name:    "non-string key",
+			args:    []jsonutil.JSONToken{jsonutil.JSONNum(1), jsonutil.JSONStr("x")},
+			wantErr: true,
 		},
 		{
-			name: "array",
-			in:   jsonutil.JSONArr{jsonutil.JSONStr("a"), jsonutil.JSONStr("b")},
-			fmt:  jsonutil.JSONStr("%v"),
-			want: jsonutil.JSONStr(`["a","b"]`),
+			name:    "duplicate key",
+			args:    []jsonutil.JSONToken{jsonutil.JSONStr("a"), nil, jsonutil.JSONStr("a"), jsonutil.JSONStr("x")},
+			wantErr: true,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := StrFmt(test.fmt, test.in)
-			if err != nil {
-				t.Fatalf("StrFmt(%v) returned unexpected error %v", test.in, err)
+			got, err := ObjOf(test.args...)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("ObjOf(%v) returned error %v, want error %v", test.args, err, test.wantErr)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("StrFmt(%v) = %v, want %v", test.in, got, test.want)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("ObjOf(%v) returned diff (-want +got):\n%s", test.args, diff)
 			}
 		})
 	}
 }
 
-func TestToLower(t *testing.T) {
+func BenchmarkMergeJSON(b *testing.B) {
+	arr := mustParseBenchmarkInput(json.RawMessage(`[
+		{"id": "1", "name": [{"given": ["Jane"], "family": "Doe"}], "meta": {"source": "a", "tag": ["x"]}},
+		{"id": "1", "gender": "female", "meta": {"source": "b", "tag": ["y", "z"]}},
+		{"birthDate": "1970-01-01", "name": [{"use": "official"}], "active": true}
+	]`), b).(jsonutil.JSONArr)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := MergeJSON(arr, false); err != nil {
+			b.Fatalf("MergeJSON(%v, false) returned unexpected error %v", arr, err)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
 	tests := []struct {
 		name string
 		in   jsonutil.JSONStr
-		want jsonutil.JSONStr
+		want jsonutil.JSONToken
 	}{
 		{
-			name: "english",
-			in:   jsonutil.JSONStr("ABCdef"),
-			want: jsonutil.JSONStr("abcdef"),
+			name: "empty",
+			in:   "",
+			want: nil,
 		},
 		{
-			name: "not english",
-			in:   jsonutil.JSONStr("АБСдеф"),
-			want: jsonutil.JSONStr("абсдеф"),
+			name: "scalar",
+			in:   "foo",
+			want: jsonutil.JSONStr("foo"),
+		},
+		{
+			name: "object",
+			in:   "a: 1\nb: [x, yes]\n",
+			want: mustParseContainer(json.RawMessage(`{"a": 1, "b": ["x", "yes"]}`), t),
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := ToLower(test.in)
+			got, err := ParseYAML(test.in)
 			if err != nil {
-				t.Fatalf("ToLower(%v) returned unexpected error %v", test.in, err)
+				t.Fatalf("ParseYAML(%q) returned unexpected error %v", test.in, err)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("ToLower(%v) = %v, want %v", test.in, got, test.want)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("ParseYAML(%q) got diff (-want +got):\n%s", test.in, diff)
 			}
 		})
 	}
 }
 
-func TestToUpper(t *testing.T) {
+func TestParseYAML_Errors(t *testing.T) {
+	if got, err := ParseYAML("? [a]\n: b\n"); err == nil {
+		t.Errorf("ParseYAML with a sequence key = %v, want error", got)
+	}
+}
+
+func TestRedactExcept(t *testing.T) {
+	resource := json.RawMessage(`{
+		"resourceType": "Patient",
+		"active": true,
+		"multipleBirthInteger": 2,
+		"deceasedBoolean": null,
+		"name": [{"family": "Doe", "given": ["Jane"]}, {"family": "Roe", "given": ["Janet", "J"]}],
+		"meta": {"source": "ehr", "tag": ["x"]}
+	}`)
+
 	tests := []struct {
-		name string
-		in   jsonutil.JSONStr
-		want jsonutil.JSONStr
+		name    string
+		keep    jsonutil.JSONArr
+		want    json.RawMessage
+		wantErr bool
 	}{
 		{
-			name: "english",
-			in:   jsonutil.JSONStr("abcDEF"),
-			want: jsonutil.JSONStr("ABCDEF"),
+			name: "keep nothing",
+			keep: jsonutil.JSONArr{},
+			want: json.RawMessage(`{
+				"resourceType": "[REDACTED]",
+				"active": "[REDACTED]",
+				"multipleBirthInteger": "[REDACTED]",
+				"deceasedBoolean": null,
+				"name": [{"family": "[REDACTED]", "given": ["[REDACTED]"]}, {"family": "[REDACTED]", "given": ["[REDACTED]", "[REDACTED]"]}],
+				"meta": {"source": "[REDACTED]", "tag": ["[REDACTED]"]}
+			}`),
+		},
+		{
+			name: "keep fields and containers",
+			keep: jsonutil.JSONArr{jsonutil.JSONStr("resourceType"), jsonutil.JSONStr("active"), jsonutil.JSONStr("meta")},
+			want: json.RawMessage(`{
+				"resourceType": "Patient",
+				"active": true,
+				"multipleBirthInteger": "[REDACTED]",
+				"deceasedBoolean": null,
+				"name": [{"family": "[REDACTED]", "given": ["[REDACTED]"]}, {"family": "[REDACTED]", "given": ["[REDACTED]", "[REDACTED]"]}],
+				"meta": {"source": "ehr", "tag": ["x"]}
+			}`),
+		},
+		{
+			name: "keep with wildcard",
+			keep: jsonutil.JSONArr{jsonutil.JSONStr("name[*].family")},
+			want: json.RawMessage(`{
+				"resourceType": "[REDACTED]",
+				"active": "[REDACTED]",
+				"multipleBirthInteger": "[REDACTED]",
+				"deceasedBoolean": null,
+				"name": [{"family": "Doe", "given": ["[REDACTED]"]}, {"family": "Roe", "given": ["[REDACTED]", "[REDACTED]"]}],
+				"meta": {"source": "[REDACTED]", "tag": ["[REDACTED]"]}
+			}`),
+		},
+		{
+			name: "keep specific index",
+			keep: jsonutil.JSONArr{jsonutil.JSONStr("name[1].given[0]"), jsonutil.JSONStr("multipleBirthInteger")},
+			want: json.RawMessage(`{
+				"resourceType": "[REDACTED]",
+				"active": "[REDACTED]",
+				"multipleBirthInteger": 2,
+				"deceasedBoolean": null,
+				"name": [{"family": "[REDACTED]", "given": ["[REDACTED]"]}, {"family": "[REDACTED]", "given": ["Janet", "[REDACTED]"]}],
+				"meta": {"source": "[REDACTED]", "tag": ["[REDACTED]"]}
+			}`),
+		},
+		{
+			name: "unknown path is not an error",
+			keep: jsonutil.JSONArr{jsonutil.JSONStr("telecom[*].value"), jsonutil.JSONStr("resourceType")},
+			want: json.RawMessage(`{
+				"resourceType": "Patient",
+				"active": "[REDACTED]",
+				"multipleBirthInteger": "[REDACTED]",
+				"deceasedBoolean": null,
+				"name": [{"family": "[REDACTED]", "given": ["[REDACTED]"]}, {"family": "[REDACTED]", "given": ["[REDACTED]", "[REDACTED]"]}],
+				"meta": {"source": "[REDACTED]", "tag": ["[REDACTED]"]}
+			}`),
+		},
+		{
+			name:    "non-string path",
+			keep:    jsonutil.JSONArr{jsonutil.JSONNum(1)},
+			wantErr: true,
 		},
 		{
-			name: "not english",
-			in:   jsonutil.JSONStr("АБСдеф"),
-			want: jsonutil.JSONStr("АБСДЕФ"),
+			name:    "invalid path",
+			keep:    jsonutil.JSONArr{jsonutil.JSONStr("name..family")},
+			wantErr: true,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := ToUpper(test.in)
+			in := mustParseContainer(resource, t)
+			orig := jsonutil.Deepcopy(in)
+
+			got, err := RedactExcept(in, test.keep)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("RedactExcept(%v, %v) expected error but got nil", in, test.keep)
+				}
+				return
+			}
 			if err != nil {
-				t.Fatalf("ToUpper(%v) returned unexpected error %v", test.in, err)
+				t.Fatalf("RedactExcept(%v, %v) returned unexpected error %v", in, test.keep, err)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("ToUpper(%v) = %v, want %v", test.in, got, test.want)
+			if want := mustParseContainer(test.want, t); !cmp.Equal(got, want) {
+				t.Errorf("RedactExcept(%v, %v) = %v, want %v", in, test.keep, got, want)
+			}
+			if !cmp.Equal(in, orig) {
+				t.Errorf("RedactExcept(%v, %v) modified its input", in, test.keep)
 			}
 		})
 	}
 }
 
-func TestDebugString(t *testing.T) {
+func TestJoinPath(t *testing.T) {
 	tests := []struct {
-		name string
-		in   jsonutil.JSONToken
-		want jsonutil.JSONStr
+		name     string
+		segments []jsonutil.JSONStr
+		want     jsonutil.JSONStr
+		wantErr  bool
 	}{
 		{
-			name: "boolean",
-			in:   jsonutil.JSONBool(true),
-			want: jsonutil.JSONStr("true"),
+			name:     "fields",
+			segments: []jsonutil.JSONStr{"name", "family"},
+			want:     "name.family",
 		},
 		{
-			name: "string",
-			in:   jsonutil.JSONStr("this is a string"),
-			want: jsonutil.JSONStr("this is a string"),
+			name:     "array indices",
+			segments: []jsonutil.JSONStr{"name", "[1]", "given", "[*]"},
+			want:     "name[1].given[*]",
 		},
 		{
-			name: "integer",
-			in:   jsonutil.JSONNum(123),
-			want: jsonutil.JSONStr("123"),
+			name:     "empty segments and dots",
+			segments: []jsonutil.JSONStr{"", "name.", " ", ".family"},
+			want:     "name.family",
 		},
 		{
-			name: "float",
-			in:   jsonutil.JSONNum(123.456),
-			want: jsonutil.JSONStr("123.456"),
+			name:     "dotted segment",
+			segments: []jsonutil.JSONStr{"meta", "tag[0].code"},
+			want:     "meta.tag[0].code",
 		},
 		{
-			name: "array",
-			in:   jsonutil.JSONArr{jsonutil.JSONStr("a"), jsonutil.JSONStr("b")},
-			want: jsonutil.JSONStr(`["a","b"]`),
+			name:     "numeric field",
+			segments: []jsonutil.JSONStr{"codes", "3"},
+			want:     "codes.3",
+		},
+		{
+			name: "no segments",
+			want: "",
+		},
+		{
+			name:     "invalid character",
+			segments: []jsonutil.JSONStr{"name", "fam!ly"},
+			wantErr:  true,
+		},
+		{
+			name:     "consecutive dots",
+			segments: []jsonutil.JSONStr{"name", "a..b"},
+			wantErr:  true,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := DebugString(test.in)
+			got, err := JoinPath(test.segments...)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("JoinPath(%v) expected error but got %q", test.segments, got)
+				}
+				return
+			}
 			if err != nil {
-				t.Fatalf("DebugString(%v) returned unexpected error %v", test.in, err)
+				t.Fatalf("JoinPath(%v) returned unexpected error %v", test.segments, err)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("DebugString(%v) = %v, want %v", test.in, got, test.want)
+			if got != test.want {
+				t.Errorf("JoinPath(%v) = %q, want %q", test.segments, got, test.want)
 			}
 		})
 	}
 }
 
-func TestMergeJSON(t *testing.T) {
+func TestSplitPath(t *testing.T) {
 	tests := []struct {
-		name            string
-		in              jsonutil.JSONArr
-		want            jsonutil.JSONToken
-		overwriteArrays jsonutil.JSONBool
+		path    jsonutil.JSONStr
+		want    jsonutil.JSONArr
+		wantErr bool
+	}{
+		{path: "", want: jsonutil.JSONArr{}},
+		{path: "name", want: jsonutil.JSONArr{jsonutil.JSONStr("name")}},
+		{path: "name[1].given[*]", want: jsonutil.JSONArr{jsonutil.JSONStr("name"), jsonutil.JSONStr("[1]"), jsonutil.JSONStr("given"), jsonutil.JSONStr("[*]")}},
+		{path: "codes.3", want: jsonutil.JSONArr{jsonutil.JSONStr("codes"), jsonutil.JSONStr("3")}},
+		{path: `a\.b.c`, want: jsonutil.JSONArr{jsonutil.JSONStr("a.b"), jsonutil.JSONStr("c")}},
+		{path: "a..b", wantErr: true},
+		{path: "a/b", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := SplitPath(test.path)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("SplitPath(%q) expected error but got %v", test.path, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("SplitPath(%q) returned unexpected error %v", test.path, err)
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("SplitPath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestJoinPathSplitPath_GetField(t *testing.T) {
+	doc := mustParseContainer(json.RawMessage(`{
+		"name": [{"family": "Doe", "given": ["Jane"]}, {"family": "Roe", "given": ["Janet", "J"]}],
+		"codes": {"3": "three"},
+		"meta": {"tag": [{"code": "x"}]}
+	}`), t)
+
+	tests := []struct {
+		segments []jsonutil.JSONStr
+		want     jsonutil.JSONToken
+	}{
+		{segments: []jsonutil.JSONStr{"name", "[1]", "family"}, want: jsonutil.JSONStr("Roe")},
+		{segments: []jsonutil.JSONStr{"name", "[1]", "given", "[0]"}, want: jsonutil.JSONStr("Janet")},
+		{segments: []jsonutil.JSONStr{"name", "[*]", "family"}, want: jsonutil.JSONArr{jsonutil.JSONStr("Doe"), jsonutil.JSONStr("Roe")}},
+		{segments: []jsonutil.JSONStr{"codes", "3"}, want: jsonutil.JSONStr("three")},
+		{segments: []jsonutil.JSONStr{"", "meta.", "tag[0]", "code"}, want: jsonutil.JSONStr("x")},
+		{segments: []jsonutil.JSONStr{"name", "[5]"}, want: nil},
+	}
+	for _, test := range tests {
+		path, err := JoinPath(test.segments...)
+		if err != nil {
+			t.Fatalf("JoinPath(%v) returned unexpected error %v", test.segments, err)
+		}
+		got, err := jsonutil.GetField(doc, string(path))
+		if err != nil {
+			t.Fatalf("GetField(%q) returned unexpected error %v", path, err)
+		}
+		if !cmp.Equal(got, test.want) {
+			t.Errorf("GetField(JoinPath(%v)) = %v, want %v", test.segments, got, test.want)
+		}
+
+		// Splitting the path and joining it again gives the same path, and the same value.
+		split, err := SplitPath(path)
+		if err != nil {
+			t.Fatalf("SplitPath(%q) returned unexpected error %v", path, err)
+		}
+		var segs []jsonutil.JSONStr
+		for _, s := range split {
+			segs = append(segs, s.(jsonutil.JSONStr))
+		}
+		rejoined, err := JoinPath(segs...)
+		if err != nil {
+			t.Fatalf("JoinPath(%v) returned unexpected error %v", segs, err)
+		}
+		if rejoined != path {
+			t.Errorf("JoinPath(SplitPath(%q)) = %q, want %q", path, rejoined, path)
+		}
+		if got, err := jsonutil.GetField(doc, string(rejoined)); err != nil || !cmp.Equal(got, test.want) {
+			t.Errorf("GetField(%q) = %v, %v, want %v", rejoined, got, err, test.want)
+		}
+	}
+}
+func TestSortAndTakeTop(t *testing.T) {
+	tests := []struct {
+		name string
+		in   jsonutil.JSONArr
+		key  jsonutil.JSONStr
+		desc jsonutil.JSONBool
+		want jsonutil.JSONToken
 	}{
 		{
-			name: "empty array",
+			name: "no elements",
 			in:   mustParseArray(json.RawMessage(`[]`), t),
+			key:  jsonutil.JSONStr("key"),
+			desc: jsonutil.JSONBool(false),
 			want: nil,
 		},
 		{
-			name: "empty objects",
-			in:   mustParseArray(json.RawMessage(`[{}]`), t),
-			want: mustParseContainer(json.RawMessage(`{}`), t),
+			name: "one only",
+			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}]`), t),
+			key:  jsonutil.JSONStr("key"),
+			desc: jsonutil.JSONBool(false),
+			want: mustParseContainer(json.RawMessage(`{"key":"val1"}`), t),
 		},
 		{
-			name: "no matching keys",
-			in:   mustParseArray(json.RawMessage(`[{"key1":"val1"}, {"key2":"val2"}]`), t),
-			want: mustParseContainer(json.RawMessage(`{"key1":"val1", "key2":"val2"}`), t),
+			name: "ascending",
+			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}, {"key":"val2"}]`), t),
+			key:  jsonutil.JSONStr("key"),
+			desc: jsonutil.JSONBool(false),
+			want: mustParseContainer(json.RawMessage(`{"key":"val1"}`), t),
 		},
 		{
-			name: "primitives only",
+			name: "descending",
 			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}, {"key":"val2"}]`), t),
+			key:  jsonutil.JSONStr("key"),
+			desc: jsonutil.JSONBool(true),
 			want: mustParseContainer(json.RawMessage(`{"key":"val2"}`), t),
 		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SortAndTakeTop(test.in, test.key, test.desc)
+			if err != nil {
+				t.Fatalf("SortAndTakeTop(%v, %v, %v) returned unexpected error %v", test.in, test.key, test.desc, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("SortAndTakeTop(%v, %v, %v) = %v, want %v", test.in, test.key, test.desc, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMinByMaxBy(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      jsonutil.JSONArr
+		key     jsonutil.JSONStr
+		wantMin jsonutil.JSONToken
+		wantMax jsonutil.JSONToken
+	}{
+		{
+			name:    "no elements",
+			in:      mustParseArray(json.RawMessage(`[]`), t),
+			key:     "key",
+			wantMin: nil,
+			wantMax: nil,
+		},
 		{
-			name: "primitives only",
-			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}, {"key":"val2"}, {"key":"val3"}]`), t),
-			want: mustParseContainer(json.RawMessage(`{"key":"val3"}`), t),
+			name:    "numbers",
+			in:      mustParseArray(json.RawMessage(`[{"key":9}, {"key":10}, {"key":-1}]`), t),
+			key:     "key",
+			wantMin: mustParseContainer(json.RawMessage(`{"key":-1}`), t),
+			wantMax: mustParseContainer(json.RawMessage(`{"key":10}`), t),
 		},
 		{
-			name: "arrays only",
-			in:   mustParseArray(json.RawMessage(`[{"key":["val1"]}, {"key":["val2"]}]`), t),
-			want: mustParseContainer(json.RawMessage(`{"key":["val1","val2"]}`), t),
+			name:    "strings",
+			in:      mustParseArray(json.RawMessage(`[{"key":"b"}, {"key":"c"}, {"key":"a"}]`), t),
+			key:     "key",
+			wantMin: mustParseContainer(json.RawMessage(`{"key":"a"}`), t),
+			wantMax: mustParseContainer(json.RawMessage(`{"key":"c"}`), t),
 		},
 		{
-			name: "primitives and arrays",
-			in:   mustParseArray(json.RawMessage(`[{"key":"val1", "arr": ["aval1"]}, {"key":"val2", "arr": ["aval2"]}]`), t),
-			want: mustParseContainer(json.RawMessage(`{"key":"val2", "arr": ["aval1", "aval2"]}`), t),
+			name: "timestamps",
+			in: mustParseArray(json.RawMessage(`[
+				{"key":"2020-01-01T10:00:00+05:00"},
+				{"key":"2020-01-01T06:00:00Z"},
+				{"key":"2020-01-01T01:00:00-05:00"}
+			]`), t),
+			key:     "key",
+			wantMin: mustParseContainer(json.RawMessage(`{"key":"2020-01-01T10:00:00+05:00"}`), t),
+			wantMax: mustParseContainer(json.RawMessage(`{"key":"2020-01-01T06:00:00Z"}`), t),
 		},
 		{
-			name: "complex type in array",
-			in:   mustParseArray(json.RawMessage(`[{"arr": [{"key":"aval1"}]}, {"arr": [{"key":"aval2"}]}]`), t),
-			want: mustParseContainer(json.RawMessage(`{"arr": [{"key":"aval1"}, {"key":"aval2"}]}`), t),
+			name:    "nested key",
+			in:      mustParseArray(json.RawMessage(`[{"a":{"b":2}}, {"a":{"b":1}}]`), t),
+			key:     "a.b",
+			wantMin: mustParseContainer(json.RawMessage(`{"a":{"b":1}}`), t),
+			wantMax: mustParseContainer(json.RawMessage(`{"a":{"b":2}}`), t),
 		},
 		{
-			name:            "array overwrite",
-			in:              mustParseArray(json.RawMessage(`[{"arr": [{"key":"aval1"}]}, {"arr": [{"key":"aval2"}]}]`), t),
-			want:            mustParseContainer(json.RawMessage(`{"arr": [{"key":"aval2"}]}`), t),
-			overwriteArrays: true,
+			name:    "missing keys skipped",
+			in:      mustParseArray(json.RawMessage(`[{"other":1}, {"key":2}, {"key":null}, {"key":3}]`), t),
+			key:     "key",
+			wantMin: mustParseContainer(json.RawMessage(`{"key":2}`), t),
+			wantMax: mustParseContainer(json.RawMessage(`{"key":3}`), t),
+		},
+		{
+			name:    "no element has the key",
+			in:      mustParseArray(json.RawMessage(`[{"other":1}]`), t),
+			key:     "key",
+			wantMin: nil,
+			wantMax: nil,
+		},
+		{
+			name:    "ties return the first",
+			in:      mustParseArray(json.RawMessage(`[{"key":1,"i":0}, {"key":1,"i":1}]`), t),
+			key:     "key",
+			wantMin: mustParseContainer(json.RawMessage(`{"key":1,"i":0}`), t),
+			wantMax: mustParseContainer(json.RawMessage(`{"key":1,"i":0}`), t),
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := MergeJSON(test.in, test.overwriteArrays)
+			got, err := MinBy(test.in, test.key)
 			if err != nil {
-				t.Fatalf("MergeJSON(%v) returned unexpected error %v", test.in, err)
+				t.Fatalf("MinBy(%v, %v) returned unexpected error %v", test.in, test.key, err)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("MergeJSON(%v) = %v, want %v", test.in, got, test.want)
+			if !cmp.Equal(got, test.wantMin) {
+				t.Errorf("MinBy(%v, %v) = %v, want %v", test.in, test.key, got, test.wantMin)
+			}
+
+			got, err = MaxBy(test.in, test.key)
+			if err != nil {
+				t.Fatalf("MaxBy(%v, %v) returned unexpected error %v", test.in, test.key, err)
+			}
+			if !cmp.Equal(got, test.wantMax) {
+				t.Errorf("MaxBy(%v, %v) = %v, want %v", test.in, test.key, got, test.wantMax)
 			}
 		})
 	}
 }
 
-func TestSortAndTakeTop(t *testing.T) {
+func TestMinByMaxByErrors(t *testing.T) {
 	tests := []struct {
 		name string
 		in   jsonutil.JSONArr
-		key  jsonutil.JSONStr
-		desc jsonutil.JSONBool
-		want jsonutil.JSONToken
 	}{
 		{
-			name: "no elements",
-			in:   mustParseArray(json.RawMessage(`[]`), t),
-			key:  jsonutil.JSONStr("key"),
-			desc: jsonutil.JSONBool(false),
-			want: nil,
-		},
-		{
-			name: "one only",
-			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}]`), t),
-			key:  jsonutil.JSONStr("key"),
-			desc: jsonutil.JSONBool(false),
-			want: mustParseContainer(json.RawMessage(`{"key":"val1"}`), t),
-		},
-		{
-			name: "ascending",
-			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}, {"key":"val2"}]`), t),
-			key:  jsonutil.JSONStr("key"),
-			desc: jsonutil.JSONBool(false),
-			want: mustParseContainer(json.RawMessage(`{"key":"val1"}`), t),
+			name: "mixed types",
+			in:   mustParseArray(json.RawMessage(`[{"key":1}, {"key":"1"}]`), t),
 		},
 		{
-			name: "descending",
-			in:   mustParseArray(json.RawMessage(`[{"key":"val1"}, {"key":"val2"}]`), t),
-			key:  jsonutil.JSONStr("key"),
-			desc: jsonutil.JSONBool(true),
-			want: mustParseContainer(json.RawMessage(`{"key":"val2"}`), t),
+			name: "uncomparable key",
+			in:   mustParseArray(json.RawMessage(`[{"key":true}]`), t),
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := SortAndTakeTop(test.in, test.key, test.desc)
-			if err != nil {
-				t.Fatalf("SortAndTakeTop(%v, %v, %v) returned unexpected error %v", test.in, test.key, test.desc, err)
+			if got, err := MinBy(test.in, "key"); err == nil {
+				t.Errorf("MinBy(%v, key) = %v, want error", test.in, got)
 			}
-			if !cmp.Equal(got, test.want) {
-				t.Errorf("SortAndTakeTop(%v, %v, %v) = %v, want %v", test.in, test.key, test.desc, got, test.want)
+			if got, err := MaxBy(test.in, "key"); err == nil {
+				t.Errorf("MaxBy(%v, key) = %v, want error", test.in, got)
 			}
 		})
 	}
 }
 
+// benchmarkByInput returns 100k elements with unique timestamp keys, in no particular order.
+func benchmarkByInput() jsonutil.JSONArr {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	arr := make(jsonutil.JSONArr, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		ts := jsonutil.JSONToken(jsonutil.JSONStr(start.Add(time.Duration(i*7919%100000) * time.Minute).Format(time.RFC3339)))
+		arr = append(arr, jsonutil.JSONContainer{"effectiveDateTime": &ts})
+	}
+	return arr
+}
+
+func BenchmarkMaxBy(b *testing.B) {
+	b.ReportAllocs()
+	arr := benchmarkByInput()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := MaxBy(arr, "effectiveDateTime"); err != nil {
+			b.Fatalf("MaxBy(...) returned unexpected error %v", err)
+		}
+	}
+}
+
+func BenchmarkSortAndTakeTop(b *testing.B) {
+	b.ReportAllocs()
+	arr := benchmarkByInput()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := SortAndTakeTop(arr, "effectiveDateTime", true); err != nil {
+			b.Fatalf("SortAndTakeTop(...) returned unexpected error %v", err)
+		}
+	}
+}
+
 func TestSplit(t *testing.T) {
 	tests := []struct {
 		name string
@@ -1784,6 +4014,169 @@ func TestOr(t *testing.T) {
 	}
 }
 
+func TestXor(t *testing.T) {
+	tests := []struct {
+		name        string
+		left, right jsonutil.JSONToken
+		want        jsonutil.JSONBool
+	}{
+		{
+			name:  "true and false",
+			left:  jsonutil.JSONBool(true),
+			right: jsonutil.JSONBool(false),
+			want:  jsonutil.JSONBool(true),
+		},
+		{
+			name:  "false and true",
+			left:  jsonutil.JSONBool(false),
+			right: jsonutil.JSONBool(true),
+			want:  jsonutil.JSONBool(true),
+		},
+		{
+			name:  "both true",
+			left:  jsonutil.JSONBool(true),
+			right: jsonutil.JSONBool(true),
+			want:  jsonutil.JSONBool(false),
+		},
+		{
+			name:  "both false",
+			left:  jsonutil.JSONBool(false),
+			right: jsonutil.JSONBool(false),
+			want:  jsonutil.JSONBool(false),
+		},
+		{
+			name:  "true and null",
+			left:  jsonutil.JSONBool(true),
+			right: nil,
+			want:  jsonutil.JSONBool(true),
+		},
+		{
+			name:  "both null",
+			left:  nil,
+			right: nil,
+			want:  jsonutil.JSONBool(false),
+		},
+		{
+			name:  "non-boolean and empty string",
+			left:  jsonutil.JSONStr("1970-01-01"),
+			right: jsonutil.JSONStr(""),
+			want:  jsonutil.JSONBool(true),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Xor(test.left, test.right)
+			if err != nil {
+				t.Fatalf("Xor(%v, %v) returned unexpected error %v", test.left, test.right, err)
+			}
+			if got != test.want {
+				t.Errorf("Xor(%v, %v) = %v, want %v", test.left, test.right, got, test.want)
+			}
+		})
+	}
+}
+
+func TestExactlyOneAndAtMostOne(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []jsonutil.JSONToken
+		wantExactlyOne jsonutil.JSONBool
+		wantAtMostOne  jsonutil.JSONBool
+	}{
+		{
+			name:           "no args",
+			args:           []jsonutil.JSONToken{},
+			wantExactlyOne: false,
+			wantAtMostOne:  true,
+		},
+		{
+			name:           "one true arg",
+			args:           []jsonutil.JSONToken{jsonutil.JSONBool(true)},
+			wantExactlyOne: true,
+			wantAtMostOne:  true,
+		},
+		{
+			name:           "one false arg",
+			args:           []jsonutil.JSONToken{jsonutil.JSONBool(false)},
+			wantExactlyOne: false,
+			wantAtMostOne:  true,
+		},
+		{
+			name:           "one of several true",
+			args:           []jsonutil.JSONToken{jsonutil.JSONBool(false), jsonutil.JSONBool(true), jsonutil.JSONBool(false)},
+			wantExactlyOne: true,
+			wantAtMostOne:  true,
+		},
+		{
+			name:           "two of several true",
+			args:           []jsonutil.JSONToken{jsonutil.JSONBool(true), jsonutil.JSONBool(false), jsonutil.JSONBool(true)},
+			wantExactlyOne: false,
+			wantAtMostOne:  false,
+		},
+		{
+			name:           "all true",
+			args:           []jsonutil.JSONToken{jsonutil.JSONBool(true), jsonutil.JSONBool(true), jsonutil.JSONBool(true)},
+			wantExactlyOne: false,
+			wantAtMostOne:  false,
+		},
+		{
+			name:           "all false",
+			args:           []jsonutil.JSONToken{jsonutil.JSONBool(false), jsonutil.JSONBool(false)},
+			wantExactlyOne: false,
+			wantAtMostOne:  true,
+		},
+		{
+			name:           "nulls are false",
+			args:           []jsonutil.JSONToken{nil, jsonutil.JSONBool(true), nil},
+			wantExactlyOne: true,
+			wantAtMostOne:  true,
+		},
+		{
+			name:           "only nulls",
+			args:           []jsonutil.JSONToken{nil, nil},
+			wantExactlyOne: false,
+			wantAtMostOne:  true,
+		},
+		{
+			name:           "present choice type alternative",
+			args:           []jsonutil.JSONToken{nil, jsonutil.JSONStr("2020-01-01")},
+			wantExactlyOne: true,
+			wantAtMostOne:  true,
+		},
+		{
+			name:           "both choice type alternatives present",
+			args:           []jsonutil.JSONToken{jsonutil.JSONNum(0), jsonutil.JSONStr("2020-01-01")},
+			wantExactlyOne: false,
+			wantAtMostOne:  false,
+		},
+		{
+			name:           "empty values are false",
+			args:           []jsonutil.JSONToken{jsonutil.JSONStr(""), jsonutil.JSONArr{}, jsonutil.JSONContainer{}, jsonutil.JSONBool(true)},
+			wantExactlyOne: true,
+			wantAtMostOne:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ExactlyOne(test.args...)
+			if err != nil {
+				t.Fatalf("ExactlyOne(%v) returned unexpected error %v", test.args, err)
+			}
+			if got != test.wantExactlyOne {
+				t.Errorf("ExactlyOne(%v) = %v, want %v", test.args, got, test.wantExactlyOne)
+			}
+
+			got, err = AtMostOne(test.args...)
+			if err != nil {
+				t.Fatalf("AtMostOne(%v) returned unexpected error %v", test.args, err)
+			}
+			if got != test.wantAtMostOne {
+				t.Errorf("AtMostOne(%v) = %v, want %v", test.args, got, test.wantAtMostOne)
+			}
+		})
+	}
+}
+
 func TestUnnestArrays(t *testing.T) {
 	tests := []struct {
 		name string
@@ -1838,27 +4231,340 @@ func TestSum(t *testing.T) {
 		want     jsonutil.JSONNum
 	}{
 		{
-			name: "no operands",
+			name: "no operands",
+		},
+		{
+			name:     "one operand",
+			operands: []jsonutil.JSONNum{-1337},
+			want:     -1337,
+		},
+		{
+			name:     "many operands",
+			operands: []jsonutil.JSONNum{1337, -7.2111, 155.829, 0},
+			want:     1485.6179,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Sum(test.operands...)
+			if err != nil {
+				t.Fatalf("Sum(%v) = error %v", test.operands, err)
+			}
+			if got != test.want {
+				t.Errorf("Sum(%v) = %v want %v", test.operands, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsInteger(t *testing.T) {
+	tests := []struct {
+		n    jsonutil.JSONNum
+		want jsonutil.JSONBool
+	}{
+		{n: 0, want: true},
+		{n: -42, want: true},
+		{n: 1e6, want: true},
+		{n: 1e21, want: true},
+		{n: 3.0000000000000004, want: true},
+		{n: 2.9999999999999996, want: true},
+		{n: 0.5, want: false},
+		{n: -1.25, want: false},
+		{n: 0.30000000000000004, want: false},
+		{n: 1e-10, want: false},
+		{n: 2.0000000001, want: false},
+		{n: 123456.0000001, want: false},
+		{n: jsonutil.JSONNum(math.NaN()), want: false},
+		{n: jsonutil.JSONNum(math.Inf(1)), want: false},
+	}
+	for _, test := range tests {
+		got, err := IsInteger(test.n)
+		if err != nil {
+			t.Fatalf("IsInteger(%v) returned unexpected error %v", test.n, err)
+		}
+		if got != test.want {
+			t.Errorf("IsInteger(%v) = %v, want %v", test.n, got, test.want)
+		}
+	}
+}
+
+func TestToFixedInt(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       jsonutil.JSONNum
+		want    jsonutil.JSONNum
+		wantErr bool
+	}{
+		{
+			name: "integer",
+			n:    -42,
+			want: -42,
+		},
+		{
+			name: "floating point artifact",
+			n:    3.0000000000000004,
+			want: 3,
+		},
+		{
+			name: "largest safe integer",
+			n:    1<<53 - 1,
+			want: 1<<53 - 1,
+		},
+		{
+			name: "smallest safe integer",
+			n:    -(1<<53 - 1),
+			want: -(1<<53 - 1),
+		},
+		{
+			name:    "fractional part",
+			n:       2.5,
+			wantErr: true,
+		},
+		{
+			name:    "above safe range",
+			n:       1 << 53,
+			wantErr: true,
+		},
+		{
+			name:    "below safe range",
+			n:       -1e20,
+			wantErr: true,
+		},
+		{
+			name:    "nan",
+			n:       jsonutil.JSONNum(math.NaN()),
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ToFixedInt(test.n)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("ToFixedInt(%v) = %v, want error", test.n, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ToFixedInt(%v) returned unexpected error %v", test.n, err)
+			}
+			if got != test.want {
+				t.Errorf("ToFixedInt(%v) = %v, want %v", test.n, got, test.want)
+			}
+		})
+	}
+}
+
+func TestToRadix(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       jsonutil.JSONNum
+		base    jsonutil.JSONNum
+		want    jsonutil.JSONStr
+		wantErr string
+	}{
+		{name: "zero", n: 0, base: 36, want: "0"},
+		{name: "base 36", n: 1295, base: 36, want: "zz"},
+		{name: "base 16", n: 255, base: 16, want: "ff"},
+		{name: "base 2", n: 10, base: 2, want: "1010"},
+		{name: "floating point artifact", n: 36.00000000000001, base: 36, want: "10"},
+		{name: "largest safe integer", n: 1<<53 - 1, base: 36, want: "2gosa7pa2gv"},
+		{name: "fractional part", n: 1.5, base: 36, wantErr: "1.5 is not an integer"},
+		{name: "negative", n: -1, base: 36, wantErr: "-1 is negative"},
+		{name: "above safe range", n: 1 << 53, base: 36, wantErr: "9007199254740992 is larger than the largest safe integer 9007199254740991"},
+		{name: "base too small", n: 1, base: 1, wantErr: "base must be an integer between 2 and 36 but got 1"},
+		{name: "base too large", n: 1, base: 37, wantErr: "base must be an integer between 2 and 36 but got 37"},
+		{name: "fractional base", n: 1, base: 2.5, wantErr: "base must be an integer between 2 and 36 but got 2.5"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ToRadix(test.n, test.base)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("ToRadix(%v, %v) = %q, %v, want error %q", test.n, test.base, got, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ToRadix(%v, %v) returned unexpected error %v", test.n, test.base, err)
+			}
+			if got != test.want {
+				t.Errorf("ToRadix(%v, %v) = %q, want %q", test.n, test.base, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFromRadix(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     jsonutil.JSONStr
+		base    jsonutil.JSONNum
+		want    jsonutil.JSONNum
+		wantErr string
+	}{
+		{name: "zero", str: "0", base: 36, want: 0},
+		{name: "lower case", str: "zz", base: 36, want: 1295},
+		{name: "upper case", str: "ZZ", base: 36, want: 1295},
+		{name: "mixed case", str: "fF", base: 16, want: 255},
+		{name: "leading zeros", str: "0010", base: 2, want: 2},
+		{name: "largest safe integer", str: "2GOSA7PA2GV", base: 36, want: 1<<53 - 1},
+		{name: "empty", str: "", base: 36, wantErr: "could not parse an empty string in base 36"},
+		{name: "invalid character", str: "AB-12", base: 36, wantErr: `could not parse "AB-12" in base 36: invalid character '-' at position 2`},
+		{name: "digit beyond base", str: "102", base: 2, wantErr: `could not parse "102" in base 2: invalid character '2' at position 2`},
+		{name: "sign", str: "-1", base: 10, wantErr: `could not parse "-1" in base 10: invalid character '-' at position 0`},
+		{name: "non-ascii", str: "zé", base: 36, wantErr: `could not parse "zé" in base 36: invalid character 'é' at position 1`},
+		{name: "above safe range", str: "2GOSA7PA2GW", base: 36, wantErr: `could not parse "2GOSA7PA2GW" in base 36: larger than the largest safe integer 9007199254740991`},
+		{name: "far above safe range", str: "zzzzzzzzzzzzzzzzzzzzzzzzzzzzzz", base: 36, wantErr: "larger than the largest safe integer"},
+		{name: "invalid base", str: "1", base: 0, wantErr: "base must be an integer between 2 and 36 but got 0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FromRadix(test.str, test.base)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("FromRadix(%q, %v) = %v, %v, want error %q", test.str, test.base, got, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FromRadix(%q, %v) returned unexpected error %v", test.str, test.base, err)
+			}
+			if got != test.want {
+				t.Errorf("FromRadix(%q, %v) = %v, want %v", test.str, test.base, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBase36(t *testing.T) {
+	for _, n := range []jsonutil.JSONNum{0, 1, 35, 36, 46655, 123456789, 1<<53 - 1} {
+		s, err := ToBase36(n)
+		if err != nil {
+			t.Fatalf("ToBase36(%v) returned unexpected error %v", n, err)
+		}
+		got, err := FromBase36(jsonutil.JSONStr(strings.ToUpper(string(s))))
+		if err != nil {
+			t.Fatalf("FromBase36(%q) returned unexpected error %v", s, err)
+		}
+		if got != n {
+			t.Errorf("FromBase36(ToBase36(%v)) = %v, want %v", n, got, n)
+		}
+	}
+}
+
+func TestFormatNum(t *testing.T) {
+	tests := []struct {
+		name                     string
+		n, decimals              jsonutil.JSONNum
+		thousandsSep, decimalSep jsonutil.JSONStr
+		want                     jsonutil.JSONStr
+		wantErr                  bool
+	}{
+		{
+			name:         "grouped",
+			n:            1234.5,
+			decimals:     1,
+			thousandsSep: ",",
+			decimalSep:   ".",
+			want:         "1,234.5",
+		},
+		{
+			name:       "plain with padded decimals",
+			n:          1234.5,
+			decimals:   3,
+			decimalSep: ".",
+			want:       "1234.500",
+		},
+		{
+			name:         "other separators",
+			n:            1234567.891,
+			decimals:     2,
+			thousandsSep: ".",
+			decimalSep:   ",",
+			want:         "1.234.567,89",
+		},
+		{
+			name:     "zero decimals rounds half away from zero",
+			n:        2.5,
+			decimals: 0,
+			want:     "3",
+		},
+		{
+			name:       "negative rounds half away from zero",
+			n:          -1.005,
+			decimals:   2,
+			decimalSep: ".",
+			want:       "-1.01",
+		},
+		{
+			name:         "rounding carries into the integer part",
+			n:            999.96,
+			decimals:     1,
+			thousandsSep: ",",
+			decimalSep:   ".",
+			want:         "1,000.0",
+		},
+		{
+			name:       "negative rounded to zero",
+			n:          -0.001,
+			decimals:   2,
+			decimalSep: ".",
+			want:       "0.00",
+		},
+		{
+			name:         "negative grouped",
+			n:            -1234567,
+			decimals:     0,
+			thousandsSep: ",",
+			want:         "-1,234,567",
+		},
+		{
+			name:     "very large without exponent",
+			n:        1e21,
+			decimals: 0,
+			want:     "1000000000000000000000",
+		},
+		{
+			name:       "very small without exponent",
+			n:          1e-7,
+			decimals:   8,
+			decimalSep: ".",
+			want:       "0.00000010",
+		},
+		{
+			name:     "fractional decimals",
+			n:        1,
+			decimals: 1.5,
+			wantErr:  true,
+		},
+		{
+			name:     "negative decimals",
+			n:        1,
+			decimals: -1,
+			wantErr:  true,
 		},
 		{
-			name:     "one operand",
-			operands: []jsonutil.JSONNum{-1337},
-			want:     -1337,
+			name:     "missing decimal separator",
+			n:        1,
+			decimals: 2,
+			wantErr:  true,
 		},
 		{
-			name:     "many operands",
-			operands: []jsonutil.JSONNum{1337, -7.2111, 155.829, 0},
-			want:     1485.6179,
+			name:     "infinity",
+			n:        jsonutil.JSONNum(math.Inf(1)),
+			decimals: 0,
+			wantErr:  true,
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			got, err := Sum(test.operands...)
-			if err != nil {
-				t.Fatalf("Sum(%v) = error %v", test.operands, err)
+			got, err := FormatNum(test.n, test.decimals, test.thousandsSep, test.decimalSep)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("FormatNum(%v, %v, %q, %q) returned error %v, want error %v", test.n, test.decimals, test.thousandsSep, test.decimalSep, err, test.wantErr)
 			}
 			if got != test.want {
-				t.Errorf("Sum(%v) = %v want %v", test.operands, got, test.want)
+				t.Errorf("FormatNum(%v, %v, %q, %q) = %q, want %q", test.n, test.decimals, test.thousandsSep, test.decimalSep, got, test.want)
 			}
 		})
 	}
@@ -2044,6 +4750,55 @@ func TestGtEq(t *testing.T) {
 	}
 }
 
+func TestIf(t *testing.T) {
+	tests := []struct {
+		name             string
+		cond             jsonutil.JSONBool
+		thenVal, elseVal jsonutil.JSONToken
+		want             jsonutil.JSONToken
+	}{
+		{
+			name:    "true",
+			cond:    true,
+			thenVal: jsonutil.JSONStr("then"),
+			elseVal: jsonutil.JSONStr("else"),
+			want:    jsonutil.JSONStr("then"),
+		},
+		{
+			name:    "false",
+			cond:    false,
+			thenVal: jsonutil.JSONStr("then"),
+			elseVal: jsonutil.JSONStr("else"),
+			want:    jsonutil.JSONStr("else"),
+		},
+		{
+			name:    "nil value",
+			cond:    true,
+			thenVal: nil,
+			elseVal: jsonutil.JSONNum(1),
+			want:    nil,
+		},
+		{
+			name:    "container value",
+			cond:    false,
+			thenVal: nil,
+			elseVal: mustParseContainer(json.RawMessage(`{"a": [1]}`), t),
+			want:    mustParseContainer(json.RawMessage(`{"a": [1]}`), t),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := If(test.cond, test.thenVal, test.elseVal)
+			if err != nil {
+				t.Fatalf("If(%v, %v, %v) = error %v", test.cond, test.thenVal, test.elseVal, err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("If(%v, %v, %v) returned diff (-want +got):\n%s", test.cond, test.thenVal, test.elseVal, diff)
+			}
+		})
+	}
+}
+
 func TestLt(t *testing.T) {
 	epsilon := jsonutil.JSONNum(math.Nextafter(1.0, 2.0) - 1.0)
 	tests := []struct {
@@ -2228,6 +4983,56 @@ func TestVoid(t *testing.T) {
 	}
 }
 
+func TestCompactList(t *testing.T) {
+	tests := []struct {
+		name  string
+		input jsonutil.JSONArr
+		want  jsonutil.JSONArr
+	}{
+		{
+			name:  "nil array",
+			input: nil,
+			want:  jsonutil.JSONArr{},
+		},
+		{
+			name:  "empty array",
+			input: jsonutil.JSONArr{},
+			want:  jsonutil.JSONArr{},
+		},
+		{
+			name:  "only nils",
+			input: mustParseArray(json.RawMessage(`[null, null]`), t),
+			want:  jsonutil.JSONArr{},
+		},
+		{
+			name:  "nils removed in order",
+			input: mustParseArray(json.RawMessage(`[null, 1, null, "two", null, true]`), t),
+			want:  mustParseArray(json.RawMessage(`[1, "two", true]`), t),
+		},
+		{
+			name:  "empty values kept",
+			input: mustParseArray(json.RawMessage(`["", {}, [], null, 0, false]`), t),
+			want:  mustParseArray(json.RawMessage(`["", {}, [], 0, false]`), t),
+		},
+		{
+			name:  "nested arrays not compacted",
+			input: mustParseArray(json.RawMessage(`[[1, null], null, [null]]`), t),
+			want:  mustParseArray(json.RawMessage(`[[1, null], [null]]`), t),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := CompactList(test.input)
+			if err != nil {
+				t.Fatalf("CompactList(%v) = error %v", test.input, err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("CompactList(%v) -want/+got:\n%s", test.input, diff)
+			}
+		})
+	}
+}
+
 func TestFlatten(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -2307,3 +5112,472 @@ func TestIntHash(t *testing.T) {
 		})
 	}
 }
+
+func BenchmarkHash(b *testing.B) {
+	obj := mustParseBenchmarkInput(json.RawMessage(`{
+		"resourceType": "Patient",
+		"identifier": [{"system": "urn:oid:1.2.3", "value": "12345"}],
+		"name": [{"given": ["Jane", "Q"], "family": "Doe"}],
+		"birthDate": "1970-01-01",
+		"deceasedBoolean": false,
+		"multipleBirthInteger": 2
+	}`), b)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Hash(obj); err != nil {
+			b.Fatalf("Hash(%v) returned unexpected error %v", obj, err)
+		}
+	}
+}
+
+func TestParseCSVLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    jsonutil.JSONStr
+		delim   jsonutil.JSONStr
+		want    jsonutil.JSONArr
+		wantErr bool
+	}{
+		{
+			name:  "simple",
+			line:  "a,b,c",
+			delim: ",",
+			want:  jsonutil.JSONArr{jsonutil.JSONStr("a"), jsonutil.JSONStr("b"), jsonutil.JSONStr("c")},
+		},
+		{
+			name:  "other delimiter",
+			line:  "10^mg^PO",
+			delim: "^",
+			want:  jsonutil.JSONArr{jsonutil.JSONStr("10"), jsonutil.JSONStr("mg"), jsonutil.JSONStr("PO")},
+		},
+		{
+			name:  "empty fields",
+			line:  ",a,,",
+			delim: ",",
+			want:  jsonutil.JSONArr{jsonutil.JSONStr(""), jsonutil.JSONStr("a"), jsonutil.JSONStr(""), jsonutil.JSONStr("")},
+		},
+		{
+			name:  "empty line",
+			line:  "",
+			delim: ",",
+			want:  jsonutil.JSONArr{},
+		},
+		{
+			name:  "quoted delimiter",
+			line:  `peanuts,"penicillin, amoxicillin",latex`,
+			delim: ",",
+			want:  jsonutil.JSONArr{jsonutil.JSONStr("peanuts"), jsonutil.JSONStr("penicillin, amoxicillin"), jsonutil.JSONStr("latex")},
+		},
+		{
+			name:  "escaped quotes",
+			line:  `"say ""hi""",""""`,
+			delim: ",",
+			want:  jsonutil.JSONArr{jsonutil.JSONStr(`say "hi"`), jsonutil.JSONStr(`"`)},
+		},
+		{
+			name:  "whitespace is kept",
+			line:  ` a ," b ",`,
+			delim: ",",
+			want:  jsonutil.JSONArr{jsonutil.JSONStr(" a "), jsonutil.JSONStr(" b "), jsonutil.JSONStr("")},
+		},
+		{
+			name:  "empty quoted field",
+			line:  `"",x`,
+			delim: ",",
+			want:  jsonutil.JSONArr{jsonutil.JSONStr(""), jsonutil.JSONStr("x")},
+		},
+		{
+			name:  "multibyte delimiter",
+			line:  "a§b",
+			delim: "§",
+			want:  jsonutil.JSONArr{jsonutil.JSONStr("a"), jsonutil.JSONStr("b")},
+		},
+		{
+			name:    "unclosed quote",
+			line:    `a,"b`,
+			delim:   ",",
+			wantErr: true,
+		},
+		{
+			name:    "text after closing quote",
+			line:    `"a"b,c`,
+			delim:   ",",
+			wantErr: true,
+		},
+		{
+			name:    "bare quote",
+			line:    `a"b,c`,
+			delim:   ",",
+			wantErr: true,
+		},
+		{
+			name:    "long delimiter",
+			line:    "a,b",
+			delim:   ",,",
+			wantErr: true,
+		},
+		{
+			name:    "empty delimiter",
+			line:    "a,b",
+			delim:   "",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseCSVLine(test.line, test.delim)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("ParseCSVLine(%q, %q) returned error %v, want error %v", test.line, test.delim, err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("ParseCSVLine(%q, %q) => diff -%v +%v\n%s", test.line, test.delim, test.want, got, diff)
+			}
+		})
+	}
+}
+
+func TestParseCSVLine_ErrorColumn(t *testing.T) {
+	tests := []struct {
+		line    jsonutil.JSONStr
+		wantCol string
+	}{
+		{line: `a,"b`, wantCol: "column 3"},
+		{line: `"a"b,c`, wantCol: "column 4"},
+		{line: `ab,c"d`, wantCol: "column 5"},
+	}
+	for _, test := range tests {
+		_, err := ParseCSVLine(test.line, ",")
+		if err == nil || !strings.Contains(err.Error(), test.wantCol) {
+			t.Errorf("ParseCSVLine(%q, \",\") returned error %v, want error at %s", test.line, err, test.wantCol)
+		}
+	}
+}
+
+func TestParseQueryString(t *testing.T) {
+	tests := []struct {
+		name    string
+		qs      jsonutil.JSONStr
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "simple",
+			qs:   "family=Doe&given=Jane",
+			want: `{"family": ["Doe"], "given": ["Jane"]}`,
+		},
+		{
+			name: "repeated parameters",
+			qs:   "code=b&status=final&code=a",
+			want: `{"code": ["b", "a"], "status": ["final"]}`,
+		},
+		{
+			name: "percent-decoded",
+			qs:   "name=Jane+Doe&note=a%26b%3Dc&q=%E2%9C%93",
+			want: `{"name": ["Jane Doe"], "note": ["a&b=c"], "q": ["✓"]}`,
+		},
+		{
+			name: "fhir token",
+			qs:   "identifier=http://hospital.org/mrn%7C123&code=http%3A%2F%2Floinc.org|1234-5",
+			want: `{"code": ["http://loinc.org|1234-5"], "identifier": ["http://hospital.org/mrn|123"]}`,
+		},
+		{
+			name: "url",
+			qs:   "https://fhir.example.com/Patient?identifier=mrn%7C1&_count=10#top",
+			want: `{"_count": ["10"], "identifier": ["mrn|1"]}`,
+		},
+		{
+			name: "empty values and parameters",
+			qs:   "?a=&&b&c=1=2",
+			want: `{"a": [""], "b": [""], "c": ["1=2"]}`,
+		},
+		{
+			name: "empty",
+			qs:   "",
+			want: `{}`,
+		},
+		{
+			name:    "invalid escape",
+			qs:      "a=%zz",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseQueryString(test.qs)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("ParseQueryString(%q) returned error %v, want error %v", test.qs, err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			want := mustParseContainer(json.RawMessage(test.want), t)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("ParseQueryString(%q) => diff -%v +%v\n%s", test.qs, want, got, diff)
+			}
+		})
+	}
+}
+
+func TestBuildQueryString(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  string
+		want    jsonutil.JSONStr
+		wantErr bool
+	}{
+		{
+			name:   "sorted",
+			params: `{"given": "Jane", "family": "Doe"}`,
+			want:   "family=Doe&given=Jane",
+		},
+		{
+			name:   "repeated parameters keep their order",
+			params: `{"code": ["b", "a"], "_count": 10}`,
+			want:   "_count=10&code=b&code=a",
+		},
+		{
+			name:   "primitives",
+			params: `{"active": true, "n": 1.5, "s": ""}`,
+			want:   "active=true&n=1.5&s=",
+		},
+		{
+			name:   "escaped",
+			params: `{"name": "Jane Doe", "note": "a&b=c", "a b": "✓"}`,
+			want:   "a+b=%E2%9C%93&name=Jane+Doe&note=a%26b%3Dc",
+		},
+		{
+			name:   "nulls are left out",
+			params: `{"a": null, "b": [null, "x"]}`,
+			want:   "b=x",
+		},
+		{
+			name:   "empty",
+			params: `{}`,
+			want:   "",
+		},
+		{
+			name:    "object value",
+			params:  `{"a": {"b": "c"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "nested array",
+			params:  `{"a": [["b"]]}`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params := mustParseContainer(json.RawMessage(test.params), t)
+			got, err := BuildQueryString(params)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("BuildQueryString(%s) returned error %v, want error %v", test.params, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("BuildQueryString(%s) = %q, want %q", test.params, got, test.want)
+			}
+		})
+	}
+}
+
+func TestQueryStringRoundTrip(t *testing.T) {
+	// Pipes and colons of FHIR token parameters (system|code) must survive.
+	params := mustParseContainer(json.RawMessage(`{
+		"identifier": ["http://hospital.org/mrn|123", "urn:oid:1.2.3|"],
+		"code:text": ["a:b|c"],
+		"date": ["ge2020-01-01T00:00:00+01:00"]
+	}`), t)
+
+	qs, err := BuildQueryString(params)
+	if err != nil {
+		t.Fatalf("BuildQueryString(%v) returned unexpected error %v", params, err)
+	}
+	got, err := ParseQueryString(qs)
+	if err != nil {
+		t.Fatalf("ParseQueryString(%q) returned unexpected error %v", qs, err)
+	}
+	if diff := cmp.Diff(params, got); diff != "" {
+		t.Errorf("ParseQueryString(BuildQueryString(%v)) => diff -%v +%v\n%s", params, params, got, diff)
+	}
+}
+
+func TestShiftDate(t *testing.T) {
+	now := func() time.Time { return time.Date(2020, time.June, 15, 12, 0, 0, 0, time.UTC) }
+	shiftDate := NewShiftDateWithClock([]byte("secret"), now)
+
+	daysBetween := func(t *testing.T, format, a, b jsonutil.JSONStr) int {
+		t.Helper()
+		ta, err := parseTime(format, a)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", a, err)
+		}
+		tb, err := parseTime(format, b)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", b, err)
+		}
+		return int(tb.Sub(ta).Hours() / 24)
+	}
+
+	t.Run("same key same shift", func(t *testing.T) {
+		var shifts []int
+		for _, date := range []jsonutil.JSONStr{"2019-01-01", "2019-03-15", "2010-12-31"} {
+			for i := 0; i < 3; i++ {
+				got, err := shiftDate(date, "2006-01-02", "MRN123", 30)
+				if err != nil {
+					t.Fatalf("ShiftDate(%q) returned unexpected error %v", date, err)
+				}
+				shifts = append(shifts, daysBetween(t, "2006-01-02", date, got))
+			}
+		}
+		for _, s := range shifts {
+			if s != shifts[0] {
+				t.Fatalf("ShiftDate(...) shifted dates with the same key by different amounts: %v", shifts)
+			}
+		}
+	})
+
+	t.Run("shift is in range", func(t *testing.T) {
+		seen := map[int]bool{}
+		for i := 0; i < 200; i++ {
+			key := jsonutil.JSONStr(fmt.Sprintf("MRN%d", i))
+			got, err := shiftDate("2019-01-01", "2006-01-02", key, 5)
+			if err != nil {
+				t.Fatalf("ShiftDate(..., %q, 5) returned unexpected error %v", key, err)
+			}
+			s := daysBetween(t, "2006-01-02", "2019-01-01", got)
+			if s < -5 || s > 5 {
+				t.Errorf("ShiftDate(..., %q, 5) shifted by %d days, want at most 5", key, s)
+			}
+			seen[s] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("ShiftDate(...) shifted all keys by the same amount: %v", seen)
+		}
+	})
+
+	t.Run("depends on secret", func(t *testing.T) {
+		other := NewShiftDateWithClock([]byte("other secret"), now)
+		var differs bool
+		for i := 0; i < 20 && !differs; i++ {
+			key := jsonutil.JSONStr(fmt.Sprintf("MRN%d", i))
+			a, errA := shiftDate("2019-01-01", "2006-01-02", key, 1000)
+			b, errB := other("2019-01-01", "2006-01-02", key, 1000)
+			if errA != nil || errB != nil {
+				t.Fatalf("ShiftDate(...) returned unexpected errors %v, %v", errA, errB)
+			}
+			differs = a != b
+		}
+		if !differs {
+			t.Errorf("ShiftDate(...) shifted the same way with different secrets")
+		}
+	})
+
+	tests := []struct {
+		name    string
+		date    jsonutil.JSONStr
+		format  jsonutil.JSONStr
+		maxDays jsonutil.JSONNum
+		want    jsonutil.JSONStr
+		wantErr bool
+	}{
+		{
+			name:    "no shift",
+			date:    "2019-01-01",
+			format:  "2006-01-02",
+			maxDays: 0,
+			want:    "2019-01-01",
+		},
+		{
+			name:    "keeps format",
+			date:    "01/02/2019 10:30",
+			format:  "%m/%d/%Y %H:%M",
+			maxDays: 0,
+			want:    "01/02/2019 10:30",
+		},
+		{
+			name:    "empty date",
+			date:    "",
+			format:  "2006-01-02",
+			maxDays: 10,
+			want:    "",
+		},
+		{
+			name:    "invalid date",
+			date:    "not a date",
+			format:  "2006-01-02",
+			maxDays: 10,
+			wantErr: true,
+		},
+		{
+			name:    "negative maxDays",
+			date:    "2019-01-01",
+			format:  "2006-01-02",
+			maxDays: -1,
+			wantErr: true,
+		},
+		{
+			name:    "fractional maxDays",
+			date:    "2019-01-01",
+			format:  "2006-01-02",
+			maxDays: 1.5,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := shiftDate(test.date, test.format, "MRN123", test.maxDays)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("ShiftDate(%q, %q, ...) returned error %v, want error %v", test.date, test.format, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("ShiftDate(%q, %q, ...) = %q, want %q", test.date, test.format, got, test.want)
+			}
+		})
+	}
+
+	// With a large maxDays, about half the keys shift backwards and half forwards.
+	clampTests := []struct {
+		name, date string
+		wantClamp  func(days int) bool
+	}{
+		{
+			name:      "clamped to 1900",
+			date:      "1900-01-01",
+			wantClamp: func(days int) bool { return days >= 0 },
+		},
+		{
+			name:      "clamped to now",
+			date:      "2020-06-15",
+			wantClamp: func(days int) bool { return days <= 0 },
+		},
+	}
+	for _, test := range clampTests {
+		t.Run(test.name, func(t *testing.T) {
+			var clamped int
+			for i := 0; i < 20; i++ {
+				key := jsonutil.JSONStr(fmt.Sprintf("MRN%d", i))
+				got, err := shiftDate(jsonutil.JSONStr(test.date), "2006-01-02", key, 100000)
+				if err != nil {
+					t.Fatalf("ShiftDate(%q, ..., %q, ...) returned unexpected error %v", test.date, key, err)
+				}
+				days := daysBetween(t, "2006-01-02", jsonutil.JSONStr(test.date), got)
+				if !test.wantClamp(days) {
+					t.Errorf("ShiftDate(%q, ..., %q, ...) = %q, which was not clamped", test.date, key, got)
+				}
+				if days == 0 {
+					clamped++
+				}
+			}
+			if clamped == 0 || clamped == 20 {
+				t.Errorf("ShiftDate(%q, ...) clamped %d of 20 keys, want some but not all", test.date, clamped)
+			}
+		})
+	}
+}
+
+func TestShiftDate_NoSecret(t *testing.T) {
+	if _, err := NewShiftDate(nil)("2019-01-01", "2006-01-02", "MRN123", 10); err == nil {
+		t.Errorf("ShiftDate(...) without a secret expected error but got nil")
+	}
+}
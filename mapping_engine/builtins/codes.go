@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// NormalizeICD10 normalizes the formatting of an ICD-10 code: it is upper cased, whitespace is
+// removed, and a decimal point is inserted after the third character if the code is longer than
+// that and has none (e.g. "i10 0" and "I100" both become "I10.0"). The code is not validated.
+func NormalizeICD10(code jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	c := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, string(code))
+
+	if len(c) > 3 && !strings.Contains(c, ".") {
+		c = c[:3] + "." + c[3:]
+	}
+	return jsonutil.JSONStr(c), nil
+}
+
+// ndcConfigurations maps the lengths of the labeler, product and package segments of the
+// hyphenated 10-digit NDC configurations (and the 11-digit one) to the segment that is zero padded
+// to convert them to the 11-digit form.
+var ndcConfigurations = map[[3]int]int{
+	{4, 4, 2}: 0,
+	{5, 3, 2}: 1,
+	{5, 4, 1}: 2,
+	{5, 4, 2}: -1,
+}
+
+// NormalizeNDC converts an NDC (National Drug Code) to the hyphenated 11-digit 5-4-2 HIPAA form
+// (e.g. "12345-0678-90"). 10-digit NDCs are converted according to their hyphenation: 4-4-2 (e.g.
+// "1234-5678-90" becomes "01234-5678-90"), 5-3-2 ("12345-678-90" becomes "12345-0678-90") and 5-4-1
+// ("12345-6789-0" becomes "12345-6789-00"). 11 digits without hyphens are hyphenated. 10 digits
+// without hyphens are an error, since they could be any of the 10-digit configurations, as are
+// other hyphenations and non-digits. Surrounding whitespace is ignored.
+func NormalizeNDC(code jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	c := strings.TrimSpace(string(code))
+	if c == "" {
+		return "", nil
+	}
+
+	segs := strings.Split(c, "-")
+	for _, s := range segs {
+		if s == "" || strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+			return "", fmt.Errorf("NDC %q must be digits separated by hyphens", c)
+		}
+	}
+
+	switch {
+	case len(segs) == 1 && len(c) == 11:
+		segs = []string{c[:5], c[5:9], c[9:]}
+	case len(segs) == 1 && len(c) == 10:
+		return "", fmt.Errorf("NDC %q is ambiguous: 10-digit NDCs must be hyphenated (4-4-2, 5-3-2 or 5-4-1) to be converted to 11 digits", c)
+	case len(segs) == 1:
+		return "", fmt.Errorf("NDC %q must have 10 or 11 digits, but has %d", c, len(c))
+	case len(segs) != 3:
+		return "", fmt.Errorf("NDC %q must have 3 hyphenated segments (4-4-2, 5-3-2, 5-4-1 or 5-4-2), but has %d", c, len(segs))
+	}
+
+	pad, ok := ndcConfigurations[[3]int{len(segs[0]), len(segs[1]), len(segs[2])}]
+	if !ok {
+		return "", fmt.Errorf("NDC %q is not in one of the configurations 4-4-2, 5-3-2, 5-4-1 or 5-4-2", c)
+	}
+	if pad >= 0 {
+		segs[pad] = "0" + segs[pad]
+	}
+	return jsonutil.JSONStr(strings.Join(segs, "-")), nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+func TestNormalizeICD10(t *testing.T) {
+	tests := []struct {
+		code jsonutil.JSONStr
+		want jsonutil.JSONStr
+	}{
+		{code: "", want: ""},
+		{code: "I10", want: "I10"},
+		{code: "i10", want: "I10"},
+		{code: "I1 0", want: "I10"},
+		{code: "I100", want: "I10.0"},
+		{code: "I10.0", want: "I10.0"},
+		{code: " e11 65 ", want: "E11.65"},
+		{code: "S72001A", want: "S72.001A"},
+		{code: "s72.001a", want: "S72.001A"},
+		{code: "Z9", want: "Z9"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.code), func(t *testing.T) {
+			got, err := NormalizeICD10(test.code)
+			if err != nil {
+				t.Fatalf("NormalizeICD10(%q) returned unexpected error %v", test.code, err)
+			}
+			if got != test.want {
+				t.Errorf("NormalizeICD10(%q) = %q, want %q", test.code, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeNDC(t *testing.T) {
+	tests := []struct {
+		name string
+		code jsonutil.JSONStr
+		want jsonutil.JSONStr
+	}{
+		{name: "empty", code: "", want: ""},
+		{name: "4-4-2", code: "1234-5678-90", want: "01234-5678-90"},
+		{name: "4-4-2 leading zeros", code: "0002-0800-01", want: "00002-0800-01"},
+		{name: "5-3-2", code: "12345-678-90", want: "12345-0678-90"},
+		{name: "5-3-2 leading zeros", code: "50090-347-00", want: "50090-0347-00"},
+		{name: "5-4-1", code: "12345-6789-0", want: "12345-6789-00"},
+		{name: "5-4-1 nonzero package", code: "12345-6789-5", want: "12345-6789-05"},
+		{name: "5-4-2", code: "12345-6789-01", want: "12345-6789-01"},
+		{name: "11 digits", code: "12345678901", want: "12345-6789-01"},
+		{name: "whitespace", code: " 1234-5678-90 ", want: "01234-5678-90"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NormalizeNDC(test.code)
+			if err != nil {
+				t.Fatalf("NormalizeNDC(%q) returned unexpected error %v", test.code, err)
+			}
+			if got != test.want {
+				t.Errorf("NormalizeNDC(%q) = %q, want %q", test.code, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeNDC_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    jsonutil.JSONStr
+		wantErr string
+	}{
+		{name: "10 digits without hyphens", code: "1234567890", wantErr: "ambiguous"},
+		{name: "too few digits", code: "123456789", wantErr: "10 or 11 digits"},
+		{name: "too many digits", code: "123456789012", wantErr: "10 or 11 digits"},
+		{name: "two segments", code: "12345-678901", wantErr: "3 hyphenated segments"},
+		{name: "four segments", code: "1-2345-678-90", wantErr: "3 hyphenated segments"},
+		{name: "6-3-2", code: "123456-789-01", wantErr: "configurations"},
+		{name: "5-5-1", code: "12345-67890-1", wantErr: "configurations"},
+		{name: "4-4-3", code: "1234-5678-901", wantErr: "configurations"},
+		{name: "3-4-2", code: "123-4567-89", wantErr: "configurations"},
+		{name: "empty segment", code: "12345--01", wantErr: "digits separated by hyphens"},
+		{name: "trailing hyphen", code: "12345-6789-", wantErr: "digits separated by hyphens"},
+		{name: "letters", code: "1234A-6789-01", wantErr: "digits separated by hyphens"},
+		{name: "placeholder", code: "12345-6789-*1", wantErr: "digits separated by hyphens"},
+		{name: "inner space", code: "12345 6789 01", wantErr: "digits separated by hyphens"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NormalizeNDC(test.code)
+			if err == nil {
+				t.Fatalf("NormalizeNDC(%q) = %q, want error", test.code, got)
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("NormalizeNDC(%q) returned error %q, want it to contain %q", test.code, err, test.wantErr)
+			}
+		})
+	}
+}
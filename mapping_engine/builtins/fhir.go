@@ -0,0 +1,505 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// The constructors below omit fields whose values are nil or empty (including whitespace only
+// strings), and so return an empty object (which is not written) if all of them are.
+
+// Coding constructs a FHIR Coding.
+func Coding(code, system, display jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	c := jsonutil.JSONContainer{}
+	setFHIRString(c, "system", system)
+	setFHIRString(c, "code", code)
+	setFHIRString(c, "display", display)
+	return c, nil
+}
+
+// CodeableConcept constructs a FHIR CodeableConcept with the given text and codings. Nil or empty
+// codings are omitted.
+func CodeableConcept(text jsonutil.JSONStr, codings ...jsonutil.JSONContainer) (jsonutil.JSONContainer, error) {
+	c := jsonutil.JSONContainer{}
+	var cs jsonutil.JSONArr
+	for _, coding := range codings {
+		if len(coding) > 0 {
+			cs = append(cs, coding)
+		}
+	}
+	if len(cs) > 0 {
+		var t jsonutil.JSONToken = cs
+		c["coding"] = &t
+	}
+	setFHIRString(c, "text", text)
+	return c, nil
+}
+
+// Identifier constructs a FHIR Identifier.
+func Identifier(value, system, use jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	c := jsonutil.JSONContainer{}
+	setFHIRString(c, "use", use)
+	setFHIRString(c, "system", system)
+	setFHIRString(c, "value", value)
+	return c, nil
+}
+
+// Reference constructs a FHIR Reference to the resource with the given type and id, i.e.
+// {"reference": "Type/id"}. If either is empty, the reference is omitted.
+func Reference(resourceType, id jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	c := jsonutil.JSONContainer{}
+	rt, i := strings.TrimSpace(string(resourceType)), strings.TrimSpace(string(id))
+	if rt == "" || i == "" {
+		return c, nil
+	}
+	if strings.Contains(rt, "/") {
+		return nil, fmt.Errorf("resource type %q must not contain a /", rt)
+	}
+	setFHIRString(c, "reference", jsonutil.JSONStr(rt+"/"+i))
+	return c, nil
+}
+
+// Quantity constructs a FHIR Quantity. The value must be a number (or nil).
+func Quantity(value jsonutil.JSONToken, unit, system, code jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	c := jsonutil.JSONContainer{}
+	switch v := value.(type) {
+	case nil:
+	case jsonutil.JSONNum:
+		var t jsonutil.JSONToken = v
+		c["value"] = &t
+	default:
+		return nil, fmt.Errorf("quantity value must be a number but was %T", value)
+	}
+	setFHIRString(c, "unit", unit)
+	setFHIRString(c, "system", system)
+	setFHIRString(c, "code", code)
+	return c, nil
+}
+
+// Period constructs a FHIR Period with the given start and end.
+func Period(start, end jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	c := jsonutil.JSONContainer{}
+	setFHIRString(c, "start", start)
+	setFHIRString(c, "end", end)
+	return c, nil
+}
+
+// setFHIRString sets the given field of the given object to the given string, unless it is empty.
+func setFHIRString(c jsonutil.JSONContainer, field string, value jsonutil.JSONStr) {
+	if strings.TrimSpace(string(value)) == "" {
+		return
+	}
+	var t jsonutil.JSONToken = value
+	c[field] = &t
+}
+
+// GetExtension returns the first extension of the given resource (or element, or extension, for
+// nested extensions) with the given url, or nil if there is none.
+func GetExtension(resource jsonutil.JSONToken, url jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+	if url == "" {
+		return nil, fmt.Errorf("extension url must not be empty")
+	}
+	exts, err := extensions(resource)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range exts {
+		if extensionURL(ext) == url {
+			return ext, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetExtensionValue returns the value[x] field (e.g. valueString or valueCoding) of the first
+// extension of the given resource with the given url, or nil if there is none.
+func GetExtensionValue(resource jsonutil.JSONToken, url jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+	ext, err := GetExtension(resource, url)
+	if err != nil || ext == nil {
+		return nil, err
+	}
+	var value jsonutil.JSONToken
+	var field string
+	for k, v := range ext.(jsonutil.JSONContainer) {
+		if !strings.HasPrefix(k, "value") || v == nil {
+			continue
+		}
+		if field != "" {
+			return nil, fmt.Errorf("extension %q has more than one value[x] field: %s and %s", url, field, k)
+		}
+		value, field = *v, k
+	}
+	return value, nil
+}
+
+// SetExtension returns a copy of the given resource (or element, or extension, for nested
+// extensions) with an extension with the given url whose given value field (e.g. valueString, or
+// extension for an extension with nested extensions) is set to the given value. The first
+// extension with the same url is replaced, and any later ones with the url are kept as they are;
+// if there is none, the extension is appended. A nil value removes all the extensions with the url
+// instead.
+func SetExtension(resource jsonutil.JSONToken, url, valueField jsonutil.JSONStr, value jsonutil.JSONToken) (jsonutil.JSONContainer, error) {
+	if url == "" {
+		return nil, fmt.Errorf("extension url must not be empty")
+	}
+	if valueField != "extension" && (!strings.HasPrefix(string(valueField), "value") || valueField == "value") {
+		return nil, fmt.Errorf("extension value field must be value[x] (e.g. valueString) or extension but was %q", valueField)
+	}
+	exts, err := extensions(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	res := jsonutil.JSONContainer{}
+	if resource != nil {
+		res = jsonutil.Deepcopy(resource).(jsonutil.JSONContainer)
+	}
+
+	var ext jsonutil.JSONToken
+	if value != nil {
+		u, v := jsonutil.JSONToken(url), jsonutil.Deepcopy(value)
+		ext = jsonutil.JSONContainer{"url": &u, string(valueField): &v}
+	}
+
+	var updated jsonutil.JSONArr
+	replaced := false
+	for _, e := range exts {
+		switch {
+		case extensionURL(e) != url, ext != nil && replaced:
+			updated = append(updated, jsonutil.Deepcopy(e))
+		case ext != nil:
+			updated = append(updated, ext)
+			replaced = true
+		default:
+			// The value is nil, so the extension is removed.
+		}
+	}
+	if ext != nil && !replaced {
+		updated = append(updated, ext)
+	}
+
+	if len(updated) == 0 {
+		delete(res, "extension")
+	} else {
+		var t jsonutil.JSONToken = updated
+		res["extension"] = &t
+	}
+	return res, nil
+}
+
+// extensions returns the extension array of the given resource, which may be nil.
+func extensions(resource jsonutil.JSONToken) (jsonutil.JSONArr, error) {
+	if resource == nil {
+		return nil, nil
+	}
+	c, ok := resource.(jsonutil.JSONContainer)
+	if !ok {
+		return nil, fmt.Errorf("extensions can only be read from objects but got %T", resource)
+	}
+	f, ok := c["extension"]
+	if !ok || f == nil || *f == nil {
+		return nil, nil
+	}
+	exts, ok := (*f).(jsonutil.JSONArr)
+	if !ok {
+		return nil, fmt.Errorf("extension field must be an array but was %T", *f)
+	}
+	return exts, nil
+}
+
+// extensionURL returns the url of the given extension, or an empty string if it has none.
+func extensionURL(ext jsonutil.JSONToken) jsonutil.JSONStr {
+	c, ok := ext.(jsonutil.JSONContainer)
+	if !ok || c["url"] == nil {
+		return ""
+	}
+	u, _ := (*c["url"]).(jsonutil.JSONStr)
+	return u
+}
+
+// SortBundleEntries returns a copy of the given Bundle whose entries are stably sorted by the
+// resourceType of their resource, in the given order of types. Entries whose type is not in the
+// order (or that have no resource or resourceType) come after the others. Entries of the same rank
+// keep their relative order.
+func SortBundleEntries(bundle jsonutil.JSONContainer, order jsonutil.JSONArr) (jsonutil.JSONContainer, error) {
+	ranks := map[string]int{}
+	for i, o := range order {
+		rt, ok := o.(jsonutil.JSONStr)
+		if !ok {
+			return nil, fmt.Errorf("resource type at index %d of the order must be a string but was %T", i, o)
+		}
+		if _, ok := ranks[string(rt)]; !ok {
+			ranks[string(rt)] = i
+		}
+	}
+
+	res := make(jsonutil.JSONContainer, len(bundle))
+	for k, v := range bundle {
+		res[k] = v
+	}
+	if bundle["entry"] == nil || *bundle["entry"] == nil {
+		return res, nil
+	}
+	entries, ok := (*bundle["entry"]).(jsonutil.JSONArr)
+	if !ok {
+		return nil, fmt.Errorf("entry of the Bundle must be an array but was %T", *bundle["entry"])
+	}
+
+	rank := func(entry jsonutil.JSONToken) int {
+		rt, err := jsonutil.GetField(entry, "resource.resourceType")
+		if s, ok := rt.(jsonutil.JSONStr); err == nil && ok {
+			if r, ok := ranks[string(s)]; ok {
+				return r
+			}
+		}
+		return len(order)
+	}
+	sorted := make(jsonutil.JSONArr, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank(sorted[i]) < rank(sorted[j])
+	})
+
+	var e jsonutil.JSONToken = sorted
+	res["entry"] = &e
+	return res, nil
+}
+
+const (
+	// maxFHIRIDLength is the maximum length of a FHIR id.
+	maxFHIRIDLength = 64
+	// fhirIDHashLength is the number of hex digits of the hash that SanitizeFHIRId appends to
+	// truncated ids.
+	fhirIDHashLength = 12
+)
+
+// isFHIRIDChar returns whether the given character is allowed in a FHIR id.
+func isFHIRIDChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.'
+}
+
+// IsValidFHIRId returns true iff the given string is a valid FHIR id, i.e. 1 to 64 letters, digits,
+// dashes and dots.
+func IsValidFHIRId(id jsonutil.JSONStr) (jsonutil.JSONBool, error) {
+	if len(id) == 0 || len(id) > maxFHIRIDLength {
+		return false, nil
+	}
+	for _, r := range id {
+		if !isFHIRIDChar(r) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// SanitizeFHIRId turns the given string into a valid FHIR id by replacing every character that is
+// not allowed with a dash. If the result is longer than 64 characters, it is truncated and a dash
+// and a hash of the original string are appended (making it 64 characters long), so that long ids
+// which only differ after the cut do not collide. Valid ids are returned as they are, and an empty
+// string stays empty.
+func SanitizeFHIRId(id jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	var sb strings.Builder
+	for _, r := range id {
+		if isFHIRIDChar(r) {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('-')
+		}
+	}
+	s := sb.String()
+	if len(s) <= maxFHIRIDLength {
+		return jsonutil.JSONStr(s), nil
+	}
+	h := sha256.Sum256([]byte(id))
+	suffix := hex.EncodeToString(h[:])[:fhirIDHashLength]
+	return jsonutil.JSONStr(s[:maxFHIRIDLength-fhirIDHashLength-1] + "-" + suffix), nil
+}
+
+// hl7v2Escapes maps the HL7v2 delimiter characters (with the default encoding characters |^~\&) to
+// their escape sequences.
+var hl7v2Escapes = map[rune]string{
+	'|':  `\F\`,
+	'^':  `\S\`,
+	'&':  `\T\`,
+	'~':  `\R\`,
+	'\\': `\E\`,
+}
+
+// cweComponents are the fields of a FHIR Coding in the order of the first components of an HL7v2
+// CWE (identifier, text, name of coding system).
+var cweComponents = []string{"code", "display", "system"}
+
+// CodingToCWE encodes the given FHIR Coding as an HL7v2 CWE, i.e. "code^display^system", escaping
+// the HL7v2 delimiter characters in the components (e.g. ^ as \S\ and & as \T\). Absent components
+// are left empty, and trailing empty components are omitted, so a Coding with only a code is
+// encoded as "code". A nil or empty Coding is encoded as an empty string.
+func CodingToCWE(coding jsonutil.JSONContainer) (jsonutil.JSONStr, error) {
+	components := make([]string, len(cweComponents))
+	for i, field := range cweComponents {
+		v, ok := coding[field]
+		if !ok || v == nil || *v == nil {
+			continue
+		}
+		s, ok := (*v).(jsonutil.JSONStr)
+		if !ok {
+			return "", fmt.Errorf("coding %s must be a string but was %T", field, *v)
+		}
+		components[i] = escapeHL7v2(string(s))
+	}
+	for len(components) > 0 && components[len(components)-1] == "" {
+		components = components[:len(components)-1]
+	}
+	return jsonutil.JSONStr(strings.Join(components, "^")), nil
+}
+
+// CWEToCoding parses the first three components of the given HL7v2 CWE ("code^display^system")
+// into a FHIR Coding, unescaping the HL7v2 escape sequences in them (e.g. \S\ into ^). Empty
+// components are omitted from the Coding, and the remaining components (e.g. the alternate
+// identifier) are ignored.
+func CWEToCoding(cwe jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	c := jsonutil.JSONContainer{}
+	for i, component := range strings.SplitN(string(cwe), "^", len(cweComponents)+1) {
+		if i >= len(cweComponents) {
+			break
+		}
+		setFHIRString(c, cweComponents[i], jsonutil.JSONStr(unescapeHL7v2(component)))
+	}
+	return c, nil
+}
+
+// escapeHL7v2 escapes the HL7v2 delimiter characters in the given string.
+func escapeHL7v2(s string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if e, ok := hl7v2Escapes[r]; ok {
+			sb.WriteString(e)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// unescapeHL7v2 replaces the HL7v2 escape sequences of delimiter characters in the given string
+// with the characters. Other escape sequences (e.g. formatting ones like \.br\) are kept as they
+// are.
+func unescapeHL7v2(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+2 < len(s) && s[i+2] == '\\' {
+			if r, ok := hl7v2Unescapes[s[i+1]]; ok {
+				sb.WriteRune(r)
+				i += 2
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// hl7v2Unescapes maps the letters of the escape sequences in hl7v2Escapes to their characters.
+var hl7v2Unescapes = map[byte]rune{
+	'F': '|',
+	'S': '^',
+	'T': '&',
+	'R': '~',
+	'E': '\\',
+}
+
+// sigTiming is the FHIR Timing.repeat of a medication sig abbreviation.
+type sigTiming struct {
+	frequency, period int
+	periodUnit        string
+	when              string
+}
+
+// sigTimings are the Timing.repeat of the sig abbreviations other than Q#H, by abbreviation.
+var sigTimings = map[string]sigTiming{
+	"QD":  {frequency: 1, period: 1, periodUnit: "d"},
+	"BID": {frequency: 2, period: 1, periodUnit: "d"},
+	"TID": {frequency: 3, period: 1, periodUnit: "d"},
+	"QID": {frequency: 4, period: 1, periodUnit: "d"},
+	"QHS": {frequency: 1, period: 1, periodUnit: "d", when: "HS"},
+	"QOD": {frequency: 1, period: 2, periodUnit: "d"},
+}
+
+// SigToTiming converts the given medication sig shorthand (e.g. "BID", "Q6H" or "TID PRN") into a
+// FHIR Timing with a repeat (frequency, period, periodUnit and, for QHS, when) and the sig as the
+// text of its code. The abbreviations QD, BID, TID, QID, QHS, QOD and Q#H (every # hours) are
+// recognized regardless of case and periods (e.g. "b.i.d."), optionally along with PRN. PRN does
+// not change the Timing: whether the medication is taken as needed is Dosage.asNeededBoolean, which
+// the caller needs to set. Any other sig is not an error, but only has its text in the Timing.
+func SigToTiming(sig jsonutil.JSONStr) (jsonutil.JSONContainer, error) {
+	timing := jsonutil.JSONContainer{}
+	code := jsonutil.JSONContainer{}
+	setFHIRString(code, "text", sig)
+	if len(code) > 0 {
+		var t jsonutil.JSONToken = code
+		timing["code"] = &t
+	}
+
+	st, ok := parseSig(string(sig))
+	if !ok {
+		return timing, nil
+	}
+	var frequency, period, unit jsonutil.JSONToken = jsonutil.JSONNum(st.frequency), jsonutil.JSONNum(st.period), jsonutil.JSONStr(st.periodUnit)
+	repeat := jsonutil.JSONContainer{"frequency": &frequency, "period": &period, "periodUnit": &unit}
+	if st.when != "" {
+		var when jsonutil.JSONToken = jsonutil.JSONArr{jsonutil.JSONStr(st.when)}
+		repeat["when"] = &when
+	}
+	var r jsonutil.JSONToken = repeat
+	timing["repeat"] = &r
+	return timing, nil
+}
+
+// parseSig returns the Timing.repeat of the given sig, which must be exactly one abbreviation,
+// optionally along with PRN.
+func parseSig(sig string) (sigTiming, bool) {
+	var abbrevs []string
+	for _, w := range strings.Fields(strings.ToUpper(strings.ReplaceAll(sig, ".", ""))) {
+		if w != "PRN" {
+			abbrevs = append(abbrevs, w)
+		}
+	}
+	if len(abbrevs) != 1 {
+		return sigTiming{}, false
+	}
+
+	a := abbrevs[0]
+	if st, ok := sigTimings[a]; ok {
+		return st, true
+	}
+	if len(a) < 3 || a[0] != 'Q' || a[len(a)-1] != 'H' {
+		return sigTiming{}, false
+	}
+	hours, err := strconv.Atoi(a[1 : len(a)-1])
+	if err != nil || hours <= 0 || a[1] == '+' {
+		return sigTiming{}, false
+	}
+	return sigTiming{frequency: 1, period: hours, periodUnit: "h"}, true
+}
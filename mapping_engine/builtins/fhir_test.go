@@ -0,0 +1,873 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestFHIRConstructors(t *testing.T) {
+	coding := func(code, system, display jsonutil.JSONStr) jsonutil.JSONContainer {
+		c, err := Coding(code, system, display)
+		if err != nil {
+			t.Fatalf("Coding(%q, %q, %q) returned unexpected error %v", code, system, display, err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name string
+		fn   func() (jsonutil.JSONContainer, error)
+		want json.RawMessage
+	}{
+		{
+			name: "coding",
+			fn:   func() (jsonutil.JSONContainer, error) { return Coding("123", "http://loinc.org", "Some Test") },
+			want: json.RawMessage(`{"code": "123", "system": "http://loinc.org", "display": "Some Test"}`),
+		},
+		{
+			name: "coding omits empty fields",
+			fn:   func() (jsonutil.JSONContainer, error) { return Coding("123", "", "  ") },
+			want: json.RawMessage(`{"code": "123"}`),
+		},
+		{
+			name: "empty coding",
+			fn:   func() (jsonutil.JSONContainer, error) { return Coding("", "", "") },
+			want: json.RawMessage(`{}`),
+		},
+		{
+			name: "codeable concept",
+			fn: func() (jsonutil.JSONContainer, error) {
+				return CodeableConcept("Some Test", coding("123", "http://loinc.org", ""), nil, coding("", "", ""), coding("456", "urn:local", ""))
+			},
+			want: json.RawMessage(`{"text": "Some Test", "coding": [{"code": "123", "system": "http://loinc.org"}, {"code": "456", "system": "urn:local"}]}`),
+		},
+		{
+			name: "codeable concept text only",
+			fn:   func() (jsonutil.JSONContainer, error) { return CodeableConcept("Some Test") },
+			want: json.RawMessage(`{"text": "Some Test"}`),
+		},
+		{
+			name: "identifier",
+			fn:   func() (jsonutil.JSONContainer, error) { return Identifier("MRN123", "urn:oid:1.2.3", "official") },
+			want: json.RawMessage(`{"value": "MRN123", "system": "urn:oid:1.2.3", "use": "official"}`),
+		},
+		{
+			name: "identifier without use",
+			fn:   func() (jsonutil.JSONContainer, error) { return Identifier("MRN123", "urn:oid:1.2.3", "") },
+			want: json.RawMessage(`{"value": "MRN123", "system": "urn:oid:1.2.3"}`),
+		},
+		{
+			name: "reference",
+			fn:   func() (jsonutil.JSONContainer, error) { return Reference("Patient", "p1") },
+			want: json.RawMessage(`{"reference": "Patient/p1"}`),
+		},
+		{
+			name: "reference without id",
+			fn:   func() (jsonutil.JSONContainer, error) { return Reference("Patient", "") },
+			want: json.RawMessage(`{}`),
+		},
+		{
+			name: "quantity",
+			fn: func() (jsonutil.JSONContainer, error) {
+				return Quantity(jsonutil.JSONNum(5.4), "mg", "http://unitsofmeasure.org", "mg")
+			},
+			want: json.RawMessage(`{"value": 5.4, "unit": "mg", "system": "http://unitsofmeasure.org", "code": "mg"}`),
+		},
+		{
+			name: "quantity zero value",
+			fn:   func() (jsonutil.JSONContainer, error) { return Quantity(jsonutil.JSONNum(0), "mg", "", "") },
+			want: json.RawMessage(`{"value": 0, "unit": "mg"}`),
+		},
+		{
+			name: "quantity without value",
+			fn:   func() (jsonutil.JSONContainer, error) { return Quantity(nil, "mg", "", "") },
+			want: json.RawMessage(`{"unit": "mg"}`),
+		},
+		{
+			name: "period",
+			fn:   func() (jsonutil.JSONContainer, error) { return Period("2020-01-01", "2020-02-01") },
+			want: json.RawMessage(`{"start": "2020-01-01", "end": "2020-02-01"}`),
+		},
+		{
+			name: "open period",
+			fn:   func() (jsonutil.JSONContainer, error) { return Period("2020-01-01", "") },
+			want: json.RawMessage(`{"start": "2020-01-01"}`),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.fn()
+			if err != nil {
+				t.Fatalf("got unexpected error %v", err)
+			}
+			want := mustParseContainer(test.want, t)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("got diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFHIRConstructors_Errors(t *testing.T) {
+	if got, err := Quantity(jsonutil.JSONStr("5"), "mg", "", ""); err == nil {
+		t.Errorf("Quantity(\"5\", ...) = %v, want error", got)
+	}
+	if got, err := Reference("Patient/p1", "p2"); err == nil {
+		t.Errorf("Reference(\"Patient/p1\", \"p2\") = %v, want error", got)
+	}
+}
+
+// usCorePatient is a Patient with the US Core race, ethnicity and birth sex extensions.
+const usCorePatient = `{
+  "resourceType": "Patient",
+  "id": "example",
+  "extension": [
+    {
+      "url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race",
+      "extension": [
+        {
+          "url": "ombCategory",
+          "valueCoding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2106-3", "display": "White"}
+        },
+        {
+          "url": "detailed",
+          "valueCoding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2108-9", "display": "European"}
+        },
+        {"url": "text", "valueString": "Mixed"}
+      ]
+    },
+    {
+      "url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-ethnicity",
+      "extension": [
+        {
+          "url": "ombCategory",
+          "valueCoding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2186-5", "display": "Not Hispanic or Latino"}
+        },
+        {"url": "text", "valueString": "Not Hispanic or Latino"}
+      ]
+    },
+    {"url": "http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex", "valueCode": "F"}
+  ],
+  "gender": "female"
+}`
+
+const (
+	usCoreRace      = "http://hl7.org/fhir/us/core/StructureDefinition/us-core-race"
+	usCoreEthnicity = "http://hl7.org/fhir/us/core/StructureDefinition/us-core-ethnicity"
+	usCoreBirthSex  = "http://hl7.org/fhir/us/core/StructureDefinition/us-core-birthsex"
+)
+
+func TestGetExtension(t *testing.T) {
+	patient := mustParseContainer(json.RawMessage(usCorePatient), t)
+
+	race, err := GetExtension(patient, usCoreRace)
+	if err != nil {
+		t.Fatalf("GetExtension(patient, %q) returned unexpected error %v", usCoreRace, err)
+	}
+	if got := extensionURL(race); got != usCoreRace {
+		t.Fatalf("GetExtension(patient, %q) returned extension with url %q", usCoreRace, got)
+	}
+
+	tests := []struct {
+		name     string
+		resource jsonutil.JSONToken
+		url      jsonutil.JSONStr
+		want     json.RawMessage
+	}{
+		{
+			name:     "value code",
+			resource: patient,
+			url:      usCoreBirthSex,
+			want:     json.RawMessage(`"F"`),
+		},
+		{
+			name:     "nested value coding",
+			resource: race,
+			url:      "ombCategory",
+			want:     json.RawMessage(`{"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2106-3", "display": "White"}`),
+		},
+		{
+			name:     "nested value string",
+			resource: race,
+			url:      "text",
+			want:     json.RawMessage(`"Mixed"`),
+		},
+		{
+			name:     "missing extension",
+			resource: patient,
+			url:      "http://example.com/missing",
+			want:     json.RawMessage(`null`),
+		},
+		{
+			name:     "no extensions",
+			resource: mustParseContainer(json.RawMessage(`{"resourceType": "Patient"}`), t),
+			url:      usCoreRace,
+			want:     json.RawMessage(`null`),
+		},
+		{
+			name:     "nil resource",
+			resource: nil,
+			url:      usCoreRace,
+			want:     json.RawMessage(`null`),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := GetExtensionValue(test.resource, test.url)
+			if err != nil {
+				t.Fatalf("GetExtensionValue(%v, %q) returned unexpected error %v", test.resource, test.url, err)
+			}
+			want, err := jsonutil.UnmarshalJSON(test.want)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", test.want, err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("GetExtensionValue(%v, %q) returned diff (-want +got):\n%s", test.resource, test.url, diff)
+			}
+		})
+	}
+}
+
+func TestGetExtension_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource json.RawMessage
+		url      jsonutil.JSONStr
+	}{
+		{name: "not an object", resource: json.RawMessage(`["a"]`), url: usCoreRace},
+		{name: "extension not an array", resource: json.RawMessage(`{"extension": {"url": "a"}}`), url: "a"},
+		{name: "empty url", resource: json.RawMessage(usCorePatient), url: ""},
+		{name: "two values", resource: json.RawMessage(`{"extension": [{"url": "a", "valueString": "x", "valueCode": "y"}]}`), url: "a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resource, err := jsonutil.UnmarshalJSON(test.resource)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", test.resource, err)
+			}
+			if got, err := GetExtensionValue(resource, test.url); err == nil {
+				t.Errorf("GetExtensionValue(%s, %q) = %v, want error", test.resource, test.url, got)
+			}
+		})
+	}
+}
+
+func TestSetExtension(t *testing.T) {
+	coding := func(code, display jsonutil.JSONStr) jsonutil.JSONToken {
+		c, err := Coding(code, "urn:oid:2.16.840.1.113883.6.238", display)
+		if err != nil {
+			t.Fatalf("Coding(%q, ...) returned unexpected error %v", code, err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		resource   json.RawMessage
+		url        jsonutil.JSONStr
+		valueField jsonutil.JSONStr
+		value      jsonutil.JSONToken
+		want       json.RawMessage
+	}{
+		{
+			name:       "append to resource without extensions",
+			resource:   json.RawMessage(`{"resourceType": "Patient"}`),
+			url:        usCoreBirthSex,
+			valueField: "valueCode",
+			value:      jsonutil.JSONStr("M"),
+			want:       json.RawMessage(`{"resourceType": "Patient", "extension": [{"url": "` + usCoreBirthSex + `", "valueCode": "M"}]}`),
+		},
+		{
+			name:       "nil resource",
+			resource:   json.RawMessage(`null`),
+			url:        "ombCategory",
+			valueField: "valueCoding",
+			value:      coding("2106-3", "White"),
+			want:       json.RawMessage(`{"extension": [{"url": "ombCategory", "valueCoding": {"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2106-3", "display": "White"}}]}`),
+		},
+		{
+			name:       "replace keeps order",
+			resource:   json.RawMessage(`{"extension": [{"url": "a", "valueString": "1"}, {"url": "b", "valueString": "2"}, {"url": "c", "valueString": "3"}]}`),
+			url:        "b",
+			valueField: "valueInteger",
+			value:      jsonutil.JSONNum(5),
+			want:       json.RawMessage(`{"extension": [{"url": "a", "valueString": "1"}, {"url": "b", "valueInteger": 5}, {"url": "c", "valueString": "3"}]}`),
+		},
+		{
+			name:       "replace keeps later extensions with the url",
+			resource:   json.RawMessage(`{"extension": [{"url": "a", "valueString": "1"}, {"url": "b", "valueString": "2"}, {"url": "a", "valueString": "3"}]}`),
+			url:        "a",
+			valueField: "valueString",
+			value:      jsonutil.JSONStr("4"),
+			want:       json.RawMessage(`{"extension": [{"url": "a", "valueString": "4"}, {"url": "b", "valueString": "2"}, {"url": "a", "valueString": "3"}]}`),
+		},
+		{
+			name:       "append",
+			resource:   json.RawMessage(`{"extension": [{"url": "a", "valueString": "1"}]}`),
+			url:        "b",
+			valueField: "valueBoolean",
+			value:      jsonutil.JSONBool(true),
+			want:       json.RawMessage(`{"extension": [{"url": "a", "valueString": "1"}, {"url": "b", "valueBoolean": true}]}`),
+		},
+		{
+			name:       "nil value removes",
+			resource:   json.RawMessage(`{"id": "1", "extension": [{"url": "a", "valueString": "1"}, {"url": "b", "valueString": "2"}]}`),
+			url:        "a",
+			valueField: "valueString",
+			want:       json.RawMessage(`{"id": "1", "extension": [{"url": "b", "valueString": "2"}]}`),
+		},
+		{
+			name:       "nil value removes all with the url",
+			resource:   json.RawMessage(`{"extension": [{"url": "a", "valueString": "1"}, {"url": "b", "valueString": "2"}, {"url": "a", "valueString": "3"}]}`),
+			url:        "a",
+			valueField: "valueString",
+			want:       json.RawMessage(`{"extension": [{"url": "b", "valueString": "2"}]}`),
+		},
+		{
+			name:       "removing the last extension removes the field",
+			resource:   json.RawMessage(`{"id": "1", "extension": [{"url": "a", "valueString": "1"}]}`),
+			url:        "a",
+			valueField: "valueString",
+			want:       json.RawMessage(`{"id": "1"}`),
+		},
+		{
+			name:       "nested extensions",
+			resource:   json.RawMessage(`{"resourceType": "Patient"}`),
+			url:        usCoreEthnicity,
+			valueField: "extension",
+			value: jsonutil.JSONArr{
+				mustParseContainer(json.RawMessage(`{"url": "text", "valueString": "Hispanic or Latino"}`), t),
+			},
+			want: json.RawMessage(`{"resourceType": "Patient", "extension": [{"url": "` + usCoreEthnicity + `", "extension": [{"url": "text", "valueString": "Hispanic or Latino"}]}]}`),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resource, err := jsonutil.UnmarshalJSON(test.resource)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", test.resource, err)
+			}
+			got, err := SetExtension(resource, test.url, test.valueField, test.value)
+			if err != nil {
+				t.Fatalf("SetExtension(%s, %q, %q, %v) returned unexpected error %v", test.resource, test.url, test.valueField, test.value, err)
+			}
+			if diff := cmp.Diff(mustParseContainer(test.want, t), got); diff != "" {
+				t.Errorf("SetExtension(%s, %q, %q, %v) returned diff (-want +got):\n%s", test.resource, test.url, test.valueField, test.value, diff)
+			}
+			original, err := jsonutil.UnmarshalJSON(test.resource)
+			if err != nil {
+				t.Fatalf("failed to parse %s: %v", test.resource, err)
+			}
+			if diff := cmp.Diff(original, resource); diff != "" {
+				t.Errorf("SetExtension(%s, ...) modified its input, diff (-want +got):\n%s", test.resource, diff)
+			}
+		})
+	}
+}
+
+func TestSetExtension_NestedRoundTrip(t *testing.T) {
+	patient := mustParseContainer(json.RawMessage(usCorePatient), t)
+
+	// Update the text of the race extension, by setting it in the extension and then the extension
+	// in the patient.
+	race, err := GetExtension(patient, usCoreRace)
+	if err != nil {
+		t.Fatalf("GetExtension(patient, %q) returned unexpected error %v", usCoreRace, err)
+	}
+	race, err = SetExtension(race, "text", "valueString", jsonutil.JSONStr("White"))
+	if err != nil {
+		t.Fatalf("SetExtension(race, text, ...) returned unexpected error %v", err)
+	}
+	nested, err := extensions(race)
+	if err != nil {
+		t.Fatalf("extensions(race) returned unexpected error %v", err)
+	}
+	updated, err := SetExtension(patient, usCoreRace, "extension", nested)
+	if err != nil {
+		t.Fatalf("SetExtension(patient, %q, ...) returned unexpected error %v", usCoreRace, err)
+	}
+
+	race, err = GetExtension(updated, usCoreRace)
+	if err != nil {
+		t.Fatalf("GetExtension(updated, %q) returned unexpected error %v", usCoreRace, err)
+	}
+	for url, want := range map[jsonutil.JSONStr]jsonutil.JSONToken{
+		"text":        jsonutil.JSONStr("White"),
+		"ombCategory": mustParseContainer(json.RawMessage(`{"system": "urn:oid:2.16.840.1.113883.6.238", "code": "2106-3", "display": "White"}`), t),
+	} {
+		got, err := GetExtensionValue(race, url)
+		if err != nil {
+			t.Fatalf("GetExtensionValue(race, %q) returned unexpected error %v", url, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("GetExtensionValue(race, %q) returned diff (-want +got):\n%s", url, diff)
+		}
+	}
+	if got, err := GetExtensionValue(updated, usCoreBirthSex); err != nil || got != jsonutil.JSONStr("F") {
+		t.Errorf("GetExtensionValue(updated, %q) = %v, %v, want F", usCoreBirthSex, got, err)
+	}
+}
+
+func TestSetExtension_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		resource   jsonutil.JSONToken
+		url        jsonutil.JSONStr
+		valueField jsonutil.JSONStr
+	}{
+		{name: "empty url", resource: jsonutil.JSONContainer{}, url: "", valueField: "valueString"},
+		{name: "bare value field", resource: jsonutil.JSONContainer{}, url: "a", valueField: "value"},
+		{name: "other value field", resource: jsonutil.JSONContainer{}, url: "a", valueField: "code"},
+		{name: "not an object", resource: jsonutil.JSONStr("a"), url: "a", valueField: "valueString"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := SetExtension(test.resource, test.url, test.valueField, jsonutil.JSONStr("x")); err == nil {
+				t.Errorf("SetExtension(%v, %q, %q, x) = %v, want error", test.resource, test.url, test.valueField, got)
+			}
+		})
+	}
+}
+
+func TestSortBundleEntries(t *testing.T) {
+	bundle := json.RawMessage(`{
+		"resourceType": "Bundle",
+		"type": "collection",
+		"entry": [
+			{"resource": {"resourceType": "Observation", "id": "o1"}},
+			{"resource": {"resourceType": "Encounter", "id": "e1"}},
+			{"resource": {"resourceType": "Patient", "id": "p1"}},
+			{"resource": {"resourceType": "Observation", "id": "o2"}},
+			{"resource": {"resourceType": "Device", "id": "d1"}},
+			{"fullUrl": "urn:uuid:x"},
+			{"resource": {"resourceType": "Encounter", "id": "e2"}},
+			{"resource": {"resourceType": "Condition", "id": "c1"}}
+		]
+	}`)
+
+	tests := []struct {
+		name  string
+		order jsonutil.JSONArr
+		want  []string
+	}{
+		{
+			name:  "all types listed",
+			order: jsonutil.JSONArr{jsonutil.JSONStr("Patient"), jsonutil.JSONStr("Encounter"), jsonutil.JSONStr("Condition"), jsonutil.JSONStr("Observation"), jsonutil.JSONStr("Device")},
+			want:  []string{"p1", "e1", "e2", "c1", "o1", "o2", "d1", ""},
+		},
+		{
+			name:  "unlisted types last",
+			order: jsonutil.JSONArr{jsonutil.JSONStr("Patient"), jsonutil.JSONStr("Observation")},
+			want:  []string{"p1", "o1", "o2", "e1", "d1", "", "e2", "c1"},
+		},
+		{
+			name:  "listed type not in the bundle",
+			order: jsonutil.JSONArr{jsonutil.JSONStr("Practitioner"), jsonutil.JSONStr("Encounter")},
+			want:  []string{"e1", "e2", "o1", "p1", "o2", "d1", "", "c1"},
+		},
+		{
+			name:  "repeated type",
+			order: jsonutil.JSONArr{jsonutil.JSONStr("Condition"), jsonutil.JSONStr("Patient"), jsonutil.JSONStr("Condition")},
+			want:  []string{"c1", "p1", "o1", "e1", "o2", "d1", "", "e2"},
+		},
+		{
+			name:  "empty order",
+			order: jsonutil.JSONArr{},
+			want:  []string{"o1", "e1", "p1", "o2", "d1", "", "e2", "c1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := mustParseContainer(bundle, t)
+			orig := jsonutil.Deepcopy(in)
+
+			got, err := SortBundleEntries(in, test.order)
+			if err != nil {
+				t.Fatalf("SortBundleEntries(bundle, %v) returned unexpected error %v", test.order, err)
+			}
+			var ids []string
+			entries, err := jsonutil.GetField(got, "entry")
+			if err != nil {
+				t.Fatalf("GetField(entry) returned unexpected error %v", err)
+			}
+			for _, e := range entries.(jsonutil.JSONArr) {
+				id, err := jsonutil.GetField(e, "resource.id")
+				if err != nil {
+					t.Fatalf("GetField(resource.id) returned unexpected error %v", err)
+				}
+				s, _ := id.(jsonutil.JSONStr)
+				ids = append(ids, string(s))
+			}
+			if diff := cmp.Diff(test.want, ids); diff != "" {
+				t.Errorf("SortBundleEntries(bundle, %v) returned entries with diff (-want +got):\n%s", test.order, diff)
+			}
+			if rt, err := jsonutil.GetField(got, "type"); err != nil || rt != jsonutil.JSONStr("collection") {
+				t.Errorf("SortBundleEntries(bundle, %v) has type %v, %v, want collection", test.order, rt, err)
+			}
+			if !cmp.Equal(in, orig) {
+				t.Errorf("SortBundleEntries(bundle, %v) modified its input", test.order)
+			}
+		})
+	}
+}
+
+func TestSortBundleEntries_NoEntries(t *testing.T) {
+	in := mustParseContainer(json.RawMessage(`{"resourceType": "Bundle", "type": "collection"}`), t)
+	got, err := SortBundleEntries(in, jsonutil.JSONArr{jsonutil.JSONStr("Patient")})
+	if err != nil {
+		t.Fatalf("SortBundleEntries(%v) returned unexpected error %v", in, err)
+	}
+	if !cmp.Equal(got, in) {
+		t.Errorf("SortBundleEntries(%v) = %v, want it unchanged", in, got)
+	}
+}
+
+func TestSortBundleEntries_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		bundle json.RawMessage
+		order  jsonutil.JSONArr
+	}{
+		{
+			name:   "non-string type",
+			bundle: json.RawMessage(`{"entry": []}`),
+			order:  jsonutil.JSONArr{jsonutil.JSONStr("Patient"), jsonutil.JSONNum(1)},
+		},
+		{
+			name:   "entry not an array",
+			bundle: json.RawMessage(`{"entry": {"resource": {}}}`),
+			order:  jsonutil.JSONArr{jsonutil.JSONStr("Patient")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := mustParseContainer(test.bundle, t)
+			if got, err := SortBundleEntries(in, test.order); err == nil {
+				t.Errorf("SortBundleEntries(%v, %v) = %v, want error", in, test.order, got)
+			}
+		})
+	}
+}
+
+func TestIsValidFHIRId(t *testing.T) {
+	tests := []struct {
+		id   jsonutil.JSONStr
+		want jsonutil.JSONBool
+	}{
+		{id: "abc-123.DEF", want: true},
+		{id: jsonutil.JSONStr(strings.Repeat("a", 64)), want: true},
+		{id: jsonutil.JSONStr(strings.Repeat("a", 65)), want: false},
+		{id: "", want: false},
+		{id: "a b", want: false},
+		{id: "a/b", want: false},
+		{id: "a_b", want: false},
+		{id: "é", want: false},
+	}
+	for _, test := range tests {
+		got, err := IsValidFHIRId(test.id)
+		if err != nil {
+			t.Fatalf("IsValidFHIRId(%q) returned unexpected error %v", test.id, err)
+		}
+		if got != test.want {
+			t.Errorf("IsValidFHIRId(%q) = %v, want %v", test.id, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeFHIRId(t *testing.T) {
+	long := strings.Repeat("0123456789", 7)
+	tests := []struct {
+		name string
+		id   jsonutil.JSONStr
+		want jsonutil.JSONStr
+	}{
+		{
+			name: "valid",
+			id:   "abc-123.DEF",
+			want: "abc-123.DEF",
+		},
+		{
+			name: "empty",
+			id:   "",
+			want: "",
+		},
+		{
+			name: "invalid characters",
+			id:   "MRN 123/45_6",
+			want: "MRN-123-45-6",
+		},
+		{
+			name: "non-ascii characters are replaced once",
+			id:   "José",
+			want: "Jos-",
+		},
+		{
+			name: "64 characters",
+			id:   jsonutil.JSONStr(long[:64]),
+			want: jsonutil.JSONStr(long[:64]),
+		},
+		{
+			name: "too long",
+			id:   jsonutil.JSONStr(long),
+			want: "012345678901234567890123456789012345678901234567890-57445fa40b08",
+		},
+		{
+			name: "too long, differing after the cut",
+			id:   jsonutil.JSONStr(long + "x"),
+			want: "012345678901234567890123456789012345678901234567890-f806b0314d0f",
+		},
+		{
+			name: "too long after sanitizing",
+			id:   jsonutil.JSONStr(strings.Repeat("ü", 65)),
+			want: "----------------------------------------------------093c56fb02c0",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := SanitizeFHIRId(test.id)
+			if err != nil {
+				t.Fatalf("SanitizeFHIRId(%q) returned unexpected error %v", test.id, err)
+			}
+			if got != test.want {
+				t.Errorf("SanitizeFHIRId(%q) = %q, want %q", test.id, got, test.want)
+			}
+			if valid, _ := IsValidFHIRId(got); test.id != "" && !valid {
+				t.Errorf("SanitizeFHIRId(%q) = %q, which is not a valid FHIR id", test.id, got)
+			}
+		})
+	}
+}
+
+func TestCodingToCWE(t *testing.T) {
+	tests := []struct {
+		name   string
+		coding json.RawMessage
+		want   jsonutil.JSONStr
+	}{
+		{
+			name:   "all components",
+			coding: json.RawMessage(`{"system": "http://loinc.org", "code": "8867-4", "display": "Heart rate"}`),
+			want:   "8867-4^Heart rate^http://loinc.org",
+		},
+		{
+			name:   "code only",
+			coding: json.RawMessage(`{"code": "8867-4"}`),
+			want:   "8867-4",
+		},
+		{
+			name:   "missing display",
+			coding: json.RawMessage(`{"system": "http://loinc.org", "code": "8867-4"}`),
+			want:   "8867-4^^http://loinc.org",
+		},
+		{
+			name:   "delimiters",
+			coding: json.RawMessage(`{"code": "A^B", "display": "Salt & Pepper | ~ \\", "system": "urn:x"}`),
+			want:   `A\S\B^Salt \T\ Pepper \F\ \R\ \E\^urn:x`,
+		},
+		{
+			name:   "empty",
+			coding: json.RawMessage(`{}`),
+			want:   "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			coding := mustParseContainer(test.coding, t)
+			got, err := CodingToCWE(coding)
+			if err != nil {
+				t.Fatalf("CodingToCWE(%v) returned unexpected error %v", coding, err)
+			}
+			if got != test.want {
+				t.Errorf("CodingToCWE(%v) = %q, want %q", coding, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCodingToCWE_Errors(t *testing.T) {
+	coding := mustParseContainer(json.RawMessage(`{"code": 1}`), t)
+	if got, err := CodingToCWE(coding); err == nil {
+		t.Errorf("CodingToCWE(%v) = %q, want error", coding, got)
+	}
+}
+
+func TestCWEToCoding(t *testing.T) {
+	tests := []struct {
+		name string
+		cwe  jsonutil.JSONStr
+		want json.RawMessage
+	}{
+		{
+			name: "all components",
+			cwe:  "8867-4^Heart rate^LN",
+			want: json.RawMessage(`{"system": "LN", "code": "8867-4", "display": "Heart rate"}`),
+		},
+		{
+			name: "empty components",
+			cwe:  "8867-4^^LN",
+			want: json.RawMessage(`{"system": "LN", "code": "8867-4"}`),
+		},
+		{
+			name: "extra components",
+			cwe:  "8867-4^Heart rate^LN^HR^Pulse^L",
+			want: json.RawMessage(`{"system": "LN", "code": "8867-4", "display": "Heart rate"}`),
+		},
+		{
+			name: "escape sequences",
+			cwe:  `A\S\B^Salt \T\ Pepper \E\ \.br\^urn:x`,
+			want: json.RawMessage(`{"system": "urn:x", "code": "A^B", "display": "Salt & Pepper \\ \\.br\\"}`),
+		},
+		{
+			name: "empty",
+			cwe:  "",
+			want: json.RawMessage(`{}`),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := CWEToCoding(test.cwe)
+			if err != nil {
+				t.Fatalf("CWEToCoding(%q) returned unexpected error %v", test.cwe, err)
+			}
+			if diff := cmp.Diff(mustParseContainer(test.want, t), got); diff != "" {
+				t.Errorf("CWEToCoding(%q) returned diff (-want +got):\n%s", test.cwe, diff)
+			}
+		})
+	}
+}
+
+func TestCWERoundTrip(t *testing.T) {
+	codings := []json.RawMessage{
+		json.RawMessage(`{"system": "http://loinc.org", "code": "8867-4", "display": "Heart rate"}`),
+		json.RawMessage(`{"code": "^&^", "display": "R&D ^ QA"}`),
+		json.RawMessage(`{"code": "a\\S\\b", "display": "|~\\", "system": "&"}`),
+		json.RawMessage(`{"display": "text only"}`),
+	}
+	for _, raw := range codings {
+		coding := mustParseContainer(raw, t)
+		cwe, err := CodingToCWE(coding)
+		if err != nil {
+			t.Fatalf("CodingToCWE(%v) returned unexpected error %v", coding, err)
+		}
+		if strings.ContainsAny(strings.ReplaceAll(string(cwe), "^", ""), "&|~") {
+			t.Errorf("CodingToCWE(%v) = %q, want delimiters escaped", coding, cwe)
+		}
+		got, err := CWEToCoding(cwe)
+		if err != nil {
+			t.Fatalf("CWEToCoding(%q) returned unexpected error %v", cwe, err)
+		}
+		if diff := cmp.Diff(coding, got); diff != "" {
+			t.Errorf("CWEToCoding(CodingToCWE(%v)) returned diff (-want +got):\n%s", coding, diff)
+		}
+	}
+}
+
+func TestSigToTiming(t *testing.T) {
+	tests := []struct {
+		sig  jsonutil.JSONStr
+		want json.RawMessage
+	}{
+		{
+			sig:  "QD",
+			want: json.RawMessage(`{"repeat": {"frequency": 1, "period": 1, "periodUnit": "d"}, "code": {"text": "QD"}}`),
+		},
+		{
+			sig:  "BID",
+			want: json.RawMessage(`{"repeat": {"frequency": 2, "period": 1, "periodUnit": "d"}, "code": {"text": "BID"}}`),
+		},
+		{
+			sig:  "tid",
+			want: json.RawMessage(`{"repeat": {"frequency": 3, "period": 1, "periodUnit": "d"}, "code": {"text": "tid"}}`),
+		},
+		{
+			sig:  "Q.I.D.",
+			want: json.RawMessage(`{"repeat": {"frequency": 4, "period": 1, "periodUnit": "d"}, "code": {"text": "Q.I.D."}}`),
+		},
+		{
+			sig:  "QHS",
+			want: json.RawMessage(`{"repeat": {"frequency": 1, "period": 1, "periodUnit": "d", "when": ["HS"]}, "code": {"text": "QHS"}}`),
+		},
+		{
+			sig:  "QOD",
+			want: json.RawMessage(`{"repeat": {"frequency": 1, "period": 2, "periodUnit": "d"}, "code": {"text": "QOD"}}`),
+		},
+		{
+			sig:  "Q6H",
+			want: json.RawMessage(`{"repeat": {"frequency": 1, "period": 6, "periodUnit": "h"}, "code": {"text": "Q6H"}}`),
+		},
+		{
+			sig:  "q12h",
+			want: json.RawMessage(`{"repeat": {"frequency": 1, "period": 12, "periodUnit": "h"}, "code": {"text": "q12h"}}`),
+		},
+		{
+			sig:  "TID PRN",
+			want: json.RawMessage(`{"repeat": {"frequency": 3, "period": 1, "periodUnit": "d"}, "code": {"text": "TID PRN"}}`),
+		},
+		{
+			sig:  " prn  q4h ",
+			want: json.RawMessage(`{"repeat": {"frequency": 1, "period": 4, "periodUnit": "h"}, "code": {"text": " prn  q4h "}}`),
+		},
+		{
+			sig:  "PRN",
+			want: json.RawMessage(`{"code": {"text": "PRN"}}`),
+		},
+		{
+			sig:  "Q0H",
+			want: json.RawMessage(`{"code": {"text": "Q0H"}}`),
+		},
+		{
+			sig:  "Q+6H",
+			want: json.RawMessage(`{"code": {"text": "Q+6H"}}`),
+		},
+		{
+			sig:  "QH",
+			want: json.RawMessage(`{"code": {"text": "QH"}}`),
+		},
+		{
+			sig:  "Q4-6H",
+			want: json.RawMessage(`{"code": {"text": "Q4-6H"}}`),
+		},
+		{
+			sig:  "BID TID",
+			want: json.RawMessage(`{"code": {"text": "BID TID"}}`),
+		},
+		{
+			sig:  "1 tab by mouth twice daily",
+			want: json.RawMessage(`{"code": {"text": "1 tab by mouth twice daily"}}`),
+		},
+		{
+			sig:  " ",
+			want: json.RawMessage(`{}`),
+		},
+	}
+	for _, test := range tests {
+		t.Run(string(test.sig), func(t *testing.T) {
+			got, err := SigToTiming(test.sig)
+			if err != nil {
+				t.Fatalf("SigToTiming(%q) returned unexpected error %v", test.sig, err)
+			}
+			if diff := cmp.Diff(mustParseContainer(test.want, t), got); diff != "" {
+				t.Errorf("SigToTiming(%q) returned diff (-want +got):\n%s", test.sig, diff)
+			}
+		})
+	}
+}
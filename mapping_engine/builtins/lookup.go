@@ -0,0 +1,183 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// LookupTables holds user supplied lookup tables (e.g. facility code to facility name), indexed by
+// a key field, for the $Lookup and $LookupAll builtins. Like UnionBy, keys are compared by their
+// jsonutil.Hash, so the number 1 and the string "1" are different keys. LookupTables is safe for
+// concurrent use.
+type LookupTables struct {
+	mu     sync.RWMutex
+	tables map[string]map[hashKey]jsonutil.JSONArr
+}
+
+// NewLookupTables creates an empty set of lookup tables.
+func NewLookupTables() *LookupTables {
+	return &LookupTables{tables: make(map[string]map[hashKey]jsonutil.JSONArr)}
+}
+
+// Register indexes the given rows by the given key field and makes them available as the table
+// with the given name, replacing any table previously registered with that name. Every row must be
+// an object; rows without the key field are never matched.
+func (l *LookupTables) Register(name string, rows jsonutil.JSONArr, keyField string) error {
+	if name == "" {
+		return fmt.Errorf("lookup table name must not be empty")
+	}
+	if keyField == "" {
+		return fmt.Errorf("key field of lookup table %q must not be empty", name)
+	}
+
+	index := make(map[hashKey]jsonutil.JSONArr)
+	for i, row := range rows {
+		if _, ok := row.(jsonutil.JSONContainer); !ok {
+			return fmt.Errorf("row %d of lookup table %q must be an object but was %T", i, name, row)
+		}
+		key, err := jsonutil.GetField(row, keyField)
+		if err != nil {
+			return fmt.Errorf("row %d of lookup table %q: %v", i, name, err)
+		}
+		if key == nil {
+			continue
+		}
+		h, err := jsonutil.Hash(key, false)
+		if err != nil {
+			return fmt.Errorf("row %d of lookup table %q: %v", i, name, err)
+		}
+		k := newHashKey(h)
+		index[k] = append(index[k], jsonutil.Deepcopy(row))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tables[name] = index
+	return nil
+}
+
+// Clone returns a copy of the lookup tables. Tables registered in either afterwards do not affect
+// the other.
+func (l *LookupTables) Clone() *LookupTables {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	// Registered tables are never modified, only replaced, so they can be shared.
+	c := &LookupTables{tables: make(map[string]map[hashKey]jsonutil.JSONArr, len(l.tables))}
+	for name, index := range l.tables {
+		c.tables[name] = index
+	}
+	return c
+}
+
+// Lookup returns the first row (in the order they were registered) of the given table whose key
+// field equals the given key, or nil if there is none.
+func (l *LookupTables) Lookup(table jsonutil.JSONStr, key jsonutil.JSONToken) (jsonutil.JSONToken, error) {
+	rows, err := l.find(table, key)
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return jsonutil.Deepcopy(rows[0]), nil
+}
+
+// LookupAll returns all rows of the given table whose key field equals the given key, in the order
+// they were registered. The result is empty if there are none.
+func (l *LookupTables) LookupAll(table jsonutil.JSONStr, key jsonutil.JSONToken) (jsonutil.JSONArr, error) {
+	rows, err := l.find(table, key)
+	if err != nil {
+		return nil, err
+	}
+	return jsonutil.Deepcopy(append(jsonutil.JSONArr{}, rows...)).(jsonutil.JSONArr), nil
+}
+
+// find returns the (shared, not to be modified) rows of the given table matching the given key.
+func (l *LookupTables) find(table jsonutil.JSONStr, key jsonutil.JSONToken) (jsonutil.JSONArr, error) {
+	l.mu.RLock()
+	index, ok := l.tables[string(table)]
+	l.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown lookup table %q, available tables are %v", table, l.names())
+	}
+
+	if key == nil {
+		return nil, nil
+	}
+	h, err := jsonutil.Hash(key, false)
+	if err != nil {
+		return nil, err
+	}
+	return index[newHashKey(h)], nil
+}
+
+func (l *LookupTables) names() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	names := make([]string, 0, len(l.tables))
+	for n := range l.tables {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseLookupTableCSV reads a lookup table from CSV. The first record is the header and holds the
+// field names, every other record becomes a row object of string values.
+func ParseLookupTableCSV(r io.Reader) (jsonutil.JSONArr, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("lookup table CSV has no header")
+	}
+
+	header := records[0]
+	rows := make(jsonutil.JSONArr, 0, len(records)-1)
+	for _, rec := range records[1:] {
+		row := make(jsonutil.JSONContainer, len(header))
+		for i, f := range header {
+			var v jsonutil.JSONToken = jsonutil.JSONStr(rec[i])
+			row[f] = &v
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// ParseLookupTableJSON reads a lookup table from a JSON array of row objects.
+func ParseLookupTableJSON(r io.Reader) (jsonutil.JSONArr, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	t, err := jsonutil.UnmarshalJSON(b)
+	if err != nil {
+		return nil, err
+	}
+	rows, ok := t.(jsonutil.JSONArr)
+	if !ok {
+		return nil, fmt.Errorf("lookup table JSON must be an array but was %T", t)
+	}
+	return rows, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestLookupTables(t *testing.T) {
+	tables := NewLookupTables()
+	rows := mustParseArray(json.RawMessage(`[
+		{"code": "F1", "name": "General Hospital"},
+		{"code": "F2", "name": "Eastside Clinic"},
+		{"code": "F2", "name": "Eastside Clinic Annex"},
+		{"code": 3, "name": "Numbered Facility"},
+		{"name": "No Code"}
+	]`), t)
+	if err := tables.Register("facilities", rows, "code"); err != nil {
+		t.Fatalf("Register returned unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		table   jsonutil.JSONStr
+		key     jsonutil.JSONToken
+		want    jsonutil.JSONToken
+		wantAll jsonutil.JSONArr
+	}{
+		{
+			name:    "single match",
+			table:   "facilities",
+			key:     jsonutil.JSONStr("F1"),
+			want:    mustParseContainer(json.RawMessage(`{"code": "F1", "name": "General Hospital"}`), t),
+			wantAll: mustParseArray(json.RawMessage(`[{"code": "F1", "name": "General Hospital"}]`), t),
+		},
+		{
+			name:    "multiple matches",
+			table:   "facilities",
+			key:     jsonutil.JSONStr("F2"),
+			want:    mustParseContainer(json.RawMessage(`{"code": "F2", "name": "Eastside Clinic"}`), t),
+			wantAll: mustParseArray(json.RawMessage(`[{"code": "F2", "name": "Eastside Clinic"}, {"code": "F2", "name": "Eastside Clinic Annex"}]`), t),
+		},
+		{
+			name:    "numeric key",
+			table:   "facilities",
+			key:     jsonutil.JSONNum(3),
+			want:    mustParseContainer(json.RawMessage(`{"code": 3, "name": "Numbered Facility"}`), t),
+			wantAll: mustParseArray(json.RawMessage(`[{"code": 3, "name": "Numbered Facility"}]`), t),
+		},
+		{
+			name:    "string does not match number",
+			table:   "facilities",
+			key:     jsonutil.JSONStr("3"),
+			want:    nil,
+			wantAll: jsonutil.JSONArr{},
+		},
+		{
+			name:    "nil key",
+			table:   "facilities",
+			key:     nil,
+			want:    nil,
+			wantAll: jsonutil.JSONArr{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := tables.Lookup(test.table, test.key)
+			if err != nil {
+				t.Fatalf("Lookup(%v, %v) returned unexpected error %v", test.table, test.key, err)
+			}
+			if !cmp.Equal(got, test.want) {
+				t.Errorf("Lookup(%v, %v) = %v, want %v", test.table, test.key, got, test.want)
+			}
+
+			gotAll, err := tables.LookupAll(test.table, test.key)
+			if err != nil {
+				t.Fatalf("LookupAll(%v, %v) returned unexpected error %v", test.table, test.key, err)
+			}
+			if !cmp.Equal(gotAll, test.wantAll) {
+				t.Errorf("LookupAll(%v, %v) = %v, want %v", test.table, test.key, gotAll, test.wantAll)
+			}
+		})
+	}
+}
+
+func TestLookupTables_Errors(t *testing.T) {
+	tables := NewLookupTables()
+	if err := tables.Register("t", mustParseArray(json.RawMessage(`[{"k": 1}]`), t), "k"); err != nil {
+		t.Fatalf("Register returned unexpected error %v", err)
+	}
+
+	if _, err := tables.Lookup("unknown", jsonutil.JSONNum(1)); err == nil || !strings.Contains(err.Error(), "[t]") {
+		t.Errorf("Lookup of unknown table got error %v, want error listing the available tables", err)
+	}
+	if err := tables.Register("t", mustParseArray(json.RawMessage(`["not an object"]`), t), "k"); err == nil {
+		t.Errorf("Register of non-object row expected error but got nil")
+	}
+	if err := tables.Register("t", jsonutil.JSONArr{}, ""); err == nil {
+		t.Errorf("Register with empty key field expected error but got nil")
+	}
+}
+
+func TestLookupTables_ResultsAreCopies(t *testing.T) {
+	tables := NewLookupTables()
+	if err := tables.Register("t", mustParseArray(json.RawMessage(`[{"k": 1, "v": "a"}]`), t), "k"); err != nil {
+		t.Fatalf("Register returned unexpected error %v", err)
+	}
+
+	got, err := tables.Lookup("t", jsonutil.JSONNum(1))
+	if err != nil {
+		t.Fatalf("Lookup returned unexpected error %v", err)
+	}
+	var v jsonutil.JSONToken = jsonutil.JSONStr("modified")
+	got.(jsonutil.JSONContainer)["v"] = &v
+
+	again, err := tables.Lookup("t", jsonutil.JSONNum(1))
+	if err != nil {
+		t.Fatalf("Lookup returned unexpected error %v", err)
+	}
+	if want := mustParseContainer(json.RawMessage(`{"k": 1, "v": "a"}`), t); !cmp.Equal(again, want) {
+		t.Errorf("Lookup after modifying a result = %v, want %v", again, want)
+	}
+}
+
+func TestLookupTables_Clone(t *testing.T) {
+	tables := NewLookupTables()
+	if err := tables.Register("t", mustParseArray(json.RawMessage(`[{"k": 1, "v": "a"}]`), t), "k"); err != nil {
+		t.Fatalf("Register returned unexpected error %v", err)
+	}
+
+	clone := tables.Clone()
+	if err := clone.Register("t", mustParseArray(json.RawMessage(`[{"k": 1, "v": "b"}]`), t), "k"); err != nil {
+		t.Fatalf("Register in the clone returned unexpected error %v", err)
+	}
+	if err := tables.Register("u", mustParseArray(json.RawMessage(`[{"k": 1}]`), t), "k"); err != nil {
+		t.Fatalf("Register returned unexpected error %v", err)
+	}
+
+	for _, test := range []struct {
+		tables *LookupTables
+		want   string
+	}{{tables, `{"k": 1, "v": "a"}`}, {clone, `{"k": 1, "v": "b"}`}} {
+		got, err := test.tables.Lookup("t", jsonutil.JSONNum(1))
+		if err != nil {
+			t.Fatalf("Lookup returned unexpected error %v", err)
+		}
+		if want := mustParseContainer(json.RawMessage(test.want), t); !cmp.Equal(got, want) {
+			t.Errorf("Lookup = %v, want %v", got, want)
+		}
+	}
+	if _, err := clone.Lookup("u", jsonutil.JSONNum(1)); err == nil {
+		t.Errorf("Lookup in the clone found a table registered in the original after cloning")
+	}
+}
+
+func TestParseLookupTable(t *testing.T) {
+	want := mustParseArray(json.RawMessage(`[{"code": "F1", "name": "General, Hospital"}, {"code": "F2", "name": "Clinic"}]`), t)
+
+	csvRows, err := ParseLookupTableCSV(strings.NewReader("code,name\nF1,\"General, Hospital\"\nF2,Clinic\n"))
+	if err != nil {
+		t.Fatalf("ParseLookupTableCSV returned unexpected error %v", err)
+	}
+	if !cmp.Equal(csvRows, want) {
+		t.Errorf("ParseLookupTableCSV = %v, want %v", csvRows, want)
+	}
+
+	jsonRows, err := ParseLookupTableJSON(strings.NewReader(`[{"code": "F1", "name": "General, Hospital"}, {"code": "F2", "name": "Clinic"}]`))
+	if err != nil {
+		t.Fatalf("ParseLookupTableJSON returned unexpected error %v", err)
+	}
+	if !cmp.Equal(jsonRows, want) {
+		t.Errorf("ParseLookupTableJSON = %v, want %v", jsonRows, want)
+	}
+
+	if _, err := ParseLookupTableCSV(strings.NewReader("")); err == nil {
+		t.Errorf("ParseLookupTableCSV of empty input expected error but got nil")
+	}
+	if _, err := ParseLookupTableJSON(strings.NewReader(`{"code": "F1"}`)); err == nil {
+		t.Errorf("ParseLookupTableJSON of non-array expected error but got nil")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+const xhtmlNamespace = "http://www.w3.org/1999/xhtml"
+
+// GenerateNarrative generates a FHIR Narrative (i.e. a value for the text field of a resource)
+// with a table containing the given fields of the resource. Fields are dotted paths (e.g.
+// name[0].family), labelled by their field names (e.g. "Name Family"). Fields that are missing from
+// the resource are omitted, and if none are present an empty object (which is not written) is
+// returned.
+func GenerateNarrative(resource jsonutil.JSONContainer, fields jsonutil.JSONArr) (jsonutil.JSONContainer, error) {
+	var rows strings.Builder
+	for i, f := range fields {
+		field, ok := f.(jsonutil.JSONStr)
+		if !ok {
+			return nil, fmt.Errorf("field %d must be a string but was %T", i, f)
+		}
+		v, err := jsonutil.GetField(resource, string(field))
+		if err != nil {
+			return nil, fmt.Errorf("error reading field %q: %v", field, err)
+		}
+		value := narrativeValue(v)
+		if value == "" {
+			continue
+		}
+		fmt.Fprintf(&rows, "<tr><th>%s</th><td>%s</td></tr>", escapeXHTML(narrativeLabel(string(field))), escapeXHTML(value))
+	}
+	if rows.Len() == 0 {
+		return jsonutil.JSONContainer{}, nil
+	}
+
+	div := fmt.Sprintf(`<div xmlns="%s"><table><tbody>%s</tbody></table></div>`, xhtmlNamespace, rows.String())
+	if err := checkWellFormedXML(div); err != nil {
+		return nil, fmt.Errorf("generated narrative is not well-formed: %v", err)
+	}
+
+	var status, d jsonutil.JSONToken = jsonutil.JSONStr("generated"), jsonutil.JSONStr(div)
+	return jsonutil.JSONContainer{"status": &status, "div": &d}, nil
+}
+
+// narrativeValue renders the given value as text. Arrays are rendered as their (non-nil) items
+// separated by commas and objects as JSON. Nil or empty values are rendered as empty strings.
+func narrativeValue(v jsonutil.JSONToken) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case jsonutil.JSONStr:
+		return strings.TrimSpace(string(t))
+	case jsonutil.JSONNum:
+		return strconv.FormatFloat(float64(t), 'f', -1, 64)
+	case jsonutil.JSONBool:
+		return strconv.FormatBool(bool(t))
+	case jsonutil.JSONArr:
+		var items []string
+		for _, i := range t {
+			if s := narrativeValue(i); s != "" {
+				items = append(items, s)
+			}
+		}
+		return strings.Join(items, ", ")
+	case jsonutil.JSONContainer:
+		if len(t) == 0 {
+			return ""
+		}
+		return jsonutil.MarshalJSON(t)
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
+
+// narrativeLabel derives a human readable label from a field path, by dropping indices and
+// splitting camel case, e.g. name[0].givenName => Name Given Name.
+func narrativeLabel(path string) string {
+	var words []string
+	for _, seg := range strings.Split(path, ".") {
+		if i := strings.Index(seg, "["); i >= 0 {
+			seg = seg[:i]
+		}
+		var word []rune
+		for _, r := range seg {
+			if unicode.IsUpper(r) && len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+			if len(word) == 0 {
+				r = unicode.ToUpper(r)
+			}
+			word = append(word, r)
+		}
+		if len(word) > 0 {
+			words = append(words, string(word))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// escapeXHTML escapes the characters that are not allowed as-is in XHTML text or attributes.
+func escapeXHTML(s string) string {
+	return strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		">", "&gt;",
+		`"`, "&quot;",
+		"'", "&#39;",
+	).Replace(s)
+}
+
+// checkWellFormedXML returns an error if the given string is not a single well-formed XML element.
+func checkWellFormedXML(s string) error {
+	d := xml.NewDecoder(strings.NewReader(s))
+	d.Strict = true
+	depth, roots := 0, 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(strings.TrimSpace(string(t))) > 0 {
+				return fmt.Errorf("text outside of the root element")
+			}
+		}
+	}
+	if roots != 1 {
+		return fmt.Errorf("expected a single root element but found %d", roots)
+	}
+	return nil
+}
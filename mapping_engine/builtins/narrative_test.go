@@ -0,0 +1,117 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestGenerateNarrative(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource json.RawMessage
+		fields   jsonutil.JSONArr
+		wantDiv  string
+		wantNone bool
+	}{
+		{
+			name:     "fields and labels",
+			resource: json.RawMessage(`{"resourceType": "Patient", "birthDate": "1980-01-02", "name": [{"family": "Smith", "given": ["Jo", "Ann"]}], "active": true}`),
+			fields:   jsonutil.JSONArr{jsonutil.JSONStr("name[0].family"), jsonutil.JSONStr("name[0].given"), jsonutil.JSONStr("birthDate"), jsonutil.JSONStr("active")},
+			wantDiv: `<div xmlns="http://www.w3.org/1999/xhtml"><table><tbody>` +
+				`<tr><th>Name Family</th><td>Smith</td></tr>` +
+				`<tr><th>Name Given</th><td>Jo, Ann</td></tr>` +
+				`<tr><th>Birth Date</th><td>1980-01-02</td></tr>` +
+				`<tr><th>Active</th><td>true</td></tr>` +
+				`</tbody></table></div>`,
+		},
+		{
+			name:     "escaping",
+			resource: json.RawMessage(`{"note": "<b>A & B</b> \"quoted\" 'single'", "value": 1000000}`),
+			fields:   jsonutil.JSONArr{jsonutil.JSONStr("note"), jsonutil.JSONStr("value")},
+			wantDiv: `<div xmlns="http://www.w3.org/1999/xhtml"><table><tbody>` +
+				`<tr><th>Note</th><td>&lt;b&gt;A &amp; B&lt;/b&gt; &quot;quoted&quot; &#39;single&#39;</td></tr>` +
+				`<tr><th>Value</th><td>1000000</td></tr>` +
+				`</tbody></table></div>`,
+		},
+		{
+			name:     "missing fields omitted",
+			resource: json.RawMessage(`{"id": "p1", "name": []}`),
+			fields:   jsonutil.JSONArr{jsonutil.JSONStr("gender"), jsonutil.JSONStr("name"), jsonutil.JSONStr("id")},
+			wantDiv: `<div xmlns="http://www.w3.org/1999/xhtml"><table><tbody>` +
+				`<tr><th>Id</th><td>p1</td></tr>` +
+				`</tbody></table></div>`,
+		},
+		{
+			name:     "no fields present",
+			resource: json.RawMessage(`{"id": "p1"}`),
+			fields:   jsonutil.JSONArr{jsonutil.JSONStr("gender")},
+			wantNone: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := GenerateNarrative(mustParseContainer(test.resource, t), test.fields)
+			if err != nil {
+				t.Fatalf("GenerateNarrative(%s, %v) returned unexpected error %v", test.resource, test.fields, err)
+			}
+			if test.wantNone {
+				if len(got) != 0 {
+					t.Errorf("GenerateNarrative(%s, %v) = %v, want empty", test.resource, test.fields, got)
+				}
+				return
+			}
+
+			want := jsonutil.JSONContainer{}
+			var status, div jsonutil.JSONToken = jsonutil.JSONStr("generated"), jsonutil.JSONStr(test.wantDiv)
+			want["status"], want["div"] = &status, &div
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("GenerateNarrative(%s, %v) returned diff (-want +got):\n%s", test.resource, test.fields, diff)
+			}
+		})
+	}
+}
+
+func TestGenerateNarrative_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource json.RawMessage
+		fields   jsonutil.JSONArr
+	}{
+		{
+			name:     "non-string field",
+			resource: json.RawMessage(`{"id": "p1"}`),
+			fields:   jsonutil.JSONArr{jsonutil.JSONNum(1)},
+		},
+		{
+			name:     "invalid XML character",
+			resource: json.RawMessage(`{"id": "p\u0001"}`),
+			fields:   jsonutil.JSONArr{jsonutil.JSONStr("id")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := GenerateNarrative(mustParseContainer(test.resource, t), test.fields); err == nil {
+				t.Errorf("GenerateNarrative(%s, %v) = %v, want error", test.resource, test.fields, got)
+			}
+		})
+	}
+}
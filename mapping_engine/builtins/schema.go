@@ -0,0 +1,370 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// schemaAnnotations are the JSON Schema keywords that do not constrain values, which are allowed in
+// schemas and ignored.
+var schemaAnnotations = map[string]bool{
+	"$comment":    true,
+	"$id":         true,
+	"$schema":     true,
+	"default":     true,
+	"description": true,
+	"examples":    true,
+	"title":       true,
+}
+
+// schemaTypes are the values of the JSON Schema type keyword.
+var schemaTypes = map[string]bool{
+	"array":   true,
+	"boolean": true,
+	"integer": true,
+	"null":    true,
+	"number":  true,
+	"object":  true,
+	"string":  true,
+}
+
+// Schemas holds user supplied JSON Schemas (e.g. of the input of a vendor), by name, for the
+// $MatchesSchema and $ValidateSchema builtins. Only the draft-07 keywords type, required,
+// properties, items (a single schema for all items), enum and pattern are supported. Schemas is safe
+// for concurrent use.
+type Schemas struct {
+	mu      sync.RWMutex
+	schemas map[string]*schema
+}
+
+// schema is a compiled JSON Schema. Unset keywords are empty.
+type schema struct {
+	types      []string
+	required   []string
+	properties map[string]*schema
+	items      *schema
+	enum       jsonutil.JSONArr
+	enumHashes map[string]bool
+	pattern    *regexp.Regexp
+}
+
+// NewSchemas creates an empty set of schemas.
+func NewSchemas() *Schemas {
+	return &Schemas{schemas: make(map[string]*schema)}
+}
+
+// Register makes the given JSON Schema available with the given name, replacing any schema
+// previously registered with that name. It is an error if the schema uses keywords that are not
+// supported, so that they are not silently ignored.
+func (s *Schemas) Register(name string, def jsonutil.JSONToken) error {
+	if name == "" {
+		return fmt.Errorf("schema name must not be empty")
+	}
+	compiled, err := compileSchema(def, "")
+	if err != nil {
+		return fmt.Errorf("schema %q is invalid%v", name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schemas[name] = compiled
+	return nil
+}
+
+// Clone returns a copy of the schemas. Schemas registered in either afterwards do not affect the
+// other.
+func (s *Schemas) Clone() *Schemas {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c := &Schemas{schemas: make(map[string]*schema, len(s.schemas))}
+	for name, compiled := range s.schemas {
+		c.schemas[name] = compiled
+	}
+	return c
+}
+
+// MatchesSchema returns true iff the given value has no violations of the schema with the given
+// name (see ValidateSchema).
+func (s *Schemas) MatchesSchema(tok jsonutil.JSONToken, schemaName jsonutil.JSONStr) (jsonutil.JSONBool, error) {
+	violations, err := s.ValidateSchema(tok, schemaName)
+	if err != nil {
+		return false, err
+	}
+	return len(violations) == 0, nil
+}
+
+// ValidateSchema returns the violations of the schema with the given name by the given value, as
+// objects with the path of the offending value (e.g. name[0].family, or "" for the value itself)
+// and a message. The result is empty if there are none. Fields that are null are treated as missing.
+// Once a value is not of the type required by its schema, the other keywords of the schema are not
+// checked against it.
+func (s *Schemas) ValidateSchema(tok jsonutil.JSONToken, schemaName jsonutil.JSONStr) (jsonutil.JSONArr, error) {
+	s.mu.RLock()
+	compiled, ok := s.schemas[string(schemaName)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %q, available schemas are %v", schemaName, s.names())
+	}
+
+	violations := jsonutil.JSONArr{}
+	compiled.validate(tok, "", &violations)
+	return violations, nil
+}
+
+func (s *Schemas) names() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.schemas))
+	for n := range s.schemas {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compileSchema compiles the given JSON Schema, which is at the given path (of keywords) within
+// the schema being registered. Errors start with where in the schema they are, e.g.
+// " at properties.name: ...".
+func compileSchema(def jsonutil.JSONToken, at string) (*schema, error) {
+	where := ""
+	if at != "" {
+		where = " at " + at
+	}
+
+	obj, ok := def.(jsonutil.JSONContainer)
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object but was %T", where, def)
+	}
+
+	keywords := make([]string, 0, len(obj))
+	for k := range obj {
+		keywords = append(keywords, k)
+	}
+	sort.Strings(keywords)
+
+	s := &schema{}
+	for _, k := range keywords {
+		var v jsonutil.JSONToken
+		if p := obj[k]; p != nil {
+			v = *p
+		}
+		switch k {
+		case "type":
+			types, err := schemaStrings(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: type %v", where, err)
+			}
+			for _, t := range types {
+				if !schemaTypes[t] {
+					return nil, fmt.Errorf("%s: unknown type %q", where, t)
+				}
+			}
+			s.types = types
+		case "required":
+			required, err := schemaStrings(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: required %v", where, err)
+			}
+			s.required = required
+		case "properties":
+			props, ok := v.(jsonutil.JSONContainer)
+			if !ok {
+				return nil, fmt.Errorf("%s: properties must be an object but was %T", where, v)
+			}
+			s.properties = make(map[string]*schema, len(props))
+			names := make([]string, 0, len(props))
+			for n := range props {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				var prop jsonutil.JSONToken
+				if p := props[name]; p != nil {
+					prop = *p
+				}
+				compiled, err := compileSchema(prop, joinKeywordPath(at, "properties."+name))
+				if err != nil {
+					return nil, err
+				}
+				s.properties[name] = compiled
+			}
+		case "items":
+			items, err := compileSchema(v, joinKeywordPath(at, "items"))
+			if err != nil {
+				return nil, err
+			}
+			s.items = items
+		case "enum":
+			enum, ok := v.(jsonutil.JSONArr)
+			if !ok {
+				return nil, fmt.Errorf("%s: enum must be an array but was %T", where, v)
+			}
+			s.enum = enum
+			s.enumHashes = make(map[string]bool, len(enum))
+			for _, e := range enum {
+				h, err := jsonutil.Hash(e, false)
+				if err != nil {
+					return nil, fmt.Errorf("%s: enum %v", where, err)
+				}
+				s.enumHashes[string(h)] = true
+			}
+		case "pattern":
+			pattern, ok := v.(jsonutil.JSONStr)
+			if !ok {
+				return nil, fmt.Errorf("%s: pattern must be a string but was %T", where, v)
+			}
+			re, err := regexp.Compile(string(pattern))
+			if err != nil {
+				return nil, fmt.Errorf("%s: pattern %v", where, err)
+			}
+			s.pattern = re
+		default:
+			if !schemaAnnotations[k] {
+				return nil, fmt.Errorf("%s: keyword %q is not supported, only type, required, properties, items, enum and pattern are", where, k)
+			}
+		}
+	}
+	return s, nil
+}
+
+// schemaStrings returns the given string, or array of strings, as a list of strings.
+func schemaStrings(v jsonutil.JSONToken) ([]string, error) {
+	switch t := v.(type) {
+	case jsonutil.JSONStr:
+		return []string{string(t)}, nil
+	case jsonutil.JSONArr:
+		strs := make([]string, 0, len(t))
+		for _, e := range t {
+			s, ok := e.(jsonutil.JSONStr)
+			if !ok {
+				return nil, fmt.Errorf("must only contain strings but has %T", e)
+			}
+			strs = append(strs, string(s))
+		}
+		return strs, nil
+	}
+	return nil, fmt.Errorf("must be a string or an array of strings but was %T", v)
+}
+
+// joinKeywordPath appends the given keywords to the given path of keywords.
+func joinKeywordPath(at, keywords string) string {
+	if at == "" {
+		return keywords
+	}
+	return at + "." + keywords
+}
+
+// validate appends the violations of the schema by the given value, which is at the given path, to
+// violations.
+func (s *schema) validate(tok jsonutil.JSONToken, path string, violations *jsonutil.JSONArr) {
+	if len(s.types) > 0 && !s.matchesType(tok) {
+		appendViolation(violations, path, fmt.Sprintf("expected %s but got %s", strings.Join(s.types, " or "), schemaTypeOf(tok)))
+		return
+	}
+
+	if s.enumHashes != nil {
+		if h, err := jsonutil.Hash(tok, false); err != nil || !s.enumHashes[string(h)] {
+			appendViolation(violations, path, fmt.Sprintf("%s is not one of %s", jsonutil.MarshalJSON(tok), jsonutil.MarshalJSON(s.enum)))
+		}
+	}
+
+	if str, ok := tok.(jsonutil.JSONStr); ok && s.pattern != nil && !s.pattern.MatchString(string(str)) {
+		appendViolation(violations, path, fmt.Sprintf("%q does not match pattern %q", str, s.pattern))
+	}
+
+	switch t := tok.(type) {
+	case jsonutil.JSONContainer:
+		for _, r := range s.required {
+			if f, ok := t[r]; !ok || f == nil || *f == nil {
+				appendViolation(violations, joinValuePath(path, r), "required field is missing")
+			}
+		}
+
+		names := make([]string, 0, len(s.properties))
+		for n := range s.properties {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if f, ok := t[n]; ok && f != nil && *f != nil {
+				s.properties[n].validate(*f, joinValuePath(path, n), violations)
+			}
+		}
+	case jsonutil.JSONArr:
+		if s.items != nil {
+			for i, item := range t {
+				s.items.validate(item, fmt.Sprintf("%s[%d]", path, i), violations)
+			}
+		}
+	}
+}
+
+// matchesType returns true iff the given value is of one of the types of the schema.
+func (s *schema) matchesType(tok jsonutil.JSONToken) bool {
+	actual := schemaTypeOf(tok)
+	for _, t := range s.types {
+		if t == actual {
+			return true
+		}
+		if n, ok := tok.(jsonutil.JSONNum); ok && t == "integer" && float64(n) == math.Trunc(float64(n)) {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaTypeOf returns the JSON Schema type of the given value. Integers are numbers.
+func schemaTypeOf(tok jsonutil.JSONToken) string {
+	switch tok.(type) {
+	case jsonutil.JSONStr:
+		return "string"
+	case jsonutil.JSONNum:
+		return "number"
+	case jsonutil.JSONBool:
+		return "boolean"
+	case jsonutil.JSONContainer:
+		return "object"
+	case jsonutil.JSONArr:
+		return "array"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", tok)
+}
+
+// joinValuePath appends the given field to the given path of a value.
+func joinValuePath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// appendViolation appends a violation object with the given path and message to violations.
+func appendViolation(violations *jsonutil.JSONArr, path, message string) {
+	p := jsonutil.JSONToken(jsonutil.JSONStr(path))
+	m := jsonutil.JSONToken(jsonutil.JSONStr(message))
+	*violations = append(*violations, jsonutil.JSONContainer{"path": &p, "message": &m})
+}
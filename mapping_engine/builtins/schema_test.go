@@ -0,0 +1,346 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func mustParseToken(j string, t *testing.T) jsonutil.JSONToken {
+	t.Helper()
+	tok, err := jsonutil.UnmarshalJSON(json.RawMessage(j))
+	if err != nil {
+		t.Fatalf("UnmarshalJSON(%s) returned unexpected error %v", j, err)
+	}
+	return tok
+}
+
+func TestSchemas_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		// want are the expected violations, as path: message.
+		want []string
+	}{
+		{
+			name:   "type",
+			schema: `{"type": "string"}`,
+			value:  `"a"`,
+		},
+		{
+			name:   "type mismatch",
+			schema: `{"type": "string"}`,
+			value:  `1`,
+			want:   []string{": expected string but got number"},
+		},
+		{
+			name:   "type list",
+			schema: `{"type": ["string", "null"]}`,
+			value:  `null`,
+		},
+		{
+			name:   "type list mismatch",
+			schema: `{"type": ["string", "null"]}`,
+			value:  `true`,
+			want:   []string{": expected string or null but got boolean"},
+		},
+		{
+			name:   "integer",
+			schema: `{"type": "integer"}`,
+			value:  `3.0`,
+		},
+		{
+			name:   "integer mismatch",
+			schema: `{"type": "integer"}`,
+			value:  `3.5`,
+			want:   []string{": expected integer but got number"},
+		},
+		{
+			name:   "number is not string",
+			schema: `{"type": "number"}`,
+			value:  `"3"`,
+			want:   []string{": expected number but got string"},
+		},
+		{
+			name:   "object and array",
+			schema: `{"type": "array", "items": {"type": "object"}}`,
+			value:  `[{}, [], {}]`,
+			want:   []string{"[1]: expected object but got array"},
+		},
+		{
+			name:   "required",
+			schema: `{"type": "object", "required": ["id", "name", "status"]}`,
+			value:  `{"id": "1", "status": null}`,
+			want: []string{
+				"name: required field is missing",
+				"status: required field is missing",
+			},
+		},
+		{
+			name:   "required on a non-object is ignored",
+			schema: `{"required": ["id"]}`,
+			value:  `"x"`,
+		},
+		{
+			name: "properties",
+			schema: `{
+				"properties": {
+					"id": {"type": "string"},
+					"name": {
+						"type": "array",
+						"items": {"type": "object", "required": ["family"], "properties": {"given": {"type": "array", "items": {"type": "string"}}}}
+					}
+				}
+			}`,
+			value: `{"id": 7, "name": [{"family": "Doe", "given": ["Jane", 1]}, {"given": ["J"]}], "other": true}`,
+			want: []string{
+				"id: expected string but got number",
+				"name[0].given[1]: expected string but got number",
+				"name[1].family: required field is missing",
+			},
+		},
+		{
+			name:   "properties that are missing are not checked",
+			schema: `{"properties": {"id": {"type": "string"}}}`,
+			value:  `{"id": null}`,
+		},
+		{
+			name:   "enum",
+			schema: `{"enum": ["male", "female", 1, null]}`,
+			value:  `1`,
+		},
+		{
+			name:   "enum mismatch",
+			schema: `{"enum": ["male", "female"]}`,
+			value:  `"M"`,
+			want:   []string{`: "M" is not one of ["male","female"]`},
+		},
+		{
+			name:   "enum compares types",
+			schema: `{"enum": ["1"]}`,
+			value:  `1`,
+			want:   []string{`: 1 is not one of ["1"]`},
+		},
+		{
+			name:   "enum of objects",
+			schema: `{"enum": [{"a": 1, "b": 2}]}`,
+			value:  `{"b": 2, "a": 1}`,
+		},
+		{
+			name:   "pattern",
+			schema: `{"type": "string", "pattern": "^[0-9]{3}-[0-9]{4}$"}`,
+			value:  `"555-1234"`,
+		},
+		{
+			name:   "pattern mismatch",
+			schema: `{"type": "string", "pattern": "^[0-9]{3}-[0-9]{4}$"}`,
+			value:  `"5551234"`,
+			want:   []string{`: "5551234" does not match pattern "^[0-9]{3}-[0-9]{4}$"`},
+		},
+		{
+			name:   "pattern is not anchored",
+			schema: `{"pattern": "[0-9]"}`,
+			value:  `"abc1"`,
+		},
+		{
+			name:   "pattern on a non-string is ignored",
+			schema: `{"pattern": "[0-9]"}`,
+			value:  `true`,
+		},
+		{
+			name:   "type mismatch skips the other keywords",
+			schema: `{"type": "object", "required": ["id"], "enum": [{"id": 1}]}`,
+			value:  `[]`,
+			want:   []string{": expected object but got array"},
+		},
+		{
+			name:   "several violations of one value",
+			schema: `{"type": "string", "enum": ["abc"], "pattern": "^[0-9]+$"}`,
+			value:  `"x"`,
+			want: []string{
+				`: "x" is not one of ["abc"]`,
+				`: "x" does not match pattern "^[0-9]+$"`,
+			},
+		},
+		{
+			name:   "annotations are ignored",
+			schema: `{"$schema": "http://json-schema.org/draft-07/schema#", "title": "Code", "description": "A code", "type": "string"}`,
+			value:  `"a"`,
+		},
+		{
+			name:   "empty schema",
+			schema: `{}`,
+			value:  `{"anything": [1, "two"]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schemas := NewSchemas()
+			if err := schemas.Register("s", mustParseToken(test.schema, t)); err != nil {
+				t.Fatalf("Register(s, %s) returned unexpected error %v", test.schema, err)
+			}
+			value := mustParseToken(test.value, t)
+
+			violations, err := schemas.ValidateSchema(value, "s")
+			if err != nil {
+				t.Fatalf("ValidateSchema(%s, s) returned unexpected error %v", test.value, err)
+			}
+			got := []string{}
+			for _, v := range violations {
+				c := v.(jsonutil.JSONContainer)
+				got = append(got, string((*c["path"]).(jsonutil.JSONStr))+": "+string((*c["message"]).(jsonutil.JSONStr)))
+			}
+			want := test.want
+			if want == nil {
+				want = []string{}
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("ValidateSchema(%s, s) returned violations diff (-want +got):\n%s", test.value, diff)
+			}
+
+			matches, err := schemas.MatchesSchema(value, "s")
+			if err != nil {
+				t.Fatalf("MatchesSchema(%s, s) returned unexpected error %v", test.value, err)
+			}
+			if wantMatches := len(test.want) == 0; bool(matches) != wantMatches {
+				t.Errorf("MatchesSchema(%s, s) = %t, want %t", test.value, matches, wantMatches)
+			}
+		})
+	}
+}
+
+func TestSchemas_ViolationObjects(t *testing.T) {
+	schemas := NewSchemas()
+	if err := schemas.Register("patient", mustParseToken(`{"required": ["id"]}`, t)); err != nil {
+		t.Fatalf("Register returned unexpected error %v", err)
+	}
+
+	got, err := schemas.ValidateSchema(mustParseToken(`{}`, t), "patient")
+	if err != nil {
+		t.Fatalf("ValidateSchema returned unexpected error %v", err)
+	}
+	want := mustParseArray(json.RawMessage(`[{"path": "id", "message": "required field is missing"}]`), t)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ValidateSchema returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestSchemas_Errors(t *testing.T) {
+	schemas := NewSchemas()
+	if err := schemas.Register("patient", mustParseToken(`{"type": "object"}`, t)); err != nil {
+		t.Fatalf("Register returned unexpected error %v", err)
+	}
+	for _, name := range []jsonutil.JSONStr{"nope", ""} {
+		if _, err := schemas.ValidateSchema(nil, name); err == nil || !strings.Contains(err.Error(), "[patient]") {
+			t.Errorf("ValidateSchema(nil, %q) returned error %v, want one listing the available schemas", name, err)
+		}
+		if _, err := schemas.MatchesSchema(nil, name); err == nil {
+			t.Errorf("MatchesSchema(nil, %q) returned no error, want one for the unknown schema", name)
+		}
+	}
+}
+
+func TestSchemas_Clone(t *testing.T) {
+	schemas := NewSchemas()
+	if err := schemas.Register("s", mustParseToken(`{"type": "string"}`, t)); err != nil {
+		t.Fatalf("Register returned unexpected error %v", err)
+	}
+
+	clone := schemas.Clone()
+	if err := clone.Register("s", mustParseToken(`{"type": "number"}`, t)); err != nil {
+		t.Fatalf("Register in the clone returned unexpected error %v", err)
+	}
+
+	if got, err := schemas.MatchesSchema(jsonutil.JSONStr("a"), "s"); err != nil || !bool(got) {
+		t.Errorf("MatchesSchema(a, s) = %t, %v, want true", got, err)
+	}
+	if got, err := clone.MatchesSchema(jsonutil.JSONNum(1), "s"); err != nil || !bool(got) {
+		t.Errorf("clone.MatchesSchema(1, s) = %t, %v, want true", got, err)
+	}
+}
+
+func TestSchemas_RegisterErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		wantErr string
+	}{
+		{
+			name:    "not an object",
+			schema:  `true`,
+			wantErr: `schema "s" is invalid: schema must be an object`,
+		},
+		{
+			name:    "unknown type",
+			schema:  `{"type": "strng"}`,
+			wantErr: `unknown type "strng"`,
+		},
+		{
+			name:    "type of the wrong type",
+			schema:  `{"type": 1}`,
+			wantErr: "type must be a string or an array of strings",
+		},
+		{
+			name:    "required of the wrong type",
+			schema:  `{"required": ["id", 2]}`,
+			wantErr: "required must only contain strings",
+		},
+		{
+			name:    "properties of the wrong type",
+			schema:  `{"properties": []}`,
+			wantErr: "properties must be an object",
+		},
+		{
+			name:    "enum of the wrong type",
+			schema:  `{"enum": "a"}`,
+			wantErr: "enum must be an array",
+		},
+		{
+			name:    "invalid pattern",
+			schema:  `{"pattern": "("}`,
+			wantErr: "pattern error parsing regexp",
+		},
+		{
+			name:    "unsupported keyword",
+			schema:  `{"type": "string", "minLength": 1}`,
+			wantErr: `keyword "minLength" is not supported`,
+		},
+		{
+			name:    "nested",
+			schema:  `{"properties": {"name": {"items": {"type": "text"}}}}`,
+			wantErr: `schema "s" is invalid at properties.name.items: unknown type "text"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := NewSchemas().Register("s", mustParseToken(test.schema, t))
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Register(s, %s) returned error %v, want one containing %q", test.schema, err, test.wantErr)
+			}
+		})
+	}
+
+	if err := NewSchemas().Register("", mustParseToken(`{}`, t)); err == nil {
+		t.Errorf("Register(\"\", {}) returned no error, want one for the empty name")
+	}
+}
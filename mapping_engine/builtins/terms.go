@@ -0,0 +1,182 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// TermDomain is a small vocabulary (e.g. gender) for the $NormalizeTerm builtin.
+type TermDomain struct {
+	// Terms maps values to their normalized terms. Values are matched case-insensitively and
+	// ignoring surrounding and repeated whitespace.
+	Terms map[string]string `json:"terms"`
+	// Default is the normalized term for values that are not in Terms.
+	Default string `json:"default"`
+}
+
+// DefaultTermDomains are the domains every TermTables starts with.
+var DefaultTermDomains = map[string]TermDomain{
+	"gender": {
+		Terms: map[string]string{
+			"m": "male", "male": "male", "1": "male",
+			"f": "female", "female": "female", "2": "female",
+			"o": "other", "other": "other",
+			"u": "unknown", "unk": "unknown", "unknown": "unknown",
+		},
+		Default: "unknown",
+	},
+	"yes-no": {
+		Terms: map[string]string{
+			"y": "yes", "yes": "yes", "true": "yes", "1": "yes",
+			"n": "no", "no": "no", "false": "no", "0": "no",
+			"u": "unknown", "unk": "unknown", "unknown": "unknown",
+		},
+		Default: "unknown",
+	},
+	// Normalizes to the HL7 v3 MaritalStatus codes used by FHIR.
+	"marital-status": {
+		Terms: map[string]string{
+			"a": "A", "annulled": "A",
+			"d": "D", "divorced": "D",
+			"l": "L", "separated": "L", "legally separated": "L",
+			"m": "M", "married": "M",
+			"s": "S", "single": "S", "never married": "S",
+			"t": "T", "domestic partner": "T",
+			"u": "U", "unmarried": "U",
+			"w": "W", "widowed": "W",
+			"unk": "UNK", "unknown": "UNK",
+		},
+		Default: "UNK",
+	},
+}
+
+// TermTables holds the domains for the $NormalizeTerm builtin. TermTables is safe for concurrent
+// use.
+type TermTables struct {
+	mu      sync.RWMutex
+	domains map[string]TermDomain
+}
+
+// NewTermTables creates term tables with the DefaultTermDomains, returning an error if any of them
+// is invalid.
+func NewTermTables() (*TermTables, error) {
+	t := &TermTables{domains: make(map[string]TermDomain)}
+	for name, d := range DefaultTermDomains {
+		if err := t.Register(name, d); err != nil {
+			return nil, fmt.Errorf("invalid default term domain %q: %v", name, err)
+		}
+	}
+	return t, nil
+}
+
+// Register adds the given domain, or overrides an existing one: its terms take precedence over (but
+// are otherwise merged with) the existing terms, and its default (if not empty) replaces the
+// existing default.
+func (t *TermTables) Register(name string, d TermDomain) error {
+	if name == "" {
+		return fmt.Errorf("term domain name must not be empty")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	existing := t.domains[name]
+	merged := TermDomain{Terms: make(map[string]string, len(existing.Terms)+len(d.Terms)), Default: existing.Default}
+	for v, term := range existing.Terms {
+		merged.Terms[v] = term
+	}
+	for v, term := range d.Terms {
+		k := normalizeTermKey(v)
+		if k == "" {
+			return fmt.Errorf("term domain %q has an empty value (for term %q)", name, term)
+		}
+		merged.Terms[k] = term
+	}
+	if d.Default != "" {
+		merged.Default = d.Default
+	}
+
+	t.domains[name] = merged
+	return nil
+}
+
+// Clone returns a copy of the term tables. Domains registered in either afterwards do not affect
+// the other.
+func (t *TermTables) Clone() *TermTables {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// Registered domains are never modified, only replaced by merged copies, so they can be shared.
+	c := &TermTables{domains: make(map[string]TermDomain, len(t.domains))}
+	for name, d := range t.domains {
+		c.domains[name] = d
+	}
+	return c
+}
+
+// NormalizeTerm returns the normalized term for the given value in the given domain, or the
+// domain's default if the value is not in it. Empty values are returned as is.
+func (t *TermTables) NormalizeTerm(domain jsonutil.JSONStr, value jsonutil.JSONStr) (jsonutil.JSONStr, error) {
+	t.mu.RLock()
+	d, ok := t.domains[string(domain)]
+	t.mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown term domain %q, available domains are %v", domain, t.names())
+	}
+
+	k := normalizeTermKey(string(value))
+	if k == "" {
+		return "", nil
+	}
+	if term, ok := d.Terms[k]; ok {
+		return jsonutil.JSONStr(term), nil
+	}
+	return jsonutil.JSONStr(d.Default), nil
+}
+
+func (t *TermTables) names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	names := make([]string, 0, len(t.domains))
+	for n := range t.domains {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// normalizeTermKey lower cases the given value and collapses its whitespace.
+func normalizeTermKey(v string) string {
+	return strings.ToLower(strings.Join(strings.Fields(v), " "))
+}
+
+// ParseTermDomainsJSON reads term domains from a JSON object of domain names to domains, e.g.
+// {"gender": {"terms": {"X": "other"}, "default": "unknown"}}.
+func ParseTermDomainsJSON(r io.Reader) (map[string]TermDomain, error) {
+	var domains map[string]TermDomain
+	if err := json.NewDecoder(r).Decode(&domains); err != nil {
+		return nil, fmt.Errorf("failed to parse term domains: %v", err)
+	}
+	return domains, nil
+}
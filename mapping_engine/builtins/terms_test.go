@@ -0,0 +1,129 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builtins
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+func mustNewTermTables(t *testing.T) *TermTables {
+	t.Helper()
+	tables, err := NewTermTables()
+	if err != nil {
+		t.Fatalf("NewTermTables returned unexpected error %v", err)
+	}
+	return tables
+}
+
+func TestNormalizeTerm(t *testing.T) {
+	tables := mustNewTermTables(t)
+	overrides, err := ParseTermDomainsJSON(strings.NewReader(`{
+		"gender": {"terms": {"X": "other", "1": "female"}},
+		"severity": {"terms": {"Mild": "mild", "MOD": "moderate", "sev": "severe"}, "default": "unspecified"}
+	}`))
+	if err != nil {
+		t.Fatalf("ParseTermDomainsJSON returned unexpected error %v", err)
+	}
+	for name, d := range overrides {
+		if err := tables.Register(name, d); err != nil {
+			t.Fatalf("Register(%q, %v) returned unexpected error %v", name, d, err)
+		}
+	}
+
+	tests := []struct {
+		domain jsonutil.JSONStr
+		value  jsonutil.JSONStr
+		want   jsonutil.JSONStr
+	}{
+		{domain: "gender", value: "M", want: "male"},
+		{domain: "gender", value: "  Female ", want: "female"},
+		{domain: "gender", value: "x", want: "other"},
+		{domain: "gender", value: "1", want: "female"},
+		{domain: "gender", value: "2", want: "female"},
+		{domain: "gender", value: "zebra", want: "unknown"},
+		{domain: "gender", value: "", want: ""},
+		{domain: "gender", value: "   ", want: ""},
+		{domain: "yes-no", value: "Y", want: "yes"},
+		{domain: "yes-no", value: "false", want: "no"},
+		{domain: "yes-no", value: "maybe", want: "unknown"},
+		{domain: "marital-status", value: "Never   Married", want: "S"},
+		{domain: "marital-status", value: "WIDOWED", want: "W"},
+		{domain: "marital-status", value: "complicated", want: "UNK"},
+		{domain: "severity", value: "mod", want: "moderate"},
+		{domain: "severity", value: "critical", want: "unspecified"},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.domain)+"/"+string(test.value), func(t *testing.T) {
+			got, err := tables.NormalizeTerm(test.domain, test.value)
+			if err != nil {
+				t.Fatalf("NormalizeTerm(%q, %q) returned unexpected error %v", test.domain, test.value, err)
+			}
+			if got != test.want {
+				t.Errorf("NormalizeTerm(%q, %q) = %q, want %q", test.domain, test.value, got, test.want)
+			}
+		})
+	}
+
+	if got, err := mustNewTermTables(t).NormalizeTerm("gender", "1"); err != nil || got != "male" {
+		t.Errorf("overrides leaked into other tables: NormalizeTerm(gender, 1) = %q, %v, want male", got, err)
+	}
+}
+
+func TestTermTables_Clone(t *testing.T) {
+	tables := mustNewTermTables(t)
+	clone := tables.Clone()
+	if err := clone.Register("gender", TermDomain{Terms: map[string]string{"x": "other"}}); err != nil {
+		t.Fatalf("Register in the clone returned unexpected error %v", err)
+	}
+
+	if got, err := clone.NormalizeTerm("gender", "X"); err != nil || got != "other" {
+		t.Errorf("clone.NormalizeTerm(gender, X) = %q, %v, want other", got, err)
+	}
+	if got, err := clone.NormalizeTerm("gender", "F"); err != nil || got != "female" {
+		t.Errorf("clone.NormalizeTerm(gender, F) = %q, %v, want female", got, err)
+	}
+	if got, err := tables.NormalizeTerm("gender", "X"); err != nil || got == "other" {
+		t.Errorf("NormalizeTerm(gender, X) = %q, %v, want the override in the clone not to apply", got, err)
+	}
+}
+
+func TestNormalizeTerm_Errors(t *testing.T) {
+	tables := mustNewTermTables(t)
+	if got, err := tables.NormalizeTerm("colour", "red"); err == nil {
+		t.Errorf("NormalizeTerm(colour, red) = %q, want error", got)
+	}
+	if err := tables.Register("", TermDomain{}); err == nil {
+		t.Errorf("Register with empty name returned nil error")
+	}
+	if err := tables.Register("colour", TermDomain{Terms: map[string]string{" ": "none"}}); err == nil {
+		t.Errorf("Register with empty value returned nil error")
+	}
+	if _, err := ParseTermDomainsJSON(strings.NewReader(`["gender"]`)); err == nil {
+		t.Errorf("ParseTermDomainsJSON with an array returned nil error")
+	}
+}
+
+func TestNewTermTables_InvalidDefault(t *testing.T) {
+	DefaultTermDomains["colour"] = TermDomain{Terms: map[string]string{" ": "none"}}
+	defer delete(DefaultTermDomains, "colour")
+
+	if _, err := NewTermTables(); err == nil || !strings.Contains(err.Error(), "colour") {
+		t.Errorf("NewTermTables returned error %v, want one for the invalid default domain colour", err)
+	}
+}
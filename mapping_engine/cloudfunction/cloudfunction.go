@@ -18,6 +18,7 @@ package cloudfunction
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -86,7 +87,18 @@ func FromCloudFunction(cf *httppb.CloudFunction) (types.Projector, error) {
 
 		errLocation = errs.FnLocationf("Cloud Function %q", cf.Name)
 
-		resp, err := http.Post(cf.RequestUrl, "application/json", bytes.NewBuffer(body))
+		// Requests honour the evaluation's context, so that e.g. projector timeouts cancel them.
+		ctx := pctx.GoContext
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cf.RequestUrl, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, errs.Wrap(errLocation, fmt.Errorf("error building cloud function request: %v", err))
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return nil, errs.Wrap(errLocation, fmt.Errorf("cloud function request failed due to: %v", err))
 		}
@@ -16,11 +16,13 @@ package cloudfunction
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
@@ -275,3 +277,44 @@ func TestFromCloudFunctionCallError(t *testing.T) {
 		})
 	}
 }
+
+func TestFromCloudFunction_Timeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	// The server never responds. It drains the body first, as otherwise it does not notice when
+	// the client gives up.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		<-r.Context().Done()
+	}))
+	defer s.Close()
+
+	cf := &httppb.CloudFunction{
+		Name:       "@Stalled",
+		RequestUrl: s.URL + "/stalled",
+	}
+	proj, err := FromCloudFunction(cf)
+	if err != nil {
+		t.Fatalf("FromCloudFunction(%v) returned unexpected error: %v", cf.Name, err)
+	}
+
+	reg := types.NewRegistry()
+	if err := reg.RegisterProjector(cf.Name, proj); err != nil {
+		t.Fatalf("RegisterProjector returned unexpected error: %v", err)
+	}
+	if err := reg.SetTimeout(cf.Name, timeout); err != nil {
+		t.Fatalf("SetTimeout returned unexpected error: %v", err)
+	}
+	if proj, err = reg.FindProjector(cf.Name); err != nil {
+		t.Fatalf("FindProjector returned unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	_, err = proj(toNodes(t, []jsonutil.JSONToken{jsonutil.JSONStr("foo")}), types.NewContext(reg))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("call cloud function %v returned after %v, want it to give up after the timeout of %v", cf.Name, elapsed, timeout)
+	}
+	var te types.TimeoutError
+	if !errors.As(err, &te) {
+		t.Errorf("call cloud function %v returned error %v, want a TimeoutError", cf.Name, err)
+	}
+}
@@ -18,8 +18,10 @@
 package errors
 
 import (
+	stderrors "errors"
 	"fmt"
 	"runtime/debug"
+	"strings"
 )
 
 const (
@@ -97,6 +99,60 @@ func (e NotFoundError) Error() string {
 	return e.Msg
 }
 
+// PermanentError marks an error that will not go away if the failing call is retried (e.g. a 404),
+// so that it is not retried even if the projector has a retry policy.
+type PermanentError struct {
+	Err error
+}
+
+func (e PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error that was marked as permanent.
+func (e PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks the given error as permanent. Permanent(nil) is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return PermanentError{Err: err}
+}
+
+// IsPermanent returns true iff the given error, or any error it wraps, was marked as permanent.
+// NotFoundErrors are always permanent.
+func IsPermanent(err error) bool {
+	var p PermanentError
+	var nf NotFoundError
+	return stderrors.As(err, &p) || stderrors.As(err, &nf)
+}
+
+// RecordError is the error for a single record of a batch of records (e.g. the input lines of a
+// file) that failed to map.
+type RecordError struct {
+	// Index is the index of the record in the batch.
+	Index int
+	// ProjectorStack are the names of the projectors that were being evaluated when the error
+	// occurred, outermost first. It is empty if the error occurred in the root mappings.
+	ProjectorStack []string
+	Err            error
+}
+
+func (e RecordError) Error() string {
+	if len(e.ProjectorStack) > 0 {
+		return fmt.Sprintf("record[%d] (in %s): %v", e.Index, strings.Join(e.ProjectorStack, " > "), e.Err)
+	}
+	return fmt.Sprintf("record[%d]: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e RecordError) Unwrap() error {
+	return e.Err
+}
+
 // Recover is a deferrable function that recovers a panic, and passes that back to the given handler
 // (which should probably assign the error return value of the function within which this is
 // deferred).
@@ -15,6 +15,7 @@
 package errors
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -66,3 +67,72 @@ func TestStringLocation(t *testing.T) {
 		})
 	}
 }
+
+func TestIsPermanent(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "plain error",
+			err:  fmt.Errorf("oops"),
+		},
+		{
+			name: "permanent error",
+			err:  Permanent(fmt.Errorf("oops")),
+			want: true,
+		},
+		{
+			name: "wrapped permanent error",
+			err:  Wrap(Locationf("somewhere"), Permanent(fmt.Errorf("oops"))),
+			want: true,
+		},
+		{
+			name: "not found error",
+			err:  NotFoundError{Msg: "404"},
+			want: true,
+		},
+		{
+			name: "nil",
+			err:  Permanent(nil),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsPermanent(test.err); got != test.want {
+				t.Errorf("IsPermanent(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRecordError(t *testing.T) {
+	inner := Permanent(fmt.Errorf("oops"))
+	tests := []struct {
+		name string
+		err  RecordError
+		want string
+	}{
+		{
+			name: "root mappings",
+			err:  RecordError{Index: 2, Err: inner},
+			want: "record[2]: oops",
+		},
+		{
+			name: "in projectors",
+			err:  RecordError{Index: 0, ProjectorStack: []string{"Patient_Patient", "Identifier"}, Err: inner},
+			want: "record[0] (in Patient_Patient > Identifier): oops",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.err.Error(); got != test.want {
+				t.Errorf("Error() = %q, want %q", got, test.want)
+			}
+			if !IsPermanent(test.err) {
+				t.Errorf("IsPermanent(%v) = false, want the wrapped error to be found", test.err)
+			}
+		})
+	}
+}
@@ -87,14 +87,20 @@ func buildFetchProjector(ctx context.Context, httpQuery *httppb.HttpFetchQuery)
 
 		errLocation = errors.FnLocationf("Fetch Function %q", httpQuery.GetName())
 
+		// Requests honour the evaluation's context, so that e.g. projector timeouts cancel them.
+		reqCtx := ctx
+		if pctx.GoContext != nil {
+			reqCtx = pctx.GoContext
+		}
+
 		client := auth.NewClient(ctx)
-		req, err := http.NewRequest(http.MethodGet, string(url), nil)
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, string(url), nil)
 		if err != nil {
 			return nil, errors.Wrap(errLocation, fmt.Errorf("error building new request %v", err))
 		}
 		q := req.URL.Query()
 		req.URL.RawQuery = q.Encode()
-		resource, err := client.ExecuteRequest(ctx, req, "search resources", false)
+		resource, err := client.ExecuteRequest(reqCtx, req, "search resources", false)
 
 		if err != nil {
 			return nil, errors.Wrap(errLocation, fmt.Errorf("error searching for resources %v", err))
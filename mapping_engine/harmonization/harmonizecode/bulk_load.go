@@ -0,0 +1,245 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unmatchedEquivalence is the equivalence of a ConceptMap target stating that there is no match,
+// which does not need a code.
+const unmatchedEquivalence = "unmatched"
+
+// ConceptMapFileError is the error for a ConceptMap file that could not be loaded.
+type ConceptMapFileError struct {
+	// Path is the path of the file.
+	Path string
+	// Err is why it could not be loaded.
+	Err error
+}
+
+func (e ConceptMapFileError) Error() string {
+	return fmt.Sprintf("concept map file %s: %v", e.Path, e.Err)
+}
+
+// BulkLoadReport describes the ConceptMap files loaded by LoadConceptMapFiles.
+type BulkLoadReport struct {
+	// Files is the number of files matched.
+	Files int
+	// Loaded is the number of ConceptMaps loaded.
+	Loaded int
+	// Elements is the number of elements (source codes) of the ConceptMaps loaded.
+	Elements int
+	// Skipped are the errors of the files that were skipped, in the order of their paths.
+	Skipped []ConceptMapFileError
+	// Duration is how long loading took.
+	Duration time.Duration
+}
+
+func (r BulkLoadReport) String() string {
+	return fmt.Sprintf("loaded %d of %d concept map files (%d elements) in %v, skipped %d", r.Loaded, r.Files, r.Elements, r.Duration, len(r.Skipped))
+}
+
+// parsedConceptMap is the result of parsing a ConceptMap file.
+type parsedConceptMap struct {
+	cache    cachedMap
+	elements int
+	err      error
+}
+
+// LoadConceptMapFiles caches the ConceptMaps of the files matching the given glob patterns (see
+// filepath.Match) or in the given directories (all .json files) in the given harmonizer. Files are
+// parsed concurrently by the given number of workers, or by one per CPU if it is not positive. Each
+// ConceptMap is checked to have the fields needed for lookups (see validateConceptMap), and an id
+// that no other file or ConceptMap cached already has. If strict, the first file (in the order of
+// the paths) that fails to load is returned as a ConceptMapFileError. Otherwise such files are
+// skipped and listed in the report. It is an error if a pattern does not match any file.
+func LoadConceptMapFiles(local *LocalCodeHarmonizer, patterns []string, strict bool, workers int) (BulkLoadReport, error) {
+	start := time.Now()
+	report := BulkLoadReport{}
+
+	paths, err := matchConceptMapFiles(patterns)
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(paths)
+
+	parsed := parseConceptMapFiles(paths, workers)
+
+	loadedFrom := make(map[string]string)
+	for i, p := range parsed {
+		err := p.err
+		if err == nil {
+			if other, ok := loadedFrom[p.cache.id]; ok {
+				err = fmt.Errorf("concept map id %q is also defined in %s", p.cache.id, other)
+			} else if _, ok := local.cachedMaps[p.cache.id]; ok {
+				err = fmt.Errorf("concept map id %q is already loaded from code_lookup", p.cache.id)
+			}
+		}
+
+		if err != nil {
+			ferr := ConceptMapFileError{Path: paths[i], Err: err}
+			if strict {
+				return report, ferr
+			}
+			report.Skipped = append(report.Skipped, ferr)
+			continue
+		}
+
+		loadedFrom[p.cache.id] = paths[i]
+		report.Loaded++
+		report.Elements += p.elements
+	}
+
+	// Only cache the ConceptMaps once all files are loaded, so that the harmonizer is left unchanged
+	// on error.
+	for i, p := range parsed {
+		if loadedFrom[p.cache.id] == paths[i] {
+			local.cachedMaps[p.cache.id] = p.cache
+		}
+	}
+
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// matchConceptMapFiles returns the sorted paths of the files matching the given glob patterns or in
+// the given directories, without duplicates.
+func matchConceptMapFiles(patterns []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, pattern := range patterns {
+		glob := pattern
+		if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+			glob = filepath.Join(pattern, "*.json")
+		}
+
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid concept map file pattern %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("concept map file pattern %q did not match any files", pattern)
+		}
+
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err != nil || fi.IsDir() || seen[m] {
+				continue
+			}
+			seen[m] = true
+			paths = append(paths, m)
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// parseConceptMapFiles reads, validates and builds the cached map of each of the given files, with
+// the given number of concurrent workers (or one per CPU if it is not positive). The results are in
+// the order of the files.
+func parseConceptMapFiles(paths []string, workers int) []parsedConceptMap {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	parsed := make([]parsedConceptMap, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				parsed[i] = parseConceptMapFile(paths[i])
+			}
+		}()
+	}
+
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return parsed
+}
+
+// parseConceptMapFile reads, validates and builds the cached map of the given file.
+func parseConceptMapFile(path string) parsedConceptMap {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return parsedConceptMap{err: err}
+	}
+
+	cm, err := unmarshalR3ConceptMap(raw)
+	if err != nil {
+		return parsedConceptMap{err: err}
+	}
+	if err := validateConceptMap(cm); err != nil {
+		return parsedConceptMap{err: err}
+	}
+
+	cache, _, err := buildCachedMap(cm)
+	if err != nil {
+		return parsedConceptMap{err: err}
+	}
+
+	elements := 0
+	for _, g := range cm.Group {
+		elements += len(g.Element)
+	}
+	return parsedConceptMap{cache: cache, elements: elements}
+}
+
+// validateConceptMap checks that the given ConceptMap has an id, a source and a target for each
+// group, and a code for each element and each of their targets, except the targets that are
+// unmatched.
+func validateConceptMap(cm *ConceptMap) error {
+	if cm.ID == "" {
+		return fmt.Errorf("concept map must have an id field")
+	}
+
+	for i, group := range cm.Group {
+		if group.Source == "" {
+			return fmt.Errorf("group[%d] of concept map %q must have a source field", i, cm.ID)
+		}
+		if group.Target == "" {
+			return fmt.Errorf("group[%d] of concept map %q must have a target field", i, cm.ID)
+		}
+		for j, element := range group.Element {
+			if element.Code == "" {
+				return fmt.Errorf("group[%d].element[%d] of concept map %q must have a code field", i, j, cm.ID)
+			}
+			for k, target := range element.Target {
+				if target.Code == "" && !strings.EqualFold(target.Equivalence, unmatchedEquivalence) {
+					return fmt.Errorf("group[%d].element[%d].target[%d] of concept map %q must have a code field", i, j, k, cm.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harmonizecode
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+// conceptMapJSON returns a ConceptMap with the given id, mapping the given source code to
+// target-<code>.
+func conceptMapJSON(id, code string) string {
+	return fmt.Sprintf(`{
+  "resourceType": "ConceptMap",
+  "id": %q,
+  "version": "v1",
+  "group": [{
+    "source": "src",
+    "target": "tgt",
+    "element": [{"code": %q, "target": [{"code": "target-%s", "equivalence": "equivalent"}]}]
+  }]
+}`, id, code, code)
+}
+
+// writeConceptMapFiles writes the given files (by path relative to dir) to a new temporary
+// directory, which it returns.
+func writeConceptMapFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bulk_load_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory for %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func cachedIDs(h *LocalCodeHarmonizer) []string {
+	var ids []string
+	for id := range h.cachedMaps {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestLoadConceptMapFiles(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        map[string]string
+		patterns     []string
+		wantIDs      []string
+		wantLoaded   int
+		wantElements int
+		wantSkipped  []string
+	}{
+		{
+			name: "directory",
+			files: map[string]string{
+				"maps/a.json":    conceptMapJSON("a", "red"),
+				"maps/b.json":    conceptMapJSON("b", "blue"),
+				"maps/notes.txt": "not a concept map",
+			},
+			patterns:     []string{"maps"},
+			wantIDs:      []string{"a", "b"},
+			wantLoaded:   2,
+			wantElements: 2,
+		},
+		{
+			name: "glob",
+			files: map[string]string{
+				"loinc-1.json":  conceptMapJSON("loinc-1", "red"),
+				"loinc-2.json":  conceptMapJSON("loinc-2", "blue"),
+				"snomed-1.json": conceptMapJSON("snomed-1", "green"),
+			},
+			patterns:     []string{"loinc-*.json"},
+			wantIDs:      []string{"loinc-1", "loinc-2"},
+			wantLoaded:   2,
+			wantElements: 2,
+		},
+		{
+			name: "overlapping patterns",
+			files: map[string]string{
+				"a.json": conceptMapJSON("a", "red"),
+			},
+			patterns:     []string{"*.json", "a.json"},
+			wantIDs:      []string{"a"},
+			wantLoaded:   1,
+			wantElements: 1,
+		},
+		{
+			name: "skips invalid files",
+			files: map[string]string{
+				"a.json":           conceptMapJSON("a", "red"),
+				"b.json":           `{"resourceType": "Patient"}`,
+				"c.json":           `{"resourceType": "ConceptMap", "group": [{"source": "s", "target": "t", "element": [{"code": "x"}]}]}`,
+				"d.json":           `{"resourceType": "ConceptMap", "id": "d", "group": [{"target": "t", "element": [{"code": "x"}]}]}`,
+				"e.json":           `{"resourceType": "ConceptMap", "id": "e", "group": [{"source": "s", "target": "t", "element": [{"code": "x", "target": [{"display": "X"}]}]}]}`,
+				"f.json":           `{`,
+				"g-unmatched.json": `{"resourceType": "ConceptMap", "id": "g", "group": [{"source": "s", "target": "t", "element": [{"code": "x", "target": [{"equivalence": "unmatched"}]}]}]}`,
+			},
+			patterns:     []string{"*.json"},
+			wantIDs:      []string{"a", "g"},
+			wantLoaded:   2,
+			wantElements: 2,
+			wantSkipped: []string{
+				"b.json: expected resourceType of ConceptMap",
+				"c.json: concept map must have an id field",
+				"d.json: group[0] of concept map \"d\" must have a source field",
+				"e.json: group[0].element[0].target[0] of concept map \"e\" must have a code field",
+				"f.json: failed to unmarshal json ConceptMap",
+			},
+		},
+		{
+			name: "skips duplicate ids",
+			files: map[string]string{
+				"a.json":      conceptMapJSON("a", "red"),
+				"copy/a.json": conceptMapJSON("a", "blue"),
+			},
+			patterns:     []string{"*.json", "copy"},
+			wantIDs:      []string{"a"},
+			wantLoaded:   1,
+			wantElements: 1,
+			wantSkipped:  []string{"copy/a.json: concept map id \"a\" is also defined in "},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeConceptMapFiles(t, test.files)
+			var patterns []string
+			for _, p := range test.patterns {
+				patterns = append(patterns, filepath.Join(dir, p))
+			}
+
+			for _, workers := range []int{0, 1, 3} {
+				h := NewLocalCodeHarmonizer()
+				report, err := LoadConceptMapFiles(h, patterns, false, workers)
+				if err != nil {
+					t.Fatalf("LoadConceptMapFiles(%v, false, %d) returned unexpected error %v", test.patterns, workers, err)
+				}
+
+				if diff := cmp.Diff(test.wantIDs, cachedIDs(h)); diff != "" {
+					t.Errorf("LoadConceptMapFiles(%v, false, %d) cached concept maps diff (-want +got):\n%s", test.patterns, workers, diff)
+				}
+				if report.Files != len(test.wantSkipped)+test.wantLoaded || report.Loaded != test.wantLoaded || report.Elements != test.wantElements {
+					t.Errorf("LoadConceptMapFiles(%v, false, %d) returned report %v, want %d files, %d loaded and %d elements", test.patterns, workers, report, len(test.wantSkipped)+test.wantLoaded, test.wantLoaded, test.wantElements)
+				}
+				if len(report.Skipped) != len(test.wantSkipped) {
+					t.Fatalf("LoadConceptMapFiles(%v, false, %d) skipped %v, want %d files", test.patterns, workers, report.Skipped, len(test.wantSkipped))
+				}
+				for i, want := range test.wantSkipped {
+					if got := strings.TrimPrefix(report.Skipped[i].Error(), "concept map file "+dir+"/"); !strings.HasPrefix(got, want) {
+						t.Errorf("LoadConceptMapFiles(%v, false, %d) skipped file %d with error %q, want it to start with %q", test.patterns, workers, i, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConceptMapFiles_DuplicateNamesBothFiles(t *testing.T) {
+	dir := writeConceptMapFiles(t, map[string]string{
+		"a.json": conceptMapJSON("a", "red"),
+		"b.json": conceptMapJSON("a", "blue"),
+	})
+
+	_, err := LoadConceptMapFiles(NewLocalCodeHarmonizer(), []string{filepath.Join(dir, "*.json")}, true, 0)
+	if err == nil {
+		t.Fatalf("LoadConceptMapFiles(*.json, true, 0) returned no error, want one for the duplicate id")
+	}
+	for _, want := range []string{filepath.Join(dir, "a.json"), filepath.Join(dir, "b.json"), `"a"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadConceptMapFiles(*.json, true, 0) returned error %q, want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestLoadConceptMapFiles_Errors(t *testing.T) {
+	dir := writeConceptMapFiles(t, map[string]string{
+		"a.json": conceptMapJSON("a", "red"),
+		"b.json": `{"resourceType": "ConceptMap"}`,
+	})
+
+	tests := []struct {
+		name     string
+		patterns []string
+		strict   bool
+		cached   []string
+		wantErr  string
+	}{
+		{
+			name:     "no matches",
+			patterns: []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.ndjson")},
+			wantErr:  "did not match any files",
+		},
+		{
+			name:     "invalid pattern",
+			patterns: []string{filepath.Join(dir, "[.json")},
+			wantErr:  "invalid concept map file pattern",
+		},
+		{
+			name:     "strict",
+			patterns: []string{filepath.Join(dir, "*.json")},
+			strict:   true,
+			wantErr:  filepath.Join(dir, "b.json") + ": concept map must have an id field",
+		},
+		{
+			name:     "already loaded",
+			patterns: []string{filepath.Join(dir, "a.json")},
+			strict:   true,
+			cached:   []string{"a"},
+			wantErr:  `concept map id "a" is already loaded from code_lookup`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewLocalCodeHarmonizer()
+			for _, id := range test.cached {
+				h.cachedMaps[id] = cachedMap{id: id}
+			}
+
+			_, err := LoadConceptMapFiles(h, test.patterns, test.strict, 0)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("LoadConceptMapFiles(%v, %t, 0) returned error %v, want one containing %q", test.patterns, test.strict, err, test.wantErr)
+			}
+			if diff := cmp.Diff(test.cached, cachedIDs(h)); diff != "" {
+				t.Errorf("LoadConceptMapFiles(%v, %t, 0) changed the cached concept maps on error, diff (-want +got):\n%s", test.patterns, test.strict, diff)
+			}
+		})
+	}
+}
+
+func TestLoadConceptMapFiles_Harmonizes(t *testing.T) {
+	dir := writeConceptMapFiles(t, map[string]string{
+		"colors.json": conceptMapJSON("colors", "red"),
+	})
+
+	h := NewLocalCodeHarmonizer()
+	if _, err := LoadConceptMapFiles(h, []string{dir}, true, 0); err != nil {
+		t.Fatalf("LoadConceptMapFiles(%s, true, 0) returned unexpected error %v", dir, err)
+	}
+
+	got, err := h.Harmonize("red", "src", "colors")
+	if err != nil {
+		t.Fatalf("Harmonize(red, src, colors) returned unexpected error %v", err)
+	}
+	want := []HarmonizedCode{{
+		Code:              "target-red",
+		System:            "tgt",
+		Version:           "v1",
+		Equivalence:       "equivalent",
+		ConceptMapID:      "colors",
+		ConceptMapVersion: "v1",
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Harmonize(red, src, colors) diff (-want +got):\n%s", diff)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/projector" /* copybara-comment: projector */
@@ -32,10 +33,12 @@ import (
 
 const (
 
-	projectorName       = "$HarmonizeCode"
-	withTargetProjector = "$HarmonizeCodeWithTarget"
-	searchProjector     = "$HarmonizeCodeBySearch"
-	localHarmonizerName = "$Local"
+	projectorName           = "$HarmonizeCode"
+	withProvenanceProjector = "$HarmonizeCodeWithProvenance"
+	withTargetProjector     = "$HarmonizeCodeWithTarget"
+	searchProjector         = "$HarmonizeCodeBySearch"
+	groupLookupProjector    = "$ConceptMapGroupLookup"
+	localHarmonizerName     = "$Local"
 )
 
 // CodeHarmonizer is the interface for harmonizing codes.
@@ -57,13 +60,31 @@ type CodeHarmonizer interface {
 	HarmonizeBySearch(sourceCode, sourceSystem, sourceValueset, targetValueset, version string) ([]HarmonizedCode, error)
 }
 
+// ContextCodeHarmonizer is a CodeHarmonizer whose lookups can be cancelled with a Go context. The
+// harmonization projectors use these methods when available, with the Go context of the evaluation
+// (see types.Context.GoContext), so that e.g. a projector timeout stops a slow remote lookup.
+type ContextCodeHarmonizer interface {
+	CodeHarmonizer
+	// HarmonizeContext is Harmonize with the given context.
+	HarmonizeContext(ctx context.Context, sourceCode, sourceSystem, sourceName string) ([]HarmonizedCode, error)
+	// HarmonizeBySearchContext is HarmonizeBySearch with the given context.
+	HarmonizeBySearchContext(ctx context.Context, sourceCode, sourceSystem, sourceValueset, targetValueset, version string) ([]HarmonizedCode, error)
+}
+
 // HarmonizedCode is the result of harmonization.
-// TODO: Add original code and equivalence here.
+// TODO: Add original code here.
 type HarmonizedCode struct {
 	Code    string
 	System  string
 	Display string
 	Version string
+	// Equivalence is the equivalence of the code to the source code (e.g. equivalent, wider,
+	// narrower), if known.
+	Equivalence string
+	// ConceptMapID and ConceptMapVersion identify the ConceptMap the code was translated with, if
+	// known. These are only output by ToProvenanceJSONContainer.
+	ConceptMapID      string
+	ConceptMapVersion string
 }
 
 // ToJSONContainer converts the HarmonizedCode to a JSONContainer.
@@ -81,6 +102,30 @@ func (h HarmonizedCode) ToJSONContainer() jsonutil.JSONContainer {
 	s := jsonutil.JSONToken(jsonutil.JSONStr(h.System))
 	jc["system"] = &s
 
+	if h.Equivalence != "" {
+		e := jsonutil.JSONToken(jsonutil.JSONStr(h.Equivalence))
+		jc["equivalence"] = &e
+	}
+
+	return jc
+}
+
+// ToProvenanceJSONContainer converts the HarmonizedCode to a JSONContainer like ToJSONContainer,
+// but also includes the ConceptMap the code was translated with (as conceptMapId and
+// conceptMapVersion), if known.
+func (h HarmonizedCode) ToProvenanceJSONContainer() jsonutil.JSONContainer {
+	jc := h.ToJSONContainer()
+
+	if h.ConceptMapID != "" {
+		id := jsonutil.JSONToken(jsonutil.JSONStr(h.ConceptMapID))
+		jc["conceptMapId"] = &id
+	}
+
+	if h.ConceptMapVersion != "" {
+		v := jsonutil.JSONToken(jsonutil.JSONStr(h.ConceptMapVersion))
+		jc["conceptMapVersion"] = &v
+	}
+
 	return jc
 }
 
@@ -118,6 +163,30 @@ func FromJSONContainer(jc jsonutil.JSONContainer) (HarmonizedCode, error) {
 		}
 	}
 
+	if e, ok := jc["equivalence"]; ok {
+		if s, ok := (*e).(jsonutil.JSONStr); ok {
+			result.Equivalence = string(s)
+		} else {
+			return result, fmt.Errorf("equivalence field is invalid")
+		}
+	}
+
+	if id, ok := jc["conceptMapId"]; ok {
+		if s, ok := (*id).(jsonutil.JSONStr); ok {
+			result.ConceptMapID = string(s)
+		} else {
+			return result, fmt.Errorf("conceptMapId field is invalid")
+		}
+	}
+
+	if v, ok := jc["conceptMapVersion"]; ok {
+		if s, ok := (*v).(jsonutil.JSONStr); ok {
+			result.ConceptMapVersion = string(s)
+		} else {
+			return result, fmt.Errorf("conceptMapVersion field is invalid")
+		}
+	}
+
 	return result, nil
 }
 
@@ -132,7 +201,7 @@ func LoadCodeHarmonizationProjectors(r *types.Registry, hc *hpb.CodeHarmonizatio
 		return err
 	}
 
-	proj, err := buildHarmonizeCodeProjector(harmonizers, projectorName)
+	proj, err := buildHarmonizeCodeProjector(harmonizers, projectorName, codesToJSONArray)
 	if err != nil {
 		return err
 	}
@@ -141,6 +210,15 @@ func LoadCodeHarmonizationProjectors(r *types.Registry, hc *hpb.CodeHarmonizatio
 		return fmt.Errorf("error registering projector %q: %v", projectorName, err)
 	}
 
+	pproj, err := buildHarmonizeCodeProjector(harmonizers, withProvenanceProjector, codesToProvenanceJSONArray)
+	if err != nil {
+		return err
+	}
+
+	if err = r.RegisterProjector(withProvenanceProjector, pproj); err != nil {
+		return fmt.Errorf("error registering projector %q: %v", withProvenanceProjector, err)
+	}
+
 	sproj, err := buildHarmonizeBySearchProjector(harmonizers, searchProjector)
 	if err != nil {
 		return err
@@ -159,6 +237,15 @@ func LoadCodeHarmonizationProjectors(r *types.Registry, hc *hpb.CodeHarmonizatio
 		return fmt.Errorf("error registering projector %q: %v", withTargetProjector, err)
 	}
 
+	gproj, err := buildGroupLookupProjector(harmonizers[localHarmonizerName].(*LocalCodeHarmonizer), groupLookupProjector)
+	if err != nil {
+		return err
+	}
+
+	if err = r.RegisterProjector(groupLookupProjector, gproj); err != nil {
+		return fmt.Errorf("error registering projector %q: %v", groupLookupProjector, err)
+	}
+
 	return nil
 }
 
@@ -205,6 +292,17 @@ func makeCodeHarmonizers(lookups *hpb.CodeHarmonizationConfig) (map[string]CodeH
 		}
 	}
 
+	if len(lookups.GetCodeLookupGlob()) > 0 {
+		report, err := LoadConceptMapFiles(local, lookups.GetCodeLookupGlob(), lookups.GetStrictCodeLookupGlob(), int(lookups.GetCodeLookupWorkers()))
+		if err != nil {
+			return nil, err
+		}
+		for _, skipped := range report.Skipped {
+			log.Printf("Warning: skipped %v", skipped)
+		}
+		log.Printf("Code harmonization: %v", report)
+	}
+
 	harmonizers[localHarmonizerName] = local
 	return harmonizers, nil
 }
@@ -217,6 +315,14 @@ func codesToJSONArray(hcs []HarmonizedCode) jsonutil.JSONArr {
 	return results
 }
 
+func codesToProvenanceJSONArray(hcs []HarmonizedCode) jsonutil.JSONArr {
+	results := make(jsonutil.JSONArr, 0, len(hcs))
+	for _, v := range hcs {
+		results = append(results, v.ToProvenanceJSONContainer())
+	}
+	return results
+}
+
 func buildHarmonizeWithTargetProjector(harmonizers map[string]CodeHarmonizer, name string) (types.Projector, error) {
 	f := func(sourceType, sourceCode, sourceSystem, targetSystem, sourceName jsonutil.JSONStr) (jsonutil.JSONToken, error) {
 		st := string(sourceType)
@@ -240,7 +346,7 @@ func buildHarmonizeWithTargetProjector(harmonizers map[string]CodeHarmonizer, na
 }
 
 func buildHarmonizeBySearchProjector(harmonizers map[string]CodeHarmonizer, name string) (types.Projector, error) {
-	f := func(sourceType, sourceCode, sourceSystem, sourceValueset, targetValueset, version jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+	f := func(ctx context.Context, sourceType, sourceCode, sourceSystem, sourceValueset, targetValueset, version jsonutil.JSONStr) (jsonutil.JSONToken, error) {
 		st := string(sourceType)
 		if st == "" {
 			return nil, fmt.Errorf("the harmonization source type cannot be empty")
@@ -250,7 +356,13 @@ func buildHarmonizeBySearchProjector(harmonizers map[string]CodeHarmonizer, name
 			return nil, fmt.Errorf("the harmonization source %s does not exist", st)
 		}
 
-		harmonizedCodes, err := harmonizer.HarmonizeBySearch(string(sourceCode), string(sourceSystem), string(sourceValueset), string(targetValueset), string(version))
+		var harmonizedCodes []HarmonizedCode
+		var err error
+		if ch, ok := harmonizer.(ContextCodeHarmonizer); ok {
+			harmonizedCodes, err = ch.HarmonizeBySearchContext(ctx, string(sourceCode), string(sourceSystem), string(sourceValueset), string(targetValueset), string(version))
+		} else {
+			harmonizedCodes, err = harmonizer.HarmonizeBySearch(string(sourceCode), string(sourceSystem), string(sourceValueset), string(targetValueset), string(version))
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -261,8 +373,8 @@ func buildHarmonizeBySearchProjector(harmonizers map[string]CodeHarmonizer, name
 	return projector.FromFunction(f, name)
 }
 
-func buildHarmonizeCodeProjector(harmonizers map[string]CodeHarmonizer, name string) (types.Projector, error) {
-	f := func(sourceType, sourceCode, sourceSystem, sourceName jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+func buildHarmonizeCodeProjector(harmonizers map[string]CodeHarmonizer, name string, toJSON func([]HarmonizedCode) jsonutil.JSONArr) (types.Projector, error) {
+	f := func(ctx context.Context, sourceType, sourceCode, sourceSystem, sourceName jsonutil.JSONStr) (jsonutil.JSONToken, error) {
 		st := string(sourceType)
 		if st == "" {
 			return nil, fmt.Errorf("the harmonization source type cannot be empty")
@@ -272,7 +384,26 @@ func buildHarmonizeCodeProjector(harmonizers map[string]CodeHarmonizer, name str
 			return nil, fmt.Errorf("the harmonization source %s does not exist", st)
 		}
 
-		harmonizedCodes, err := harmonizer.Harmonize(string(sourceCode), string(sourceSystem), string(sourceName))
+		var harmonizedCodes []HarmonizedCode
+		var err error
+		if ch, ok := harmonizer.(ContextCodeHarmonizer); ok {
+			harmonizedCodes, err = ch.HarmonizeContext(ctx, string(sourceCode), string(sourceSystem), string(sourceName))
+		} else {
+			harmonizedCodes, err = harmonizer.Harmonize(string(sourceCode), string(sourceSystem), string(sourceName))
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return toJSON(harmonizedCodes), nil
+	}
+
+	return projector.FromFunction(f, name)
+}
+
+func buildGroupLookupProjector(local *LocalCodeHarmonizer, name string) (types.Projector, error) {
+	f := func(sourceCode, sourceName, sourceSystem, targetSystem jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+		harmonizedCodes, err := local.LookupGroups(string(sourceCode), string(sourceSystem), string(targetSystem), string(sourceName))
 		if err != nil {
 			return nil, err
 		}
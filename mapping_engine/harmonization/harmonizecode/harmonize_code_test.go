@@ -27,6 +27,7 @@ func TestToJsonContainer(t *testing.T) {
 	var vstr jsonutil.JSONToken = jsonutil.JSONStr("v1")
 	var dstr jsonutil.JSONToken = jsonutil.JSONStr("Target Code")
 	var estr jsonutil.JSONToken = jsonutil.JSONStr("")
+	var eqstr jsonutil.JSONToken = jsonutil.JSONStr("wider")
 
 	tests := []struct {
 		name string
@@ -61,6 +62,23 @@ func TestToJsonContainer(t *testing.T) {
 				"display": &dstr,
 			},
 		},
+		{
+			name: "code with equivalence",
+			hc: HarmonizedCode{
+				Code:        "target-code",
+				System:      "target-system",
+				Display:     "Target Code",
+				Version:     "v1",
+				Equivalence: "wider",
+			},
+			jc: jsonutil.JSONContainer{
+				"code":        &cstr,
+				"system":      &sstr,
+				"version":     &vstr,
+				"display":     &dstr,
+				"equivalence": &eqstr,
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -79,3 +97,54 @@ func TestToJsonContainer(t *testing.T) {
 		})
 	}
 }
+
+func TestToProvenanceJsonContainer(t *testing.T) {
+	hc := HarmonizedCode{
+		Code:              "target-code",
+		System:            "target-system",
+		Display:           "Target Code",
+		Version:           "v1",
+		Equivalence:       "wider",
+		ConceptMapID:      "cm",
+		ConceptMapVersion: "v1",
+	}
+
+	var cstr jsonutil.JSONToken = jsonutil.JSONStr("target-code")
+	var sstr jsonutil.JSONToken = jsonutil.JSONStr("target-system")
+	var vstr jsonutil.JSONToken = jsonutil.JSONStr("v1")
+	var dstr jsonutil.JSONToken = jsonutil.JSONStr("Target Code")
+	var eqstr jsonutil.JSONToken = jsonutil.JSONStr("wider")
+	var idstr jsonutil.JSONToken = jsonutil.JSONStr("cm")
+
+	lean := jsonutil.JSONContainer{
+		"code":        &cstr,
+		"system":      &sstr,
+		"version":     &vstr,
+		"display":     &dstr,
+		"equivalence": &eqstr,
+	}
+	if diff := cmp.Diff(lean, hc.ToJSONContainer()); diff != "" {
+		t.Errorf("ToJSONContainer(%v) => diff (-want +got):\n%s", hc, diff)
+	}
+
+	provenance := jsonutil.JSONContainer{
+		"code":              &cstr,
+		"system":            &sstr,
+		"version":           &vstr,
+		"display":           &dstr,
+		"equivalence":       &eqstr,
+		"conceptMapId":      &idstr,
+		"conceptMapVersion": &vstr,
+	}
+	if diff := cmp.Diff(provenance, hc.ToProvenanceJSONContainer()); diff != "" {
+		t.Errorf("ToProvenanceJSONContainer(%v) => diff (-want +got):\n%s", hc, diff)
+	}
+
+	gothc, err := FromJSONContainer(provenance)
+	if err != nil {
+		t.Fatalf("FromJSONContainer(%v) resulted in an error %v", provenance, err)
+	}
+	if diff := cmp.Diff(hc, gothc); diff != "" {
+		t.Errorf("FromJSONContainer(%v) => diff (-want +got):\n%s", provenance, diff)
+	}
+}
@@ -25,6 +25,7 @@ const (
 
 // cachedMap stores FHIR concept map data.
 type cachedMap struct {
+	id      string
 	version string
 	groups  []cachedGroup
 }
@@ -84,41 +85,81 @@ func (h *LocalCodeHarmonizer) HarmonizeWithTarget(sourceCode, sourceSystem, targ
 			switch mode := group.unmapped.Mode; mode {
 			case unmappedModeFixed:
 				output = append(output, HarmonizedCode{
-					Version: conceptMap.version,
-					System:  group.targetSystem,
-					Code:    group.unmapped.Code,
-					Display: group.unmapped.Display,
+					Version:           conceptMap.version,
+					System:            group.targetSystem,
+					Code:              group.unmapped.Code,
+					Display:           group.unmapped.Display,
+					ConceptMapID:      conceptMap.id,
+					ConceptMapVersion: conceptMap.version,
 				})
 			case unmappedModeProvided:
 				output = append(output, HarmonizedCode{
-					Version: conceptMap.version,
-					System:  group.targetSystem,
-					Code:    sourceCode,
-					Display: sourceCode,
+					Version:           conceptMap.version,
+					System:            group.targetSystem,
+					Code:              sourceCode,
+					Display:           sourceCode,
+					ConceptMapID:      conceptMap.id,
+					ConceptMapVersion: conceptMap.version,
 				})
 			}
 			continue
 		}
-		for _, target := range targets {
-			output = append(output, HarmonizedCode{
-				Version: conceptMap.version,
-				System:  group.targetSystem,
-				Code:    target.Code,
-				Display: target.Display,
-			})
-		}
+		output = append(output, groupTargets(conceptMap, group, targets)...)
 	}
 
 	if len(output) == 0 {
 		output = append(output, HarmonizedCode{
-			Code:    sourceCode,
-			System:  fmt.Sprintf("%s-%s", sourceName, "unharmonized"),
-			Version: conceptMap.version,
+			Code:              sourceCode,
+			System:            fmt.Sprintf("%s-%s", sourceName, "unharmonized"),
+			Version:           conceptMap.version,
+			ConceptMapID:      conceptMap.id,
+			ConceptMapVersion: conceptMap.version,
 		})
 	}
 	return output, nil
 }
 
+// LookupGroups looks up the given code in the groups of the given concept map that map from the
+// given source system to the given target system. Empty systems match any group, and groups
+// without a source system match any source system. Unlike HarmonizeWithTarget, only codes from the
+// matching groups are returned, and the unmapped settings of the groups are not applied, so if no
+// group matches (or none of them maps the code) the result is empty.
+func (h *LocalCodeHarmonizer) LookupGroups(sourceCode, sourceSystem, targetSystem, sourceName string) ([]HarmonizedCode, error) {
+	conceptMap, ok := h.cachedMaps[sourceName]
+	if !ok {
+		return nil, fmt.Errorf("the harmonization source %q does not exist", sourceName)
+	}
+
+	output := []HarmonizedCode{}
+	for _, group := range conceptMap.groups {
+		if sourceSystem != "" && group.sourceSystem != "" && group.sourceSystem != sourceSystem {
+			continue
+		}
+		if targetSystem != "" && group.targetSystem != targetSystem {
+			continue
+		}
+		output = append(output, groupTargets(conceptMap, group, group.lookups[sourceCode])...)
+	}
+	return output, nil
+}
+
+// groupTargets converts the given targets of a group of the given concept map to HarmonizedCodes.
+func groupTargets(conceptMap cachedMap, group cachedGroup, targets []ConceptElementTarget) []HarmonizedCode {
+	var output []HarmonizedCode
+	for _, target := range targets {
+		output = append(output, HarmonizedCode{
+			Version:           conceptMap.version,
+			System:            group.targetSystem,
+			Code:              target.Code,
+			Display:           target.Display,
+			Equivalence:       target.Equivalence,
+			ConceptMapID:      conceptMap.id,
+			ConceptMapVersion: conceptMap.version,
+		})
+	}
+	return output
+}
+
 // Harmonize implements CodeHarmonizer's Harmonize function.
 func (h *LocalCodeHarmonizer) Harmonize(sourceCode, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
 	return h.HarmonizeWithTarget(sourceCode, sourceSystem, "", sourceName)
@@ -143,6 +184,7 @@ func buildCachedMap(cm *ConceptMap) (cachedMap, string, error) {
 	}
 
 	cache := cachedMap{
+		id:      cm.ID,
 		version: cm.Version,
 		groups:  make([]cachedGroup, 0, len(cm.Group)),
 	}
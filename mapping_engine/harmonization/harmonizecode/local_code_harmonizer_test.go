@@ -75,10 +75,13 @@ func TestHarmonize(t *testing.T) {
 			sourceName:   "foo",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "def",
-					System:  "xyz",
-					Display: "DEF",
-					Version: "bar",
+					Code:              "def",
+					System:            "xyz",
+					Display:           "DEF",
+					Version:           "bar",
+					Equivalence:       "EQUIVALENT",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -124,14 +127,20 @@ func TestHarmonize(t *testing.T) {
 			sourceName:   "foo",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "def1",
-					System:  "xyz1",
-					Version: "bar",
+					Code:              "def1",
+					System:            "xyz1",
+					Version:           "bar",
+					Equivalence:       "EQUIVALENT",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 				HarmonizedCode{
-					Code:    "def2",
-					System:  "xyz2",
-					Version: "bar",
+					Code:              "def2",
+					System:            "xyz2",
+					Version:           "bar",
+					Equivalence:       "EQUIVALENT",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -177,9 +186,12 @@ func TestHarmonize(t *testing.T) {
 			sourceName:   "foo",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "def",
-					System:  "xyz",
-					Version: "bar",
+					Code:              "def",
+					System:            "xyz",
+					Version:           "bar",
+					Equivalence:       "EQUIVALENT",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -211,9 +223,11 @@ func TestHarmonize(t *testing.T) {
 			sourceName:   "foo",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "unmatched",
-					System:  "foo-unharmonized",
-					Version: "bar",
+					Code:              "unmatched",
+					System:            "foo-unharmonized",
+					Version:           "bar",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -249,10 +263,12 @@ func TestHarmonize(t *testing.T) {
 			sourceName:   "map-id",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "unmatched",
-					Display: "unmatched",
-					System:  "xyz",
-					Version: "bar",
+					Code:              "unmatched",
+					Display:           "unmatched",
+					System:            "xyz",
+					Version:           "bar",
+					ConceptMapID:      "map-id",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -290,10 +306,12 @@ func TestHarmonize(t *testing.T) {
 			sourceName:   "map-id",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "unknown",
-					Display: "Unknown Code",
-					System:  "xyz",
-					Version: "bar",
+					Code:              "unknown",
+					Display:           "Unknown Code",
+					System:            "xyz",
+					Version:           "bar",
+					ConceptMapID:      "map-id",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -371,10 +389,12 @@ func TestHarmonize(t *testing.T) {
 			sourceName:   "map-id",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "unknown",
-					System:  "xyz2",
-					Version: "bar",
-					Display: "Unknown Code",
+					Code:              "unknown",
+					System:            "xyz2",
+					Version:           "bar",
+					Display:           "Unknown Code",
+					ConceptMapID:      "map-id",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -549,9 +569,12 @@ func TestHarmonizeWithTarget(t *testing.T) {
 			sourceName:    "foo",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "def1",
-					System:  "t1",
-					Version: "bar",
+					Code:              "def1",
+					System:            "t1",
+					Version:           "bar",
+					Equivalence:       "EQUIVALENT",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -564,9 +587,12 @@ func TestHarmonizeWithTarget(t *testing.T) {
 			sourceName:    "foo",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "def2",
-					System:  "t2",
-					Version: "bar",
+					Code:              "def2",
+					System:            "t2",
+					Version:           "bar",
+					Equivalence:       "EQUIVALENT",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -579,9 +605,11 @@ func TestHarmonizeWithTarget(t *testing.T) {
 			sourceName:    "foo",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "abc",
-					System:  "foo-unharmonized",
-					Version: "bar",
+					Code:              "abc",
+					System:            "foo-unharmonized",
+					Version:           "bar",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -594,9 +622,12 @@ func TestHarmonizeWithTarget(t *testing.T) {
 			sourceName:    "foo",
 			expectedOutput: []HarmonizedCode{
 				HarmonizedCode{
-					Code:    "def2",
-					System:  "t2",
-					Version: "bar",
+					Code:              "def2",
+					System:            "t2",
+					Version:           "bar",
+					Equivalence:       "EQUIVALENT",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
 				},
 			},
 		},
@@ -619,3 +650,187 @@ func TestHarmonizeWithTarget(t *testing.T) {
 		})
 	}
 }
+
+func TestLookupGroups(t *testing.T) {
+	conceptMap := json.RawMessage(`{
+				"group":[
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "snomed-abc",
+										"display": "SNOMED ABC",
+										"equivalence": "equivalent"
+									}
+								]
+							},
+							{
+								"code": "xyz",
+								"target":[
+									{
+										"code": "snomed-xyz",
+										"equivalence": "narrower"
+									}
+								]
+							}
+						],
+						"source": "local",
+						"target": "snomed"
+					},
+					{
+						"element":[
+							{
+								"code": "abc",
+								"target":[
+									{
+										"code": "loinc-abc",
+										"equivalence": "wider"
+									},
+									{
+										"code": "loinc-abc-2",
+										"equivalence": "narrower"
+									}
+								]
+							}
+						],
+						"unmapped": {
+							"mode": "provided"
+						},
+						"source": "local",
+						"target": "loinc"
+					}
+				],
+				"id": "foo",
+				"version": "bar",
+				"resourceType":"ConceptMap"
+			}`)
+	tests := []struct {
+		name           string
+		sourceCode     string
+		sourceSystem   string
+		targetSystem   string
+		expectedOutput []HarmonizedCode
+	}{
+		{
+			name:         "first target system",
+			sourceCode:   "abc",
+			sourceSystem: "local",
+			targetSystem: "snomed",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:              "snomed-abc",
+					System:            "snomed",
+					Display:           "SNOMED ABC",
+					Version:           "bar",
+					Equivalence:       "equivalent",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
+				},
+			},
+		},
+		{
+			name:         "second target system",
+			sourceCode:   "abc",
+			sourceSystem: "local",
+			targetSystem: "loinc",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:              "loinc-abc",
+					System:            "loinc",
+					Version:           "bar",
+					Equivalence:       "wider",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
+				},
+				HarmonizedCode{
+					Code:              "loinc-abc-2",
+					System:            "loinc",
+					Version:           "bar",
+					Equivalence:       "narrower",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
+				},
+			},
+		},
+		{
+			name:       "no filters",
+			sourceCode: "abc",
+			expectedOutput: []HarmonizedCode{
+				HarmonizedCode{
+					Code:              "snomed-abc",
+					System:            "snomed",
+					Display:           "SNOMED ABC",
+					Version:           "bar",
+					Equivalence:       "equivalent",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
+				},
+				HarmonizedCode{
+					Code:              "loinc-abc",
+					System:            "loinc",
+					Version:           "bar",
+					Equivalence:       "wider",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
+				},
+				HarmonizedCode{
+					Code:              "loinc-abc-2",
+					System:            "loinc",
+					Version:           "bar",
+					Equivalence:       "narrower",
+					ConceptMapID:      "foo",
+					ConceptMapVersion: "bar",
+				},
+			},
+		},
+		{
+			name:           "unmatched target system",
+			sourceCode:     "abc",
+			sourceSystem:   "local",
+			targetSystem:   "icd10",
+			expectedOutput: []HarmonizedCode{},
+		},
+		{
+			name:           "unmatched source system",
+			sourceCode:     "abc",
+			sourceSystem:   "other",
+			targetSystem:   "snomed",
+			expectedOutput: []HarmonizedCode{},
+		},
+		{
+			name:           "code not in group",
+			sourceCode:     "xyz",
+			sourceSystem:   "local",
+			targetSystem:   "loinc",
+			expectedOutput: []HarmonizedCode{},
+		},
+	}
+
+	local := NewLocalCodeHarmonizer()
+	cm, err := unmarshalR3ConceptMap(conceptMap)
+	if err != nil {
+		t.Fatalf("unmarshal failed with error: %v", err)
+	}
+	if err := local.Cache(cm); err != nil {
+		t.Fatalf("Cache returned unexpected error: %v", err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actualOutput, err := local.LookupGroups(test.sourceCode, test.sourceSystem, test.targetSystem, "foo")
+			if err != nil {
+				t.Fatalf("LookupGroups(%s, %s, %s, foo) returned unexpected error: %v", test.sourceCode, test.sourceSystem, test.targetSystem, err)
+			}
+
+			if diff := cmp.Diff(test.expectedOutput, actualOutput); diff != "" {
+				t.Errorf("LookupGroups(%s, %s, %s, foo) => diff -%v +%v\n%s", test.sourceCode, test.sourceSystem, test.targetSystem, test.expectedOutput, actualOutput, diff)
+			}
+		})
+	}
+
+	if _, err := local.LookupGroups("abc", "", "", "missing"); err == nil {
+		t.Errorf("LookupGroups(abc, , , missing) returned nil error, want error")
+	}
+}
@@ -45,7 +45,7 @@ type ConceptElement struct {
 // ConceptElementTarget represents a slimmed-down, multiversion representation
 // of a FHIR Target within a ConceptMap > Group > Element.
 type ConceptElementTarget struct {
-	Code, Display string
+	Code, Display, Equivalence string
 }
 
 // ConceptUnmapped represents a slimmed-down, multiversion representation of a
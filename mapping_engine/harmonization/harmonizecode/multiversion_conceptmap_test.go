@@ -92,7 +92,8 @@ func TestUnmarshalR3ConceptMap(t *testing.T) {
 								Code: "abc",
 								Target: []ConceptElementTarget{
 									ConceptElementTarget{
-										Code: "def",
+										Code:        "def",
+										Equivalence: "EQUIVALENT",
 									},
 								},
 							},
@@ -182,7 +183,8 @@ func TestUnmarshalR3ConceptMap(t *testing.T) {
 								Code: "abc",
 								Target: []ConceptElementTarget{
 									ConceptElementTarget{
-										Code: "def",
+										Code:        "def",
+										Equivalence: "EQUIVALENT",
 									},
 								},
 							},
@@ -200,7 +202,8 @@ func TestUnmarshalR3ConceptMap(t *testing.T) {
 								Code: "abc",
 								Target: []ConceptElementTarget{
 									ConceptElementTarget{
-										Code: "def",
+										Code:        "def",
+										Equivalence: "EQUIVALENT",
 									},
 								},
 							},
@@ -218,7 +221,8 @@ func TestUnmarshalR3ConceptMap(t *testing.T) {
 								Code: "source-code",
 								Target: []ConceptElementTarget{
 									ConceptElementTarget{
-										Code: "def",
+										Code:        "def",
+										Equivalence: "EQUIVALENT",
 									},
 								},
 							},
@@ -376,8 +380,9 @@ func TestUnmarshalR3ConceptMap(t *testing.T) {
 								Code: "old",
 								Target: []ConceptElementTarget{
 									ConceptElementTarget{
-										Code:    "BAD",
-										Display: "bad address",
+										Code:        "BAD",
+										Display:     "bad address",
+										Equivalence: "disjoint",
 									},
 								},
 							},
@@ -33,6 +33,8 @@ type ParamParameter struct {
 	Name        string
 	Part        []ParamParameter
 	ValueCoding ParamValueCoding
+	ValueCode   string
+	ValueURI    string
 }
 
 // ParamValueCoding represents a multiversion representation of a FHIR Coding
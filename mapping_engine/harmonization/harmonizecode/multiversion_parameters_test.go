@@ -174,10 +174,12 @@ func TestUnmarshalR3Parameters(t *testing.T) {
 						Name: "property",
 						Part: []ParamParameter{
 							ParamParameter{
-								Name: "code",
+								Name:      "code",
+								ValueCode: "focus",
 							},
 							ParamParameter{
-								Name: "value",
+								Name:      "value",
+								ValueCode: "top",
 							},
 						},
 					},
@@ -26,25 +26,27 @@ import (
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/auth" /* copybara-comment: auth */
 )
 
-// RemoteCodeHarmonizer will harmonize codes using a remote lookup service.
+// RemoteCodeHarmonizer will harmonize codes using a remote lookup service. It is a
+// ContextCodeHarmonizer, so that lookups are cancelled with the evaluation calling them.
 type RemoteCodeHarmonizer struct {
-	client  auth.Client
 	address string
 	cache   *ExpiringCache
 }
 
 func makeRemoteCodeHarmonizer(address string, ttl int, cleanup int) (*RemoteCodeHarmonizer, error) {
-	c := auth.NewClient(context.Background())
-
 	return &RemoteCodeHarmonizer{
 		address: address,
-		client:  c,
 		cache:   NewCache(ttl, cleanup),
 	}, nil
 }
 
 // HarmonizeBySearch implements CodeHarmonizer's HarmonizeBySearch function.
 func (h *RemoteCodeHarmonizer) HarmonizeBySearch(sourceCode, sourceSystem, sourceValueset, targetValueset, version string) ([]HarmonizedCode, error) {
+	return h.HarmonizeBySearchContext(context.Background(), sourceCode, sourceSystem, sourceValueset, targetValueset, version)
+}
+
+// HarmonizeBySearchContext implements ContextCodeHarmonizer's HarmonizeBySearchContext function.
+func (h *RemoteCodeHarmonizer) HarmonizeBySearchContext(ctx context.Context, sourceCode, sourceSystem, sourceValueset, targetValueset, version string) ([]HarmonizedCode, error) {
 	key := CodeLookupKey{
 		Code:    sourceCode,
 		System:  sourceSystem,
@@ -67,7 +69,7 @@ func (h *RemoteCodeHarmonizer) HarmonizeBySearch(sourceCode, sourceSystem, sourc
 	u.Path = path.Join(u.Path, "fhir/ConceptMap/$translate")
 	addr := u.String()
 
-	req, err := http.NewRequest(http.MethodGet, addr, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error building new request %v", err)
 	}
@@ -85,21 +87,22 @@ func (h *RemoteCodeHarmonizer) HarmonizeBySearch(sourceCode, sourceSystem, sourc
 	}
 
 	req.URL.RawQuery = q.Encode()
-	raw, err := h.client.ExecuteRequest(context.Background(), req, "translate code", true)
+	raw, err := auth.NewClient(ctx).ExecuteRequest(ctx, req, "translate code", true)
 	if err != nil {
 		return nil, fmt.Errorf("error calling remote endpoint to harmonize code, %v", err)
 	}
 
-	res, err := rawToCodes(raw)
+	res, err := rawToCodes(raw, "", version)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshalling translate result %v", err)
 	}
 
 	if len(res) == 0 {
 		res = append(res, HarmonizedCode{
-			Code:    sourceCode,
-			System:  "unharmonized",
-			Version: version,
+			Code:              sourceCode,
+			System:            "unharmonized",
+			Version:           version,
+			ConceptMapVersion: version,
 		})
 	}
 
@@ -116,6 +119,11 @@ func (h *RemoteCodeHarmonizer) HarmonizeWithTarget(sourceCode, sourceSystem, tar
 
 // Harmonize implements CodeHarmonizer's Harmonize function.
 func (h *RemoteCodeHarmonizer) Harmonize(sourceCode, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
+	return h.HarmonizeContext(context.Background(), sourceCode, sourceSystem, sourceName)
+}
+
+// HarmonizeContext implements ContextCodeHarmonizer's HarmonizeContext function.
+func (h *RemoteCodeHarmonizer) HarmonizeContext(ctx context.Context, sourceCode, sourceSystem, sourceName string) ([]HarmonizedCode, error) {
 	key := CodeLookupKey{
 		Code:   sourceCode,
 		System: sourceSystem,
@@ -133,7 +141,7 @@ func (h *RemoteCodeHarmonizer) Harmonize(sourceCode, sourceSystem, sourceName st
 	u.Path = path.Join(u.Path, fmt.Sprintf("fhir/ConceptMap/%s/$translate", sourceName))
 	addr := u.String()
 
-	req, err := http.NewRequest(http.MethodGet, addr, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error building new request %v", err)
 	}
@@ -143,20 +151,21 @@ func (h *RemoteCodeHarmonizer) Harmonize(sourceCode, sourceSystem, sourceName st
 
 	req.URL.RawQuery = q.Encode()
 
-	raw, err := h.client.ExecuteRequest(context.Background(), req, "translate code", true)
+	raw, err := auth.NewClient(ctx).ExecuteRequest(ctx, req, "translate code", true)
 	if err != nil {
 		return nil, fmt.Errorf("error calling remote endpoint to harmonize code, %v", err)
 	}
 
-	res, err := rawToCodes(raw)
+	res, err := rawToCodes(raw, sourceName, "")
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshalling translate result %v", err)
 	}
 
 	if len(res) == 0 {
 		res = append(res, HarmonizedCode{
-			Code:   sourceCode,
-			System: fmt.Sprintf("%s-%s", sourceName, "unharmonized"),
+			Code:         sourceCode,
+			System:       fmt.Sprintf("%s-%s", sourceName, "unharmonized"),
+			ConceptMapID: sourceName,
 		})
 	}
 
@@ -166,7 +175,10 @@ func (h *RemoteCodeHarmonizer) Harmonize(sourceCode, sourceSystem, sourceName st
 	return res, nil
 }
 
-func rawToCodes(raw *json.RawMessage) ([]HarmonizedCode, error) {
+// rawToCodes converts the matches in the given $translate result to HarmonizedCodes. The ConceptMap
+// of a match is the canonical URL (and version, from url|version) in its source part, if it has
+// one, and the given id and version otherwise.
+func rawToCodes(raw *json.RawMessage, conceptMapID, conceptMapVersion string) ([]HarmonizedCode, error) {
 	// TODO: Add support for multiple FHIR versions.
 	parameters, err := unmarshalR3Parameters(*raw)
 	if err != nil {
@@ -179,24 +191,36 @@ func rawToCodes(raw *json.RawMessage) ([]HarmonizedCode, error) {
 			continue
 		}
 
+		var codes []HarmonizedCode
+		equivalence, id, version := "", conceptMapID, conceptMapVersion
 		for _, part := range p.Part {
-			if part.Name != "concept" {
-				continue
-			}
-
-			coding := part.ValueCoding
-
-			// We do not support non equivalent codes yet.
-			if part.Name == "equivalence" && strings.ToLower(coding.Code) != "equivalent" {
-				continue
+			switch part.Name {
+			case "concept":
+				coding := part.ValueCoding
+				codes = append(codes, HarmonizedCode{
+					Code:    coding.Code,
+					System:  coding.System,
+					Display: coding.Display,
+					Version: coding.Version,
+				})
+			case "equivalence":
+				equivalence = part.ValueCode
+			case "source":
+				if part.ValueURI == "" {
+					continue
+				}
+				id = part.ValueURI
+				if i := strings.LastIndex(id, "|"); i >= 0 {
+					id, version = id[:i], id[i+1:]
+				}
 			}
+		}
 
-			res = append(res, HarmonizedCode{
-				Code:    coding.Code,
-				System:  coding.System,
-				Display: coding.Display,
-				Version: coding.Version,
-			})
+		for _, c := range codes {
+			c.Equivalence = equivalence
+			c.ConceptMapID = id
+			c.ConceptMapVersion = version
+			res = append(res, c)
 		}
 	}
 
@@ -16,6 +16,7 @@ package harmonizecode
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -24,6 +25,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
 	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
 )
 
@@ -61,6 +64,37 @@ const (
 		"resourceType": "Parameters"
 	}`
 
+	// A match from a versioned ConceptMap.
+	parameter3 = `{
+		"parameter": [
+			{
+				"name": "result",
+				"valueBoolean": true
+			},
+			{
+				"name": "match",
+				"part": [
+					{
+						"name": "equivalence",
+						"valueCode": "wider"
+					},
+					{
+						"name": "concept",
+						"valueCoding": {
+							"code": "target-code",
+							"system": "target-system"
+						}
+					},
+					{
+						"name": "source",
+						"valueUri": "http://example.com/fhir/ConceptMap/cm|2.1"
+					}
+				]
+			}
+		],
+		"resourceType": "Parameters"
+	}`
+
 	parameter2 = `{
 		"parameter": [
 			{
@@ -76,6 +110,7 @@ func setupMockServer(t *testing.T) *httptest.Server {
 	mocks := map[string]json.RawMessage{
 		"result1": json.RawMessage(parameter1),
 		"result2": json.RawMessage(parameter2),
+		"result3": json.RawMessage(parameter3),
 	}
 
 	count := 0
@@ -161,10 +196,29 @@ func TestRemoteCodeHarmonizerBySearch(t *testing.T) {
 			version:        "",
 			expectedOutput: []HarmonizedCode{
 				{
-					Code:    "target-code",
-					Display: "Target Code",
-					System:  "target-system",
-					Version: "target-version",
+					Code:        "target-code",
+					Display:     "Target Code",
+					System:      "target-system",
+					Version:     "target-version",
+					Equivalence: "equivalent",
+				},
+			},
+		},
+		{
+			name:           "versioned concept map",
+			urlPath:        "/result3",
+			sourceCode:     "source-code",
+			sourceSystem:   "source-system",
+			sourceValueset: "sourcevs",
+			targetValueset: "targetvs",
+			version:        "2",
+			expectedOutput: []HarmonizedCode{
+				{
+					Code:              "target-code",
+					System:            "target-system",
+					Equivalence:       "wider",
+					ConceptMapID:      "http://example.com/fhir/ConceptMap/cm",
+					ConceptMapVersion: "2.1",
 				},
 			},
 		},
@@ -178,9 +232,10 @@ func TestRemoteCodeHarmonizerBySearch(t *testing.T) {
 			version:        "v1",
 			expectedOutput: []HarmonizedCode{
 				{
-					Code:    "source-code",
-					System:  "unharmonized",
-					Version: "v1",
+					Code:              "source-code",
+					System:            "unharmonized",
+					Version:           "v1",
+					ConceptMapVersion: "v1",
 				},
 			},
 		},
@@ -221,10 +276,28 @@ func TestRemoteCodeHarmonizer(t *testing.T) {
 			sourceName:   "conceptmap1",
 			expectedOutput: []HarmonizedCode{
 				{
-					Code:    "target-code",
-					Display: "Target Code",
-					System:  "target-system",
-					Version: "target-version",
+					Code:         "target-code",
+					Display:      "Target Code",
+					System:       "target-system",
+					Version:      "target-version",
+					Equivalence:  "equivalent",
+					ConceptMapID: "conceptmap1",
+				},
+			},
+		},
+		{
+			name:         "versioned concept map",
+			urlPath:      "/result3",
+			sourceCode:   "source-code",
+			sourceSystem: "source-system",
+			sourceName:   "cm",
+			expectedOutput: []HarmonizedCode{
+				{
+					Code:              "target-code",
+					System:            "target-system",
+					Equivalence:       "wider",
+					ConceptMapID:      "http://example.com/fhir/ConceptMap/cm",
+					ConceptMapVersion: "2.1",
 				},
 			},
 		},
@@ -236,8 +309,9 @@ func TestRemoteCodeHarmonizer(t *testing.T) {
 			sourceName:   "conceptmap2",
 			expectedOutput: []HarmonizedCode{
 				{
-					Code:   "source-code",
-					System: "conceptmap2-unharmonized",
+					Code:         "source-code",
+					System:       "conceptmap2-unharmonized",
+					ConceptMapID: "conceptmap2",
 				},
 			},
 		},
@@ -323,3 +397,84 @@ func verifyServerCalls(t *testing.T, name, url string, expectedCount int) {
 		t.Errorf("request count verification failed, got %v, expected %v", c["count"], expectedCount)
 	}
 }
+
+// setupStalledServer returns a server that never responds, but gives up once the request is
+// cancelled.
+func setupStalledServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestRemoteCodeHarmonizer_Timeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	s := setupStalledServer(t)
+	harmonizer, err := makeRemoteCodeHarmonizer(s.URL, testCacheTTL, 1)
+	if err != nil {
+		t.Fatalf("makeRemoteCodeHarmonizer returned unexpected error %v", err)
+	}
+	harmonizers := map[string]CodeHarmonizer{"remote": harmonizer}
+
+	codeProj, err := buildHarmonizeCodeProjector(harmonizers, projectorName, codesToJSONArray)
+	if err != nil {
+		t.Fatalf("buildHarmonizeCodeProjector returned unexpected error %v", err)
+	}
+	searchProj, err := buildHarmonizeBySearchProjector(harmonizers, searchProjector)
+	if err != nil {
+		t.Fatalf("buildHarmonizeBySearchProjector returned unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name string
+		proj types.Projector
+		args []jsonutil.JSONToken
+	}{
+		{
+			name: projectorName,
+			proj: codeProj,
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("remote"), jsonutil.JSONStr("code"), jsonutil.JSONStr("system"), jsonutil.JSONStr("cm")},
+		},
+		{
+			name: searchProjector,
+			proj: searchProj,
+			args: []jsonutil.JSONToken{jsonutil.JSONStr("remote"), jsonutil.JSONStr("code"), jsonutil.JSONStr("system"), jsonutil.JSONStr("source"), jsonutil.JSONStr("target"), jsonutil.JSONStr("")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := types.NewRegistry()
+			if err := reg.RegisterProjector(test.name, test.proj); err != nil {
+				t.Fatalf("RegisterProjector returned unexpected error %v", err)
+			}
+			if err := reg.SetTimeout(test.name, timeout); err != nil {
+				t.Fatalf("SetTimeout returned unexpected error %v", err)
+			}
+			proj, err := reg.FindProjector(test.name)
+			if err != nil {
+				t.Fatalf("FindProjector returned unexpected error %v", err)
+			}
+
+			var args []jsonutil.JSONMetaNode
+			for _, a := range test.args {
+				n, err := jsonutil.TokenToNode(a)
+				if err != nil {
+					t.Fatalf("TokenToNode(%v) returned unexpected error %v", a, err)
+				}
+				args = append(args, n)
+			}
+
+			start := time.Now()
+			_, err = proj(args, types.NewContext(reg))
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("%s returned after %v, want it to give up after the timeout of %v", test.name, elapsed, timeout)
+			}
+			var te types.TimeoutError
+			if !errors.As(err, &te) {
+				t.Errorf("%s returned error %v, want a TimeoutError", test.name, err)
+			}
+		})
+	}
+}
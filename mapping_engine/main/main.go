@@ -65,6 +65,10 @@ var (
 
 	verbose = flag.Bool("verbose", false, "Enables outputting full trace of operations at the end.")
 
+	mappingStatsFile = flag.String("mapping_stats_output", "", "If set, a JSON report of how often each field mapping had an empty source (so nothing was written) is written to this file at the end.")
+
+	canonicalOutput = flag.Bool("canonical_output", false, "Writes the outputs as canonical JSON (RFC 8785) instead of indented JSON, e.g. so they can be compared byte by byte.")
+
 )
 
 const (
@@ -171,13 +175,18 @@ func main() {
 	}
 
 	tconfig := transform.TransformationConfig{
-		LogTrace: *verbose,
+		LogTrace:     *verbose,
+		MappingStats: *mappingStatsFile != "",
+		OutputFormat: transform.PrettyOutput,
+	}
+	if *canonicalOutput {
+		tconfig.OutputFormat = transform.CanonicalOutput
 	}
 
-	var tr transform.Transformer
+	var tr *transform.DefaultTransformer
 	var err error
 
-	if tr, err = transform.NewTransformer(context.Background(), dhConfig, tconfig); err != nil {
+	if tr, err = transform.NewDefaultTransformer(context.Background(), dhConfig, tconfig); err != nil {
 		log.Fatalf("Failed to load mapping config: %v", err)
 	}
 
@@ -194,7 +203,7 @@ func main() {
 			log.Fatalf("Mapping failed for input file %v: %v", f, err)
 		}
 
-		bres, err := json.MarshalIndent(res, "", "  ")
+		bres, err := tr.MarshalOutput(res)
 		if err != nil {
 			log.Fatalf("Failed to serialize output: %v", err)
 		}
@@ -208,4 +217,14 @@ func main() {
 			}
 		}
 	}
+
+	if *mappingStatsFile != "" {
+		bstats, err := json.MarshalIndent(tr.MappingStats(), "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to serialize mapping stats: %v", err)
+		}
+		if err := ioutil.WriteFile(*mappingStatsFile, bstats, fileWritePerm); err != nil {
+			log.Fatalf("Could not write mapping stats file %q: %v", *mappingStatsFile, err)
+		}
+	}
 }
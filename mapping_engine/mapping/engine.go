@@ -35,7 +35,16 @@ type Engine interface {
 	EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, output jsonutil.JSONToken, pctx *types.Context) (jsonutil.JSONMetaNode, error)
 }
 
+// PartialEngine is implemented by Engines that can go on after failed mappings, like Whistler.
+type PartialEngine interface {
+	Engine
+	ProcessMappingsPartially(maps []*mappb.FieldMapping, projName string, args []jsonutil.JSONMetaNode, output *jsonutil.JSONToken, pctx *types.Context) []MappingError
+}
+
 func checkCondition(conditionVs *mappb.ValueSource, args []jsonutil.JSONMetaNode, output *jsonutil.JSONToken, pctx *types.Context, a jsonutil.JSONTokenAccessor) (bool, error) {
+	// Conditions commonly check for data that may be missing.
+	defer relaxStrictSourcePaths(pctx)()
+
 	cond, err := EvaluateValueSource(conditionVs, args, *output, pctx, a)
 	if err != nil {
 		return false, err
@@ -100,9 +109,18 @@ func EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, ou
 		return nil, errors.New("nil value source pointer")
 	}
 
+	// Only the source of a required mapping itself is checked, not the value sources it is made of.
+	requiredTarget := pctx.RequiredTarget
+	pctx.RequiredTarget = ""
+
+	if pctx.StrictSourcePaths && guardProjectors[strings.TrimSuffix(vs.Projector, "[]")] {
+		defer relaxStrictSourcePaths(pctx)()
+	}
+
 	nextArgs := make([]jsonutil.JSONMetaNode, 0, 1)
 	var iterableIndicies []bool
-	var anyArgsToIterate bool
+	var spreadIndicies []bool
+	var anyArgsToIterate, anyArgsToSpread bool
 
 	if vs.GetSource() != nil {
 		arg, err := evaluateValueSourceSource(vs, args, output, pctx, a)
@@ -114,6 +132,11 @@ func EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, ou
 		iterableIndicies = append(iterableIndicies, isArray(vs))
 		anyArgsToIterate = isArray(vs)
 
+		// A spread first argument is always wrapped in a projected value, since the source oneof has
+		// nowhere else to carry the flag.
+		spreadIndicies = append(spreadIndicies, vs.GetProjectedValue().GetSpread())
+		anyArgsToSpread = vs.GetProjectedValue().GetSpread()
+
 		for _, s := range vs.AdditionalArg {
 			arg, err := EvaluateValueSource(s, args, output, pctx, a)
 			if err != nil {
@@ -126,6 +149,9 @@ func EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, ou
 			shouldIterate := (isArray(s) && s.GetProjector() == "") || isSelectorArray(s.GetProjector())
 			iterableIndicies = append(iterableIndicies, shouldIterate)
 			anyArgsToIterate = anyArgsToIterate || shouldIterate
+
+			spreadIndicies = append(spreadIndicies, s.GetSpread())
+			anyArgsToSpread = anyArgsToSpread || s.GetSpread()
 		}
 	}
 
@@ -135,6 +161,16 @@ func EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, ou
 		return nil, fmt.Errorf("error finding projector: %v", err)
 	}
 
+	if anyArgsToSpread {
+		if nextArgs, iterableIndicies, err = spread(nextArgs, iterableIndicies, spreadIndicies); err != nil {
+			return nil, fmt.Errorf("error spreading arguments for %q: %v", projName, err)
+		}
+
+		if arity, ok := pctx.Registry.Arity(projName); ok && arity != len(nextArgs) {
+			return nil, fmt.Errorf("%q expects %d arguments but the spread argument list has %d", projName, arity, len(nextArgs))
+		}
+	}
+
 	if anyArgsToIterate {
 		if len(nextArgs) == 0 {
 			return nil, errors.New("source was enumerated (ended with []) but source itself did not exist (?)")
@@ -146,8 +182,9 @@ func EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, ou
 			return nil, fmt.Errorf("error zipping args: %v", err)
 		}
 
+		label := iterationLabel(vs)
 		projVals := make([]jsonutil.JSONMetaNode, 0)
-		for _, args := range zippedArgs {
+		for i, args := range zippedArgs {
 			sources := []string{}
 			for _, s := range args {
 				if s != nil {
@@ -157,19 +194,29 @@ func EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, ou
 				}
 			}
 
+			if pctx.Lineage != nil {
+				pctx.Lineage.TakeReturned()
+			}
+			// The element stays on the stack if the projector fails, like the projector itself.
+			pctx.PushIterationFrame(label, i)
 			pv, err := proj(args, pctx)
 			if err != nil {
-				return nil, errs.Wrap(errs.Locationf("Iterated arguments %q", strings.Join(sources, ", ")), err)
+				return nil, errs.Wrap(errs.Locationf("Iterated arguments %q (element %d)", strings.Join(sources, ", "), i), err)
 			}
+			pctx.PopIterationFrame()
 
 			pv = postProcessValue(pv)
 			if isNil(pv) {
+				if requiredTarget != "" {
+					return nil, fmt.Errorf("required target %q has no value for element %d of its source (iterated arguments %q)", requiredTarget, i, strings.Join(sources, ", "))
+				}
 				continue
 			}
 
 			pvm, err := jsonutil.TokenToNodeWithProvenance(pv, "", jsonutil.Provenance{
 				Sources:  args,
 				Function: projName,
+				Lineage:  returnedLineage(pctx),
 			})
 			if err != nil {
 				return nil, err
@@ -187,6 +234,9 @@ func EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, ou
 		}, nil
 	}
 
+	if pctx.Lineage != nil {
+		pctx.Lineage.TakeReturned()
+	}
 	pv, err := proj(nextArgs, pctx)
 	if err != nil {
 		return nil, err
@@ -199,9 +249,19 @@ func EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, ou
 	return jsonutil.TokenToNodeWithProvenance(pv, "", jsonutil.Provenance{
 		Sources:  nextArgs,
 		Function: projName,
+		Lineage:  returnedLineage(pctx),
 	})
 }
 
+// returnedLineage returns the lineage tree of the value the projector that was just called
+// returned, if lineage is recorded and it was a projector defined in the mappings.
+func returnedLineage(pctx *types.Context) jsonutil.JSONToken {
+	if pctx.Lineage == nil {
+		return nil
+	}
+	return pctx.Lineage.TakeReturned()
+}
+
 func isArray(vs *mappb.ValueSource) bool {
 	var selector string
 	switch s := vs.Source.(type) {
@@ -211,6 +271,8 @@ func isArray(vs *mappb.ValueSource) bool {
 		selector = s.FromDestination
 	case *mappb.ValueSource_FromLocalVar:
 		selector = s.FromLocalVar
+	case *mappb.ValueSource_FromGlobal:
+		selector = s.FromGlobal
 	case *mappb.ValueSource_FromInput:
 		selector = s.FromInput.Field
 	case *mappb.ValueSource_ProjectedValue:
@@ -222,10 +284,90 @@ func isArray(vs *mappb.ValueSource) bool {
 	return isSelectorArray(selector)
 }
 
+// iterationLabel returns the name of the first iterated argument of the given value source, without
+// the [] suffix (e.g. obx for Build(o.obx[]), or Split for Build(Split(s)[])), which names the
+// elements of the iteration on the projector stack. It is empty if the argument has no name, e.g. if
+// it is a whole input.
+func iterationLabel(vs *mappb.ValueSource) string {
+	if vs.GetSource() != nil && isArray(vs) {
+		return selectorLabel(vs)
+	}
+	for _, s := range vs.AdditionalArg {
+		if isSelectorArray(s.GetProjector()) {
+			return strings.TrimSuffix(s.GetProjector(), "[]")
+		}
+		if isArray(s) && s.GetProjector() == "" {
+			return selectorLabel(s)
+		}
+	}
+	return ""
+}
+
+// selectorLabel returns the name of the source of the given value source, without the [] suffix.
+func selectorLabel(vs *mappb.ValueSource) string {
+	var selector string
+	switch s := vs.Source.(type) {
+	case *mappb.ValueSource_FromSource:
+		selector = s.FromSource
+	case *mappb.ValueSource_FromDestination:
+		selector = s.FromDestination
+	case *mappb.ValueSource_FromLocalVar:
+		selector = s.FromLocalVar
+	case *mappb.ValueSource_FromGlobal:
+		selector = s.FromGlobal
+	case *mappb.ValueSource_FromInput:
+		selector = s.FromInput.Field
+	case *mappb.ValueSource_ProjectedValue:
+		selector = s.ProjectedValue.Projector
+	}
+	return strings.TrimPrefix(strings.TrimSuffix(selector, "[]"), ".")
+}
+
 func isSelectorArray(selector string) bool {
 	return strings.HasSuffix(selector, "[]")
 }
 
+// spread expands each value flagged in spreads (which must be an array, or nil which is treated as
+// an empty array) into its items, in place. The iterable flags are expanded alongside the values,
+// with the items of a spread array never being iterated. For example
+// spread(["foo", [1, 2, 3], "bar"], [false, false, false], [false, true, false]) returns
+// ["foo", 1, 2, 3, "bar"], [false, false, false, false, false]
+func spread(values []jsonutil.JSONMetaNode, iterables []bool, spreads []bool) ([]jsonutil.JSONMetaNode, []bool, error) {
+	if len(values) != len(iterables) || len(values) != len(spreads) {
+		return nil, nil, fmt.Errorf("this is an internal bug: number of values (%d) did not match number of iterable (%d) or spread (%d) flags", len(values), len(iterables), len(spreads))
+	}
+
+	var res []jsonutil.JSONMetaNode
+	var resIterables []bool
+	for i, v := range values {
+		if !spreads[i] {
+			res = append(res, v)
+			resIterables = append(resIterables, iterables[i])
+			continue
+		}
+
+		if iterables[i] {
+			return nil, nil, fmt.Errorf("the %s argument can't be both iterated and spread", errs.SuffixNumber(i+1))
+		}
+
+		if v == nil {
+			continue
+		}
+
+		arr, ok := v.(jsonutil.JSONMetaArrayNode)
+		if !ok {
+			return nil, nil, fmt.Errorf("can't spread non-array %q (it was the %s argument in the function call)", v.ProvenanceString(), errs.SuffixNumber(i+1))
+		}
+
+		for _, item := range arr.Items {
+			res = append(res, item)
+			resIterables = append(resIterables, false)
+		}
+	}
+
+	return res, resIterables, nil
+}
+
 // zip allows synchronized iteration of some arrays along with non-arrays.
 // Given some values, and an equal number of iterable flags; For any index where an iterable flag
 // is true and the value is an array - the array is expanded. For example
@@ -346,7 +488,11 @@ func evaluateValueSourceSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNo
 		if lerr != nil {
 			return nil, lerr
 		}
-		metaNode, err = jsonutil.TokenToNodeWithProvenance(token, fmt.Sprintf("%s's output field %s", pctx.Projector(), s.FromDestination), jsonutil.Provenance{})
+		var prov jsonutil.Provenance
+		if pctx.Lineage != nil {
+			prov.Lineage = readLineage(*pctx.Lineage.ScopeOutput(), s.FromDestination, a)
+		}
+		metaNode, err = jsonutil.TokenToNodeWithProvenance(token, fmt.Sprintf("%s's output field %s", pctx.Projector(), s.FromDestination), prov)
 	case *mappb.ValueSource_FromLocalVar:
 		location = fmt.Sprintf("From Var %q", s.FromLocalVar)
 		// TODO: Provenance support for vars.
@@ -354,7 +500,19 @@ func evaluateValueSourceSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNo
 		if lerr != nil {
 			return nil, lerr
 		}
-		metaNode, err = jsonutil.TokenToNodeWithProvenance(token, fmt.Sprintf("%s's var %s", pctx.Projector(), s.FromLocalVar), jsonutil.Provenance{})
+		var prov jsonutil.Provenance
+		if pctx.Lineage != nil {
+			name := varName(s.FromLocalVar)
+			prov.Lineage = readLineage(pctx.Lineage.Var(name), strings.TrimPrefix(strings.TrimPrefix(s.FromLocalVar, name), "."), a)
+		}
+		metaNode, err = jsonutil.TokenToNodeWithProvenance(token, fmt.Sprintf("%s's var %s", pctx.Projector(), s.FromLocalVar), prov)
+	case *mappb.ValueSource_FromGlobal:
+		location = fmt.Sprintf("From Global %q", s.FromGlobal)
+		token, lerr := EvaluateFromGlobal(s, pctx, a)
+		if lerr != nil {
+			return nil, lerr
+		}
+		metaNode, err = jsonutil.TokenToNodeWithProvenance(token, fmt.Sprintf("global %s", s.FromGlobal), jsonutil.Provenance{})
 	case *mappb.ValueSource_ProjectedValue:
 		if s.ProjectedValue.Projector != "" {
 			location = "Argument for " + s.ProjectedValue.Projector
@@ -404,7 +562,7 @@ func fromSourceToArgSource(source *mappb.ValueSource_FromSource, args []jsonutil
 		}, nil
 	}
 
-	segs, err := jsonutil.SegmentPath(source.FromSource)
+	segs, err := jsonutil.CachedSegmentPath(source.FromSource)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing source %q: %v", source.FromSource, err)
 	}
@@ -433,7 +591,7 @@ func fromSourceToArgSource(source *mappb.ValueSource_FromSource, args []jsonutil
 func EvaluateArgSource(vs *mappb.ValueSource_InputSource, args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONMetaNode, error) {
 	// We need to find the argument (or subfield) or pctx referred to by this source.
 
-	segs, err := jsonutil.SegmentPath(vs.Field)
+	segs, err := jsonutil.CachedSegmentPath(vs.Field)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing source %s: %v", vs.Field, err)
 	}
@@ -454,12 +612,21 @@ func EvaluateArgSource(vs *mappb.ValueSource_InputSource, args []jsonutil.JSONMe
 	}
 
 	if vs.Arg == 0 {
+		if len(vs.GetPredicate()) > 0 {
+			return nil, fmt.Errorf("predicates are not supported on input context value %q", vs.Field)
+		}
 		targetObj, err = getValueFromContext(args, segs, pctx)
 		if err != nil {
 			return nil, fmt.Errorf("error getting value %q from input context: %v", vs.Field, err)
 		}
 	} else {
-		targetObj, err = jsonutil.GetNodeFieldSegmented(args[vs.Arg-1], segs)
+		optional := optionalSegments(vs.GetOptionalSegment(), len(segs))
+		if pctx.StrictSourcePaths {
+			if err := checkSourcePath(args[vs.Arg-1], segs, optional); err != nil {
+				return nil, fmt.Errorf("error getting field %q from %q: %v", vs.Field, args[vs.Arg-1].ProvenanceString(), err)
+			}
+		}
+		targetObj, err = getNodeFieldWithPredicates(args[vs.Arg-1], segs, optional, vs.GetPredicate())
 		if err != nil {
 			return nil, fmt.Errorf("error getting field %q from %q: %v", vs.Field, args[vs.Arg-1].ProvenanceString(), err)
 		}
@@ -468,6 +635,21 @@ func EvaluateArgSource(vs *mappb.ValueSource_InputSource, args []jsonutil.JSONMe
 	return targetObj, err
 }
 
+// optionalSegments converts the given optional segment indices (see InputSource.optional_segment)
+// into flags for each of the given number of segments, or nil if there are none.
+func optionalSegments(indices []int32, segments int) []bool {
+	if len(indices) == 0 {
+		return nil
+	}
+	optional := make([]bool, segments)
+	for _, i := range indices {
+		if i >= 0 && int(i) < segments {
+			optional[i] = true
+		}
+	}
+	return optional
+}
+
 func getValueFromContext(args []jsonutil.JSONMetaNode, segs []string, pctx *types.Context) (jsonutil.JSONMetaNode, error) {
 	var node jsonutil.JSONMetaNode
 	var remSegs []string
@@ -504,6 +686,8 @@ func ParentInfoFromArgs(args []jsonutil.JSONMetaNode, segs []string) (jsonutil.J
 			continue
 		}
 
+		// Argument paths are fully qualified (i.e. include array indices) so they rarely repeat and
+		// are not worth caching.
 		p := arg.Path()
 		argSegs, err := jsonutil.SegmentPath(p)
 		if err != nil {
@@ -602,6 +786,25 @@ func EvaluateFromVar(vs *mappb.ValueSource_FromLocalVar, pctx *types.Context, a
 	return readField(v, strings.TrimPrefix(strings.TrimPrefix(vs.FromLocalVar, name), "."), a)
 }
 
+// EvaluateFromGlobal returns the global (or the field of it) specified by the given accessor.
+func EvaluateFromGlobal(vs *mappb.ValueSource_FromGlobal, pctx *types.Context, a jsonutil.JSONTokenAccessor) (jsonutil.JSONToken, error) {
+	src := strings.TrimSuffix(vs.FromGlobal, "[]")
+	path, err := jsonutil.CachedSegmentPath(src)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing global accessor %q: %v", src, err)
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("no valid global accessor specified (%q is not valid)", src)
+	}
+
+	name := path[0]
+	g, err := pctx.Global(name)
+	if err != nil {
+		return nil, err
+	}
+	return readField(g, strings.TrimPrefix(strings.TrimPrefix(vs.FromGlobal, name), "."), a)
+}
+
 type undefinedVarError struct {
 	name string
 }
@@ -615,7 +818,7 @@ func (e undefinedVarError) Error() string {
 // not defined in the context.
 func getVar(source string, pctx *types.Context) (jsonutil.JSONToken, string, error) {
 	src := strings.TrimSuffix(strings.TrimSuffix(source, "!"), "[]")
-	path, err := jsonutil.SegmentPath(src)
+	path, err := jsonutil.CachedSegmentPath(src)
 	if err != nil {
 		return nil, "", fmt.Errorf("error parsing var accessor %q: %v", src, err)
 	}
@@ -632,6 +835,9 @@ func getVar(source string, pctx *types.Context) (jsonutil.JSONToken, string, err
 	}
 
 	if v == nil {
+		if pctx.VarFailed(name) {
+			return nil, name, fmt.Errorf("var %s is not assigned because the root mapping assigning it failed", name)
+		}
 		return jsonutil.JSONToken(nil), name, nil
 	}
 
@@ -646,6 +852,22 @@ func writeField(src jsonutil.JSONToken, field string, dest *jsonutil.JSONToken,
 	return a.SetField(src, strings.TrimSuffix(field, "!"), dest, forceOverwrite || strings.HasSuffix(field, "!"), srcIterate)
 }
 
+// isThis returns true iff the given target field refers to the whole output (i.e. $this).
+func isThis(field string) bool {
+	field = strings.TrimSuffix(field, "!")
+	return field == "" || field == "."
+}
+
+// writeThis writes the given value to the whole output. The value is deep-merged into the output
+// (arrays are appended) unless overwrite is set, in which case it replaces the output.
+func writeThis(src jsonutil.JSONToken, output *jsonutil.JSONToken, overwrite bool) error {
+	if overwrite {
+		*output = src
+		return nil
+	}
+	return jsonutil.Merge(src, output, true /* failOnOverwrite */, false /* overwriteArrays */)
+}
+
 func isSrcIteratable(vs *mappb.ValueSource) bool {
 	if strings.HasSuffix(vs.Projector, "[]") {
 		return true
@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// keyedTarget resolves the keyed append of the given mapping (see FieldMapping.target_key): it
+// returns the mapping with the keyed [] of its target replaced by the index of the element appended
+// earlier with the same key, if any, or left as is to append a new element, which is recorded under
+// the key.
+func (w Whistler) keyedTarget(m *mappb.FieldMapping, args []jsonutil.JSONMetaNode, output *jsonutil.JSONToken, pctx *types.Context) (*mappb.FieldMapping, error) {
+	var field string
+	var dest *jsonutil.JSONToken
+	switch t := m.Target.(type) {
+	case *mappb.FieldMapping_TargetField:
+		field, dest = t.TargetField, output
+	case *mappb.FieldMapping_TargetRootField:
+		field, dest = t.TargetRootField, pctx.Output
+	default:
+		return nil, fmt.Errorf("keyed appends can only target fields and root fields, not %s", budgetTargetName(m))
+	}
+	if isSrcIteratable(m.ValueSource) {
+		return nil, fmt.Errorf("keyed append to %s can not be written with an iterated source, since all its elements would have the same key", field)
+	}
+	// The transpiler rejects appends before the keyed one, so the keyed [] is the first.
+	i := strings.Index(field, "[]")
+	if i < 0 {
+		return nil, fmt.Errorf("keyed append target %s has no array to append to", field)
+	}
+
+	keyNode, err := EvaluateValueSource(m.TargetKey, args, *output, pctx, w.accessor)
+	if err != nil {
+		return nil, err
+	}
+	key, err := jsonutil.NodeToToken(keyNode)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("the key of keyed append to %s is null", field)
+	}
+
+	// The array may be shorter than when the key was recorded, e.g. if the mapping that appended the
+	// element failed, in which case a new element is appended again.
+	length := 0
+	if arr, err := w.accessor.GetField(*dest, field[:i]); err == nil {
+		if a, ok := arr.(jsonutil.JSONArr); ok {
+			length = len(a)
+		}
+	}
+	k := jsonutil.MarshalJSON(key)
+	if idx, ok := pctx.KeyedElement(dest, field[:i], k); ok && idx < length {
+		field = field[:i] + "[" + strconv.Itoa(idx) + "]" + field[i+2:]
+	} else {
+		pctx.RecordKeyedElement(dest, field[:i], k, length)
+	}
+
+	keyed := &mappb.FieldMapping{
+		ValueSource: m.ValueSource,
+		Condition:   m.Condition,
+		Required:    m.Required,
+	}
+	if _, ok := m.Target.(*mappb.FieldMapping_TargetRootField); ok {
+		keyed.Target = &mappb.FieldMapping_TargetRootField{TargetRootField: field}
+	} else {
+		keyed.Target = &mappb.FieldMapping_TargetField{TargetField: field}
+	}
+	return keyed, nil
+}
@@ -0,0 +1,239 @@
+// Copyright 2020 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// maxLineageSources is the maximum number of sources recorded for a single leaf, which bounds the
+// lineage of values computed from whole arrays or objects.
+const maxLineageSources = 16
+
+// writeLineage writes the lineage tree of the given source of the given mapping to the lineage of
+// its target, the same way writeTarget wrote the source itself.
+func (w Whistler) writeLineage(m *mappb.FieldMapping, src jsonutil.JSONMetaNode, pctx *types.Context) error {
+	lin := lineageTree(src)
+	iterateSrc := isSrcIteratable(m.ValueSource)
+
+	switch t := m.Target.(type) {
+	case *mappb.FieldMapping_TargetField:
+		if isThis(t.TargetField) {
+			return writeThis(lin, pctx.Lineage.ScopeOutput(), strings.HasSuffix(t.TargetField, "!"))
+		}
+		// The target was checked when the value was written, but the lineage needs the same primitives
+		// wrapped for lenient appends.
+		field := strings.TrimSuffix(t.TargetField, "!")
+		if err := checkTarget("", field, lin, pctx.Lineage.ScopeOutput(), true, pctx.LenientAppend); err != nil {
+			return err
+		}
+		return writeField(lin, t.TargetField, pctx.Lineage.ScopeOutput(), false, iterateSrc, w.accessor)
+	case *mappb.FieldMapping_TargetLocalVar:
+		name := varName(t.TargetLocalVar)
+		cval := pctx.Lineage.Var(name)
+		if cval != nil {
+			cval = jsonutil.Deepcopy(cval)
+		}
+
+		field := strings.TrimPrefix(strings.TrimPrefix(t.TargetLocalVar, name), ".")
+		if err := checkTarget(name, strings.TrimSuffix(field, "!"), lin, &cval, true, pctx.LenientAppend); err != nil {
+			return err
+		}
+		if err := writeField(lin, field, &cval, !isSelectorArray(field), iterateSrc, w.accessor); err != nil {
+			return err
+		}
+		pctx.Lineage.SetVar(name, cval)
+		return nil
+	case *mappb.FieldMapping_TargetObject:
+		addLineageObject(lin, t.TargetObject, pctx)
+		return nil
+	case *mappb.FieldMapping_TargetRootField:
+		field := strings.TrimSuffix(t.TargetRootField, "!")
+		if err := checkTarget("", field, lin, &pctx.Lineage.Output, true, pctx.LenientAppend); err != nil {
+			return err
+		}
+		return writeField(lin, t.TargetRootField, &pctx.Lineage.Output, false, iterateSrc, w.accessor)
+	default:
+		// Globals are not traced.
+		return nil
+	}
+}
+
+// addLineageObject adds the given lineage tree of an output object like addObject adds the object.
+func addLineageObject(lin jsonutil.JSONToken, targetObject string, pctx *types.Context) {
+	if arr, ok := lin.(jsonutil.JSONArr); ok {
+		for _, l := range arr {
+			addLineageObject(l, targetObject, pctx)
+		}
+		return
+	}
+	pctx.Lineage.TopLevelObjects[targetObject] = append(pctx.Lineage.TopLevelObjects[targetObject], lin)
+}
+
+// readLineage returns the lineage tree of the given field of the given lineage tree (of a variable
+// or an output), or nil if it has none.
+func readLineage(lin jsonutil.JSONToken, field string, a jsonutil.JSONTokenAccessor) jsonutil.JSONToken {
+	if lin == nil {
+		return nil
+	}
+	l, err := readField(lin, field, a)
+	if err != nil {
+		return nil
+	}
+	return l
+}
+
+// lineageTree returns the lineage tree of the given value: a token of the same shape, whose leaves
+// list the sources of the leaves of the value.
+func lineageTree(n jsonutil.JSONMetaNode) jsonutil.JSONToken {
+	switch t := n.(type) {
+	case jsonutil.JSONMetaContainerNode:
+		c := make(jsonutil.JSONContainer, len(t.Children))
+		for k, v := range t.Children {
+			l := lineageTree(v)
+			c[k] = &l
+		}
+		return c
+	case jsonutil.JSONMetaArrayNode:
+		a := make(jsonutil.JSONArr, 0, len(t.Items))
+		for _, v := range t.Items {
+			a = append(a, lineageTree(v))
+		}
+		return a
+	case jsonutil.JSONMetaPrimitiveNode:
+		return types.LineageLeaf(lineageSources(t))
+	default:
+		return nil
+	}
+}
+
+// lineageSources returns the sources of the given value. Values read from the input have their
+// path in it, values with a lineage tree (e.g. ones returned by projectors, or read from variables)
+// the sources listed in it, and values computed by a builtin the name of the builtin with the
+// sources of its arguments, e.g. $ToUpper(patient.name.family). Constants have no sources. At most
+// maxLineageSources are returned.
+func lineageSources(n jsonutil.JSONMetaNode) []string {
+	var keys []string
+	for c := n; c != nil; c = c.Parent() {
+		p := c.Provenance()
+		if p.Lineage != nil {
+			return lineageTreeSources(p.Lineage, keys)
+		}
+		if c.Parent() != nil {
+			keys = append(keys, c.Key())
+			continue
+		}
+
+		switch {
+		case p.Function != "":
+			return []string{callSources(p)}
+		case c.Key() == "" && len(p.Sources) == 0:
+			// The root of the input.
+			if path := n.Path(); path != "" {
+				return []string{path}
+			}
+			return []string{"$root"}
+		}
+	}
+	return nil
+}
+
+// callSources describes the sources of a value computed by a function from its arguments.
+func callSources(p jsonutil.Provenance) string {
+	var args []string
+	for _, s := range p.Sources {
+		if s == nil {
+			continue
+		}
+		args = appendSources(args, lineageSources(s))
+	}
+	return fmt.Sprintf("%s(%s)", p.Function, strings.Join(args, ", "))
+}
+
+// lineageTreeSources returns the sources listed in the subtree of the given lineage tree at the
+// given keys, innermost first.
+func lineageTreeSources(lin jsonutil.JSONToken, keys []string) []string {
+	for i := len(keys) - 1; i >= 0 && lin != nil; i-- {
+		switch t := lin.(type) {
+		case jsonutil.JSONContainer:
+			if c, ok := t[keys[i]]; ok {
+				lin = *c
+			} else {
+				lin = nil
+			}
+		case jsonutil.JSONArr:
+			idx, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(keys[i], "["), "]"))
+			if err != nil || idx < 0 || idx >= len(t) {
+				return nil
+			}
+			lin = t[idx]
+		default:
+			return nil
+		}
+	}
+	return subtreeSources(nil, lin)
+}
+
+// subtreeSources appends the sources listed in the leaves of the given lineage tree to the given
+// ones.
+func subtreeSources(sources []string, lin jsonutil.JSONToken) []string {
+	switch t := lin.(type) {
+	case jsonutil.JSONContainer:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sources = subtreeSources(sources, *t[k])
+		}
+	case jsonutil.JSONArr:
+		for _, c := range t {
+			sources = subtreeSources(sources, c)
+		}
+	default:
+		sources = appendSources(sources, types.LineageLeafSources(t))
+	}
+	return sources
+}
+
+// appendSources appends the given new sources that are not in the given ones yet, up to
+// maxLineageSources.
+func appendSources(sources, add []string) []string {
+	for _, a := range add {
+		if len(sources) >= maxLineageSources {
+			break
+		}
+		dup := false
+		for _, s := range sources {
+			if s == a {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			sources = append(sources, a)
+		}
+	}
+	return sources
+}
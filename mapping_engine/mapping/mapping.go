@@ -42,64 +42,297 @@ func (w Whistler) ProcessMappings(maps []*mappb.FieldMapping, projName string, a
 		mapType = "root"
 	}
 
+	defer pctx.ForgetKeyedElements(output)
 	for i, m := range maps {
-		if err := w.EvaluateMapping(m, args, output, pctx); err != nil {
-			return errs.Wrap(errs.NewProtoLocationf(m, "%s %s_mapping", errs.SuffixNumber(i+1), mapType), err)
+		if err := w.processMapping(i, m, mapType, projName, args, output, pctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MappingError is the error of a mapping that failed in ProcessMappingsPartially.
+type MappingError struct {
+	// Index is the index of the mapping, counting from 0.
+	Index int
+	// Target is the target of the mapping as it is written in Whistle, e.g. "var x" or "out Patient".
+	Target string
+	Err    error
+}
+
+func (e MappingError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of the mapping.
+func (e MappingError) Unwrap() error {
+	return e.Err
+}
+
+// ProcessMappingsPartially is ProcessMappings, except that a mapping that fails does not stop the
+// ones after it. The errors of the failed mappings are returned in order. The variable or global a
+// failed mapping assigns is left unassigned, and the top level objects written while evaluating it
+// (e.g. by out in the projectors it called) are discarded. Reading the variable or global it did
+// not assign is an error, so the mappings that depend on a failed one fail in turn. Writes to fields
+// are not rolled back though: those made to the output or to the root (by root in the projectors it
+// called) before the mapping failed are kept.
+func (w Whistler) ProcessMappingsPartially(maps []*mappb.FieldMapping, projName string, args []jsonutil.JSONMetaNode, output *jsonutil.JSONToken, pctx *types.Context) []MappingError {
+	mapType := "field"
+	if projName == "" {
+		mapType = "root"
+	}
+
+	defer pctx.ForgetKeyedElements(output)
+	var errors []MappingError
+	for i, m := range maps {
+		mark := pctx.Mark()
+		tlos := make(map[string]int, len(pctx.TopLevelObjects))
+		for target, objs := range pctx.TopLevelObjects {
+			tlos[target] = len(objs)
+		}
+
+		if err := w.processMapping(i, m, mapType, projName, args, output, pctx); err != nil {
+			errors = append(errors, MappingError{Index: i, Target: targetName(m), Err: err})
+
+			// Projectors that failed leave their variables and themselves on the stacks.
+			pctx.Unwind(mark)
+
+			switch t := m.Target.(type) {
+			case *mappb.FieldMapping_TargetLocalVar:
+				pctx.MarkVarFailed(varName(t.TargetLocalVar))
+			case *mappb.FieldMapping_TargetGlobal:
+				pctx.MarkGlobalFailed(t.TargetGlobal)
+			}
+
+			truncateObjects(pctx.TopLevelObjects, tlos)
+			if pctx.Lineage != nil {
+				truncateObjects(pctx.Lineage.TopLevelObjects, tlos)
+			}
+		}
+	}
+
+	return errors
+}
+
+// truncateObjects truncates the given top level objects back to the given numbers of objects by
+// target.
+func truncateObjects(objects map[string][]jsonutil.JSONToken, lengths map[string]int) {
+	for target, objs := range objects {
+		if n, ok := lengths[target]; ok && n < len(objs) {
+			objects[target] = objs[:n]
+		} else if !ok {
+			delete(objects, target)
 		}
 	}
+}
 
+// varName returns the name of the variable of the given var target, e.g. x for x.y[].
+func varName(target string) string {
+	if i := strings.IndexAny(target, ".[!"); i >= 0 {
+		return target[:i]
+	}
+	return target
+}
+
+// processMapping evaluates the mapping with the given index, and records its outcome in the
+// mapping stats.
+func (w Whistler) processMapping(i int, m *mappb.FieldMapping, mapType, projName string, args []jsonutil.JSONMetaNode, output *jsonutil.JSONToken, pctx *types.Context) error {
+	outcome, err := w.evaluateMapping(m, args, output, pctx)
+	if err != nil {
+		return errs.Wrap(errs.NewProtoLocationf(m, "%s %s_mapping", errs.SuffixNumber(i+1), mapType), err)
+	}
+	if pctx.MappingStats != nil && outcome != mappingSkipped {
+		pctx.MappingStats.RecordMapping(projName, i, targetName(m), outcome == mappingEmpty)
+	}
 	return nil
 }
 
+// mappingOutcome is the outcome of evaluating a field mapping.
+type mappingOutcome int
+
+const (
+	// mappingSkipped means the condition of the mapping was false.
+	mappingSkipped mappingOutcome = iota
+	// mappingEmpty means the source of the mapping was null or empty, so nothing was written (unless
+	// the target is a variable, which is still defined).
+	mappingEmpty
+	// mappingWritten means the source of the mapping was written to its target.
+	mappingWritten
+)
+
+// targetName describes the target of the given mapping as it is written in Whistle, e.g. "var x"
+// for variables. The target of mappings to this is "".
+func targetName(m *mappb.FieldMapping) string {
+	switch t := m.Target.(type) {
+	case *mappb.FieldMapping_TargetField:
+		return t.TargetField
+	case *mappb.FieldMapping_TargetLocalVar:
+		return "var " + t.TargetLocalVar
+	case *mappb.FieldMapping_TargetObject:
+		return "out " + t.TargetObject
+	case *mappb.FieldMapping_TargetDynamicObject:
+		return "out(...)"
+	case *mappb.FieldMapping_TargetRootField:
+		return "root " + t.TargetRootField
+	case *mappb.FieldMapping_TargetGlobal:
+		return "$global." + t.TargetGlobal
+	default:
+		return ""
+	}
+}
+
 // EvaluateMapping evaluates and assigns a single field mapping sequentially. This method
 // will check the condition as well, returning false if the condition check successfully evaluated
 // to false.
 // The JSONToken returned is the resulting value of this mapping (including a top level object if
 // that was the target).
 func (w Whistler) EvaluateMapping(m *mappb.FieldMapping, args []jsonutil.JSONMetaNode, output *jsonutil.JSONToken, pctx *types.Context) error {
+	_, err := w.evaluateMapping(m, args, output, pctx)
+	return err
+}
+
+// evaluateMapping is EvaluateMapping, which also returns whether the mapping was skipped, empty or
+// written.
+func (w Whistler) evaluateMapping(m *mappb.FieldMapping, args []jsonutil.JSONMetaNode, output *jsonutil.JSONToken, pctx *types.Context) (mappingOutcome, error) {
 	if m.Condition != nil {
 		var cb bool
 		var err error
 		if cb, err = checkCondition(m.Condition, args, output, pctx, w.accessor); err != nil {
-			return errs.Wrap(errs.NewProtoLocation(m.Condition, m), err)
+			return mappingSkipped, errs.Wrap(errs.NewProtoLocation(m.Condition, m), err)
 		}
 		if !cb {
-			return nil
+			return mappingSkipped, nil
 		}
 	}
 
+	if m.Required {
+		pctx.RequiredTarget = budgetTargetName(m)
+	}
+
 	var src jsonutil.JSONMetaNode
 	var err error
 	if src, err = EvaluateValueSource(m.ValueSource, args, *output, pctx, w.accessor); err != nil {
-		return errs.Wrap(errs.NewProtoLocation(m.ValueSource, m), err)
+		return mappingSkipped, errs.Wrap(errs.NewProtoLocation(m.ValueSource, m), err)
 	}
 
 	srcToken, err := jsonutil.NodeToToken(src)
 	if err != nil {
-		return err
+		return mappingSkipped, err
 	}
 	srcToken = postProcessValue(srcToken)
 
-	// Skip nil-check if target is var, since we still want to define the var even assign nil to it.
-	// Once the var is used, and written to something else that isn't a var, that's when nil-check
-	// will happen on this value.
-	if _, isVar := m.Target.(*mappb.FieldMapping_TargetLocalVar); !isVar && isNil(srcToken) {
-		return nil
+	if err := checkRequired(m, srcToken); err != nil {
+		return mappingSkipped, errs.Wrap(errs.NewProtoLocation(m.ValueSource, m), err)
 	}
 
+	outcome := mappingWritten
+	if isNil(srcToken) {
+		outcome = mappingEmpty
+		// Skip nil-check if target is var (or global), since we still want to define the var even assign
+		// nil to it. Once the var is used, and written to something else that isn't a var, that's when
+		// nil-check will happen on this value.
+		switch m.Target.(type) {
+		case *mappb.FieldMapping_TargetLocalVar, *mappb.FieldMapping_TargetGlobal:
+		default:
+			return outcome, nil
+		}
+	}
+
+	if t, ok := m.Target.(*mappb.FieldMapping_TargetDynamicObject); ok {
+		name, err := w.dynamicObjectName(t.TargetDynamicObject, args, *output, pctx)
+		if err != nil {
+			return mappingSkipped, errs.Wrap(errs.NewProtoLocation(t.TargetDynamicObject, m), err)
+		}
+		m = &mappb.FieldMapping{
+			Target:      &mappb.FieldMapping_TargetObject{TargetObject: name},
+			ValueSource: m.ValueSource,
+			Condition:   m.Condition,
+		}
+	}
+
+	if m.TargetKey != nil {
+		keyed, err := w.keyedTarget(m, args, output, pctx)
+		if err != nil {
+			return mappingSkipped, errs.Wrap(errs.NewProtoLocation(m.TargetKey, m), err)
+		}
+		m = keyed
+	}
+
+	if err := w.writeTarget(m, srcToken, output, pctx); err != nil {
+		return outcome, err
+	}
+	if pctx.Lineage != nil {
+		return outcome, w.writeLineage(m, src, pctx)
+	}
+	return outcome, nil
+}
+
+// dynamicObjectName evaluates the name of the output object targeted by a dynamic object target.
+// The name must be a non-empty string, and can not contain path separators since it is used as a
+// top level key of the output.
+func (w Whistler) dynamicObjectName(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, output jsonutil.JSONToken, pctx *types.Context) (string, error) {
+	node, err := EvaluateValueSource(vs, args, output, pctx, w.accessor)
+	if err != nil {
+		return "", err
+	}
+	tkn, err := jsonutil.NodeToToken(node)
+	if err != nil {
+		return "", err
+	}
+	name, ok := tkn.(jsonutil.JSONStr)
+	if !ok || name == "" || strings.ContainsAny(string(name), ".[]") {
+		return "", fmt.Errorf("the name of a dynamic output object must be a non-empty string without path separators (. [ ]), but got %s", jsonutil.MarshalJSON(tkn))
+	}
+	return string(name), nil
+}
+
+// checkRequired returns an error if the given mapping is required but the value of its source is
+// nil or empty. Empty elements of iterated sources are already checked during the iteration.
+func checkRequired(m *mappb.FieldMapping, srcToken jsonutil.JSONToken) error {
+	if m.Required && isNil(srcToken) {
+		return fmt.Errorf("required target %q has no value, its source evaluated to %s", budgetTargetName(m), jsonutil.MarshalJSON(srcToken))
+	}
+	return nil
+}
+
+// writeTarget writes the (non-nil, unless the target is a variable) source value of the given
+// mapping to its target.
+func (w Whistler) writeTarget(m *mappb.FieldMapping, srcToken jsonutil.JSONToken, output *jsonutil.JSONToken, pctx *types.Context) error {
+
 	// No target field defaults to self.
 	if m.Target == nil {
 		m.Target = &mappb.FieldMapping_TargetField{TargetField: ""}
 	}
 
+	if pctx.OutputBudget != nil {
+		if err := pctx.OutputBudget.Charge(budgetTargetName(m), srcToken); err != nil {
+			return err
+		}
+	}
+
 	iterateSrc := isSrcIteratable(m.ValueSource)
 
 	switch t := m.Target.(type) {
 	case *mappb.FieldMapping_TargetField:
+		if isThis(t.TargetField) {
+			overwrite := strings.HasSuffix(t.TargetField, "!")
+			if err := checkTarget("", "", srcToken, output, overwrite, pctx.LenientAppend); err != nil {
+				return fmt.Errorf("could not write to this: %v", err)
+			}
+			if err := writeThis(srcToken, output, overwrite); err != nil {
+				return fmt.Errorf("could not write to this: %v", err)
+			}
+			return nil
+		}
+		field := strings.TrimSuffix(t.TargetField, "!")
+		if err := checkTarget("", field, srcToken, output, field != t.TargetField, pctx.LenientAppend); err != nil {
+			return fmt.Errorf("could not write field %q: %v", t.TargetField, err)
+		}
 		if err := writeField(srcToken, t.TargetField, output, false, iterateSrc, w.accessor); err != nil {
 			return fmt.Errorf("could not write field %q: %v", t.TargetField, err)
 		}
-		return nil
+		return w.checkAppendedArray(m, t.TargetField, *output, pctx)
 	case *mappb.FieldMapping_TargetLocalVar:
 		cval, name, err := getVar(t.TargetLocalVar, pctx)
 		// Undefined var errors are safe to ignore here.
@@ -115,6 +348,9 @@ func (w Whistler) EvaluateMapping(m *mappb.FieldMapping, args []jsonutil.JSONMet
 		// For variables, we allow to overwrite them without "!" except for array appending.
 		forceOverwrite := !isSelectorArray(field)
 
+		if err := checkTarget(name, strings.TrimSuffix(field, "!"), srcToken, &cval, forceOverwrite || strings.HasSuffix(field, "!"), pctx.LenientAppend); err != nil {
+			return fmt.Errorf("could not write var %q: %v", t.TargetLocalVar, err)
+		}
 		if err := writeField(srcToken, field, &cval, forceOverwrite, iterateSrc, w.accessor); err != nil {
 			return err
 		}
@@ -124,20 +360,55 @@ func (w Whistler) EvaluateMapping(m *mappb.FieldMapping, args []jsonutil.JSONMet
 			return fmt.Errorf("error setting var %q: %v", t.TargetLocalVar, err)
 		}
 
-		return nil
+		return w.checkAppendedArray(m, field, cval, pctx)
 	case *mappb.FieldMapping_TargetObject:
 		addObject(srcToken, t.TargetObject, pctx)
+		if pctx.OutputBudget != nil {
+			return pctx.OutputBudget.CheckArrayLength(budgetTargetName(m), len(pctx.TopLevelObjects[t.TargetObject]))
+		}
 		return nil
 	case *mappb.FieldMapping_TargetRootField:
+		field := strings.TrimSuffix(t.TargetRootField, "!")
+		if err := checkTarget("", field, srcToken, pctx.Output, field != t.TargetRootField, pctx.LenientAppend); err != nil {
+			return fmt.Errorf("could not write root field %q: %v", t.TargetRootField, err)
+		}
 		if err := writeField(srcToken, t.TargetRootField, pctx.Output, false, iterateSrc, w.accessor); err != nil {
 			return fmt.Errorf("could not write root field %q: %v", t.TargetRootField, err)
 		}
-		return nil
+		return w.checkAppendedArray(m, t.TargetRootField, *pctx.Output, pctx)
+	case *mappb.FieldMapping_TargetGlobal:
+		return pctx.SetGlobal(t.TargetGlobal, srcToken)
 	default:
 		return fmt.Errorf("unknown target %T", m.Target)
 	}
 }
 
+// budgetTargetName describes the target of the given mapping in output budget errors.
+func budgetTargetName(m *mappb.FieldMapping) string {
+	if name := targetName(m); name != "" {
+		return name
+	}
+	return "$this"
+}
+
+// checkAppendedArray checks the length of the array that writing the given field of dest appended
+// to, if any, against the output budget. Only the first appended array of the field (e.g. a in
+// a[].b[]) can grow, the others are new.
+func (w Whistler) checkAppendedArray(m *mappb.FieldMapping, field string, dest jsonutil.JSONToken, pctx *types.Context) error {
+	if pctx.OutputBudget == nil {
+		return nil
+	}
+	i := strings.Index(field, "[]")
+	if i < 0 {
+		return nil
+	}
+	arr, err := w.accessor.GetField(dest, field[:i])
+	if a, ok := arr.(jsonutil.JSONArr); err == nil && ok {
+		return pctx.OutputBudget.CheckArrayLength(budgetTargetName(m), len(a))
+	}
+	return nil
+}
+
 // EvaluateValueSource evaluates a single value source with a DefaultAccessor.
 func (w Whistler) EvaluateValueSource(vs *mappb.ValueSource, args []jsonutil.JSONMetaNode, output jsonutil.JSONToken, pctx *types.Context) (jsonutil.JSONMetaNode, error) {
 	return EvaluateValueSource(vs, args, output, pctx, w.accessor)
@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// CompilePaths parses all source and target paths used in the given mappings (including nested
+// value sources) once, so that evaluating the mappings does not need to parse them again. The
+// paths are compiled in the same form that the engine will later access them in. Invalid paths
+// are skipped here; they are reported (with the mapping's location) when the mapping is evaluated.
+func CompilePaths(maps []*mappb.FieldMapping) {
+	for _, m := range maps {
+		compileValueSourcePaths(m.Condition)
+		compileValueSourcePaths(m.ValueSource)
+		compileValueSourcePaths(m.TargetKey)
+
+		switch t := m.Target.(type) {
+		case *mappb.FieldMapping_TargetField:
+			jsonutil.CompilePath(strings.TrimSuffix(t.TargetField, "!"))
+		case *mappb.FieldMapping_TargetRootField:
+			jsonutil.CompilePath(strings.TrimSuffix(t.TargetRootField, "!"))
+		case *mappb.FieldMapping_TargetLocalVar:
+			compileVarPaths(t.TargetLocalVar)
+		case *mappb.FieldMapping_TargetDynamicObject:
+			compileValueSourcePaths(t.TargetDynamicObject)
+		}
+	}
+}
+
+func compileValueSourcePaths(vs *mappb.ValueSource) {
+	if vs == nil {
+		return
+	}
+
+	switch s := vs.Source.(type) {
+	case *mappb.ValueSource_FromSource:
+		jsonutil.CompilePath(s.FromSource)
+	case *mappb.ValueSource_FromInput:
+		jsonutil.CompilePath(s.FromInput.Field)
+		compilePredicatePaths(s.FromInput.GetPredicate())
+	case *mappb.ValueSource_FromDestination:
+		jsonutil.CompilePath(strings.TrimSuffix(s.FromDestination, "[]"))
+	case *mappb.ValueSource_FromLocalVar:
+		compileVarPaths(s.FromLocalVar)
+	case *mappb.ValueSource_FromGlobal:
+		compileVarPaths(s.FromGlobal)
+	case *mappb.ValueSource_ProjectedValue:
+		compileValueSourcePaths(s.ProjectedValue)
+	}
+
+	for _, a := range vs.AdditionalArg {
+		compileValueSourcePaths(a)
+	}
+}
+
+// compilePredicatePaths compiles the compared fields of the given predicates, and of their own.
+func compilePredicatePaths(predicates []*mappb.PathPredicate) {
+	for _, p := range predicates {
+		jsonutil.CompilePath(p.GetField())
+		compilePredicatePaths(p.GetPredicate())
+	}
+}
+
+// compileVarPaths compiles both the var (or global) accessor itself and the field within it,
+// mirroring getVar and readField/writeField.
+func compileVarPaths(accessor string) {
+	segs, err := jsonutil.CompilePath(strings.TrimSuffix(strings.TrimSuffix(accessor, "!"), "[]"))
+	if err != nil || len(segs) == 0 {
+		return
+	}
+
+	field := strings.TrimPrefix(strings.TrimPrefix(accessor, segs[0]), ".")
+	jsonutil.CompilePath(strings.TrimSuffix(field, "!"))
+	jsonutil.CompilePath(strings.TrimSuffix(field, "[]"))
+}
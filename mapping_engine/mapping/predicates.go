@@ -0,0 +1,145 @@
+// Copyright 2020 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// getNodeFieldWithPredicates reads the given segments of the given node like
+// jsonutil.GetNodeFieldSegmentedOptional, selecting elements of arrays along the way with the given
+// predicates (see PathPredicate), which must be in order of their segment.
+func getNodeFieldWithPredicates(node jsonutil.JSONMetaNode, segs []string, optional []bool, predicates []*mappb.PathPredicate) (jsonutil.JSONMetaNode, error) {
+	for i := 1; i < len(predicates); i++ {
+		if predicates[i].GetSegment() < predicates[i-1].GetSegment() {
+			return nil, fmt.Errorf("predicates must be in order of their segment but got segment %d after %d", predicates[i].GetSegment(), predicates[i-1].GetSegment())
+		}
+	}
+	return readPredicated(node, segs, optional, predicates, 0)
+}
+
+// readPredicated implements getNodeFieldWithPredicates for the segments of the path from the given
+// one on, which the given node was read with.
+func readPredicated(node jsonutil.JSONMetaNode, segs []string, optional []bool, predicates []*mappb.PathPredicate, start int) (jsonutil.JSONMetaNode, error) {
+	if len(predicates) == 0 {
+		return jsonutil.GetNodeFieldSegmentedOptional(node, segs[start:], sliceOptional(optional, start, len(segs)))
+	}
+
+	p := predicates[0]
+	end := int(p.GetSegment())
+	if end < start || end > len(segs) {
+		return nil, fmt.Errorf("predicate segment %d is out of range [%d, %d]", end, start, len(segs))
+	}
+
+	node, err := jsonutil.GetNodeFieldSegmentedOptional(node, segs[start:end], sliceOptional(optional, start, end))
+	if err != nil || node == nil {
+		return nil, err
+	}
+
+	var items []jsonutil.JSONMetaNode
+	if arr, ok := node.(jsonutil.JSONMetaArrayNode); ok {
+		items = arr.Items
+	} else {
+		items = []jsonutil.JSONMetaNode{node}
+	}
+
+	var matches []jsonutil.JSONMetaNode
+	for _, item := range items {
+		ok, err := matchesPredicate(item, p)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		res, err := readPredicated(item, segs, optional, predicates[1:], end)
+		if err != nil {
+			return nil, err
+		}
+		if !p.GetAll() {
+			return res, nil
+		}
+		if res != nil {
+			matches = append(matches, res)
+		}
+	}
+
+	if !p.GetAll() {
+		return nil, nil
+	}
+	meta := jsonutil.NewJSONMeta(node.Key(), node.Provenance())
+	if arr, ok := node.(jsonutil.JSONMetaArrayNode); ok {
+		meta = arr.JSONMeta
+	}
+	return jsonutil.JSONMetaArrayNode{JSONMeta: meta, Items: matches}, nil
+}
+
+// matchesPredicate returns true iff the compared field of the given array element matches the given
+// predicate. Elements that can not have the field (e.g. primitives, for a field of an object) do
+// not have it, rather than being an error.
+func matchesPredicate(item jsonutil.JSONMetaNode, p *mappb.PathPredicate) (bool, error) {
+	segs, err := jsonutil.CachedSegmentPath(p.GetField())
+	if err != nil {
+		return false, fmt.Errorf("error parsing predicate field %s: %v", p.GetField(), err)
+	}
+
+	optional := make([]bool, len(segs))
+	for i := range optional {
+		optional[i] = true
+	}
+	field, err := getNodeFieldWithPredicates(item, segs, optional, p.GetPredicate())
+	if err != nil {
+		return false, err
+	}
+
+	var want jsonutil.JSONPrimitive
+	switch v := p.GetValue().(type) {
+	case *mappb.PathPredicate_ConstString:
+		want = jsonutil.JSONStr(v.ConstString)
+	case *mappb.PathPredicate_ConstNum:
+		want = jsonutil.JSONNum(v.ConstNum)
+	case *mappb.PathPredicate_ConstBool:
+		want = jsonutil.JSONBool(v.ConstBool)
+	default:
+		return false, fmt.Errorf("predicate on %q has no value to compare to", p.GetField())
+	}
+
+	prim, ok := field.(jsonutil.JSONMetaPrimitiveNode)
+	equal := ok && prim.Value == want
+	if p.GetOp() == mappb.PathPredicate_NEQ {
+		return !equal, nil
+	}
+	return equal, nil
+}
+
+// sliceOptional returns the optional flags (see optionalSegments) of the given range of segments,
+// or nil if there are none.
+func sliceOptional(optional []bool, start, end int) []bool {
+	if len(optional) == 0 {
+		return nil
+	}
+	if end > len(optional) {
+		end = len(optional)
+	}
+	if start >= end {
+		return nil
+	}
+	return optional[start:end]
+}
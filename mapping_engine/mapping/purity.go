@@ -0,0 +1,123 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"fmt"
+	"strings"
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// ImpureBuiltins are the builtins whose results are not determined by their arguments and the record
+// being mapped, which pure projectors (see ProjectorDefinition.pure) can not call.
+var ImpureBuiltins = map[string]bool{
+	"$Counter":     true,
+	"$CurrentTime": true,
+	"$UUID":        true,
+}
+
+// PurityError is the error for a projector that is declared pure but is not.
+type PurityError struct {
+	// Projector is the name of the projector declared pure.
+	Projector string
+	// Reason is why it is not pure, e.g. calls $UUID.
+	Reason string
+}
+
+func (e PurityError) Error() string {
+	return fmt.Sprintf("projector %s is declared pure but %s", e.Projector, e.Reason)
+}
+
+// CheckPurity checks that the given projectors that are declared pure only write to their own
+// output and variables, and do not call impure builtins or the given other impure projectors (e.g.
+// ones fetching from remote services), directly or through the given projectors they call (or pass
+// by name, like lambdas). It returns a PurityError for the first pure projector that is not.
+// Projectors that are called by names only known at runtime (e.g. with $CallFn) are not checked.
+func CheckPurity(projectors []*mappb.ProjectorDefinition, impure map[string]bool) error {
+	defs := make(map[string]*mappb.ProjectorDefinition)
+	for _, p := range projectors {
+		defs[p.GetName()] = p
+	}
+
+	for _, p := range projectors {
+		if !p.GetPure() {
+			continue
+		}
+		if reason := sideEffect(p.GetName(), defs, impure, map[string]bool{}); reason != "" {
+			return PurityError{Projector: p.GetName(), Reason: reason}
+		}
+	}
+	return nil
+}
+
+// sideEffect returns the first side-effect of the projector with the given name or the projectors it
+// calls, e.g. calls Build, which writes to root field x, or "" if there is none. Projectors that were
+// visited already are skipped.
+func sideEffect(name string, defs map[string]*mappb.ProjectorDefinition, impure map[string]bool, visited map[string]bool) string {
+	visited[name] = true
+
+	var calls []string
+	for _, m := range defs[name].GetMapping() {
+		switch t := m.GetTarget().(type) {
+		case *mappb.FieldMapping_TargetObject:
+			return fmt.Sprintf("writes to output object %s", t.TargetObject)
+		case *mappb.FieldMapping_TargetRootField:
+			return fmt.Sprintf("writes to root field %s", t.TargetRootField)
+		case *mappb.FieldMapping_TargetGlobal:
+			return fmt.Sprintf("writes to global %s", t.TargetGlobal)
+		case *mappb.FieldMapping_TargetDynamicObject:
+			return "writes to a dynamic output object"
+		}
+		calls = appendCalls(calls, defs, m.GetValueSource())
+		calls = appendCalls(calls, defs, m.GetCondition())
+		calls = appendCalls(calls, defs, m.GetTargetKey())
+	}
+	calls = appendCalls(calls, defs, defs[name].GetEnsures())
+
+	for _, c := range calls {
+		if ImpureBuiltins[c] || impure[c] {
+			return fmt.Sprintf("calls %s", c)
+		}
+	}
+	for _, c := range calls {
+		if defs[c] == nil || visited[c] {
+			continue
+		}
+		if reason := sideEffect(c, defs, impure, visited); reason != "" {
+			return fmt.Sprintf("calls %s, which %s", c, reason)
+		}
+	}
+	return ""
+}
+
+// appendCalls appends the names of the projectors called in the given value source to calls, along
+// with those of the given projectors passed by name (like lambdas), which may be called too.
+func appendCalls(calls []string, defs map[string]*mappb.ProjectorDefinition, vs *mappb.ValueSource) []string {
+	if vs == nil {
+		return calls
+	}
+	if name := strings.TrimSuffix(vs.GetProjector(), "[]"); name != "" {
+		calls = append(calls, name)
+	}
+	if name := vs.GetConstString(); defs[name] != nil {
+		calls = append(calls, name)
+	}
+	calls = appendCalls(calls, defs, vs.GetProjectedValue())
+	for _, arg := range vs.GetAdditionalArg() {
+		calls = appendCalls(calls, defs, arg)
+	}
+	return calls
+}
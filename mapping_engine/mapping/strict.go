@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// guardProjectors are the projectors whose arguments are expected to be missing at times (i.e.
+// they check for existence), so strict source path checks are not applied to them.
+var guardProjectors = map[string]bool{
+	"$IsEmpty":    true,
+	"$IsNil":      true,
+	"$IsNotEmpty": true,
+	"$IsNotNil":   true,
+}
+
+// relaxStrictSourcePaths turns off strict source path checks (see types.Context.StrictSourcePaths)
+// and returns a function that restores them.
+func relaxStrictSourcePaths(pctx *types.Context) func() {
+	strict := pctx.StrictSourcePaths
+	pctx.StrictSourcePaths = false
+	return func() {
+		pctx.StrictSourcePaths = strict
+	}
+}
+
+// checkSourcePath returns an error for the first of the given segments of a source path that does
+// not exist on the object it is read from (see checkSourceField), walking the path from the given
+// node. A segment that is read optionally (see optionalSegments) ends the check if it does not
+// exist, since the whole source is null then. So does the first segment that is read from anything
+// but an object or an array index, e.g. a [*] expansion, whose elements may differ.
+func checkSourcePath(node jsonutil.JSONMetaNode, segs []string, optional []bool) error {
+	for i, seg := range segs {
+		switch n := node.(type) {
+		case jsonutil.JSONMetaContainerNode:
+			if jsonutil.IsIndex(seg) {
+				return nil
+			}
+			child, ok := n.Children[seg]
+			if !ok && optional != nil && optional[i] {
+				return nil
+			}
+			if err := checkSourceField(n, seg); err != nil {
+				return err
+			}
+			node = child
+		case jsonutil.JSONMetaArrayNode:
+			idx, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(seg, "["), "]"))
+			if !jsonutil.IsIndex(seg) || err != nil || idx < 0 || idx >= len(n.Items) {
+				return nil
+			}
+			node = n.Items[idx]
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// checkSourceField returns an error if the given object does not have the given field, suggesting
+// the closest field it does have. Only objects are checked, as other values (including nulls) can
+// not be told apart from legitimately missing data.
+func checkSourceField(node jsonutil.JSONMetaNode, field string) error {
+	c, ok := node.(jsonutil.JSONMetaContainerNode)
+	if !ok || jsonutil.IsIndex(field) {
+		return nil
+	}
+	if _, ok := c.Children[field]; ok {
+		return nil
+	}
+
+	fields := make([]string, 0, len(c.Children))
+	for f := range c.Children {
+		fields = append(fields, f)
+	}
+	if closest := closestField(field, fields); closest != "" {
+		return fmt.Errorf("field %q does not exist (did you mean %q?)", field, closest)
+	}
+	return fmt.Errorf("field %q does not exist", field)
+}
+
+// closestField returns the field with the smallest edit distance to the given one, if that
+// distance is small enough for it to plausibly be a typo.
+func closestField(field string, fields []string) string {
+	if similar := types.SimilarNames(field, fields, 1); len(similar) > 0 {
+		return similar[0]
+	}
+	return ""
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// targetTypeError is the error for a result that can not be written to a target because of the
+// value already there, or on the way there.
+type targetTypeError struct {
+	// at is the path of the value in the way, e.g. name[0] for the target name[0].given.
+	at string
+	// existing is the value in the way.
+	existing jsonutil.JSONToken
+	// result is the value being written.
+	result jsonutil.JSONToken
+	// needs describes what the target needs at the path, e.g. "writing a field into it needs an
+	// object".
+	needs string
+}
+
+func (e targetTypeError) Error() string {
+	return fmt.Sprintf("%s is %s, but %s (the result is %s)", e.at, describeExisting(e.existing), e.needs, jsonTypeName(e.result))
+}
+
+// checkTarget checks that the given result can be written to the given field of dest, given the
+// values already in dest, and returns a targetTypeError if not. The rules are:
+//
+//   - Writing a field (e.g. a.b) needs objects along the path (a), and writing an element (a[0] or
+//     a[]) needs an array (a). Nothing (null) is fine anywhere, as are empty objects and arrays,
+//     which are replaced.
+//   - With lenientAppend, a primitive where appending (a[]) needs an array is wrapped into an array
+//     (in dest), so that the result is appended after it.
+//   - Unless overwrite is set, the value already at the target must be nothing, empty, or of the
+//     same type as the result if that is an object (merged) or an array (appended to). Primitives
+//     can only be overwritten.
+//
+// The paths in errors start with base (e.g. the name of a variable), or are $this for the whole
+// of dest. Invalid paths are not checked, as writing them fails anyway.
+func checkTarget(base, field string, result jsonutil.JSONToken, dest *jsonutil.JSONToken, overwrite, lenientAppend bool) error {
+	segs, err := jsonutil.CachedSegmentPath(field)
+	if err != nil {
+		return nil
+	}
+
+	cur := dest
+	at := base
+	for _, seg := range segs {
+		if seg == "" || seg == "." {
+			continue
+		}
+		if *cur == nil {
+			return nil
+		}
+
+		if jsonutil.IsIndex(seg) {
+			switch v := (*cur).(type) {
+			case jsonutil.JSONArr:
+				if seg == "[]" {
+					return nil
+				}
+				idx, err := strconv.Atoi(seg[1 : len(seg)-1])
+				if err != nil || idx < 0 || idx >= len(v) {
+					return nil
+				}
+				cur = &v[idx]
+			case jsonutil.JSONContainer:
+				if len(v) != 0 {
+					return targetTypeError{at: pathOrThis(at), existing: v, result: result, needs: "writing an element into it needs an array"}
+				}
+				*cur = jsonutil.JSONArr{}
+				return nil
+			default:
+				if seg == "[]" && lenientAppend {
+					*cur = jsonutil.JSONArr{v}
+					return nil
+				}
+				return targetTypeError{at: pathOrThis(at), existing: v, result: result, needs: "writing an element into it needs an array"}
+			}
+			at += seg
+			continue
+		}
+
+		switch v := (*cur).(type) {
+		case jsonutil.JSONContainer:
+			next, ok := v[seg]
+			if !ok || next == nil {
+				return nil
+			}
+			cur = next
+		case jsonutil.JSONArr:
+			if len(v) != 0 {
+				return targetTypeError{at: pathOrThis(at), existing: v, result: result, needs: fmt.Sprintf("writing a field into it needs an object (use %s[].%s to append one)", pathOrThis(at), seg)}
+			}
+			*cur = jsonutil.JSONContainer{}
+			return nil
+		default:
+			return targetTypeError{at: pathOrThis(at), existing: v, result: result, needs: "writing a field into it needs an object"}
+		}
+		if at == "" {
+			at = seg
+		} else {
+			at += "." + seg
+		}
+	}
+
+	if overwrite || *cur == nil {
+		return nil
+	}
+	switch v := (*cur).(type) {
+	case jsonutil.JSONContainer:
+		if _, ok := result.(jsonutil.JSONContainer); ok || len(v) == 0 {
+			return nil
+		}
+		return targetTypeError{at: pathOrThis(at), existing: v, result: result, needs: "only an object result can be merged into it (use ! to overwrite it)"}
+	case jsonutil.JSONArr:
+		if _, ok := result.(jsonutil.JSONArr); ok || len(v) == 0 {
+			return nil
+		}
+		return targetTypeError{at: pathOrThis(at), existing: v, result: result, needs: fmt.Sprintf("only an array result can be appended to it (use %s[] to append the result as one element, or ! to overwrite it)", pathOrThis(at))}
+	default:
+		return targetTypeError{at: pathOrThis(at), existing: v, result: result, needs: "a primitive can only be overwritten (with !)"}
+	}
+}
+
+// pathOrThis returns the given path, or $this if it is empty.
+func pathOrThis(path string) string {
+	if path == "" {
+		return "$this"
+	}
+	return path
+}
+
+// jsonTypeName returns the type of the given value with an article, e.g. "an array".
+func jsonTypeName(t jsonutil.JSONToken) string {
+	switch name := jsonType(t); name {
+	case "array", "object":
+		return "an " + name
+	default:
+		return "a " + name
+	}
+}
+
+// jsonType returns the type of the given value, e.g. "array".
+func jsonType(t jsonutil.JSONToken) string {
+	switch t.(type) {
+	case jsonutil.JSONStr:
+		return "string"
+	case jsonutil.JSONNum:
+		return "number"
+	case jsonutil.JSONBool:
+		return "boolean"
+	case jsonutil.JSONArr:
+		return "array"
+	case jsonutil.JSONContainer:
+		return "object"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", t)
+}
+
+// describeExisting describes a value already in the output, e.g. `the string "final"` or "an
+// array".
+func describeExisting(t jsonutil.JSONToken) string {
+	switch t.(type) {
+	case jsonutil.JSONStr, jsonutil.JSONNum, jsonutil.JSONBool:
+		return fmt.Sprintf("the %s %s", jsonType(t), jsonutil.MarshalJSON(t))
+	}
+	return jsonTypeName(t)
+}
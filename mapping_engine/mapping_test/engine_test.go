@@ -16,6 +16,7 @@ package mapping_test
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
@@ -352,6 +353,211 @@ func TestEvaluateArgSource(t *testing.T) {
 	}
 }
 
+func TestEvaluateArgSource_Predicates(t *testing.T) {
+	patient := mustTokenToNode(t, mustParseContainer(json.RawMessage(`{
+		"identifier": [
+			{"type": {"coding": [{"system": "v2", "code": "SS"}]}, "value": "123-45"},
+			{"type": {"coding": [{"system": "local", "code": "XX"}, {"system": "v2", "code": "MR"}]}, "value": "m1"},
+			{"type": {"coding": [{"system": "v2", "code": "MR"}]}, "value": "m2", "rank": 2},
+			"not an object"
+		],
+		"name": {"use": "official", "family": "Doe"}
+	}`), t))
+
+	mr := func(all bool, op mappb.PathPredicate_Operator, segment int32) *mappb.PathPredicate {
+		return &mappb.PathPredicate{
+			Segment: segment,
+			Field:   "type.coding[0].code",
+			Op:      op,
+			Value:   &mappb.PathPredicate_ConstString{ConstString: "MR"},
+			All:     all,
+		}
+	}
+
+	tests := []struct {
+		name       string
+		field      string
+		predicates []*mappb.PathPredicate
+		want       string
+	}{
+		{
+			name:       "first match",
+			field:      "identifier.value",
+			predicates: []*mappb.PathPredicate{mr(false, mappb.PathPredicate_EQ, 1)},
+			want:       `"m2"`,
+		},
+		{
+			name:       "all matches",
+			field:      "identifier.value",
+			predicates: []*mappb.PathPredicate{mr(true, mappb.PathPredicate_EQ, 1)},
+			want:       `["m2"]`,
+		},
+		{
+			name:       "not equal",
+			field:      "identifier",
+			predicates: []*mappb.PathPredicate{mr(true, mappb.PathPredicate_NEQ, 1)},
+			want:       `[{"type":{"coding":[{"code":"SS","system":"v2"}]},"value":"123-45"},{"type":{"coding":[{"code":"XX","system":"local"},{"code":"MR","system":"v2"}]},"value":"m1"},"not an object"]`,
+		},
+		{
+			name:       "whole element",
+			field:      "identifier",
+			predicates: []*mappb.PathPredicate{mr(false, mappb.PathPredicate_EQ, 1)},
+			want:       `{"rank":2,"type":{"coding":[{"code":"MR","system":"v2"}]},"value":"m2"}`,
+		},
+		{
+			name:  "number",
+			field: "identifier.value",
+			predicates: []*mappb.PathPredicate{{
+				Segment: 1,
+				Field:   "rank",
+				Value:   &mappb.PathPredicate_ConstNum{ConstNum: 2},
+			}},
+			want: `"m2"`,
+		},
+		{
+			name:  "nested predicate",
+			field: "identifier.value",
+			predicates: []*mappb.PathPredicate{{
+				Segment: 1,
+				Field:   "type.coding.code",
+				Predicate: []*mappb.PathPredicate{{
+					Segment: 2,
+					Field:   "system",
+					Value:   &mappb.PathPredicate_ConstString{ConstString: "v2"},
+				}},
+				Value: &mappb.PathPredicate_ConstString{ConstString: "MR"},
+				All:   true,
+			}},
+			want: `["m1","m2"]`,
+		},
+		{
+			name:       "no match",
+			field:      "identifier.value",
+			predicates: []*mappb.PathPredicate{{Segment: 1, Field: "value", Value: &mappb.PathPredicate_ConstString{ConstString: "none"}}},
+			want:       `null`,
+		},
+		{
+			name:       "no match of all",
+			field:      "identifier.value",
+			predicates: []*mappb.PathPredicate{{Segment: 1, Field: "value", Value: &mappb.PathPredicate_ConstString{ConstString: "none"}, All: true}},
+			want:       `[]`,
+		},
+		{
+			name:       "missing array",
+			field:      "contact.value",
+			predicates: []*mappb.PathPredicate{mr(false, mappb.PathPredicate_EQ, 1)},
+			want:       `null`,
+		},
+		{
+			name:       "single object",
+			field:      "name.family",
+			predicates: []*mappb.PathPredicate{{Segment: 1, Field: "use", Value: &mappb.PathPredicate_ConstString{ConstString: "official"}}},
+			want:       `"Doe"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := &mappb.ValueSource_InputSource{Arg: 1, Field: test.field, Predicate: test.predicates}
+			got, err := mapping.EvaluateArgSource(src, []jsonutil.JSONMetaNode{patient}, types.NewContext(types.NewRegistry()))
+			if err != nil {
+				t.Fatalf("EvaluateArgSource(%v) got unexpected error %v", src, err)
+			}
+
+			var tkn jsonutil.JSONToken
+			if got != nil {
+				if tkn, err = jsonutil.NodeToToken(got); err != nil {
+					t.Fatalf("NodeToToken(%v) got unexpected error %v", got, err)
+				}
+			}
+			b, err := json.Marshal(tkn)
+			if err != nil {
+				t.Fatalf("json.Marshal(%v) got unexpected error %v", tkn, err)
+			}
+			if diff := cmp.Diff(test.want, string(b)); diff != "" {
+				t.Errorf("EvaluateArgSource(%v) returned diff (-want +got):\n%s", src, diff)
+			}
+		})
+	}
+}
+
+func TestEvaluateArgSource_StrictSourcePaths(t *testing.T) {
+	patient := mustTokenToNode(t, mustParseContainer(json.RawMessage(`{
+		"identifier": [{"value": "123"}],
+		"name": {"family": "Doe", "given": "John"},
+		"deceased": null
+	}`), t))
+
+	tests := []struct {
+		name     string
+		field    string
+		optional []int32
+		want     string
+		wantErr  string
+	}{
+		{
+			name:    "missing first field",
+			field:   "nmae.family",
+			wantErr: `field "nmae" does not exist (did you mean "name"?)`,
+		},
+		{
+			name:    "missing second field",
+			field:   "name.famly",
+			wantErr: `field "famly" does not exist (did you mean "family"?)`,
+		},
+		{
+			name:    "missing field of an array element",
+			field:   "identifier[0].vaule",
+			wantErr: `field "vaule" does not exist (did you mean "value"?)`,
+		},
+		{
+			name:     "optional second field",
+			field:    "name.suffix",
+			optional: []int32{1},
+			want:     `null`,
+		},
+		{
+			name:     "fields after a missing optional one",
+			field:    "contact.name.family",
+			optional: []int32{0},
+			want:     `null`,
+		},
+		{
+			name:  "field of a null",
+			field: "deceased.value",
+			want:  `null`,
+		},
+		{
+			name:  "existing fields",
+			field: "identifier[0].value",
+			want:  `"123"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pctx := types.NewContext(types.NewRegistry())
+			pctx.StrictSourcePaths = true
+			src := &mappb.ValueSource_InputSource{Arg: 1, Field: test.field, OptionalSegment: test.optional}
+			got, err := mapping.EvaluateArgSource(src, []jsonutil.JSONMetaNode{patient}, pctx)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("EvaluateArgSource(%q) returned error %v, want error containing %q", test.field, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EvaluateArgSource(%q) returned unexpected error %v", test.field, err)
+			}
+			tkn, err := jsonutil.NodeToToken(got)
+			if err != nil {
+				t.Fatalf("NodeToToken returned unexpected error %v", err)
+			}
+			if diff := cmp.Diff(test.want, jsonutil.MarshalJSON(tkn)); diff != "" {
+				t.Errorf("EvaluateArgSource(%q) returned diff (-want +got):\n%s", test.field, diff)
+			}
+		})
+	}
+}
+
 func mustGetNodeField(t *testing.T, root jsonutil.JSONMetaNode, path string) jsonutil.JSONMetaNode {
 	n, err := jsonutil.GetNodeField(root, path)
 	if err != nil {
@@ -0,0 +1,192 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/mapping" /* copybara-comment: mapping */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/projector" /* copybara-comment: projector */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types/register_all" /* copybara-comment: registerall */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+func fromArg(field string) *mappb.ValueSource {
+	return &mappb.ValueSource{Source: &mappb.ValueSource_FromInput{FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: field}}}
+}
+
+// keyed returns a mapping of the given source to the given field, whose first [] is keyed by the
+// given key.
+func keyed(target string, key, vs *mappb.ValueSource) *mappb.FieldMapping {
+	return &mappb.FieldMapping{ValueSource: vs, TargetKey: key, Target: &mappb.FieldMapping_TargetField{TargetField: target}}
+}
+
+// keyedRoot is keyed for root fields.
+func keyedRoot(target string, key, vs *mappb.ValueSource) *mappb.FieldMapping {
+	return &mappb.FieldMapping{ValueSource: vs, TargetKey: key, Target: &mappb.FieldMapping_TargetRootField{TargetRootField: target}}
+}
+
+func TestWhistlerProcessMappings_KeyedAppends(t *testing.T) {
+	// The codes and severities of the allergies are written by different projectors, in a different
+	// order.
+	projectors := []*mappb.ProjectorDefinition{
+		{
+			Name:    "AllergyCode",
+			Mapping: []*mappb.FieldMapping{keyedRoot("allergy[].code", fromArg("id"), fromArg("code"))},
+		},
+		{
+			Name:    "AllergySeverity",
+			Mapping: []*mappb.FieldMapping{keyedRoot("allergy[].reaction[0].severity", fromArg("allergy"), fromArg("severity"))},
+		},
+		{
+			Name: "Entries",
+			Mapping: []*mappb.FieldMapping{
+				keyed("entry[].a", constStr("x"), constStr("1")),
+				keyed("entry[]", constStr("y"), constStr("2")),
+				keyed("entry[].b", constStr("x"), constStr("3")),
+				keyed("entry[].c", call("$StrCat", constStr("x")), constStr("4")),
+			},
+		},
+	}
+	maps := []*mappb.FieldMapping{
+		{
+			ValueSource: &mappb.ValueSource{Source: fromArg("allergies[]").Source, Projector: "AllergyCode[]"},
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "codes"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{Source: fromArg("reactions[]").Source, Projector: "AllergySeverity[]"},
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "severities"},
+		},
+		keyed("allergy[].note", constStr("a1"), constStr("checked")),
+		field("bundle", call("Entries")),
+	}
+
+	pctx := types.NewContext(types.NewRegistry())
+	pctx.Variables.Push()
+	if err := registerall.RegisterAll(pctx.Registry); err != nil {
+		t.Fatalf("RegisterAll returned unexpected error %v", err)
+	}
+	w := mapping.NewWhistler()
+	for _, p := range projectors {
+		if err := pctx.Registry.RegisterProjector(p.Name, projector.FromDef(p, w)); err != nil {
+			t.Fatalf("RegisterProjector(%q) returned unexpected error %v", p.Name, err)
+		}
+	}
+
+	in := `{
+		"allergies": [{"id": "a1", "code": "peanut"}, {"id": "a2", "code": "latex"}],
+		"reactions": [{"allergy": "a2", "severity": "severe"}, {"allergy": "a3", "severity": "mild"}, {"allergy": "a1", "severity": "moderate"}]
+	}`
+	var output jsonutil.JSONToken
+	pctx.Output = &output
+	args := toNodes(t, []jsonutil.JSONToken{mustParseContainer(json.RawMessage(in), t)})
+	if err := w.ProcessMappings(maps, "", args, &output, pctx); err != nil {
+		t.Fatalf("ProcessMappings returned unexpected error %v", err)
+	}
+
+	want := jsonutil.JSONToken(mustParseContainer(json.RawMessage(`{
+		"allergy": [
+			{"code": "peanut", "reaction": [{"severity": "moderate"}], "note": "checked"},
+			{"code": "latex", "reaction": [{"severity": "severe"}]},
+			{"reaction": [{"severity": "mild"}]}
+		],
+		"bundle": {"entry": [{"a": "1", "b": "3", "c": "4"}, "2"]}
+	}`), t))
+	if diff := cmp.Diff(want, output); diff != "" {
+		t.Errorf("ProcessMappings returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWhistlerProcessMappings_KeyedAppendErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		maps    []*mappb.FieldMapping
+		wantErr string
+	}{
+		{
+			name: "same field twice",
+			maps: []*mappb.FieldMapping{
+				keyed("entry[].a", constStr("x"), constStr("1")),
+				keyed("entry[].a", constStr("x"), constStr("2")),
+			},
+			wantErr: `could not write field "entry[0].a"`,
+		},
+		{
+			name:    "null key",
+			maps:    []*mappb.FieldMapping{keyed("entry[].a", fromArg("missing"), constStr("1"))},
+			wantErr: "the key of keyed append to entry[].a is null",
+		},
+		{
+			name:    "no array",
+			maps:    []*mappb.FieldMapping{keyed("entry.a", constStr("x"), constStr("1"))},
+			wantErr: "keyed append target entry.a has no array to append to",
+		},
+		{
+			name: "iterated source",
+			maps: []*mappb.FieldMapping{
+				{ValueSource: fromArg("items[]"), TargetKey: constStr("x"), Target: &mappb.FieldMapping_TargetField{TargetField: "entry[]"}},
+			},
+			wantErr: "can not be written with an iterated source",
+		},
+		{
+			name: "variable",
+			maps: []*mappb.FieldMapping{
+				{ValueSource: constStr("1"), TargetKey: constStr("x"), Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "v[]"}},
+			},
+			wantErr: "keyed appends can only target fields and root fields, not var v[]",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pctx := types.NewContext(types.NewRegistry())
+			pctx.Variables.Push()
+
+			var output jsonutil.JSONToken
+			pctx.Output = &output
+			args := toNodes(t, []jsonutil.JSONToken{mustParseContainer(json.RawMessage(`{"items": [1, 2]}`), t)})
+			err := mapping.NewWhistler().ProcessMappings(test.maps, "", args, &output, pctx)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ProcessMappings returned error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestContext_UnwindKeyedElements(t *testing.T) {
+	pctx := types.NewContext(types.NewRegistry())
+	var output jsonutil.JSONToken
+
+	pctx.RecordKeyedElement(&output, "entry", `"x"`, 0)
+	m := pctx.Mark()
+	pctx.RecordKeyedElement(&output, "entry", `"y"`, 1)
+	pctx.RecordKeyedElement(&output, "allergy", `"x"`, 0)
+	pctx.Unwind(m)
+
+	if i, ok := pctx.KeyedElement(&output, "entry", `"x"`); !ok || i != 0 {
+		t.Errorf("KeyedElement(entry, x) after Unwind = %d, %v, want 0, true", i, ok)
+	}
+	for _, k := range []struct{ path, key string }{{"entry", `"y"`}, {"allergy", `"x"`}} {
+		if i, ok := pctx.KeyedElement(&output, k.path, k.key); ok {
+			t.Errorf("KeyedElement(%s, %s) after Unwind = %d, want none", k.path, k.key, i)
+		}
+	}
+}
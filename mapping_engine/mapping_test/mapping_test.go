@@ -16,6 +16,7 @@ package mapping_test
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
@@ -645,6 +646,46 @@ func TestWhistlerEvaluateMapping(t *testing.T) {
 			},
 			wantOk: false,
 		},
+		{
+			name: "required with false condition",
+			mapping: &mappb.FieldMapping{
+				Condition: &mappb.ValueSource{
+					Source: &mappb.ValueSource_ConstBool{
+						ConstBool: false,
+					},
+				},
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_ConstString{
+						ConstString: "",
+					},
+				},
+				Target: &mappb.FieldMapping_TargetField{
+					TargetField: "foo",
+				},
+				Required: true,
+			},
+			wantOk: false,
+		},
+		{
+			name: "required iterated source",
+			mapping: &mappb.FieldMapping{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_FromInput{
+						FromInput: &mappb.ValueSource_InputSource{
+							Arg:   1,
+							Field: "ids[]",
+						},
+					},
+				},
+				Target: &mappb.FieldMapping_TargetField{
+					TargetField: "",
+				},
+				Required: true,
+			},
+			args:   []jsonutil.JSONToken{mustParseContainer(json.RawMessage(`{"ids": ["a", "b"]}`), t)},
+			want:   mustParseArray(json.RawMessage(`["a", "b"]`), t),
+			wantOk: true,
+		},
 		{
 			name: "non-bool condition: non-empty string",
 			mapping: &mappb.FieldMapping{
@@ -901,6 +942,26 @@ func TestWhistlerEvaluateMapping(t *testing.T) {
 			wantOk:  true,
 			wantTLO: "Foo",
 		},
+		{
+			name: "dynamic top level target",
+			mapping: &mappb.FieldMapping{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_ConstString{
+						ConstString: "foo",
+					},
+				},
+				Target: &mappb.FieldMapping_TargetDynamicObject{
+					TargetDynamicObject: &mappb.ValueSource{
+						Source: &mappb.ValueSource_ConstString{
+							ConstString: "Foo",
+						},
+					},
+				},
+			},
+			want:    jsonutil.JSONArr{jsonutil.JSONStr("foo")},
+			wantOk:  true,
+			wantTLO: "Foo",
+		},
 		{
 			name: "root field target",
 			mapping: &mappb.FieldMapping{
@@ -1414,6 +1475,93 @@ func TestWhistlerEvaluateMappingErrors(t *testing.T) {
 			},
 			argOutput: mustParseContainer(json.RawMessage(`{"bar": ["hi"]}`), t),
 		},
+		{
+			name: "required empty source",
+			mapping: &mappb.FieldMapping{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_FromInput{
+						FromInput: &mappb.ValueSource_InputSource{
+							Arg:   1,
+							Field: "missing",
+						},
+					},
+				},
+				Target: &mappb.FieldMapping_TargetField{
+					TargetField: "identifier[0].value",
+				},
+				Required: true,
+			},
+			args: []jsonutil.JSONToken{mustParseContainer(json.RawMessage(`{"id": "a"}`), t)},
+		},
+		{
+			name: "required iterated source with empty element",
+			mapping: &mappb.FieldMapping{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_FromInput{
+						FromInput: &mappb.ValueSource_InputSource{
+							Arg:   1,
+							Field: "ids[]",
+						},
+					},
+				},
+				Target: &mappb.FieldMapping_TargetField{
+					TargetField: "identifier[]",
+				},
+				Required: true,
+			},
+			args: []jsonutil.JSONToken{mustParseContainer(json.RawMessage(`{"ids": ["a", ""]}`), t)},
+		},
+		{
+			name: "dynamic top level target empty",
+			mapping: &mappb.FieldMapping{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_ConstString{
+						ConstString: "foo",
+					},
+				},
+				Target: &mappb.FieldMapping_TargetDynamicObject{
+					TargetDynamicObject: &mappb.ValueSource{
+						Source: &mappb.ValueSource_ConstString{
+							ConstString: "",
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "dynamic top level target path",
+			mapping: &mappb.FieldMapping{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_ConstString{
+						ConstString: "foo",
+					},
+				},
+				Target: &mappb.FieldMapping_TargetDynamicObject{
+					TargetDynamicObject: &mappb.ValueSource{
+						Source: &mappb.ValueSource_ConstString{
+							ConstString: "Foo.bar",
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "dynamic top level target not a string",
+			mapping: &mappb.FieldMapping{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_ConstString{
+						ConstString: "foo",
+					},
+				},
+				Target: &mappb.FieldMapping_TargetDynamicObject{
+					TargetDynamicObject: &mappb.ValueSource{
+						Source: &mappb.ValueSource_ConstInt{
+							ConstInt: 1,
+						},
+					},
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -1427,3 +1575,479 @@ func TestWhistlerEvaluateMappingErrors(t *testing.T) {
 		})
 	}
 }
+
+type mappingRecord struct {
+	Projector string
+	Index     int
+	Target    string
+	Empty     bool
+}
+
+type fakeMappingStats struct {
+	records []mappingRecord
+}
+
+func (f *fakeMappingStats) RecordMapping(projector string, index int, target string, empty bool) {
+	f.records = append(f.records, mappingRecord{projector, index, target, empty})
+}
+
+func TestWhistlerProcessMappings_Stats(t *testing.T) {
+	fromInput := func(field string) *mappb.ValueSource {
+		return &mappb.ValueSource{
+			Source: &mappb.ValueSource_FromInput{
+				FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: field},
+			},
+		}
+	}
+	maps := []*mappb.FieldMapping{
+		{
+			ValueSource: fromInput("name"),
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "name"},
+		},
+		{
+			ValueSource: fromInput("birthDate"),
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "birthDate"},
+		},
+		{
+			ValueSource: fromInput("name"),
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "skipped"},
+			Condition:   &mappb.ValueSource{Source: &mappb.ValueSource_ConstBool{ConstBool: false}},
+		},
+		{
+			ValueSource: fromInput("address"),
+			Target:      &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "addr"},
+		},
+		{
+			ValueSource: fromInput("tags"),
+			Target:      &mappb.FieldMapping_TargetRootField{TargetRootField: "tags"},
+		},
+	}
+
+	pctx := types.NewContext(types.NewRegistry())
+	pctx.Variables.Push()
+	stats := &fakeMappingStats{}
+	pctx.MappingStats = stats
+
+	var output jsonutil.JSONToken
+	args := toNodes(t, []jsonutil.JSONToken{mustParseContainer(json.RawMessage(`{"name": "Jane", "tags": []}`), t)})
+	if err := mapping.NewWhistler().ProcessMappings(maps, "Patient", args, &output, pctx); err != nil {
+		t.Fatalf("ProcessMappings returned unexpected error %v", err)
+	}
+
+	want := []mappingRecord{
+		{Projector: "Patient", Index: 0, Target: "name", Empty: false},
+		{Projector: "Patient", Index: 1, Target: "birthDate", Empty: true},
+		{Projector: "Patient", Index: 3, Target: "var addr", Empty: true},
+		{Projector: "Patient", Index: 4, Target: "root tags", Empty: true},
+	}
+	if diff := cmp.Diff(want, stats.records); diff != "" {
+		t.Errorf("ProcessMappings recorded %v, want %v\ndiff %s", stats.records, want, diff)
+	}
+}
+
+func TestWhistlerProcessMappings_OutputBudget(t *testing.T) {
+	fromInput := &mappb.ValueSource{
+		Source: &mappb.ValueSource_FromInput{
+			FromInput: &mappb.ValueSource_InputSource{Arg: 1},
+		},
+	}
+	tests := []struct {
+		name       string
+		target     *mappb.FieldMapping
+		in         string
+		budget     *types.OutputBudget
+		wantWrites int
+		wantErr    string
+	}{
+		{
+			name:       "runaway field append",
+			target:     &mappb.FieldMapping{Target: &mappb.FieldMapping_TargetField{TargetField: "items[]"}},
+			in:         `"a"`,
+			budget:     types.NewOutputBudget(0, 5),
+			wantWrites: 6,
+			wantErr:    "items[]",
+		},
+		{
+			name:       "runaway var append",
+			target:     &mappb.FieldMapping{Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "acc[]"}},
+			in:         `"a"`,
+			budget:     types.NewOutputBudget(0, 5),
+			wantWrites: 6,
+			wantErr:    "var acc[]",
+		},
+		{
+			name:       "runaway output objects",
+			target:     &mappb.FieldMapping{Target: &mappb.FieldMapping_TargetObject{TargetObject: "Patient"}},
+			in:         `{"name": "a"}`,
+			budget:     types.NewOutputBudget(0, 5),
+			wantWrites: 6,
+			wantErr:    "out Patient",
+		},
+		{
+			name:       "token budget",
+			target:     &mappb.FieldMapping{Target: &mappb.FieldMapping_TargetRootField{TargetRootField: "items[]"}},
+			in:         `{"name": "a", "tags": ["b", "c"]}`,
+			budget:     types.NewOutputBudget(20, 0),
+			wantWrites: 5, // 5 tokens per write.
+			wantErr:    "root items[]",
+		},
+		{
+			name:       "long array",
+			target:     &mappb.FieldMapping{Target: &mappb.FieldMapping_TargetField{TargetField: "items"}},
+			in:         `[1, 2, 3, 4, 5, 6]`,
+			budget:     types.NewOutputBudget(0, 5),
+			wantWrites: 1,
+			wantErr:    "items",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := test.target
+			m.ValueSource = fromInput
+
+			pctx := types.NewContext(types.NewRegistry())
+			pctx.Variables.Push()
+			pctx.OutputBudget = test.budget
+
+			in, err := jsonutil.UnmarshalJSON(json.RawMessage(test.in))
+			if err != nil {
+				t.Fatalf("UnmarshalJSON(%s) returned unexpected error %v", test.in, err)
+			}
+			args := toNodes(t, []jsonutil.JSONToken{in})
+
+			// Simulates an unbounded iteration, which must be stopped by the budget.
+			var output jsonutil.JSONToken
+			writes := 0
+			for err == nil && writes < 1000000 {
+				writes++
+				err = mapping.NewWhistler().ProcessMappings([]*mappb.FieldMapping{m}, "Runaway", args, &output, pctx)
+			}
+			if err == nil || !strings.Contains(err.Error(), "output budget exceeded") || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("ProcessMappings returned error %v, want an output budget error naming %q", err, test.wantErr)
+			}
+			if writes != test.wantWrites {
+				t.Errorf("ProcessMappings failed after %d writes, want %d", writes, test.wantWrites)
+			}
+		})
+	}
+}
+
+func TestWhistlerProcessMappings_NoOutputBudget(t *testing.T) {
+	m := &mappb.FieldMapping{
+		ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: "a"}},
+		Target:      &mappb.FieldMapping_TargetField{TargetField: "items[]"},
+	}
+	pctx := types.NewContext(types.NewRegistry())
+	pctx.Variables.Push()
+
+	var output jsonutil.JSONToken
+	for i := 0; i < 100; i++ {
+		if err := mapping.NewWhistler().ProcessMappings([]*mappb.FieldMapping{m}, "Patient", nil, &output, pctx); err != nil {
+			t.Fatalf("ProcessMappings returned unexpected error %v", err)
+		}
+	}
+}
+
+func TestWhistlerProcessMappings_Globals(t *testing.T) {
+	fromGlobal := func(accessor string) *mappb.ValueSource {
+		return &mappb.ValueSource{Source: &mappb.ValueSource_FromGlobal{FromGlobal: accessor}}
+	}
+	maps := []*mappb.FieldMapping{
+		{
+			ValueSource: &mappb.ValueSource{
+				Source: &mappb.ValueSource_FromInput{
+					FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "patient"},
+				},
+			},
+			Target: &mappb.FieldMapping_TargetGlobal{TargetGlobal: "patient"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{
+				Source: &mappb.ValueSource_FromInput{
+					FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "missing"},
+				},
+			},
+			Target: &mappb.FieldMapping_TargetGlobal{TargetGlobal: "missing"},
+		},
+		{
+			ValueSource: fromGlobal("patient.id"),
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "Encounter.subject"},
+		},
+		{
+			ValueSource: fromGlobal("patient"),
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "Observation.patient"},
+		},
+		{
+			ValueSource: fromGlobal("missing"),
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "Observation.missing"},
+		},
+	}
+
+	records := []struct {
+		in, want string
+	}{
+		{in: `{"patient": {"id": "1"}}`, want: `{"Encounter": {"subject": "1"}, "Observation": {"patient": {"id": "1"}}}`},
+		{in: `{"patient": {"id": "2"}}`, want: `{"Encounter": {"subject": "2"}, "Observation": {"patient": {"id": "2"}}}`},
+	}
+	for _, r := range records {
+		// Each record is evaluated with its own context, so its globals are its own.
+		pctx := types.NewContext(types.NewRegistry())
+		pctx.Variables.Push()
+
+		var output jsonutil.JSONToken
+		args := toNodes(t, []jsonutil.JSONToken{mustParseContainer(json.RawMessage(r.in), t)})
+		if err := mapping.NewWhistler().ProcessMappings(maps, "", args, &output, pctx); err != nil {
+			t.Fatalf("ProcessMappings(%s) returned unexpected error %v", r.in, err)
+		}
+
+		want := jsonutil.JSONToken(mustParseContainer(json.RawMessage(r.want), t))
+		if diff := cmp.Diff(want, output); diff != "" {
+			t.Errorf("ProcessMappings(%s) returned diff (-want +got):\n%s", r.in, diff)
+		}
+	}
+}
+
+func TestWhistlerProcessMappings_GlobalErrors(t *testing.T) {
+	assign := &mappb.FieldMapping{
+		ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: "1"}},
+		Target:      &mappb.FieldMapping_TargetGlobal{TargetGlobal: "id"},
+	}
+	read := &mappb.FieldMapping{
+		ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_FromGlobal{FromGlobal: "id"}},
+		Target:      &mappb.FieldMapping_TargetField{TargetField: "id"},
+	}
+	tests := []struct {
+		name    string
+		maps    []*mappb.FieldMapping
+		wantErr string
+	}{
+		{
+			name:    "read before assigned",
+			maps:    []*mappb.FieldMapping{read, assign},
+			wantErr: "global id is read before it is assigned",
+		},
+		{
+			name:    "assigned twice",
+			maps:    []*mappb.FieldMapping{assign, read, assign},
+			wantErr: "global id is already assigned",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pctx := types.NewContext(types.NewRegistry())
+			pctx.Variables.Push()
+
+			var output jsonutil.JSONToken
+			err := mapping.NewWhistler().ProcessMappings(test.maps, "", nil, &output, pctx)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ProcessMappings returned error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestWhistlerProcessMappingsPartially(t *testing.T) {
+	// Coverage writes an output object, and then fails.
+	coverage := &mappb.ProjectorDefinition{
+		Name: "Coverage",
+		Mapping: []*mappb.FieldMapping{
+			{
+				ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: "c"}},
+				Target:      &mappb.FieldMapping_TargetObject{TargetObject: "Coverage"},
+			},
+			{
+				ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_FromGlobal{FromGlobal: "missing"}},
+				Target:      &mappb.FieldMapping_TargetField{TargetField: "payor"},
+			},
+		},
+	}
+	maps := []*mappb.FieldMapping{
+		{
+			ValueSource: &mappb.ValueSource{
+				Source: &mappb.ValueSource_FromInput{
+					FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "patient"},
+				},
+			},
+			Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "patient"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{Projector: "Coverage"},
+			Target:      &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "coverage"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_FromLocalVar{FromLocalVar: "patient.id"}},
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "Patient.id"},
+		},
+		{
+			// Reads the var of the failed mapping, so it fails too.
+			ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_FromLocalVar{FromLocalVar: "coverage"}},
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "Claim.coverage"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: "e"}},
+			Target:      &mappb.FieldMapping_TargetObject{TargetObject: "Encounter"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{Projector: "Coverage"},
+			Target:      &mappb.FieldMapping_TargetGlobal{TargetGlobal: "payor"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_FromGlobal{FromGlobal: "payor"}},
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "Claim.payor"},
+		},
+	}
+
+	pctx := types.NewContext(types.NewRegistry())
+	pctx.Variables.Push()
+	w := mapping.NewWhistler()
+	if err := pctx.Registry.RegisterProjector(coverage.Name, projector.FromDef(coverage, w)); err != nil {
+		t.Fatalf("RegisterProjector(%q) returned unexpected error %v", coverage.Name, err)
+	}
+
+	var output jsonutil.JSONToken
+	args := toNodes(t, []jsonutil.JSONToken{mustParseContainer(json.RawMessage(`{"patient": {"id": "1"}}`), t)})
+	errs := w.(mapping.PartialEngine).ProcessMappingsPartially(maps, "", args, &output, pctx)
+
+	want := jsonutil.JSONToken(mustParseContainer(json.RawMessage(`{"Patient": {"id": "1"}}`), t))
+	if diff := cmp.Diff(want, output); diff != "" {
+		t.Errorf("ProcessMappingsPartially returned output diff (-want +got):\n%s", diff)
+	}
+	wantTLOs := map[string][]jsonutil.JSONToken{"Encounter": {jsonutil.JSONStr("e")}}
+	if diff := cmp.Diff(wantTLOs, pctx.TopLevelObjects); diff != "" {
+		t.Errorf("ProcessMappingsPartially returned top level objects diff (-want +got):\n%s", diff)
+	}
+
+	type mappingError struct {
+		index  int
+		target string
+		errStr string
+	}
+	wantErrs := []mappingError{
+		{index: 1, target: "var coverage", errStr: "global missing is read before it is assigned"},
+		{index: 3, target: "Claim.coverage", errStr: "var coverage is not assigned because the root mapping assigning it failed"},
+		{index: 5, target: "$global.payor", errStr: "global missing is read before it is assigned"},
+		{index: 6, target: "Claim.payor", errStr: "global payor is not assigned because the root mapping assigning it failed"},
+	}
+	if len(errs) != len(wantErrs) {
+		t.Fatalf("ProcessMappingsPartially returned errors %v, want %d errors", errs, len(wantErrs))
+	}
+	for i, want := range wantErrs {
+		got := errs[i]
+		if got.Index != want.index || got.Target != want.target || !strings.Contains(got.Error(), want.errStr) {
+			t.Errorf("ProcessMappingsPartially returned error %d: %d %q %v, want %d %q with error containing %q", i, got.Index, got.Target, got.Err, want.index, want.target, want.errStr)
+		}
+	}
+}
+
+func TestWhistlerLineage(t *testing.T) {
+	name := &mappb.ProjectorDefinition{
+		Name: "Name",
+		Mapping: []*mappb.FieldMapping{
+			{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_FromInput{
+						FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "given"},
+					},
+				},
+				Target: &mappb.FieldMapping_TargetField{TargetField: "given"},
+			},
+			{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_FromInput{
+						FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "family"},
+					},
+					Projector: "$ToUpper",
+				},
+				Target: &mappb.FieldMapping_TargetField{TargetField: "family"},
+			},
+			{
+				ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: "official"}},
+				Target:      &mappb.FieldMapping_TargetField{TargetField: "use"},
+			},
+		},
+	}
+	patient := &mappb.ProjectorDefinition{
+		Name: "Patient",
+		Mapping: []*mappb.FieldMapping{
+			{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_FromInput{
+						FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "id"},
+					},
+				},
+				Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "id"},
+			},
+			{
+				ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_FromLocalVar{FromLocalVar: "id"}},
+				Target:      &mappb.FieldMapping_TargetField{TargetField: "id"},
+			},
+			{
+				ValueSource: &mappb.ValueSource{
+					Source: &mappb.ValueSource_FromInput{
+						FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "name[]"},
+					},
+					Projector: "Name[]",
+				},
+				Target: &mappb.FieldMapping_TargetField{TargetField: "name"},
+			},
+		},
+	}
+	maps := []*mappb.FieldMapping{
+		{
+			ValueSource: &mappb.ValueSource{
+				Source: &mappb.ValueSource_FromInput{
+					FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "patient"},
+				},
+				Projector: "Patient",
+			},
+			Target: &mappb.FieldMapping_TargetObject{TargetObject: "Patient"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{
+				Source: &mappb.ValueSource_FromInput{
+					FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "patient.sex"},
+				},
+			},
+			Target: &mappb.FieldMapping_TargetField{TargetField: "meta.source"},
+		},
+		{
+			ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: "x"}},
+			Target:      &mappb.FieldMapping_TargetField{TargetField: "meta.constant"},
+		},
+	}
+
+	reg := types.NewRegistry()
+	registerall.RegisterAll(reg)
+	w := mapping.NewWhistler()
+	for _, p := range []*mappb.ProjectorDefinition{name, patient} {
+		if err := reg.RegisterProjector(p.Name, projector.FromDef(p, w)); err != nil {
+			t.Fatalf("RegisterProjector(%q) returned unexpected error %v", p.Name, err)
+		}
+	}
+	pctx := types.NewContext(reg)
+	pctx.Variables.Push()
+	pctx.Lineage = types.NewLineage()
+
+	in := mustParseContainer(json.RawMessage(`{
+		"patient": {
+			"id": "1",
+			"sex": "m",
+			"name": [{"given": "a", "family": "b"}, {"given": "c", "family": "d"}]
+		}
+	}`), t)
+	if err := w.ProcessMappings(maps, "", toNodes(t, []jsonutil.JSONToken{in}), pctx.Output, pctx); err != nil {
+		t.Fatalf("ProcessMappings returned unexpected error %v", err)
+	}
+
+	want := map[string][]string{
+		"meta.source":               {"patient.sex"},
+		"Patient[0].id":             {"patient.id"},
+		"Patient[0].name[0].given":  {"patient.name[0].given"},
+		"Patient[0].name[0].family": {"$ToUpper(patient.name[0].family)"},
+		"Patient[0].name[1].given":  {"patient.name[1].given"},
+		"Patient[0].name[1].family": {"$ToUpper(patient.name[1].family)"},
+	}
+	if diff := cmp.Diff(want, pctx.Lineage.Paths()); diff != "" {
+		t.Errorf("Lineage.Paths() returned diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping_test
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/mapping" /* copybara-comment: mapping */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// call returns a value source calling the given projector with the given arguments.
+func call(projector string, args ...*mappb.ValueSource) *mappb.ValueSource {
+	vs := &mappb.ValueSource{Projector: projector}
+	if len(args) > 0 {
+		vs.Source = &mappb.ValueSource_ProjectedValue{ProjectedValue: args[0]}
+		vs.AdditionalArg = args[1:]
+	}
+	return vs
+}
+
+func constStr(s string) *mappb.ValueSource {
+	return &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: s}}
+}
+
+func field(target string, vs *mappb.ValueSource) *mappb.FieldMapping {
+	return &mappb.FieldMapping{ValueSource: vs, Target: &mappb.FieldMapping_TargetField{TargetField: target}}
+}
+
+func TestCheckPurity(t *testing.T) {
+	tests := []struct {
+		name       string
+		projectors []*mappb.ProjectorDefinition
+		impure     map[string]bool
+		wantErr    string
+	}{
+		{
+			name: "pure",
+			projectors: []*mappb.ProjectorDefinition{
+				{
+					Name: "BuildName",
+					Pure: true,
+					Mapping: []*mappb.FieldMapping{
+						field("family", call("$ToUpper", constStr("doe"))),
+						{ValueSource: call("Given"), Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "given"}},
+						{ValueSource: constStr("x"), Target: &mappb.FieldMapping_TargetField{TargetField: "."}, Condition: call("$IsNotNil", constStr("y"))},
+					},
+				},
+				{
+					Name:    "Given",
+					Mapping: []*mappb.FieldMapping{field("given", constStr("john"))},
+				},
+			},
+		},
+		{
+			name: "recursive",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{field("b", call("B"))}},
+				{Name: "B", Mapping: []*mappb.FieldMapping{field("a", call("A"))}},
+			},
+		},
+		{
+			name: "writes to output object",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{{ValueSource: constStr("x"), Target: &mappb.FieldMapping_TargetObject{TargetObject: "Patient"}}}},
+			},
+			wantErr: "projector A is declared pure but writes to output object Patient",
+		},
+		{
+			name: "writes to root field",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{{ValueSource: constStr("x"), Target: &mappb.FieldMapping_TargetRootField{TargetRootField: "x"}}}},
+			},
+			wantErr: "projector A is declared pure but writes to root field x",
+		},
+		{
+			name: "calls impure builtin",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{field("id", call("$StrCat", constStr("x"), call("$UUID")))}},
+			},
+			wantErr: "projector A is declared pure but calls $UUID",
+		},
+		{
+			name: "calls impure builtin in condition",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{{ValueSource: constStr("x"), Target: &mappb.FieldMapping_TargetField{TargetField: "x"}, Condition: call("$CurrentTime")}}},
+			},
+			wantErr: "projector A is declared pure but calls $CurrentTime",
+		},
+		{
+			name: "calls impure builtin in post-condition",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{field("x", constStr("x"))}, Ensures: call("$Eq", constStr("x"), call("$UUID"))},
+			},
+			wantErr: "projector A is declared pure but calls $UUID",
+		},
+		{
+			name: "calls impure projector",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{field("x", call("FetchPatient[]", constStr("1")))}},
+			},
+			impure:  map[string]bool{"FetchPatient": true},
+			wantErr: "projector A is declared pure but calls FetchPatient",
+		},
+		{
+			name: "calls impure projector indirectly",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{field("b", call("B"))}},
+				{Name: "B", Mapping: []*mappb.FieldMapping{field("c", call("C"))}},
+				{Name: "C", Mapping: []*mappb.FieldMapping{{ValueSource: constStr("x"), Target: &mappb.FieldMapping_TargetGlobal{TargetGlobal: "g"}}}},
+			},
+			wantErr: "projector A is declared pure but calls B, which calls C, which writes to global g",
+		},
+		{
+			name: "passes impure projector by name",
+			projectors: []*mappb.ProjectorDefinition{
+				{Name: "A", Pure: true, Mapping: []*mappb.FieldMapping{field("b", call("$CallFn", constStr("B")))}},
+				{Name: "B", Mapping: []*mappb.FieldMapping{field("n", call("$Counter", constStr("n")))}},
+			},
+			wantErr: "projector A is declared pure but calls B, which calls $Counter",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := mapping.CheckPurity(test.projectors, test.impure)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("CheckPurity() returned unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("CheckPurity() returned error %v, want %q", err, test.wantErr)
+			}
+		})
+	}
+}
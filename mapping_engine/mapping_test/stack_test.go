@@ -0,0 +1,138 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/mapping" /* copybara-comment: mapping */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/projector" /* copybara-comment: projector */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types/register_all" /* copybara-comment: registerall */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+func TestWhistlerProcessMappings_IterationStack(t *testing.T) {
+	projectors := []*mappb.ProjectorDefinition{
+		{
+			Name: "Output_Observations",
+			Mapping: []*mappb.FieldMapping{
+				field("component", &mappb.ValueSource{Source: fromArg("obx[]").Source, Projector: "BuildComponent[]"}),
+			},
+		},
+		{
+			Name: "BuildComponent",
+			Mapping: []*mappb.FieldMapping{
+				field("value", &mappb.ValueSource{Source: fromArg("value").Source, Projector: "$ParseFloat"}),
+				field("part", &mappb.ValueSource{Source: fromArg("parts[]").Source, Projector: "BuildPart[]"}),
+			},
+		},
+		{
+			Name: "BuildPart",
+			Mapping: []*mappb.FieldMapping{
+				field("value", &mappb.ValueSource{Source: fromArg("value").Source, Projector: "$ParseFloat"}),
+			},
+		},
+	}
+	maps := []*mappb.FieldMapping{
+		field("observation", &mappb.ValueSource{Source: fromArg("").Source, Projector: "Output_Observations"}),
+	}
+
+	tests := []struct {
+		name      string
+		in        string
+		wantStack []string
+		wantErr   string
+	}{
+		{
+			name: "no error",
+			in:   `{"obx": [{"value": "1"}, {"value": "2", "parts": [{"value": "3"}]}]}`,
+		},
+		{
+			name:      "failing element",
+			in:        `{"obx": [{"value": "1"}, {"value": "2"}, {"value": "x"}, {"value": "4"}]}`,
+			wantStack: []string{"Output_Observations", "obx[2]", "BuildComponent", "$ParseFloat"},
+			wantErr:   `Iterated arguments "...obx.[2]" (element 2)`,
+		},
+		{
+			name:      "failing nested element",
+			in:        `{"obx": [{"value": "1"}, {"value": "2", "parts": [{"value": "3"}, {"value": "4"}, {"value": "5"}, {"value": "x"}]}]}`,
+			wantStack: []string{"Output_Observations", "obx[1]", "BuildComponent", "parts[3]", "BuildPart", "$ParseFloat"},
+			wantErr:   `Iterated arguments "obx[1].parts.[3]" (element 3)`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pctx := types.NewContext(types.NewRegistry())
+			pctx.Variables.Push()
+			if err := registerall.RegisterAll(pctx.Registry); err != nil {
+				t.Fatalf("RegisterAll returned unexpected error %v", err)
+			}
+			w := mapping.NewWhistler()
+			for _, p := range projectors {
+				if err := pctx.Registry.RegisterProjector(p.Name, projector.FromDef(p, w)); err != nil {
+					t.Fatalf("RegisterProjector(%q) returned unexpected error %v", p.Name, err)
+				}
+			}
+
+			var output jsonutil.JSONToken
+			pctx.Output = &output
+			args := toNodes(t, []jsonutil.JSONToken{mustParseContainer(json.RawMessage(test.in), t)})
+			err := w.ProcessMappings(maps, "", args, &output, pctx)
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("ProcessMappings returned unexpected error %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("ProcessMappings returned error %v, want %q", err, test.wantErr)
+			}
+			// A successful evaluation leaves nothing on the stack.
+			got, want := strings.Join(pctx.ProjectorStack(), " > "), strings.Join(test.wantStack, " > ")
+			if got != want {
+				t.Errorf("ProjectorStack() = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestContext_UnwindIterationFrames(t *testing.T) {
+	pctx := types.NewContext(types.NewRegistry())
+	if err := pctx.PushProjectorToStack("Output_Observations"); err != nil {
+		t.Fatalf("PushProjectorToStack returned unexpected error %v", err)
+	}
+	m := pctx.Mark()
+
+	pctx.PushIterationFrame("obx", 3)
+	if err := pctx.PushProjectorToStack("BuildComponent"); err != nil {
+		t.Fatalf("PushProjectorToStack returned unexpected error %v", err)
+	}
+	pctx.PushIterationFrame("parts", 0)
+	if got, want := pctx.Projector(), "BuildComponent"; got != want {
+		t.Errorf("Projector() = %q, want %q", got, want)
+	}
+
+	pctx.Unwind(m)
+	if diff := cmp.Diff([]string{"Output_Observations"}, pctx.ProjectorStack()); diff != "" {
+		t.Errorf("ProjectorStack() after Unwind returned diff (-want +got):\n%s", diff)
+	}
+	if got, want := pctx.Projector(), "Output_Observations"; got != want {
+		t.Errorf("Projector() after Unwind = %q, want %q", got, want)
+	}
+}
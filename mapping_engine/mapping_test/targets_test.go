@@ -0,0 +1,236 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapping_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/mapping" /* copybara-comment: mapping */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// targetTypesInput is the input of TestWhistlerProcessMappings_TargetTypes, whose fields are the
+// results written.
+const targetTypesInput = `{"str": "b", "num": 2, "bool": true, "arr": [3, 4], "obj": {"k": "v"}}`
+
+func mustParseToken(t *testing.T, j string) jsonutil.JSONToken {
+	t.Helper()
+	tok, err := jsonutil.UnmarshalJSON(json.RawMessage(j))
+	if err != nil {
+		t.Fatalf("UnmarshalJSON(%s) returned unexpected error %v", j, err)
+	}
+	return tok
+}
+
+func TestWhistlerProcessMappings_TargetTypes(t *testing.T) {
+	tests := []struct {
+		// target is written with the field of targetTypesInput named by result, in an output whose
+		// field t is existing (or does not exist if existing is empty).
+		target   string
+		existing string
+		result   string
+		lenient  bool
+		// want is the resulting value of t, or wantErr the error.
+		want    string
+		wantErr string
+	}{
+		// Fields merge into nothing, empty values, objects (with objects) and arrays (with arrays).
+		{target: "t", result: "str", want: `"b"`},
+		{target: "t", result: "num", want: `2`},
+		{target: "t", result: "bool", want: `true`},
+		{target: "t", result: "arr", want: `[3, 4]`},
+		{target: "t", result: "obj", want: `{"k": "v"}`},
+		{target: "t", existing: `"a"`, result: "str", wantErr: `t is the string "a", but a primitive can only be overwritten (with !) (the result is a string)`},
+		{target: "t", existing: `1`, result: "num", wantErr: `t is the number 1, but a primitive can only be overwritten (with !) (the result is a number)`},
+		{target: "t", existing: `false`, result: "bool", wantErr: `t is the boolean false, but a primitive can only be overwritten (with !) (the result is a boolean)`},
+		{target: "t", existing: `"a"`, result: "arr", wantErr: `t is the string "a", but a primitive can only be overwritten (with !) (the result is an array)`},
+		{target: "t", existing: `"a"`, result: "obj", wantErr: `t is the string "a", but a primitive can only be overwritten (with !) (the result is an object)`},
+		{target: "t", existing: `[1]`, result: "str", wantErr: `t is an array, but only an array result can be appended to it (use t[] to append the result as one element, or ! to overwrite it) (the result is a string)`},
+		{target: "t", existing: `[1]`, result: "arr", want: `[1, 3, 4]`},
+		{target: "t", existing: `[1]`, result: "obj", wantErr: `t is an array, but only an array result can be appended to it`},
+		{target: "t", existing: `{"j": "w"}`, result: "str", wantErr: `t is an object, but only an object result can be merged into it (use ! to overwrite it) (the result is a string)`},
+		{target: "t", existing: `{"j": "w"}`, result: "arr", wantErr: `t is an object, but only an object result can be merged into it`},
+		{target: "t", existing: `{"j": "w"}`, result: "obj", want: `{"j": "w", "k": "v"}`},
+		{target: "t", existing: `[]`, result: "str", want: `"b"`},
+		{target: "t", existing: `[]`, result: "obj", want: `{"k": "v"}`},
+		{target: "t", existing: `{}`, result: "str", want: `"b"`},
+		{target: "t", existing: `{}`, result: "arr", want: `[3, 4]`},
+
+		// Overwriting replaces anything.
+		{target: "t!", existing: `"a"`, result: "str", want: `"b"`},
+		{target: "t!", existing: `[1]`, result: "obj", want: `{"k": "v"}`},
+		{target: "t!", existing: `{"j": "w"}`, result: "arr", want: `[3, 4]`},
+
+		// Appending adds the elements of array results, and other results as one element.
+		{target: "t[]", result: "str", want: `["b"]`},
+		{target: "t[]", result: "arr", want: `[3, 4]`},
+		{target: "t[]", result: "obj", want: `[{"k": "v"}]`},
+		{target: "t[]", existing: `[1]`, result: "str", want: `[1, "b"]`},
+		{target: "t[]", existing: `[1]`, result: "arr", want: `[1, 3, 4]`},
+		{target: "t[]", existing: `[1]`, result: "obj", want: `[1, {"k": "v"}]`},
+		{target: "t[]", existing: `{}`, result: "str", want: `["b"]`},
+		{target: "t[]", existing: `"a"`, result: "str", wantErr: `t is the string "a", but writing an element into it needs an array (the result is a string)`},
+		{target: "t[]", existing: `{"j": "w"}`, result: "str", wantErr: `t is an object, but writing an element into it needs an array (the result is a string)`},
+		{target: "t[]", existing: `{"j": "w"}`, result: "str", lenient: true, wantErr: `t is an object, but writing an element into it needs an array`},
+
+		// Lenient appends wrap primitives.
+		{target: "t[]", existing: `"a"`, result: "str", lenient: true, want: `["a", "b"]`},
+		{target: "t[]", existing: `1`, result: "arr", lenient: true, want: `[1, 3, 4]`},
+		{target: "t[]", existing: `true`, result: "obj", lenient: true, want: `[true, {"k": "v"}]`},
+		{target: "t[].f", existing: `"a"`, result: "str", lenient: true, want: `["a", {"f": "b"}]`},
+		{target: "t[0]", existing: `"a"`, result: "str", lenient: true, wantErr: `t is the string "a", but writing an element into it needs an array`},
+
+		// Elements follow the rules of fields.
+		{target: "t[1]", existing: `[1]`, result: "str", want: `[1, "b"]`},
+		{target: "t[0]", existing: `[1]`, result: "str", wantErr: `t[0] is the number 1, but a primitive can only be overwritten (with !) (the result is a string)`},
+		{target: "t[0]", existing: `[{"j": "w"}]`, result: "obj", want: `[{"j": "w", "k": "v"}]`},
+		{target: "t[0]", existing: `{"j": "w"}`, result: "str", wantErr: `t is an object, but writing an element into it needs an array (the result is a string)`},
+
+		// Fields need objects along their paths.
+		{target: "t.f", existing: `{"j": "w"}`, result: "str", want: `{"j": "w", "f": "b"}`},
+		{target: "t.f", existing: `[]`, result: "str", want: `{"f": "b"}`},
+		{target: "t.f", existing: `"a"`, result: "str", wantErr: `t is the string "a", but writing a field into it needs an object (the result is a string)`},
+		{target: "t.f", existing: `[1]`, result: "str", wantErr: `t is an array, but writing a field into it needs an object (use t[].f to append one) (the result is a string)`},
+		{target: "t[0].f.g", existing: `[{"f": 1}]`, result: "arr", wantErr: `t[0].f is the number 1, but writing a field into it needs an object (the result is an array)`},
+		{target: "t.f!", existing: `{"f": [1]}`, result: "str", want: `{"f": "b"}`},
+	}
+	for _, test := range tests {
+		name := test.target + " " + test.existing + " " + test.result
+		if test.lenient {
+			name += " lenient"
+		}
+		t.Run(name, func(t *testing.T) {
+			pctx := types.NewContext(types.NewRegistry())
+			pctx.Variables.Push()
+			pctx.LenientAppend = test.lenient
+
+			output := jsonutil.JSONToken(jsonutil.JSONContainer{})
+			if test.existing != "" {
+				existing := mustParseToken(t, test.existing)
+				output = jsonutil.JSONContainer{"t": &existing}
+			}
+			pctx.Output = &output
+
+			args := toNodes(t, []jsonutil.JSONToken{mustParseToken(t, targetTypesInput)})
+			maps := []*mappb.FieldMapping{field(test.target, fromArg(test.result))}
+			err := mapping.NewWhistler().ProcessMappings(maps, "", args, &output, pctx)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ProcessMappings returned error %v, want %q", err, test.wantErr)
+				}
+				if want := `could not write field "` + test.target + `"`; !strings.Contains(err.Error(), want) {
+					t.Errorf("ProcessMappings returned error %v, want it to name the target with %q", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessMappings returned unexpected error %v", err)
+			}
+
+			got, err := jsonutil.GetField(output, "t")
+			if err != nil {
+				t.Fatalf("GetField(t) returned unexpected error %v", err)
+			}
+			if diff := cmp.Diff(mustParseToken(t, test.want), got); diff != "" {
+				t.Errorf("ProcessMappings wrote diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWhistlerProcessMappings_TargetTypesOfOtherTargets(t *testing.T) {
+	tests := []struct {
+		name    string
+		maps    []*mappb.FieldMapping
+		lenient bool
+		want    string
+		wantErr string
+	}{
+		{
+			name: "this",
+			maps: []*mappb.FieldMapping{
+				field("a", fromArg("str")),
+				{ValueSource: fromArg("arr")},
+			},
+			wantErr: "could not write to this: $this is an object, but only an object result can be merged into it",
+		},
+		{
+			name: "var",
+			maps: []*mappb.FieldMapping{
+				{ValueSource: fromArg("str"), Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "v"}},
+				{ValueSource: fromArg("str"), Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "v[]"}},
+			},
+			wantErr: `could not write var "v[]": v is the string "b", but writing an element into it needs an array`,
+		},
+		{
+			name: "lenient var",
+			maps: []*mappb.FieldMapping{
+				{ValueSource: fromArg("str"), Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "v"}},
+				{ValueSource: fromArg("num"), Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "v[]"}},
+				field("out", &mappb.ValueSource{Source: &mappb.ValueSource_FromLocalVar{FromLocalVar: "v"}}),
+			},
+			lenient: true,
+			want:    `{"out": ["b", 2]}`,
+		},
+		{
+			name: "variables are overwritten",
+			maps: []*mappb.FieldMapping{
+				{ValueSource: fromArg("obj"), Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "v"}},
+				{ValueSource: fromArg("arr"), Target: &mappb.FieldMapping_TargetLocalVar{TargetLocalVar: "v"}},
+				field("out", &mappb.ValueSource{Source: &mappb.ValueSource_FromLocalVar{FromLocalVar: "v"}}),
+			},
+			want: `{"out": [3, 4]}`,
+		},
+		{
+			name: "root field",
+			maps: []*mappb.FieldMapping{
+				{ValueSource: fromArg("obj"), Target: &mappb.FieldMapping_TargetRootField{TargetRootField: "r"}},
+				{ValueSource: fromArg("str"), Target: &mappb.FieldMapping_TargetRootField{TargetRootField: "r[]"}},
+			},
+			wantErr: `could not write root field "r[]": r is an object, but writing an element into it needs an array`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pctx := types.NewContext(types.NewRegistry())
+			pctx.Variables.Push()
+			pctx.LenientAppend = test.lenient
+
+			var output jsonutil.JSONToken
+			pctx.Output = &output
+			args := toNodes(t, []jsonutil.JSONToken{mustParseToken(t, targetTypesInput)})
+			err := mapping.NewWhistler().ProcessMappings(test.maps, "", args, &output, pctx)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Errorf("ProcessMappings returned error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessMappings returned unexpected error %v", err)
+			}
+			if diff := cmp.Diff(mustParseToken(t, test.want), output); diff != "" {
+				t.Errorf("ProcessMappings returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -34,20 +34,32 @@ const (
 
 // Process handles post processing logic for the mapping library.
 func Process(pctx *types.Context, config *mappb.MappingConfig, skipBundling bool, e mapping.Engine) (jsonutil.JSONToken, error) {
+	return ProcessPartial(pctx, config, skipBundling, e, nil)
+}
+
+// ProcessPartial is Process for the output of root mappings that were processed partially (see
+// mapping.PartialEngine), with the given errors of the root mappings that failed.
+// If the post process projector takes two arguments, it is passed the errors as the second one, so
+// that it can tell which targets are missing: an array with the mapping (index), target and message
+// of each error. Process passes an empty array.
+func ProcessPartial(pctx *types.Context, config *mappb.MappingConfig, skipBundling bool, e mapping.Engine, mappingErrors []mapping.MappingError) (jsonutil.JSONToken, error) {
 	var result jsonutil.JSONToken
 
 	errLocation := errors.FnLocationf("Post Processing")
 
 	var p types.Projector
+	var arity int
 	switch proj := config.PostProcess.(type) {
 	case *mappb.MappingConfig_PostProcessProjectorDefinition:
 		p = projector.FromDef(proj.PostProcessProjectorDefinition, e)
+		arity = int(proj.PostProcessProjectorDefinition.ArgCount)
 	case *mappb.MappingConfig_PostProcessProjectorName:
 		fp, err := pctx.Registry.FindProjector(proj.PostProcessProjectorName)
 		if err != nil {
 			return nil, errors.Wrap(errLocation, fmt.Errorf("post_process projector %v not found", proj.PostProcessProjectorName))
 		}
 		p = fp
+		arity, _ = pctx.Registry.Arity(proj.PostProcessProjectorName)
 	}
 
 	result = *pctx.Output
@@ -62,7 +74,15 @@ func Process(pctx *types.Context, config *mappb.MappingConfig, skipBundling bool
 		if err != nil {
 			return nil, errors.Wrap(errLocation, err)
 		}
-		res, err := p([]jsonutil.JSONMetaNode{jmn}, pctx)
+		args := []jsonutil.JSONMetaNode{jmn}
+		if arity == 2 {
+			errs, err := jsonutil.TokenToNode(mappingErrorsToken(mappingErrors))
+			if err != nil {
+				return nil, errors.Wrap(errLocation, err)
+			}
+			args = append(args, errs)
+		}
+		res, err := p(args, pctx)
 		if err != nil {
 			return nil, errors.Wrap(errLocation, err)
 		}
@@ -72,6 +92,23 @@ func Process(pctx *types.Context, config *mappb.MappingConfig, skipBundling bool
 	return result, nil
 }
 
+// mappingErrorsToken converts the given errors of root mappings into an array of objects with the
+// mapping (index), target and message of each.
+func mappingErrorsToken(mappingErrors []mapping.MappingError) jsonutil.JSONToken {
+	arr := make(jsonutil.JSONArr, 0, len(mappingErrors))
+	for _, e := range mappingErrors {
+		var index jsonutil.JSONToken = jsonutil.JSONNum(e.Index)
+		var target jsonutil.JSONToken = jsonutil.JSONStr(e.Target)
+		var message jsonutil.JSONToken = jsonutil.JSONStr(e.Err.Error())
+		arr = append(arr, jsonutil.JSONContainer{
+			"mapping": &index,
+			"target":  &target,
+			"message": &message,
+		})
+	}
+	return arr
+}
+
 func convertTopLevelObjectsToContainer(ctx *types.Context) jsonutil.JSONContainer {
 	cont := make(jsonutil.JSONContainer)
 
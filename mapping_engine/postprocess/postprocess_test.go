@@ -16,6 +16,7 @@ package postprocess
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
@@ -266,3 +267,79 @@ func TestPostProcess(t *testing.T) {
 		})
 	}
 }
+
+func TestProcessPartial(t *testing.T) {
+	patient, err := jsonutil.UnmarshalJSON(json.RawMessage(`{"resourceType": "Patient", "id": "a"}`))
+	if err != nil {
+		t.Fatalf("test variable for patient entry is invalid, error: %v", err)
+	}
+	mappingErrors := []mapping.MappingError{
+		{Index: 2, Target: "out Coverage", Err: fmt.Errorf("bad payor")},
+	}
+	// Bundle writes its second argument, if any, to failures.
+	bundle := func(argCount int32) *mappb.MappingConfig {
+		return &mappb.MappingConfig{
+			PostProcess: &mappb.MappingConfig_PostProcessProjectorDefinition{
+				PostProcessProjectorDefinition: &mappb.ProjectorDefinition{
+					Name:     "Bundle",
+					ArgCount: argCount,
+					Mapping: []*mappb.FieldMapping{
+						{
+							ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_FromInput{FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: "Patient"}}},
+							Target:      &mappb.FieldMapping_TargetField{TargetField: "entry"},
+						},
+						{
+							ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_FromArg{FromArg: 2}},
+							Target:      &mappb.FieldMapping_TargetField{TargetField: "failures"},
+							Condition:   &mappb.ValueSource{Source: &mappb.ValueSource_ConstBool{ConstBool: argCount == 2}},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		desc          string
+		config        *mappb.MappingConfig
+		mappingErrors []mapping.MappingError
+		want          json.RawMessage
+	}{
+		{
+			desc:          "errors passed",
+			config:        bundle(2),
+			mappingErrors: mappingErrors,
+			want:          json.RawMessage(`{"entry": [{"resourceType": "Patient", "id": "a"}], "failures": [{"mapping": 2, "target": "out Coverage", "message": "bad payor"}]}`),
+		},
+		{
+			desc:   "no errors",
+			config: bundle(2),
+			// Empty arrays are not written.
+			want: json.RawMessage(`{"entry": [{"resourceType": "Patient", "id": "a"}]}`),
+		},
+		{
+			desc:          "projector with one argument",
+			config:        bundle(1),
+			mappingErrors: mappingErrors,
+			want:          json.RawMessage(`{"entry": [{"resourceType": "Patient", "id": "a"}]}`),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			pctx := types.NewContext(types.NewRegistry())
+			pctx.TopLevelObjects = map[string][]jsonutil.JSONToken{"Patient": {patient}}
+			got, err := ProcessPartial(pctx, test.config, false, mapping.NewWhistler(), test.mappingErrors)
+			if err != nil {
+				t.Fatalf("ProcessPartial(%v) failed with error: %v", test.mappingErrors, err)
+			}
+
+			want, err := jsonutil.UnmarshalJSON(test.want)
+			if err != nil {
+				t.Fatalf("expected result has bad format, jsonutil.UnmarshalJSON(%v) returned error: %v", test.want, err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("ProcessPartial(%v) returned diff (-want +got):\n%s", test.mappingErrors, diff)
+			}
+		})
+	}
+}
@@ -16,10 +16,14 @@
 package projector
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"math"
 	"reflect"
+	"unicode/utf8"
 
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/builtins" /* copybara-comment: builtins */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/errors" /* copybara-comment: errors */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/mapping" /* copybara-comment: mapping */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
@@ -28,8 +32,56 @@ import (
 	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
 )
 
-// FromDef creates a projector from a proto definition. This will not register it.
+// FromDef creates a projector from a proto definition. This will not register it. Calls to a pure
+// projector are memoized, so that calls with the same arguments are only evaluated once per record
+// (unless lineage is recorded, which differs between calls).
 func FromDef(definition *mappb.ProjectorDefinition, e mapping.Engine) types.Projector {
+	proj := fromDef(definition, e)
+	if !definition.GetPure() {
+		return proj
+	}
+	return func(arguments []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+		if pctx.Lineage != nil {
+			return proj(arguments, pctx)
+		}
+		key, err := memoKey(definition.Name, arguments)
+		if err != nil {
+			return proj(arguments, pctx)
+		}
+		if res, ok := pctx.Memoized(key); ok {
+			return jsonutil.Deepcopy(res), nil
+		}
+
+		res, err := proj(arguments, pctx)
+		if err != nil {
+			return nil, err
+		}
+		// The result may be modified where it is written, so the memo keeps a copy.
+		pctx.Memoize(key, jsonutil.Deepcopy(res))
+		return res, nil
+	}
+}
+
+// memoKey returns the key of the memoized result of a call to the projector with the given name
+// and arguments.
+func memoKey(name string, arguments []jsonutil.JSONMetaNode) (string, error) {
+	args := make(jsonutil.JSONArr, 0, len(arguments))
+	for _, a := range arguments {
+		t, err := jsonutil.NodeToToken(a)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, t)
+	}
+	b, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+	return name + string(b), nil
+}
+
+// fromDef creates a projector evaluating the mappings of the given definition.
+func fromDef(definition *mappb.ProjectorDefinition, e mapping.Engine) types.Projector {
 	return func(arguments []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
 		pctx.Variables.Push()
 
@@ -38,6 +90,10 @@ func FromDef(definition *mappb.ProjectorDefinition, e mapping.Engine) types.Proj
 			return nil, errors.Wrap(errLocation, err)
 		}
 
+		if pctx.Lineage != nil {
+			pctx.Lineage.Push()
+		}
+
 		var merged jsonutil.JSONToken
 
 		// TODO: Sort in dependency order
@@ -47,28 +103,114 @@ func FromDef(definition *mappb.ProjectorDefinition, e mapping.Engine) types.Proj
 
 		pctx.PopProjectorFromStack(definition.Name)
 
+		if pctx.Lineage != nil {
+			pctx.Lineage.Pop()
+		}
+
 		if _, err := pctx.Variables.Pop(); err != nil {
 			return nil, errors.Wrap(errLocation, err)
 		}
 
+		if err := checkEnsures(definition, merged, e, pctx); err != nil {
+			return nil, errors.Wrap(errLocation, err)
+		}
+
 		return merged, nil
 	}
 }
 
+// maxEnsuresResultLen is the number of bytes of a result shown in the error of a post-condition it
+// does not meet.
+const maxEnsuresResultLen = 200
+
+// checkEnsures returns an error if the given result of the projector with the given definition does
+// not meet its post-condition (if it has one). Like conditions, the post-condition holds if it is
+// true or, if it is not a boolean, not nil.
+func checkEnsures(definition *mappb.ProjectorDefinition, result jsonutil.JSONToken, e mapping.Engine, pctx *types.Context) error {
+	if definition.GetEnsures() == nil {
+		return nil
+	}
+
+	node, err := jsonutil.TokenToNode(result)
+	if err != nil {
+		return err
+	}
+	cond, err := e.EvaluateValueSource(definition.GetEnsures(), []jsonutil.JSONMetaNode{node}, nil, pctx)
+	if err != nil {
+		return fmt.Errorf("failed to evaluate post-condition %s: %v", definition.GetEnsuresText(), err)
+	}
+	ct, err := jsonutil.NodeToToken(cond)
+	if err != nil {
+		return err
+	}
+
+	holds, isBool := ct.(jsonutil.JSONBool)
+	if !isBool {
+		notNil, err := builtins.IsNotNil(ct)
+		if err != nil {
+			return err
+		}
+		holds = notNil
+	}
+	if holds {
+		return nil
+	}
+
+	shown := jsonutil.MarshalJSON(result)
+	if len(shown) > maxEnsuresResultLen {
+		n := maxEnsuresResultLen
+		for n > 0 && !utf8.RuneStart(shown[n]) {
+			n--
+		}
+		shown = shown[:n] + "..."
+	}
+	return fmt.Errorf("projector %s returned a result that does not meet its post-condition %s: %s", definition.GetName(), definition.GetEnsuresText(), shown)
+}
+
+// ResultType returns the type of the results of the given function ("string", "number", "bool",
+// "array" or "object"), as registered with types.Registry.RegisterResultType, or "" if it is not
+// a function or may return values of any type.
+func ResultType(fn interface{}) string {
+	ft := reflect.TypeOf(fn)
+	if ft == nil || ft.Kind() != reflect.Func || ft.NumOut() == 0 {
+		return ""
+	}
+	switch ft.Out(0) {
+	case reflect.TypeOf(jsonutil.JSONStr("")):
+		return "string"
+	case reflect.TypeOf(jsonutil.JSONNum(0)):
+		return "number"
+	case reflect.TypeOf(jsonutil.JSONBool(false)):
+		return "bool"
+	case reflect.TypeOf(jsonutil.JSONArr{}):
+		return "array"
+	case reflect.TypeOf(jsonutil.JSONContainer{}):
+		return "object"
+	}
+	return ""
+}
+
 // FromFunction creates a projector from a given function. The function must have a return type of
-// (JSONObject, error) and all arguments must be assignable to JSONObject. This will not register
-// the projector.
+// (JSONObject, error) and all arguments must be assignable to JSONObject, except for an optional
+// first context.Context argument, which is passed the Go context of the evaluation (see
+// types.Context.GoContext) so that I/O done by the function is cancelled with it. This will not
+// register the projector.
 func FromFunction(fn interface{}, name string) (types.Projector, error) {
 	tokenType := reflect.TypeOf((*jsonutil.JSONToken)(nil)).Elem()
+	contextType := reflect.TypeOf((*context.Context)(nil)).Elem()
 
 	f := reflect.ValueOf(fn)
 	if f.Kind() != reflect.Func {
 		return nil, fmt.Errorf("projector must be a function")
 	}
 
-	// Check args are our JSON types.
+	// Check args are our JSON types. params is the index of the first of them.
 	ft := reflect.TypeOf(fn)
-	for i := 0; i < ft.NumIn(); i++ {
+	params := 0
+	if ft.NumIn() > 0 && ft.In(0) == contextType {
+		params = 1
+	}
+	for i := params; i < ft.NumIn(); i++ {
 		isObj := ft.In(i).AssignableTo(tokenType)
 		isSliceOfObj := ft.In(i).Kind() == reflect.Slice && ft.In(i).Elem().AssignableTo(tokenType)
 		if !isObj && !isSliceOfObj {
@@ -102,16 +244,25 @@ func FromFunction(fn interface{}, name string) (types.Projector, error) {
 			args[i] = node
 		}
 
-		if ft.IsVariadic() && len(args) < ft.NumIn()-1 {
-			return nil, errors.Wrap(errLocation, fmt.Errorf("expected at least %d parameters (could be more, function is variadic), got %d", ft.NumIn()-1, len(args)))
+		numIn := ft.NumIn() - params
+		if ft.IsVariadic() && len(args) < numIn-1 {
+			return nil, errors.Wrap(errLocation, fmt.Errorf("expected at least %d parameters (could be more, function is variadic), got %d", numIn-1, len(args)))
 		}
-		if !ft.IsVariadic() && len(args) != ft.NumIn() {
-			return nil, errors.Wrap(errLocation, fmt.Errorf("expected %d parameters, got %d", ft.NumIn(), len(args)))
+		if !ft.IsVariadic() && len(args) != numIn {
+			return nil, errors.Wrap(errLocation, fmt.Errorf("expected %d parameters, got %d", numIn, len(args)))
+		}
+		argvs := make([]reflect.Value, 0, len(args)+params)
+		if params > 0 {
+			ctx := pctx.GoContext
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			argvs = append(argvs, reflect.ValueOf(ctx))
 		}
-		argvs := make([]reflect.Value, 0, len(args))
 		for i, arg := range args {
-			if ft.IsVariadic() && i == ft.NumIn()-1 {
-				a, err := extractVariadic(ft.In(i).Elem(), args[i:])
+			in := ft.In(i + params)
+			if ft.IsVariadic() && i == numIn-1 {
+				a, err := extractVariadic(in.Elem(), args[i:])
 				if err != nil {
 					return nil, errors.Wrap(errLocation, fmt.Errorf("error extracting variadic argument %d: %v", i, err))
 				}
@@ -119,8 +270,8 @@ func FromFunction(fn interface{}, name string) (types.Projector, error) {
 				argvs = append(argvs, a...)
 				break
 			}
-			if ft.In(i).Kind() == reflect.Slice {
-				a, err := extractSlice(ft.In(i).Elem(), arg)
+			if in.Kind() == reflect.Slice {
+				a, err := extractSlice(in.Elem(), arg)
 				if err != nil {
 					return nil, errors.Wrap(errLocation, fmt.Errorf("error extracting slice argument %d: %v", i, err))
 				}
@@ -128,7 +279,7 @@ func FromFunction(fn interface{}, name string) (types.Projector, error) {
 				continue
 			}
 
-			a, err := extractSimple(ft.In(i), arg)
+			a, err := extractSimple(in, arg)
 			if err != nil {
 				return nil, errors.Wrap(errLocation, fmt.Errorf("error extracting argument %d: %v", i, err))
 			}
@@ -147,12 +298,14 @@ func FromFunction(fn interface{}, name string) (types.Projector, error) {
 			err = ri.(error)
 		}
 
-		pctx.PopProjectorFromStack(name)
-
+		// Like projectors defined in mappings, a function that fails stays on the stack, so that the
+		// stack shows where evaluation failed.
 		if err != nil {
 			return nil, errors.Wrap(errors.FnLocationf("Native Function %q", name), err)
 		}
 
+		pctx.PopProjectorFromStack(name)
+
 		return r, nil
 	}, nil
 }
@@ -15,6 +15,7 @@
 package projector
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -157,6 +158,47 @@ func TestFromFunction(t *testing.T) {
 	}
 }
 
+// ctxKey is the key of the value TestFromFunction_Context stores in the Go context.
+type ctxKey struct{}
+
+func TestFromFunction_Context(t *testing.T) {
+	fn := func(ctx context.Context, prefix jsonutil.JSONStr) (jsonutil.JSONToken, error) {
+		v, _ := ctx.Value(ctxKey{}).(string)
+		return prefix + jsonutil.JSONStr(v), nil
+	}
+	proj, err := FromFunction(fn, "ctx")
+	if err != nil {
+		t.Fatalf("FromFunction(ctx) returned unexpected error %v", err)
+	}
+
+	pctx := types.NewContext(types.NewRegistry())
+	pctx.GoContext = context.WithValue(context.Background(), ctxKey{}, "bar")
+	got, err := proj(toNodes(t, []jsonutil.JSONToken{jsonutil.JSONStr("foo")}), pctx)
+	if err != nil {
+		t.Fatalf("<generated projector>(foo) => unexpected error %v", err)
+	}
+	if want := jsonutil.JSONStr("foobar"); got != want {
+		t.Errorf("<generated projector>(foo) = %v, want %v", got, want)
+	}
+
+	// Without a Go context, the function is given the background one.
+	pctx.GoContext = nil
+	if got, err := proj(toNodes(t, []jsonutil.JSONToken{jsonutil.JSONStr("foo")}), pctx); err != nil || got != jsonutil.JSONStr("foo") {
+		t.Errorf("<generated projector>(foo) without a Go context = %v, %v, want foo", got, err)
+	}
+
+	// The context is not an argument of the projector.
+	if got, err := proj(toNodes(t, []jsonutil.JSONToken{jsonutil.JSONStr("foo"), jsonutil.JSONStr("bar")}), pctx); err == nil {
+		t.Errorf("<generated projector>(foo, bar) = %v, want error for the extra argument", got)
+	}
+
+	// Only the first argument can be the context.
+	late := func(prefix jsonutil.JSONStr, ctx context.Context) (jsonutil.JSONToken, error) { return prefix, nil }
+	if _, err := FromFunction(late, "late"); err == nil {
+		t.Errorf("FromFunction(late) returned no error, want one for the context that is not the first argument")
+	}
+}
+
 func TestFromFunctionCompileErrors(t *testing.T) {
 	tests := []struct {
 		name string
@@ -197,6 +239,59 @@ func TestFromFunctionCompileErrors(t *testing.T) {
 	}
 }
 
+func TestResultType(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   interface{}
+		want string
+	}{
+		{
+			name: "string",
+			fn:   UDFFoo,
+			want: "string",
+		},
+		{
+			name: "number",
+			fn:   func(jsonutil.JSONStr) (jsonutil.JSONNum, error) { return 0, nil },
+			want: "number",
+		},
+		{
+			name: "bool",
+			fn:   func(...jsonutil.JSONToken) (jsonutil.JSONBool, error) { return false, nil },
+			want: "bool",
+		},
+		{
+			name: "array",
+			fn:   func() (jsonutil.JSONArr, error) { return nil, nil },
+			want: "array",
+		},
+		{
+			name: "object",
+			fn:   func() (jsonutil.JSONContainer, error) { return nil, nil },
+			want: "object",
+		},
+		{
+			name: "any",
+			fn:   func() (jsonutil.JSONToken, error) { return nil, nil },
+		},
+		{
+			name: "no return value",
+			fn:   func() {},
+		},
+		{
+			name: "not a function",
+			fn:   "foo",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ResultType(test.fn); got != test.want {
+				t.Errorf("ResultType(%v) = %q, want %q", test.fn, got, test.want)
+			}
+		})
+	}
+}
+
 func TestFromFunctionInvocationErrors(t *testing.T) {
 	tests := []struct {
 		name string
@@ -373,6 +468,179 @@ func TestFromDefinition_OutputsAnArrayWhenMapping(t *testing.T) {
 	}
 }
 
+func TestFromDefinition_ChecksEnsures(t *testing.T) {
+	fromArg := func(field string) *mappb.ValueSource {
+		return &mappb.ValueSource{Source: &mappb.ValueSource_FromInput{FromInput: &mappb.ValueSource_InputSource{Arg: 1, Field: field}}}
+	}
+	codeEnsures := fromArg("code")
+	tests := []struct {
+		name    string
+		ensures *mappb.ValueSource
+		arg     string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "no post-condition",
+			arg:  `{"text": "x"}`,
+			want: `{"text": "x"}`,
+		},
+		{
+			name:    "holds",
+			ensures: codeEnsures,
+			arg:     `{"code": "a"}`,
+			want:    `{"code": "a"}`,
+		},
+		{
+			name:    "true",
+			ensures: &mappb.ValueSource{Source: &mappb.ValueSource_ConstBool{ConstBool: true}},
+			arg:     `{"text": "x"}`,
+			want:    `{"text": "x"}`,
+		},
+		{
+			name:    "does not hold",
+			ensures: codeEnsures,
+			arg:     `{"text": "x"}`,
+			wantErr: `projector BuildCoding returned a result that does not meet its post-condition $this.code: {"text":"x"}`,
+		},
+		{
+			name:    "false",
+			ensures: &mappb.ValueSource{Source: &mappb.ValueSource_ConstBool{ConstBool: false}},
+			arg:     `{"code": "a"}`,
+			wantErr: `projector BuildCoding returned a result that does not meet its post-condition $this.code: {"code":"a"}`,
+		},
+		{
+			name:    "nil result",
+			ensures: codeEnsures,
+			arg:     `{}`,
+			wantErr: `projector BuildCoding returned a result that does not meet its post-condition $this.code: null`,
+		},
+		{
+			name:    "long result",
+			ensures: codeEnsures,
+			arg:     fmt.Sprintf(`{"text": %q}`, strings.Repeat("x", 300)),
+			wantErr: fmt.Sprintf(`projector BuildCoding returned a result that does not meet its post-condition $this.code: {"text":"%s...`, strings.Repeat("x", maxEnsuresResultLen-9)),
+		},
+	}
+	for _, mode := range testModes {
+		for _, test := range tests {
+			t.Run(mode.name+"/"+test.name, func(t *testing.T) {
+				def := &mpb.ProjectorDefinition{
+					Name: "BuildCoding",
+					Mapping: []*mappb.FieldMapping{
+						{ValueSource: fromArg("code"), Target: &mappb.FieldMapping_TargetField{TargetField: "code"}},
+						{ValueSource: fromArg("text"), Target: &mappb.FieldMapping_TargetField{TargetField: "text"}},
+					},
+					Ensures:     test.ensures,
+					EnsuresText: "$this.code",
+				}
+				proj := FromDef(def, mode.engine)
+				ctx := types.NewContext(types.NewRegistry())
+				ctx.Variables.Push()
+
+				arg, err := jsonutil.UnmarshalJSON(json.RawMessage(test.arg))
+				if err != nil {
+					t.Fatalf("could not unmarshal arg JSON: %v", err)
+				}
+				got, err := proj(toNodes(t, []jsonutil.JSONToken{arg}), ctx)
+				if test.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+						t.Fatalf("projector returned error %v, want it to contain %q", err, test.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("projector returned unexpected error: %v", err)
+				}
+				want, err := jsonutil.UnmarshalJSON(json.RawMessage(test.want))
+				if err != nil {
+					t.Fatalf("could not unmarshal want JSON: %v", err)
+				}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("projector returned diff (-want +got):\n%s", diff)
+				}
+			})
+		}
+	}
+}
+
+func TestFromDefinition_MemoizesPureProjectors(t *testing.T) {
+	tests := []struct {
+		name      string
+		pure      bool
+		lineage   bool
+		wantCalls int
+	}{
+		{
+			name:      "pure",
+			pure:      true,
+			wantCalls: 2,
+		},
+		{
+			name:      "not pure",
+			wantCalls: 3,
+		},
+		{
+			name:      "pure with lineage",
+			pure:      true,
+			lineage:   true,
+			wantCalls: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Build returns {"name": $Expensive(arg)}, and $Expensive counts its calls.
+			calls := 0
+			expensive := func(args []jsonutil.JSONMetaNode, _ *types.Context) (jsonutil.JSONToken, error) {
+				calls++
+				return jsonutil.NodeToToken(args[0])
+			}
+			reg := types.NewRegistry()
+			if err := reg.RegisterProjector("$Expensive", expensive); err != nil {
+				t.Fatalf("RegisterProjector returned unexpected error: %v", err)
+			}
+
+			def := &mpb.ProjectorDefinition{
+				Name: "Build",
+				Pure: test.pure,
+				Mapping: []*mappb.FieldMapping{
+					{
+						ValueSource: &mappb.ValueSource{
+							Source:    &mappb.ValueSource_FromInput{FromInput: &mappb.ValueSource_InputSource{Arg: 1}},
+							Projector: "$Expensive",
+						},
+						Target: &mappb.FieldMapping_TargetField{TargetField: "name"},
+					},
+				},
+			}
+			proj := FromDef(def, mapping.NewWhistler())
+			ctx := types.NewContext(reg)
+			if test.lineage {
+				ctx.Lineage = types.NewLineage()
+			}
+
+			for _, arg := range []string{"a", "b", "a"} {
+				got, err := proj(toNodes(t, []jsonutil.JSONToken{jsonutil.JSONStr(arg)}), ctx)
+				if err != nil {
+					t.Fatalf("Build(%q) returned unexpected error: %v", arg, err)
+				}
+				var name jsonutil.JSONToken = jsonutil.JSONStr(arg)
+				want := jsonutil.JSONContainer{"name": &name}
+				if diff := cmp.Diff(want, got); diff != "" {
+					t.Errorf("Build(%q) returned diff -want +got: %s", arg, diff)
+				}
+				// Results written to the output may be modified, which must not affect memoized ones.
+				var changed jsonutil.JSONToken = jsonutil.JSONStr("changed")
+				got.(jsonutil.JSONContainer)["name"] = &changed
+			}
+
+			if calls != test.wantCalls {
+				t.Errorf("$Expensive was called %d times, want %d", calls, test.wantCalls)
+			}
+		})
+	}
+}
+
 func TestProjectorsCannotExceedMaxStackDepth(t *testing.T) {
 	tests := []struct {
 		name       string
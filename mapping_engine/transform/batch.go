@@ -0,0 +1,158 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/errors" /* copybara-comment: errors */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// RecordErrorPolicy determines what ProcessBatch does with records that fail to map.
+type RecordErrorPolicy int
+
+const (
+	// FailOnRecordError fails the whole batch with the errors.RecordError of the first record that
+	// fails.
+	FailOnRecordError RecordErrorPolicy = iota
+	// CollectRecordErrors leaves the outputs of failed records out (as null) and reports their
+	// errors in the result.
+	CollectRecordErrors
+	// EmitRecordErrors reports the errors of failed records in the result, and replaces their
+	// outputs with an error record in TransformationConfig.RecordErrorTarget (see
+	// TransformationConfig.RecordErrorProjector), so that errors reach the same sinks as outputs.
+	// With a TransformationConfig.DeadLetterSink, the error records are written to it instead, and
+	// the outputs of failed records are null.
+	EmitRecordErrors
+)
+
+// defaultRecordErrorTarget is the target of error records if TransformationConfig.RecordErrorTarget
+// is not set.
+const defaultRecordErrorTarget = "RecordError"
+
+// BatchResult is the result of ProcessBatch.
+type BatchResult struct {
+	// Outputs are the outputs of the records, in the same order. The output of a failed record is
+	// null, or its error record with EmitRecordErrors (unless it went to the DeadLetterSink).
+	Outputs []jsonutil.JSONToken
+	// Errors are the errors of the records that failed, in order.
+	Errors []errors.RecordError
+}
+
+// ProcessBatch transforms each of the given records like Transform, handling records that fail to
+// map according to TransformationConfig.RecordErrorPolicy. Records are independent of each other, so
+// a failed record does not affect the outputs of the others.
+func (t *DefaultTransformer) ProcessBatch(records []jsonutil.JSONToken) (*BatchResult, error) {
+	res := &BatchResult{Outputs: make([]jsonutil.JSONToken, 0, len(records))}
+	for i, record := range records {
+		out, recErr, err := t.processRecord(i, record)
+		if err != nil {
+			return nil, err
+		}
+		res.Outputs = append(res.Outputs, out)
+		if recErr != nil {
+			res.Errors = append(res.Errors, *recErr)
+		}
+	}
+	return res, nil
+}
+
+// processRecord transforms the record with the given index of a batch, handling it failing to map
+// according to TransformationConfig.RecordErrorPolicy. If the record failed but the batch can go
+// on, its error is returned along with its output (see BatchResult.Outputs).
+func (t *DefaultTransformer) processRecord(i int, record jsonutil.JSONToken) (jsonutil.JSONToken, *errors.RecordError, error) {
+	pctx := t.newContext(nil)
+	if d := t.transformationConfig.DeterministicForTesting; d != nil {
+		pctx.Random = d.indexRandom(i)
+	}
+	out, err := t.transform(pctx, record)
+	if err == nil {
+		return out, nil, nil
+	}
+
+	recErr := errors.RecordError{Index: i, ProjectorStack: pctx.ProjectorStack(), Err: err}
+	switch t.transformationConfig.RecordErrorPolicy {
+	case CollectRecordErrors:
+		return nil, &recErr, nil
+	case EmitRecordErrors:
+		if out, err = t.errorRecordOutput(recErr, record); err != nil {
+			return nil, nil, fmt.Errorf("could not create error record for record %d: %v", i, err)
+		}
+		if sink := t.transformationConfig.DeadLetterSink; sink != nil {
+			if err := WriteOutput(out, sink); err != nil {
+				return nil, nil, fmt.Errorf("could not write error record for record %d to the dead-letter sink: %v", i, err)
+			}
+			return nil, &recErr, nil
+		}
+		return out, &recErr, nil
+	default:
+		return nil, nil, recErr
+	}
+}
+
+// errorRecordOutput creates the output that replaces the output of the given failed record with
+// EmitRecordErrors, i.e. the error record in the record error target.
+func (t *DefaultTransformer) errorRecordOutput(recErr errors.RecordError, record jsonutil.JSONToken) (jsonutil.JSONToken, error) {
+	stack := make(jsonutil.JSONArr, 0, len(recErr.ProjectorStack))
+	for _, p := range recErr.ProjectorStack {
+		stack = append(stack, jsonutil.JSONStr(p))
+	}
+	var index, projectorStack, message jsonutil.JSONToken = jsonutil.JSONNum(recErr.Index), stack, jsonutil.JSONStr(recErr.Err.Error())
+	var timestamp jsonutil.JSONToken = jsonutil.JSONStr(t.now().UTC().Format(time.RFC3339))
+	fields := jsonutil.JSONContainer{
+		"recordIndex":    &index,
+		"projectorStack": &projectorStack,
+		"message":        &message,
+		"timestamp":      &timestamp,
+	}
+	if t.transformationConfig.RecordErrorIncludeInput {
+		fields["input"] = &record
+	}
+	var rec jsonutil.JSONToken = fields
+
+	if name := t.transformationConfig.RecordErrorProjector; name != "" {
+		var err error
+		if rec, err = t.projectErrorRecord(name, rec); err != nil {
+			return nil, err
+		}
+	}
+
+	target := t.transformationConfig.RecordErrorTarget
+	if target == "" {
+		target = defaultRecordErrorTarget
+	}
+	var recs jsonutil.JSONToken = jsonutil.JSONArr{rec}
+	return jsonutil.JSONContainer{target: &recs}, nil
+}
+
+// projectErrorRecord calls the record error projector with the given name to shape an error record.
+func (t *DefaultTransformer) projectErrorRecord(name string, rec jsonutil.JSONToken) (out jsonutil.JSONToken, err error) {
+	pctx := t.newContext(nil)
+	defer errors.Recover(fmt.Sprintf("Record error projector %q", name), func(e error) {
+		err = e
+	})
+
+	proj, err := t.registry.FindProjector(name)
+	if err != nil {
+		return nil, err
+	}
+	n, err := jsonutil.TokenToNode(rec)
+	if err != nil {
+		return nil, err
+	}
+	return proj([]jsonutil.JSONMetaNode{n}, pctx)
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/errors" /* copybara-comment: errors */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// UnmappedResourcePolicy determines what ProcessBundle does with entries whose resourceType has no
+// projector in TransformationConfig.BundleProjectors.
+type UnmappedResourcePolicy int
+
+const (
+	// SkipUnmappedResources leaves such entries out of the output bundle.
+	SkipUnmappedResources UnmappedResourcePolicy = iota
+	// PassThroughUnmappedResources copies such entries to the output bundle unchanged.
+	PassThroughUnmappedResources
+	// RejectUnmappedResources reports such entries as failed.
+	RejectUnmappedResources
+)
+
+// BundleEntryError is the error for a single entry of the bundle given to ProcessBundle.
+type BundleEntryError struct {
+	// Index is the index of the entry in the input bundle.
+	Index int
+	// FullURL is the fullUrl of the entry, if it has one.
+	FullURL string
+	Err     error
+}
+
+func (e BundleEntryError) Error() string {
+	if e.FullURL != "" {
+		return fmt.Sprintf("entry[%d] (%s): %v", e.Index, e.FullURL, e.Err)
+	}
+	return fmt.Sprintf("entry[%d]: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e BundleEntryError) Unwrap() error {
+	return e.Err
+}
+
+// BundleResult is the result of ProcessBundle.
+type BundleResult struct {
+	// Bundle is a collection Bundle of all mapped (and passed through) resources.
+	Bundle jsonutil.JSONToken
+	// Errors are the entries that could not be mapped. These are left out of Bundle.
+	Errors []BundleEntryError
+}
+
+// ProcessBundle maps each entry.resource of the given FHIR Bundle with the projector configured
+// for its resourceType in TransformationConfig.BundleProjectors, and collects all resulting
+// resources (including any written to out targets by the projector) into a collection Bundle.
+// Entries that fail to map are reported in the result rather than failing the whole bundle, unless
+// TransformationConfig.FailOnBundleEntryError is set. Post processing, metadata stamping and output
+// validation are not applied.
+func (t *DefaultTransformer) ProcessBundle(bundle jsonutil.JSONToken) (*BundleResult, error) {
+	b, ok := bundle.(jsonutil.JSONContainer)
+	if !ok {
+		return nil, fmt.Errorf("input must be a Bundle object but was %T", bundle)
+	}
+	if rt, err := jsonutil.GetField(b, "resourceType"); err != nil || rt != jsonutil.JSONStr("Bundle") {
+		return nil, fmt.Errorf("input must be a Bundle but had resourceType %v", rt)
+	}
+	entries, err := jsonutil.GetField(b, "entry")
+	if err != nil {
+		return nil, err
+	}
+	entryArr, ok := entries.(jsonutil.JSONArr)
+	if !ok && entries != nil {
+		return nil, fmt.Errorf("entry of the Bundle must be an array but was %T", entries)
+	}
+
+	res := &BundleResult{}
+	out := make(jsonutil.JSONArr, 0, len(entryArr))
+	for i, entry := range entryArr {
+		resources, err := t.processBundleEntry(entry)
+		if err != nil {
+			fullURL, _ := jsonutil.GetField(entry, "fullUrl")
+			url, _ := fullURL.(jsonutil.JSONStr)
+			entryErr := BundleEntryError{Index: i, FullURL: string(url), Err: err}
+			if t.transformationConfig.FailOnBundleEntryError {
+				return nil, entryErr
+			}
+			res.Errors = append(res.Errors, entryErr)
+			continue
+		}
+		out = append(out, resources...)
+	}
+
+	var resourceType, typ jsonutil.JSONToken = jsonutil.JSONStr("Bundle"), jsonutil.JSONStr("collection")
+	var entry jsonutil.JSONToken = out
+	res.Bundle = jsonutil.JSONContainer{"resourceType": &resourceType, "type": &typ, "entry": &entry}
+	return res, nil
+}
+
+// processBundleEntry maps the resource of the given bundle entry, returning the output entries.
+func (t *DefaultTransformer) processBundleEntry(entry jsonutil.JSONToken) (out jsonutil.JSONArr, err error) {
+	resource, err := jsonutil.GetField(entry, "resource")
+	if err != nil {
+		return nil, err
+	}
+	rt, err := jsonutil.GetField(resource, "resourceType")
+	if err != nil {
+		return nil, err
+	}
+	resourceType, ok := rt.(jsonutil.JSONStr)
+	if !ok {
+		return nil, fmt.Errorf("entry has no resource with a resourceType")
+	}
+
+	projName, ok := t.transformationConfig.BundleProjectors[string(resourceType)]
+	if !ok {
+		switch t.transformationConfig.UnmappedResourcePolicy {
+		case PassThroughUnmappedResources:
+			return jsonutil.JSONArr{jsonutil.Deepcopy(entry)}, nil
+		case RejectUnmappedResources:
+			return nil, fmt.Errorf("no projector is configured for resourceType %q", resourceType)
+		default:
+			return nil, nil
+		}
+	}
+
+	pctx := t.newContext(nil)
+	defer errors.Recover(fmt.Sprintf("Bundle entry projector %q", projName), func(e error) {
+		err = e
+	})
+
+	proj, err := t.registry.FindProjector(projName)
+	if err != nil {
+		return nil, err
+	}
+	node, err := jsonutil.TokenToNode(resource)
+	if err != nil {
+		return nil, err
+	}
+	mapped, err := proj([]jsonutil.JSONMetaNode{node}, pctx)
+	if err != nil {
+		return nil, err
+	}
+
+	add := func(r jsonutil.JSONToken) {
+		if r == nil {
+			return
+		}
+		var rr jsonutil.JSONToken = r
+		out = append(out, jsonutil.JSONContainer{"resource": &rr})
+	}
+	if arr, ok := mapped.(jsonutil.JSONArr); ok {
+		for _, r := range arr {
+			add(r)
+		}
+	} else {
+		add(mapped)
+	}
+
+	// Also collect any resources the projector wrote to out targets.
+	if err := forEachTopLevelObject(pctx, func(_ string, _ int, obj jsonutil.JSONToken) error {
+		add(obj)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
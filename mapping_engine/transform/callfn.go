@@ -0,0 +1,182 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+const (
+	// callFnProjectorName is the name of the builtin that calls projectors by name.
+	callFnProjectorName = "$CallFn"
+
+	// tryProjectorName is the name of the builtin that calls projectors by name, capturing their
+	// errors.
+	tryProjectorName = "$Try"
+
+	// buildListProjectorName is the name of the builtin that builds arrays by calling a projector
+	// with each index.
+	buildListProjectorName = "$BuildList"
+)
+
+// callFnProjector calls the projector named by the first argument with the remaining arguments.
+// Since the name is only known at runtime, a projector that does not exist is only reported here,
+// along with the registered names it may have been a typo of.
+func callFnProjector(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+	proj, fnArgs, err := findNamedProjector(callFnProjectorName, args, pctx)
+	if err != nil {
+		return nil, err
+	}
+	return proj(fnArgs, pctx)
+}
+
+// tryProjector calls the projector named by the first argument with the remaining arguments like
+// callFnProjector, but returns {"value": result} if it succeeds and {"error": message} if it fails,
+// instead of failing. Calls that can not be made at all (e.g. to a projector that does not exist, or
+// with the wrong number of arguments) are mistakes in the mappings rather than the data, and still
+// fail. So do the limits the engine puts on the whole evaluation (see isEngineError), which must not
+// be caught by the mappings they limit.
+func tryProjector(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+	proj, fnArgs, err := findNamedProjector(tryProjectorName, args, pctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A projector that fails leaves its variables and itself on the stacks.
+	mark := pctx.Mark()
+	res, err := proj(fnArgs, pctx)
+	if err != nil {
+		if isEngineError(err) {
+			// Like any other failure that is not caught, this leaves the stacks where it failed.
+			return nil, err
+		}
+		pctx.Unwind(mark)
+		var msg jsonutil.JSONToken = jsonutil.JSONStr(err.Error())
+		return jsonutil.JSONContainer{"error": &msg}, nil
+	}
+	if pctx.Lineage != nil {
+		lin := pctx.Lineage.TakeReturned()
+		pctx.Lineage.SetReturned(jsonutil.JSONContainer{"value": &lin})
+	}
+	return jsonutil.JSONContainer{"value": &res}, nil
+}
+
+// isEngineError returns true iff the given error, or any error it wraps, was raised by the engine
+// rather than by the mappings or builtins it evaluated: a timeout, an exceeded output budget or
+// stack depth, or a projector that failed all of its retries.
+func isEngineError(err error) bool {
+	var timeout types.TimeoutError
+	var budget types.OutputBudgetError
+	var overflow types.StackOverflowError
+	var retry types.RetryError
+	return errors.As(err, &timeout) || errors.As(err, &budget) || errors.As(err, &overflow) || errors.As(err, &retry)
+}
+
+// buildListProjector calls the projector named by the second argument with each index from 0 to
+// the first argument (exclusive), and returns the results in that order. Null results are kept, so
+// that the element at every index is the result for that index.
+func buildListProjector(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%s expects 2 arguments, got %d", buildListProjectorName, len(args))
+	}
+
+	count, err := jsonutil.NodeToToken(args[0])
+	if err != nil {
+		return nil, err
+	}
+	n, ok := count.(jsonutil.JSONNum)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a number of elements, got %T", buildListProjectorName, count)
+	}
+	if n < 0 || n != jsonutil.JSONNum(int(n)) {
+		return nil, fmt.Errorf("%s expects a non-negative integer number of elements, got %v", buildListProjectorName, n)
+	}
+
+	proj, err := lookupNamedProjector(buildListProjectorName, args[1], 1, pctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := jsonutil.JSONArr{}
+	var lineage jsonutil.JSONArr
+	for i := 0; i < int(n); i++ {
+		index, err := jsonutil.TokenToNode(jsonutil.JSONNum(i))
+		if err != nil {
+			return nil, err
+		}
+		if pctx.Lineage != nil {
+			pctx.Lineage.TakeReturned()
+		}
+		v, err := proj([]jsonutil.JSONMetaNode{index}, pctx)
+		if err != nil {
+			return nil, fmt.Errorf("%s: error building element %d: %w", buildListProjectorName, i, err)
+		}
+		res = append(res, v)
+		if pctx.Lineage != nil {
+			lineage = append(lineage, pctx.Lineage.TakeReturned())
+		}
+	}
+	if pctx.Lineage != nil {
+		pctx.Lineage.SetReturned(lineage)
+	}
+	return res, nil
+}
+
+// findNamedProjector returns the projector named by the first of the given arguments of the given
+// builtin, along with the remaining arguments to call it with.
+func findNamedProjector(builtin string, args []jsonutil.JSONMetaNode, pctx *types.Context) (types.Projector, []jsonutil.JSONMetaNode, error) {
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("%s expects at least 1 argument, got 0", builtin)
+	}
+
+	fnArgs := args[1:]
+	proj, err := lookupNamedProjector(builtin, args[0], len(fnArgs), pctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proj, fnArgs, nil
+}
+
+// lookupNamedProjector returns the projector named by the given argument of the given builtin,
+// which the builtin calls with the given number of arguments. Since the name is only known at
+// runtime, a projector that does not exist is only reported here, along with the registered names
+// it may have been a typo of.
+func lookupNamedProjector(builtin string, nameArg jsonutil.JSONMetaNode, nargs int, pctx *types.Context) (types.Projector, error) {
+	name, err := jsonutil.NodeToToken(nameArg)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := name.(jsonutil.JSONStr)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string projector name, got %T", builtin, name)
+	}
+
+	proj, err := pctx.Registry.FindProjector(string(n))
+	if err != nil {
+		if similar := pctx.Registry.SimilarNames(string(n), 3); len(similar) > 0 {
+			return nil, fmt.Errorf("%s: projector %q does not exist (did you mean one of %q?)", builtin, n, similar)
+		}
+		return nil, fmt.Errorf("%s: projector %q does not exist", builtin, n)
+	}
+
+	if arity, ok := pctx.Registry.Arity(string(n)); ok && arity != nargs {
+		return nil, fmt.Errorf("%s: %q expects %d arguments but was given %d", builtin, n, arity, nargs)
+	}
+	return proj, nil
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// counterProjectorName is the name of the builtin that produces sequential numbers.
+const counterProjectorName = "$Counter"
+
+// counterProjector returns the next value (starting at 1) of the counter with the given name. The
+// counters live in the context, so they start over for every record and are not shared between
+// concurrent transformations.
+func counterProjector(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s expects 1 argument, got %d", counterProjectorName, len(args))
+	}
+
+	name, err := jsonutil.NodeToToken(args[0])
+	if err != nil {
+		return nil, err
+	}
+	n, ok := name.(jsonutil.JSONStr)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string name, got %T", counterProjectorName, name)
+	}
+
+	return jsonutil.JSONNum(pctx.NextCounter(string(n))), nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// DedupKeyStore records the keys of the outputs emitted so far, so that later outputs with the same
+// key can be suppressed. Implementations must be safe for concurrent use, and may be backed by an
+// external store (e.g. to deduplicate across runs).
+type DedupKeyStore interface {
+	// Add records the given key, returning false if it was already recorded.
+	Add(key string) (bool, error)
+}
+
+// MemoryDedupKeyStore is a DedupKeyStore that keeps the keys in memory.
+type MemoryDedupKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+// NewMemoryDedupKeyStore creates an empty MemoryDedupKeyStore.
+func NewMemoryDedupKeyStore() *MemoryDedupKeyStore {
+	return &MemoryDedupKeyStore{keys: make(map[string]bool)}
+}
+
+// Add records the given key, returning false if it was already recorded.
+func (s *MemoryDedupKeyStore) Add(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.keys[key] {
+		return false, nil
+	}
+	s.keys[key] = true
+	return true, nil
+}
+
+// DedupCounts are the numbers of outputs of a target that were emitted and suppressed by
+// deduplication.
+type DedupCounts struct {
+	Emitted    int
+	Suppressed int
+}
+
+// dedupStats counts the outputs per target. It is safe for concurrent use.
+type dedupStats struct {
+	mu     sync.Mutex
+	counts map[string]DedupCounts
+}
+
+func (s *dedupStats) add(target string, emitted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counts == nil {
+		s.counts = make(map[string]DedupCounts)
+	}
+	c := s.counts[target]
+	if emitted {
+		c.Emitted++
+	} else {
+		c.Suppressed++
+	}
+	s.counts[target] = c
+}
+
+func (s *dedupStats) snapshot() map[string]DedupCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]DedupCounts, len(s.counts))
+	for target, c := range s.counts {
+		counts[target] = c
+	}
+	return counts
+}
+
+// dedupEnabled returns true iff deduplication of outputs is configured.
+func (t *DefaultTransformer) dedupEnabled() bool {
+	return len(t.transformationConfig.DedupKeyPaths) > 0 || t.transformationConfig.DedupKeyProjector != ""
+}
+
+// DedupStats returns the numbers of outputs emitted and suppressed by deduplication (see
+// TransformationConfig.DedupKeyPaths) so far, by target.
+func (t *DefaultTransformer) DedupStats() map[string]DedupCounts {
+	return t.dedupStats.snapshot()
+}
+
+// dedupOutputs removes the top level output objects whose key was already emitted, by this or any
+// earlier transformation. Objects without a key are always emitted.
+func (t *DefaultTransformer) dedupOutputs(pctx *types.Context) error {
+	return filterTopLevelObjects(pctx, func(target string, obj jsonutil.JSONToken) (bool, error) {
+		key, err := t.dedupKey(pctx, obj)
+		if err != nil {
+			return false, fmt.Errorf("could not compute deduplication key of output %s: %v", target, err)
+		}
+		if key == "" {
+			return true, nil
+		}
+
+		added, err := t.dedupStore.Add(key)
+		if err != nil {
+			return false, fmt.Errorf("could not record deduplication key of output %s: %v", target, err)
+		}
+		t.dedupStats.add(target, added)
+		return added, nil
+	})
+}
+
+// dedupKey returns the deduplication key of the given output, or "" if it has none, i.e. if all key
+// paths are null or the key projector returned null.
+func (t *DefaultTransformer) dedupKey(pctx *types.Context, obj jsonutil.JSONToken) (string, error) {
+	if name := t.transformationConfig.DedupKeyProjector; name != "" {
+		proj, err := pctx.Registry.FindProjector(name)
+		if err != nil {
+			return "", err
+		}
+		n, err := jsonutil.TokenToNode(obj)
+		if err != nil {
+			return "", err
+		}
+		key, err := proj([]jsonutil.JSONMetaNode{n}, pctx)
+		if err != nil {
+			return "", err
+		}
+		if key == nil {
+			return "", nil
+		}
+		if s, ok := key.(jsonutil.JSONStr); ok {
+			return string(s), nil
+		}
+		b, err := json.Marshal(key)
+		return string(b), err
+	}
+
+	values := make(jsonutil.JSONArr, 0, len(t.transformationConfig.DedupKeyPaths))
+	empty := true
+	for _, path := range t.transformationConfig.DedupKeyPaths {
+		v, err := jsonutil.GetField(obj, path)
+		if err != nil {
+			return "", err
+		}
+		if v != nil {
+			empty = false
+		}
+		values = append(values, v)
+	}
+	if empty {
+		return "", nil
+	}
+	b, err := json.Marshal(values)
+	return string(b), err
+}
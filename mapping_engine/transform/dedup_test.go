@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemoryDedupKeyStore(t *testing.T) {
+	s := NewMemoryDedupKeyStore()
+
+	for _, key := range []string{"a", "b"} {
+		if added, err := s.Add(key); err != nil || !added {
+			t.Errorf("Add(%q) = %v, %v, want true, nil", key, added, err)
+		}
+	}
+	if added, err := s.Add("a"); err != nil || added {
+		t.Errorf("Add(%q) again = %v, %v, want false, nil", "a", added, err)
+	}
+}
+
+func TestMemoryDedupKeyStore_Concurrent(t *testing.T) {
+	s := NewMemoryDedupKeyStore()
+
+	const workers, keys = 10, 100
+	var mu sync.Mutex
+	added := 0
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < keys; k++ {
+				ok, err := s.Add(fmt.Sprintf("key-%d", k))
+				if err != nil {
+					t.Errorf("Add got unexpected error: %v", err)
+					return
+				}
+				if ok {
+					mu.Lock()
+					added++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if added != keys {
+		t.Errorf("got %d keys added, want %d", added, keys)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/builtins" /* copybara-comment: builtins */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/projector" /* copybara-comment: projector */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// uuidProjectorName and currentTimeProjectorName are the names of the builtins that
+// TransformationConfig.DeterministicForTesting makes reproducible.
+const (
+	uuidProjectorName        = "$UUID"
+	currentTimeProjectorName = "$CurrentTime"
+)
+
+// Determinism configures the deterministic mode of TransformationConfig.DeterministicForTesting.
+type Determinism struct {
+	// Seed is the seed of the run. The $UUID builtin draws from a random number generator of each
+	// record, seeded with Seed and the index of the record in ProcessBatch, ProcessStream and
+	// ProcessZip, or the hash of the record in the other methods.
+	Seed int64
+
+	// Clock, if set, is the clock of the $CurrentTime and $ShiftDate builtins and of the timestamps of
+	// error records. By default it always returns the Unix epoch.
+	Clock func() time.Time
+}
+
+// now returns the time of the clock.
+func (d *Determinism) now() time.Time {
+	if d.Clock == nil {
+		return time.Unix(0, 0).UTC()
+	}
+	return d.Clock()
+}
+
+// random returns a new random number generator seeded with the seed of the run and the given key
+// of a record (e.g. its index).
+func (d *Determinism) random(key string) *rand.Rand {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, d.Seed)
+	h.Write([]byte(key))
+	return rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(h.Sum(nil)))))
+}
+
+// indexRandom returns the random number generator of the record with the given index of a batch or
+// stream.
+func (d *Determinism) indexRandom(i int) *rand.Rand {
+	return d.random(fmt.Sprintf("index:%d", i))
+}
+
+// inputRandom returns the random number generator of the given record, whose index is not known.
+func (d *Determinism) inputRandom(in jsonutil.JSONToken) (*rand.Rand, error) {
+	h, err := jsonutil.Hash(in, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not hash the input record: %v", err)
+	}
+	return d.random("input:" + string(h)), nil
+}
+
+// now returns the current time, or the time of the clock of TransformationConfig.DeterministicForTesting
+// if set.
+func (t *DefaultTransformer) now() time.Time {
+	if d := t.transformationConfig.DeterministicForTesting; d != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+// deterministicProjectors creates the reproducible $UUID and $CurrentTime builtins of the given
+// configuration, by name. $UUID draws from the random number generator of the context (see
+// types.Context.Random), which is seeded with the seed of the run alone if the record did not get
+// one (e.g. in Project).
+func deterministicProjectors(d *Determinism) (map[string]types.Projector, error) {
+	currentTime, err := projector.FromFunction(builtins.NewCurrentTime(d.now), currentTimeProjectorName)
+	if err != nil {
+		return nil, err
+	}
+	uuid := func(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("%s expects no arguments, got %d", uuidProjectorName, len(args))
+		}
+		if pctx.Random == nil {
+			pctx.Random = d.random("")
+		}
+		return builtins.RandomUUID(pctx.Random)
+	}
+	return map[string]types.Projector{
+		uuidProjectorName:        uuid,
+		currentTimeProjectorName: currentTime,
+	}, nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	dhpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: data_harmonization_go_proto */
+	hpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: harmonization_go_proto */
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+const deterministicWhistle = `
+out Patient: Patient($root)
+
+def Patient(p) {
+  id: $UUID()
+  identifier[0].value: p.mrn
+  meta.lastUpdated: $CurrentTime("2006-01-02T15:04:05Z07:00", "UTC")
+  contained[]: Contact(p.contacts[])
+}
+
+def Contact(c) {
+  id: $UUID()
+  name: c
+}`
+
+func compileDeterministic(t *testing.T, d *Determinism) *CompiledConfig {
+	t.Helper()
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: deterministicWhistle,
+			},
+		},
+	}
+	compiled, err := CompileConfig(context.Background(), dhconfig, TransformationConfig{SkipBundling: true, DeterministicForTesting: d})
+	if err != nil {
+		t.Fatalf("could not compile config: %v", err)
+	}
+	return compiled
+}
+
+func deterministicRecords(t *testing.T, n int) []jsonutil.JSONToken {
+	t.Helper()
+	var records []jsonutil.JSONToken
+	for i := 0; i < n; i++ {
+		r, err := jsonutil.UnmarshalJSON(json.RawMessage(fmt.Sprintf(`{"mrn": "%d", "contacts": ["a", "b"]}`, i%4)))
+		if err != nil {
+			t.Fatalf("could not parse record %d: %v", i, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func marshalOutputs(t *testing.T, outputs []jsonutil.JSONToken) []string {
+	t.Helper()
+	var res []string
+	for _, o := range outputs {
+		b, err := json.Marshal(o)
+		if err != nil {
+			t.Fatalf("could not marshal output %v: %v", o, err)
+		}
+		res = append(res, string(b))
+	}
+	return res
+}
+
+func TestTransformer_DeterministicForTesting_ProcessBatch(t *testing.T) {
+	clock := func() time.Time { return time.Date(2021, time.March, 4, 15, 30, 0, 0, time.UTC) }
+	records := deterministicRecords(t, 8)
+
+	run := func(seed int64) []string {
+		tr, err := NewEngine(compileDeterministic(t, &Determinism{Seed: seed, Clock: clock}))
+		if err != nil {
+			t.Fatalf("NewEngine got unexpected error: %v", err)
+		}
+		res, err := tr.ProcessBatch(records)
+		if err != nil {
+			t.Fatalf("ProcessBatch got unexpected error: %v", err)
+		}
+		return marshalOutputs(t, res.Outputs)
+	}
+
+	got := run(42)
+	if diff := cmp.Diff(got, run(42)); diff != "" {
+		t.Errorf("ProcessBatch returned different outputs for the same seed (-first +second):\n%s", diff)
+	}
+	if cmp.Equal(got, run(7)) {
+		t.Errorf("ProcessBatch returned the same outputs for different seeds: %v", got)
+	}
+
+	// Records are seeded by their index, so equal records still get different UUIDs.
+	ids := make(map[string]bool)
+	for i, o := range got {
+		var out struct {
+			Patient []struct {
+				ID   string `json:"id"`
+				Meta struct {
+					LastUpdated string `json:"lastUpdated"`
+				} `json:"meta"`
+				Contained []struct {
+					ID string `json:"id"`
+				} `json:"contained"`
+			}
+		}
+		if err := json.Unmarshal([]byte(o), &out); err != nil || len(out.Patient) != 1 {
+			t.Fatalf("could not parse output %d %s: %v", i, o, err)
+		}
+		p := out.Patient[0]
+		if want := "2021-03-04T15:30:00Z"; p.Meta.LastUpdated != want {
+			t.Errorf("output %d has meta.lastUpdated %q, want %q", i, p.Meta.LastUpdated, want)
+		}
+		for _, id := range []string{p.ID, p.Contained[0].ID, p.Contained[1].ID} {
+			if ids[id] {
+				t.Errorf("output %d repeats UUID %s", i, id)
+			}
+			ids[id] = true
+		}
+	}
+}
+
+func TestTransformer_DeterministicForTesting_Workers(t *testing.T) {
+	compiled := compileDeterministic(t, &Determinism{Seed: 42})
+	records := deterministicRecords(t, 16)
+
+	// run transforms the records with the given number of workers, each with an engine of its own.
+	run := func(workers int) []string {
+		outputs := make([]jsonutil.JSONToken, len(records))
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				tr, err := NewEngine(compiled)
+				if err != nil {
+					t.Errorf("NewEngine got unexpected error: %v", err)
+					return
+				}
+				for i := w; i < len(records); i += workers {
+					out, err := tr.Transform(records[i])
+					if err != nil {
+						t.Errorf("Transform(%v) got unexpected error: %v", records[i], err)
+						return
+					}
+					outputs[i] = out
+				}
+			}(w)
+		}
+		wg.Wait()
+		return marshalOutputs(t, outputs)
+	}
+
+	want := run(1)
+	for _, workers := range []int{1, 4, 16} {
+		if diff := cmp.Diff(want, run(workers)); diff != "" {
+			t.Errorf("Transform with %d workers returned diff (-want +got):\n%s", workers, diff)
+		}
+	}
+
+	// The default clock is the Unix epoch.
+	if lastUpdated := `"lastUpdated":"1970-01-01T00:00:00Z"`; !strings.Contains(want[0], lastUpdated) {
+		t.Errorf("Transform returned %s, want it to contain %s", want[0], lastUpdated)
+	}
+}
+
+func TestTransformer_DeterministicForTesting_ShiftDate(t *testing.T) {
+	const date = "2021-01-01"
+	clock := func() time.Time { return time.Date(2021, time.January, 1, 12, 0, 0, 0, time.UTC) }
+	str := func(s string) *mappb.ValueSource {
+		return &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: s}}
+	}
+
+	// Each key maps a date of the clock's day to a field, shifted by up to 10000 days.
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	var mappings []*mappb.FieldMapping
+	for _, k := range keys {
+		vs := str(date)
+		vs.Projector = shiftDateProjectorName
+		vs.AdditionalArg = []*mappb.ValueSource{str("2006-01-02"), str(k), {Source: &mappb.ValueSource_ConstInt{ConstInt: 10000}}}
+		mappings = append(mappings, &mappb.FieldMapping{ValueSource: vs, Target: &mappb.FieldMapping_TargetField{TargetField: k}})
+	}
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingConfig{
+				MappingConfig: &mappb.MappingConfig{
+					RootMapping: []*mappb.FieldMapping{
+						{
+							ValueSource: &mappb.ValueSource{Projector: "Dates"},
+							Target:      &mappb.FieldMapping_TargetObject{TargetObject: "Dates"},
+						},
+					},
+					Projector: []*mappb.ProjectorDefinition{{Name: "Dates", Mapping: mappings}},
+				},
+			},
+		},
+	}
+	tconfig := TransformationConfig{SkipBundling: true, DateShiftSecret: []byte("secret"), DeterministicForTesting: &Determinism{Clock: clock}}
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, tconfig)
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	out, err := tr.Transform(jsonutil.JSONContainer{})
+	if err != nil {
+		t.Fatalf("Transform got unexpected error: %v", err)
+	}
+
+	// Dates shifted forward are clamped to the clock, not to the wall clock time.
+	var got struct {
+		Dates []map[string]string
+	}
+	if b, err := json.Marshal(out); err != nil || json.Unmarshal(b, &got) != nil || len(got.Dates) != 1 {
+		t.Fatalf("could not parse output %v: %v", out, err)
+	}
+	clamped := 0
+	for _, k := range keys {
+		if shifted := got.Dates[0][k]; shifted > date {
+			t.Errorf("$ShiftDate(%q, key %q) = %q, want it on or before %s", date, k, shifted, date)
+		} else if shifted == date {
+			clamped++
+		}
+	}
+	if clamped == 0 {
+		t.Errorf("$ShiftDate did not shift %s forward for any of the keys %v, got %v", date, keys, got.Dates[0])
+	}
+}
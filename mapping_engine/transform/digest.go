@@ -0,0 +1,214 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto" /* copybara-comment: proto */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+
+	mappb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// DigestStore records the digests of the input records processed so far, by record ID, so that
+// unchanged records can be skipped (see TransformIfChanged). Implementations must be safe for
+// concurrent use, and are usually backed by an external store to skip records across runs.
+type DigestStore interface {
+	// Get returns the digest recorded for the given record ID, and false if there is none.
+	Get(id string) (string, bool, error)
+	// Put records the digest of the given record ID, replacing any earlier one.
+	Put(id, digest string) error
+}
+
+// MemoryDigestStore is a DigestStore that keeps the digests in memory.
+type MemoryDigestStore struct {
+	mu      sync.Mutex
+	digests map[string]string
+}
+
+// NewMemoryDigestStore creates an empty MemoryDigestStore.
+func NewMemoryDigestStore() *MemoryDigestStore {
+	return &MemoryDigestStore{digests: make(map[string]string)}
+}
+
+// Get returns the digest recorded for the given record ID, and false if there is none.
+func (s *MemoryDigestStore) Get(id string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.digests[id]
+	return d, ok, nil
+}
+
+// Put records the digest of the given record ID, replacing any earlier one.
+func (s *MemoryDigestStore) Put(id, digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.digests[id] = digest
+	return nil
+}
+
+// RecordStatus is what TransformIfChanged did with a record.
+type RecordStatus int
+
+const (
+	// RecordProcessed means the record was new or changed, and was transformed.
+	RecordProcessed RecordStatus = iota
+	// RecordSkipped means the record was unchanged since it was last transformed, and was skipped.
+	RecordSkipped
+)
+
+func (s RecordStatus) String() string {
+	switch s {
+	case RecordProcessed:
+		return "processed"
+	case RecordSkipped:
+		return "skipped"
+	default:
+		return fmt.Sprintf("RecordStatus(%d)", int(s))
+	}
+}
+
+// IncrementalResult is the result of TransformIfChanged.
+type IncrementalResult struct {
+	Status RecordStatus
+	// Output is the output of the record, or null if it was skipped.
+	Output jsonutil.JSONToken
+	// Digest is the digest of the record.
+	Digest string
+}
+
+// TransformIfChanged transforms the given record like Transform, unless its digest matches the one
+// recorded for its ID in TransformationConfig.DigestStore, i.e. unless it is unchanged since it was
+// last transformed. The digest ignores key order and TransformationConfig.DigestIgnorePaths. It
+// also covers the mappings (including those of libraries), so all records are transformed again
+// once they change. The digest is only recorded once the record is transformed successfully, so
+// failed records are retried.
+func (t *DefaultTransformer) TransformIfChanged(id string, in jsonutil.JSONToken) (*IncrementalResult, error) {
+	digest, err := t.digest(in)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute digest of record %q: %v", id, err)
+	}
+
+	prev, ok, err := t.digestStore.Get(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get digest of record %q: %v", id, err)
+	}
+	if ok && prev == digest {
+		return &IncrementalResult{Status: RecordSkipped, Digest: digest}, nil
+	}
+
+	out, err := t.Transform(in)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.digestStore.Put(id, digest); err != nil {
+		return nil, fmt.Errorf("could not record digest of record %q: %v", id, err)
+	}
+	return &IncrementalResult{Status: RecordProcessed, Output: out, Digest: digest}, nil
+}
+
+// digest returns the canonical digest of the given record, without the digest ignore paths, salted
+// with the fingerprint of the config.
+func (t *DefaultTransformer) digest(in jsonutil.JSONToken) (string, error) {
+	if len(t.digestIgnorePaths) > 0 {
+		in = jsonutil.Deepcopy(in)
+		for _, segs := range t.digestIgnorePaths {
+			in = removePath(in, segs)
+		}
+	}
+	h, err := jsonutil.Hash(in, false)
+	if err != nil {
+		return "", err
+	}
+	if len(t.configFingerprint) == 0 {
+		return hex.EncodeToString(h), nil
+	}
+	salted := sha256.Sum256(append(append([]byte{}, t.configFingerprint...), h...))
+	return hex.EncodeToString(salted[:]), nil
+}
+
+// configFingerprint returns a hash of the given mapping config and projector definitions, which
+// changes whenever any of the mappings do.
+func configFingerprint(mpc *mappb.MappingConfig, defs []*mappb.ProjectorDefinition) ([]byte, error) {
+	msgs := []proto.Message{mpc}
+	for _, d := range defs {
+		msgs = append(msgs, d)
+	}
+
+	h := sha256.New()
+	for _, m := range msgs {
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+		if err != nil {
+			return nil, err
+		}
+		// Each message is prefixed with its length, so that moving bytes across messages changes the
+		// fingerprint.
+		var n [8]byte
+		binary.BigEndian.PutUint64(n[:], uint64(len(b)))
+		h.Write(n[:])
+		h.Write(b)
+	}
+	return h.Sum(nil), nil
+}
+
+// removePath removes the field at the given segmented path from the given token, which is modified
+// in place. [*] segments apply to all items of an array. Array items are set to null rather than
+// removed, so that the indices of the other items do not change.
+func removePath(tok jsonutil.JSONToken, segs []string) jsonutil.JSONToken {
+	if len(segs) == 0 {
+		return nil
+	}
+	seg, rest := segs[0], segs[1:]
+
+	switch t := tok.(type) {
+	case jsonutil.JSONContainer:
+		v, ok := t[seg]
+		if !ok {
+			return t
+		}
+		if len(rest) == 0 {
+			delete(t, seg)
+			return t
+		}
+		r := removePath(*v, rest)
+		t[seg] = &r
+	case jsonutil.JSONArr:
+		if seg == "[*]" {
+			for i := range t {
+				t[i] = removePath(t[i], rest)
+			}
+			return t
+		}
+		if !jsonutil.IsIndex(seg) {
+			return t
+		}
+		i, err := strconv.Atoi(strings.Trim(seg, "[]"))
+		if err != nil || i < 0 || i >= len(t) {
+			return t
+		}
+		t[i] = removePath(t[i], rest)
+	}
+	return tok
+}
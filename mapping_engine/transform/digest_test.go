@@ -0,0 +1,100 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestMemoryDigestStore(t *testing.T) {
+	s := NewMemoryDigestStore()
+
+	if d, ok, err := s.Get("a"); err != nil || ok {
+		t.Errorf("Get(a) = %q, %v, %v, want false", d, ok, err)
+	}
+	for _, digest := range []string{"1", "2"} {
+		if err := s.Put("a", digest); err != nil {
+			t.Fatalf("Put(a, %s) got unexpected error: %v", digest, err)
+		}
+		if d, ok, err := s.Get("a"); err != nil || !ok || d != digest {
+			t.Errorf("Get(a) = %q, %v, %v, want %q, true, nil", d, ok, err, digest)
+		}
+	}
+}
+
+func TestRemovePath(t *testing.T) {
+	in := `{"id": "1", "meta": {"lastUpdated": "today", "source": "s"}, "entry": [{"fullUrl": "a", "v": 1}, {"fullUrl": "b", "v": 2}]}`
+	tests := []struct {
+		path string
+		want string
+	}{
+		{
+			path: "id",
+			want: `{"meta": {"lastUpdated": "today", "source": "s"}, "entry": [{"fullUrl": "a", "v": 1}, {"fullUrl": "b", "v": 2}]}`,
+		},
+		{
+			path: "meta.lastUpdated",
+			want: `{"id": "1", "meta": {"source": "s"}, "entry": [{"fullUrl": "a", "v": 1}, {"fullUrl": "b", "v": 2}]}`,
+		},
+		{
+			path: "entry[*].fullUrl",
+			want: `{"id": "1", "meta": {"lastUpdated": "today", "source": "s"}, "entry": [{"v": 1}, {"v": 2}]}`,
+		},
+		{
+			path: "entry[1].fullUrl",
+			want: `{"id": "1", "meta": {"lastUpdated": "today", "source": "s"}, "entry": [{"fullUrl": "a", "v": 1}, {"v": 2}]}`,
+		},
+		{
+			path: "entry[0]",
+			want: `{"id": "1", "meta": {"lastUpdated": "today", "source": "s"}, "entry": [null, {"fullUrl": "b", "v": 2}]}`,
+		},
+		{
+			path: "missing.field",
+			want: in,
+		},
+		{
+			path: "entry[5].fullUrl",
+			want: in,
+		},
+		{
+			path: "id.nested",
+			want: in,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			tok, err := jsonutil.UnmarshalJSON(json.RawMessage(in))
+			if err != nil {
+				t.Fatalf("UnmarshalJSON(%s) got unexpected error: %v", in, err)
+			}
+			want, err := jsonutil.UnmarshalJSON(json.RawMessage(test.want))
+			if err != nil {
+				t.Fatalf("UnmarshalJSON(%s) got unexpected error: %v", test.want, err)
+			}
+			segs, err := jsonutil.SegmentPath(test.path)
+			if err != nil {
+				t.Fatalf("SegmentPath(%s) got unexpected error: %v", test.path, err)
+			}
+
+			if diff := cmp.Diff(want, removePath(tok, segs)); diff != "" {
+				t.Errorf("removePath(%s) returned diff (-want +got):\n%s", test.path, diff)
+			}
+		})
+	}
+}
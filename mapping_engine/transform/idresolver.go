@@ -0,0 +1,58 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// resolveIDProjectorName is the name of the builtin that resolves the ids of output resources with
+// the IDResolver of the transformation (see TransformationConfig.IDResolver).
+const resolveIDProjectorName = "$ResolveID"
+
+// resolveIDProjector returns the id of the resource of the given type with the given identifiers,
+// as resolved by the IDResolver in the context. It fails if there is no IDResolver, rather than
+// returning null, since resources without ids would not be linked up downstream. Errors of the
+// resolver are returned as types.IDResolutionErrors naming the resource type.
+func resolveIDProjector(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%s expects 2 arguments, got %d", resolveIDProjectorName, len(args))
+	}
+
+	resourceType, err := jsonutil.NodeToToken(args[0])
+	if err != nil {
+		return nil, err
+	}
+	rt, ok := resourceType.(jsonutil.JSONStr)
+	if !ok || rt == "" {
+		return nil, fmt.Errorf("%s expects a non-empty string resource type, got %v", resolveIDProjectorName, resourceType)
+	}
+	identifiers, err := jsonutil.NodeToToken(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if pctx.IDResolver == nil {
+		return nil, fmt.Errorf("%s can not resolve the id of %s since no IDResolver is configured", resolveIDProjectorName, rt)
+	}
+	id, err := pctx.IDResolver.Resolve(string(rt), identifiers)
+	if err != nil {
+		return nil, types.IDResolutionError{ResourceType: string(rt), Identifiers: identifiers, Err: err}
+	}
+	return jsonutil.JSONStr(id), nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	dhpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: data_harmonization_go_proto */
+	hpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: harmonization_go_proto */
+)
+
+const resolveIDWhistle = `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  id: $ResolveID("Patient", p.identifier)
+}`
+
+// failingIDResolver fails to resolve the identifiers with the value "unknown".
+type failingIDResolver struct {
+	types.IDResolver
+}
+
+func (r failingIDResolver) Resolve(resourceType string, identifiers jsonutil.JSONToken) (string, error) {
+	if v, err := jsonutil.GetField(identifiers, "[0].value"); err == nil && v == jsonutil.JSONStr("unknown") {
+		return "", fmt.Errorf("no match in the patient index")
+	}
+	return r.IDResolver.Resolve(resourceType, identifiers)
+}
+
+func newResolveIDTransformer(t *testing.T, tconfig TransformationConfig) *DefaultTransformer {
+	t.Helper()
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: resolveIDWhistle,
+			},
+		},
+	}
+	tconfig.SkipBundling = true
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, tconfig)
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	return tr
+}
+
+func parseRecords(t *testing.T, tr *DefaultTransformer, records ...string) []jsonutil.JSONToken {
+	t.Helper()
+	var parsed []jsonutil.JSONToken
+	for _, r := range records {
+		p, err := tr.ParseJSON(json.RawMessage(r))
+		if err != nil {
+			t.Fatalf("ParseJSON(%s) got unexpected error: %v", r, err)
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed
+}
+
+func TestTransformer_ResolveID(t *testing.T) {
+	resolver := types.NewInMemoryIDResolver()
+	tr := newResolveIDTransformer(t, TransformationConfig{IDResolver: resolver})
+
+	records := parseRecords(t, tr,
+		`{"identifier": [{"system": "urn:mrn", "value": "1"}]}`,
+		`{"identifier": [{"system": "urn:mrn", "value": "2"}]}`,
+		`{"identifier": [{"value": "1", "system": "urn:mrn"}]}`)
+	res, err := tr.ProcessBatch(records)
+	if err != nil {
+		t.Fatalf("ProcessBatch got unexpected error: %v", err)
+	}
+
+	got, err := json.Marshal(res.Outputs)
+	if err != nil {
+		t.Fatalf("could not marshal outputs: %v", err)
+	}
+	want := `[{"Patient":[{"id":"Patient-1"}]},{"Patient":[{"id":"Patient-2"}]},{"Patient":[{"id":"Patient-1"}]}]`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("ProcessBatch returned diff (-want +got):\n%s", diff)
+	}
+
+	// The same identifiers are only resolved once, also in later batches.
+	if _, err := tr.ProcessBatch(records[:1]); err != nil {
+		t.Fatalf("ProcessBatch got unexpected error: %v", err)
+	}
+	if got := resolver.Calls(); got != 2 {
+		t.Errorf("IDResolver was called %d times, want 2", got)
+	}
+}
+
+func TestTransformer_ResolveIDErrors(t *testing.T) {
+	tr := newResolveIDTransformer(t, TransformationConfig{
+		IDResolver:        failingIDResolver{types.NewInMemoryIDResolver()},
+		RecordErrorPolicy: CollectRecordErrors,
+	})
+
+	records := parseRecords(t, tr,
+		`{"identifier": [{"value": "1"}]}`,
+		`{"identifier": [{"value": "unknown"}]}`)
+	res, err := tr.ProcessBatch(records)
+	if err != nil {
+		t.Fatalf("ProcessBatch got unexpected error: %v", err)
+	}
+	if len(res.Errors) != 1 {
+		t.Fatalf("ProcessBatch returned errors %v, want one for record 1", res.Errors)
+	}
+
+	recErr := res.Errors[0]
+	var resErr types.IDResolutionError
+	if recErr.Index != 1 || !stderrors.As(recErr, &resErr) || resErr.ResourceType != "Patient" {
+		t.Errorf("ProcessBatch returned error %v, want an IDResolutionError of a Patient for record 1", recErr)
+	}
+	if want := `could not resolve the id of Patient with the given (redacted) identifiers: no match in the patient index`; !strings.Contains(recErr.Error(), want) {
+		t.Errorf("ProcessBatch returned error %v, want one containing %q", recErr, want)
+	}
+	if strings.Contains(recErr.Error(), "unknown") {
+		t.Errorf("ProcessBatch returned error %v, want the identifiers redacted", recErr)
+	}
+}
+
+func TestTransformer_ResolveIDWithoutResolver(t *testing.T) {
+	tr := newResolveIDTransformer(t, TransformationConfig{})
+
+	in := parseRecords(t, tr, `{"identifier": [{"value": "1"}]}`)[0]
+	wantErr := "no IDResolver is configured"
+	if _, err := tr.Transform(in); err == nil || !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("Transform got error %v, want error containing %q", err, wantErr)
+	}
+}
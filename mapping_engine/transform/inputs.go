@@ -0,0 +1,61 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// TransformInputs transforms the given named inputs (e.g. a message and a roster record) together.
+// The mapping config declares the names of the inputs it reads (see
+// MappingConfig.root_input_name), and $root is an object with all of them. It is equivalent to
+// calling Transform with that object.
+func (t *DefaultTransformer) TransformInputs(inputs map[string]jsonutil.JSONToken) (jsonutil.JSONToken, error) {
+	in := make(jsonutil.JSONContainer, len(inputs))
+	for name, input := range inputs {
+		input := input
+		in[name] = &input
+	}
+	return t.Transform(in)
+}
+
+// rootArgs returns the arguments of the root mappings for the given (pre-processed) input, i.e. the
+// input itself, followed by the named inputs declared by the mapping config.
+func (t *DefaultTransformer) rootArgs(in jsonutil.JSONToken) ([]jsonutil.JSONMetaNode, error) {
+	inn, err := jsonutil.TokenToNode(in)
+	if err != nil {
+		return nil, fmt.Errorf("input was invalid: %v", err)
+	}
+	args := []jsonutil.JSONMetaNode{inn}
+
+	names := t.mappingConfig.GetRootInputName()
+	if len(names) == 0 {
+		return args, nil
+	}
+	cn, ok := inn.(jsonutil.JSONMetaContainerNode)
+	if !ok {
+		return nil, fmt.Errorf("the mapping config expects the inputs %v, so the input must be an object with them but was %T", names, in)
+	}
+	for _, name := range names {
+		n := cn.Children[name]
+		if n == nil {
+			return nil, fmt.Errorf("missing input %q (the mapping config expects the inputs %v)", name, names)
+		}
+		args = append(args, n)
+	}
+	return args, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"sort"
+	"sync"
+)
+
+// MappingStat counts the evaluations of a single field mapping, and how many of them had an empty
+// source (so that nothing was written).
+type MappingStat struct {
+	// Projector is the name of the projector the mapping is in, or root for the root mappings.
+	Projector string `json:"projector"`
+	// Mapping is the number of the mapping within the projector, starting at 1 (as in errors).
+	Mapping int `json:"mapping"`
+	// Target is the target of the mapping, e.g. birthDate or var x. It is empty for mappings to this.
+	Target      string `json:"target"`
+	Evaluations int    `json:"evaluations"`
+	Empty       int    `json:"empty"`
+	// EmptyRatio is Empty / Evaluations.
+	EmptyRatio float64 `json:"emptyRatio"`
+}
+
+// MappingStatsReport is the report of the field mappings evaluated in a run (see
+// TransformationConfig.MappingStats). It is meant to be marshalled to JSON.
+type MappingStatsReport struct {
+	Mappings []MappingStat `json:"mappings"`
+}
+
+type mappingKey struct {
+	projector string
+	index     int
+}
+
+// mappingStats counts the evaluations of the field mappings. It is safe for concurrent use.
+type mappingStats struct {
+	mu    sync.Mutex
+	stats map[mappingKey]*MappingStat
+}
+
+// RecordMapping implements types.MappingStatsRecorder.
+func (s *mappingStats) RecordMapping(projector string, index int, target string, empty bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stats == nil {
+		s.stats = make(map[mappingKey]*MappingStat)
+	}
+	k := mappingKey{projector: projector, index: index}
+	st, ok := s.stats[k]
+	if !ok {
+		st = &MappingStat{Projector: projector, Mapping: index + 1, Target: target}
+		s.stats[k] = st
+	}
+	st.Evaluations++
+	if empty {
+		st.Empty++
+	}
+}
+
+func (s *mappingStats) report() MappingStatsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := MappingStatsReport{Mappings: make([]MappingStat, 0, len(s.stats))}
+	for _, st := range s.stats {
+		c := *st
+		c.EmptyRatio = float64(c.Empty) / float64(c.Evaluations)
+		r.Mappings = append(r.Mappings, c)
+	}
+	sort.Slice(r.Mappings, func(i, j int) bool {
+		if r.Mappings[i].Projector != r.Mappings[j].Projector {
+			return r.Mappings[i].Projector < r.Mappings[j].Projector
+		}
+		return r.Mappings[i].Mapping < r.Mappings[j].Mapping
+	})
+	return r
+}
+
+// MappingStats returns the evaluation counts of the field mappings so far, by projector and mapping
+// number. It is empty unless TransformationConfig.MappingStats is set.
+func (t *DefaultTransformer) MappingStats() MappingStatsReport {
+	if t.mappingStats == nil {
+		return MappingStatsReport{Mappings: []MappingStat{}}
+	}
+	return t.mappingStats.report()
+}
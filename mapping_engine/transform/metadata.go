@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// mappingMetaProjectorName is the name of the builtin that exposes TransformationConfig.Metadata to
+// mappings.
+const mappingMetaProjectorName = "$MappingMeta"
+
+// mappingMetaProjector returns a projector that looks up the given metadata key, returning null if
+// it is not set.
+func mappingMetaProjector(metadata map[string]string) types.Projector {
+	return func(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s expects 1 argument, got %d", mappingMetaProjectorName, len(args))
+		}
+
+		key, err := jsonutil.NodeToToken(args[0])
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(jsonutil.JSONStr)
+		if !ok {
+			return nil, fmt.Errorf("%s expects a string key, got %T", mappingMetaProjectorName, key)
+		}
+
+		if v, ok := metadata[string(k)]; ok {
+			return jsonutil.JSONStr(v), nil
+		}
+		return nil, nil
+	}
+}
+
+// metadataStamp returns the value written by stampMetadata. For array paths (i.e. ending in [], like
+// meta.tag[]) this is a list of {"system": key, "code": value} entries sorted by key, which are
+// appended to the array, otherwise it is an object of all the metadata.
+func metadataStamp(path string, metadata map[string]string) jsonutil.JSONToken {
+	if !strings.HasSuffix(path, "[]") {
+		c := make(jsonutil.JSONContainer)
+		for k, v := range metadata {
+			var val jsonutil.JSONToken = jsonutil.JSONStr(v)
+			c[k] = &val
+		}
+		return c
+	}
+
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	arr := make(jsonutil.JSONArr, 0, len(keys))
+	for _, k := range keys {
+		var system, code jsonutil.JSONToken = jsonutil.JSONStr(k), jsonutil.JSONStr(metadata[k])
+		arr = append(arr, jsonutil.JSONContainer{"system": &system, "code": &code})
+	}
+	return arr
+}
+
+// stampMetadata writes the given metadata to the given path in every top level output object (see
+// forEachTopLevelObject). It must be called before post processing, so the post process projector
+// sees the stamped objects.
+func stampMetadata(pctx *types.Context, path string, metadata map[string]string) error {
+	return forEachTopLevelObject(pctx, func(_ string, _ int, obj jsonutil.JSONToken) error {
+		if _, ok := obj.(jsonutil.JSONContainer); !ok {
+			return nil
+		}
+		if err := jsonutil.SetField(metadataStamp(path, metadata), path, &obj, false, false); err != nil {
+			return fmt.Errorf("could not stamp metadata on %q: %v", path, err)
+		}
+		return nil
+	})
+}
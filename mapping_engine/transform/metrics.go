@@ -0,0 +1,225 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The names of the metrics the transformer emits to TransformationConfig.Metrics. They are stable,
+// so that dashboards and alerts can rely on them.
+const (
+	// MetricRecordsStarted counts the records whose transformation started.
+	MetricRecordsStarted = "whistle_records_started_total"
+	// MetricRecordsProcessed counts the records that were transformed successfully.
+	MetricRecordsProcessed = "whistle_records_processed_total"
+	// MetricRecordsFailed counts the records that failed to transform.
+	MetricRecordsFailed = "whistle_records_failed_total"
+	// MetricRootMappingErrors counts the root mappings that failed (at most one per record, except
+	// with TransformPartial).
+	MetricRootMappingErrors = "whistle_root_mapping_errors_total"
+	// MetricOutputs counts the output objects written, before post processing, labelled with their
+	// target (e.g. {"target": "Patient"}).
+	MetricOutputs = "whistle_outputs_total"
+	// MetricRecordDuration observes how long each record took to transform, in seconds, whether it
+	// succeeded or not.
+	MetricRecordDuration = "whistle_record_duration_seconds"
+	// MetricPostProcessDuration observes how long the post processing of each record took, in
+	// seconds.
+	MetricPostProcessDuration = "whistle_post_process_duration_seconds"
+
+	// MetricTargetLabel is the label of MetricOutputs with the name of the target.
+	MetricTargetLabel = "target"
+)
+
+// MetricsCollector receives the metrics of the transformer (see the Metric constants), e.g. to
+// export them to a monitoring system. Implementations must be safe for concurrent use, since
+// records may be transformed concurrently. Prometheus users can implement it with a CounterVec and
+// a HistogramVec per name.
+type MetricsCollector interface {
+	// Inc increments the counter with the given name and labels by one.
+	Inc(name string, labels map[string]string)
+	// Observe records the given value (e.g. a duration in seconds) in the distribution with the given
+	// name and labels.
+	Observe(name string, labels map[string]string, value float64)
+}
+
+// maxMetricSamples is the number of most recent observations a distribution of InMemoryMetrics keeps
+// to compute its quantiles.
+const maxMetricSamples = 1024
+
+// MetricKey returns the key of the metric with the given name and labels in a MetricsSnapshot, in
+// the Prometheus text format, e.g. whistle_outputs_total{target="Patient"}. Labels are sorted by
+// name.
+func MetricKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	names := make([]string, 0, len(labels))
+	for n := range labels {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(n)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[n]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// DistributionSnapshot summarizes the values observed for a distribution metric. The quantiles are
+// those of the most recent 1024 observations.
+type DistributionSnapshot struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// MetricsSnapshot is the state of the metrics of an InMemoryMetrics at one point in time, keyed by
+// MetricKey. It is meant to be marshalled to JSON.
+type MetricsSnapshot struct {
+	Counters      map[string]int64                `json:"counters"`
+	Distributions map[string]DistributionSnapshot `json:"distributions"`
+}
+
+type distribution struct {
+	count   int64
+	sum     float64
+	samples []float64
+	// next is the index in samples to overwrite once it is full.
+	next int
+}
+
+// InMemoryMetrics is a MetricsCollector that keeps the metrics in memory, to be read with
+// Snapshot. It is safe for concurrent use.
+type InMemoryMetrics struct {
+	mu            sync.Mutex
+	counters      map[string]int64
+	distributions map[string]*distribution
+}
+
+// NewInMemoryMetrics creates an empty InMemoryMetrics.
+func NewInMemoryMetrics() *InMemoryMetrics {
+	return &InMemoryMetrics{
+		counters:      map[string]int64{},
+		distributions: map[string]*distribution{},
+	}
+}
+
+// Inc implements MetricsCollector.
+func (m *InMemoryMetrics) Inc(name string, labels map[string]string) {
+	k := MetricKey(name, labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[k]++
+}
+
+// Observe implements MetricsCollector.
+func (m *InMemoryMetrics) Observe(name string, labels map[string]string, value float64) {
+	k := MetricKey(name, labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.distributions[k]
+	if !ok {
+		d = &distribution{}
+		m.distributions[k] = d
+	}
+	d.count++
+	d.sum += value
+	if len(d.samples) < maxMetricSamples {
+		d.samples = append(d.samples, value)
+	} else {
+		d.samples[d.next] = value
+		d.next = (d.next + 1) % maxMetricSamples
+	}
+}
+
+// Snapshot returns the current state of the metrics.
+func (m *InMemoryMetrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := MetricsSnapshot{
+		Counters:      make(map[string]int64, len(m.counters)),
+		Distributions: make(map[string]DistributionSnapshot, len(m.distributions)),
+	}
+	for k, c := range m.counters {
+		s.Counters[k] = c
+	}
+	for k, d := range m.distributions {
+		sorted := append([]float64(nil), d.samples...)
+		sort.Float64s(sorted)
+		s.Distributions[k] = DistributionSnapshot{
+			Count: d.count,
+			Sum:   d.sum,
+			P50:   quantile(sorted, 0.5),
+			P95:   quantile(sorted, 0.95),
+			P99:   quantile(sorted, 0.99),
+		}
+	}
+	return s
+}
+
+// quantile returns the q-quantile of the given sorted values, by the nearest-rank method.
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(q * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// ExpvarMetrics is an InMemoryMetrics that is also an expvar.Var, so that its snapshot can be
+// published with expvar.Publish, e.g. expvar.Publish("whistle", NewExpvarMetrics()).
+type ExpvarMetrics struct {
+	*InMemoryMetrics
+}
+
+// NewExpvarMetrics creates an empty ExpvarMetrics.
+func NewExpvarMetrics() ExpvarMetrics {
+	return ExpvarMetrics{InMemoryMetrics: NewInMemoryMetrics()}
+}
+
+// String implements expvar.Var, returning the snapshot of the metrics as JSON.
+func (m ExpvarMetrics) String() string {
+	b, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		// Only non-finite observations can not be marshalled.
+		return "{}"
+	}
+	return string(b)
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"expvar"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestMetricKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{
+			name: "whistle_records_started_total",
+			want: "whistle_records_started_total",
+		},
+		{
+			name:   "whistle_outputs_total",
+			labels: map[string]string{"target": "Patient"},
+			want:   `whistle_outputs_total{target="Patient"}`,
+		},
+		{
+			name:   "m",
+			labels: map[string]string{"b": `say "hi"`, "a": "1"},
+			want:   `m{a="1",b="say \"hi\""}`,
+		},
+	}
+	for _, test := range tests {
+		if got := MetricKey(test.name, test.labels); got != test.want {
+			t.Errorf("MetricKey(%q, %v) = %q, want %q", test.name, test.labels, got, test.want)
+		}
+	}
+}
+
+func TestInMemoryMetrics(t *testing.T) {
+	m := NewInMemoryMetrics()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.Inc(MetricRecordsStarted, nil)
+			m.Inc(MetricOutputs, map[string]string{MetricTargetLabel: "Patient"})
+			m.Observe(MetricRecordDuration, nil, float64(i))
+		}(i)
+	}
+	wg.Wait()
+	m.Inc(MetricOutputs, map[string]string{MetricTargetLabel: "Observation"})
+
+	want := MetricsSnapshot{
+		Counters: map[string]int64{
+			MetricRecordsStarted:                          100,
+			`whistle_outputs_total{target="Patient"}`:     100,
+			`whistle_outputs_total{target="Observation"}`: 1,
+		},
+		Distributions: map[string]DistributionSnapshot{
+			MetricRecordDuration: {Count: 100, Sum: 5050, P50: 50, P95: 95, P99: 99},
+		},
+	}
+	if diff := cmp.Diff(want, m.Snapshot()); diff != "" {
+		t.Errorf("Snapshot() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestInMemoryMetrics_RecentSamples(t *testing.T) {
+	m := NewInMemoryMetrics()
+	// The quantiles only cover the most recent observations, which are all 10.
+	for i := 0; i < maxMetricSamples; i++ {
+		m.Observe(MetricPostProcessDuration, nil, 1000)
+	}
+	for i := 0; i < maxMetricSamples; i++ {
+		m.Observe(MetricPostProcessDuration, nil, 10)
+	}
+
+	want := DistributionSnapshot{Count: 2 * maxMetricSamples, Sum: 1010 * maxMetricSamples, P50: 10, P95: 10, P99: 10}
+	if diff := cmp.Diff(want, m.Snapshot().Distributions[MetricPostProcessDuration]); diff != "" {
+		t.Errorf("Snapshot() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	m := NewExpvarMetrics()
+	var _ expvar.Var = m
+	var _ MetricsCollector = m
+
+	m.Inc(MetricRecordsFailed, nil)
+	m.Observe(MetricRecordDuration, nil, 0.5)
+
+	var got MetricsSnapshot
+	if err := json.Unmarshal([]byte(m.String()), &got); err != nil {
+		t.Fatalf("String() returned invalid JSON %q: %v", m.String(), err)
+	}
+	want := MetricsSnapshot{
+		Counters:      map[string]int64{MetricRecordsFailed: 1},
+		Distributions: map[string]DistributionSnapshot{MetricRecordDuration: {Count: 1, Sum: 0.5, P50: 0.5, P95: 0.5, P99: 0.5}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("String() returned diff (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"sort"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// forEachTopLevelObject calls fn with every top level output object, i.e. objects written with out,
+// and fields (or the items of array fields) written to the root output by root mappings, along with
+// the target they were written to and their index in it (or -1 if the target is not an array).
+// Targets are visited in sorted order. Iteration stops at the first error, which is returned.
+func forEachTopLevelObject(pctx *types.Context, fn func(target string, index int, obj jsonutil.JSONToken) error) error {
+	targets := make([]string, 0, len(pctx.TopLevelObjects))
+	for target := range pctx.TopLevelObjects {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		for i, obj := range pctx.TopLevelObjects[target] {
+			if err := fn(target, i, obj); err != nil {
+				return err
+			}
+		}
+	}
+
+	out, ok := (*pctx.Output).(jsonutil.JSONContainer)
+	if !ok {
+		return nil
+	}
+
+	targets = make([]string, 0, len(out))
+	for target := range out {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		field := out[target]
+		if field == nil {
+			continue
+		}
+		arr, ok := (*field).(jsonutil.JSONArr)
+		if !ok {
+			if err := fn(target, -1, *field); err != nil {
+				return err
+			}
+			continue
+		}
+		for i, obj := range arr {
+			if err := fn(target, i, obj); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// filterTopLevelObjects removes the top level output objects (see forEachTopLevelObject) for which
+// keep returns false, visiting them in the same order. Targets left without objects are removed.
+// Filtering stops at the first error, which is returned.
+func filterTopLevelObjects(pctx *types.Context, keep func(target string, obj jsonutil.JSONToken) (bool, error)) error {
+	targets := make([]string, 0, len(pctx.TopLevelObjects))
+	for target := range pctx.TopLevelObjects {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		var kept []jsonutil.JSONToken
+		for _, obj := range pctx.TopLevelObjects[target] {
+			k, err := keep(target, obj)
+			if err != nil {
+				return err
+			}
+			if k {
+				kept = append(kept, obj)
+			}
+		}
+		if len(kept) == 0 {
+			delete(pctx.TopLevelObjects, target)
+		} else {
+			pctx.TopLevelObjects[target] = kept
+		}
+	}
+
+	out, ok := (*pctx.Output).(jsonutil.JSONContainer)
+	if !ok {
+		return nil
+	}
+
+	targets = make([]string, 0, len(out))
+	for target := range out {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		field := out[target]
+		if field == nil {
+			continue
+		}
+		arr, ok := (*field).(jsonutil.JSONArr)
+		if !ok {
+			k, err := keep(target, *field)
+			if err != nil {
+				return err
+			}
+			if !k {
+				delete(out, target)
+			}
+			continue
+		}
+
+		kept := make(jsonutil.JSONArr, 0, len(arr))
+		for _, obj := range arr {
+			k, err := keep(target, obj)
+			if err != nil {
+				return err
+			}
+			if k {
+				kept = append(kept, obj)
+			}
+		}
+		if len(kept) == 0 {
+			delete(out, target)
+			continue
+		}
+		var t jsonutil.JSONToken = kept
+		out[target] = &t
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// paramProjectorName is the name of the builtin that exposes engine parameters to mappings.
+const paramProjectorName = "$Param"
+
+// paramProjector looks up the given parameter in the context. Unknown parameters are an error,
+// since they are most likely a typo or a missing deployment setting. The value is copied so that
+// mappings can not modify the parameters.
+func paramProjector(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s expects 1 argument, got %d", paramProjectorName, len(args))
+	}
+
+	name, err := jsonutil.NodeToToken(args[0])
+	if err != nil {
+		return nil, err
+	}
+	n, ok := name.(jsonutil.JSONStr)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string name, got %T", paramProjectorName, name)
+	}
+
+	v, ok := pctx.Params[string(n)]
+	if !ok {
+		available := make([]string, 0, len(pctx.Params))
+		for k := range pctx.Params {
+			available = append(available, k)
+		}
+		sort.Strings(available)
+		return nil, fmt.Errorf("unknown parameter %q, available parameters are %v", n, available)
+	}
+	return jsonutil.Deepcopy(v), nil
+}
+
+// layerParams returns the given defaults overridden by the given overrides, without modifying
+// either.
+func layerParams(defaults, overrides map[string]jsonutil.JSONToken) map[string]jsonutil.JSONToken {
+	params := make(map[string]jsonutil.JSONToken, len(defaults)+len(overrides))
+	for k, v := range defaults {
+		params[k] = v
+	}
+	for k, v := range overrides {
+		params[k] = v
+	}
+	return params
+}
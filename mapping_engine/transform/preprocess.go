@@ -0,0 +1,54 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/errors" /* copybara-comment: errors */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// preProcessProjectors returns the names of the pre-process projectors, from the mapping config
+// followed by those from the TransformationConfig.
+func (t *DefaultTransformer) preProcessProjectors() []string {
+	names := append([]string{}, t.mappingConfig.GetPreProcessProjectorName()...)
+	return append(names, t.transformationConfig.PreProcessProjectors...)
+}
+
+// preProcess runs the given projectors over the input in order, each receiving the output of the
+// previous one, and returns the output of the last.
+func preProcess(pctx *types.Context, projectors []string, in jsonutil.JSONToken) (jsonutil.JSONToken, error) {
+	for i, name := range projectors {
+		errLocation := errors.FnLocationf("Pre Processing (step %d, projector %q)", i, name)
+
+		p, err := pctx.Registry.FindProjector(name)
+		if err != nil {
+			return nil, errors.Wrap(errLocation, fmt.Errorf("pre_process projector %v not found", name))
+		}
+
+		jmn, err := jsonutil.TokenToNode(in)
+		if err != nil {
+			return nil, errors.Wrap(errLocation, err)
+		}
+
+		in, err = p([]jsonutil.JSONMetaNode{jmn}, pctx)
+		if err != nil {
+			return nil, errors.Wrap(errLocation, err)
+		}
+	}
+	return in, nil
+}
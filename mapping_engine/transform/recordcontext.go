@@ -0,0 +1,54 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// contextProjectorName is the name of the builtin that exposes the context data of the record
+// being transformed to mappings.
+const contextProjectorName = "$Context"
+
+// contextProjector reads the given path (e.g. "envelope.controlId") from the context data of the
+// record in the context (see TransformWithContext). Unlike with $Param, missing paths (or records
+// without context data) give nil, since the context data of records may vary. The value is copied
+// so that mappings can not modify the context data.
+func contextProjector(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("%s expects 1 argument, got %d", contextProjectorName, len(args))
+	}
+
+	path, err := jsonutil.NodeToToken(args[0])
+	if err != nil {
+		return nil, err
+	}
+	p, ok := path.(jsonutil.JSONStr)
+	if !ok {
+		return nil, fmt.Errorf("%s expects a string path, got %T", contextProjectorName, path)
+	}
+
+	if pctx.RecordContext == nil {
+		return nil, nil
+	}
+	v, err := jsonutil.GetField(pctx.RecordContext, string(p))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %q from the record context: %v", p, err)
+	}
+	return jsonutil.Deepcopy(v), nil
+}
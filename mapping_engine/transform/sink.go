@@ -0,0 +1,162 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// OutputSink receives top level output objects (e.g. FHIR resources) one at a time, along with the
+// target they were written to (e.g. Patient), so that large outputs can be written out (or sent)
+// as they are produced rather than as a single object.
+type OutputSink interface {
+	// Write receives the next object.
+	Write(target string, obj jsonutil.JSONToken) error
+	// Close is called once all objects have been written.
+	Close() error
+}
+
+// WriteOutput writes the fields of the given unbundled transformation output (see
+// TransformationConfig.SkipBundling) to the given sink, in sorted order of their targets. The
+// items of array fields are written as objects of their own. The sink is not closed.
+func WriteOutput(out jsonutil.JSONToken, sink OutputSink) error {
+	c, ok := out.(jsonutil.JSONContainer)
+	if !ok {
+		return fmt.Errorf("expected the output to be an object but got %T", out)
+	}
+
+	targets := make([]string, 0, len(c))
+	for target := range c {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		field := c[target]
+		if field == nil {
+			continue
+		}
+		arr, ok := (*field).(jsonutil.JSONArr)
+		if !ok {
+			if err := sink.Write(target, *field); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, obj := range arr {
+			if err := sink.Write(target, obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Part describes a part of the objects written to a SplitterSink.
+type Part struct {
+	// Index is the index of the part, counting from 0.
+	Index int
+	// Objects is the number of objects in the part.
+	Objects int
+	// Bytes is the total size of the objects in the part, serialized as JSON.
+	Bytes int
+}
+
+// SplitConfig configures the parts of a SplitterSink.
+type SplitConfig struct {
+	// MaxObjects is the maximum number of objects in a part, or 0 for no limit.
+	MaxObjects int
+
+	// MaxBytes is the maximum total size of the objects in a part, serialized as JSON, or 0 for no
+	// limit. An object that is larger than this on its own is written to a part of its own, since
+	// objects are never split.
+	MaxBytes int
+
+	// OnPart is called at the end of each part, once its last object has been written to the inner
+	// sink, e.g. to send the objects buffered by the inner sink as one transaction bundle. Empty
+	// parts are never ended. Returning an error stops the writing, and the error is returned by the
+	// Write (or Close) that ended the part.
+	OnPart func(Part) error
+}
+
+// SplitterSink forwards objects to an inner sink in order, dividing them into parts of at most the
+// configured number or size of objects, and calling SplitConfig.OnPart at the end of each.
+type SplitterSink struct {
+	inner  OutputSink
+	config SplitConfig
+	part   Part
+}
+
+// NewSplitterSink creates a SplitterSink forwarding objects to the given sink.
+func NewSplitterSink(inner OutputSink, config SplitConfig) *SplitterSink {
+	return &SplitterSink{inner: inner, config: config}
+}
+
+// Write forwards the given object to the inner sink, ending the current part first if the object
+// does not fit in it.
+func (s *SplitterSink) Write(target string, obj jsonutil.JSONToken) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("unable to serialize %s object: %v", target, err)
+	}
+
+	if s.part.Objects > 0 && !s.fits(len(b)) {
+		if err := s.endPart(); err != nil {
+			return err
+		}
+	}
+
+	if err := s.inner.Write(target, obj); err != nil {
+		return err
+	}
+	s.part.Objects++
+	s.part.Bytes += len(b)
+	return nil
+}
+
+// Close ends the last part, if it is not empty, and closes the inner sink.
+func (s *SplitterSink) Close() error {
+	if s.part.Objects > 0 {
+		if err := s.endPart(); err != nil {
+			return err
+		}
+	}
+	return s.inner.Close()
+}
+
+// fits returns true iff an object of the given size can be added to the current part.
+func (s *SplitterSink) fits(size int) bool {
+	if s.config.MaxObjects > 0 && s.part.Objects+1 > s.config.MaxObjects {
+		return false
+	}
+	if s.config.MaxBytes > 0 && s.part.Bytes+size > s.config.MaxBytes {
+		return false
+	}
+	return true
+}
+
+// endPart calls SplitConfig.OnPart with the current part, and starts the next one.
+func (s *SplitterSink) endPart() error {
+	p := s.part
+	s.part = Part{Index: p.Index + 1}
+	if s.config.OnPart == nil {
+		return nil
+	}
+	return s.config.OnPart(p)
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// recordingSink records the objects written to it, and the parts ended by a SplitterSink around it,
+// as events in order.
+type recordingSink struct {
+	events *[]string
+	closed bool
+}
+
+func (s *recordingSink) Write(target string, obj jsonutil.JSONToken) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	*s.events = append(*s.events, fmt.Sprintf("%s %s", target, b))
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func mustParseJSON(t *testing.T, in string) jsonutil.JSONToken {
+	t.Helper()
+	tkn, err := jsonutil.UnmarshalJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("UnmarshalJSON(%s) returned unexpected error %v", in, err)
+	}
+	return tkn
+}
+
+func TestSplitterSink(t *testing.T) {
+	// Each object is 10 bytes, serialized as JSON.
+	objs := []string{`{"id":"a"}`, `{"id":"b"}`, `{"id":"c"}`}
+
+	tests := []struct {
+		name   string
+		config SplitConfig
+		n      int
+		want   []string
+	}{
+		{
+			name: "no limits",
+			n:    3,
+			want: []string{`R {"id":"a"}`, `R {"id":"b"}`, `R {"id":"c"}`, "part 0: 3 objects, 30 bytes"},
+		},
+		{
+			name:   "exactly at object limit",
+			config: SplitConfig{MaxObjects: 2},
+			n:      2,
+			want:   []string{`R {"id":"a"}`, `R {"id":"b"}`, "part 0: 2 objects, 20 bytes"},
+		},
+		{
+			name:   "one over object limit",
+			config: SplitConfig{MaxObjects: 2},
+			n:      3,
+			want:   []string{`R {"id":"a"}`, `R {"id":"b"}`, "part 0: 2 objects, 20 bytes", `R {"id":"c"}`, "part 1: 1 objects, 10 bytes"},
+		},
+		{
+			name:   "exactly at byte limit",
+			config: SplitConfig{MaxBytes: 20},
+			n:      3,
+			want:   []string{`R {"id":"a"}`, `R {"id":"b"}`, "part 0: 2 objects, 20 bytes", `R {"id":"c"}`, "part 1: 1 objects, 10 bytes"},
+		},
+		{
+			name:   "one byte under two objects",
+			config: SplitConfig{MaxBytes: 19},
+			n:      2,
+			want:   []string{`R {"id":"a"}`, "part 0: 1 objects, 10 bytes", `R {"id":"b"}`, "part 1: 1 objects, 10 bytes"},
+		},
+		{
+			name:   "objects larger than byte limit",
+			config: SplitConfig{MaxBytes: 5},
+			n:      2,
+			want:   []string{`R {"id":"a"}`, "part 0: 1 objects, 10 bytes", `R {"id":"b"}`, "part 1: 1 objects, 10 bytes"},
+		},
+		{
+			name:   "both limits",
+			config: SplitConfig{MaxObjects: 2, MaxBytes: 10},
+			n:      2,
+			want:   []string{`R {"id":"a"}`, "part 0: 1 objects, 10 bytes", `R {"id":"b"}`, "part 1: 1 objects, 10 bytes"},
+		},
+		{
+			name:   "no objects",
+			config: SplitConfig{MaxObjects: 2},
+			want:   nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			inner := &recordingSink{events: &got}
+			test.config.OnPart = func(p Part) error {
+				got = append(got, fmt.Sprintf("part %d: %d objects, %d bytes", p.Index, p.Objects, p.Bytes))
+				return nil
+			}
+			s := NewSplitterSink(inner, test.config)
+			for _, obj := range objs[:test.n] {
+				if err := s.Write("R", mustParseJSON(t, obj)); err != nil {
+					t.Fatalf("Write(%s) returned unexpected error %v", obj, err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("Close() returned unexpected error %v", err)
+			}
+			if !inner.closed {
+				t.Errorf("Close() did not close the inner sink")
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("SplitterSink wrote diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSplitterSink_OnPartError(t *testing.T) {
+	var got []string
+	s := NewSplitterSink(&recordingSink{events: &got}, SplitConfig{
+		MaxObjects: 1,
+		OnPart: func(p Part) error {
+			return fmt.Errorf("part %d could not be sent", p.Index)
+		},
+	})
+	if err := s.Write("R", mustParseJSON(t, `{"id":"a"}`)); err != nil {
+		t.Fatalf("Write returned unexpected error %v", err)
+	}
+	err := s.Write("R", mustParseJSON(t, `{"id":"b"}`))
+	if err == nil || !strings.Contains(err.Error(), "part 0 could not be sent") {
+		t.Errorf("Write got error %v, want the error of OnPart", err)
+	}
+	if diff := cmp.Diff([]string{`R {"id":"a"}`}, got); diff != "" {
+		t.Errorf("SplitterSink wrote diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteOutput(t *testing.T) {
+	out := mustParseJSON(t, `{"Patient": [{"id":"p1"}, {"id":"p2"}], "Bundle": {"id":"b"}, "Encounter": [{"id":"e"}]}`)
+	var got []string
+	if err := WriteOutput(out, &recordingSink{events: &got}); err != nil {
+		t.Fatalf("WriteOutput returned unexpected error %v", err)
+	}
+	want := []string{`Bundle {"id":"b"}`, `Encounter {"id":"e"}`, `Patient {"id":"p1"}`, `Patient {"id":"p2"}`}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("WriteOutput wrote diff (-want +got):\n%s", diff)
+	}
+
+	if err := WriteOutput(mustParseJSON(t, `[1]`), &recordingSink{events: &got}); err == nil {
+		t.Errorf("WriteOutput([1]) got no error, want an error for a non-object output")
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/errors" /* copybara-comment: errors */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// gzipMagic are the first bytes of gzip compressed data (RFC 1952, section 2.3.1).
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// StreamResult is the result of a single record read by ProcessStream or ProcessZip.
+type StreamResult struct {
+	// Member is the name of the zip archive member the record was read from. It is empty for
+	// ProcessStream.
+	Member string
+	// Line is the line of the input (or member) the record starts on, counting from 1.
+	Line int
+	// Output is the output of the record. It is null if the record failed, or its error record with
+	// EmitRecordErrors (unless it went to the DeadLetterSink).
+	Output jsonutil.JSONToken
+	// Err is the error of the record if it failed to map. Its index counts the records of the whole
+	// input (or archive), from 0.
+	Err *errors.RecordError
+}
+
+// StreamError is an error reading or mapping a record of ProcessStream or ProcessZip, along with
+// where in the input it occurred. Line is 0 if the error is not about a record, e.g. an invalid
+// gzip header.
+type StreamError struct {
+	Member string
+	Line   int
+	Err    error
+}
+
+func (e StreamError) Error() string {
+	name := e.Member
+	if name == "" {
+		name = "input"
+	}
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", name, e.Line, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", name, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e StreamError) Unwrap() error {
+	return e.Err
+}
+
+// ProcessStream transforms each record of the given newline delimited JSON (one record per line,
+// blank lines are skipped) like ProcessBatch, passing the results to emit in order. Gzip compressed
+// input is detected by its magic bytes and decompressed transparently. Records are read one at a
+// time, so the input does not need to fit in memory.
+//
+// The stream stops at the first StreamError, which is returned: invalid input, a record failing to
+// map with FailOnRecordError, or an error returned by emit.
+func (t *DefaultTransformer) ProcessStream(r io.Reader, emit func(StreamResult) error) error {
+	s := &recordStream{t: t, emit: emit}
+	return s.readNDJSON("", r)
+}
+
+// ProcessZip transforms the records of the .json and .ndjson members (optionally gzip compressed,
+// e.g. .ndjson.gz) of the given zip archive, in order of their names. A .json member is a single
+// record, an .ndjson member is read like ProcessStream. Other members, like directories and
+// manifests, are skipped. Members are read one at a time, and errors are StreamErrors giving the
+// member and line they occurred at.
+func (t *DefaultTransformer) ProcessZip(r io.ReaderAt, size int64, emit func(StreamResult) error) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("invalid zip archive: %v", err)
+	}
+
+	var members []*zip.File
+	for _, f := range zr.File {
+		if isNDJSONMember(f.Name) || isJSONMember(f.Name) {
+			members = append(members, f)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+
+	s := &recordStream{t: t, emit: emit}
+	for _, f := range members {
+		if err := s.readMember(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProcessZipFile is ProcessZip for the zip archive at the given path.
+func (t *DefaultTransformer) ProcessZipFile(path string, emit func(StreamResult) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return t.ProcessZip(f, fi.Size(), emit)
+}
+
+func isNDJSONMember(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(strings.ToLower(name), ".gz"), ".ndjson")
+}
+
+func isJSONMember(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(strings.ToLower(name), ".gz"), ".json")
+}
+
+// recordStream reads the records of ProcessStream or ProcessZip, and passes their results to emit.
+type recordStream struct {
+	t    *DefaultTransformer
+	emit func(StreamResult) error
+	// index is the index of the next record in the whole input.
+	index int
+}
+
+// readMember reads the records of the given zip archive member.
+func (s *recordStream) readMember(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return StreamError{Member: f.Name, Err: err}
+	}
+	defer rc.Close()
+
+	if isNDJSONMember(f.Name) {
+		return s.readNDJSON(f.Name, rc)
+	}
+	return s.readJSON(f.Name, rc)
+}
+
+// readNDJSON reads the records of the given (possibly gzip compressed) newline delimited JSON.
+func (s *recordStream) readNDJSON(member string, r io.Reader) error {
+	br, err := decompress(r)
+	if err != nil {
+		return StreamError{Member: member, Err: err}
+	}
+
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return StreamError{Member: member, Line: line, Err: err}
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			if err := s.process(member, line, b); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// readJSON reads the single record of the given (possibly gzip compressed) JSON.
+func (s *recordStream) readJSON(member string, r io.Reader) error {
+	br, err := decompress(r)
+	if err != nil {
+		return StreamError{Member: member, Err: err}
+	}
+
+	dec := json.NewDecoder(br)
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return StreamError{Member: member, Line: 1, Err: err}
+	}
+	// Reading to the end also verifies the checksum of the member.
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("unexpected data after the record, .json members can only contain a single record (use .ndjson for more)")
+		}
+		return StreamError{Member: member, Line: 1, Err: err}
+	}
+	return s.process(member, 1, raw)
+}
+
+// process transforms the given record, and passes its result to emit.
+func (s *recordStream) process(member string, line int, raw json.RawMessage) error {
+	rec, err := s.t.ParseJSON(raw)
+	if err != nil {
+		return StreamError{Member: member, Line: line, Err: err}
+	}
+
+	out, recErr, err := s.t.processRecord(s.index, rec)
+	s.index++
+	if err != nil {
+		return StreamError{Member: member, Line: line, Err: err}
+	}
+
+	if err := s.emit(StreamResult{Member: member, Line: line, Output: out, Err: recErr}); err != nil {
+		return StreamError{Member: member, Line: line, Err: err}
+	}
+	return nil
+}
+
+// decompress returns a buffered reader of the given input, which is decompressed if it starts with
+// the gzip magic bytes.
+func decompress(r io.Reader) (*bufio.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip input: %v", err)
+	}
+	return bufio.NewReader(zr), nil
+}
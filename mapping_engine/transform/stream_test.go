@@ -0,0 +1,320 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	dhpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: data_harmonization_go_proto */
+	hpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: harmonization_go_proto */
+)
+
+const streamWhistle = `
+id: $root.id
+age: $ParseFloat($root.age)
+`
+
+func newStreamTransformer(t *testing.T, tconfig TransformationConfig) *DefaultTransformer {
+	t.Helper()
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: streamWhistle,
+			},
+		},
+	}
+	tconfig.SkipBundling = true
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, tconfig)
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	return tr
+}
+
+// collectResults returns an emit function that records each result as "member:line output", along
+// with the records.
+func collectResults(t *testing.T) (func(StreamResult) error, *[]string) {
+	var got []string
+	return func(r StreamResult) error {
+		out, err := json.Marshal(r.Output)
+		if err != nil {
+			t.Fatalf("json.Marshal(%v) returned unexpected error %v", r.Output, err)
+		}
+		rec := fmt.Sprintf("%s:%d %s", r.Member, r.Line, out)
+		if r.Err != nil {
+			rec += fmt.Sprintf(" (record %d failed)", r.Err.Index)
+		}
+		got = append(got, rec)
+		return nil
+	}, &got
+}
+
+func gzipBytes(t *testing.T, s string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write([]byte(s)); err != nil {
+		t.Fatalf("gzip Write returned unexpected error %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("gzip Close returned unexpected error %v", err)
+	}
+	return b.Bytes()
+}
+
+type zipMember struct {
+	name    string
+	content []byte
+}
+
+func zipBytes(t *testing.T, members ...zipMember) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for _, m := range members {
+		// Members are stored uncompressed, so tests can corrupt their content.
+		f, err := w.CreateHeader(&zip.FileHeader{Name: m.name, Method: zip.Store})
+		if err != nil {
+			t.Fatalf("zip Create(%q) returned unexpected error %v", m.name, err)
+		}
+		if _, err := f.Write(m.content); err != nil {
+			t.Fatalf("zip Write(%q) returned unexpected error %v", m.name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("zip Close returned unexpected error %v", err)
+	}
+	return b.Bytes()
+}
+
+func TestProcessStream(t *testing.T) {
+	ndjson := "{\"id\": \"p0\", \"age\": \"5\"}\n\n{\"id\": \"p1\", \"age\": \"five\"}\r\n{\"id\": \"p2\", \"age\": \"7\"}"
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{
+			name: "ndjson",
+			in:   []byte(ndjson),
+		},
+		{
+			name: "gzip",
+			in:   gzipBytes(t, ndjson),
+		},
+		{
+			name: "concatenated gzip",
+			in:   append(gzipBytes(t, ndjson[:28]), gzipBytes(t, ndjson[28:])...),
+		},
+	}
+	want := []string{
+		`:1 {"age":5,"id":"p0"}`,
+		`:3 null (record 1 failed)`,
+		`:4 {"age":7,"id":"p2"}`,
+	}
+
+	tr := newStreamTransformer(t, TransformationConfig{RecordErrorPolicy: CollectRecordErrors})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			emit, got := collectResults(t)
+			if err := tr.ProcessStream(bytes.NewReader(test.in), emit); err != nil {
+				t.Fatalf("ProcessStream returned unexpected error %v", err)
+			}
+			if diff := cmp.Diff(want, *got); diff != "" {
+				t.Errorf("ProcessStream returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProcessStream_Errors(t *testing.T) {
+	valid := gzipBytes(t, "{\"id\": \"p0\", \"age\": \"5\"}\n{\"id\": \"p1\", \"age\": \"6\"}\n")
+	corrupt := append([]byte{}, valid...)
+	// Flip a byte of the CRC-32 in the trailer.
+	corrupt[len(corrupt)-5] ^= 0xff
+
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr string
+	}{
+		{
+			name:    "invalid json",
+			in:      []byte("{\"id\": \"p0\", \"age\": \"5\"}\n{\"id\": \n"),
+			wantErr: "input:2: ",
+		},
+		{
+			name:    "record error",
+			in:      []byte("{\"id\": \"p0\", \"age\": \"5\"}\n{\"id\": \"p1\", \"age\": \"five\"}\n"),
+			wantErr: "input:2: record[1]",
+		},
+		{
+			name:    "truncated gzip",
+			in:      valid[:len(valid)-10],
+			wantErr: "unexpected EOF",
+		},
+		{
+			name:    "corrupt gzip",
+			in:      corrupt,
+			wantErr: "gzip: invalid checksum",
+		},
+		{
+			name:    "invalid gzip header",
+			in:      []byte{0x1f, 0x8b, 0x00, 0x00},
+			wantErr: "input: invalid gzip input: ",
+		},
+	}
+
+	tr := newStreamTransformer(t, TransformationConfig{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			emit, _ := collectResults(t)
+			err := tr.ProcessStream(bytes.NewReader(test.in), emit)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ProcessStream got error %v, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcessStream_EmitError(t *testing.T) {
+	tr := newStreamTransformer(t, TransformationConfig{})
+	in := "{\"id\": \"p0\", \"age\": \"5\"}\n{\"id\": \"p1\", \"age\": \"6\"}\n"
+	calls := 0
+	err := tr.ProcessStream(strings.NewReader(in), func(StreamResult) error {
+		calls++
+		return fmt.Errorf("sink is full")
+	})
+	if err == nil || err.Error() != "input:1: sink is full" {
+		t.Errorf("ProcessStream got error %v, want %q", err, "input:1: sink is full")
+	}
+	if calls != 1 {
+		t.Errorf("ProcessStream called emit %d times, want 1", calls)
+	}
+}
+
+func TestProcessZip(t *testing.T) {
+	archive := zipBytes(t,
+		zipMember{"b.ndjson", []byte("{\"id\": \"b0\", \"age\": \"1\"}\n{\"id\": \"b1\", \"age\": \"one\"}\n")},
+		zipMember{"README.txt", []byte("not a record")},
+		zipMember{"dir/", nil},
+		zipMember{"a.json", []byte("{\n  \"id\": \"a0\",\n  \"age\": \"2\"\n}\n")},
+		zipMember{"c.ndjson.gz", gzipBytes(t, "{\"id\": \"c0\", \"age\": \"3\"}\n")},
+	)
+	want := []string{
+		`a.json:1 {"age":2,"id":"a0"}`,
+		`b.ndjson:1 {"age":1,"id":"b0"}`,
+		`b.ndjson:2 null (record 2 failed)`,
+		`c.ndjson.gz:1 {"age":3,"id":"c0"}`,
+	}
+
+	tr := newStreamTransformer(t, TransformationConfig{RecordErrorPolicy: CollectRecordErrors})
+
+	emit, got := collectResults(t)
+	if err := tr.ProcessZip(bytes.NewReader(archive), int64(len(archive)), emit); err != nil {
+		t.Fatalf("ProcessZip returned unexpected error %v", err)
+	}
+	if diff := cmp.Diff(want, *got); diff != "" {
+		t.Errorf("ProcessZip returned diff (-want +got):\n%s", diff)
+	}
+
+	dir, err := ioutil.TempDir("", "stream_test")
+	if err != nil {
+		t.Fatalf("TempDir returned unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "export.zip")
+	if err := ioutil.WriteFile(path, archive, 0644); err != nil {
+		t.Fatalf("WriteFile returned unexpected error %v", err)
+	}
+
+	emit, got = collectResults(t)
+	if err := tr.ProcessZipFile(path, emit); err != nil {
+		t.Fatalf("ProcessZipFile(%q) returned unexpected error %v", path, err)
+	}
+	if diff := cmp.Diff(want, *got); diff != "" {
+		t.Errorf("ProcessZipFile(%q) returned diff (-want +got):\n%s", path, diff)
+	}
+}
+
+func TestProcessZip_Errors(t *testing.T) {
+	valid := zipBytes(t, zipMember{"a.ndjson", []byte("{\"id\": \"a0\", \"age\": \"1\"}\n")})
+	// Corrupt the (uncompressed) record in the member, so its CRC-32 no longer matches.
+	corrupt := bytes.Replace(valid, []byte(`"a0"`), []byte(`"x0"`), 1)
+
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr string
+	}{
+		{
+			name:    "not a zip archive",
+			in:      []byte("not a zip archive"),
+			wantErr: "invalid zip archive: ",
+		},
+		{
+			name:    "truncated archive",
+			in:      valid[:len(valid)-10],
+			wantErr: "invalid zip archive: ",
+		},
+		{
+			name:    "corrupt member",
+			in:      corrupt,
+			wantErr: "a.ndjson:2: zip: checksum error",
+		},
+		{
+			name:    "invalid json member",
+			in:      zipBytes(t, zipMember{"a.json", []byte("{\"id\": ")}),
+			wantErr: "a.json:1: ",
+		},
+		{
+			name:    "json member with several records",
+			in:      zipBytes(t, zipMember{"a.json", []byte("{\"id\": \"a0\"}\n{\"id\": \"a1\"}\n")}),
+			wantErr: "a.json:1: unexpected data after the record",
+		},
+		{
+			name:    "invalid ndjson member",
+			in:      zipBytes(t, zipMember{"a.ndjson", []byte("{\"id\": \"a0\", \"age\": \"1\"}\n{\"id\": \"a1\", \"age\": \"1\"\n")}),
+			wantErr: "a.ndjson:2: ",
+		},
+		{
+			name:    "corrupt gzip member",
+			in:      zipBytes(t, zipMember{"a.ndjson.gz", gzipBytes(t, "{\"id\": \"a0\"}\n")[:12]}),
+			wantErr: "a.ndjson.gz",
+		},
+	}
+
+	tr := newStreamTransformer(t, TransformationConfig{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			emit, _ := collectResults(t)
+			err := tr.ProcessZip(bytes.NewReader(test.in), int64(len(test.in)), emit)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ProcessZip got error %v, want error containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
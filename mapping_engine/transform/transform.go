@@ -20,10 +20,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"time"
 
 	"google.golang.org/protobuf/encoding/prototext" /* copybara-comment: prototext */
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/auth" /* copybara-comment: auth */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/builtins" /* copybara-comment: builtins */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/cloudfunction" /* copybara-comment: cloudfunction */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/errors" /* copybara-comment: errors */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/fetch" /* copybara-comment: fetch */
@@ -69,19 +71,210 @@ type Transformer interface {
 
 // DefaultTransformer contains projectors initialized for a specific config, and receiver methods
 // to perform transformations.
+//
+// Once created, a DefaultTransformer may be shared by any number of goroutines: Transform,
+// TransformPartial, TransformWithLineage, TransformWithParams, TransformWithContext,
+// TransformIfChanged, TransformInputs, JSONtoJSON, Project, ProcessBundle, ProcessBatch,
+// ProcessStream and ProcessZip keep all evaluation state in a context of their own, and may run
+// concurrently with each other and with RegisterProjector, RegisterNamespacedProjector,
+// RegisterLookupTable, RegisterTermDomain, RegisterSchema and the methods of Registry().
+// SetOutputValidator and LoadProjectors must not be called while transformations are running.
 type DefaultTransformer struct {
 	registry                *types.Registry
 	dataHarmonizationConfig *dhpb.DataHarmonizationConfig
 	mappingConfig           *mappb.MappingConfig
 	transformationConfig    TransformationConfig
+	outputValidator         OutputValidator
+	lookupTables            *builtins.LookupTables
+	termTables              *builtins.TermTables
+	schemas                 *builtins.Schemas
+	dedupStore              DedupKeyStore
+	dedupStats              dedupStats
+	mappingStats            *mappingStats
+	digestStore             DigestStore
+	digestIgnorePaths       [][]string
+	configFingerprint       []byte
+	idResolver              types.IDResolver
 }
 
 // TransformationConfig contains metadata used during transformation.
 type TransformationConfig struct {
 	LogTrace     bool
 	SkipBundling bool
+
+	// Metadata is made available to mappings through the $MappingMeta builtin, e.g. the mapping
+	// config name and version, or an ID for this run.
+	Metadata map[string]string
+
+	// MetadataStampPath, if set, is the path (e.g. meta.tag[]) that Metadata is written to in every
+	// top level output object before post processing.
+	MetadataStampPath string
+
+	// RetryPolicies configures retries of failed calls to the projectors with the given names,
+	// e.g. those calling remote services.
+	RetryPolicies map[string]types.RetryPolicy
+
+	// ProjectorTimeouts makes calls to the projectors with the given names fail if they take longer
+	// than the given durations, e.g. those calling remote services. Timeouts apply to each retry.
+	ProjectorTimeouts map[string]time.Duration
+
+	// OutputValidationSeverity determines what happens to outputs that fail the validator set with
+	// SetOutputValidator. By default, the transformation of the record fails.
+	OutputValidationSeverity ValidationSeverity
+
+	// DateShiftSecret keys the $ShiftDate builtin, so that date shifts can not be derived from the
+	// (e.g. patient) keys alone. $ShiftDate fails if this is not set.
+	DateShiftSecret []byte
+
+	// Params are engine parameters readable from mappings through the $Param builtin, e.g. the
+	// identifier system of the facility the config is deployed for. They can be overridden per
+	// transformation with TransformWithParams.
+	Params map[string]jsonutil.JSONToken
+
+	// StrictSourcePaths makes reading a field that does not exist on an (input or argument) object
+	// an error that names the closest existing field, instead of silently producing null. Every
+	// field of a path is checked, but not optional ones (like ?.) or those within conditions or
+	// existence checks (like ?).
+	StrictSourcePaths bool
+
+	// LenientAppend makes appending to a target field (e.g. name[]) that already has a primitive
+	// value wrap the value into an array that the result is appended to, e.g. name: "a" followed by
+	// name[]: "b" makes ["a", "b"], instead of failing the mapping.
+	LenientAppend bool
+
+	// IDResolver, if set, assigns the ids returned by the $ResolveID builtin, e.g. from an external
+	// master patient index. It is wrapped in a types.CachingIDResolver shared by all transformers
+	// of the config, so that identifiers looked up recently are not resolved again.
+	IDResolver types.IDResolver
+
+	// BundleProjectors maps the resourceType of the entries of a FHIR Bundle to the name of the
+	// projector that maps them in ProcessBundle.
+	BundleProjectors map[string]string
+
+	// UnmappedResourcePolicy determines what ProcessBundle does with entries whose resourceType is
+	// not in BundleProjectors. By default they are skipped.
+	UnmappedResourcePolicy UnmappedResourcePolicy
+
+	// FailOnBundleEntryError makes ProcessBundle fail if any entry fails to map, instead of
+	// reporting it in the result.
+	FailOnBundleEntryError bool
+
+	// TermDomains are added to (or override the terms of) the domains of the $NormalizeTerm
+	// builtin. See builtins.TermTables.
+	TermDomains map[string]builtins.TermDomain
+
+	// PreProcessProjectors are the names of projectors to pre-process the input with before the
+	// root mappings are run. They run in order, after those in the mapping config (see
+	// MappingConfig.pre_process_projector_name).
+	PreProcessProjectors []string
+
+	// DedupKeyPaths, if set, are the paths (e.g. resourceType, identifier[0].system and
+	// identifier[0].value) that make up the key of every top level output object. Outputs whose key
+	// was already emitted (by any transformation with this transformer, or as recorded in
+	// DedupKeyStore) are suppressed. Outputs whose key paths are all null are always emitted.
+	// Deduplication runs after output validation and before post processing.
+	DedupKeyPaths []string
+
+	// DedupKeyProjector, if set, is the name of a projector that is called with every top level
+	// output object and returns its key for deduplication (see DedupKeyPaths), or null to always emit
+	// it. It can not be used together with DedupKeyPaths.
+	DedupKeyProjector string
+
+	// DedupKeyStore records the keys of emitted outputs for deduplication. By default the keys are
+	// kept in memory for the lifetime of the transformer.
+	DedupKeyStore DedupKeyStore
+
+	// RecordErrorPolicy determines what ProcessBatch does with records that fail to map. By default
+	// the whole batch fails.
+	RecordErrorPolicy RecordErrorPolicy
+
+	// RecordErrorTarget is the target that error records are written to with EmitRecordErrors. It
+	// defaults to RecordError.
+	RecordErrorTarget string
+
+	// RecordErrorProjector, if set, is the name of a projector that shapes the error records of
+	// EmitRecordErrors (e.g. into an OperationOutcome). It is called with an object with the
+	// recordIndex, projectorStack and message of the error, the input record (with
+	// RecordErrorIncludeInput), and the timestamp of the failure (RFC 3339, UTC), and returns the
+	// error record. By default that object is the error record.
+	RecordErrorProjector string
+
+	// RecordErrorIncludeInput adds the failed input record to the error records of EmitRecordErrors
+	// (as input). It is off by default, since error records often end up in logs and dead-letter
+	// queues that are not meant to hold (e.g. patient) input data.
+	RecordErrorIncludeInput bool
+
+	// DeadLetterSink, if set, receives the error records of EmitRecordErrors (in RecordErrorTarget)
+	// in place of the outputs of the failed records, which are then null, so that failed records are
+	// routed apart from the others (e.g. to a dead-letter queue). It is not closed by the
+	// transformer, and must be safe for concurrent use if records are processed concurrently.
+	DeadLetterSink OutputSink
+
+	// MappingStats enables counting, for every field mapping, how often it is evaluated and how often
+	// its source is empty so that nothing is written (e.g. to report that birthDate is unmapped in 12%
+	// of the records). The counts are aggregated over all transformations, and are retrieved with
+	// MappingStats.
+	MappingStats bool
+
+	// Metrics, if set, receives the metrics of every record transformed (see the Metric constants),
+	// e.g. an InMemoryMetrics, an ExpvarMetrics or an adapter to a monitoring system.
+	Metrics MetricsCollector
+
+	// DigestStore records the digests of the records transformed with TransformIfChanged, which
+	// skips records whose digest did not change. By default the digests are kept in memory for the
+	// lifetime of the transformer.
+	DigestStore DigestStore
+
+	// DigestIgnorePaths are the paths (e.g. meta.lastUpdated or entry[*].fullUrl) of volatile input
+	// fields that are left out of the digests of TransformIfChanged, so that changes to them alone do
+	// not cause a record to be transformed again.
+	DigestIgnorePaths []string
+
+	// MaxOutputTokens limits the number of JSON tokens (objects, arrays and primitives) the mappings
+	// may write while transforming a single record, so that runaway mappings fail instead of
+	// exhausting memory. Values returned by functions count again where they are written. It
+	// defaults to types.DefaultMaxOutputTokens, which legitimate mappings never reach; a negative
+	// value means no limit.
+	MaxOutputTokens int
+
+	// MaxArrayLength limits the length of any array the mappings write or append to while
+	// transforming a single record. It defaults to types.DefaultMaxArrayLength; a negative value
+	// means no limit.
+	MaxArrayLength int
+
+	// OutputFormat determines how JSONtoJSON and MarshalOutput serialize the output.
+	OutputFormat OutputFormat
+
+	// OutputIndent is the indent per level of PrettyOutput. It defaults to two spaces.
+	OutputIndent string
+
+	// DeterministicForTesting, if set, makes the outputs reproducible for golden tests and
+	// reproducible exports: $UUID draws from a random number generator seeded per record (so the
+	// outputs of a record do not depend on the order or concurrency of the others), and
+	// $CurrentTime reads the given clock. The UUIDs are predictable from the seed, so this must
+	// never be used to assign production identifiers.
+	DeterministicForTesting *Determinism
 }
 
+// OutputFormat determines how outputs are serialized.
+type OutputFormat int
+
+const (
+	// DefaultOutput serializes outputs with encoding/json, i.e. compact, with sorted keys, HTML
+	// characters escaped, and numbers formatted as Go does.
+	DefaultOutput OutputFormat = iota
+
+	// CanonicalOutput serializes outputs into canonical JSON (see jsonutil.MarshalCanonical), so that
+	// equal outputs are equal byte by byte, e.g. for deduplication downstream.
+	CanonicalOutput
+
+	// PrettyOutput serializes outputs indented by TransformationConfig.OutputIndent, for humans (see
+	// jsonutil.MarshalPretty).
+	PrettyOutput
+)
+
+const defaultOutputIndent = "  "
+
 // Options for initializing Data Harmonization transform library
 type Options struct {
 	// CloudFunctions enables support for cloud functions within the transform library.
@@ -128,24 +321,223 @@ func GCSClient(c gcsutil.StorageClient) Option {
 	}
 }
 
+// shiftDateProjectorName is the name of the builtin created with builtins.NewShiftDateWithClock,
+// keyed with TransformationConfig.DateShiftSecret and reading the clock of
+// TransformationConfig.DeterministicForTesting if set.
+const shiftDateProjectorName = "$ShiftDate"
+
+// lookupProjectorName and lookupAllProjectorName are the names of the builtins that read the
+// tables registered with RegisterLookupTable.
+const (
+	lookupProjectorName    = "$Lookup"
+	lookupAllProjectorName = "$LookupAll"
+)
+
+// normalizeTermProjectorName is the name of the builtin that reads the domains registered with
+// RegisterTermDomain.
+const normalizeTermProjectorName = "$NormalizeTerm"
+
+// matchesSchemaProjectorName and validateSchemaProjectorName are the names of the builtins that
+// read the schemas registered with RegisterSchema.
+const (
+	matchesSchemaProjectorName  = "$MatchesSchema"
+	validateSchemaProjectorName = "$ValidateSchema"
+)
+
 // NewTransformer creates and initializes a transformer, and returns a new DefaultTransformer by
 // default.
 func NewTransformer(ctx context.Context, config *dhpb.DataHarmonizationConfig, tconfig TransformationConfig, setters ...Option) (Transformer, error) {
 	return NewDefaultTransformer(ctx, config, tconfig, setters...)
 }
 
-// NewDefaultTransformer creates and initializes a default transformer.
+// NewDefaultTransformer creates and initializes a default transformer. It is the same as calling
+// CompileConfig and then NewEngine, so services creating many transformers for the same config
+// (e.g. one per worker) should call those instead, to only compile the config once.
 func NewDefaultTransformer(ctx context.Context, config *dhpb.DataHarmonizationConfig, tconfig TransformationConfig, setters ...Option) (*DefaultTransformer, error) {
+	compiled, err := CompileConfig(ctx, config, tconfig, setters...)
+	if err != nil {
+		return nil, err
+	}
+	return NewEngine(compiled)
+}
+
+// CompiledConfig is a data harmonization config with everything a transformation needs loaded and
+// checked: the mappings are parsed (or transpiled) and their paths compiled, the projectors of all
+// libraries, cloud functions, fetch configs and code and unit harmonizations are registered, and
+// the projectors named by the TransformationConfig are known to exist. A CompiledConfig is
+// immutable, so it can be shared by any number of goroutines, each creating its own engines with
+// NewEngine.
+type CompiledConfig struct {
+	registry                *types.Registry
+	dataHarmonizationConfig *dhpb.DataHarmonizationConfig
+	mappingConfig           *mappb.MappingConfig
+	transformationConfig    TransformationConfig
+	lookupTables            *builtins.LookupTables
+	termTables              *builtins.TermTables
+	schemas                 *builtins.Schemas
+	digestIgnorePaths       [][]string
+	configFingerprint       []byte
+	idResolver              types.IDResolver
+}
+
+// NewEngine creates a transformer of the given compiled config. It does not load anything, so it is
+// cheap enough to call per worker, or even per batch of records. Projectors, lookup tables, term
+// domains and schemas registered with the transformer are only seen by it, never by the compiled
+// config or the other transformers created from it. Dedup and mapping stats are also kept per
+// transformer, and so are the dedup key and digest stores unless the TransformationConfig sets
+// them, in which case they are shared.
+func NewEngine(compiled *CompiledConfig) (*DefaultTransformer, error) {
+	tconfig := compiled.transformationConfig
+	t := &DefaultTransformer{
+		registry:                compiled.registry.Clone(),
+		dataHarmonizationConfig: compiled.dataHarmonizationConfig,
+		mappingConfig:           compiled.mappingConfig,
+		transformationConfig:    tconfig,
+		lookupTables:            compiled.lookupTables.Clone(),
+		termTables:              compiled.termTables.Clone(),
+		schemas:                 compiled.schemas.Clone(),
+		dedupStore:              tconfig.DedupKeyStore,
+		digestStore:             tconfig.DigestStore,
+		digestIgnorePaths:       compiled.digestIgnorePaths,
+		configFingerprint:       compiled.configFingerprint,
+		idResolver:              compiled.idResolver,
+	}
+	if t.dedupStore == nil {
+		t.dedupStore = NewMemoryDedupKeyStore()
+	}
+	if t.digestStore == nil {
+		t.digestStore = NewMemoryDigestStore()
+	}
+	if tconfig.MappingStats {
+		t.mappingStats = &mappingStats{}
+	}
+
+	// The builtins reading the tables are bound to those of the compiled config, so they are rebound
+	// to the copies of this transformer.
+	projectors, err := tableProjectors(t.lookupTables, t.termTables, t.schemas)
+	if err != nil {
+		return nil, fmt.Errorf("builtins reading tables can not be created: %v", err)
+	}
+	for name, p := range projectors {
+		if err := t.registry.ReplaceProjector(name, p); err != nil {
+			return nil, fmt.Errorf("builtin %s is not registered in the compiled config: %v", name, err)
+		}
+	}
+
+	return t, nil
+}
+
+// tableProjectors creates the builtins that read the given lookup tables, term domains and schemas,
+// by name.
+func tableProjectors(lookupTables *builtins.LookupTables, termTables *builtins.TermTables, schemas *builtins.Schemas) (map[string]types.Projector, error) {
+	fns := map[string]interface{}{
+		lookupProjectorName:         lookupTables.Lookup,
+		lookupAllProjectorName:      lookupTables.LookupAll,
+		normalizeTermProjectorName:  termTables.NormalizeTerm,
+		matchesSchemaProjectorName:  schemas.MatchesSchema,
+		validateSchemaProjectorName: schemas.ValidateSchema,
+	}
+
+	projectors := make(map[string]types.Projector, len(fns))
+	for name, fn := range fns {
+		p, err := projector.FromFunction(fn, name)
+		if err != nil {
+			return nil, err
+		}
+		projectors[name] = p
+	}
+	return projectors, nil
+}
+
+// CompileConfig loads the given config (see CompiledConfig), returning any error in it or in the
+// TransformationConfig.
+func CompileConfig(ctx context.Context, config *dhpb.DataHarmonizationConfig, tconfig TransformationConfig, setters ...Option) (*CompiledConfig, error) {
+	termTables, err := builtins.NewTermTables()
+	if err != nil {
+		return nil, err
+	}
+
+	// The transformer the config is loaded into, which is only used to create the CompiledConfig.
 	t := &DefaultTransformer{
 		registry:                types.NewRegistry(),
 		dataHarmonizationConfig: config,
 		transformationConfig:    tconfig,
+		lookupTables:            builtins.NewLookupTables(),
+		termTables:              termTables,
+		schemas:                 builtins.NewSchemas(),
 	}
 
 	if err := registerall.RegisterAll(t.registry); err != nil {
 		return nil, err
 	}
 
+	if err := t.registry.RegisterProjector(mappingMetaProjectorName, mappingMetaProjector(tconfig.Metadata)); err != nil {
+		return nil, err
+	}
+
+	if err := t.registry.RegisterProjector(paramProjectorName, paramProjector); err != nil {
+		return nil, err
+	}
+
+	if err := t.registry.RegisterProjector(contextProjectorName, contextProjector); err != nil {
+		return nil, err
+	}
+
+	if err := t.registry.RegisterProjector(resolveIDProjectorName, resolveIDProjector); err != nil {
+		return nil, err
+	}
+
+	if err := t.registry.RegisterProjector(counterProjectorName, counterProjector); err != nil {
+		return nil, err
+	}
+
+	if err := t.registry.RegisterProjector(callFnProjectorName, callFnProjector); err != nil {
+		return nil, err
+	}
+
+	if err := t.registry.RegisterProjector(tryProjectorName, tryProjector); err != nil {
+		return nil, err
+	}
+
+	if err := t.registry.RegisterProjector(buildListProjectorName, buildListProjector); err != nil {
+		return nil, err
+	}
+
+	if d := tconfig.DeterministicForTesting; d != nil {
+		projectors, err := deterministicProjectors(d)
+		if err != nil {
+			return nil, err
+		}
+		for name, p := range projectors {
+			if err := t.registry.ReplaceProjector(name, p); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	shiftDate, err := projector.FromFunction(builtins.NewShiftDateWithClock(tconfig.DateShiftSecret, t.now), shiftDateProjectorName)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.registry.RegisterProjector(shiftDateProjectorName, shiftDate); err != nil {
+		return nil, err
+	}
+
+	for name, d := range tconfig.TermDomains {
+		if err := t.termTables.Register(name, d); err != nil {
+			return nil, err
+		}
+	}
+	projectors, err := tableProjectors(t.lookupTables, t.termTables, t.schemas)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{lookupProjectorName, lookupAllProjectorName, normalizeTermProjectorName, matchesSchemaProjectorName, validateSchemaProjectorName} {
+		if err := t.registry.RegisterProjector(name, projectors[name]); err != nil {
+			return nil, err
+		}
+	}
+
 	options := &Options{}
 	for _, setter := range setters {
 		setter(options)
@@ -170,16 +562,33 @@ func NewDefaultTransformer(ctx context.Context, config *dhpb.DataHarmonizationCo
 		return nil, err
 	}
 	t.mappingConfig = mpc
+	mapping.CompilePaths(mpc.GetRootMapping())
+	mapping.CompilePaths(mpc.GetPostProcessProjectorDefinition().GetMapping())
 
 	if err := t.LoadProjectors(mpc.GetProjector()); err != nil {
 		return nil, err
 	}
 
+	// The projectors of all configurations, and the projectors calling remote services, which are
+	// impure, so that pure projectors can be checked.
+	defs := append([]*mappb.ProjectorDefinition{}, mpc.GetProjector()...)
+	if pp := mpc.GetPostProcessProjectorDefinition(); pp != nil {
+		defs = append(defs, pp)
+	}
+	remote := make(map[string]bool)
+
 	// Load the library configurations.
 	for _, lc := range config.GetLibraryConfig() {
 		if err := t.LoadProjectors(lc.Projector); err != nil {
 			return nil, err
 		}
+		defs = append(defs, lc.Projector...)
+		for _, q := range lc.GetHttpQuery() {
+			remote[q.GetName()] = true
+		}
+		for _, cf := range lc.GetCloudFunction() {
+			remote[cf.GetName()] = true
+		}
 
 		if options.CloudFunctions {
 			if err := cloudfunction.LoadCloudFunctionProjectors(t.registry, lc.CloudFunction); err != nil {
@@ -214,10 +623,93 @@ func NewDefaultTransformer(ctx context.Context, config *dhpb.DataHarmonizationCo
 			if err := t.LoadProjectors(mpc.GetProjector()); err != nil {
 				return nil, err
 			}
+			defs = append(defs, mpc.GetProjector()...)
 		}
 	}
 
-	return t, nil
+	if err := mapping.CheckPurity(defs, remote); err != nil {
+		return nil, err
+	}
+
+	if t.configFingerprint, err = configFingerprint(mpc, defs); err != nil {
+		return nil, fmt.Errorf("could not compute fingerprint of mapping config: %v", err)
+	}
+
+	// Projectors registered later into the used namespaces (e.g. with RegisterNamespacedProjector) are
+	// checked for collisions as they are registered.
+	for _, ns := range mpc.GetUseNamespace() {
+		if err := t.registry.UseNamespace(ns); err != nil {
+			return nil, fmt.Errorf("error using namespace %q: %v", ns, err)
+		}
+	}
+
+	for name, policy := range tconfig.RetryPolicies {
+		if err := t.registry.SetRetryPolicy(name, policy); err != nil {
+			return nil, fmt.Errorf("error setting retry policy: %v", err)
+		}
+	}
+
+	for name, timeout := range tconfig.ProjectorTimeouts {
+		if err := t.registry.SetTimeout(name, timeout); err != nil {
+			return nil, fmt.Errorf("error setting projector timeout: %v", err)
+		}
+	}
+
+	for _, name := range t.preProcessProjectors() {
+		if _, err := t.registry.FindProjector(name); err != nil {
+			return nil, fmt.Errorf("error finding pre-process projector: %v", err)
+		}
+	}
+
+	for resourceType, name := range tconfig.BundleProjectors {
+		if _, err := t.registry.FindProjector(name); err != nil {
+			return nil, fmt.Errorf("error finding bundle projector for resourceType %q: %v", resourceType, err)
+		}
+	}
+
+	if len(tconfig.DedupKeyPaths) > 0 && tconfig.DedupKeyProjector != "" {
+		return nil, fmt.Errorf("only one of dedup key paths and dedup key projector may be set")
+	}
+	if name := tconfig.DedupKeyProjector; name != "" {
+		if _, err := t.registry.FindProjector(name); err != nil {
+			return nil, fmt.Errorf("error finding dedup key projector: %v", err)
+		}
+	}
+
+	if name := tconfig.RecordErrorProjector; name != "" {
+		if _, err := t.registry.FindProjector(name); err != nil {
+			return nil, fmt.Errorf("error finding record error projector: %v", err)
+		}
+	}
+
+	if tconfig.DeadLetterSink != nil && tconfig.RecordErrorPolicy != EmitRecordErrors {
+		return nil, fmt.Errorf("a dead-letter sink requires the EmitRecordErrors record error policy")
+	}
+
+	for _, path := range tconfig.DigestIgnorePaths {
+		segs, err := jsonutil.SegmentPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest ignore path %q: %v", path, err)
+		}
+		t.digestIgnorePaths = append(t.digestIgnorePaths, segs)
+	}
+
+	if tconfig.IDResolver != nil {
+		t.idResolver = types.NewCachingIDResolver(tconfig.IDResolver)
+	}
+
+	return &CompiledConfig{
+		registry:                t.registry,
+		dataHarmonizationConfig: config,
+		mappingConfig:           t.mappingConfig,
+		transformationConfig:    tconfig,
+		lookupTables:            t.lookupTables,
+		termTables:              t.termTables,
+		schemas:                 t.schemas,
+		digestIgnorePaths:       t.digestIgnorePaths,
+		configFingerprint:       t.configFingerprint,
+		idResolver:              t.idResolver,
+	}, nil
 }
 
 type invalidCloudFunctionProjectorError struct {
@@ -244,9 +736,39 @@ func (e invalidFetchProjectorError) Error() string {
 	return fmt.Sprintf("attempting to use disabled Fetch projectors feature with projectors: %v", names)
 }
 
+// newContext creates a context for evaluating mappings, with the given parameters layered on top of
+// the engine parameters.
+func (t *DefaultTransformer) newContext(params map[string]jsonutil.JSONToken) *types.Context {
+	pctx := types.NewContext(t.registry)
+	pctx.Params = layerParams(t.transformationConfig.Params, params)
+	pctx.StrictSourcePaths = t.transformationConfig.StrictSourcePaths
+	pctx.LenientAppend = t.transformationConfig.LenientAppend
+	pctx.IDResolver = t.idResolver
+	pctx.OutputBudget = types.NewOutputBudget(
+		budgetLimit(t.transformationConfig.MaxOutputTokens, types.DefaultMaxOutputTokens),
+		budgetLimit(t.transformationConfig.MaxArrayLength, types.DefaultMaxArrayLength))
+	if t.mappingStats != nil {
+		pctx.MappingStats = t.mappingStats
+	}
+	return pctx
+}
+
+// budgetLimit returns the output budget limit for the given configured limit, which defaults to def
+// if zero and means no limit if negative.
+func budgetLimit(configured, def int) int {
+	switch {
+	case configured == 0:
+		return def
+	case configured < 0:
+		return 0
+	default:
+		return configured
+	}
+}
+
 // Project is a convenience function to call a single projector out of context.
 func (t *DefaultTransformer) Project(projector string, args ...jsonutil.JSONMetaNode) (res jsonutil.JSONToken, err error) {
-	pctx := types.NewContext(t.registry)
+	pctx := t.newContext(nil)
 
 	defer errors.Recover("Project", func(e error) {
 		err = e
@@ -271,7 +793,8 @@ func (t *DefaultTransformer) LoadMappingConfig(config *dhpb.DataHarmonizationCon
 		case *hapb.StructureMappingConfig_MappingPathConfig:
 			return loadMappingConfig(mapping.MappingPathConfig.MappingConfigPath, mapping.MappingPathConfig.MappingType)
 		case *hapb.StructureMappingConfig_MappingLanguageString:
-			return transpiler.Transpile(mapping.MappingLanguageString)
+			mpc, _, err := transpiler.Transpile(mapping.MappingLanguageString, transpiler.Options{})
+			return mpc, err
 		default:
 			return nil, fmt.Errorf("unsupported structure mapping config type: %v", mapping)
 		}
@@ -282,41 +805,208 @@ func (t *DefaultTransformer) LoadMappingConfig(config *dhpb.DataHarmonizationCon
 // LoadProjectors registers all given projectors.
 func (t *DefaultTransformer) LoadProjectors(projectors []*mappb.ProjectorDefinition) error {
 	for _, pd := range projectors {
+		mapping.CompilePaths(pd.Mapping)
 		p := projector.FromDef(pd, mapping.NewWhistler())
 
 		if err := t.registry.RegisterProjector(pd.Name, p); err != nil {
 			return fmt.Errorf("error registering projector %s: %v", pd.Name, err)
 		}
+
+		if pd.ArgCount > 0 {
+			if err := t.registry.RegisterArity(pd.Name, int(pd.ArgCount)); err != nil {
+				return fmt.Errorf("error registering projector %s: %v", pd.Name, err)
+			}
+		}
+
+		if pd.Description != "" {
+			if err := t.registry.RegisterDescription(pd.Name, pd.Description); err != nil {
+				return fmt.Errorf("error registering projector %s: %v", pd.Name, err)
+			}
+		}
 	}
 	return nil
 }
 
 // Transform converts the json tree using the specified config.
-func (t *DefaultTransformer) Transform(in jsonutil.JSONToken) (res jsonutil.JSONToken, err error) {
-	pctx := types.NewContext(t.registry)
+func (t *DefaultTransformer) Transform(in jsonutil.JSONToken) (jsonutil.JSONToken, error) {
+	return t.TransformWithParams(in, nil)
+}
+
+// TransformWithParams converts the json tree using the specified config, with the given parameters
+// layered on top of the engine parameters from the TransformationConfig.
+func (t *DefaultTransformer) TransformWithParams(in jsonutil.JSONToken, params map[string]jsonutil.JSONToken) (jsonutil.JSONToken, error) {
+	return t.transform(t.newContext(params), in)
+}
+
+// TransformWithContext converts the json tree using the specified config, with the given context
+// data of the record (e.g. its source facility, or the control id of the message it came in)
+// readable from the mappings through $Context. The context data is only visible to this
+// transformation, so concurrent transformations can each be given their own.
+func (t *DefaultTransformer) TransformWithContext(in jsonutil.JSONToken, recordContext jsonutil.JSONContainer) (jsonutil.JSONToken, error) {
+	pctx := t.newContext(nil)
+	pctx.RecordContext = recordContext
+	return t.transform(pctx, in)
+}
+
+// PartialResult is the result of TransformPartial.
+type PartialResult struct {
+	// Output is the output of the root mappings that succeeded, after post processing.
+	Output jsonutil.JSONToken
+	// Errors are the errors of the root mappings that failed, in order.
+	Errors []mapping.MappingError
+}
+
+// TransformPartial converts the json tree like Transform, except that a root mapping that fails
+// does not fail the whole transformation: the other root mappings still run, and the output of the
+// ones that succeeded is returned along with the errors of the ones that failed. A failed root
+// mapping does not assign its variable or global, so root mappings reading it fail in turn. Its
+// writes to the output are not rolled back (see mapping.Whistler.ProcessMappingsPartially). A post process projector that takes two arguments is passed the errors as the second
+// one (see postprocess.ProcessPartial), e.g. to leave out resources that refer to missing ones.
+// Errors outside of the root mappings (e.g. in pre or post processing) still fail the whole
+// transformation.
+func (t *DefaultTransformer) TransformPartial(in jsonutil.JSONToken) (*PartialResult, error) {
+	out, mappingErrors, err := t.transformPartially(t.newContext(nil), in, true)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialResult{Output: out, Errors: mappingErrors}, nil
+}
+
+// LineageResult is the result of TransformWithLineage.
+type LineageResult struct {
+	// Output is the output of the transformation, as returned by Transform.
+	Output jsonutil.JSONToken
+	// Lineage maps the path of each leaf written by the mappings to its sources (see
+	// TransformWithLineage).
+	Lineage map[string][]string
+}
+
+// TransformWithLineage converts the json tree like Transform, and records where each leaf value
+// written by the mappings comes from. The lineage is keyed by the path of the leaf in the output of
+// the mappings, before post processing: root fields are keyed by their path (e.g. "meta.source"),
+// and fields of output objects by the name and index of the object (e.g. "Patient[0].name[0].given"
+// for the first object written to out Patient). The sources of a value copied from the input are
+// its path in it (e.g. "patient.name[0].given"), and those of a value computed by a builtin are the
+// name of the builtin with the sources of its arguments (e.g. "$ToUpper(patient.name[0].family)").
+// Values keep their sources when passed to and returned from projectors, or stored in variables.
+// Constants have no sources, and leaves without any are left out. Values read from globals are not
+// traced. A leaf lists at most 16 sources. Recording lineage costs roughly a copy of every value
+// written; Transform and the other methods do not record it.
+func (t *DefaultTransformer) TransformWithLineage(in jsonutil.JSONToken) (*LineageResult, error) {
+	pctx := t.newContext(nil)
+	pctx.Lineage = types.NewLineage()
+	out, err := t.transform(pctx, in)
+	if err != nil {
+		return nil, err
+	}
+	return &LineageResult{Output: out, Lineage: pctx.Lineage.Paths()}, nil
+}
+
+// transform converts the json tree using the specified config, evaluating the mappings in the given
+// context.
+func (t *DefaultTransformer) transform(pctx *types.Context, in jsonutil.JSONToken) (jsonutil.JSONToken, error) {
+	res, _, err := t.transformPartially(pctx, in, false)
+	return res, err
+}
+
+// transformPartially is transform, which processes the root mappings partially (returning the errors
+// of the ones that failed) if partial is set.
+func (t *DefaultTransformer) transformPartially(pctx *types.Context, in jsonutil.JSONToken, partial bool) (res jsonutil.JSONToken, mappingErrors []mapping.MappingError, err error) {
+	if metrics := t.transformationConfig.Metrics; metrics != nil {
+		// Deferred before recovering panics, so that it sees the error they are turned into.
+		start := time.Now()
+		metrics.Inc(MetricRecordsStarted, nil)
+		defer func() {
+			metrics.Observe(MetricRecordDuration, nil, time.Since(start).Seconds())
+			if err != nil {
+				metrics.Inc(MetricRecordsFailed, nil)
+			} else {
+				metrics.Inc(MetricRecordsProcessed, nil)
+			}
+		}()
+	}
+
 	defer errors.Recover("Transform", func(e error) {
 		err = e
 	})
 
 	pctx.Variables.Push()
 
-	inn, err := jsonutil.TokenToNode(in)
+	if d := t.transformationConfig.DeterministicForTesting; d != nil && pctx.Random == nil {
+		if pctx.Random, err = d.inputRandom(in); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	in, err = preProcess(pctx, t.preProcessProjectors(), in)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args, err := t.rootArgs(in)
 	if err != nil {
-		return nil, fmt.Errorf("input was invalid: %v", err)
+		return nil, nil, err
 	}
-	args := []jsonutil.JSONMetaNode{inn}
 
 	e := mapping.NewWhistler()
-	if err := e.ProcessMappings(t.mappingConfig.RootMapping, "root", args, pctx.Output, pctx); err != nil {
-		return nil, err
+	if partial {
+		pe, ok := e.(mapping.PartialEngine)
+		if !ok {
+			return nil, nil, fmt.Errorf("engine %T can not process mappings partially", e)
+		}
+		mappingErrors = pe.ProcessMappingsPartially(t.mappingConfig.RootMapping, "root", args, pctx.Output, pctx)
+		for range mappingErrors {
+			t.incMetric(MetricRootMappingErrors, nil)
+		}
+	} else if err := e.ProcessMappings(t.mappingConfig.RootMapping, "root", args, pctx.Output, pctx); err != nil {
+		t.incMetric(MetricRootMappingErrors, nil)
+		return nil, nil, err
 	}
 
-	result, err := postprocess.Process(pctx, t.mappingConfig, t.transformationConfig.SkipBundling, e)
+	if path := t.transformationConfig.MetadataStampPath; path != "" {
+		if err := stampMetadata(pctx, path, t.transformationConfig.Metadata); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if t.outputValidator != nil {
+		if err := validateOutputs(pctx, t.outputValidator, t.transformationConfig.OutputValidationSeverity); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if t.dedupEnabled() {
+		if err := t.dedupOutputs(pctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if metrics := t.transformationConfig.Metrics; metrics != nil {
+		for target, objs := range pctx.TopLevelObjects {
+			labels := map[string]string{MetricTargetLabel: target}
+			for range objs {
+				metrics.Inc(MetricOutputs, labels)
+			}
+		}
+	}
+
+	postStart := time.Now()
+	result, err := postprocess.ProcessPartial(pctx, t.mappingConfig, t.transformationConfig.SkipBundling, e, mappingErrors)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if metrics := t.transformationConfig.Metrics; metrics != nil {
+		metrics.Observe(MetricPostProcessDuration, nil, time.Since(postStart).Seconds())
 	}
 
-	return result, nil
+	return result, mappingErrors, nil
+}
+
+// incMetric increments the given counter of TransformationConfig.Metrics, if set.
+func (t *DefaultTransformer) incMetric(name string, labels map[string]string) {
+	if metrics := t.transformationConfig.Metrics; metrics != nil {
+		metrics.Inc(name, labels)
+	}
 }
 
 // JSONtoJSON converts the byte array (JSON format) using the specified config.
@@ -330,7 +1020,7 @@ func (t *DefaultTransformer) JSONtoJSON(in json.RawMessage) (json.RawMessage, er
 	if err != nil {
 		return nil, err
 	}
-	return json.Marshal(res)
+	return t.MarshalOutput(res)
 }
 
 // ParseJSON parses the given JSON into a JSONToken.
@@ -342,6 +1032,22 @@ func (t *DefaultTransformer) ParseJSON(in json.RawMessage) (jsonutil.JSONToken,
 	return mc, nil
 }
 
+// MarshalOutput serializes the given output in the configured TransformationConfig.OutputFormat.
+func (t *DefaultTransformer) MarshalOutput(out jsonutil.JSONToken) (json.RawMessage, error) {
+	switch t.transformationConfig.OutputFormat {
+	case CanonicalOutput:
+		return jsonutil.MarshalCanonical(out)
+	case PrettyOutput:
+		indent := t.transformationConfig.OutputIndent
+		if indent == "" {
+			indent = defaultOutputIndent
+		}
+		return jsonutil.MarshalPretty(out, indent)
+	default:
+		return json.Marshal(out)
+	}
+}
+
 // Registry returns the registry in DefaultTransformer.
 func (t *DefaultTransformer) Registry() *types.Registry {
 	return t.registry
@@ -352,6 +1058,30 @@ func (t *DefaultTransformer) RegisterProjector(name string, proj types.Projector
 	return t.registry.RegisterProjector(name, proj)
 }
 
+// RegisterNamespacedProjector adds the given Projector to this transformer's registry under the
+// given namespace. See types.Registry.RegisterNamespacedProjector.
+func (t *DefaultTransformer) RegisterNamespacedProjector(namespace, name string, proj types.Projector) error {
+	return t.registry.RegisterNamespacedProjector(namespace, name, proj)
+}
+
+// RegisterLookupTable makes the given rows available to the $Lookup and $LookupAll builtins as the
+// table with the given name, indexed by the given key field. See builtins.LookupTables.
+func (t *DefaultTransformer) RegisterLookupTable(name string, rows jsonutil.JSONArr, keyField string) error {
+	return t.lookupTables.Register(name, rows, keyField)
+}
+
+// RegisterTermDomain adds the given domain to the $NormalizeTerm builtin, or overrides the terms of
+// an existing one. See builtins.TermTables.
+func (t *DefaultTransformer) RegisterTermDomain(name string, domain builtins.TermDomain) error {
+	return t.termTables.Register(name, domain)
+}
+
+// RegisterSchema makes the given JSON Schema available to the $MatchesSchema and $ValidateSchema
+// builtins as the schema with the given name. See builtins.Schemas for the supported keywords.
+func (t *DefaultTransformer) RegisterSchema(name string, schema jsonutil.JSONToken) error {
+	return t.schemas.Register(name, schema)
+}
+
 // HasPostProcessProjector returns true iff a post process projector is set.
 func (t *DefaultTransformer) HasPostProcessProjector() bool {
 	return t.mappingConfig.GetPostProcessProjectorDefinition() != nil || t.mappingConfig.GetPostProcessProjectorName() != ""
@@ -360,19 +1090,20 @@ func (t *DefaultTransformer) HasPostProcessProjector() bool {
 // loadMappingConfig loads a mapping config from GCS.
 func loadMappingConfig(loc *httppb.Location, typ hapb.MappingType) (*mappb.MappingConfig, error) {
 	var data []byte
+	var name string
 	switch l := loc.Location.(type) {
 	case *httppb.Location_GcsLocation:
 		d, err := gcsutil.ReadFromGcs(context.Background(), l.GcsLocation)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read mapping config from GCS, %v", err)
 		}
-		data = d
+		data, name = d, l.GcsLocation
 	case *httppb.Location_LocalPath:
 		d, err := ioutil.ReadFile(l.LocalPath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read library file with error %v", err)
 		}
-		data = d
+		data, name = d, l.LocalPath
 	case *httppb.Location_UrlPath:
 		return nil, fmt.Errorf("loading mappings from remote path %s is unsupported", l.UrlPath)
 	default:
@@ -386,7 +1117,7 @@ func loadMappingConfig(loc *httppb.Location, typ hapb.MappingType) (*mappb.Mappi
 			return nil, err
 		}
 	case hapb.MappingType_MAPPING_LANGUAGE:
-		lmpc, err := transpiler.Transpile(string(data))
+		lmpc, _, err := transpiler.Transpile(string(data), transpiler.Options{FileName: name})
 		if err != nil {
 			return nil, err
 		}
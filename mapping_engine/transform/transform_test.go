@@ -17,9 +17,18 @@ package transform
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/builtins" /* copybara-comment: builtins */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/transpiler" /* copybara-comment: transpiler */
 	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
 	"google.golang.org/protobuf/encoding/prototext" /* copybara-comment: prototext */
 	"google.golang.org/protobuf/proto" /* copybara-comment: proto */
@@ -826,3 +835,3274 @@ func TestTransformer_HasPostProcessProjector(t *testing.T) {
 		)
 	}
 }
+
+func TestTransformer_Metadata(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+Encounter[]: Encounter_Encounter($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.ID
+  meta.source: $MappingMeta("config")
+  meta.versionId: $MappingMeta("unset")
+}
+
+def Encounter_Encounter(p) {
+  resourceType: "Encounter"
+  subject: p.ID
+}
+
+post Bundle(output) {
+  patients: output.Patient
+  encounters: output.Encounter
+  patientTags: $ListLen(output.Patient[0].meta.tag)
+}`
+
+	metadata := map[string]string{"config": "test-mapping", "run": "42"}
+
+	tests := []struct {
+		name    string
+		tconfig TransformationConfig
+		want    string
+	}{
+		{
+			name:    "no stamping by default",
+			tconfig: TransformationConfig{Metadata: metadata},
+			want: `{"encounters":[{"resourceType":"Encounter","subject":"test"}],` +
+				`"patientTags":0,` +
+				`"patients":[{"id":"test","meta":{"source":"test-mapping"},"resourceType":"Patient"}]}`,
+		},
+		{
+			name:    "stamp array path",
+			tconfig: TransformationConfig{Metadata: metadata, MetadataStampPath: "meta.tag[]"},
+			want: `{"encounters":[{"meta":{"tag":[{"code":"test-mapping","system":"config"},{"code":"42","system":"run"}]},"resourceType":"Encounter","subject":"test"}],` +
+				`"patientTags":2,` +
+				`"patients":[{"id":"test","meta":{"source":"test-mapping","tag":[{"code":"test-mapping","system":"config"},{"code":"42","system":"run"}]},"resourceType":"Patient"}]}`,
+		},
+		{
+			name:    "stamp object path",
+			tconfig: TransformationConfig{Metadata: metadata, MetadataStampPath: "provenance"},
+			want: `{"encounters":[{"provenance":{"config":"test-mapping","run":"42"},"resourceType":"Encounter","subject":"test"}],` +
+				`"patientTags":0,` +
+				`"patients":[{"id":"test","meta":{"source":"test-mapping"},"provenance":{"config":"test-mapping","run":"42"},"resourceType":"Patient"}]}`,
+		},
+		{
+			name:    "stamp without post processing",
+			tconfig: TransformationConfig{Metadata: metadata, MetadataStampPath: "meta.tag[]", SkipBundling: true},
+			want: `{"Encounter":[{"meta":{"tag":[{"code":"test-mapping","system":"config"},{"code":"42","system":"run"}]},"resourceType":"Encounter","subject":"test"}],` +
+				`"Patient":[{"id":"test","meta":{"source":"test-mapping","tag":[{"code":"test-mapping","system":"config"},{"code":"42","system":"run"}]},"resourceType":"Patient"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dhconfig := &dhpb.DataHarmonizationConfig{
+				StructureMappingConfig: &hpb.StructureMappingConfig{
+					Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+						MappingLanguageString: whistle,
+					},
+				},
+			}
+
+			tr, err := NewTransformer(context.Background(), dhconfig, test.tconfig)
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+
+			in := `{"ID": "test"}`
+			got, err := tr.JSONtoJSON(json.RawMessage(in))
+			if err != nil {
+				t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+			}
+
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_OutputValidator(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+out Patient: Patient_Patient($root.other)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.ID
+}`
+
+	tests := []struct {
+		name     string
+		severity ValidationSeverity
+		want     string
+		wantErr  string
+	}{
+		{
+			name:    "reject",
+			wantErr: "invalid output Patient[1]",
+		},
+		{
+			name:     "warn",
+			severity: WarnInvalidOutput,
+			want:     `{"Patient":[{"id":"test","resourceType":"Patient"},{"id":"not_valid","resourceType":"Patient"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dhconfig := &dhpb.DataHarmonizationConfig{
+				StructureMappingConfig: &hpb.StructureMappingConfig{
+					Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+						MappingLanguageString: whistle,
+					},
+				},
+			}
+
+			tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{OutputValidationSeverity: test.severity})
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+			tr.SetOutputValidator(FHIRShapeValidator)
+
+			in := `{"ID": "test", "other": {"ID": "not_valid"}}`
+			got, err := tr.JSONtoJSON(json.RawMessage(in))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("JSONtoJSON(%v) got error %v, want error containing %q", in, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+			}
+
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_Params(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  identifier[].system: $Param("system")
+  identifier[0].assigner: $Param("assigner")
+  identifier[0].assigner.display: "Facility"
+  identifier[0].value: p.ID
+}`
+
+	defaults := map[string]jsonutil.JSONToken{
+		"system":   jsonutil.JSONStr("urn:oid:1.2.3"),
+		"assigner": jsonutil.JSONContainer{},
+	}
+
+	tests := []struct {
+		name      string
+		overrides map[string]jsonutil.JSONToken
+		want      string
+		wantErr   string
+	}{
+		{
+			name: "engine defaults",
+			want: `{"Patient":[{"identifier":[{"assigner":{"display":"Facility"},"system":"urn:oid:1.2.3","value":"test"}],"resourceType":"Patient"}]}`,
+		},
+		{
+			name:      "per call override",
+			overrides: map[string]jsonutil.JSONToken{"system": jsonutil.JSONStr("urn:oid:4.5.6")},
+			want:      `{"Patient":[{"identifier":[{"assigner":{"display":"Facility"},"system":"urn:oid:4.5.6","value":"test"}],"resourceType":"Patient"}]}`,
+		},
+		{
+			name:      "per call only",
+			overrides: map[string]jsonutil.JSONToken{"unused": jsonutil.JSONNum(1)},
+			want:      `{"Patient":[{"identifier":[{"assigner":{"display":"Facility"},"system":"urn:oid:1.2.3","value":"test"}],"resourceType":"Patient"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dhconfig := &dhpb.DataHarmonizationConfig{
+				StructureMappingConfig: &hpb.StructureMappingConfig{
+					Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+						MappingLanguageString: whistle,
+					},
+				},
+			}
+
+			tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{Params: defaults, SkipBundling: true})
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+
+			in, err := tr.ParseJSON(json.RawMessage(`{"ID": "test"}`))
+			if err != nil {
+				t.Fatalf("ParseJSON got unexpected error: %v", err)
+			}
+			res, err := tr.TransformWithParams(in, test.overrides)
+			if err != nil {
+				t.Fatalf("TransformWithParams(%v, %v) got unexpected error: %v", in, test.overrides, err)
+			}
+			got, err := json.Marshal(res)
+			if err != nil {
+				t.Fatalf("could not marshal result: %v", err)
+			}
+
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("TransformWithParams(%v, %v) returned diff (-want +got):\n%s", in, test.overrides, diff)
+			}
+			if diff := cmp.Diff(jsonutil.JSONContainer{}, defaults["assigner"]); diff != "" {
+				t.Errorf("TransformWithParams(%v, %v) modified the engine parameters (-want +got):\n%s", in, test.overrides, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_UnknownParam(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $Param("sytem")`,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{
+		Params: map[string]jsonutil.JSONToken{"system": jsonutil.JSONStr("urn:oid:1.2.3"), "assigner": jsonutil.JSONStr("a")},
+	})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	in := `{}`
+	wantErr := `unknown parameter "sytem", available parameters are [assigner system]`
+	if _, err := tr.JSONtoJSON(json.RawMessage(in)); err == nil || !strings.Contains(err.Error(), wantErr) {
+		t.Errorf("JSONtoJSON(%v) got error %v, want error containing %q", in, err, wantErr)
+	}
+}
+
+func TestTransformer_RecordContext(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.ID
+  meta.source: $Context("facility")
+  meta.tag[0].code: $Context("envelope.controlId")
+  meta.lastUpdated: $Context("envelope.received")
+  if $IsNil($Context("missing.path")) {
+    active: true
+  }
+}`
+
+	tests := []struct {
+		name          string
+		recordContext string
+		want          string
+	}{
+		{
+			name:          "context data",
+			recordContext: `{"facility": "north", "envelope": {"controlId": "MSG-1", "received": "2020-01-02T03:04:05Z"}}`,
+			want:          `{"Patient":[{"active":true,"id":"test","meta":{"lastUpdated":"2020-01-02T03:04:05Z","source":"north","tag":[{"code":"MSG-1"}]},"resourceType":"Patient"}]}`,
+		},
+		{
+			name:          "partial context data",
+			recordContext: `{"facility": "south"}`,
+			want:          `{"Patient":[{"active":true,"id":"test","meta":{"source":"south"},"resourceType":"Patient"}]}`,
+		},
+		{
+			name: "no context data",
+			want: `{"Patient":[{"active":true,"id":"test","resourceType":"Patient"}]}`,
+		},
+	}
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in, err := tr.ParseJSON(json.RawMessage(`{"ID": "test"}`))
+			if err != nil {
+				t.Fatalf("ParseJSON got unexpected error: %v", err)
+			}
+			var recordContext jsonutil.JSONContainer
+			if test.recordContext != "" {
+				parsed, err := tr.ParseJSON(json.RawMessage(test.recordContext))
+				if err != nil {
+					t.Fatalf("ParseJSON got unexpected error: %v", err)
+				}
+				recordContext = parsed.(jsonutil.JSONContainer)
+			}
+			res, err := tr.TransformWithContext(in, recordContext)
+			if err != nil {
+				t.Fatalf("TransformWithContext(%v, %v) got unexpected error: %v", in, test.recordContext, err)
+			}
+			got, err := json.Marshal(res)
+			if err != nil {
+				t.Fatalf("could not marshal result: %v", err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("TransformWithContext(%v, %v) returned diff (-want +got):\n%s", in, test.recordContext, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_RecordContextConcurrent(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  id: p.ID
+  meta.source: $Context("facility")
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	// Each record must only see its own context data, however the transformations interleave.
+	const records = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, records)
+	for r := 0; r < records; r++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			in, err := tr.ParseJSON(json.RawMessage(`{"ID": "` + id + `"}`))
+			if err != nil {
+				errs <- fmt.Errorf("ParseJSON got unexpected error: %v", err)
+				return
+			}
+			recordContext, err := tr.ParseJSON(json.RawMessage(`{"facility": "` + id + `-facility"}`))
+			if err != nil {
+				errs <- fmt.Errorf("ParseJSON got unexpected error: %v", err)
+				return
+			}
+			res, err := tr.TransformWithContext(in, recordContext.(jsonutil.JSONContainer))
+			if err != nil {
+				errs <- fmt.Errorf("TransformWithContext(%v) got unexpected error: %v", id, err)
+				return
+			}
+			got, err := json.Marshal(res)
+			if err != nil {
+				errs <- fmt.Errorf("could not marshal result: %v", err)
+				return
+			}
+			want := `{"Patient":[{"id":"` + id + `","meta":{"source":"` + id + `-facility"}}]}`
+			if diff := cmp.Diff(want, string(got)); diff != "" {
+				errs <- fmt.Errorf("TransformWithContext(%v) returned diff (-want +got):\n%s", id, diff)
+			}
+		}(fmt.Sprintf("patient-%d", r))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestTransformer_LookupTables(t *testing.T) {
+	whistle := `
+out Encounter: Encounter_Encounter($root)
+
+def Encounter_Encounter(e) {
+  var facility: $Lookup("facilities", e.facility)
+  var locations: $LookupAll("locations", e.facility)
+  resourceType: "Encounter"
+  serviceProvider.display: facility.name
+  location: Location(locations[])
+  unknownFacility: $Lookup("facilities", "nope")
+}
+
+def Location(l) {
+  display: l.name
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	tables := map[string]string{
+		"facilities": `[{"code": "F1", "name": "General Hospital"}, {"code": "F2", "name": "Eastside Clinic"}]`,
+		"locations":  `[{"code": "F1", "name": "Ward A"}, {"code": "F2", "name": "Ward B"}, {"code": "F1", "name": "Ward C"}]`,
+	}
+	for name, rows := range tables {
+		parsed, err := tr.ParseJSON(json.RawMessage(rows))
+		if err != nil {
+			t.Fatalf("ParseJSON(%v) got unexpected error: %v", rows, err)
+		}
+		if err := tr.RegisterLookupTable(name, parsed.(jsonutil.JSONArr), "code"); err != nil {
+			t.Fatalf("RegisterLookupTable(%q, ...) got unexpected error: %v", name, err)
+		}
+	}
+
+	in := `{"facility": "F1"}`
+	got, err := tr.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+
+	want := `{"Encounter":[{"location":[{"display":"Ward A"},{"display":"Ward C"}],"resourceType":"Encounter","serviceProvider":{"display":"General Hospital"}}]}`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+}
+
+func TestTransformer_Schemas(t *testing.T) {
+	whistle := `
+valid: $MatchesSchema($root, "vendor-patient")
+violations: $ValidateSchema($root, "vendor-patient")`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	schema := `{"type": "object", "required": ["mrn"], "properties": {"sex": {"enum": ["M", "F", "U"]}}}`
+	parsed, err := tr.ParseJSON(json.RawMessage(schema))
+	if err != nil {
+		t.Fatalf("ParseJSON(%v) got unexpected error: %v", schema, err)
+	}
+	if err := tr.RegisterSchema("vendor-patient", parsed); err != nil {
+		t.Fatalf("RegisterSchema(vendor-patient, %v) got unexpected error: %v", schema, err)
+	}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   `{"mrn": "123", "sex": "F"}`,
+			want: `{"valid":true}`,
+		},
+		{
+			in:   `{"sex": "female"}`,
+			want: `{"valid":false,"violations":[{"message":"required field is missing","path":"mrn"},{"message":"\"female\" is not one of [\"M\",\"F\",\"U\"]","path":"sex"}]}`,
+		},
+	}
+	for _, test := range tests {
+		got, err := tr.JSONtoJSON(json.RawMessage(test.in))
+		if err != nil {
+			t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", test.in, err)
+		}
+		if diff := cmp.Diff(test.want, string(got)); diff != "" {
+			t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestTransformer_IteratedCallFilters(t *testing.T) {
+	// Build is only called for the numeric OBX, so the text one, which $ParseFloat fails on, is never
+	// mapped, and the results have no nulls in their place.
+	whistle := `
+filtered: Build($root.obx[] where $.type = "NM")
+inline: Build($root.obx[where $.type = "NM"][])
+captured: Build($root.obx[] where $.type = $root.numericType)
+
+def Build(obx) {
+  value: $ParseFloat(obx.value)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	in := `{"numericType": "NM", "obx": [{"type": "NM", "value": "1.5"}, {"type": "TX", "value": "abc"}, {"type": "NM", "value": "2"}]}`
+	want := `{"captured":[{"value":1.5},{"value":2}],"filtered":[{"value":1.5},{"value":2}],"inline":[{"value":1.5},{"value":2}]}`
+	got, err := tr.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+}
+
+func TestTransformer_ProcessBundle(t *testing.T) {
+	whistle := `
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.id
+  name: p.name[0].family
+}
+
+def Observation_Observation(o) {
+  resourceType: "Observation"
+  id: o.id
+  value: $ParseFloat(o.value)
+  out Audit: AuditEvent(o)
+}
+
+def AuditEvent(o) {
+  resourceType: "AuditEvent"
+  entity.what: $StrCat("Observation/", o.id)
+}`
+
+	bundle := `{
+  "resourceType": "Bundle",
+  "type": "transaction",
+  "entry": [
+    {"fullUrl": "urn:uuid:p1", "resource": {"resourceType": "Patient", "id": "p1", "name": [{"family": "Smith"}]}},
+    {"fullUrl": "urn:uuid:o1", "resource": {"resourceType": "Observation", "id": "o1", "value": "5"}},
+    {"fullUrl": "urn:uuid:o2", "resource": {"resourceType": "Observation", "id": "o2", "value": "five"}},
+    {"resource": {"resourceType": "Device", "id": "d1"}}
+  ]
+}`
+
+	projectors := map[string]string{
+		"Patient":     "Patient_Patient",
+		"Observation": "Observation_Observation",
+	}
+
+	tests := []struct {
+		name       string
+		policy     UnmappedResourcePolicy
+		failOnErr  bool
+		want       string
+		wantErrors []string
+		wantErr    bool
+	}{
+		{
+			name:   "skip unmapped",
+			policy: SkipUnmappedResources,
+			want: `{"entry":[` +
+				`{"resource":{"id":"p1","name":"Smith","resourceType":"Patient"}},` +
+				`{"resource":{"id":"o1","resourceType":"Observation","value":5}},` +
+				`{"resource":{"entity":{"what":"Observation/o1"},"resourceType":"AuditEvent"}}` +
+				`],"resourceType":"Bundle","type":"collection"}`,
+			wantErrors: []string{"entry[2] (urn:uuid:o2)"},
+		},
+		{
+			name:   "pass through unmapped",
+			policy: PassThroughUnmappedResources,
+			want: `{"entry":[` +
+				`{"resource":{"id":"p1","name":"Smith","resourceType":"Patient"}},` +
+				`{"resource":{"id":"o1","resourceType":"Observation","value":5}},` +
+				`{"resource":{"entity":{"what":"Observation/o1"},"resourceType":"AuditEvent"}},` +
+				`{"resource":{"id":"d1","resourceType":"Device"}}` +
+				`],"resourceType":"Bundle","type":"collection"}`,
+			wantErrors: []string{"entry[2] (urn:uuid:o2)"},
+		},
+		{
+			name:   "reject unmapped",
+			policy: RejectUnmappedResources,
+			want: `{"entry":[` +
+				`{"resource":{"id":"p1","name":"Smith","resourceType":"Patient"}},` +
+				`{"resource":{"id":"o1","resourceType":"Observation","value":5}},` +
+				`{"resource":{"entity":{"what":"Observation/o1"},"resourceType":"AuditEvent"}}` +
+				`],"resourceType":"Bundle","type":"collection"}`,
+			wantErrors: []string{"entry[2] (urn:uuid:o2)", "entry[3]: no projector is configured for resourceType \"Device\""},
+		},
+		{
+			name:      "fail on entry error",
+			policy:    SkipUnmappedResources,
+			failOnErr: true,
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dhconfig := &dhpb.DataHarmonizationConfig{
+				StructureMappingConfig: &hpb.StructureMappingConfig{
+					Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+						MappingLanguageString: whistle,
+					},
+				},
+			}
+
+			tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{
+				SkipBundling:           true,
+				BundleProjectors:       projectors,
+				UnmappedResourcePolicy: test.policy,
+				FailOnBundleEntryError: test.failOnErr,
+			})
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+
+			in, err := tr.ParseJSON(json.RawMessage(bundle))
+			if err != nil {
+				t.Fatalf("ParseJSON(%v) got unexpected error: %v", bundle, err)
+			}
+
+			res, err := tr.ProcessBundle(in)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ProcessBundle(%v) = %v, want error", bundle, res)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessBundle(%v) got unexpected error: %v", bundle, err)
+			}
+
+			got, err := json.Marshal(res.Bundle)
+			if err != nil {
+				t.Fatalf("json.Marshal(%v) got unexpected error: %v", res.Bundle, err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("ProcessBundle(%v) returned diff (-want +got):\n%s", bundle, diff)
+			}
+
+			if len(res.Errors) != len(test.wantErrors) {
+				t.Fatalf("ProcessBundle(%v) returned errors %v, want %d errors", bundle, res.Errors, len(test.wantErrors))
+			}
+			for i, e := range res.Errors {
+				if !strings.HasPrefix(e.Error(), test.wantErrors[i]) {
+					t.Errorf("ProcessBundle(%v) error %d = %q, want prefix %q", bundle, i, e.Error(), test.wantErrors[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTransformer_UnknownBundleProjector(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `def Patient_Patient(p) {
+  id: p.id
+}`,
+			},
+		},
+	}
+
+	tconfig := TransformationConfig{SkipBundling: true, BundleProjectors: map[string]string{"Patient": "Patient_Typo"}}
+	if _, err := NewTransformer(context.Background(), dhconfig, tconfig); err == nil {
+		t.Errorf("NewTransformer with unknown bundle projector got nil error, want error")
+	}
+}
+
+func TestTransformer_ProcessBatch(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.id
+  age: Age(p.age)
+}
+
+def Age(a) {
+  $this: $ParseFloat(a)
+}
+
+def Outcome(e) {
+  resourceType: "OperationOutcome"
+  issue[0].severity: "error"
+  issue[0].diagnostics: $StrCat("record ", e.recordIndex)
+  issue[0].expression: e.projectorStack
+}`
+
+	records := []string{
+		`{"id": "p0", "age": "5"}`,
+		`{"id": "p1", "age": "five"}`,
+		`{"id": "p2", "age": "7"}`,
+		`{"id": "p3", "age": "seven"}`,
+	}
+	stack := []string{"Patient_Patient", "Age", "$ParseFloat"}
+
+	tests := []struct {
+		name       string
+		tconfig    TransformationConfig
+		want       []string
+		wantErrors []int
+		wantErr    string
+	}{
+		{
+			name:    "fail on record error",
+			tconfig: TransformationConfig{SkipBundling: true},
+			wantErr: "record[1] (in Patient_Patient > Age > $ParseFloat): ",
+		},
+		{
+			name:    "collect record errors",
+			tconfig: TransformationConfig{SkipBundling: true, RecordErrorPolicy: CollectRecordErrors},
+			want: []string{
+				`{"Patient":[{"age":5,"id":"p0","resourceType":"Patient"}]}`,
+				`null`,
+				`{"Patient":[{"age":7,"id":"p2","resourceType":"Patient"}]}`,
+				`null`,
+			},
+			wantErrors: []int{1, 3},
+		},
+		{
+			name: "emit record errors",
+			tconfig: TransformationConfig{
+				SkipBundling:         true,
+				RecordErrorPolicy:    EmitRecordErrors,
+				RecordErrorTarget:    "OperationOutcome",
+				RecordErrorProjector: "Outcome",
+			},
+			want: []string{
+				`{"Patient":[{"age":5,"id":"p0","resourceType":"Patient"}]}`,
+				`{"OperationOutcome":[{"issue":[{"diagnostics":"record 1","expression":["Patient_Patient","Age","$ParseFloat"],"severity":"error"}],"resourceType":"OperationOutcome"}]}`,
+				`{"Patient":[{"age":7,"id":"p2","resourceType":"Patient"}]}`,
+				`{"OperationOutcome":[{"issue":[{"diagnostics":"record 3","expression":["Patient_Patient","Age","$ParseFloat"],"severity":"error"}],"resourceType":"OperationOutcome"}]}`,
+			},
+			wantErrors: []int{1, 3},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dhconfig := &dhpb.DataHarmonizationConfig{
+				StructureMappingConfig: &hpb.StructureMappingConfig{
+					Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+						MappingLanguageString: whistle,
+					},
+				},
+			}
+
+			tr, err := NewDefaultTransformer(context.Background(), dhconfig, test.tconfig)
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+
+			var in []jsonutil.JSONToken
+			for _, r := range records {
+				parsed, err := tr.ParseJSON(json.RawMessage(r))
+				if err != nil {
+					t.Fatalf("ParseJSON(%v) got unexpected error: %v", r, err)
+				}
+				in = append(in, parsed)
+			}
+
+			res, err := tr.ProcessBatch(in)
+			if test.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.wantErr) {
+					t.Fatalf("ProcessBatch(%v) returned error %v, want error with prefix %q", records, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ProcessBatch(%v) got unexpected error: %v", records, err)
+			}
+
+			var got []string
+			for _, out := range res.Outputs {
+				b, err := json.Marshal(out)
+				if err != nil {
+					t.Fatalf("json.Marshal(%v) got unexpected error: %v", out, err)
+				}
+				got = append(got, string(b))
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("ProcessBatch(%v) returned diff (-want +got):\n%s", records, diff)
+			}
+
+			var gotErrors []int
+			for _, e := range res.Errors {
+				gotErrors = append(gotErrors, e.Index)
+				if diff := cmp.Diff(stack, e.ProjectorStack); diff != "" {
+					t.Errorf("ProcessBatch(%v) error %d has projector stack diff (-want +got):\n%s", records, e.Index, diff)
+				}
+			}
+			if diff := cmp.Diff(test.wantErrors, gotErrors); diff != "" {
+				t.Errorf("ProcessBatch(%v) returned errors for records diff (-want +got):\n%s", records, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_Metrics(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.id
+  age: $ParseFloat(p.age)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	metrics := NewInMemoryMetrics()
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true, RecordErrorPolicy: CollectRecordErrors, Metrics: metrics})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	var in []jsonutil.JSONToken
+	for _, r := range []string{`{"id": "p0", "age": "5"}`, `{"id": "p1", "age": "five"}`, `{"id": "p2", "age": "7"}`} {
+		parsed, err := tr.ParseJSON(json.RawMessage(r))
+		if err != nil {
+			t.Fatalf("ParseJSON(%v) got unexpected error: %v", r, err)
+		}
+		in = append(in, parsed)
+	}
+	if _, err := tr.ProcessBatch(in); err != nil {
+		t.Fatalf("ProcessBatch got unexpected error: %v", err)
+	}
+
+	got := metrics.Snapshot()
+	wantCounters := map[string]int64{
+		MetricRecordsStarted:    3,
+		MetricRecordsProcessed:  2,
+		MetricRecordsFailed:     1,
+		MetricRootMappingErrors: 1,
+		MetricKey(MetricOutputs, map[string]string{MetricTargetLabel: "Patient"}): 2,
+	}
+	if diff := cmp.Diff(wantCounters, got.Counters); diff != "" {
+		t.Errorf("Snapshot() returned counters diff (-want +got):\n%s", diff)
+	}
+	if c := got.Distributions[MetricRecordDuration].Count; c != 3 {
+		t.Errorf("Snapshot() has %d record durations, want 3", c)
+	}
+	if c := got.Distributions[MetricPostProcessDuration].Count; c != 2 {
+		t.Errorf("Snapshot() has %d post process durations, want 2", c)
+	}
+}
+
+func TestTransformer_ProjectorTimeouts(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.id
+  name: $LookupName(p.id)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true, RecordErrorPolicy: CollectRecordErrors})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	// $LookupName is slow for p1, like a remote service that does not respond.
+	lookup := func(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+		id, err := jsonutil.NodeToToken(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if id == jsonutil.JSONStr("p1") {
+			<-pctx.GoContext.Done()
+			return nil, pctx.GoContext.Err()
+		}
+		return jsonutil.JSONStr(fmt.Sprintf("name of %v", id)), nil
+	}
+	if err := tr.RegisterProjector("$LookupName", lookup); err != nil {
+		t.Fatalf("RegisterProjector($LookupName) got unexpected error: %v", err)
+	}
+	if err := tr.Registry().SetTimeout("$LookupName", 10*time.Millisecond); err != nil {
+		t.Fatalf("SetTimeout($LookupName) got unexpected error: %v", err)
+	}
+
+	var in []jsonutil.JSONToken
+	for _, r := range []string{`{"id": "p0"}`, `{"id": "p1"}`, `{"id": "p2"}`} {
+		parsed, err := tr.ParseJSON(json.RawMessage(r))
+		if err != nil {
+			t.Fatalf("ParseJSON(%v) got unexpected error: %v", r, err)
+		}
+		in = append(in, parsed)
+	}
+
+	res, err := tr.ProcessBatch(in)
+	if err != nil {
+		t.Fatalf("ProcessBatch got unexpected error: %v", err)
+	}
+	if len(res.Errors) != 1 || res.Errors[0].Index != 1 {
+		t.Fatalf("ProcessBatch returned errors %v, want an error for record 1", res.Errors)
+	}
+	if diff := cmp.Diff([]string{"Patient_Patient"}, res.Errors[0].ProjectorStack); diff != "" {
+		t.Errorf("ProcessBatch error has projector stack diff (-want +got):\n%s", diff)
+	}
+	if !strings.Contains(res.Errors[0].Error(), "projector $LookupName timed out") {
+		t.Errorf("ProcessBatch returned error %v, want a timeout of $LookupName", res.Errors[0])
+	}
+	for _, i := range []int{0, 2} {
+		if res.Outputs[i] == nil {
+			t.Errorf("ProcessBatch returned no output for record %d", i)
+		}
+	}
+}
+
+func TestTransformer_UnknownTimeoutProjector(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $root`,
+			},
+		},
+	}
+
+	tconfig := TransformationConfig{SkipBundling: true, ProjectorTimeouts: map[string]time.Duration{"$LookupName": time.Second}}
+	if _, err := NewTransformer(context.Background(), dhconfig, tconfig); err == nil {
+		t.Errorf("NewTransformer with a timeout for an unknown projector got nil error, want error")
+	}
+}
+
+func TestTransformer_ProcessBatchDefaultErrorRecord(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $ParseInt($root.id)`,
+			},
+		},
+	}
+
+	clock := func() time.Time { return time.Date(2021, time.March, 4, 15, 30, 0, 0, time.UTC) }
+	tconfig := TransformationConfig{SkipBundling: true, RecordErrorPolicy: EmitRecordErrors, DeterministicForTesting: &Determinism{Clock: clock}}
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, tconfig)
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	in, err := tr.ParseJSON(json.RawMessage(`{"id": "x"}`))
+	if err != nil {
+		t.Fatalf("ParseJSON got unexpected error: %v", err)
+	}
+
+	res, err := tr.ProcessBatch([]jsonutil.JSONToken{in})
+	if err != nil {
+		t.Fatalf("ProcessBatch got unexpected error: %v", err)
+	}
+	if len(res.Outputs) != 1 || len(res.Errors) != 1 {
+		t.Fatalf("ProcessBatch returned %d outputs and %d errors, want 1 and 1", len(res.Outputs), len(res.Errors))
+	}
+
+	rec, err := jsonutil.GetField(res.Outputs[0], "RecordError[0]")
+	if err != nil {
+		t.Fatalf("GetField(%v, RecordError[0]) got unexpected error: %v", res.Outputs[0], err)
+	}
+	for field, want := range map[string]jsonutil.JSONToken{
+		"recordIndex":    jsonutil.JSONNum(0),
+		"projectorStack": jsonutil.JSONArr{},
+		"message":        jsonutil.JSONStr(res.Errors[0].Err.Error()),
+		"timestamp":      jsonutil.JSONStr("2021-03-04T15:30:00Z"),
+		"input":          nil,
+	} {
+		got, err := jsonutil.GetField(rec, field)
+		if err != nil {
+			t.Fatalf("GetField(%v, %s) got unexpected error: %v", rec, field, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("error record field %s returned diff (-want +got):\n%s", field, diff)
+		}
+	}
+
+	// The input is only included on request.
+	tconfig.RecordErrorIncludeInput = true
+	if tr, err = NewDefaultTransformer(context.Background(), dhconfig, tconfig); err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	if res, err = tr.ProcessBatch([]jsonutil.JSONToken{in}); err != nil {
+		t.Fatalf("ProcessBatch got unexpected error: %v", err)
+	}
+	got, err := jsonutil.GetField(res.Outputs[0], "RecordError[0].input")
+	if err != nil {
+		t.Fatalf("GetField(%v, RecordError[0].input) got unexpected error: %v", res.Outputs[0], err)
+	}
+	if diff := cmp.Diff(in, got); diff != "" {
+		t.Errorf("error record field input with RecordErrorIncludeInput returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTransformer_DeadLetterSink(t *testing.T) {
+	whistle := `
+out Patient: {
+  id: $root.id
+  age: $ParseFloat($root.age)
+}
+
+def Outcome(e) {
+  resourceType: "OperationOutcome"
+  issue[0].diagnostics: $StrCat("record ", e.recordIndex, " of ", e.input.id)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	var deadLetters []string
+	tconfig := TransformationConfig{
+		SkipBundling:            true,
+		RecordErrorPolicy:       EmitRecordErrors,
+		RecordErrorTarget:       "OperationOutcome",
+		RecordErrorProjector:    "Outcome",
+		RecordErrorIncludeInput: true,
+		DeadLetterSink:          &recordingSink{events: &deadLetters},
+	}
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, tconfig)
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	records := []string{
+		`{"id": "p0", "age": "5"}`,
+		`{"id": "p1", "age": "five"}`,
+		`{"id": "p2", "age": "7"}`,
+		`{"id": "p3", "age": "seven"}`,
+	}
+	var in []jsonutil.JSONToken
+	for _, r := range records {
+		parsed, err := tr.ParseJSON(json.RawMessage(r))
+		if err != nil {
+			t.Fatalf("ParseJSON(%v) got unexpected error: %v", r, err)
+		}
+		in = append(in, parsed)
+	}
+
+	res, err := tr.ProcessBatch(in)
+	if err != nil {
+		t.Fatalf("ProcessBatch(%v) got unexpected error: %v", records, err)
+	}
+
+	var got []string
+	for _, out := range res.Outputs {
+		b, err := json.Marshal(out)
+		if err != nil {
+			t.Fatalf("json.Marshal(%v) got unexpected error: %v", out, err)
+		}
+		got = append(got, string(b))
+	}
+	want := []string{
+		`{"Patient":[{"age":5,"id":"p0"}]}`,
+		`null`,
+		`{"Patient":[{"age":7,"id":"p2"}]}`,
+		`null`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ProcessBatch(%v) returned diff (-want +got):\n%s", records, diff)
+	}
+	if len(res.Errors) != 2 {
+		t.Errorf("ProcessBatch(%v) returned %d errors, want 2", records, len(res.Errors))
+	}
+
+	wantDeadLetters := []string{
+		`OperationOutcome {"issue":[{"diagnostics":"record 1 of p1"}],"resourceType":"OperationOutcome"}`,
+		`OperationOutcome {"issue":[{"diagnostics":"record 3 of p3"}],"resourceType":"OperationOutcome"}`,
+	}
+	if diff := cmp.Diff(wantDeadLetters, deadLetters); diff != "" {
+		t.Errorf("ProcessBatch(%v) wrote dead letters diff (-want +got):\n%s", records, diff)
+	}
+}
+
+func TestTransformer_DeadLetterSinkRequiresEmitRecordErrors(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $root`,
+			},
+		},
+	}
+
+	var deadLetters []string
+	tconfig := TransformationConfig{SkipBundling: true, RecordErrorPolicy: CollectRecordErrors, DeadLetterSink: &recordingSink{events: &deadLetters}}
+	if _, err := NewTransformer(context.Background(), dhconfig, tconfig); err == nil {
+		t.Errorf("NewTransformer with a dead-letter sink and CollectRecordErrors got nil error, want error")
+	}
+}
+
+func TestTransformer_UnknownRecordErrorProjector(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $root`,
+			},
+		},
+	}
+
+	tconfig := TransformationConfig{SkipBundling: true, RecordErrorPolicy: EmitRecordErrors, RecordErrorProjector: "Outcome_Typo"}
+	if _, err := NewTransformer(context.Background(), dhconfig, tconfig); err == nil {
+		t.Errorf("NewTransformer with unknown record error projector got nil error, want error")
+	}
+}
+
+func TestTransformer_PreProcess(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.id
+  gender: p.gender
+}
+
+def Unwrap(msg) {
+  $this: msg.payload
+}
+
+def NormalizeGender(p) {
+  id: p.id
+  gender: $ToLower(p.gender)
+}
+
+def ParseID(p) {
+  id: $ParseInt(p.id)
+}`
+
+	mpc, _, err := transpiler.Transpile(whistle, transpiler.Options{})
+	if err != nil {
+		t.Fatalf("Transpile got unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		configPre  []string
+		tconfigPre []string
+		want       string
+		wantErr    string
+	}{
+		{
+			name:      "mapping config",
+			configPre: []string{"Unwrap"},
+			want:      `{"Patient":[{"gender":"FEMALE","id":"p1","resourceType":"Patient"}]}`,
+		},
+		{
+			name:       "mapping config then transformation config",
+			configPre:  []string{"Unwrap"},
+			tconfigPre: []string{"NormalizeGender"},
+			want:       `{"Patient":[{"gender":"female","id":"p1","resourceType":"Patient"}]}`,
+		},
+		{
+			name: "no pre-processing",
+			want: `{"Patient":[{"resourceType":"Patient"}]}`,
+		},
+		{
+			name:       "failing pre-process projector",
+			configPre:  []string{"Unwrap"},
+			tconfigPre: []string{"ParseID"},
+			wantErr:    `Pre Processing (step 1, projector "ParseID")`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mc := proto.Clone(mpc).(*mappb.MappingConfig)
+			mc.PreProcessProjectorName = test.configPre
+			dhconfig := &dhpb.DataHarmonizationConfig{
+				StructureMappingConfig: &hpb.StructureMappingConfig{
+					Mapping: &hpb.StructureMappingConfig_MappingConfig{
+						MappingConfig: mc,
+					},
+				},
+			}
+
+			tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true, PreProcessProjectors: test.tconfigPre})
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+
+			in := `{"payload": {"id": "p1", "gender": "FEMALE"}}`
+			got, err := tr.JSONtoJSON(json.RawMessage(in))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("JSONtoJSON(%v) got error %v, want error containing %q", in, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_UnknownPreProcessProjector(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $root`,
+			},
+		},
+	}
+
+	tconfig := TransformationConfig{SkipBundling: true, PreProcessProjectors: []string{"Unwrap"}}
+	if _, err := NewTransformer(context.Background(), dhconfig, tconfig); err == nil {
+		t.Errorf("NewTransformer with unknown pre-process projector got nil error, want error")
+	}
+}
+
+func TestTransformer_NormalizeTerm(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  gender: $NormalizeTerm("gender", p.sex)
+  deceasedBoolean: $Eq($NormalizeTerm("yes-no", p.deceased), "yes")
+  extension[].valueCode: $NormalizeTerm("race", p.race)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tconfig := TransformationConfig{
+		SkipBundling: true,
+		TermDomains: map[string]builtins.TermDomain{
+			"gender": {Terms: map[string]string{"9": "unknown", "X": "other"}},
+		},
+	}
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, tconfig)
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	if err := tr.RegisterTermDomain("race", builtins.TermDomain{Terms: map[string]string{"W": "2106-3"}, Default: "UNK"}); err != nil {
+		t.Fatalf("RegisterTermDomain got unexpected error: %v", err)
+	}
+
+	in := `{"sex": " x ", "deceased": "N", "race": "w"}`
+	got, err := tr.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+
+	want := `{"Patient":[{"deceasedBoolean":false,"extension":[{"valueCode":"2106-3"}],"gender":"other","resourceType":"Patient"}]}`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+}
+
+func TestTransformer_Counter(t *testing.T) {
+	whistle := `
+out Claim: Claim_Claim($root)
+
+def Claim_Claim(c) {
+  resourceType: "Claim"
+  id: c.id
+  item: Item(c.items[])
+  supportingInfo: Info(c.infos[])
+}
+
+def Item(i) {
+  sequence: $Counter("line")
+  productOrService.text: i
+}
+
+def Info(i) {
+  sequence: $Counter("line")
+  infoSequence: $Counter("info")
+  category.text: i
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	want := func(id string) string {
+		return `{"Claim":[{"id":"` + id + `",` +
+			`"item":[{"productOrService":{"text":"a"},"sequence":1},{"productOrService":{"text":"b"},"sequence":2}],` +
+			`"resourceType":"Claim",` +
+			`"supportingInfo":[{"category":{"text":"c"},"infoSequence":1,"sequence":3}]}]}`
+	}
+
+	// Counters start over for every record, including ones transformed concurrently.
+	const records = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, records)
+	for r := 0; r < records; r++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			in := `{"id": "` + id + `", "items": ["a", "b"], "infos": ["c"]}`
+			got, err := tr.JSONtoJSON(json.RawMessage(in))
+			if err != nil {
+				errs <- fmt.Errorf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+				return
+			}
+			if diff := cmp.Diff(want(id), string(got)); diff != "" {
+				errs <- fmt.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+			}
+		}(fmt.Sprintf("claim-%d", r))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestTransformer_CallFn(t *testing.T) {
+	whistle := `
+out Message: Dispatch($root)
+
+def Dispatch(m) {
+  var name: $StrCat("Process_", m.type)
+  if $Eq(m.type, "NO_ARGS") {
+    $this: $CallFn("Process_ADT_A01")
+  } else {
+    $this: $CallFn(name, m)
+  }
+}
+
+def Process_ADT_A01(m) {
+  event: "admit"
+  patient: m.pid
+}
+
+def Process_ORU_R01(m) {
+  event: "result"
+  value: m.obx
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "first projector",
+			in:   `{"type": "ADT_A01", "pid": "p1"}`,
+			want: `{"Message":[{"event":"admit","patient":"p1"}]}`,
+		},
+		{
+			name: "second projector",
+			in:   `{"type": "ORU_R01", "obx": 4.2}`,
+			want: `{"Message":[{"event":"result","value":4.2}]}`,
+		},
+		{
+			name:    "unknown projector",
+			in:      `{"type": "ADT_A02"}`,
+			wantErr: `projector "Process_ADT_A02" does not exist (did you mean one of ["Process_ADT_A01"`,
+		},
+		{
+			name:    "wrong number of arguments",
+			in:      `{"type": "NO_ARGS"}`,
+			wantErr: `"Process_ADT_A01" expects 1 arguments but was given 0`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := tr.JSONtoJSON(json.RawMessage(test.in))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("JSONtoJSON(%v) got error %v, want error containing %q", test.in, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", test.in, err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", test.in, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_PureProjectors(t *testing.T) {
+	whistle := `
+first: Name($root.name)
+second: Name($root.name)
+
+pure def Name(n) {
+  family: $Expensive(n.family)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	calls := 0
+	expensive := func(args []jsonutil.JSONMetaNode, _ *types.Context) (jsonutil.JSONToken, error) {
+		calls++
+		return jsonutil.NodeToToken(args[0])
+	}
+	if err := tr.RegisterProjector("$Expensive", expensive); err != nil {
+		t.Fatalf("RegisterProjector($Expensive) got unexpected error: %v", err)
+	}
+
+	in := `{"name": {"family": "Doe"}}`
+	want := `{"first":{"family":"Doe"},"second":{"family":"Doe"}}`
+	got, err := tr.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+	// The second call to the pure projector is memoized.
+	if calls != 1 {
+		t.Errorf("$Expensive was called %d times, want 1", calls)
+	}
+}
+
+func TestTransformer_PureProjectorCallingCloudFunction(t *testing.T) {
+	// The transpiler does not know the projectors calling remote services, so the engine checks them.
+	config := &mappb.MappingConfig{
+		Projector: []*mappb.ProjectorDefinition{
+			{
+				Name: "Identify",
+				Pure: true,
+				Mapping: []*mappb.FieldMapping{
+					{
+						ValueSource: &mappb.ValueSource{Projector: "@identity"},
+						Target:      &mappb.FieldMapping_TargetField{TargetField: "id"},
+					},
+				},
+			},
+		},
+	}
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingConfig{
+				MappingConfig: config,
+			},
+		},
+		LibraryConfig: []*libpb.LibraryConfig{
+			{
+				CloudFunction: []*httppb.CloudFunction{
+					{Name: "@identity", RequestUrl: "https://google.cloud.function/identity"},
+				},
+			},
+		},
+	}
+
+	_, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{}, CloudFunctions(true))
+	if err == nil || !strings.Contains(err.Error(), "projector Identify is declared pure but calls @identity") {
+		t.Errorf("NewTransformer with a pure projector calling a cloud function got error %v, want purity error", err)
+	}
+}
+
+func TestTransformer_BuildList(t *testing.T) {
+	whistle := `
+schedule: $BuildList($root.days, "Slot")
+
+def Slot(i) {
+  day: $Sum(i, 1)
+  if $Eq(i, 0) {
+    note: "first dose"
+  }
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	in := `{"days": 3}`
+	want := `{"schedule":[{"day":1,"note":"first dose"},{"day":2},{"day":3}]}`
+	got, err := tr.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+}
+
+func TestBuildListProjector(t *testing.T) {
+	reg := types.NewRegistry()
+	index := func(args []jsonutil.JSONMetaNode, _ *types.Context) (jsonutil.JSONToken, error) {
+		return jsonutil.NodeToToken(args[0])
+	}
+	if err := reg.RegisterProjector("Index", index); err != nil {
+		t.Fatalf("RegisterProjector(Index) got unexpected error: %v", err)
+	}
+	if err := reg.RegisterArity("Index", 1); err != nil {
+		t.Fatalf("RegisterArity(Index, 1) got unexpected error: %v", err)
+	}
+	if err := reg.RegisterProjector("Pair", index); err != nil {
+		t.Fatalf("RegisterProjector(Pair) got unexpected error: %v", err)
+	}
+	if err := reg.RegisterArity("Pair", 2); err != nil {
+		t.Fatalf("RegisterArity(Pair, 2) got unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		n       jsonutil.JSONToken
+		proj    string
+		want    jsonutil.JSONToken
+		wantErr string
+	}{
+		{
+			name: "elements",
+			n:    jsonutil.JSONNum(3),
+			proj: "Index",
+			want: jsonutil.JSONArr{jsonutil.JSONNum(0), jsonutil.JSONNum(1), jsonutil.JSONNum(2)},
+		},
+		{
+			name: "no elements",
+			n:    jsonutil.JSONNum(0),
+			proj: "Index",
+			want: jsonutil.JSONArr{},
+		},
+		{
+			name:    "negative",
+			n:       jsonutil.JSONNum(-1),
+			proj:    "Index",
+			wantErr: "non-negative integer",
+		},
+		{
+			name:    "not an integer",
+			n:       jsonutil.JSONNum(1.5),
+			proj:    "Index",
+			wantErr: "non-negative integer",
+		},
+		{
+			name:    "not a number",
+			n:       jsonutil.JSONStr("3"),
+			proj:    "Index",
+			wantErr: "expects a number",
+		},
+		{
+			name:    "unknown projector",
+			n:       jsonutil.JSONNum(3),
+			proj:    "Indx",
+			wantErr: `projector "Indx" does not exist (did you mean one of ["Index"`,
+		},
+		{
+			name:    "wrong number of arguments",
+			n:       jsonutil.JSONNum(3),
+			proj:    "Pair",
+			wantErr: `"Pair" expects 2 arguments but was given 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var args []jsonutil.JSONMetaNode
+			for _, a := range []jsonutil.JSONToken{test.n, jsonutil.JSONStr(test.proj)} {
+				node, err := jsonutil.TokenToNode(a)
+				if err != nil {
+					t.Fatalf("TokenToNode(%v) got unexpected error: %v", a, err)
+				}
+				args = append(args, node)
+			}
+
+			got, err := buildListProjector(args, types.NewContext(reg))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("$BuildList(%v, %q) got error %v, want error containing %q", test.n, test.proj, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("$BuildList(%v, %q) got unexpected error: %v", test.n, test.proj, err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("$BuildList(%v, %q) returned diff (-want +got):\n%s", test.n, test.proj, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_Try(t *testing.T) {
+	whistle := `
+results: Parse($root.fn, $root.dates[])
+
+def Parse(fn, d) {
+  var parsed: $Try(fn, d)
+  if $IsNotNil(parsed.error) {
+    dataAbsentReason: "error"
+    original: d
+  } else {
+    date: parsed.value
+  }
+}
+
+def ParseDate(d) {
+  $this: $ParseTime("2006-01-02", d)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "projector",
+			in:   `{"fn": "ParseDate", "dates": ["2020-01-02", "02/01/2020"]}`,
+			want: `{"results":[{"date":"2020-01-02T00:00:00Z"},{"dataAbsentReason":"error","original":"02/01/2020"}]}`,
+		},
+		{
+			name: "builtin",
+			in:   `{"fn": "$ToUpper", "dates": ["a", "b"]}`,
+			want: `{"results":[{"date":"A"},{"date":"B"}]}`,
+		},
+		{
+			name:    "unknown projector",
+			in:      `{"fn": "ParseDates", "dates": ["2020-01-02"]}`,
+			wantErr: `$Try: projector "ParseDates" does not exist (did you mean one of ["ParseDate"`,
+		},
+		{
+			name:    "wrong number of arguments",
+			in:      `{"fn": "Parse", "dates": ["2020-01-02"]}`,
+			wantErr: `$Try: "Parse" expects 2 arguments but was given 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := tr.JSONtoJSON(json.RawMessage(test.in))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("JSONtoJSON(%v) got error %v, want error containing %q", test.in, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", test.in, err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", test.in, diff)
+			}
+		})
+	}
+}
+
+func TestTryProjector_EngineErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantCaught bool
+	}{
+		{
+			name:       "mapping error",
+			err:        fmt.Errorf("could not parse date"),
+			wantCaught: true,
+		},
+		{
+			name: "timeout",
+			err:  fmt.Errorf("fetching: %w", types.TimeoutError{Projector: "Fail", Timeout: time.Second}),
+		},
+		{
+			name: "output budget",
+			err:  types.OutputBudgetError{Target: "out Patient", Limit: 10},
+		},
+		{
+			name: "stack overflow",
+			err:  types.StackOverflowError{MaxDepth: types.MaxStackDepth},
+		},
+		{
+			name: "retries",
+			err:  types.RetryError{Projector: "Fail", Attempts: 3, Err: errors.New("unavailable")},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := types.NewRegistry()
+			fail := func(_ []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+				pctx.Variables.Push()
+				if err := pctx.PushProjectorToStack("Fail"); err != nil {
+					return nil, err
+				}
+				return nil, test.err
+			}
+			if err := reg.RegisterProjector("Fail", fail); err != nil {
+				t.Fatalf("RegisterProjector(Fail) got unexpected error: %v", err)
+			}
+			pctx := types.NewContext(reg)
+			pctx.Variables.Push()
+			var caller jsonutil.JSONToken = jsonutil.JSONStr("caller")
+			if err := pctx.Variables.Set("x", &caller); err != nil {
+				t.Fatalf("Variables.Set(x) got unexpected error: %v", err)
+			}
+
+			name, err := jsonutil.TokenToNode(jsonutil.JSONStr("Fail"))
+			if err != nil {
+				t.Fatalf("TokenToNode got unexpected error: %v", err)
+			}
+			got, err := tryProjector([]jsonutil.JSONMetaNode{name}, pctx)
+
+			if !test.wantCaught {
+				// Not compared with ==, as some of the errors are not comparable.
+				if !reflect.DeepEqual(err, test.err) {
+					t.Errorf("%s got error %v, want %v unchanged", tryProjectorName, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s got unexpected error: %v", tryProjectorName, err)
+			}
+			var msg jsonutil.JSONToken = jsonutil.JSONStr(test.err.Error())
+			want := jsonutil.JSONContainer{"error": &msg}
+			if diff := cmp.Diff(jsonutil.MarshalJSON(want), jsonutil.MarshalJSON(got)); diff != "" {
+				t.Errorf("%s returned diff (-want +got):\n%s", tryProjectorName, diff)
+			}
+			// The failed projector is rolled back.
+			if stack := pctx.ProjectorStack(); len(stack) != 0 {
+				t.Errorf("%s left projectors %v on the stack", tryProjectorName, stack)
+			}
+			if v, err := pctx.Variables.Get("x"); err != nil || jsonutil.MarshalJSON(*v) != `"caller"` {
+				t.Errorf("%s left the variables of the failed projector, caller's x got %v (error %v)", tryProjectorName, v, err)
+			}
+		})
+	}
+}
+
+func TestTransformer_Lambdas(t *testing.T) {
+	whistle := `
+mrn: $CallFn(i => i.value, $root.identifier[])
+names: $CallFn(n => {
+  family: n.family
+  given: n.given
+}, $root.name[])
+sum: $CallFn((a, b) => $Sum(a, b), $root.a, $root.b)
+parsed: $Try(d => $ParseTime("2006-01-02", d), $root.date)`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	in := `{"identifier": [{"value": "1"}, {"value": "2"}], "name": [{"given": "A", "family": "B"}], "a": 1, "b": 2, "date": "2020-01-02"}`
+	want := `{"mrn":["1","2"],"names":[{"family":"B","given":"A"}],"parsed":{"value":"2020-01-02T00:00:00Z"},"sum":3}`
+	got, err := tr.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+}
+
+func TestTransformer_Namespaces(t *testing.T) {
+	whistle := `
+use "acme"
+
+mrn: $ChecksumMRN($root.mrn)
+qualified: acme::$ChecksumMRN($root.mrn)`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	checksum := func(args []jsonutil.JSONMetaNode, pctx *types.Context) (jsonutil.JSONToken, error) {
+		mrn, err := jsonutil.NodeToToken(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return jsonutil.JSONStr(fmt.Sprintf("%v-7", mrn)), nil
+	}
+	if err := tr.RegisterNamespacedProjector("acme", "$ChecksumMRN", checksum); err != nil {
+		t.Fatalf("RegisterNamespacedProjector(acme, $ChecksumMRN) got unexpected error: %v", err)
+	}
+
+	// Both of these would make calls to $ChecksumMRN and $StrCat ambiguous.
+	if err := tr.RegisterProjector("$ChecksumMRN", checksum); err == nil {
+		t.Errorf("RegisterProjector($ChecksumMRN) colliding with acme::$ChecksumMRN got nil error, want error")
+	}
+	if err := tr.RegisterNamespacedProjector("acme", "$StrCat", checksum); err == nil {
+		t.Errorf("RegisterNamespacedProjector(acme, $StrCat) colliding with the builtin got nil error, want error")
+	}
+
+	in := `{"mrn": "123"}`
+	want := `{"mrn":"123-7","qualified":"123-7"}`
+	got, err := tr.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+}
+
+func TestTransformer_TransformPartial(t *testing.T) {
+	whistle := `
+var patient: $root.patient
+var coverage: Coverage($root.coverage)
+out Patient: {
+  id: patient.id
+}
+out Claim: {
+  coverage: coverage
+}
+out Encounter: {
+  id: $root.encounter
+}
+
+def Coverage(c) {
+  required payor: c.payor
+}
+
+post def Bundle(resources, failures) {
+  Patient: resources.Patient
+  Encounter: resources.Encounter
+  Claim: resources.Claim
+  missing: TargetOf(failures[])
+}
+
+def TargetOf(failure) {
+  $this: failure.target
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		in          string
+		want        string
+		wantTargets []string
+	}{
+		{
+			name: "all mappings succeed",
+			in:   `{"patient": {"id": "p"}, "coverage": {"payor": "x"}, "encounter": "e"}`,
+			want: `{"Claim":[{"coverage":{"payor":"x"}}],"Encounter":[{"id":"e"}],"Patient":[{"id":"p"}]}`,
+		},
+		{
+			// Claim reads the var of the failed Coverage mapping, so it fails too.
+			name:        "failed mapping and its dependent",
+			in:          `{"patient": {"id": "p"}, "coverage": {}, "encounter": "e"}`,
+			want:        `{"Encounter":[{"id":"e"}],"Patient":[{"id":"p"}],"missing":["var coverage","out Claim"]}`,
+			wantTargets: []string{"var coverage", "out Claim"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in, err := tr.ParseJSON(json.RawMessage(test.in))
+			if err != nil {
+				t.Fatalf("ParseJSON(%v) got unexpected error: %v", test.in, err)
+			}
+			res, err := tr.TransformPartial(in)
+			if err != nil {
+				t.Fatalf("TransformPartial(%v) got unexpected error: %v", test.in, err)
+			}
+			got, err := tr.MarshalOutput(res.Output)
+			if err != nil {
+				t.Fatalf("MarshalOutput(%v) got unexpected error: %v", res.Output, err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("TransformPartial(%v) returned diff (-want +got):\n%s", test.in, diff)
+			}
+
+			var targets []string
+			for _, e := range res.Errors {
+				targets = append(targets, e.Target)
+			}
+			if diff := cmp.Diff(test.wantTargets, targets); diff != "" {
+				t.Errorf("TransformPartial(%v) returned errors %v, diff of their targets (-want +got):\n%s", test.in, res.Errors, diff)
+			}
+
+			// Transform is all or nothing.
+			if _, err := tr.Transform(in); (err != nil) != (len(test.wantTargets) > 0) {
+				t.Errorf("Transform(%v) got error %v, want error %t", test.in, err, len(test.wantTargets) > 0)
+			}
+		})
+	}
+}
+
+func TestTransformer_TransformWithLineage(t *testing.T) {
+	whistle := `
+var mrn: $root.patient.mrn
+meta.mrn: mrn
+out Patient: {
+  id: $root.patient.id
+  name: Name($root.patient.name[])
+  gender: $ToLower($root.patient.sex)
+  active: true
+}
+
+def Name(n) {
+  given: n.first
+  family: $StrCat(n.last, ", ", n.suffix)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	in, err := tr.ParseJSON(json.RawMessage(`{"patient": {"id": "p", "mrn": "m", "sex": "F", "name": [{"first": "a", "last": "b", "suffix": "jr"}]}}`))
+	if err != nil {
+		t.Fatalf("ParseJSON got unexpected error: %v", err)
+	}
+	res, err := tr.TransformWithLineage(in)
+	if err != nil {
+		t.Fatalf("TransformWithLineage got unexpected error: %v", err)
+	}
+
+	wantOut, err := tr.Transform(in)
+	if err != nil {
+		t.Fatalf("Transform got unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(wantOut, res.Output); diff != "" {
+		t.Errorf("TransformWithLineage returned output diff from Transform (-want +got):\n%s", diff)
+	}
+
+	want := map[string][]string{
+		"meta.mrn":                  {"patient.mrn"},
+		"Patient[0].id":             {"patient.id"},
+		"Patient[0].gender":         {"$ToLower(patient.sex)"},
+		"Patient[0].name[0].given":  {"patient.name[0].first"},
+		"Patient[0].name[0].family": {"$StrCat(patient.name[0].last, patient.name[0].suffix)"},
+	}
+	if diff := cmp.Diff(want, res.Lineage); diff != "" {
+		t.Errorf("TransformWithLineage returned lineage diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTransformer_DynamicObjects(t *testing.T) {
+	whistle := `
+var routed: Route($root.resources[])
+
+def Route(r) {
+  out(r.resourceType): r
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "objects",
+			in:   `{"resources": [{"resourceType": "Patient", "id": "1"}, {"resourceType": "Encounter", "id": "2"}, {"resourceType": "Patient", "id": "3"}]}`,
+			want: `{"Encounter":[{"id":"2","resourceType":"Encounter"}],"Patient":[{"id":"1","resourceType":"Patient"},{"id":"3","resourceType":"Patient"}]}`,
+		},
+		{
+			name:    "empty name",
+			in:      `{"resources": [{"resourceType": "", "id": "1"}]}`,
+			wantErr: `must be a non-empty string without path separators (. [ ]), but got ""`,
+		},
+		{
+			name:    "path",
+			in:      `{"resources": [{"resourceType": "Patient.name", "id": "1"}]}`,
+			wantErr: `but got "Patient.name"`,
+		},
+		{
+			name:    "not a string",
+			in:      `{"resources": [{"resourceType": 1, "id": "1"}]}`,
+			wantErr: `but got 1`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := tr.JSONtoJSON(json.RawMessage(test.in))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("JSONtoJSON(%v) got error %v, want error containing %q", test.in, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", test.in, err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", test.in, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_RequiredTargets(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  required identifier[]: Identifier(p.ids[])
+  if p.deceased {
+    required deceasedDateTime: p.deathDate
+  }
+}
+
+def Identifier(id) {
+  required value: id.value
+  system: id.system
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "all required values",
+			in:   `{"ids": [{"value": "1", "system": "a"}, {"value": "2"}]}`,
+			want: `{"Patient":[{"identifier":[{"system":"a","value":"1"},{"value":"2"}],"resourceType":"Patient"}]}`,
+		},
+		{
+			name:    "missing value of an element",
+			in:      `{"ids": [{"value": "1"}, {"system": "b"}]}`,
+			wantErr: `required target "value" has no value`,
+		},
+		{
+			name:    "empty element",
+			in:      `{"ids": [{"value": "1"}, null]}`,
+			wantErr: `required target "identifier[]" has no value for element 1 of its source`,
+		},
+		{
+			name:    "no elements",
+			in:      `{"ids": []}`,
+			wantErr: `required target "identifier[]" has no value`,
+		},
+		{
+			name:    "true condition",
+			in:      `{"ids": [{"value": "1"}], "deceased": true}`,
+			wantErr: `required target "deceasedDateTime" has no value`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := tr.JSONtoJSON(json.RawMessage(test.in))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("JSONtoJSON(%v) got error %v, want error containing %q", test.in, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", test.in, err)
+			}
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", test.in, diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_Dedup(t *testing.T) {
+	whistle := `
+Patient: Patient_Patient($root.patients[])
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.id
+  identifier[]: Identifier(p.mrn)
+}
+
+def Identifier(mrn) {
+  system: "urn:mrn"
+  value: mrn
+}
+
+def PatientKey(r) {
+  $this: $StrCat(r.resourceType, "/", r.id)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	preRecorded := NewMemoryDedupKeyStore()
+	if _, err := preRecorded.Add("Patient/3"); err != nil {
+		t.Fatalf("Add got unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		config    TransformationConfig
+		inputs    []string
+		want      []string
+		wantStats map[string]DedupCounts
+	}{
+		{
+			name:   "key paths",
+			config: TransformationConfig{SkipBundling: true, DedupKeyPaths: []string{"resourceType", "identifier[0].system", "identifier[0].value"}},
+			inputs: []string{
+				`{"patients": [{"id": "1", "mrn": "A"}, {"id": "2", "mrn": "A"}, {"id": "3", "mrn": "B"}]}`,
+				`{"patients": [{"id": "4", "mrn": "B"}, {"id": "5", "mrn": "C"}]}`,
+				`{"patients": [{"id": "6", "mrn": "C"}]}`,
+			},
+			want: []string{
+				`{"Patient":[{"id":"1","identifier":[{"system":"urn:mrn","value":"A"}],"resourceType":"Patient"},{"id":"3","identifier":[{"system":"urn:mrn","value":"B"}],"resourceType":"Patient"}]}`,
+				`{"Patient":[{"id":"5","identifier":[{"system":"urn:mrn","value":"C"}],"resourceType":"Patient"}]}`,
+				`{}`,
+			},
+			wantStats: map[string]DedupCounts{"Patient": {Emitted: 3, Suppressed: 3}},
+		},
+		{
+			name:   "key projector and store",
+			config: TransformationConfig{SkipBundling: true, DedupKeyProjector: "PatientKey", DedupKeyStore: preRecorded},
+			inputs: []string{
+				`{"patients": [{"id": "1"}, {"id": "1"}, {"id": "2"}, {"id": "3"}]}`,
+			},
+			want: []string{
+				`{"Patient":[{"id":"1","resourceType":"Patient"},{"id":"2","resourceType":"Patient"}]}`,
+			},
+			wantStats: map[string]DedupCounts{"Patient": {Emitted: 2, Suppressed: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := NewDefaultTransformer(context.Background(), dhconfig, test.config)
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+
+			for i, in := range test.inputs {
+				got, err := tr.JSONtoJSON(json.RawMessage(in))
+				if err != nil {
+					t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+				}
+				if diff := cmp.Diff(test.want[i], string(got)); diff != "" {
+					t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+				}
+			}
+
+			if diff := cmp.Diff(test.wantStats, tr.DedupStats()); diff != "" {
+				t.Errorf("DedupStats() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_MappingStats(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  name: p.name
+  birthDate: p.dob
+}`,
+			},
+		},
+	}
+	inputs := []string{`{"name": "A", "dob": "2000-01-01"}`, `{"name": "B"}`, `{"name": "C", "dob": ""}`}
+
+	tests := []struct {
+		name   string
+		config TransformationConfig
+		want   MappingStatsReport
+	}{
+		{
+			name:   "enabled",
+			config: TransformationConfig{SkipBundling: true, MappingStats: true},
+			want: MappingStatsReport{Mappings: []MappingStat{
+				{Projector: "Patient_Patient", Mapping: 1, Target: "name", Evaluations: 3, Empty: 0, EmptyRatio: 0},
+				{Projector: "Patient_Patient", Mapping: 2, Target: "birthDate", Evaluations: 3, Empty: 2, EmptyRatio: 2.0 / 3},
+				{Projector: "root", Mapping: 1, Target: "out Patient", Evaluations: 3, Empty: 0, EmptyRatio: 0},
+			}},
+		},
+		{
+			name:   "disabled",
+			config: TransformationConfig{SkipBundling: true},
+			want:   MappingStatsReport{Mappings: []MappingStat{}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := NewDefaultTransformer(context.Background(), dhconfig, test.config)
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+
+			for _, in := range inputs {
+				if _, err := tr.JSONtoJSON(json.RawMessage(in)); err != nil {
+					t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+				}
+			}
+
+			if diff := cmp.Diff(test.want, tr.MappingStats()); diff != "" {
+				t.Errorf("MappingStats() returned diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestTransformer_TransformIfChanged(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $root.name`,
+			},
+		},
+	}
+	tconfig := TransformationConfig{SkipBundling: true, DigestIgnorePaths: []string{"meta.lastUpdated"}}
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, tconfig)
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	steps := []struct {
+		id, in     string
+		wantStatus RecordStatus
+	}{
+		{id: "1", in: `{"name": "A", "meta": {"lastUpdated": "mon"}}`, wantStatus: RecordProcessed},
+		{id: "2", in: `{"name": "B"}`, wantStatus: RecordProcessed},
+		{id: "1", in: `{"meta": {"lastUpdated": "mon"}, "name": "A"}`, wantStatus: RecordSkipped},
+		{id: "1", in: `{"name": "A", "meta": {"lastUpdated": "tue"}}`, wantStatus: RecordSkipped},
+		{id: "2", in: `{"name": "C"}`, wantStatus: RecordProcessed},
+		{id: "2", in: `{"name": "C"}`, wantStatus: RecordSkipped},
+		{id: "3", in: `{"name": "C"}`, wantStatus: RecordProcessed},
+	}
+	for i, step := range steps {
+		in, err := tr.ParseJSON(json.RawMessage(step.in))
+		if err != nil {
+			t.Fatalf("ParseJSON got unexpected error: %v", err)
+		}
+		res, err := tr.TransformIfChanged(step.id, in)
+		if err != nil {
+			t.Fatalf("step %d: TransformIfChanged(%s, %s) got unexpected error: %v", i, step.id, step.in, err)
+		}
+		if res.Status != step.wantStatus {
+			t.Errorf("step %d: TransformIfChanged(%s, %s) got status %v, want %v", i, step.id, step.in, res.Status, step.wantStatus)
+		}
+		if (res.Output == nil) != (step.wantStatus == RecordSkipped) {
+			t.Errorf("step %d: TransformIfChanged(%s, %s) got output %v with status %v", i, step.id, step.in, res.Output, res.Status)
+		}
+	}
+}
+
+func TestTransformer_TransformIfChangedConfigChanges(t *testing.T) {
+	configOf := func(value string) *dhpb.DataHarmonizationConfig {
+		return &dhpb.DataHarmonizationConfig{
+			StructureMappingConfig: &hpb.StructureMappingConfig{
+				Mapping: &hpb.StructureMappingConfig_MappingConfig{
+					MappingConfig: &mappb.MappingConfig{
+						RootMapping: []*mappb.FieldMapping{
+							{
+								ValueSource: &mappb.ValueSource{Source: &mappb.ValueSource_ConstString{ConstString: value}},
+								Target:      &mappb.FieldMapping_TargetObject{TargetObject: "Patient"},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	store := NewMemoryDigestStore()
+	in := jsonutil.JSONContainer{}
+
+	// Steps run in order against the same digest store, each with a transformer of its own.
+	steps := []struct {
+		value      string
+		wantStatus RecordStatus
+	}{
+		{value: "v1", wantStatus: RecordProcessed},
+		{value: "v1", wantStatus: RecordSkipped},
+		{value: "v2", wantStatus: RecordProcessed},
+		{value: "v2", wantStatus: RecordSkipped},
+		{value: "v1", wantStatus: RecordProcessed},
+	}
+	for i, step := range steps {
+		tr, err := NewDefaultTransformer(context.Background(), configOf(step.value), TransformationConfig{SkipBundling: true, DigestStore: store})
+		if err != nil {
+			t.Fatalf("step %d: could not initialize with config: %v", i, err)
+		}
+		res, err := tr.TransformIfChanged("1", in)
+		if err != nil {
+			t.Fatalf("step %d: TransformIfChanged got unexpected error: %v", i, err)
+		}
+		if res.Status != step.wantStatus {
+			t.Errorf("step %d: TransformIfChanged with mapping to %s got status %v, want %v", i, step.value, res.Status, step.wantStatus)
+		}
+	}
+}
+
+func TestTransformer_TransformIfChangedRetriesFailures(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $ParseInt($root.id)`,
+			},
+		},
+	}
+	store := NewMemoryDigestStore()
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true, DigestStore: store})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	in, err := tr.ParseJSON(json.RawMessage(`{"id": "x"}`))
+	if err != nil {
+		t.Fatalf("ParseJSON got unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := tr.TransformIfChanged("1", in); err == nil {
+			t.Errorf("attempt %d: TransformIfChanged got nil error, want error", i)
+		}
+	}
+	if d, ok, err := store.Get("1"); err != nil || ok {
+		t.Errorf("Get(1) = %q, %v, %v after failures, want no digest", d, ok, err)
+	}
+}
+
+func TestTransformer_InvalidDigestIgnorePath(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Patient: $root`,
+			},
+		},
+	}
+
+	tconfig := TransformationConfig{SkipBundling: true, DigestIgnorePaths: []string{"meta..lastUpdated"}}
+	if _, err := NewTransformer(context.Background(), dhconfig, tconfig); err == nil {
+		t.Errorf("NewTransformer with invalid digest ignore path got nil error, want error")
+	}
+}
+
+func TestTransformer_TransformInputs(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `root(msg, roster)
+out Patient: {
+  name: msg.name
+  mrn: roster.mrn
+  ward: Ward()
+}
+
+def Ward() {
+  $this: roster.ward
+}`,
+			},
+		},
+	}
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	inputs := make(map[string]jsonutil.JSONToken)
+	for name, in := range map[string]string{"msg": `{"name": "Ann"}`, "roster": `{"mrn": "123", "ward": "4B"}`} {
+		if inputs[name], err = tr.ParseJSON(json.RawMessage(in)); err != nil {
+			t.Fatalf("ParseJSON(%s) got unexpected error: %v", in, err)
+		}
+	}
+	want := `{"Patient":[{"mrn":"123","name":"Ann","ward":"4B"}]}`
+
+	got, err := tr.TransformInputs(inputs)
+	if err != nil {
+		t.Fatalf("TransformInputs(%v) got unexpected error: %v", inputs, err)
+	}
+	if diff := cmp.Diff(want, marshalOrDie(t, got)); diff != "" {
+		t.Errorf("TransformInputs(%v) returned diff (-want +got):\n%s", inputs, diff)
+	}
+
+	// Transforming an object with the inputs is equivalent.
+	in := `{"msg": {"name": "Ann"}, "roster": {"mrn": "123", "ward": "4B"}}`
+	gotJSON, err := tr.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+	if diff := cmp.Diff(want, string(gotJSON)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+
+	missing := map[string]jsonutil.JSONToken{"msg": inputs["msg"]}
+	if _, err := tr.TransformInputs(missing); err == nil || !strings.Contains(err.Error(), `missing input "roster"`) {
+		t.Errorf("TransformInputs(%v) got error %v, want missing input \"roster\"", missing, err)
+	}
+}
+
+func marshalOrDie(t *testing.T, tok jsonutil.JSONToken) string {
+	t.Helper()
+	b, err := json.Marshal(tok)
+	if err != nil {
+		t.Fatalf("json.Marshal(%v) got unexpected error: %v", tok, err)
+	}
+	return string(b)
+}
+
+func TestTransformer_KeyedAppends(t *testing.T) {
+	// The code and the severity of each allergy come from different arrays of the input, which are
+	// mapped by different projectors.
+	whistle := `
+var codes: AllergyCode($root.allergies[])
+var severities: AllergySeverity($root.reactions[])
+allergyIntolerance[@"a1"].note: "checked"
+
+def AllergyCode(a) {
+  root allergyIntolerance[@a.id].code.text: a.code
+}
+
+def AllergySeverity(r) {
+  root allergyIntolerance[@r.allergy].reaction[0].severity: r.severity
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	in := json.RawMessage(`{
+  "allergies": [{"id": "a1", "code": "peanut"}, {"id": "a2", "code": "latex"}],
+  "reactions": [{"allergy": "a2", "severity": "severe"}, {"allergy": "a3", "severity": "mild"}, {"allergy": "a1", "severity": "moderate"}]
+}`)
+	got, err := tr.JSONtoJSON(in)
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%s) got unexpected error: %v", in, err)
+	}
+	want := `{"allergyIntolerance":[` +
+		`{"code":{"text":"peanut"},"note":"checked","reaction":[{"severity":"moderate"}]},` +
+		`{"code":{"text":"latex"},"reaction":[{"severity":"severe"}]},` +
+		`{"reaction":[{"severity":"mild"}]}]}`
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%s) returned diff (-want +got):\n%s", in, diff)
+	}
+}
+
+func TestTransformer_OutputBudget(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Summary: Runaway($root.items[])
+
+def Runaway(item) {
+  root all[]: {value: item}
+}`,
+			},
+		},
+	}
+	items := make([]string, 1000)
+	for i := range items {
+		items[i] = fmt.Sprint(i)
+	}
+	in := json.RawMessage(`{"items": [` + strings.Join(items, ",") + `]}`)
+
+	tests := []struct {
+		name    string
+		config  TransformationConfig
+		wantErr string
+	}{
+		{
+			name:    "array length",
+			config:  TransformationConfig{SkipBundling: true, MaxArrayLength: 10},
+			wantErr: "limit of 10 elements",
+		},
+		{
+			name:    "output tokens",
+			config:  TransformationConfig{SkipBundling: true, MaxOutputTokens: 100},
+			wantErr: "limit of 100 output tokens",
+		},
+		{
+			name:   "defaults",
+			config: TransformationConfig{SkipBundling: true},
+		},
+		{
+			name:   "no limits",
+			config: TransformationConfig{SkipBundling: true, MaxOutputTokens: -1, MaxArrayLength: -1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := NewTransformer(context.Background(), dhconfig, test.config)
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+			_, err = tr.JSONtoJSON(in)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Errorf("JSONtoJSON got unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) || !strings.Contains(err.Error(), "root all[]") {
+				t.Errorf("JSONtoJSON got error %v, want an error naming root all[] with %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestTransformer_OutputFormat(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `root b: $root.amount
+root a: $root.note`,
+			},
+		},
+	}
+	in := json.RawMessage(`{"amount": 1e21, "note": "<é>"}`)
+
+	tests := []struct {
+		name   string
+		config TransformationConfig
+		want   string
+	}{
+		{
+			name:   "default",
+			config: TransformationConfig{SkipBundling: true},
+			want:   `{"a":"\u003cé\u003e","b":1e+21}`,
+		},
+		{
+			name:   "canonical",
+			config: TransformationConfig{SkipBundling: true, OutputFormat: CanonicalOutput},
+			want:   `{"a":"<é>","b":1e+21}`,
+		},
+		{
+			name:   "pretty",
+			config: TransformationConfig{SkipBundling: true, OutputFormat: PrettyOutput},
+			want:   "{\n  \"a\": \"<é>\",\n  \"b\": 1e+21\n}",
+		},
+		{
+			name:   "pretty with indent",
+			config: TransformationConfig{SkipBundling: true, OutputFormat: PrettyOutput, OutputIndent: "\t"},
+			want:   "{\n\t\"a\": \"<é>\",\n\t\"b\": 1e+21\n}",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr, err := NewTransformer(context.Background(), dhconfig, test.config)
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+			got, err := tr.JSONtoJSON(in)
+			if err != nil {
+				t.Fatalf("JSONtoJSON got unexpected error: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("JSONtoJSON got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransformer_Globals(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `$global.patientId: $StrCat("Patient/", $root.mrn)
+out Patient: {
+  id: $global.patientId
+}
+out Encounter: Encounter($root.visit)
+
+def Encounter(v) {
+  id: v.id
+  subject: $global.patientId
+}`,
+			},
+		},
+	}
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	// The globals of each record are its own.
+	records := []struct {
+		in, want string
+	}{
+		{
+			in:   `{"mrn": "1", "visit": {"id": "v1"}}`,
+			want: `{"Encounter":[{"id":"v1","subject":"Patient/1"}],"Patient":[{"id":"Patient/1"}]}`,
+		},
+		{
+			in:   `{"mrn": "2", "visit": {"id": "v2"}}`,
+			want: `{"Encounter":[{"id":"v2","subject":"Patient/2"}],"Patient":[{"id":"Patient/2"}]}`,
+		},
+	}
+	for _, r := range records {
+		got, err := tr.JSONtoJSON(json.RawMessage(r.in))
+		if err != nil {
+			t.Fatalf("JSONtoJSON(%s) got unexpected error: %v", r.in, err)
+		}
+		if diff := cmp.Diff(r.want, string(got)); diff != "" {
+			t.Errorf("JSONtoJSON(%s) returned diff (-want +got):\n%s", r.in, diff)
+		}
+	}
+}
+
+func TestTransformer_GlobalReadBeforeAssigned(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `out Encounter: Encounter($root.visit)
+$global.patientId: $root.mrn
+
+def Encounter(v) {
+  subject: $global.patientId
+}`,
+			},
+		},
+	}
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	in := `{"mrn": "1", "visit": {"id": "v1"}}`
+	if _, err := tr.JSONtoJSON(json.RawMessage(in)); err == nil || !strings.Contains(err.Error(), "global patientId is read before it is assigned") {
+		t.Errorf("JSONtoJSON(%s) got error %v, want global patientId is read before it is assigned", in, err)
+	}
+}
+
+func TestTransformer_DedupConfigErrors(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `def Key(r) { $this: r.id }`,
+			},
+		},
+	}
+
+	for _, config := range []TransformationConfig{
+		{DedupKeyProjector: "Missing"},
+		{DedupKeyProjector: "Key", DedupKeyPaths: []string{"id"}},
+	} {
+		if _, err := NewTransformer(context.Background(), dhconfig, config); err == nil {
+			t.Errorf("NewTransformer with %+v got no error, want error", config)
+		}
+	}
+}
+
+func TestTransformer_If(t *testing.T) {
+	whistle := `
+status: $If($root.active, "active", "inactive")`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: `{"active": true}`, want: `{"status":"active"}`},
+		{in: `{"active": false}`, want: `{"status":"inactive"}`},
+		// A missing condition is false.
+		{in: `{}`, want: `{"status":"inactive"}`},
+	}
+	for _, test := range tests {
+		got, err := tr.JSONtoJSON(json.RawMessage(test.in))
+		if err != nil {
+			t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", test.in, err)
+		}
+		if diff := cmp.Diff(test.want, string(got)); diff != "" {
+			t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestTransformer_CallStatements(t *testing.T) {
+	whistle := `
+out Patient: Patient($root)
+
+def Patient(p) {
+  CheckRequiredFields(p);
+  if p.active {
+    CheckRequiredFields(p.contact);
+  }
+  id: p.id
+}
+
+def CheckRequiredFields(r) {
+  required id: r.id
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr string
+	}{
+		{in: `{"id": "1"}`, want: `{"Patient":[{"id":"1"}]}`},
+		{in: `{"id": "1", "active": true, "contact": {"id": "2"}}`, want: `{"Patient":[{"id":"1"}]}`},
+		// The calls are evaluated, so their checks fail.
+		{in: `{"name": "x"}`, wantErr: `required target "id" has no value`},
+		{in: `{"id": "1", "active": true, "contact": {}}`, wantErr: `required target "id" has no value`},
+		// The call in the condition block is not evaluated for inactive patients.
+		{in: `{"id": "1", "active": false, "contact": {}}`, want: `{"Patient":[{"id":"1"}]}`},
+	}
+	for _, test := range tests {
+		got, err := tr.JSONtoJSON(json.RawMessage(test.in))
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("JSONtoJSON(%v) got error %v, want error containing %q", test.in, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", test.in, err)
+		}
+		if diff := cmp.Diff(test.want, string(got)); diff != "" {
+			t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", test.in, diff)
+		}
+	}
+}
+
+func TestTransformer_Concurrent(t *testing.T) {
+	whistle := `
+out Patient: Patient_Patient($root)
+out Observation: Observation_Observation($root.obs[], $root.id)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.id
+  name[0].family: $ToUpper(p.last)
+  if $Eq(p.sex, "F") {
+    gender: "female"
+  } else {
+    gender: "unknown"
+  }
+  meta.source: $Param("source")
+}
+
+def Observation_Observation(o, id) {
+  var code: $Lookup("codes", o.code)
+  resourceType: "Observation"
+  subject.reference: $StrCat("Patient/", id)
+  code.text: code.display
+  valueQuantity.value: $Mul(o.value, 2)
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("could not initialize with config: %v", err)
+	}
+	parsed, err := tr.ParseJSON(json.RawMessage(`[{"code": "hr", "display": "Heart rate"}]`))
+	if err != nil {
+		t.Fatalf("ParseJSON got unexpected error: %v", err)
+	}
+	codes := parsed.(jsonutil.JSONArr)
+	if err := tr.RegisterLookupTable("codes", codes, "code"); err != nil {
+		t.Fatalf("RegisterLookupTable got unexpected error: %v", err)
+	}
+	extra := func([]jsonutil.JSONMetaNode, *types.Context) (jsonutil.JSONToken, error) {
+		return nil, nil
+	}
+
+	want := func(id string) string {
+		return `{"Observation":[` +
+			`{"code":{"text":"Heart rate"},"resourceType":"Observation","subject":{"reference":"Patient/` + id + `"},"valueQuantity":{"value":2}},` +
+			`{"code":{"text":"Heart rate"},"resourceType":"Observation","subject":{"reference":"Patient/` + id + `"},"valueQuantity":{"value":4}}],` +
+			`"Patient":[{"gender":"female","id":"` + id + `","meta":{"source":"` + id + `-source"},"name":[{"family":"DOE"}],"resourceType":"Patient"}]}`
+	}
+
+	// Transformations run concurrently with each other and with registrations, which must not
+	// affect them.
+	const records = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*records)
+	for r := 0; r < records; r++ {
+		wg.Add(2)
+		go func(id string) {
+			defer wg.Done()
+			in, err := tr.ParseJSON(json.RawMessage(`{"id": "` + id + `", "last": "Doe", "sex": "F", "obs": [{"code": "hr", "value": 1}, {"code": "hr", "value": 2}]}`))
+			if err != nil {
+				errs <- fmt.Errorf("ParseJSON got unexpected error: %v", err)
+				return
+			}
+			res, err := tr.TransformWithParams(in, map[string]jsonutil.JSONToken{"source": jsonutil.JSONStr(id + "-source")})
+			if err != nil {
+				errs <- fmt.Errorf("TransformWithParams(%v) got unexpected error: %v", id, err)
+				return
+			}
+			got, err := json.Marshal(res)
+			if err != nil {
+				errs <- fmt.Errorf("could not marshal result: %v", err)
+				return
+			}
+			if diff := cmp.Diff(want(id), string(got)); diff != "" {
+				errs <- fmt.Errorf("TransformWithParams(%v) returned diff (-want +got):\n%s", id, diff)
+			}
+		}(fmt.Sprintf("patient-%d", r))
+		go func(r int) {
+			defer wg.Done()
+			name := fmt.Sprintf("Extra_%d", r)
+			if err := tr.RegisterProjector(name, extra); err != nil {
+				errs <- fmt.Errorf("RegisterProjector(%q, ...) got unexpected error: %v", name, err)
+			}
+			if err := tr.Registry().RegisterArity(name, 0); err != nil {
+				errs <- fmt.Errorf("RegisterArity(%q, 0) got unexpected error: %v", name, err)
+			}
+			if err := tr.RegisterLookupTable(fmt.Sprintf("extra_%d", r), codes, "code"); err != nil {
+				errs <- fmt.Errorf("RegisterLookupTable got unexpected error: %v", err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCompileConfig(t *testing.T) {
+	whistle := `
+facility: Facility($root.facility)
+gender: $NormalizeTerm("gender", $root.sex)
+
+def Facility(code) {
+  var facility: $Lookup("facilities", code)
+  $this: facility.name
+}`
+
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: whistle,
+			},
+		},
+	}
+
+	compiled, err := CompileConfig(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		t.Fatalf("CompileConfig got unexpected error: %v", err)
+	}
+
+	// Tables registered with an engine are only seen by it.
+	withTable, err := NewEngine(compiled)
+	if err != nil {
+		t.Fatalf("NewEngine got unexpected error: %v", err)
+	}
+	rows, err := withTable.ParseJSON(json.RawMessage(`[{"code": "F1", "name": "General Hospital"}]`))
+	if err != nil {
+		t.Fatalf("ParseJSON got unexpected error: %v", err)
+	}
+	if err := withTable.RegisterLookupTable("facilities", rows.(jsonutil.JSONArr), "code"); err != nil {
+		t.Fatalf("RegisterLookupTable got unexpected error: %v", err)
+	}
+	if err := withTable.RegisterTermDomain("gender", builtins.TermDomain{Terms: map[string]string{"w": "female"}}); err != nil {
+		t.Fatalf("RegisterTermDomain got unexpected error: %v", err)
+	}
+
+	in := `{"facility": "F1", "sex": "W"}`
+	want := `{"facility":"General Hospital","gender":"female"}`
+	got, err := withTable.JSONtoJSON(json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+	}
+	if diff := cmp.Diff(want, string(got)); diff != "" {
+		t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+	}
+
+	withoutTable, err := NewEngine(compiled)
+	if err != nil {
+		t.Fatalf("NewEngine got unexpected error: %v", err)
+	}
+	if _, err := withoutTable.JSONtoJSON(json.RawMessage(in)); err == nil || !strings.Contains(err.Error(), "facilities") {
+		t.Errorf("JSONtoJSON(%v) of another engine got error %v, want one for the unknown lookup table", in, err)
+	}
+}
+
+func TestCompileConfig_Errors(t *testing.T) {
+	dhconfig := &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: `def Key(r) { $this: r.id }`,
+			},
+		},
+	}
+
+	for _, config := range []TransformationConfig{
+		{DedupKeyProjector: "Missing"},
+		{BundleProjectors: map[string]string{"Patient": "Missing"}},
+		{DigestIgnorePaths: []string{"meta..lastUpdated"}},
+	} {
+		if _, err := CompileConfig(context.Background(), dhconfig, config); err == nil {
+			t.Errorf("CompileConfig with %+v got no error, want error", config)
+		}
+	}
+}
+
+func TestTransformer_StrictSourcePaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		whistle string
+		strict  bool
+		want    string
+		wantErr string
+	}{
+		{
+			name: "typo is null when not strict",
+			whistle: `
+out Patient: Patient_Patient($root.patient)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.identifer
+}`,
+			want: `{"Patient":[{"resourceType":"Patient"}]}`,
+		},
+		{
+			name: "typo in projector argument",
+			whistle: `
+out Patient: Patient_Patient($root.patient)
+
+def Patient_Patient(p) {
+  id: p.identifer
+}`,
+			strict:  true,
+			wantErr: `field "identifer" does not exist (did you mean "identifier"?)`,
+		},
+		{
+			name:    "typo in root input",
+			whistle: `out Patient: $root.patinet`,
+			strict:  true,
+			wantErr: `field "patinet" does not exist (did you mean "patient"?)`,
+		},
+		{
+			name: "typo in nested field",
+			whistle: `
+out Patient: Patient_Patient($root.patient)
+
+def Patient_Patient(p) {
+  family: p.name.famly
+}`,
+			strict:  true,
+			wantErr: `field "famly" does not exist (did you mean "family"?)`,
+		},
+		{
+			name: "optional reads are allowed",
+			whistle: `
+out Patient: Patient_Patient($root.patient)
+
+def Patient_Patient(p) {
+  id: p.identifier
+  telecom: p?.telecom
+  suffix: p.name?.suffix
+}`,
+			strict: true,
+			want:   `{"Patient":[{"id":"123"}]}`,
+		},
+		{
+			name: "guarded reads are allowed",
+			whistle: `
+out Patient: Patient_Patient($root.patient)
+
+def Patient_Patient(p) {
+  id: p.identifier
+  deceased (if p.deceased?): true
+  hasPhone: $IsNotNil(p.phone)
+}`,
+			strict: true,
+			want:   `{"Patient":[{"hasPhone":false,"id":"123"}]}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dhconfig := &dhpb.DataHarmonizationConfig{
+				StructureMappingConfig: &hpb.StructureMappingConfig{
+					Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+						MappingLanguageString: test.whistle,
+					},
+				},
+			}
+
+			tr, err := NewTransformer(context.Background(), dhconfig, TransformationConfig{StrictSourcePaths: test.strict, SkipBundling: true})
+			if err != nil {
+				t.Fatalf("could not initialize with config: %v", err)
+			}
+
+			in := `{"patient": {"identifier": "123", "name": {"family": "Doe"}}}`
+			got, err := tr.JSONtoJSON(json.RawMessage(in))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("JSONtoJSON(%v) got error %v, want error containing %q", in, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("JSONtoJSON(%v) got unexpected error: %v", in, err)
+			}
+
+			if diff := cmp.Diff(test.want, string(got)); diff != "" {
+				t.Errorf("JSONtoJSON(%v) returned diff (-want +got):\n%s", in, diff)
+			}
+		})
+	}
+}
+
+// benchmarkWhistle is the config of the benchmarks of creating transformers and transforming
+// records.
+const benchmarkWhistle = `
+out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  resourceType: "Patient"
+  id: p.id
+  name[0].family: $ToUpper(p.last)
+  gender: $NormalizeTerm("gender", p.sex)
+}`
+
+func benchmarkConfig() *dhpb.DataHarmonizationConfig {
+	return &dhpb.DataHarmonizationConfig{
+		StructureMappingConfig: &hpb.StructureMappingConfig{
+			Mapping: &hpb.StructureMappingConfig_MappingLanguageString{
+				MappingLanguageString: benchmarkWhistle,
+			},
+		},
+	}
+}
+
+func BenchmarkNewDefaultTransformer(b *testing.B) {
+	dhconfig := benchmarkConfig()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true}); err != nil {
+			b.Fatalf("NewDefaultTransformer got unexpected error: %v", err)
+		}
+	}
+}
+
+func BenchmarkNewEngine(b *testing.B) {
+	compiled, err := CompileConfig(context.Background(), benchmarkConfig(), TransformationConfig{SkipBundling: true})
+	if err != nil {
+		b.Fatalf("CompileConfig got unexpected error: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewEngine(compiled); err != nil {
+			b.Fatalf("NewEngine got unexpected error: %v", err)
+		}
+	}
+}
+
+// BenchmarkTransform_EnginePerRecord transforms each record with a new transformer, like a service
+// creating one per request would, either from scratch or from a shared compiled config.
+func BenchmarkTransform_EnginePerRecord(b *testing.B) {
+	in := json.RawMessage(`{"id": "1", "last": "Doe", "sex": "F"}`)
+	dhconfig := benchmarkConfig()
+	compiled, err := CompileConfig(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+	if err != nil {
+		b.Fatalf("CompileConfig got unexpected error: %v", err)
+	}
+
+	b.Run("NewDefaultTransformer", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				tr, err := NewDefaultTransformer(context.Background(), dhconfig, TransformationConfig{SkipBundling: true})
+				if err != nil {
+					b.Errorf("NewDefaultTransformer got unexpected error: %v", err)
+					return
+				}
+				if _, err := tr.JSONtoJSON(in); err != nil {
+					b.Errorf("JSONtoJSON got unexpected error: %v", err)
+					return
+				}
+			}
+		})
+	})
+	b.Run("NewEngine", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				tr, err := NewEngine(compiled)
+				if err != nil {
+					b.Errorf("NewEngine got unexpected error: %v", err)
+					return
+				}
+				if _, err := tr.JSONtoJSON(in); err != nil {
+					b.Errorf("JSONtoJSON got unexpected error: %v", err)
+					return
+				}
+			}
+		})
+	})
+}
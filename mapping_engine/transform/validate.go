@@ -0,0 +1,135 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// OutputValidator checks a single top level output object (e.g. a FHIR resource), written to the
+// given target (e.g. Patient), returning an error if it is invalid.
+type OutputValidator func(target string, resource jsonutil.JSONToken) error
+
+// ValidationSeverity determines what happens when an output fails validation.
+type ValidationSeverity int
+
+const (
+	// RejectInvalidOutput fails the transformation of the record with the invalid output.
+	RejectInvalidOutput ValidationSeverity = iota
+
+	// WarnInvalidOutput logs the validation error and keeps the invalid output.
+	WarnInvalidOutput
+)
+
+// OutputValidationError is returned when an output fails validation.
+type OutputValidationError struct {
+	Target string
+
+	// Index is the index of the output in the target, or -1 if the target is not an array.
+	Index int
+
+	Err error
+}
+
+func (e OutputValidationError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("invalid output %s: %v", e.Target, e.Err)
+	}
+	return fmt.Sprintf("invalid output %s[%d]: %v", e.Target, e.Index, e.Err)
+}
+
+// Unwrap returns the error returned by the validator.
+func (e OutputValidationError) Unwrap() error {
+	return e.Err
+}
+
+// SetOutputValidator sets a validator that is called with every top level output object of each
+// transformed record (before post processing). What happens to invalid outputs is determined by
+// TransformationConfig.OutputValidationSeverity. A nil validator disables validation.
+func (t *DefaultTransformer) SetOutputValidator(v OutputValidator) {
+	t.outputValidator = v
+}
+
+// validateOutputs runs the given validator on every top level output object.
+func validateOutputs(pctx *types.Context, v OutputValidator, severity ValidationSeverity) error {
+	return forEachTopLevelObject(pctx, func(target string, index int, obj jsonutil.JSONToken) error {
+		err := v(target, obj)
+		if err == nil {
+			return nil
+		}
+
+		verr := OutputValidationError{Target: target, Index: index, Err: err}
+		if severity == WarnInvalidOutput {
+			log.Printf("Warning: %v", verr)
+			return nil
+		}
+		return verr
+	})
+}
+
+// fhirIDRegex matches valid FHIR resource ids; see https://www.hl7.org/fhir/datatypes.html#id.
+var fhirIDRegex = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+
+// FHIRShapeValidator is an OutputValidator with cheap structural checks for FHIR resources; it is
+// not a replacement for validating against the resource profiles. It checks that:
+//  * the resource is an object with a resourceType
+//  * the id, if present, is a valid FHIR id (at most 64 letters, digits, - and .)
+//  * field names start with a lowercase letter (or _ for primitive extensions)
+func FHIRShapeValidator(_ string, resource jsonutil.JSONToken) error {
+	c, ok := resource.(jsonutil.JSONContainer)
+	if !ok {
+		return fmt.Errorf("expected a resource object but got %T", resource)
+	}
+
+	var problems []string
+
+	if rt, ok := c["resourceType"]; !ok || rt == nil {
+		problems = append(problems, "missing resourceType")
+	} else if s, ok := (*rt).(jsonutil.JSONStr); !ok || s == "" {
+		problems = append(problems, fmt.Sprintf("resourceType must be a non-empty string but got %v", *rt))
+	}
+
+	if id, ok := c["id"]; ok && id != nil {
+		if s, ok := (*id).(jsonutil.JSONStr); !ok || !fhirIDRegex.MatchString(string(s)) {
+			problems = append(problems, fmt.Sprintf("id %v is not a valid FHIR id (at most 64 letters, digits, - and .)", *id))
+		}
+	}
+
+	var fields []string
+	for f := range c {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		r, _ := utf8.DecodeRuneInString(strings.TrimPrefix(f, "_"))
+		if !unicode.IsLower(r) {
+			problems = append(problems, fmt.Sprintf("field %q does not start with a lowercase letter", f))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
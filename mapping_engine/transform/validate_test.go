@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transform
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+func TestFHIRShapeValidator(t *testing.T) {
+	tests := []struct {
+		name         string
+		resource     string
+		wantProblems []string
+	}{
+		{
+			name:     "valid",
+			resource: `{"resourceType": "Patient", "id": "abc-123.4", "birthDate": "2000", "_birthDate": {}}`,
+		},
+		{
+			name:         "not an object",
+			resource:     `"Patient"`,
+			wantProblems: []string{"resource object"},
+		},
+		{
+			name:         "missing resourceType",
+			resource:     `{"id": "abc"}`,
+			wantProblems: []string{"missing resourceType"},
+		},
+		{
+			name:         "non-string resourceType",
+			resource:     `{"resourceType": 1}`,
+			wantProblems: []string{"resourceType must be a non-empty string"},
+		},
+		{
+			name:         "long id",
+			resource:     `{"resourceType": "Patient", "id": "` + strings.Repeat("a", 65) + `"}`,
+			wantProblems: []string{"not a valid FHIR id"},
+		},
+		{
+			name:         "invalid id characters",
+			resource:     `{"resourceType": "Patient", "id": "a_b"}`,
+			wantProblems: []string{"not a valid FHIR id"},
+		},
+		{
+			name:         "field casing",
+			resource:     `{"ResourceType": "Patient", "Gender": "male"}`,
+			wantProblems: []string{"missing resourceType", `"Gender" does not start with a lowercase letter`, `"ResourceType" does not start with a lowercase letter`},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resource, err := jsonutil.UnmarshalJSON(json.RawMessage(test.resource))
+			if err != nil {
+				t.Fatalf("failed to parse resource: %v", err)
+			}
+
+			err = FHIRShapeValidator("Patient", resource)
+			if len(test.wantProblems) == 0 {
+				if err != nil {
+					t.Errorf("FHIRShapeValidator(%s) returned unexpected error %v", test.resource, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("FHIRShapeValidator(%s) expected error but got nil", test.resource)
+			}
+			for _, p := range test.wantProblems {
+				if !strings.Contains(err.Error(), p) {
+					t.Errorf("FHIRShapeValidator(%s) returned error %q, want it to contain %q", test.resource, err, p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+const (
+	// DefaultMaxOutputTokens is the default OutputBudget.MaxTokens. It is far above what legitimate
+	// mappings write for a single record.
+	DefaultMaxOutputTokens = 100000000
+
+	// DefaultMaxArrayLength is the default OutputBudget.MaxArrayLength.
+	DefaultMaxArrayLength = 10000000
+)
+
+// OutputBudget limits how much a single evaluation may write, so that runaway mappings (e.g. an
+// array appended to in an unbounded iteration) fail with an error instead of exhausting memory.
+// It is not safe for concurrent use.
+type OutputBudget struct {
+	// MaxTokens is the maximum number of JSON tokens (objects, arrays and primitives) written by
+	// mappings, to fields, variables and output objects. Values written in a function and then
+	// returned count again when the function result is written. Zero or less means no limit.
+	MaxTokens int
+
+	// MaxArrayLength is the maximum length of any array that is written or appended to. Zero or less
+	// means no limit.
+	MaxArrayLength int
+
+	tokens int
+}
+
+// OutputBudgetError is returned when a write exceeds an OutputBudget.
+type OutputBudgetError struct {
+	// Target is the target of the write, as it is written in Whistle.
+	Target string
+	// Limit is the limit that was exceeded.
+	Limit int
+	// ArrayLength is true if the limit is OutputBudget.MaxArrayLength rather than
+	// OutputBudget.MaxTokens.
+	ArrayLength bool
+}
+
+func (e OutputBudgetError) Error() string {
+	if e.ArrayLength {
+		return fmt.Sprintf("output budget exceeded: writing to %s makes an array longer than the limit of %d elements", e.Target, e.Limit)
+	}
+	return fmt.Sprintf("output budget exceeded: writing to %s exceeds the limit of %d output tokens", e.Target, e.Limit)
+}
+
+// NewOutputBudget creates an OutputBudget with the given limits.
+func NewOutputBudget(maxTokens, maxArrayLength int) *OutputBudget {
+	return &OutputBudget{MaxTokens: maxTokens, MaxArrayLength: maxArrayLength}
+}
+
+// Tokens returns the number of tokens charged so far.
+func (b *OutputBudget) Tokens() int {
+	return b.tokens
+}
+
+// Charge accounts for the given value being written to the given target, returning an error that
+// names the target if that exceeds the budget.
+func (b *OutputBudget) Charge(target string, value jsonutil.JSONToken) error {
+	n, err := b.count(target, value)
+	if err != nil {
+		return err
+	}
+	b.tokens += n
+	if b.MaxTokens > 0 && b.tokens > b.MaxTokens {
+		return OutputBudgetError{Target: target, Limit: b.MaxTokens}
+	}
+	return nil
+}
+
+// CheckArrayLength returns an error that names the given target if an array of the given length,
+// which was appended to by writing the target, exceeds the budget.
+func (b *OutputBudget) CheckArrayLength(target string, length int) error {
+	if b.MaxArrayLength > 0 && length > b.MaxArrayLength {
+		return OutputBudgetError{Target: target, Limit: b.MaxArrayLength, ArrayLength: true}
+	}
+	return nil
+}
+
+// count returns the number of tokens in the given value, checking the length of its arrays.
+func (b *OutputBudget) count(target string, value jsonutil.JSONToken) (int, error) {
+	n := 1
+	switch t := value.(type) {
+	case jsonutil.JSONContainer:
+		for _, c := range t {
+			if c == nil {
+				continue
+			}
+			cn, err := b.count(target, *c)
+			if err != nil {
+				return 0, err
+			}
+			n += cn
+		}
+	case jsonutil.JSONArr:
+		if err := b.CheckArrayLength(target, len(t)); err != nil {
+			return 0, err
+		}
+		for _, c := range t {
+			cn, err := b.count(target, c)
+			if err != nil {
+				return 0, err
+			}
+			n += cn
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+func TestOutputBudget_Charge(t *testing.T) {
+	tests := []struct {
+		name       string
+		budget     *OutputBudget
+		values     []string
+		wantTokens int
+		wantErr    string
+	}{
+		{
+			name:       "primitives",
+			budget:     NewOutputBudget(10, 10),
+			values:     []string{`1`, `"a"`, `true`},
+			wantTokens: 3,
+		},
+		{
+			name:       "nested",
+			budget:     NewOutputBudget(10, 10),
+			values:     []string{`{"a": [1, 2], "b": {"c": null}}`},
+			wantTokens: 6,
+		},
+		{
+			name:       "no limits",
+			budget:     NewOutputBudget(0, 0),
+			values:     []string{`[1, 2, 3, 4]`, `[1, 2, 3, 4]`},
+			wantTokens: 10,
+		},
+		{
+			name:    "too many tokens",
+			budget:  NewOutputBudget(4, 0),
+			values:  []string{`[1, 2]`, `[1, 2]`},
+			wantErr: "limit of 4 output tokens",
+		},
+		{
+			name:    "nested array too long",
+			budget:  NewOutputBudget(0, 2),
+			values:  []string{`{"a": [1, 2, 3]}`},
+			wantErr: "limit of 2 elements",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			for _, v := range test.values {
+				tok, perr := jsonutil.UnmarshalJSON(json.RawMessage(v))
+				if perr != nil {
+					t.Fatalf("UnmarshalJSON(%s) returned unexpected error %v", v, perr)
+				}
+				if err = test.budget.Charge("target", tok); err != nil {
+					break
+				}
+			}
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) || !strings.Contains(err.Error(), "target") {
+					t.Errorf("Charge got error %v, want error naming the target with %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Charge returned unexpected error %v", err)
+			}
+			if got := test.budget.Tokens(); got != test.wantTokens {
+				t.Errorf("Tokens() = %d, want %d", got, test.wantTokens)
+			}
+		})
+	}
+}
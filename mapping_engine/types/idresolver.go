@@ -0,0 +1,206 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// IDResolver assigns the ids of output resources, e.g. by looking up the identifiers of a patient
+// in an external master patient index, so that the same source entity always gets the same id.
+// Implementations must be safe for concurrent use.
+type IDResolver interface {
+	// Resolve returns the id of the resource of the given type (e.g. Patient) with the given
+	// identifiers (e.g. an array of FHIR Identifiers).
+	Resolve(resourceType string, identifiers jsonutil.JSONToken) (string, error)
+}
+
+// IDResolutionError is the error for ids an IDResolver could not resolve. Identifiers are usually
+// personal data (e.g. medical record numbers), so they are left out of the error message.
+type IDResolutionError struct {
+	ResourceType string
+	Identifiers  jsonutil.JSONToken
+	Err          error
+}
+
+func (e IDResolutionError) Error() string {
+	return fmt.Sprintf("could not resolve the id of %s with the given (redacted) identifiers: %v", e.ResourceType, e.Err)
+}
+
+// Unwrap returns the error the resolver returned.
+func (e IDResolutionError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultIDCacheSize is the number of resolved ids a CachingIDResolver created with
+// NewCachingIDResolver keeps.
+const DefaultIDCacheSize = 100000
+
+// CachingIDResolver wraps an IDResolver so that each resource type and identifiers (compared as
+// JSON, ignoring key order) are only resolved once, and later lookups are answered from memory.
+// Concurrent lookups of the same identifiers wait for the first one. Failed lookups are not cached,
+// so they are tried again. The cache is a bounded LRU, so identifiers not looked up recently may be
+// resolved again.
+type CachingIDResolver struct {
+	resolver IDResolver
+	capacity int
+
+	mu  sync.Mutex
+	lru *list.List
+	ids map[string]*list.Element
+}
+
+// cachedID is a (possibly ongoing) lookup of a CachingIDResolver.
+type cachedID struct {
+	key string
+
+	// done is closed once the lookup finished and id and err are set.
+	done chan struct{}
+	id   string
+	err  error
+}
+
+// NewCachingIDResolver creates a CachingIDResolver with an empty cache of DefaultIDCacheSize ids.
+func NewCachingIDResolver(resolver IDResolver) *CachingIDResolver {
+	return NewCachingIDResolverWithSize(resolver, DefaultIDCacheSize)
+}
+
+// NewCachingIDResolverWithSize creates a CachingIDResolver with an empty cache of the given number
+// of ids. Ongoing lookups count towards the size too.
+func NewCachingIDResolverWithSize(resolver IDResolver, size int) *CachingIDResolver {
+	return &CachingIDResolver{resolver: resolver, capacity: size, lru: list.New(), ids: make(map[string]*list.Element)}
+}
+
+// Resolve returns the cached id of the given resource type and identifiers, or resolves it with the
+// wrapped resolver.
+func (c *CachingIDResolver) Resolve(resourceType string, identifiers jsonutil.JSONToken) (string, error) {
+	h, err := jsonutil.Hash(identifiers, false)
+	if err != nil {
+		return "", fmt.Errorf("could not hash identifiers: %v", err)
+	}
+	key := resourceType + "/" + string(h)
+
+	c.mu.Lock()
+	if el, ok := c.ids[key]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		e := el.Value.(*cachedID)
+		<-e.done
+		if e.err == nil {
+			return e.id, nil
+		}
+		// The lookup being waited for failed, so this one tries again.
+		return c.Resolve(resourceType, identifiers)
+	}
+	e := &cachedID{key: key, done: make(chan struct{})}
+	el := c.lru.PushFront(e)
+	c.ids[key] = el
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	c.mu.Unlock()
+
+	e.id, e.err = c.resolver.Resolve(resourceType, identifiers)
+	if e.err != nil {
+		c.mu.Lock()
+		// The entry may have been evicted (and replaced by a new lookup) in the meantime.
+		if c.ids[key] == el {
+			c.remove(el)
+		}
+		c.mu.Unlock()
+	}
+	close(e.done)
+	return e.id, e.err
+}
+
+// remove removes the given entry from the cache. c.mu must be held.
+func (c *CachingIDResolver) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.ids, el.Value.(*cachedID).key)
+}
+
+// len returns the number of cached (or ongoing) lookups.
+func (c *CachingIDResolver) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// DefaultInMemoryIDLimit is the number of ids an InMemoryIDResolver created with
+// NewInMemoryIDResolver assigns at most.
+const DefaultInMemoryIDLimit = 1000000
+
+// InMemoryIDResolver is an IDResolver that assigns sequential ids (e.g. Patient-1) to the
+// identifiers it has not seen before, for tests and local runs without an external registry. It
+// keeps every id it assigned, so that the same identifiers keep their id, and therefore assigns a
+// limited number of ids.
+type InMemoryIDResolver struct {
+	mu    sync.Mutex
+	ids   map[string]string
+	next  map[string]int
+	limit int
+	calls int
+}
+
+// NewInMemoryIDResolver creates an InMemoryIDResolver that has not assigned any ids, and assigns at
+// most DefaultInMemoryIDLimit.
+func NewInMemoryIDResolver() *InMemoryIDResolver {
+	return NewInMemoryIDResolverWithLimit(DefaultInMemoryIDLimit)
+}
+
+// NewInMemoryIDResolverWithLimit creates an InMemoryIDResolver that has not assigned any ids, and
+// assigns at most the given number.
+func NewInMemoryIDResolverWithLimit(limit int) *InMemoryIDResolver {
+	return &InMemoryIDResolver{ids: make(map[string]string), next: make(map[string]int), limit: limit}
+}
+
+// Resolve returns the id assigned to the given resource type and identifiers, assigning the next
+// one if there is none yet. Null identifiers, and new identifiers once the limit of ids is
+// reached, are an error.
+func (r *InMemoryIDResolver) Resolve(resourceType string, identifiers jsonutil.JSONToken) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls++
+	if identifiers == nil {
+		return "", fmt.Errorf("identifiers must not be null")
+	}
+	h, err := jsonutil.Hash(identifiers, false)
+	if err != nil {
+		return "", fmt.Errorf("could not hash identifiers: %v", err)
+	}
+	key := resourceType + "/" + string(h)
+	if id, ok := r.ids[key]; ok {
+		return id, nil
+	}
+	if len(r.ids) >= r.limit {
+		return "", fmt.Errorf("can not assign more than %d ids", r.limit)
+	}
+	r.next[resourceType]++
+	id := fmt.Sprintf("%s-%d", resourceType, r.next[resourceType])
+	r.ids[key] = id
+	return id, nil
+}
+
+// Calls returns the number of times Resolve was called.
+func (r *InMemoryIDResolver) Calls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls
+}
@@ -0,0 +1,182 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	stderrors "errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+func identifiers(values ...string) jsonutil.JSONToken {
+	arr := jsonutil.JSONArr{}
+	for _, v := range values {
+		var system, value jsonutil.JSONToken = jsonutil.JSONStr("urn:mrn"), jsonutil.JSONStr(v)
+		arr = append(arr, jsonutil.JSONContainer{"system": &system, "value": &value})
+	}
+	return arr
+}
+
+func TestInMemoryIDResolver(t *testing.T) {
+	r := NewInMemoryIDResolver()
+	tests := []struct {
+		resourceType string
+		identifiers  jsonutil.JSONToken
+		want         string
+	}{
+		{resourceType: "Patient", identifiers: identifiers("1"), want: "Patient-1"},
+		{resourceType: "Patient", identifiers: identifiers("2"), want: "Patient-2"},
+		{resourceType: "Patient", identifiers: identifiers("1"), want: "Patient-1"},
+		{resourceType: "Practitioner", identifiers: identifiers("1"), want: "Practitioner-1"},
+		{resourceType: "Patient", identifiers: identifiers("1", "2"), want: "Patient-3"},
+	}
+	for _, test := range tests {
+		got, err := r.Resolve(test.resourceType, test.identifiers)
+		if err != nil {
+			t.Fatalf("Resolve(%s, %v) returned unexpected error %v", test.resourceType, test.identifiers, err)
+		}
+		if got != test.want {
+			t.Errorf("Resolve(%s, %v) = %s, want %s", test.resourceType, test.identifiers, got, test.want)
+		}
+	}
+	if got := r.Calls(); got != len(tests) {
+		t.Errorf("Calls() = %d, want %d", got, len(tests))
+	}
+	if _, err := r.Resolve("Patient", nil); err == nil {
+		t.Errorf("Resolve(Patient, nil) returned no error, want one for the null identifiers")
+	}
+}
+
+func TestCachingIDResolver(t *testing.T) {
+	r := NewInMemoryIDResolver()
+	c := NewCachingIDResolver(r)
+
+	for i := 0; i < 3; i++ {
+		for _, rt := range []string{"Patient", "Practitioner"} {
+			got, err := c.Resolve(rt, identifiers("1"))
+			if err != nil {
+				t.Fatalf("Resolve(%s, 1) returned unexpected error %v", rt, err)
+			}
+			if want := rt + "-1"; got != want {
+				t.Errorf("Resolve(%s, 1) = %s, want %s", rt, got, want)
+			}
+		}
+	}
+	if got := r.Calls(); got != 2 {
+		t.Errorf("the wrapped resolver was called %d times, want 2", got)
+	}
+}
+
+func TestInMemoryIDResolver_Limit(t *testing.T) {
+	r := NewInMemoryIDResolverWithLimit(2)
+	for _, v := range []string{"1", "2", "1"} {
+		if _, err := r.Resolve("Patient", identifiers(v)); err != nil {
+			t.Fatalf("Resolve(Patient, %s) returned unexpected error %v", v, err)
+		}
+	}
+	if _, err := r.Resolve("Practitioner", identifiers("1")); err == nil {
+		t.Errorf("Resolve(Practitioner, 1) returned no error, want one for the third id over the limit of 2")
+	}
+}
+
+func TestCachingIDResolver_Evicts(t *testing.T) {
+	r := NewInMemoryIDResolver()
+	c := NewCachingIDResolverWithSize(r, 2)
+
+	// 1 is looked up again before 3 is, so 2 is the least recently used when 3 is cached.
+	for _, v := range []string{"1", "2", "1", "3", "1", "2"} {
+		if _, err := c.Resolve("Patient", identifiers(v)); err != nil {
+			t.Fatalf("Resolve(Patient, %s) returned unexpected error %v", v, err)
+		}
+	}
+	if got := c.len(); got != 2 {
+		t.Errorf("the cache holds %d ids, want 2", got)
+	}
+	// 1, 2 and 3 are resolved once each, and 2 again after it was evicted.
+	if got := r.Calls(); got != 4 {
+		t.Errorf("the wrapped resolver was called %d times, want 4", got)
+	}
+	if got, err := c.Resolve("Patient", identifiers("2")); err != nil || got != "Patient-2" {
+		t.Errorf("Resolve(Patient, 2) = %s, %v, want Patient-2", got, err)
+	}
+}
+
+func TestCachingIDResolver_Concurrent(t *testing.T) {
+	r := NewInMemoryIDResolver()
+	c := NewCachingIDResolver(r)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v := fmt.Sprint(i % 5)
+			if _, err := c.Resolve("Patient", identifiers(v)); err != nil {
+				t.Errorf("Resolve(Patient, %s) returned unexpected error %v", v, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := r.Calls(); got != 5 {
+		t.Errorf("the wrapped resolver was called %d times, want 5", got)
+	}
+}
+
+// flakyIDResolver fails the first call, and resolves every identifier to "id" afterwards.
+type flakyIDResolver struct {
+	calls int
+}
+
+func (r *flakyIDResolver) Resolve(string, jsonutil.JSONToken) (string, error) {
+	r.calls++
+	if r.calls == 1 {
+		return "", fmt.Errorf("index unavailable")
+	}
+	return "id", nil
+}
+
+func TestCachingIDResolver_ErrorsAreNotCached(t *testing.T) {
+	r := &flakyIDResolver{}
+	c := NewCachingIDResolver(r)
+
+	if _, err := c.Resolve("Patient", identifiers("1")); err == nil {
+		t.Fatalf("Resolve(Patient, 1) returned no error, want the error of the wrapped resolver")
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := c.Resolve("Patient", identifiers("1")); err != nil || got != "id" {
+			t.Errorf("Resolve(Patient, 1) = %s, %v, want id", got, err)
+		}
+	}
+	if r.calls != 2 {
+		t.Errorf("the wrapped resolver was called %d times, want 2", r.calls)
+	}
+}
+
+func TestIDResolutionError(t *testing.T) {
+	cause := fmt.Errorf("no match")
+	err := error(IDResolutionError{ResourceType: "Patient", Identifiers: identifiers("1"), Err: cause})
+
+	want := `could not resolve the id of Patient with the given (redacted) identifiers: no match`
+	if err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	if !stderrors.Is(err, cause) {
+		t.Errorf("errors.Is(%v, %v) = false, want true", err, cause)
+	}
+}
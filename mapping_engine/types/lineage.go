@@ -0,0 +1,179 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// lineageSeparator separates the sources in a lineage leaf.
+const lineageSeparator = "\x00"
+
+// Lineage records where the values written by an evaluation come from. Every value the mappings
+// write (to the output of the projector being evaluated, the root output, output objects and
+// variables) is mirrored by a lineage tree of the same shape, written the same way, whose leaves
+// are lineage leaves (see LineageLeaf) listing the sources of the corresponding leaves of the value.
+// It is not safe for concurrent use.
+type Lineage struct {
+	// Output is the lineage tree of the root output.
+	Output jsonutil.JSONToken
+
+	// TopLevelObjects are the lineage trees of the output objects, in the order they were written.
+	TopLevelObjects map[string][]jsonutil.JSONToken
+
+	// scopes are the lineage of the projector invocations in progress, innermost last. The first is
+	// the root mappings, whose output is Output.
+	scopes []*lineageScope
+
+	// returned is the lineage tree of the value returned by the last projector invocation that ended.
+	returned jsonutil.JSONToken
+}
+
+// lineageScope is the lineage of a projector invocation.
+type lineageScope struct {
+	output *jsonutil.JSONToken
+	vars   map[string]jsonutil.JSONToken
+}
+
+// NewLineage creates an empty Lineage, ready to record the root mappings.
+func NewLineage() *Lineage {
+	l := &Lineage{TopLevelObjects: map[string][]jsonutil.JSONToken{}}
+	l.scopes = []*lineageScope{{output: &l.Output, vars: map[string]jsonutil.JSONToken{}}}
+	return l
+}
+
+// Push starts recording the lineage of a projector invocation.
+func (l *Lineage) Push() {
+	l.scopes = append(l.scopes, &lineageScope{output: new(jsonutil.JSONToken), vars: map[string]jsonutil.JSONToken{}})
+}
+
+// Pop ends recording the lineage of the innermost projector invocation. The lineage tree of its
+// output is then returned by TakeReturned.
+func (l *Lineage) Pop() {
+	if len(l.scopes) <= 1 {
+		return
+	}
+	l.returned = *l.scope().output
+	l.scopes = l.scopes[:len(l.scopes)-1]
+}
+
+// TakeReturned returns the lineage tree of the value returned by the last projector invocation that
+// ended, if it was not taken yet.
+func (l *Lineage) TakeReturned() jsonutil.JSONToken {
+	r := l.returned
+	l.returned = nil
+	return r
+}
+
+// SetReturned replaces the lineage tree of the value returned by the last projector invocation,
+// e.g. for builtins that return a wrapped result of a projector.
+func (l *Lineage) SetReturned(r jsonutil.JSONToken) {
+	l.returned = r
+}
+
+// ScopeOutput returns the lineage tree of the output of the innermost projector invocation (or of
+// the root mappings).
+func (l *Lineage) ScopeOutput() *jsonutil.JSONToken {
+	return l.scope().output
+}
+
+// Var returns the lineage tree of the value of the variable with the given name, in the innermost
+// projector invocation.
+func (l *Lineage) Var(name string) jsonutil.JSONToken {
+	return l.scope().vars[name]
+}
+
+// SetVar sets the lineage tree of the value of the variable with the given name, in the innermost
+// projector invocation.
+func (l *Lineage) SetVar(name string, v jsonutil.JSONToken) {
+	l.scope().vars[name] = v
+}
+
+func (l *Lineage) scope() *lineageScope {
+	return l.scopes[len(l.scopes)-1]
+}
+
+// depth returns the number of projector invocations in progress, counting the root mappings.
+func (l *Lineage) depth() int {
+	return len(l.scopes)
+}
+
+// unwind discards the projector invocations started since the given depth, which failed.
+func (l *Lineage) unwind(depth int) {
+	if depth > 0 && depth < len(l.scopes) {
+		l.scopes = l.scopes[:depth]
+	}
+	l.returned = nil
+}
+
+// Paths returns the sources of each leaf of the root output and the output objects, keyed by the
+// path of the leaf, e.g. "Patient[0].name[0].given" for a field of the first Patient output object.
+// Leaves that no source flowed into (e.g. constants) are left out.
+func (l *Lineage) Paths() map[string][]string {
+	paths := map[string][]string{}
+	addLineagePaths("", l.Output, paths)
+
+	names := make([]string, 0, len(l.TopLevelObjects))
+	for name := range l.TopLevelObjects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for i, obj := range l.TopLevelObjects[name] {
+			addLineagePaths(name+"["+strconv.Itoa(i)+"]", obj, paths)
+		}
+	}
+	return paths
+}
+
+func addLineagePaths(path string, t jsonutil.JSONToken, paths map[string][]string) {
+	switch v := t.(type) {
+	case jsonutil.JSONContainer:
+		for k, c := range v {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			addLineagePaths(p, *c, paths)
+		}
+	case jsonutil.JSONArr:
+		for i, c := range v {
+			addLineagePaths(path+"["+strconv.Itoa(i)+"]", c, paths)
+		}
+	default:
+		if sources := LineageLeafSources(t); len(sources) > 0 {
+			paths[path] = sources
+		}
+	}
+}
+
+// LineageLeaf returns the lineage leaf listing the given sources.
+func LineageLeaf(sources []string) jsonutil.JSONToken {
+	return jsonutil.JSONStr(strings.Join(sources, lineageSeparator))
+}
+
+// LineageLeafSources returns the sources listed by the given lineage leaf. It returns nil for
+// anything else.
+func LineageLeafSources(t jsonutil.JSONToken) []string {
+	s, ok := t.(jsonutil.JSONStr)
+	if !ok || s == "" {
+		return nil
+	}
+	return strings.Split(string(s), lineageSeparator)
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+func TestLineage_Paths(t *testing.T) {
+	l := NewLineage()
+	given := LineageLeaf([]string{"name.given"})
+	constant := LineageLeaf(nil)
+	l.Output = jsonutil.JSONContainer{
+		"meta": &constant,
+		"id":   &given,
+	}
+	l.TopLevelObjects["Patient"] = []jsonutil.JSONToken{
+		jsonutil.JSONArr{LineageLeaf([]string{"a", "$ToUpper(b)"}), nil},
+		LineageLeaf([]string{"c"}),
+	}
+
+	want := map[string][]string{
+		"id":            {"name.given"},
+		"Patient[0][0]": {"a", "$ToUpper(b)"},
+		"Patient[1]":    {"c"},
+	}
+	if diff := cmp.Diff(want, l.Paths()); diff != "" {
+		t.Errorf("Paths() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestLineage_Scopes(t *testing.T) {
+	pctx := NewContext(NewRegistry())
+	pctx.Variables.Push()
+	pctx.Lineage = NewLineage()
+	root := pctx.Lineage.ScopeOutput()
+
+	pctx.Lineage.Push()
+	*pctx.Lineage.ScopeOutput() = LineageLeaf([]string{"x"})
+	pctx.Lineage.Pop()
+	if got := LineageLeafSources(pctx.Lineage.TakeReturned()); !cmp.Equal(got, []string{"x"}) {
+		t.Errorf("TakeReturned() after Pop() returned sources %v, want [x]", got)
+	}
+	if got := pctx.Lineage.TakeReturned(); got != nil {
+		t.Errorf("TakeReturned() returned %v the second time, want nil", got)
+	}
+
+	// Scopes of failed projectors are discarded by Unwind.
+	mark := pctx.Mark()
+	pctx.Lineage.Push()
+	pctx.Lineage.Push()
+	pctx.Unwind(mark)
+	if got := pctx.Lineage.ScopeOutput(); got != root {
+		t.Errorf("ScopeOutput() after Unwind() returned %p, want the root output %p", got, root)
+	}
+}
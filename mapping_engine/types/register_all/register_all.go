@@ -35,6 +35,12 @@ func RegisterAll(r *types.Registry) error {
 		if err = r.RegisterProjector(name, proj); err != nil {
 			return fmt.Errorf("failed to register built-in %s: %v", name, err)
 		}
+
+		if rt := projector.ResultType(fn); rt != "" {
+			if err = r.RegisterResultType(name, rt); err != nil {
+				return fmt.Errorf("failed to register result type of built-in %s: %v", name, err)
+			}
+		}
 	}
 
 	return nil
@@ -16,13 +16,45 @@ package types
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
 )
 
-// Registry stores projectors for a mapping config to use.
+// NamespaceSeparator separates the namespace of a projector from its name in qualified names, e.g.
+// acme::$ChecksumMRN.
+const NamespaceSeparator = "::"
+
+// Registry stores projectors for a mapping config to use. A Registry is safe for concurrent use:
+// projectors may be found (i.e. mappings evaluated) by any number of goroutines at once, including
+// while other goroutines register projectors, arities, retry policies or timeouts. Registering
+// only ever adds projectors, so a projector found once stays valid, but whether an evaluation that
+// is already in progress sees a projector registered concurrently is unspecified.
 type Registry struct {
-	registry map[string]Projector
+	mu            sync.RWMutex
+	registry      map[string]Projector
+	arities       map[string]int
+	retryPolicies map[string]RetryPolicy
+	timeouts      map[string]time.Duration
+	descriptions  map[string]string
+	resultTypes   map[string]string
+
+	// namespaces are the namespaces whose projectors can be found by their unqualified names (see
+	// UseNamespace).
+	namespaces map[string]bool
+
+	// aliases are the qualified names of the projectors of the used namespaces, by unqualified name.
+	aliases map[string]string
+}
+
+// ProjectorInfo describes a projector in a registry, e.g. for documentation or editor tooling.
+type ProjectorInfo struct {
+	Name string
+	// Description is the documentation of the projector, if it has any (see RegisterDescription).
+	Description string
 }
 
 // NewRegistry creates a new empty registry.
@@ -31,6 +63,15 @@ func NewRegistry() *Registry {
 		registry: map[string]Projector{
 			"": identity,
 		},
+		arities: map[string]int{
+			"": 1,
+		},
+		retryPolicies: map[string]RetryPolicy{},
+		timeouts:      map[string]time.Duration{},
+		descriptions:  map[string]string{},
+		resultTypes:   map[string]string{},
+		namespaces:    map[string]bool{},
+		aliases:       map[string]string{},
 	}
 }
 
@@ -42,12 +83,22 @@ func identity(arguments []jsonutil.JSONMetaNode, _ *Context) (jsonutil.JSONToken
 	return jsonutil.NodeToToken(arguments[0])
 }
 
-// RegisterProjector adds the given Projector to the registry.
+// RegisterProjector adds the given Projector to the registry. The name may be qualified with a
+// namespace (see RegisterNamespacedProjector).
 func (r *Registry) RegisterProjector(name string, projector Projector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if err := r.validateProjectorName(name); err != nil {
 		return err
 	}
 
+	if ns, n, ok := SplitQualifiedName(name); ok && r.namespaces[ns] {
+		if err := r.addAlias(ns, n); err != nil {
+			return err
+		}
+	}
+
 	r.registry[name] = projector
 
 	return nil
@@ -58,20 +109,337 @@ func (r *Registry) validateProjectorName(name string) error {
 	if _, ok := r.registry[name]; ok {
 		return fmt.Errorf("projector %s is already defined", name)
 	}
+	if q, ok := r.aliases[name]; ok {
+		return fmt.Errorf("projector %s collides with %s, which is in scope as %s since its namespace is used", name, q, name)
+	}
+
+	return nil
+}
+
+// ReplaceProjector replaces the projector registered with the given name, keeping its arity, retry
+// policy, timeout and description, e.g. to rebind a builtin to the state of a cloned engine. It is
+// an error if no projector is registered with the name.
+func (r *Registry) ReplaceProjector(name string, projector Projector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.registry[name]; !ok {
+		return fmt.Errorf("projector not found: %s", name)
+	}
+
+	r.registry[name] = projector
 
 	return nil
 }
 
+// RegisterNamespacedProjector adds the given Projector to the registry under the given namespace,
+// e.g. so that packs of projectors from different sources can not collide. It can be found by its
+// qualified name (see QualifiedName), or by its name alone if its namespace is used (see
+// UseNamespace).
+func (r *Registry) RegisterNamespacedProjector(namespace, name string, projector Projector) error {
+	if namespace == "" || strings.Contains(namespace, NamespaceSeparator) {
+		return fmt.Errorf("invalid namespace %q: it must be non-empty and can not contain %s", namespace, NamespaceSeparator)
+	}
+	if name == "" || strings.Contains(name, NamespaceSeparator) {
+		return fmt.Errorf("invalid projector name %q: it must be non-empty and can not contain %s", name, NamespaceSeparator)
+	}
+	return r.RegisterProjector(QualifiedName(namespace, name), projector)
+}
+
+// QualifiedName returns the name of the projector with the given name in the given namespace.
+func QualifiedName(namespace, name string) string {
+	return namespace + NamespaceSeparator + name
+}
+
+// SplitQualifiedName returns the namespace and the name of the given qualified projector name, and
+// false if the name is not qualified.
+func SplitQualifiedName(qualified string) (string, string, bool) {
+	i := strings.Index(qualified, NamespaceSeparator)
+	if i < 0 {
+		return "", "", false
+	}
+	return qualified[:i], qualified[i+len(NamespaceSeparator):], true
+}
+
+// UseNamespace makes the projectors of the given namespace, including ones registered later, found
+// by their unqualified names too. It is an error if any of them has the name of another projector,
+// either one registered without a namespace (like the builtins), or one of another used namespace.
+func (r *Registry) UseNamespace(namespace string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.namespaces[namespace] {
+		return nil
+	}
+	r.namespaces[namespace] = true
+
+	var names []string
+	for qualified := range r.registry {
+		if ns, n, ok := SplitQualifiedName(qualified); ok && ns == namespace {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		if err := r.addAlias(namespace, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addAlias makes the projector with the given name in the given used namespace found by its
+// unqualified name, unless that collides with another projector.
+func (r *Registry) addAlias(namespace, name string) error {
+	qualified := QualifiedName(namespace, name)
+	if q, ok := r.aliases[name]; ok && q != qualified {
+		return fmt.Errorf("projector %s collides with %s: both namespaces are used, so both are in scope as %s", qualified, q, name)
+	}
+	if _, ok := r.registry[name]; ok {
+		return fmt.Errorf("projector %s collides with the projector %s registered without a namespace, which is in scope since the namespace %s is used", qualified, name, namespace)
+	}
+	r.aliases[name] = qualified
+	return nil
+}
+
+// resolve returns the name the projector with the given (possibly unqualified) name is registered
+// under. The caller must hold the lock.
+func (r *Registry) resolve(name string) string {
+	if _, ok := r.registry[name]; ok {
+		return name
+	}
+	if q, ok := r.aliases[name]; ok {
+		return q
+	}
+	return name
+}
+
 // FindProjector finds and returns a projector with the given name, or an error if no projector with
-// that name exists.
+// that name exists. If the projector has a timeout or a retry policy, the returned projector applies
+// them (the timeout applies to each attempt).
 func (r *Registry) FindProjector(name string) (Projector, error) {
-	if proj, ok := r.registry[name]; ok {
-		return proj, nil
+	r.mu.RLock()
+	name = r.resolve(name)
+	proj, ok := r.registry[name]
+	policy, hasPolicy := r.retryPolicies[name]
+	timeout, hasTimeout := r.timeouts[name]
+	r.mu.RUnlock()
+
+	if !ok {
+		if similar := r.SimilarNames(name, 3); len(similar) > 0 {
+			return nil, fmt.Errorf("projector not found: %s (did you mean one of %q?)", name, similar)
+		}
+		return nil, fmt.Errorf("projector not found: %s", name)
+	}
+	if hasTimeout {
+		proj = withTimeout(name, timeout, proj)
+	}
+	if hasPolicy {
+		return policy.withRetries(name, proj), nil
+	}
+	return proj, nil
+}
+
+// SetRetryPolicy makes calls to the projector with the given name (found through FindProjector) be
+// retried according to the given policy.
+func (r *Registry) SetRetryPolicy(name string, policy RetryPolicy) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = r.resolve(name)
+	if _, ok := r.registry[name]; !ok {
+		return fmt.Errorf("projector not found: %s", name)
 	}
-	return nil, fmt.Errorf("projector not found: %s", name)
+
+	r.retryPolicies[name] = policy
+
+	return nil
+}
+
+// SetTimeout makes calls to the projector with the given name (found through FindProjector) fail
+// with a TimeoutError if they take longer than the given timeout. The projector is called with a Go
+// context (see Context.GoContext) that is cancelled once the timeout passes, so it is meant for
+// projectors doing I/O with that context, like lookups in remote services. Projectors without a
+// timeout are called as they are.
+func (r *Registry) SetTimeout(name string, timeout time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = r.resolve(name)
+	if _, ok := r.registry[name]; !ok {
+		return fmt.Errorf("projector not found: %s", name)
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("timeout of projector %s must be positive but was %v", name, timeout)
+	}
+
+	r.timeouts[name] = timeout
+
+	return nil
+}
+
+// RegisterArity records the number of arguments the projector with the given name expects. This is
+// only needed for projectors that do not validate their own arguments (e.g. those created from
+// mapping definitions), so that calls whose argument count is only known at runtime (like those
+// with spread arguments) can be validated.
+func (r *Registry) RegisterArity(name string, arity int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = r.resolve(name)
+	if _, ok := r.registry[name]; !ok {
+		return fmt.Errorf("projector not found: %s", name)
+	}
+
+	r.arities[name] = arity
+
+	return nil
+}
+
+// Arity returns the number of arguments the projector with the given name expects, and whether it
+// is known.
+func (r *Registry) Arity(name string) (int, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	arity, ok := r.arities[r.resolve(name)]
+	return arity, ok
+}
+
+// RegisterResultType records the type of the results of the projector with the given name ("string",
+// "number", "bool", "array" or "object"), e.g. so that the transpiler can type check calls to it.
+func (r *Registry) RegisterResultType(name, resultType string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = r.resolve(name)
+	if _, ok := r.registry[name]; !ok {
+		return fmt.Errorf("projector not found: %s", name)
+	}
+
+	r.resultTypes[name] = resultType
+
+	return nil
+}
+
+// ResultTypes returns the registered result types of the projectors (see RegisterResultType), by
+// name.
+func (r *Registry) ResultTypes() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res := make(map[string]string, len(r.resultTypes))
+	for name, t := range r.resultTypes {
+		res[name] = t
+	}
+	return res
+}
+
+// RegisterDescription records the documentation of the projector with the given name, e.g. the doc
+// comment of a projector defined in Whistle.
+func (r *Registry) RegisterDescription(name, description string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name = r.resolve(name)
+	if _, ok := r.registry[name]; !ok {
+		return fmt.Errorf("projector not found: %s", name)
+	}
+
+	r.descriptions[name] = description
+
+	return nil
+}
+
+// ListProjectors returns the projectors in the registry with their descriptions, sorted by name.
+func (r *Registry) ListProjectors() []ProjectorInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	infos := make([]ProjectorInfo, 0, len(r.registry))
+	for name := range r.registry {
+		infos = append(infos, ProjectorInfo{Name: name, Description: r.descriptions[name]})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// Names returns the sorted names of the projectors in the registry.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.registry))
+	for name := range r.registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SimilarNames returns up to max of the names the projectors in the registry can be called by
+// (including the unqualified names of used namespaces) that the given name is plausibly a typo of,
+// closest first.
+func (r *Registry) SimilarNames(name string, max int) []string {
+	names := r.Names()
+	r.mu.RLock()
+	for alias := range r.aliases {
+		names = append(names, alias)
+	}
+	r.mu.RUnlock()
+	return SimilarNames(name, names, max)
 }
 
 // Count returns the number of projectors in the registry.
 func (r *Registry) Count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	return len(r.registry)
 }
+
+// Clone returns a copy of the registry. Projectors, arities, retry policies, timeouts, descriptions
+// and used namespaces registered in either afterwards do not affect the other.
+func (r *Registry) Clone() *Registry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c := &Registry{
+		registry:      make(map[string]Projector, len(r.registry)),
+		arities:       make(map[string]int, len(r.arities)),
+		retryPolicies: make(map[string]RetryPolicy, len(r.retryPolicies)),
+		timeouts:      make(map[string]time.Duration, len(r.timeouts)),
+		descriptions:  make(map[string]string, len(r.descriptions)),
+		resultTypes:   make(map[string]string, len(r.resultTypes)),
+		namespaces:    make(map[string]bool, len(r.namespaces)),
+		aliases:       make(map[string]string, len(r.aliases)),
+	}
+	for k, v := range r.registry {
+		c.registry[k] = v
+	}
+	for k, v := range r.arities {
+		c.arities[k] = v
+	}
+	for k, v := range r.retryPolicies {
+		c.retryPolicies[k] = v
+	}
+	for k, v := range r.timeouts {
+		c.timeouts[k] = v
+	}
+	for k, v := range r.descriptions {
+		c.descriptions[k] = v
+	}
+	for k, v := range r.resultTypes {
+		c.resultTypes[k] = v
+	}
+	for k, v := range r.namespaces {
+		c.namespaces[k] = v
+	}
+	for k, v := range r.aliases {
+		c.aliases[k] = v
+	}
+	return c
+}
@@ -16,7 +16,10 @@ package types
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
@@ -77,6 +80,65 @@ func TestRegisterProjector(t *testing.T) {
 	}
 }
 
+func TestNames(t *testing.T) {
+	reg := NewRegistry()
+	for _, name := range []string{"foo", "bar"} {
+		if err := reg.RegisterProjector(name, nilProjector); err != nil {
+			t.Fatalf("RegisterProjector(%v) returned unexpected error %v", name, err)
+		}
+	}
+
+	want := []string{"", "bar", "foo"}
+	if diff := cmp.Diff(want, reg.Names()); diff != "" {
+		t.Errorf("Names() returned diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestFindProjectorSuggestions(t *testing.T) {
+	reg := NewRegistry()
+	for _, name := range []string{"$StrCat", "$StrJoin", "$StrSplit", "$ToUpper"} {
+		if err := reg.RegisterProjector(name, nilProjector); err != nil {
+			t.Fatalf("RegisterProjector(%v) returned unexpected error %v", name, err)
+		}
+	}
+	if err := reg.RegisterNamespacedProjector("acme", "$ChecksumMRN", nilProjector); err != nil {
+		t.Fatalf("RegisterNamespacedProjector(acme, $ChecksumMRN) returned unexpected error %v", err)
+	}
+	if err := reg.UseNamespace("acme"); err != nil {
+		t.Fatalf("UseNamespace(acme) returned unexpected error %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{
+			name:    "$StrConcat",
+			wantErr: `projector not found: $StrConcat (did you mean one of ["$StrCat" "$StrJoin" "$StrSplit"]?)`,
+		},
+		{
+			name:    "$ToUper",
+			wantErr: `projector not found: $ToUper (did you mean one of ["$ToUpper"]?)`,
+		},
+		{
+			name:    "$ChecksumMNR",
+			wantErr: `projector not found: $ChecksumMNR (did you mean one of ["$ChecksumMRN"]?)`,
+		},
+		{
+			name:    "Unrelated",
+			wantErr: `projector not found: Unrelated`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := reg.FindProjector(test.name)
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("FindProjector(%s) returned error %v, want %s", test.name, err, test.wantErr)
+			}
+		})
+	}
+}
+
 func TestIdentity(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -158,6 +220,220 @@ func TestRegisterProjectorErrors(t *testing.T) {
 	}
 }
 
+func TestNamespaces(t *testing.T) {
+	reg := NewRegistry()
+
+	for _, n := range []string{"$A", "$B"} {
+		if err := reg.RegisterNamespacedProjector("acme", n, nilProjector); err != nil {
+			t.Fatalf("RegisterNamespacedProjector(acme, %s) returned unexpected error %v", n, err)
+		}
+	}
+	if _, err := reg.FindProjector("$A"); err == nil {
+		t.Errorf("FindProjector($A) expected to error before acme is used but didn't")
+	}
+	if _, err := reg.FindProjector("acme::$A"); err != nil {
+		t.Errorf("FindProjector(acme::$A) returned unexpected error %v", err)
+	}
+
+	if err := reg.UseNamespace("acme"); err != nil {
+		t.Fatalf("UseNamespace(acme) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterNamespacedProjector("acme", "$C", nilProjector); err != nil {
+		t.Fatalf("RegisterNamespacedProjector(acme, $C) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterArity("$C", 2); err != nil {
+		t.Fatalf("RegisterArity($C, 2) returned unexpected error %v", err)
+	}
+	for _, n := range []string{"$A", "$B", "$C"} {
+		if _, err := reg.FindProjector(n); err != nil {
+			t.Errorf("FindProjector(%s) returned unexpected error %v", n, err)
+		}
+	}
+	if got, ok := reg.Arity("acme::$C"); !ok || got != 2 {
+		t.Errorf("Arity(acme::$C) => %d, %v, want 2, true", got, ok)
+	}
+}
+
+func TestNamespacesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(reg *Registry) error
+		wantErr string
+	}{
+		{
+			name: "invalid namespace",
+			setup: func(reg *Registry) error {
+				return reg.RegisterNamespacedProjector("a::b", "$A", nilProjector)
+			},
+			wantErr: `invalid namespace "a::b"`,
+		},
+		{
+			name: "invalid name",
+			setup: func(reg *Registry) error {
+				return reg.RegisterNamespacedProjector("acme", "", nilProjector)
+			},
+			wantErr: `invalid projector name ""`,
+		},
+		{
+			name: "two used namespaces",
+			setup: func(reg *Registry) error {
+				reg.RegisterNamespacedProjector("acme", "$A", nilProjector)
+				reg.RegisterNamespacedProjector("beta", "$A", nilProjector)
+				reg.UseNamespace("acme")
+				return reg.UseNamespace("beta")
+			},
+			wantErr: "projector beta::$A collides with acme::$A",
+		},
+		{
+			name: "registered into a used namespace",
+			setup: func(reg *Registry) error {
+				reg.RegisterNamespacedProjector("acme", "$A", nilProjector)
+				reg.UseNamespace("acme")
+				reg.UseNamespace("beta")
+				return reg.RegisterNamespacedProjector("beta", "$A", nilProjector)
+			},
+			wantErr: "projector beta::$A collides with acme::$A",
+		},
+		{
+			name: "projector without a namespace",
+			setup: func(reg *Registry) error {
+				reg.RegisterProjector("$A", nilProjector)
+				reg.RegisterNamespacedProjector("acme", "$A", nilProjector)
+				return reg.UseNamespace("acme")
+			},
+			wantErr: "projector acme::$A collides with the projector $A registered without a namespace",
+		},
+		{
+			name: "projector without a namespace registered later",
+			setup: func(reg *Registry) error {
+				reg.RegisterNamespacedProjector("acme", "$A", nilProjector)
+				reg.UseNamespace("acme")
+				return reg.RegisterProjector("$A", nilProjector)
+			},
+			wantErr: "projector $A collides with acme::$A",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.setup(NewRegistry())
+			if err == nil {
+				t.Fatalf("expected error containing %q but got none", test.wantErr)
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %q, want it to contain %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestArity(t *testing.T) {
+	reg := NewRegistry()
+
+	if err := reg.RegisterProjector("foo", nilProjector); err != nil {
+		t.Fatalf("RegisterProjector('foo', nilProjector) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterProjector("bar", nilProjector); err != nil {
+		t.Fatalf("RegisterProjector('bar', nilProjector) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterArity("foo", 2); err != nil {
+		t.Fatalf("RegisterArity('foo', 2) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterArity("baz", 2); err == nil {
+		t.Errorf("RegisterArity('baz', 2) expected to error for unregistered projector but didn't")
+	}
+
+	tests := []struct {
+		name, pName string
+		want        int
+		wantOK      bool
+	}{
+		{
+			name:   "identity",
+			pName:  "",
+			want:   1,
+			wantOK: true,
+		},
+		{
+			name:   "registered arity",
+			pName:  "foo",
+			want:   2,
+			wantOK: true,
+		},
+		{
+			name:   "no registered arity",
+			pName:  "bar",
+			wantOK: false,
+		},
+		{
+			name:   "unregistered projector",
+			pName:  "baz",
+			wantOK: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := reg.Arity(test.pName)
+			if ok != test.wantOK || got != test.want {
+				t.Errorf("Arity(%q) => %d, %v, want %d, %v", test.pName, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestResultTypes(t *testing.T) {
+	reg := NewRegistry()
+
+	if err := reg.RegisterProjector("foo", nilProjector); err != nil {
+		t.Fatalf("RegisterProjector('foo', nilProjector) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterProjector("bar", nilProjector); err != nil {
+		t.Fatalf("RegisterProjector('bar', nilProjector) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterResultType("foo", "string"); err != nil {
+		t.Fatalf("RegisterResultType('foo', 'string') returned unexpected error %v", err)
+	}
+	if err := reg.RegisterResultType("baz", "string"); err == nil {
+		t.Errorf("RegisterResultType('baz', 'string') expected to error for unregistered projector but didn't")
+	}
+
+	want := map[string]string{"foo": "string"}
+	got := reg.ResultTypes()
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ResultTypes() returned diff (-want +got):\n%s", diff)
+	}
+
+	got["bar"] = "number"
+	if diff := cmp.Diff(want, reg.ResultTypes()); diff != "" {
+		t.Errorf("ResultTypes() returned diff after modifying a previous result (-want +got):\n%s", diff)
+	}
+}
+
+func TestListProjectors(t *testing.T) {
+	reg := NewRegistry()
+
+	if err := reg.RegisterProjector("foo", nilProjector); err != nil {
+		t.Fatalf("RegisterProjector('foo', nilProjector) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterProjector("bar", nilProjector); err != nil {
+		t.Fatalf("RegisterProjector('bar', nilProjector) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterDescription("foo", "Maps a foo.\nSee bar."); err != nil {
+		t.Fatalf("RegisterDescription('foo', ...) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterDescription("baz", "Unknown."); err == nil {
+		t.Errorf("RegisterDescription('baz', ...) expected to error for unregistered projector but didn't")
+	}
+
+	want := []ProjectorInfo{
+		{Name: ""},
+		{Name: "bar"},
+		{Name: "foo", Description: "Maps a foo.\nSee bar."},
+	}
+	if diff := cmp.Diff(want, reg.ListProjectors()); diff != "" {
+		t.Errorf("ListProjectors() returned diff (-want +got):\n%s", diff)
+	}
+}
+
 func TestCount(t *testing.T) {
 	reg := NewRegistry()
 
@@ -189,3 +465,141 @@ func TestCount(t *testing.T) {
 		})
 	}
 }
+
+// constProjector returns a projector that returns the given string.
+func constProjector(s string) Projector {
+	return func(arguments []jsonutil.JSONMetaNode, pctx *Context) (jsonutil.JSONToken, error) {
+		return jsonutil.JSONStr(s), nil
+	}
+}
+
+func TestReplaceProjector(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.RegisterProjector("foo", constProjector("old")); err != nil {
+		t.Fatalf("RegisterProjector(foo) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterArity("foo", 2); err != nil {
+		t.Fatalf("RegisterArity(foo, 2) returned unexpected error %v", err)
+	}
+
+	if err := reg.ReplaceProjector("foo", constProjector("new")); err != nil {
+		t.Fatalf("ReplaceProjector(foo) returned unexpected error %v", err)
+	}
+	proj, err := reg.FindProjector("foo")
+	if err != nil {
+		t.Fatalf("FindProjector(foo) returned unexpected error %v", err)
+	}
+	if got, _ := proj(nil, NewContext(reg)); got != jsonutil.JSONStr("new") {
+		t.Errorf("replaced projector foo returned %v, want new", got)
+	}
+	if arity, ok := reg.Arity("foo"); !ok || arity != 2 {
+		t.Errorf("Arity(foo) => %d, %t after ReplaceProjector, want 2, true", arity, ok)
+	}
+
+	if err := reg.ReplaceProjector("bar", nilProjector); err == nil {
+		t.Errorf("ReplaceProjector(bar) expected to error for unregistered projector but didn't")
+	}
+}
+
+func TestClone(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.RegisterNamespacedProjector("ns", "foo", constProjector("foo")); err != nil {
+		t.Fatalf("RegisterNamespacedProjector(ns, foo) returned unexpected error %v", err)
+	}
+	if err := reg.UseNamespace("ns"); err != nil {
+		t.Fatalf("UseNamespace(ns) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterArity("foo", 1); err != nil {
+		t.Fatalf("RegisterArity(foo, 1) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterDescription("foo", "Maps a foo."); err != nil {
+		t.Fatalf("RegisterDescription(foo) returned unexpected error %v", err)
+	}
+
+	clone := reg.Clone()
+	if diff := cmp.Diff(reg.ListProjectors(), clone.ListProjectors()); diff != "" {
+		t.Errorf("Clone().ListProjectors() returned diff (-want +got):\n%s", diff)
+	}
+	if arity, ok := clone.Arity("foo"); !ok || arity != 1 {
+		t.Errorf("Clone().Arity(foo) => %d, %t, want 1, true", arity, ok)
+	}
+
+	// Changes to either are not seen by the other.
+	if err := clone.RegisterNamespacedProjector("ns", "bar", nilProjector); err != nil {
+		t.Fatalf("Clone().RegisterNamespacedProjector(ns, bar) returned unexpected error %v", err)
+	}
+	if err := clone.ReplaceProjector("ns::foo", constProjector("cloned")); err != nil {
+		t.Fatalf("Clone().ReplaceProjector(ns::foo) returned unexpected error %v", err)
+	}
+	if err := reg.RegisterProjector("baz", nilProjector); err != nil {
+		t.Fatalf("RegisterProjector(baz) returned unexpected error %v", err)
+	}
+
+	if _, err := reg.FindProjector("bar"); err == nil {
+		t.Errorf("FindProjector(bar) found a projector registered in the clone")
+	}
+	if _, err := clone.FindProjector("baz"); err == nil {
+		t.Errorf("Clone().FindProjector(baz) found a projector registered in the original")
+	}
+	for _, test := range []struct {
+		reg  *Registry
+		want jsonutil.JSONToken
+	}{{reg, jsonutil.JSONStr("foo")}, {clone, jsonutil.JSONStr("cloned")}} {
+		proj, err := test.reg.FindProjector("foo")
+		if err != nil {
+			t.Fatalf("FindProjector(foo) returned unexpected error %v", err)
+		}
+		if got, _ := proj(nil, NewContext(test.reg)); got != test.want {
+			t.Errorf("projector foo returned %v, want %v", got, test.want)
+		}
+	}
+}
+
+func TestRegistry_Concurrent(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.RegisterProjector("shared", nilProjector); err != nil {
+		t.Fatalf("RegisterProjector(shared) returned unexpected error %v", err)
+	}
+
+	const goroutines = 16
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				name := fmt.Sprintf("p_%d_%d", g, i)
+				if err := reg.RegisterProjector(name, nilProjector); err != nil {
+					t.Errorf("RegisterProjector(%v) returned unexpected error %v", name, err)
+				}
+				if err := reg.RegisterArity(name, 1); err != nil {
+					t.Errorf("RegisterArity(%v) returned unexpected error %v", name, err)
+				}
+				if err := reg.SetRetryPolicy(name, RetryPolicy{MaxAttempts: 2}); err != nil {
+					t.Errorf("SetRetryPolicy(%v) returned unexpected error %v", name, err)
+				}
+
+				proj, err := reg.FindProjector("shared")
+				if err != nil {
+					t.Errorf("FindProjector(shared) returned unexpected error %v", err)
+					continue
+				}
+				if _, err := proj(nil, NewContext(reg)); err != nil {
+					t.Errorf("shared projector returned unexpected error %v", err)
+				}
+				if _, err := reg.FindProjector(name); err != nil {
+					t.Errorf("FindProjector(%v) returned unexpected error %v", name, err)
+				}
+				reg.Arity(name)
+				reg.Names()
+				reg.Count()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// The identity projector, the shared one and all registered ones.
+	if got, want := reg.Count(), 2+goroutines*50; got != want {
+		t.Errorf("Count() => %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/errors" /* copybara-comment: errors */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+const (
+	// DefaultRetryBackoffMultiplier is the factor the backoff grows by after each attempt if the
+	// policy does not specify one.
+	DefaultRetryBackoffMultiplier = 2
+)
+
+// RetryPolicy configures how failed calls to a projector are retried. It is meant for projectors
+// whose failures may be transient, like those calling remote services.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times the projector is called (including the first) before
+	// giving up. Values less than 2 disable retries, so errors are returned as they are.
+	MaxAttempts int
+
+	// InitialBackoff is how long to wait before the first retry. Every subsequent retry waits
+	// BackoffMultiplier times longer than the previous one, up to MaxBackoff (if it is set).
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+
+	// Retryable decides whether the given error is worth retrying. If unset, all errors are retried.
+	// Errors marked with errors.Permanent are never retried, regardless of this.
+	Retryable func(error) bool
+
+	// Sleep waits for the given duration before a retry. If unset, a timer is used instead, and the
+	// retries are given up (returning the error of the last attempt) once the Go context of the
+	// evaluation (see Context.GoContext) is done. This exists for tests.
+	Sleep func(time.Duration)
+}
+
+// RetryError is returned when a projector with a retry policy fails, and records how many times it
+// was called.
+type RetryError struct {
+	Projector string
+	Attempts  int
+	Err       error
+}
+
+func (e RetryError) Error() string {
+	return fmt.Sprintf("projector %s failed after %d attempt(s): %v", e.Projector, e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e RetryError) Unwrap() error {
+	return e.Err
+}
+
+// backoff returns how long to wait before the given retry (1 being the first retry).
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	mult := p.BackoffMultiplier
+	if mult <= 0 {
+		mult = DefaultRetryBackoffMultiplier
+	}
+
+	d := float64(p.InitialBackoff) * math.Pow(mult, float64(retry-1))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		return p.MaxBackoff
+	}
+	return time.Duration(d)
+}
+
+// wait waits for the given duration, returning false if the given context is done before that.
+func (p RetryPolicy) wait(ctx context.Context, d time.Duration) bool {
+	if p.Sleep != nil {
+		p.Sleep(d)
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// withRetries wraps the given projector so that failed calls are retried according to the policy.
+func (p RetryPolicy) withRetries(name string, proj Projector) Projector {
+	if p.MaxAttempts < 2 {
+		return proj
+	}
+
+	return func(args []jsonutil.JSONMetaNode, pctx *Context) (jsonutil.JSONToken, error) {
+		ctx := pctx.GoContext
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		var err error
+		attempt := 1
+		for ; ; attempt++ {
+			mark := pctx.Mark()
+			var res jsonutil.JSONToken
+			if res, err = proj(args, pctx); err == nil {
+				return res, nil
+			}
+
+			if attempt >= p.MaxAttempts || errors.IsPermanent(err) || (p.Retryable != nil && !p.Retryable(err)) {
+				break
+			}
+			if !p.wait(ctx, p.backoff(attempt)) {
+				break
+			}
+
+			// A failed call may not have cleaned up after itself (e.g. projectors defined in mappings
+			// leave their variable layer and frames behind). The last attempt's are left for the
+			// caller, as they record where it failed.
+			pctx.Unwind(mark)
+		}
+
+		return nil, RetryError{Projector: name, Attempts: attempt, Err: err}
+	}
+}
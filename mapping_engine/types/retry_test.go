@@ -0,0 +1,295 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/errors" /* copybara-comment: errors */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+var errTransient = fmt.Errorf("service unavailable")
+
+// flakyProjector fails with the given errors (in order), then succeeds. Like native projectors, it
+// pushes itself to the stack and does not pop itself if it fails.
+type flakyProjector struct {
+	errs  []error
+	calls int
+}
+
+func (f *flakyProjector) project(_ []jsonutil.JSONMetaNode, pctx *Context) (jsonutil.JSONToken, error) {
+	if err := pctx.PushProjectorToStack("Flaky"); err != nil {
+		return nil, err
+	}
+	f.calls++
+	if f.calls <= len(f.errs) {
+		return nil, f.errs[f.calls-1]
+	}
+	pctx.PopProjectorFromStack("Flaky")
+	return jsonutil.JSONStr("ok"), nil
+}
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       RetryPolicy
+		errs         []error
+		wantErr      bool
+		wantAttempts int
+		wantSleeps   []time.Duration
+	}{
+		{
+			name:         "succeeds first time",
+			policy:       RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second},
+			wantAttempts: 1,
+		},
+		{
+			name:         "succeeds after retries",
+			policy:       RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second},
+			errs:         []error{errTransient, errTransient},
+			wantAttempts: 3,
+			wantSleeps:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:         "gives up",
+			policy:       RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second},
+			errs:         []error{errTransient, errTransient, errTransient},
+			wantErr:      true,
+			wantAttempts: 3,
+			wantSleeps:   []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:         "custom multiplier and max backoff",
+			policy:       RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, BackoffMultiplier: 3, MaxBackoff: 5 * time.Second},
+			errs:         []error{errTransient, errTransient, errTransient},
+			wantAttempts: 4,
+			wantSleeps:   []time.Duration{time.Second, 3 * time.Second, 5 * time.Second},
+		},
+		{
+			name:         "permanent error",
+			policy:       RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second},
+			errs:         []error{errTransient, errors.Permanent(fmt.Errorf("not found"))},
+			wantErr:      true,
+			wantAttempts: 2,
+			wantSleeps:   []time.Duration{time.Second},
+		},
+		{
+			name:         "not found error",
+			policy:       RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second},
+			errs:         []error{errors.NotFoundError{Msg: "404"}},
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+		{
+			name: "not retryable",
+			policy: RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Second,
+				Retryable:      func(err error) bool { return err == errTransient },
+			},
+			errs:         []error{errTransient, fmt.Errorf("bad request")},
+			wantErr:      true,
+			wantAttempts: 2,
+			wantSleeps:   []time.Duration{time.Second},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var sleeps []time.Duration
+			test.policy.Sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+			f := &flakyProjector{errs: test.errs}
+			reg := NewRegistry()
+			if err := reg.RegisterProjector("Flaky", f.project); err != nil {
+				t.Fatalf("RegisterProjector returned unexpected error %v", err)
+			}
+			if err := reg.SetRetryPolicy("Flaky", test.policy); err != nil {
+				t.Fatalf("SetRetryPolicy returned unexpected error %v", err)
+			}
+
+			proj, err := reg.FindProjector("Flaky")
+			if err != nil {
+				t.Fatalf("FindProjector returned unexpected error %v", err)
+			}
+			pctx := NewContext(reg)
+			got, err := proj(nil, pctx)
+
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Flaky() returned error %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && got != jsonutil.JSONStr("ok") {
+				t.Errorf("Flaky() = %v, want ok", got)
+			}
+			if err != nil {
+				re, ok := err.(RetryError)
+				if !ok {
+					t.Fatalf("Flaky() returned error of type %T, want RetryError", err)
+				}
+				if re.Attempts != test.wantAttempts || re.Err != test.errs[test.wantAttempts-1] {
+					t.Errorf("Flaky() returned %v, want %d attempts and error %v", re, test.wantAttempts, test.errs[test.wantAttempts-1])
+				}
+				if !strings.Contains(err.Error(), fmt.Sprintf("%d attempt", test.wantAttempts)) {
+					t.Errorf("Flaky() returned error %q, want it to mention the number of attempts", err)
+				}
+			}
+			if f.calls != test.wantAttempts {
+				t.Errorf("Flaky() was called %d times, want %d", f.calls, test.wantAttempts)
+			}
+			if diff := cmp.Diff(test.wantSleeps, sleeps); diff != "" {
+				t.Errorf("Flaky() slept diff -want +got:\n%s", diff)
+			}
+			// Only the frame of the last failed attempt is left, for the caller to report where it failed.
+			wantFrames := 0
+			if test.wantErr {
+				wantFrames = 1
+			}
+			if got := len(pctx.projectorStack); got != wantFrames {
+				t.Errorf("Flaky() left %d frame(s) on the projector stack, want %d", got, wantFrames)
+			}
+		})
+	}
+}
+
+// scopedProjector is like flakyProjector, but also pushes a layer of variables in which it sets x,
+// like projectors defined in mappings. It does not pop the layer if it fails either.
+type scopedProjector struct {
+	flakyProjector
+}
+
+func (s *scopedProjector) project(args []jsonutil.JSONMetaNode, pctx *Context) (jsonutil.JSONToken, error) {
+	pctx.Variables.Push()
+	x := jsonutil.JSONToken(jsonutil.JSONStr("callee"))
+	if err := pctx.Variables.Set("x", &x); err != nil {
+		return nil, err
+	}
+	res, err := s.flakyProjector.project(args, pctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pctx.Variables.Pop(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func TestRetryPolicy_CallerVariables(t *testing.T) {
+	s := &scopedProjector{flakyProjector{errs: []error{errTransient, errTransient}}}
+	reg := NewRegistry()
+	if err := reg.RegisterProjector("Flaky", s.project); err != nil {
+		t.Fatalf("RegisterProjector returned unexpected error %v", err)
+	}
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, Sleep: func(time.Duration) {}}
+	if err := reg.SetRetryPolicy("Flaky", policy); err != nil {
+		t.Fatalf("SetRetryPolicy returned unexpected error %v", err)
+	}
+	proj, err := reg.FindProjector("Flaky")
+	if err != nil {
+		t.Fatalf("FindProjector returned unexpected error %v", err)
+	}
+
+	pctx := NewContext(reg)
+	pctx.Variables.Push()
+	x := jsonutil.JSONToken(jsonutil.JSONStr("caller"))
+	if err := pctx.Variables.Set("x", &x); err != nil {
+		t.Fatalf("Variables.Set returned unexpected error %v", err)
+	}
+	depth := pctx.Variables.(LayeredStackMap).Depth()
+
+	if _, err := proj(nil, pctx); err != nil {
+		t.Fatalf("Flaky() returned unexpected error %v", err)
+	}
+	if got := pctx.Variables.(LayeredStackMap).Depth(); got != depth {
+		t.Errorf("Flaky() left the variable stack at depth %d, want %d", got, depth)
+	}
+	got, err := pctx.Variables.Get("x")
+	if err != nil {
+		t.Fatalf("Variables.Get(x) returned unexpected error %v", err)
+	}
+	if *got != jsonutil.JSONStr("caller") {
+		t.Errorf("Variables.Get(x) after Flaky() = %v, want the caller's value", *got)
+	}
+}
+
+func TestRetryPolicy_NoRetries(t *testing.T) {
+	f := &flakyProjector{errs: []error{errTransient}}
+	reg := NewRegistry()
+	if err := reg.RegisterProjector("Flaky", f.project); err != nil {
+		t.Fatalf("RegisterProjector returned unexpected error %v", err)
+	}
+	if err := reg.SetRetryPolicy("Flaky", RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Second}); err != nil {
+		t.Fatalf("SetRetryPolicy returned unexpected error %v", err)
+	}
+	proj, err := reg.FindProjector("Flaky")
+	if err != nil {
+		t.Fatalf("FindProjector returned unexpected error %v", err)
+	}
+
+	if _, err := proj(nil, NewContext(reg)); err != errTransient {
+		t.Errorf("Flaky() returned error %v, want the error of the only attempt %v", err, errTransient)
+	}
+	if f.calls != 1 {
+		t.Errorf("Flaky() was called %d times, want 1", f.calls)
+	}
+}
+
+func TestRetryPolicy_Cancelled(t *testing.T) {
+	f := &flakyProjector{errs: []error{errTransient, errTransient}}
+	reg := NewRegistry()
+	if err := reg.RegisterProjector("Flaky", f.project); err != nil {
+		t.Fatalf("RegisterProjector returned unexpected error %v", err)
+	}
+	if err := reg.SetRetryPolicy("Flaky", RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}); err != nil {
+		t.Fatalf("SetRetryPolicy returned unexpected error %v", err)
+	}
+	proj, err := reg.FindProjector("Flaky")
+	if err != nil {
+		t.Fatalf("FindProjector returned unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pctx := NewContext(reg)
+	pctx.GoContext = ctx
+
+	start := time.Now()
+	_, err = proj(nil, pctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Flaky() returned after %v, want it to stop waiting once the context is done", elapsed)
+	}
+	re, ok := err.(RetryError)
+	if !ok {
+		t.Fatalf("Flaky() returned error %v, want a RetryError", err)
+	}
+	if re.Attempts != 1 || re.Err != errTransient {
+		t.Errorf("Flaky() returned %v, want 1 attempt and error %v", re, errTransient)
+	}
+	if f.calls != 1 {
+		t.Errorf("Flaky() was called %d times, want 1", f.calls)
+	}
+}
+
+func TestSetRetryPolicy_UnknownProjector(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.SetRetryPolicy("foo", RetryPolicy{MaxAttempts: 2}); err == nil {
+		t.Errorf("SetRetryPolicy(%q) expected error but got nil", "foo")
+	}
+}
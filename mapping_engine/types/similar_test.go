@@ -0,0 +1,64 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestSimilarNames(t *testing.T) {
+	names := []string{"$StrCat", "$StrJoin", "$StrSplit", "$ToUpper", "identifier", "identity"}
+
+	tests := []struct {
+		name string
+		max  int
+		want []string
+	}{
+		{
+			name: "$StrConcat",
+			max:  3,
+			want: []string{"$StrCat", "$StrJoin", "$StrSplit"},
+		},
+		{
+			name: "$StrConcat",
+			max:  1,
+			want: []string{"$StrCat"},
+		},
+		{
+			name: "$toupper",
+			max:  3,
+			want: []string{"$ToUpper"},
+		},
+		{
+			name: "identifer",
+			max:  3,
+			want: []string{"identifier", "identity"},
+		},
+		{
+			name: "$Hash",
+			max:  3,
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if diff := cmp.Diff(test.want, SimilarNames(test.name, names, test.max)); diff != "" {
+				t.Errorf("SimilarNames(%s, %v, %d) returned diff (-want +got):\n%s", test.name, names, test.max, diff)
+			}
+		})
+	}
+}
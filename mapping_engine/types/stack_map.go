@@ -78,6 +78,11 @@ func (s *StackMap) allowedOp() error {
 	return nil
 }
 
+// Depth returns the number of layers in the stack.
+func (s *StackMap) Depth() int {
+	return len(s.maps)
+}
+
 // Empty returns true if the StackMap contains no layers or its sole layer is empty.
 func (s *StackMap) Empty() bool {
 	return len(s.maps) == 0 || (len(s.maps) == 1 && len(s.maps[0]) == 0)
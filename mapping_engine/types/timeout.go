@@ -0,0 +1,77 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// TimeoutError is returned when a call to a projector with a timeout (see Registry.SetTimeout)
+// takes longer than the timeout.
+type TimeoutError struct {
+	Projector string
+	Timeout   time.Duration
+	Elapsed   time.Duration
+	// Err is the error the projector returned (typically because its context was cancelled), if any.
+	Err error
+}
+
+func (e TimeoutError) Error() string {
+	msg := fmt.Sprintf("projector %s timed out after %v (timeout %v)", e.Projector, e.Elapsed.Round(time.Millisecond), e.Timeout)
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
+	}
+	return msg
+}
+
+// Unwrap returns the error the projector returned, or context.DeadlineExceeded if it returned none.
+func (e TimeoutError) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
+	}
+	return context.DeadlineExceeded
+}
+
+// withTimeout wraps the given projector so that it is called with a Go context (see
+// Context.GoContext) that is cancelled after the given timeout, and fails with a TimeoutError if the
+// call takes longer than that. The projector is not interrupted: it has to give up by itself once
+// its context is cancelled (as I/O done with the context does).
+func withTimeout(name string, timeout time.Duration, proj Projector) Projector {
+	return func(args []jsonutil.JSONMetaNode, pctx *Context) (jsonutil.JSONToken, error) {
+		orig := pctx.GoContext
+		parent := orig
+		if parent == nil {
+			parent = context.Background()
+		}
+		ctx, cancel := context.WithTimeout(parent, timeout)
+		defer cancel()
+
+		pctx.GoContext = ctx
+		start := time.Now()
+		res, err := proj(args, pctx)
+		elapsed := time.Since(start)
+		pctx.GoContext = orig
+
+		// If the parent context is done too, it (and not this timeout) is what stopped the call.
+		if ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+			return nil, TimeoutError{Projector: name, Timeout: timeout, Elapsed: elapsed, Err: err}
+		}
+		return res, err
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"context"
+	stderrors "errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+)
+
+// slowProjector waits for the given delay, giving up if its Go context is cancelled first, like
+// projectors doing I/O.
+func slowProjector(delay time.Duration) Projector {
+	return func(_ []jsonutil.JSONMetaNode, pctx *Context) (jsonutil.JSONToken, error) {
+		select {
+		case <-time.After(delay):
+			return jsonutil.JSONStr("ok"), nil
+		case <-pctx.GoContext.Done():
+			return nil, pctx.GoContext.Err()
+		}
+	}
+}
+
+// stubbornProjector sleeps for the given delay, ignoring its Go context.
+func stubbornProjector(delay time.Duration) Projector {
+	return func(_ []jsonutil.JSONMetaNode, _ *Context) (jsonutil.JSONToken, error) {
+		time.Sleep(delay)
+		return jsonutil.JSONStr("ok"), nil
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		proj        Projector
+		timeout     time.Duration
+		wantErr     bool
+		wantErrWrap bool
+	}{
+		{
+			name:    "fast projector",
+			proj:    slowProjector(0),
+			timeout: time.Minute,
+		},
+		{
+			name:        "slow projector",
+			proj:        slowProjector(time.Minute),
+			timeout:     10 * time.Millisecond,
+			wantErr:     true,
+			wantErrWrap: true,
+		},
+		{
+			name:    "projector ignoring its context",
+			proj:    stubbornProjector(50 * time.Millisecond),
+			timeout: 10 * time.Millisecond,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reg := NewRegistry()
+			if err := reg.RegisterProjector("Slow", test.proj); err != nil {
+				t.Fatalf("RegisterProjector returned unexpected error %v", err)
+			}
+			if err := reg.SetTimeout("Slow", test.timeout); err != nil {
+				t.Fatalf("SetTimeout returned unexpected error %v", err)
+			}
+
+			proj, err := reg.FindProjector("Slow")
+			if err != nil {
+				t.Fatalf("FindProjector returned unexpected error %v", err)
+			}
+			pctx := NewContext(reg)
+			got, err := proj(nil, pctx)
+
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Slow() returned error %v, want error %v", err, test.wantErr)
+			}
+			if pctx.GoContext != context.Background() {
+				t.Errorf("Slow() left Go context %v, want it restored", pctx.GoContext)
+			}
+			if err == nil {
+				if got != jsonutil.JSONStr("ok") {
+					t.Errorf("Slow() = %v, want ok", got)
+				}
+				return
+			}
+			te, ok := err.(TimeoutError)
+			if !ok {
+				t.Fatalf("Slow() returned error of type %T, want TimeoutError", err)
+			}
+			if te.Projector != "Slow" || te.Timeout != test.timeout || te.Elapsed < test.timeout {
+				t.Errorf("Slow() returned %#v, want projector Slow, timeout %v and elapsed time of at least the timeout", te, test.timeout)
+			}
+			if !strings.Contains(err.Error(), "projector Slow timed out") {
+				t.Errorf("Slow() returned error %q, want it to name the projector", err)
+			}
+			if !stderrors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Slow() returned error %v, want it to wrap context.DeadlineExceeded", err)
+			}
+			if gotWrap := te.Err != nil; gotWrap != test.wantErrWrap {
+				t.Errorf("Slow() returned error wrapping %v, want wrapped error %v", te.Err, test.wantErrWrap)
+			}
+		})
+	}
+}
+
+func TestTimeout_CancelledParent(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.RegisterProjector("Slow", slowProjector(time.Minute)); err != nil {
+		t.Fatalf("RegisterProjector returned unexpected error %v", err)
+	}
+	if err := reg.SetTimeout("Slow", 10*time.Millisecond); err != nil {
+		t.Fatalf("SetTimeout returned unexpected error %v", err)
+	}
+	proj, err := reg.FindProjector("Slow")
+	if err != nil {
+		t.Fatalf("FindProjector returned unexpected error %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pctx := NewContext(reg)
+	pctx.GoContext = ctx
+	_, err = proj(nil, pctx)
+
+	if err != context.Canceled {
+		t.Errorf("Slow() with a cancelled context returned error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestTimeout_NilGoContext(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.RegisterProjector("Slow", slowProjector(time.Minute)); err != nil {
+		t.Fatalf("RegisterProjector returned unexpected error %v", err)
+	}
+	if err := reg.SetTimeout("Slow", 10*time.Millisecond); err != nil {
+		t.Fatalf("SetTimeout returned unexpected error %v", err)
+	}
+	proj, err := reg.FindProjector("Slow")
+	if err != nil {
+		t.Fatalf("FindProjector returned unexpected error %v", err)
+	}
+
+	pctx := &Context{Variables: NewStackMap(), Registry: reg}
+	if _, err := proj(nil, pctx); err == nil {
+		t.Errorf("Slow() expected TimeoutError but got nil")
+	}
+	if pctx.GoContext != nil {
+		t.Errorf("Slow() left Go context %v, want nil", pctx.GoContext)
+	}
+}
+
+func TestTimeout_AppliesToEachAttempt(t *testing.T) {
+	calls := 0
+	proj := func(args []jsonutil.JSONMetaNode, pctx *Context) (jsonutil.JSONToken, error) {
+		calls++
+		if calls == 1 {
+			return slowProjector(time.Minute)(args, pctx)
+		}
+		return slowProjector(0)(args, pctx)
+	}
+
+	reg := NewRegistry()
+	if err := reg.RegisterProjector("Slow", proj); err != nil {
+		t.Fatalf("RegisterProjector returned unexpected error %v", err)
+	}
+	if err := reg.SetTimeout("Slow", 10*time.Millisecond); err != nil {
+		t.Fatalf("SetTimeout returned unexpected error %v", err)
+	}
+	policy := RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second, Sleep: func(time.Duration) {}}
+	if err := reg.SetRetryPolicy("Slow", policy); err != nil {
+		t.Fatalf("SetRetryPolicy returned unexpected error %v", err)
+	}
+
+	found, err := reg.FindProjector("Slow")
+	if err != nil {
+		t.Fatalf("FindProjector returned unexpected error %v", err)
+	}
+	got, err := found(nil, NewContext(reg))
+	if err != nil {
+		t.Fatalf("Slow() returned unexpected error %v", err)
+	}
+	if got != jsonutil.JSONStr("ok") || calls != 2 {
+		t.Errorf("Slow() = %v after %d calls, want ok after 2 calls", got, calls)
+	}
+}
+
+func TestSetTimeout_Errors(t *testing.T) {
+	reg := NewRegistry()
+	if err := reg.SetTimeout("foo", time.Second); err == nil {
+		t.Errorf("SetTimeout(%q) expected error but got nil", "foo")
+	}
+	if err := reg.RegisterProjector("foo", slowProjector(0)); err != nil {
+		t.Fatalf("RegisterProjector returned unexpected error %v", err)
+	}
+	if err := reg.SetTimeout("foo", 0); err == nil {
+		t.Errorf("SetTimeout(%q, 0) expected error but got nil", "foo")
+	}
+}
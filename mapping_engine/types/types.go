@@ -16,7 +16,9 @@
 package types
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"sort"
 	"strings"
 
@@ -41,22 +43,112 @@ type StackMapInterface interface {
 	Empty() bool
 }
 
+// LayeredStackMap is implemented by StackMapInterfaces that can tell how many layers they have, like
+// StackMap. Failed projectors can only be rolled back (see Context.Unwind), and failed variables
+// only be told apart by layer (see Context.MarkVarFailed), if the Variables of a Context implement
+// it.
+type LayeredStackMap interface {
+	StackMapInterface
+	Depth() int
+}
+
 // A Context stores data about variables and ancestors for a projector invocation.
 type Context struct {
 	Variables StackMapInterface
 
+	// GoContext is the Go context of this evaluation, which projectors doing I/O (like lookups in
+	// remote services) should use, so that they can be cancelled, e.g. by a timeout (see
+	// Registry.SetTimeout). NewContext sets it to context.Background().
+	GoContext context.Context
+
 	Output *jsonutil.JSONToken
 
 	TopLevelObjects map[string][]jsonutil.JSONToken
 	Registry        *Registry
 
+	// Params are the engine parameters for this transformation (see $Param). They are set up
+	// before evaluation starts and must not be modified afterwards.
+	Params map[string]jsonutil.JSONToken
+
+	// RecordContext is the context data of the record being transformed (see $Context), e.g. the
+	// facility it comes from, which unlike Params varies from record to record. Like Params, it is
+	// set up before evaluation starts and must not be modified afterwards.
+	RecordContext jsonutil.JSONContainer
+
+	// StrictSourcePaths makes reading a field that does not exist on a projector argument object
+	// an error, to catch typos in source paths. It is turned off while evaluating conditions and
+	// the arguments of existence checks like $IsNil.
+	StrictSourcePaths bool
+
+	// LenientAppend makes appending (e.g. a[]) to a field that has a primitive value wrap the value
+	// into an array that the result is appended to, instead of failing.
+	LenientAppend bool
+
+	// IDResolver, if set, assigns the ids returned by the $ResolveID builtin, e.g. from an external
+	// master patient index.
+	IDResolver IDResolver
+
+	// Random, if set, is the source of randomness of builtins like $UUID in this evaluation, e.g. a
+	// seeded one for reproducible outputs. It is not safe for concurrent use.
+	Random io.Reader
+
+	// MappingStats, if set, is told the outcome of every field mapping evaluation, e.g. to report how
+	// often fields end up empty. It is nil unless such stats are enabled.
+	MappingStats MappingStatsRecorder
+
+	// OutputBudget, if set, limits how much the mappings of this evaluation may write.
+	OutputBudget *OutputBudget
+
+	// RequiredTarget is the target of the required mapping whose source is about to be evaluated, if
+	// any. It is consumed (reset) by the evaluation of that source, which then fails instead of
+	// dropping empty elements if it is iterated.
+	RequiredTarget string
+
+	// Lineage, if set, records where the values written by this evaluation come from. It is nil
+	// unless lineage is requested.
+	Lineage *Lineage
+
+	// globals are the values of the globals assigned so far in this evaluation (see SetGlobal).
+	globals map[string]jsonutil.JSONToken
+
+	// failedVars are the variables whose mappings failed in a partial evaluation (see MarkVarFailed),
+	// with the depth of the variable stack they would have been assigned at.
+	failedVars map[string]int
+
+	// failedGlobals are the globals whose mappings failed in a partial evaluation (see
+	// MarkGlobalFailed).
+	failedGlobals map[string]bool
+
+	// counters are the current values of the counters of this evaluation (see NextCounter).
+	counters map[string]int
+
+	// memo are the results memoized in this evaluation, e.g. of calls to pure projectors (see
+	// Memoize).
+	memo map[string]jsonutil.JSONToken
+
+	// keyedElements are the indices of the elements appended by keyed appends (see KeyedElement) to
+	// the arrays of the outputs being written in this evaluation, by key.
+	keyedElements map[keyedArray]map[string]int
+
+	// keyedLog are the keys recorded in keyedElements, in order, so that the ones recorded by failed
+	// mappings can be forgotten (see Unwind).
+	keyedLog []keyedKey
+
 	// The depth of the projector stack
 	stackDepth int
 
 	// The number of times a projector is present in the current stack (useful for debugging).
 	stackProjectorCounts map[string]int
 
-	projectorStack []string
+	projectorStack []stackFrame
+}
+
+// stackFrame is a frame of the projector stack of a Context: a projector being evaluated, or an
+// element of an iteration (see PushIterationFrame).
+type stackFrame struct {
+	// name is the name of the projector, or of the element (e.g. obx[137]).
+	name      string
+	iteration bool
 }
 
 func (c *Context) String() string {
@@ -73,6 +165,33 @@ func (c *Context) String() string {
 	return fmt.Sprintf("{\n\t\tTop Level Objects: %s\n\t\tVariables: %s\n\t}", tlos, vars)
 }
 
+// SetGlobal assigns the global with the given name. Globals are scoped to the evaluation (i.e. the
+// input record), and can only be assigned once.
+func (c *Context) SetGlobal(name string, value jsonutil.JSONToken) error {
+	if _, ok := c.globals[name]; ok {
+		return fmt.Errorf("global %s is already assigned, globals can only be assigned once per record", name)
+	}
+	if c.globals == nil {
+		c.globals = make(map[string]jsonutil.JSONToken)
+	}
+	c.globals[name] = value
+	return nil
+}
+
+// Global returns the value of the global with the given name, or an error if it has not been
+// assigned yet. Root mappings assign globals in order, so a global can only be read by the root
+// mappings after the one assigning it, and by the projectors they call.
+func (c *Context) Global(name string) (jsonutil.JSONToken, error) {
+	v, ok := c.globals[name]
+	if !ok && c.failedGlobals[name] {
+		return nil, fmt.Errorf("global %s is not assigned because the root mapping assigning it failed", name)
+	}
+	if !ok {
+		return nil, fmt.Errorf("global %s is read before it is assigned; globals can only be read after the root mapping assigning them", name)
+	}
+	return v, nil
+}
+
 // PushProjectorToStack adds one count of the given projector name to the stack trace.
 func (c *Context) PushProjectorToStack(name string) error {
 	c.stackDepth++
@@ -82,7 +201,7 @@ func (c *Context) PushProjectorToStack(name string) error {
 		return c.generateStackOverflowError()
 	}
 
-	c.projectorStack = append(c.projectorStack, name)
+	c.projectorStack = append(c.projectorStack, stackFrame{name: name})
 
 	return nil
 }
@@ -94,44 +213,243 @@ func (c *Context) PopProjectorFromStack(name string) {
 	c.projectorStack = c.projectorStack[:len(c.projectorStack)-1]
 }
 
+// PushIterationFrame adds the element with the given index of an iteration over the array with the
+// given name (e.g. obx for Build(obx[])) to the stack trace, so that errors in the projectors called
+// with it show which element they failed on, e.g. Output_Observations > obx[137] > BuildComponent.
+// Like projectors, an element whose evaluation fails is not removed from the stack.
+func (c *Context) PushIterationFrame(array string, index int) {
+	c.projectorStack = append(c.projectorStack, stackFrame{name: fmt.Sprintf("%s[%d]", array, index), iteration: true})
+}
+
+// PopIterationFrame removes the element added last with PushIterationFrame from the stack trace.
+func (c *Context) PopIterationFrame() {
+	c.projectorStack = c.projectorStack[:len(c.projectorStack)-1]
+}
+
+// popFrame removes the latest frame (a projector or an iteration element) from the stack trace.
+func (c *Context) popFrame() {
+	if f := c.projectorStack[len(c.projectorStack)-1]; !f.iteration {
+		c.PopProjectorFromStack(f.name)
+		return
+	}
+	c.PopIterationFrame()
+}
+
+// MarkVarFailed records that the variable with the given name (in the current layer of the variable
+// stack) was not assigned because its mapping failed, in an evaluation that goes on after failed
+// mappings. Reading it then fails too, instead of reading null as if it were never assigned.
+func (c *Context) MarkVarFailed(name string) {
+	if c.failedVars == nil {
+		c.failedVars = make(map[string]int)
+	}
+	c.failedVars[name] = c.variablesDepth()
+}
+
+// VarFailed returns true iff the variable with the given name in the current layer of the variable
+// stack was marked with MarkVarFailed.
+func (c *Context) VarFailed(name string) bool {
+	depth, ok := c.failedVars[name]
+	return ok && depth == c.variablesDepth()
+}
+
+// variablesDepth returns the number of layers of the variable stack, or -1 if it can not tell (see
+// LayeredStackMap).
+func (c *Context) variablesDepth() int {
+	if l, ok := c.Variables.(LayeredStackMap); ok {
+		return l.Depth()
+	}
+	return -1
+}
+
+// MarkGlobalFailed records that the global with the given name was not assigned because its mapping
+// failed, like MarkVarFailed.
+func (c *Context) MarkGlobalFailed(name string) {
+	if c.failedGlobals == nil {
+		c.failedGlobals = make(map[string]bool)
+	}
+	c.failedGlobals[name] = true
+}
+
+// StackMark is the depth of the variable and projector stacks of a Context at some point, see Mark.
+type StackMark struct {
+	variables  int
+	projectors int
+	lineage    int
+	keys       int
+}
+
+// Mark returns the current depth of the variable and projector stacks, so that they can be unwound
+// back to it with Unwind.
+func (c *Context) Mark() StackMark {
+	m := StackMark{variables: c.variablesDepth(), projectors: len(c.projectorStack), keys: len(c.keyedLog)}
+	if c.Lineage != nil {
+		m.lineage = c.Lineage.depth()
+	}
+	return m
+}
+
+// Unwind removes the variable layers and projectors pushed to the stacks since the given mark, e.g.
+// by projectors that failed, so that evaluation can go on as if they had not been called. The keys
+// of keyed appends recorded since then are forgotten too, as the elements they were recorded for
+// may never have been written.
+func (c *Context) Unwind(m StackMark) {
+	if m.variables >= 0 {
+		for c.variablesDepth() > m.variables {
+			c.Variables.Pop()
+		}
+	}
+	for len(c.projectorStack) > m.projectors {
+		c.popFrame()
+	}
+	if c.Lineage != nil {
+		c.Lineage.unwind(m.lineage)
+	}
+	for len(c.keyedLog) > m.keys {
+		k := c.keyedLog[len(c.keyedLog)-1]
+		delete(c.keyedElements[k.array], k.key)
+		c.keyedLog = c.keyedLog[:len(c.keyedLog)-1]
+	}
+}
+
+// NextCounter increments the counter with the given name and returns its new value, so it returns 1
+// the first time it is called with a name. Counters are per context, so they start over for every
+// evaluation.
+func (c *Context) NextCounter(name string) int {
+	if c.counters == nil {
+		c.counters = map[string]int{}
+	}
+	c.counters[name]++
+	return c.counters[name]
+}
+
+// Memoize records the given result under the given key (e.g. identifying a call to a pure
+// projector) for the rest of the evaluation, i.e. of the input record.
+func (c *Context) Memoize(key string, result jsonutil.JSONToken) {
+	if c.memo == nil {
+		c.memo = make(map[string]jsonutil.JSONToken)
+	}
+	c.memo[key] = result
+}
+
+// Memoized returns the result recorded under the given key with Memoize, if any.
+func (c *Context) Memoized(key string) (jsonutil.JSONToken, bool) {
+	res, ok := c.memo[key]
+	return res, ok
+}
+
+// keyedArray identifies an array written with keyed appends: the one at the given path of the
+// given output.
+type keyedArray struct {
+	output *jsonutil.JSONToken
+	path   string
+}
+
+// keyedKey identifies a key recorded for an array written with keyed appends.
+type keyedKey struct {
+	array keyedArray
+	key   string
+}
+
+// KeyedElement returns the index of the element of the array at the given path of the given output
+// (e.g. of a projector, or the root output) that was appended by a keyed append with the given key,
+// if any.
+func (c *Context) KeyedElement(output *jsonutil.JSONToken, path, key string) (int, bool) {
+	i, ok := c.keyedElements[keyedArray{output: output, path: path}][key]
+	return i, ok
+}
+
+// RecordKeyedElement records the index of the element appended by a keyed append with the given key
+// to the array at the given path of the given output, until the output is done with (see
+// ForgetKeyedElements).
+func (c *Context) RecordKeyedElement(output *jsonutil.JSONToken, path, key string, index int) {
+	k := keyedArray{output: output, path: path}
+	if c.keyedElements == nil {
+		c.keyedElements = make(map[keyedArray]map[string]int)
+	}
+	elements, ok := c.keyedElements[k]
+	if !ok {
+		elements = make(map[string]int)
+		c.keyedElements[k] = elements
+	}
+	elements[key] = index
+	c.keyedLog = append(c.keyedLog, keyedKey{array: k, key: key})
+}
+
+// ForgetKeyedElements forgets the keyed elements of the arrays of the given output, once all its
+// mappings are processed, so that another output that reuses its memory starts afresh.
+func (c *Context) ForgetKeyedElements(output *jsonutil.JSONToken) {
+	for k := range c.keyedElements {
+		if k.output == output {
+			delete(c.keyedElements, k)
+		}
+	}
+}
+
 // Projector returns the latest projector in the stack.
 func (c *Context) Projector() string {
-	if len(c.projectorStack) == 0 {
-		return ""
+	for i := len(c.projectorStack) - 1; i >= 0; i-- {
+		if !c.projectorStack[i].iteration {
+			return c.projectorStack[i].name
+		}
 	}
-	return c.projectorStack[len(c.projectorStack)-1]
+	return ""
 }
 
-func (c *Context) generateStackOverflowError() error {
-	type stackCount struct {
-		projector string
-		count     int
+// ProjectorStack returns the names of the projectors in the stack, outermost first, along with the
+// elements of the iterations they were called for (see PushIterationFrame), e.g.
+// [Output_Observations obx[137] BuildComponent $ParseFloat]. A projector that fails does not remove
+// itself from the stack, so after a failed evaluation this is the stack at the point of failure.
+func (c *Context) ProjectorStack() []string {
+	names := make([]string, 0, len(c.projectorStack))
+	for _, f := range c.projectorStack {
+		names = append(names, f.name)
 	}
+	return names
+}
 
-	var stackCounts []stackCount
-
+func (c *Context) generateStackOverflowError() error {
+	var counts []ProjectorCount
 	for p, sc := range c.stackProjectorCounts {
-		stackCounts = append(stackCounts, stackCount{p, sc})
+		counts = append(counts, ProjectorCount{Projector: p, Count: sc})
 	}
 
-	sort.SliceStable(stackCounts, func(i, j int) bool {
+	sort.SliceStable(counts, func(i, j int) bool {
 		// Sort descending
-		return !(stackCounts[i].count < stackCounts[j].count)
+		return !(counts[i].Count < counts[j].Count)
 	})
 
+	return StackOverflowError{MaxDepth: MaxStackDepth, Counts: counts}
+}
+
+// ProjectorCount is how many times a projector appeared in the stack.
+type ProjectorCount struct {
+	Projector string
+	Count     int
+}
+
+// StackOverflowError is returned when projectors are nested more than MaxStackDepth deep, which is
+// almost always unbounded recursion.
+type StackOverflowError struct {
+	MaxDepth int
+	// Counts are the projectors that were on the stack, most frequently recurring first.
+	Counts []ProjectorCount
+}
+
+func (e StackOverflowError) Error() string {
 	sb := strings.Builder{}
-	for _, sc := range stackCounts {
-		sb.WriteString(fmt.Sprintf("%s: %d\n", sc.projector, sc.count))
+	for _, sc := range e.Counts {
+		sb.WriteString(fmt.Sprintf("%s: %d\n", sc.Projector, sc.Count))
 	}
 
-	return fmt.Errorf("stack depth exceeded %d: too many recursive projector calls. Most frequently recurring projectors and how many times they appeared in the stack:\n%s", MaxStackDepth, sb.String())
+	return fmt.Sprintf("stack depth exceeded %d: too many recursive projector calls. Most frequently recurring projectors and how many times they appeared in the stack:\n%s", e.MaxDepth, sb.String())
 }
 
 // NewContext creates a new context with empty components initialized and ready to go.
 func NewContext(registry *Registry) *Context {
 	return &Context{
-		TopLevelObjects: map[string][]jsonutil.JSONToken{},
-		Output:          new(jsonutil.JSONToken),
+		TopLevelObjects:      map[string][]jsonutil.JSONToken{},
+		Output:               new(jsonutil.JSONToken),
+		GoContext:            context.Background(),
 		Variables:            NewStackMap(),
 		Registry:             registry,
 		stackProjectorCounts: map[string]int{},
@@ -148,5 +466,15 @@ func prettyPrintArrayMap(mp map[string][]jsonutil.JSONToken) string {
 	return sb.String()
 }
 
+// MappingStatsRecorder records the outcomes of field mapping evaluations. Implementations must be
+// safe for concurrent use.
+type MappingStatsRecorder interface {
+	// RecordMapping records an evaluation of the index-th (starting at 0) mapping of the given
+	// projector (or of the root mappings), which writes to the given target. Empty is true iff the
+	// source of the mapping was null or empty, so nothing was written (variables are still defined).
+	// Mappings whose condition was false, or that failed, are not recorded.
+	RecordMapping(projector string, index int, target string, empty bool)
+}
+
 // Projector is a type alias for the function signature of a projector.
 type Projector func(arguments []jsonutil.JSONMetaNode, pctx *Context) (jsonutil.JSONToken, error)
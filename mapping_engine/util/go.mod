@@ -5,4 +5,5 @@ go 1.14
 require (
         cloud.google.com/go/storage v1.6.0
         github.com/google/go-cmp v0.4.0
+        gopkg.in/yaml.v3 v3.0.1
 )
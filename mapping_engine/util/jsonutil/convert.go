@@ -0,0 +1,770 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonutil
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxConvertDepth limits how deeply values are nested, to protect against cyclic values.
+const maxConvertDepth = 1000
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// FromInterface converts the given Go value into a JSONToken without serializing it, producing the
+// same token as marshaling it with encoding/json and parsing the result with UnmarshalJSON. Struct
+// fields are converted following their json tags (including omitempty, string and "-") and the
+// fields of embedded structs are promoted. Types implementing json.Marshaler or
+// encoding.TextMarshaler are converted through their marshalers. All numbers become JSONNums, so
+// integers beyond 2^53 are rounded just like when parsing them from JSON.
+func FromInterface(v interface{}) (JSONToken, error) {
+	return fromValue(reflect.ValueOf(v), 0)
+}
+
+// ToInterface populates the value pointed to by out from the given token without serializing it,
+// like parsing the token's JSON with encoding/json would. Fields are matched following their json
+// tags, preferring exact matches over case-insensitive ones, and unknown fields are ignored. Nil
+// pointers (including embedded ones) are allocated as needed, and null sets pointers, maps, slices
+// and interfaces to nil. Numbers are only converted into integer types if they are integral and
+// fit the type. Types implementing json.Unmarshaler or encoding.TextUnmarshaler are populated
+// through their unmarshalers.
+func ToInterface(tok JSONToken, out interface{}) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("ToInterface requires a non-nil pointer, but got %T", out)
+	}
+	return toValue(tok, rv.Elem(), 0)
+}
+
+// convertError is an error converting a nested value. It records the path to the value.
+type convertError struct {
+	// segs are the path segments to the value, innermost first.
+	segs []string
+	err  error
+}
+
+func (e *convertError) Error() string {
+	segs := make([]string, len(e.segs))
+	for i, s := range e.segs {
+		segs[len(segs)-1-i] = s
+	}
+	return fmt.Sprintf("%s: %v", JoinPath(segs...), e.err)
+}
+
+// atSegment adds the given path segment to the path of the given error.
+func atSegment(err error, seg string) error {
+	if ce, ok := err.(*convertError); ok {
+		ce.segs = append(ce.segs, seg)
+		return ce
+	}
+	return &convertError{segs: []string{seg}, err: err}
+}
+
+func indexSegment(i int) string {
+	return "[" + strconv.Itoa(i) + "]"
+}
+
+func fromValue(v reflect.Value, depth int) (JSONToken, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if depth > maxConvertDepth {
+		return nil, fmt.Errorf("value is nested more than %d levels deep (it may be cyclic)", maxConvertDepth)
+	}
+
+	if m, ok := marshaler(v); ok {
+		if m == nil {
+			return nil, nil
+		}
+		return fromMarshaler(m)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return JSONBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return JSONNum(v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return JSONNum(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("number %v can not be represented in JSON", f)
+		}
+		if v.Kind() == reflect.Float32 {
+			// Use the shortest decimal representation of the float32, as encoding/json writes it.
+			f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'g', -1, 32), 64)
+		}
+		return JSONNum(f), nil
+	case reflect.String:
+		return JSONStr(v.String()), nil
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return fromValue(v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if isByteSlice(v.Type()) {
+			return JSONStr(base64.StdEncoding.EncodeToString(v.Bytes())), nil
+		}
+		return fromArray(v, depth)
+	case reflect.Array:
+		return fromArray(v, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return fromMap(v, depth)
+	case reflect.Struct:
+		return fromStruct(v, depth)
+	default:
+		return nil, fmt.Errorf("unsupported Go type %v", v.Type())
+	}
+}
+
+// marshaler returns the json.Marshaler or encoding.TextMarshaler of the given value, if its type
+// (or a pointer to it, if it is addressable) implements one. The returned marshaler is nil if the
+// value is a nil pointer or interface.
+func marshaler(v reflect.Value) (interface{}, bool) {
+	t := v.Type()
+	if v.Kind() != reflect.Ptr && v.CanAddr() && (reflect.PtrTo(t).Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)) {
+		v = v.Addr()
+	} else if !t.Implements(jsonMarshalerType) && !t.Implements(textMarshalerType) {
+		return nil, false
+	}
+	if !v.CanInterface() {
+		return nil, false
+	}
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, true
+	}
+	return v.Interface(), true
+}
+
+func fromMarshaler(m interface{}) (JSONToken, error) {
+	if tm, ok := m.(encoding.TextMarshaler); ok {
+		if _, ok := m.(json.Marshaler); !ok {
+			text, err := tm.MarshalText()
+			if err != nil {
+				return nil, err
+			}
+			return JSONStr(text), nil
+		}
+	}
+	b, err := m.(json.Marshaler).MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var u interface{}
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, fmt.Errorf("%T returned invalid JSON: %v", m, err)
+	}
+	return unmarshaledToJSONToken(u)
+}
+
+func fromArray(v reflect.Value, depth int) (JSONToken, error) {
+	arr := make(JSONArr, v.Len())
+	for i := range arr {
+		t, err := fromValue(v.Index(i), depth+1)
+		if err != nil {
+			return nil, atSegment(err, indexSegment(i))
+		}
+		arr[i] = t
+	}
+	return arr, nil
+}
+
+func fromMap(v reflect.Value, depth int) (JSONToken, error) {
+	c := make(JSONContainer, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		k, err := mapKey(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		t, err := fromValue(iter.Value(), depth+1)
+		if err != nil {
+			return nil, atSegment(err, k)
+		}
+		c[k] = &t
+	}
+	return c, nil
+}
+
+// mapKey returns the given map key as a string, following encoding/json.
+func mapKey(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if k.Type().Implements(textMarshalerType) && k.CanInterface() {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		text, err := k.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type %v", k.Type())
+}
+
+func fromStruct(v reflect.Value, depth int) (JSONToken, error) {
+	fields := structFields(v.Type())
+	c := make(JSONContainer, len(fields))
+	for _, f := range fields {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok || f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		var t JSONToken
+		var err error
+		if f.quoted {
+			t, err = fromQuoted(fv)
+		} else {
+			t, err = fromValue(fv, depth+1)
+		}
+		if err != nil {
+			return nil, atSegment(err, f.name)
+		}
+		c[f.name] = &t
+	}
+	return c, nil
+}
+
+// fromQuoted converts the given primitive value of a field tagged with the string option, whose
+// JSON is written into a string.
+func fromQuoted(v reflect.Value) (JSONToken, error) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return nil, err
+	}
+	return JSONStr(b), nil
+}
+
+// fieldByIndex returns the field with the given index sequence. It returns false if the field is
+// in an embedded struct that is a nil pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func isByteSlice(t reflect.Type) bool {
+	if t.Elem().Kind() != reflect.Uint8 {
+		return false
+	}
+	p := reflect.PtrTo(t.Elem())
+	return !p.Implements(jsonMarshalerType) && !p.Implements(textMarshalerType)
+}
+
+func toValue(tok JSONToken, v reflect.Value, depth int) error {
+	if depth > maxConvertDepth {
+		return fmt.Errorf("value is nested more than %d levels deep", maxConvertDepth)
+	}
+
+	if tok == nil {
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+
+	// Tokens are copied as they are into fields of their own type (or of an interface they
+	// implement, other than interface{}).
+	if tt := reflect.TypeOf(tok); tt.AssignableTo(v.Type()) && (v.Kind() != reflect.Interface || v.NumMethod() > 0) {
+		v.Set(reflect.ValueOf(Deepcopy(tok)))
+		return nil
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		if ok, err := toUnmarshaler(tok, v); ok {
+			return err
+		}
+		return toValue(tok, v.Elem(), depth+1)
+	}
+	if v.CanAddr() {
+		if ok, err := toUnmarshaler(tok, v.Addr()); ok {
+			return err
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return fmt.Errorf("can not convert into Go value of interface type %v", v.Type())
+		}
+		v.Set(reflect.ValueOf(toNative(tok)))
+	case reflect.Bool:
+		b, ok := tok.(JSONBool)
+		if !ok {
+			return typeMismatch(tok, v.Type())
+		}
+		v.SetBool(bool(b))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := tok.(JSONNum)
+		if !ok {
+			return typeMismatch(tok, v.Type())
+		}
+		f := float64(n)
+		if f != math.Trunc(f) || f < math.MinInt64 || f >= -math.MinInt64 || v.OverflowInt(int64(f)) {
+			return fmt.Errorf("number %v does not fit Go value of type %v", f, v.Type())
+		}
+		v.SetInt(int64(f))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := tok.(JSONNum)
+		if !ok {
+			return typeMismatch(tok, v.Type())
+		}
+		f := float64(n)
+		if f != math.Trunc(f) || f < 0 || f >= 2*-math.MinInt64 || v.OverflowUint(uint64(f)) {
+			return fmt.Errorf("number %v does not fit Go value of type %v", f, v.Type())
+		}
+		v.SetUint(uint64(f))
+	case reflect.Float32, reflect.Float64:
+		n, ok := tok.(JSONNum)
+		if !ok {
+			return typeMismatch(tok, v.Type())
+		}
+		if v.OverflowFloat(float64(n)) {
+			return fmt.Errorf("number %v does not fit Go value of type %v", float64(n), v.Type())
+		}
+		v.SetFloat(float64(n))
+	case reflect.String:
+		s, ok := tok.(JSONStr)
+		if !ok {
+			return typeMismatch(tok, v.Type())
+		}
+		v.SetString(string(s))
+	case reflect.Slice:
+		if s, ok := tok.(JSONStr); ok && isByteSlice(v.Type()) {
+			b, err := base64.StdEncoding.DecodeString(string(s))
+			if err != nil {
+				return err
+			}
+			v.SetBytes(b)
+			return nil
+		}
+		arr, ok := tok.(JSONArr)
+		if !ok {
+			return typeMismatch(tok, v.Type())
+		}
+		s := reflect.MakeSlice(v.Type(), len(arr), len(arr))
+		for i, t := range arr {
+			if err := toValue(t, s.Index(i), depth+1); err != nil {
+				return atSegment(err, indexSegment(i))
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		arr, ok := tok.(JSONArr)
+		if !ok {
+			return typeMismatch(tok, v.Type())
+		}
+		for i := 0; i < v.Len(); i++ {
+			if i >= len(arr) {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+				continue
+			}
+			if err := toValue(arr[i], v.Index(i), depth+1); err != nil {
+				return atSegment(err, indexSegment(i))
+			}
+		}
+	case reflect.Map:
+		return toMap(tok, v, depth)
+	case reflect.Struct:
+		return toStruct(tok, v, depth)
+	default:
+		return fmt.Errorf("unsupported Go type %v", v.Type())
+	}
+	return nil
+}
+
+// toUnmarshaler populates the value the given pointer points to with its json.Unmarshaler, or its
+// encoding.TextUnmarshaler if the token is a string. It returns false if the value has neither.
+func toUnmarshaler(tok JSONToken, p reflect.Value) (bool, error) {
+	if !p.CanInterface() {
+		return false, nil
+	}
+	if u, ok := p.Interface().(json.Unmarshaler); ok {
+		b, err := MarshalCanonical(tok)
+		if err != nil {
+			return true, err
+		}
+		return true, u.UnmarshalJSON(b)
+	}
+	if u, ok := p.Interface().(encoding.TextUnmarshaler); ok {
+		s, ok := tok.(JSONStr)
+		if !ok {
+			return true, typeMismatch(tok, p.Type().Elem())
+		}
+		return true, u.UnmarshalText([]byte(s))
+	}
+	return false, nil
+}
+
+func toMap(tok JSONToken, v reflect.Value, depth int) error {
+	c, ok := tok.(JSONContainer)
+	if !ok {
+		return typeMismatch(tok, v.Type())
+	}
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, len(c)))
+	}
+	for k, val := range c {
+		key, err := toMapKey(k, t.Key())
+		if err != nil {
+			return err
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		if err := toValue(*val, elem, depth+1); err != nil {
+			return atSegment(err, k)
+		}
+		v.SetMapIndex(key, elem)
+	}
+	return nil
+}
+
+// toMapKey converts the given object key into a map key of the given type, following
+// encoding/json.
+func toMapKey(k string, t reflect.Type) (reflect.Value, error) {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		kv := reflect.New(t)
+		if err := kv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(k)); err != nil {
+			return reflect.Value{}, err
+		}
+		return kv.Elem(), nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(k).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(k, 10, 64)
+		if err != nil || reflect.Zero(t).OverflowInt(n) {
+			return reflect.Value{}, fmt.Errorf("key %q does not fit Go map key of type %v", k, t)
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(k, 10, 64)
+		if err != nil || reflect.Zero(t).OverflowUint(n) {
+			return reflect.Value{}, fmt.Errorf("key %q does not fit Go map key of type %v", k, t)
+		}
+		return reflect.ValueOf(n).Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("unsupported map key type %v", t)
+}
+
+func toStruct(tok JSONToken, v reflect.Value, depth int) error {
+	c, ok := tok.(JSONContainer)
+	if !ok {
+		return typeMismatch(tok, v.Type())
+	}
+	fields := structFields(v.Type())
+	for k, val := range c {
+		f := findField(fields, k)
+		if f == nil {
+			continue
+		}
+		fv, err := allocFieldByIndex(v, f.index)
+		if err != nil {
+			return atSegment(err, k)
+		}
+		if f.quoted {
+			err = toQuoted(*val, fv, depth)
+		} else {
+			err = toValue(*val, fv, depth+1)
+		}
+		if err != nil {
+			return atSegment(err, k)
+		}
+	}
+	return nil
+}
+
+// toQuoted populates the given primitive value of a field tagged with the string option, whose JSON
+// is read from a string.
+func toQuoted(tok JSONToken, v reflect.Value, depth int) error {
+	if tok == nil {
+		return toValue(nil, v, depth+1)
+	}
+	s, ok := tok.(JSONStr)
+	if !ok {
+		return fmt.Errorf("field tagged with the string option requires a string, but got %T", tok)
+	}
+	var u interface{}
+	if err := json.Unmarshal([]byte(s), &u); err != nil {
+		return fmt.Errorf("invalid string option value %q: %v", s, err)
+	}
+	inner, err := unmarshaledToJSONToken(u)
+	if err != nil {
+		return err
+	}
+	return toValue(inner, v, depth+1)
+}
+
+// findField returns the field with the given name, preferring an exact match over a
+// case-insensitive one. It returns nil if there is no such field.
+func findField(fields []convertField, name string) *convertField {
+	var fold *convertField
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+		if fold == nil && strings.EqualFold(fields[i].name, name) {
+			fold = &fields[i]
+		}
+	}
+	return fold
+}
+
+// allocFieldByIndex returns the field with the given index sequence, allocating the nil embedded
+// struct pointers on the way.
+func allocFieldByIndex(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("can not set embedded pointer to unexported struct %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// toNative converts the given token into the Go value encoding/json produces for interface{}.
+func toNative(tok JSONToken) interface{} {
+	switch t := tok.(type) {
+	case JSONBool:
+		return bool(t)
+	case JSONNum:
+		return float64(t)
+	case JSONStr:
+		return string(t)
+	case JSONArr:
+		arr := make([]interface{}, len(t))
+		for i, v := range t {
+			arr[i] = toNative(v)
+		}
+		return arr
+	case JSONContainer:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[k] = toNative(*v)
+		}
+		return m
+	}
+	return nil
+}
+
+func typeMismatch(tok JSONToken, t reflect.Type) error {
+	return fmt.Errorf("can not convert %T into Go value of type %v", tok, t)
+}
+
+// convertField is a struct field that is converted from and into a JSON object member.
+type convertField struct {
+	name string
+	// tagged is whether the name comes from the json tag.
+	tagged bool
+	// index is the index sequence of the field for reflect.Value.FieldByIndex.
+	index     []int
+	omitEmpty bool
+	// quoted is whether the field's JSON is written into a string (the string tag option).
+	quoted bool
+}
+
+// fieldCache holds the fields of the struct types converted so far, by reflect.Type.
+var fieldCache sync.Map
+
+// structFields returns the fields of the given struct type that are converted from and into JSON,
+// in declaration order. The fields of embedded structs are promoted following the encoding/json
+// rules: a shallower field hides deeper ones with the same name, and of fields with the same name
+// at the same depth only a tagged one survives (and only if it is the only tagged one).
+func structFields(t reflect.Type) []convertField {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]convertField)
+	}
+
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var fields []convertField
+	visited := map[reflect.Type]bool{}
+	next := []embedded{{t: t}}
+	for len(next) > 0 {
+		current := next
+		next = nil
+		for _, e := range current {
+			if visited[e.t] {
+				continue
+			}
+			visited[e.t] = true
+
+			for i := 0; i < e.t.NumField(); i++ {
+				sf := e.t.Field(i)
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if sf.Anonymous {
+					if sf.PkgPath != "" && ft.Kind() != reflect.Struct {
+						continue
+					}
+				} else if sf.PkgPath != "" {
+					continue
+				}
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				opts := strings.Split(tag, ",")
+				name := opts[0]
+				index := make([]int, len(e.index)+1)
+				copy(index, e.index)
+				index[len(e.index)] = i
+
+				if name == "" && sf.Anonymous && ft.Kind() == reflect.Struct {
+					next = append(next, embedded{t: ft, index: index})
+					continue
+				}
+				f := convertField{
+					name:      name,
+					tagged:    name != "",
+					index:     index,
+					omitEmpty: hasTagOption(opts, "omitempty"),
+				}
+				if !f.tagged {
+					f.name = sf.Name
+				}
+				if hasTagOption(opts, "string") {
+					switch ft.Kind() {
+					case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+						reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+						reflect.Float32, reflect.Float64, reflect.String:
+						f.quoted = true
+					}
+				}
+				fields = append(fields, f)
+			}
+		}
+	}
+
+	// Find the dominant field of each name.
+	sort.SliceStable(fields, func(i, j int) bool {
+		a, b := fields[i], fields[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if len(a.index) != len(b.index) {
+			return len(a.index) < len(b.index)
+		}
+		return a.tagged && !b.tagged
+	})
+	dominant := fields[:0]
+	for i := 0; i < len(fields); {
+		j := i + 1
+		for j < len(fields) && fields[j].name == fields[i].name {
+			j++
+		}
+		first := fields[i]
+		if j == i+1 || len(fields[i+1].index) > len(first.index) || first.tagged && !fields[i+1].tagged {
+			dominant = append(dominant, first)
+		}
+		i = j
+	}
+	sort.Slice(dominant, func(i, j int) bool {
+		a, b := dominant[i].index, dominant[j].index
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	f, _ := fieldCache.LoadOrStore(t, dominant)
+	return f.([]convertField)
+}
+
+// hasTagOption returns whether the given json tag parts (the name followed by the options) contain
+// the given option.
+func hasTagOption(parts []string, opt string) bool {
+	for _, o := range parts[1:] {
+		if o == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,462 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+type testCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code"`
+	Display *string
+}
+
+type PatientMeta struct {
+	Version     int       `json:"version"`
+	LastUpdated time.Time `json:"lastUpdated"`
+}
+
+type testAddress struct {
+	Lines []string `json:"line,omitempty"`
+	City  string   `json:"city"`
+}
+
+type testPatient struct {
+	*PatientMeta
+	testAddress `json:"address"`
+
+	ID         string               `json:"id"`
+	Active     bool                 `json:"active"`
+	Age        uint8                `json:"age,omitempty"`
+	Weight     float32              `json:"weight"`
+	Height     *float64             `json:"height"`
+	Count      int64                `json:"count,string"`
+	Codes      []testCoding         `json:"codes"`
+	Tags       map[string]int       `json:"tags,omitempty"`
+	Scores     map[int]float64      `json:"scores"`
+	Extra      interface{}          `json:"extra"`
+	Raw        []byte               `json:"raw"`
+	Pair       [2]string            `json:"pair"`
+	Nested     map[string][]*string `json:"nested"`
+	Ignored    string               `json:"-"`
+	unexported string
+}
+
+func TestFromInterface(t *testing.T) {
+	display := "Display"
+	height := 1.8
+	tests := []struct {
+		name string
+		in   interface{}
+		want string
+	}{
+		{
+			name: "nil",
+			in:   nil,
+			want: `null`,
+		},
+		{
+			name: "primitives",
+			in:   []interface{}{true, 1, int8(-2), uint64(3), float32(0.1), 4.5, "str", nil},
+			want: `[true, 1, -2, 3, 0.1, 4.5, "str", null]`,
+		},
+		{
+			name: "map with int keys",
+			in:   map[int][]int{1: {1}, 2: nil},
+			want: `{"1": [1], "2": null}`,
+		},
+		{
+			name: "struct",
+			in: testPatient{
+				PatientMeta: &PatientMeta{Version: 2, LastUpdated: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+				testAddress: testAddress{City: "Springfield"},
+				ID:          "p1",
+				Height:      &height,
+				Count:       7,
+				Codes:       []testCoding{{Code: "a", Display: &display}},
+				Raw:         []byte("hi"),
+				Ignored:     "ignored",
+				unexported:  "unexported",
+			},
+			want: `{
+				"version": 2,
+				"lastUpdated": "2020-01-02T03:04:05Z",
+				"address": {"city": "Springfield"},
+				"id": "p1",
+				"active": false,
+				"weight": 0,
+				"height": 1.8,
+				"count": "7",
+				"codes": [{"code": "a", "Display": "Display"}],
+				"scores": null,
+				"extra": null,
+				"raw": "aGk=",
+				"pair": ["", ""],
+				"nested": null
+			}`,
+		},
+		{
+			name: "nil embedded pointer",
+			in:   testPatient{},
+			want: `{
+				"address": {"city": ""},
+				"id": "",
+				"active": false,
+				"weight": 0,
+				"height": null,
+				"count": "0",
+				"codes": null,
+				"scores": null,
+				"extra": null,
+				"raw": null,
+				"pair": ["", ""],
+				"nested": null
+			}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := FromInterface(test.in)
+			if err != nil {
+				t.Fatalf("FromInterface(%v) returned unexpected error %v", test.in, err)
+			}
+			want := mustParseJSON(t, json.RawMessage(test.want))
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("FromInterface(%v) returned diff (-want +got):\n%s", test.in, diff)
+			}
+		})
+	}
+}
+
+func TestFromInterface_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want string
+	}{
+		{
+			name: "nan",
+			in:   map[string]float64{"a": math.NaN()},
+			want: "a: number NaN can not be represented in JSON",
+		},
+		{
+			name: "channel",
+			in:   struct{ C []chan int }{C: []chan int{make(chan int)}},
+			want: "C[0]: unsupported Go type chan int",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := FromInterface(test.in); err == nil || err.Error() != test.want {
+				t.Errorf("FromInterface(%v) returned error %v, want %q", test.in, err, test.want)
+			}
+		})
+	}
+}
+
+func TestToInterface(t *testing.T) {
+	in := `{
+		"version": 3,
+		"lastUpdated": "2020-01-02T03:04:05Z",
+		"address": {"line": ["1 Main St"], "city": "Springfield"},
+		"ID": "p1",
+		"active": true,
+		"age": 42,
+		"weight": 70.5,
+		"height": null,
+		"count": "12",
+		"codes": [{"system": "s", "code": "a", "display": "Display"}],
+		"tags": {"x": 1},
+		"scores": {"1": 0.5},
+		"extra": {"a": [1, "b", null]},
+		"raw": "aGk=",
+		"pair": ["a"],
+		"nested": {"n": ["s", null]},
+		"unknown": 1
+	}`
+	display := "Display"
+	s := "s"
+	want := testPatient{
+		PatientMeta: &PatientMeta{Version: 3, LastUpdated: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		testAddress: testAddress{Lines: []string{"1 Main St"}, City: "Springfield"},
+		ID:          "p1",
+		Active:      true,
+		Age:         42,
+		Weight:      70.5,
+		Count:       12,
+		Codes:       []testCoding{{System: "s", Code: "a", Display: &display}},
+		Tags:        map[string]int{"x": 1},
+		Scores:      map[int]float64{1: 0.5},
+		Extra:       map[string]interface{}{"a": []interface{}{1.0, "b", nil}},
+		Raw:         []byte("hi"),
+		Pair:        [2]string{"a", ""},
+		Nested:      map[string][]*string{"n": {&s, nil}},
+	}
+
+	got := testPatient{Height: new(float64), Pair: [2]string{"x", "y"}}
+	if err := ToInterface(mustParseJSON(t, json.RawMessage(in)), &got); err != nil {
+		t.Fatalf("ToInterface(%s) returned unexpected error %v", in, err)
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(testPatient{})); diff != "" {
+		t.Errorf("ToInterface(%s) returned diff (-want +got):\n%s", in, diff)
+	}
+}
+
+func TestToInterface_Tokens(t *testing.T) {
+	in := mustParseJSON(t, json.RawMessage(`{"c": {"a": [1]}, "t": "s"}`))
+	var got struct {
+		C JSONContainer
+		T JSONToken
+	}
+	if err := ToInterface(in, &got); err != nil {
+		t.Fatalf("ToInterface(%v) returned unexpected error %v", in, err)
+	}
+	if want := mustParseJSON(t, json.RawMessage(`{"a": [1]}`)); !want.Equal(got.C) {
+		t.Errorf("ToInterface(%v) set C to %v, want %v", in, got.C, want)
+	}
+	if want := JSONStr("s"); !want.Equal(got.T) {
+		t.Errorf("ToInterface(%v) set T to %v, want %v", in, got.T, want)
+	}
+}
+
+func TestToInterface_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		out  interface{}
+		want string
+	}{
+		{
+			name: "not a pointer",
+			in:   `{}`,
+			out:  testPatient{},
+			want: "ToInterface requires a non-nil pointer, but got jsonutil.testPatient",
+		},
+		{
+			name: "type mismatch",
+			in:   `{"codes": [{"code": 1}]}`,
+			out:  &testPatient{},
+			want: "codes[0].code: can not convert jsonutil.JSONNum into Go value of type string",
+		},
+		{
+			name: "fractional integer",
+			in:   `{"version": 1.5}`,
+			out:  &testPatient{},
+			want: "version: number 1.5 does not fit Go value of type int",
+		},
+		{
+			name: "integer overflow",
+			in:   `{"age": 256}`,
+			out:  &testPatient{},
+			want: "age: number 256 does not fit Go value of type uint8",
+		},
+		{
+			name: "negative unsigned integer",
+			in:   `[-1]`,
+			out:  &[]uint{},
+			want: "[0]: number -1 does not fit Go value of type uint",
+		},
+		{
+			name: "string option",
+			in:   `{"count": 12}`,
+			out:  &testPatient{},
+			want: "count: field tagged with the string option requires a string, but got jsonutil.JSONNum",
+		},
+		{
+			name: "map key",
+			in:   `{"scores": {"a": 1}}`,
+			out:  &testPatient{},
+			want: `scores: key "a" does not fit Go map key of type int`,
+		},
+		{
+			name: "unmarshaler",
+			in:   `{"lastUpdated": "yesterday"}`,
+			out:  &testPatient{},
+			want: "lastUpdated: parsing time",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := mustParseJSON(t, json.RawMessage(test.in))
+			if err := ToInterface(in, test.out); err == nil || !strings.HasPrefix(err.Error(), test.want) {
+				t.Errorf("ToInterface(%v, %T) returned error %v, want an error starting with %q", in, test.out, err, test.want)
+			}
+		})
+	}
+}
+
+// randomPatient returns a patient with random contents, so that each field is sometimes empty.
+func randomPatient(r *rand.Rand) testPatient {
+	str := func() string {
+		return strings.Repeat(string(rune('a'+r.Intn(26))), r.Intn(3))
+	}
+	var p testPatient
+	if r.Intn(2) == 0 {
+		p.PatientMeta = &PatientMeta{Version: r.Intn(10), LastUpdated: time.Unix(r.Int63n(1e10), 0).UTC()}
+	}
+	for i := r.Intn(3); i > 0; i-- {
+		p.Lines = append(p.Lines, str())
+	}
+	p.City = str()
+	p.ID = str()
+	p.Active = r.Intn(2) == 0
+	p.Age = uint8(r.Intn(256))
+	p.Weight = r.Float32() * 100
+	if r.Intn(2) == 0 {
+		h := r.NormFloat64()
+		p.Height = &h
+	}
+	p.Count = r.Int63n(1<<53) - 1<<52
+	for i := r.Intn(3); i > 0; i-- {
+		c := testCoding{System: str(), Code: str()}
+		if r.Intn(2) == 0 {
+			d := str()
+			c.Display = &d
+		}
+		p.Codes = append(p.Codes, c)
+	}
+	if r.Intn(2) == 0 {
+		p.Tags = map[string]int{str(): r.Intn(100) - 50}
+		p.Scores = map[int]float64{r.Intn(100): r.ExpFloat64()}
+	}
+	switch r.Intn(3) {
+	case 0:
+		p.Extra = str()
+	case 1:
+		p.Extra = []interface{}{r.Float64(), map[string]interface{}{str(): nil}}
+	}
+	if r.Intn(2) == 0 {
+		p.Raw = []byte(str())
+	}
+	p.Pair = [2]string{str(), str()}
+	if r.Intn(2) == 0 {
+		s := str()
+		p.Nested = map[string][]*string{str(): {&s, nil}}
+	}
+	return p
+}
+
+func TestFromInterface_MatchesJSONRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		p := randomPatient(r)
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			b, err := json.Marshal(p)
+			if err != nil {
+				t.Fatalf("json.Marshal(%+v) returned unexpected error %v", p, err)
+			}
+			want := mustParseJSON(t, b)
+
+			got, err := FromInterface(p)
+			if err != nil {
+				t.Fatalf("FromInterface(%+v) returned unexpected error %v", p, err)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("FromInterface(%+v) returned diff from the JSON round trip (-want +got):\n%s", p, diff)
+			}
+		})
+	}
+}
+
+func TestToInterface_MatchesJSONRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		p := randomPatient(r)
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			b, err := json.Marshal(p)
+			if err != nil {
+				t.Fatalf("json.Marshal(%+v) returned unexpected error %v", p, err)
+			}
+			var want testPatient
+			if err := json.Unmarshal(b, &want); err != nil {
+				t.Fatalf("json.Unmarshal(%s) returned unexpected error %v", b, err)
+			}
+
+			var got testPatient
+			if err := ToInterface(mustParseJSON(t, b), &got); err != nil {
+				t.Fatalf("ToInterface(%s) returned unexpected error %v", b, err)
+			}
+			if diff := cmp.Diff(want, got, cmp.AllowUnexported(testPatient{})); diff != "" {
+				t.Errorf("ToInterface(%s) returned diff from the JSON round trip (-want +got):\n%s", b, diff)
+			}
+		})
+	}
+}
+
+func BenchmarkFromInterface(b *testing.B) {
+	p := randomPatient(rand.New(rand.NewSource(1)))
+
+	b.Run("json round trip", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			j, err := json.Marshal(p)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := UnmarshalJSON(j); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := FromInterface(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkToInterface(b *testing.B) {
+	tok, err := FromInterface(randomPatient(rand.New(rand.NewSource(1))))
+	if err != nil {
+		b.Fatalf("failed to convert benchmark input: %v", err)
+	}
+
+	b.Run("json round trip", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			j, err := MarshalCanonical(tok)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var p testPatient
+			if err := json.Unmarshal(j, &p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var p testPatient
+			if err := ToInterface(tok, &p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
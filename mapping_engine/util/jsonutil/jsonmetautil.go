@@ -36,6 +36,10 @@ type JSONMetaNode interface {
 type Provenance struct {
 	Sources  []JSONMetaNode
 	Function string
+
+	// Lineage, if set, is a token of the same shape as the value of the node whose leaves list the
+	// sources of the leaves of the value (see types.Lineage). It is only set when lineage is recorded.
+	Lineage JSONToken
 }
 
 // ShallowString returns the paths of the arguments and the function used to get this node. It does
@@ -284,7 +288,7 @@ func NodeToToken(node JSONMetaNode) (JSONToken, error) {
 
 // GetNodeField returns the child given a path in dot/bracket notation like foo.bar[3].baz
 func GetNodeField(node JSONMetaNode, path string) (JSONMetaNode, error) {
-	segs, err := SegmentPath(path)
+	segs, err := CachedSegmentPath(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to segment path: %v", err)
 	}
@@ -294,18 +298,34 @@ func GetNodeField(node JSONMetaNode, path string) (JSONMetaNode, error) {
 // GetNodeFieldSegmented returns the child given a path in parsed dot/bracket notation like
 // ["foo", "bar", "[3]", "baz"]
 func GetNodeFieldSegmented(node JSONMetaNode, segments []string) (JSONMetaNode, error) {
-	n, _, err := getNodeFieldSegmented(node, segments)
+	n, _, err := getNodeFieldSegmented(node, segments, nil)
+	return n, err
+}
+
+// GetNodeFieldSegmentedOptional is like GetNodeFieldSegmented, but segments whose optional flag is
+// set are optional accesses (like foo?.bar or foo?[0] in Whistle): if the node they are applied to
+// can not have them (e.g. a primitive, or an object for an array index), the result is nil rather
+// than an error. The optional flags are parallel to segments, and may be shorter.
+func GetNodeFieldSegmentedOptional(node JSONMetaNode, segments []string, optional []bool) (JSONMetaNode, error) {
+	n, _, err := getNodeFieldSegmented(node, segments, optional)
 	return n, err
 }
 
 // getNodeFieldSegmented finds the node given a segmented path. It returns the node (if found) and
 // a boolean indicating whether an array expansion [*] occurred somewhere in the given path.
-func getNodeFieldSegmented(node JSONMetaNode, segments []string) (JSONMetaNode, bool, error) {
+func getNodeFieldSegmented(node JSONMetaNode, segments []string, optional []bool) (JSONMetaNode, bool, error) {
 	if len(segments) == 0 {
 		return node, false, nil
 	}
 
 	seg := segments[0]
+	var restOptional []bool
+	if len(optional) > 0 {
+		if optional[0] && !canAccess(node, seg) {
+			return nil, false, nil
+		}
+		restOptional = optional[1:]
+	}
 
 	switch n := node.(type) {
 	case JSONMetaPrimitiveNode:
@@ -323,7 +343,7 @@ func getNodeFieldSegmented(node JSONMetaNode, segments []string) (JSONMetaNode,
 			}
 
 			for i := range n.Items {
-				f, expand, err := getNodeFieldSegmented(n.Items[i], segments[1:])
+				f, expand, err := getNodeFieldSegmented(n.Items[i], segments[1:], restOptional)
 				if err != nil {
 					return nil, false, fmt.Errorf("error expanding [*] on item index %d: %v", i, err)
 				}
@@ -357,14 +377,14 @@ func getNodeFieldSegmented(node JSONMetaNode, segments []string) (JSONMetaNode,
 			return nil, false, nil
 		}
 
-		return getNodeFieldSegmented(n.Items[idx], segments[1:])
+		return getNodeFieldSegmented(n.Items[idx], segments[1:], restOptional)
 	case JSONMetaContainerNode:
 		if IsIndex(seg) {
 			return nil, false, fmt.Errorf("expected an object key, but got an array index %q", seg)
 		}
 
 		if val, ok := n.Children[seg]; ok {
-			return getNodeFieldSegmented(val, segments[1:])
+			return getNodeFieldSegmented(val, segments[1:], restOptional)
 		}
 		// TODO: Consider returning a different value for fields that don't exist vs
 		// fields that are actually set to null.
@@ -375,3 +395,17 @@ func getNodeFieldSegmented(node JSONMetaNode, segments []string) (JSONMetaNode,
 		return nil, false, fmt.Errorf("found node of un-navigable type %T", node)
 	}
 }
+
+// canAccess returns true iff the given segment can be looked up in the given node without an error,
+// i.e. the node is an array and the segment an index, or the node is an object and the segment a
+// key.
+func canAccess(node JSONMetaNode, seg string) bool {
+	switch node.(type) {
+	case JSONMetaArrayNode:
+		return IsIndex(seg)
+	case JSONMetaContainerNode:
+		return !IsIndex(seg)
+	default:
+		return false
+	}
+}
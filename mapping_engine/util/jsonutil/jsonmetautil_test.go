@@ -689,6 +689,96 @@ func TestGetNodeField_Errors(t *testing.T) {
 	}
 }
 
+func TestGetNodeFieldSegmentedOptional(t *testing.T) {
+	msg := json.RawMessage(`{
+	  "id":"an_id",
+	  "code":{
+	    "system":"code_system"
+	  },
+	  "name":[
+	    {"family": "first"},
+	    "not_an_object"
+	  ]
+	}`)
+	jn, err := TokenToNode(mustParseJSON(t, msg))
+	if err != nil {
+		t.Fatalf("error creating test node: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		segments []string
+		optional []bool
+		want     JSONToken
+		wantErr  bool
+	}{
+		{
+			name:     "no optional segments",
+			segments: []string{"code", "system"},
+			want:     JSONStr("code_system"),
+		},
+		{
+			name:     "optional key into primitive",
+			segments: []string{"id", "foo"},
+			optional: []bool{false, true},
+		},
+		{
+			name:     "non-optional key into primitive",
+			segments: []string{"id", "foo"},
+			optional: []bool{true, false},
+			wantErr:  true,
+		},
+		{
+			name:     "optional index into object",
+			segments: []string{"code", "[0]"},
+			optional: []bool{false, true},
+		},
+		{
+			name:     "optional key into array",
+			segments: []string{"name", "family"},
+			optional: []bool{false, true},
+		},
+		{
+			name:     "optional key within expansion",
+			segments: []string{"name", "[*]", "family"},
+			optional: []bool{false, false, true},
+			want:     JSONArr{JSONStr("first"), nil},
+		},
+		{
+			name:     "non-optional key within expansion",
+			segments: []string{"name", "[*]", "family"},
+			wantErr:  true,
+		},
+		{
+			name:     "optional key on missing field",
+			segments: []string{"missing", "foo", "bar"},
+			optional: []bool{false, true, true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := GetNodeFieldSegmentedOptional(jn, test.segments, test.optional)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("GetNodeFieldSegmentedOptional(%v, %v, %v) did not return expected error", string(msg), test.segments, test.optional)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetNodeFieldSegmentedOptional(%v, %v, %v) returned unexpected error %v", string(msg), test.segments, test.optional, err)
+			}
+
+			gotTkn, err := NodeToToken(got)
+			if err != nil {
+				t.Fatalf("failed to convert got value %v to token: %v", got, err)
+			}
+			if diff := cmp.Diff(test.want, gotTkn); diff != "" {
+				t.Errorf("GetNodeFieldSegmentedOptional(%v, %v, %v) unexpected result (-want/+got):\n%s", string(msg), test.segments, test.optional, diff)
+			}
+		})
+	}
+}
+
 func complexNode() JSONMetaNode {
 	node := JSONMetaContainerNode{JSONMeta: JSONMeta{}}
 	arr := JSONMetaArrayNode{JSONMeta: JSONMeta{key: "key1", provenance: simpleCP(&node)}}
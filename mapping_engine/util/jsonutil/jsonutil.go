@@ -195,7 +195,7 @@ func GetFieldSegmented(src JSONToken, segments []string) (JSONToken, error) {
 
 // GetField gets the specified field value for the provided JSON object.
 func (w DefaultAccessor) GetField(src JSONToken, field string) (JSONToken, error) {
-	segs, err := SegmentPath(field)
+	segs, err := CachedSegmentPath(field)
 	if err != nil {
 		return nil, fmt.Errorf("failed to segment path: %v", err)
 	}
@@ -362,9 +362,15 @@ func SetField(src JSONToken, field string, dest *JSONToken, overwrite bool, matc
 	return w.SetField(src, field, dest, overwrite, matchNesting)
 }
 
+// SetFieldSegmented is a wrapper for DefaultAccessor.setFieldSegmented().
+func SetFieldSegmented(src JSONToken, segments []string, dest *JSONToken, overwrite bool, matchNesting bool) error {
+	w := DefaultAccessor{}
+	return w.setFieldSegmented(src, segments, dest, overwrite, matchNesting)
+}
+
 // SetField sets the specified field value for the provided JSON object.
 func (w DefaultAccessor) SetField(src JSONToken, field string, dest *JSONToken, overwrite bool, matchNesting bool) error {
-	segments, err := SegmentPath(field)
+	segments, err := CachedSegmentPath(field)
 	if err != nil {
 		return fmt.Errorf("failed to segment path: %v", err)
 	}
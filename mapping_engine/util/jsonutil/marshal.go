@@ -0,0 +1,240 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonutil
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// MarshalCanonical serializes the given token into canonical JSON, following the JSON
+// Canonicalization Scheme (RFC 8785): object keys are sorted by their UTF-16 code units, there is
+// no insignificant whitespace, numbers are formatted like ECMAScript's Number.prototype.toString
+// (the shortest digits that round trip, e.g. 4.5, 1e+21 or 1e-7) and strings only escape what they
+// must. Equal tokens always serialize to the same bytes, regardless of the Go version, so the output
+// can be compared or hashed byte by byte (e.g. for deduplication).
+func MarshalCanonical(tkn JSONToken) ([]byte, error) {
+	w := &jsonWriter{}
+	if err := w.write(tkn, 0); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// MarshalPretty serializes the given token into JSON for humans. It is formatted like
+// MarshalCanonical, except that every array item and object member is on its own line, indented by
+// the given indent per level, and object keys are followed by a space.
+func MarshalPretty(tkn JSONToken, indent string) ([]byte, error) {
+	w := &jsonWriter{pretty: true, indent: indent}
+	if err := w.write(tkn, 0); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// jsonWriter writes canonical (or pretty printed) JSON.
+type jsonWriter struct {
+	buf    bytes.Buffer
+	pretty bool
+	indent string
+}
+
+func (w *jsonWriter) write(tkn JSONToken, depth int) error {
+	switch t := tkn.(type) {
+	case nil:
+		w.buf.WriteString("null")
+	case JSONBool:
+		w.buf.WriteString(strconv.FormatBool(bool(t)))
+	case JSONNum:
+		s, err := formatCanonicalNumber(float64(t))
+		if err != nil {
+			return err
+		}
+		w.buf.WriteString(s)
+	case JSONStr:
+		return w.writeString(string(t))
+	case JSONArr:
+		if len(t) == 0 {
+			w.buf.WriteString("[]")
+			return nil
+		}
+		w.buf.WriteByte('[')
+		for i, v := range t {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.newline(depth + 1)
+			if err := w.write(v, depth+1); err != nil {
+				return err
+			}
+		}
+		w.newline(depth)
+		w.buf.WriteByte(']')
+	case JSONContainer:
+		if len(t) == 0 {
+			w.buf.WriteString("{}")
+			return nil
+		}
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return lessUTF16(keys[i], keys[j])
+		})
+
+		w.buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.newline(depth + 1)
+			if err := w.writeString(k); err != nil {
+				return err
+			}
+			w.buf.WriteByte(':')
+			if w.pretty {
+				w.buf.WriteByte(' ')
+			}
+			var v JSONToken
+			if t[k] != nil {
+				v = *t[k]
+			}
+			if err := w.write(v, depth+1); err != nil {
+				return err
+			}
+		}
+		w.newline(depth)
+		w.buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unsupported JSON token type %T", tkn)
+	}
+	return nil
+}
+
+// newline starts a new line indented to the given depth, if pretty printing.
+func (w *jsonWriter) newline(depth int) {
+	if !w.pretty {
+		return
+	}
+	w.buf.WriteByte('\n')
+	for i := 0; i < depth; i++ {
+		w.buf.WriteString(w.indent)
+	}
+}
+
+// writeString writes the given string as a JSON string. Only quotes, backslashes and control
+// characters are escaped, using the short escapes (like \n) where they exist.
+func (w *jsonWriter) writeString(s string) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("string %q is not valid UTF-8", s)
+	}
+	w.buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			w.buf.WriteString(`\"`)
+		case '\\':
+			w.buf.WriteString(`\\`)
+		case '\b':
+			w.buf.WriteString(`\b`)
+		case '\f':
+			w.buf.WriteString(`\f`)
+		case '\n':
+			w.buf.WriteString(`\n`)
+		case '\r':
+			w.buf.WriteString(`\r`)
+		case '\t':
+			w.buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&w.buf, `\u%04x`, r)
+			} else {
+				w.buf.WriteRune(r)
+			}
+		}
+	}
+	w.buf.WriteByte('"')
+	return nil
+}
+
+// lessUTF16 compares the given strings by their UTF-16 code units, as RFC 8785 sorts object keys.
+// This differs from comparing their bytes for characters outside of the Basic Multilingual Plane.
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+// formatCanonicalNumber formats the given number like ECMAScript's Number.prototype.toString, as
+// RFC 8785 requires. Only the shortest decimal digits that round trip are taken from strconv (which
+// are uniquely defined); where the decimal point goes and when to use an exponent is decided here,
+// so the format does not depend on the Go version.
+func formatCanonicalNumber(f float64) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", fmt.Errorf("number %v can not be represented in JSON", f)
+	}
+	if f == 0 {
+		// Including -0.
+		return "0", nil
+	}
+	sign := ""
+	if f < 0 {
+		sign = "-"
+		f = -f
+	}
+
+	// The value is 0.digits * 10^n, i.e. the decimal point is n digits into the digits.
+	e := strconv.FormatFloat(f, 'e', -1, 64)
+	i := strings.IndexByte(e, 'e')
+	digits := strings.Replace(e[:i], ".", "", 1)
+	exp, err := strconv.Atoi(e[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("unexpected format of number %s: %v", e, err)
+	}
+	n := exp + 1
+	k := len(digits)
+
+	var s string
+	switch {
+	case k <= n && n <= 21:
+		s = digits + strings.Repeat("0", n-k)
+	case 0 < n && n <= 21:
+		s = digits[:n] + "." + digits[n:]
+	case -6 < n && n <= 0:
+		s = "0." + strings.Repeat("0", -n) + digits
+	default:
+		s = digits[:1]
+		if k > 1 {
+			s += "." + digits[1:]
+		}
+		if n-1 < 0 {
+			s += "e-" + strconv.Itoa(1-n)
+		} else {
+			s += "e+" + strconv.Itoa(n-1)
+		}
+	}
+	return sign + s, nil
+}
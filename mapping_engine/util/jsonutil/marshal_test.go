@@ -0,0 +1,169 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonutil
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestMarshalCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			// The example of RFC 8785, section 3.2.2.
+			name: "rfc 8785 example",
+			in: `{
+  "numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001],
+  "string": "\u20ac$\u000F\u000aA'B\u0022\u005c\u005c\u0022\u002f",
+  "literals": [null, true, false]
+}`,
+			want: `{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			// The example of RFC 8785, section 3.2.3.
+			name: "keys sorted by utf-16",
+			in:   `{"\u20ac": "Euro Sign", "\r": "Carriage Return", "\ufb33": "Hebrew Letter Dalet With Dagesh", "1": "One", "\ud83d\ude00": "Emoji: Grinning Face", "\u0080": "Control", "\u00f6": "Latin Small Letter O With Diaeresis"}`,
+			want: "{\"\\r\":\"Carriage Return\",\"1\":\"One\",\"\u0080\":\"Control\",\"\u00f6\":\"Latin Small Letter O With Diaeresis\",\"\u20ac\":\"Euro Sign\",\"\U0001f600\":\"Emoji: Grinning Face\",\"\ufb33\":\"Hebrew Letter Dalet With Dagesh\"}",
+		},
+		{
+			name: "nested",
+			in:   `{"b": [{"d": 1, "c": {}}, []], "a": null}`,
+			want: `{"a":null,"b":[{"c":{},"d":1},[]]}`,
+		},
+		{
+			name: "html is not escaped",
+			in:   `["<a href=\"x\">&</a>", " "]`,
+			want: `["<a href=\"x\">&</a>","` + " " + `"]`,
+		},
+		{
+			name: "control characters",
+			in:   `["\u0000\u0001\b\t\n\f\r\u001f\u007f"]`,
+			want: `["\u0000\u0001\b\t\n\f\r\u001f` + "\u007f" + `"]`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := mustParseJSON(t, json.RawMessage(test.in))
+			got, err := MarshalCanonical(in)
+			if err != nil {
+				t.Fatalf("MarshalCanonical(%s) returned unexpected error %v", test.in, err)
+			}
+			if string(got) != test.want {
+				t.Errorf("MarshalCanonical(%s) = %s, want %s", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestMarshalCanonical_Numbers(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want string
+	}{
+		{in: 0, want: "0"},
+		{in: math.Copysign(0, -1), want: "0"},
+		{in: 1, want: "1"},
+		{in: -1, want: "-1"},
+		{in: 4.5, want: "4.5"},
+		{in: 0.1, want: "0.1"},
+		{in: 0.30000000000000004, want: "0.30000000000000004"},
+		{in: 100, want: "100"},
+		{in: 123.456, want: "123.456"},
+		{in: 1e20, want: "100000000000000000000"},
+		{in: 1e21, want: "1e+21"},
+		{in: 123456789012345680000, want: "123456789012345680000"},
+		{in: 1.5e21, want: "1.5e+21"},
+		{in: 0.000001, want: "0.000001"},
+		{in: 0.0000012345, want: "0.0000012345"},
+		{in: 1e-7, want: "1e-7"},
+		{in: -1.5e-7, want: "-1.5e-7"},
+		// Integers above 2^53 are not exact, the closest float is formatted.
+		{in: 9007199254740993, want: "9007199254740992"},
+		{in: 18014398509481985, want: "18014398509481984"},
+		{in: 295147905179352830000, want: "295147905179352830000"},
+		{in: math.MaxFloat64, want: "1.7976931348623157e+308"},
+		{in: math.SmallestNonzeroFloat64, want: "5e-324"},
+		{in: 2.2250738585072014e-308, want: "2.2250738585072014e-308"},
+		{in: 333333333.33333329, want: "333333333.3333333"},
+	}
+	for _, test := range tests {
+		got, err := MarshalCanonical(JSONNum(test.in))
+		if err != nil {
+			t.Fatalf("MarshalCanonical(%v) returned unexpected error %v", test.in, err)
+		}
+		if string(got) != test.want {
+			t.Errorf("MarshalCanonical(%v) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+func TestMarshalCanonical_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   JSONToken
+	}{
+		{name: "nan", in: JSONNum(math.NaN())},
+		{name: "infinity", in: JSONArr{JSONNum(math.Inf(-1))}},
+		{name: "invalid utf-8", in: JSONStr("\xff")},
+		{name: "invalid utf-8 key", in: JSONContainer{"\xff": nil}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := MarshalCanonical(test.in); err == nil {
+				t.Errorf("MarshalCanonical(%v) = %s, want error", test.in, got)
+			}
+		})
+	}
+}
+
+func TestMarshalPretty(t *testing.T) {
+	in := mustParseJSON(t, json.RawMessage(`{"b": [1.50, "é", {}], "a": {"c": null, "d": []}}`))
+	want := `{
+  "a": {
+    "c": null,
+    "d": []
+  },
+  "b": [
+    1.5,
+    "é",
+    {}
+  ]
+}`
+	got, err := MarshalPretty(in, "  ")
+	if err != nil {
+		t.Fatalf("MarshalPretty(%v) returned unexpected error %v", in, err)
+	}
+	if string(got) != want {
+		t.Errorf("MarshalPretty(%v) = %s, want %s", in, got, want)
+	}
+
+	// Pretty printing only adds whitespace.
+	canonical, err := MarshalCanonical(in)
+	if err != nil {
+		t.Fatalf("MarshalCanonical(%v) returned unexpected error %v", in, err)
+	}
+	reparsed, err := MarshalCanonical(mustParseJSON(t, got))
+	if err != nil {
+		t.Fatalf("MarshalCanonical(%s) returned unexpected error %v", got, err)
+	}
+	if string(reparsed) != string(canonical) {
+		t.Errorf("MarshalCanonical(MarshalPretty(%v)) = %s, want %s", in, reparsed, canonical)
+	}
+}
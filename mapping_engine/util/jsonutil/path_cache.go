@@ -0,0 +1,137 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonutil
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultPathCacheSize is the number of dynamic (i.e. not compiled) paths whose segments are kept
+// in the path cache.
+const DefaultPathCacheSize = 4096
+
+// pathCache holds the segmented form of paths so that they are only parsed once. Paths compiled
+// with CompilePath (i.e. those that appear in a mapping config) are kept forever, all other paths
+// are kept in a bounded LRU. The cache is safe for concurrent use.
+type pathCache struct {
+	mu       sync.Mutex
+	compiled map[string][]string
+	capacity int
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+type pathCacheEntry struct {
+	path string
+	segs []string
+}
+
+func newPathCache(capacity int) *pathCache {
+	return &pathCache{
+		compiled: make(map[string][]string),
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+var defaultPathCache = newPathCache(DefaultPathCacheSize)
+
+// CompilePath segments the given path (as per SegmentPath) and keeps the result for the lifetime
+// of the process, so that later accesses with the same path do not need to parse it again. This
+// is meant for the static set of paths that appear in a mapping config, and is called when the
+// config is loaded.
+func CompilePath(path string) ([]string, error) {
+	return defaultPathCache.compile(path)
+}
+
+// CachedSegmentPath returns the segments of the given path (as per SegmentPath), parsing it only
+// if it has not been compiled or seen recently. The returned slice is shared between callers and
+// must not be modified (this includes appending to a subslice of it).
+func CachedSegmentPath(path string) ([]string, error) {
+	return defaultPathCache.segments(path)
+}
+
+func (c *pathCache) compile(path string) ([]string, error) {
+	c.mu.Lock()
+	if segs, ok := c.compiled[path]; ok {
+		c.mu.Unlock()
+		return segs, nil
+	}
+	c.mu.Unlock()
+
+	segs, err := SegmentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	segs = segs[:len(segs):len(segs)]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.compiled[path] = segs
+	if e, ok := c.entries[path]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, path)
+	}
+	return segs, nil
+}
+
+func (c *pathCache) segments(path string) ([]string, error) {
+	c.mu.Lock()
+	if segs, ok := c.compiled[path]; ok {
+		c.mu.Unlock()
+		return segs, nil
+	}
+	if e, ok := c.entries[path]; ok {
+		c.lru.MoveToFront(e)
+		segs := e.Value.(*pathCacheEntry).segs
+		c.mu.Unlock()
+		return segs, nil
+	}
+	c.mu.Unlock()
+
+	// Parse outside the lock; at worst two goroutines parse the same path concurrently.
+	segs, err := SegmentPath(path)
+	if err != nil {
+		return nil, err
+	}
+	// Cap the slice so that appending to it reallocates instead of writing past its end.
+	segs = segs[:len(segs):len(segs)]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[path]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*pathCacheEntry).segs, nil
+	}
+	if c.capacity <= 0 {
+		return segs, nil
+	}
+	c.entries[path] = c.lru.PushFront(&pathCacheEntry{path: path, segs: segs})
+	for c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*pathCacheEntry).path)
+	}
+	return segs, nil
+}
+
+// len returns the number of compiled and cached paths.
+func (c *pathCache) len() (compiled int, cached int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.compiled), c.lru.Len()
+}
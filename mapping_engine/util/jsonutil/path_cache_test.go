@@ -0,0 +1,178 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestPathCache_Segments(t *testing.T) {
+	c := newPathCache(2)
+
+	for _, path := range []string{"foo.bar", "foo[0].bar", "foo.bar"} {
+		want, err := SegmentPath(path)
+		if err != nil {
+			t.Fatalf("SegmentPath(%q) returned unexpected error %v", path, err)
+		}
+		got, err := c.segments(path)
+		if err != nil {
+			t.Fatalf("segments(%q) returned unexpected error %v", path, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("segments(%q) => diff -%v +%v\n%s", path, want, got, diff)
+		}
+	}
+
+	if _, cached := c.len(); cached != 2 {
+		t.Errorf("cache has %d paths, want 2", cached)
+	}
+}
+
+func TestPathCache_Errors(t *testing.T) {
+	c := newPathCache(2)
+
+	if _, err := c.segments("foo..bar"); err == nil {
+		t.Errorf("segments(%q) expected error but got nil", "foo..bar")
+	}
+	if _, err := c.compile("foo..bar"); err == nil {
+		t.Errorf("compile(%q) expected error but got nil", "foo..bar")
+	}
+	if compiled, cached := c.len(); compiled != 0 || cached != 0 {
+		t.Errorf("cache has %d compiled and %d cached paths, want none", compiled, cached)
+	}
+}
+
+func TestPathCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := newPathCache(2)
+
+	mustSegment := func(path string) {
+		t.Helper()
+		if _, err := c.segments(path); err != nil {
+			t.Fatalf("segments(%q) returned unexpected error %v", path, err)
+		}
+	}
+
+	mustSegment("a")
+	mustSegment("b")
+	mustSegment("a")
+	mustSegment("c")
+
+	for path, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, got := c.entries[path]; got != want {
+			t.Errorf("path %q cached = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestPathCache_CompiledPathsAreNotEvicted(t *testing.T) {
+	c := newPathCache(1)
+
+	if _, err := c.compile("compiled.path"); err != nil {
+		t.Fatalf("compile returned unexpected error %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := c.segments(fmt.Sprintf("dynamic[%d]", i)); err != nil {
+			t.Fatalf("segments returned unexpected error %v", err)
+		}
+	}
+
+	if _, ok := c.compiled["compiled.path"]; !ok {
+		t.Errorf("compiled path was evicted")
+	}
+	if compiled, cached := c.len(); compiled != 1 || cached != 1 {
+		t.Errorf("cache has %d compiled and %d cached paths, want 1 and 1", compiled, cached)
+	}
+}
+
+func TestPathCache_Concurrent(t *testing.T) {
+	c := newPathCache(8)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				path := fmt.Sprintf("foo[%d].bar", (g+i)%16)
+				if i%10 == 0 {
+					if _, err := c.compile(path); err != nil {
+						t.Errorf("compile(%q) returned unexpected error %v", path, err)
+					}
+					continue
+				}
+				if _, err := c.segments(path); err != nil {
+					t.Errorf("segments(%q) returned unexpected error %v", path, err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if _, cached := c.len(); cached > 8 {
+		t.Errorf("cache has %d paths, want at most 8", cached)
+	}
+}
+
+func TestGetField_CompiledPathAllocs(t *testing.T) {
+	src := mustParseJSON(t, json.RawMessage(`{"a": [{"b": {"c": [{"d": "deep"}]}}]}`))
+	const path = "a[0].b.c[0].d"
+	if _, err := CompilePath(path); err != nil {
+		t.Fatalf("CompilePath(%q) returned unexpected error %v", path, err)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if _, err := GetField(src, path); err != nil {
+			t.Fatalf("GetField(%v, %q) returned unexpected error %v", src, path, err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("GetField(%v, %q) made %v allocations, want 0", src, path, allocs)
+	}
+}
+
+func BenchmarkGetField_DeepPath(b *testing.B) {
+	src, err := UnmarshalJSON(json.RawMessage(`{"a": [{"b": {"c": [{"d": {"e": [{"f": "deep"}]}}]}}]}`))
+	if err != nil {
+		b.Fatalf("failed to unmarshal benchmark input: %v", err)
+	}
+	const path = "a[0].b.c[0].d.e[0].f"
+
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			segs, err := SegmentPath(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := GetFieldSegmented(src, segs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := GetField(src, path); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
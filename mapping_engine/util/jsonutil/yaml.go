@@ -0,0 +1,194 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonutil
+
+import (
+	"fmt"
+	"math"
+
+	"gopkg.in/yaml.v3" /* copybara-comment: yaml */
+)
+
+// maxYAMLAliasNodes limits the number of nodes produced by expanding aliases, to protect against
+// documents that expand exponentially (e.g. "billion laughs").
+const maxYAMLAliasNodes = 1000000
+
+// UnmarshalYAML parses the first document of the given YAML into a JSONToken. Anchors and aliases
+// (including << merge keys) are resolved. Scalars are resolved with the YAML 1.2 core schema, so
+// only true/false are booleans (yes, no, on and off are strings), and quoted scalars are always
+// strings (so "007" stays a string). Timestamps are kept as strings as written. Mapping keys must
+// be scalars and are converted to strings (e.g. the key 1 becomes "1").
+func UnmarshalYAML(in []byte) (JSONToken, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(in, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %v", err)
+	}
+	if doc.Kind == 0 || len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	d := &yamlDecoder{expanding: map[*yaml.Node]bool{}}
+	return d.decode(doc.Content[0])
+}
+
+type yamlDecoder struct {
+	// expanding are the anchored nodes whose aliases are currently being expanded, to detect cycles.
+	expanding map[*yaml.Node]bool
+	// aliasNodes is the number of nodes produced by expanding aliases so far.
+	aliasNodes int
+}
+
+func (d *yamlDecoder) decode(n *yaml.Node) (JSONToken, error) {
+	if len(d.expanding) > 0 {
+		d.aliasNodes++
+		if d.aliasNodes > maxYAMLAliasNodes {
+			return nil, fmt.Errorf("YAML aliases expand to more than %d nodes", maxYAMLAliasNodes)
+		}
+	}
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return d.decode(n.Content[0])
+	case yaml.AliasNode:
+		if d.expanding[n.Alias] {
+			return nil, fmt.Errorf("line %d: YAML alias %q refers to itself", n.Line, n.Value)
+		}
+		d.expanding[n.Alias] = true
+		defer delete(d.expanding, n.Alias)
+		return d.decode(n.Alias)
+	case yaml.SequenceNode:
+		arr := make(JSONArr, 0, len(n.Content))
+		for _, c := range n.Content {
+			t, err := d.decode(c)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, t)
+		}
+		return arr, nil
+	case yaml.MappingNode:
+		return d.decodeMapping(n)
+	case yaml.ScalarNode:
+		return decodeYAMLScalar(n)
+	default:
+		return nil, fmt.Errorf("line %d: unsupported YAML node kind %v", n.Line, n.Kind)
+	}
+}
+
+func (d *yamlDecoder) decodeMapping(n *yaml.Node) (JSONToken, error) {
+	c := make(JSONContainer, len(n.Content)/2)
+	var merges []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		if k.Kind == yaml.ScalarNode && k.ShortTag() == "!!merge" {
+			merges = append(merges, v)
+			continue
+		}
+
+		key, err := yamlKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate YAML mapping key %q", k.Line, key)
+		}
+		t, err := d.decode(v)
+		if err != nil {
+			return nil, err
+		}
+		c[key] = &t
+	}
+
+	// Merged keys never override the mapping's own keys, and earlier merged mappings take precedence
+	// over later ones.
+	for _, m := range merges {
+		merged, err := d.decode(m)
+		if err != nil {
+			return nil, err
+		}
+		var sources JSONArr
+		switch t := merged.(type) {
+		case JSONContainer:
+			sources = JSONArr{t}
+		case JSONArr:
+			sources = t
+		default:
+			return nil, fmt.Errorf("line %d: YAML merge key value must be a mapping or a sequence of mappings", m.Line)
+		}
+		for _, s := range sources {
+			sc, ok := s.(JSONContainer)
+			if !ok {
+				return nil, fmt.Errorf("line %d: YAML merge key value must be a mapping or a sequence of mappings", m.Line)
+			}
+			for k, v := range sc {
+				if _, ok := c[k]; !ok {
+					c[k] = v
+				}
+			}
+		}
+	}
+	return c, nil
+}
+
+// yamlKey returns the given mapping key as a string.
+func yamlKey(k *yaml.Node) (string, error) {
+	if k.Kind == yaml.AliasNode && k.Alias != nil {
+		k = k.Alias
+	}
+	if k.Kind != yaml.ScalarNode {
+		return "", fmt.Errorf("line %d: YAML mapping keys must be scalars, but found a %s", k.Line, yamlKindName(k.Kind))
+	}
+	return k.Value, nil
+}
+
+func decodeYAMLScalar(n *yaml.Node) (JSONToken, error) {
+	switch tag := n.ShortTag(); tag {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		if err := n.Decode(&b); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n.Line, err)
+		}
+		return JSONBool(b), nil
+	case "!!int", "!!float":
+		var f float64
+		if err := n.Decode(&f); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n.Line, err)
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("line %d: YAML number %s can not be represented in JSON", n.Line, n.Value)
+		}
+		return JSONNum(f), nil
+	case "!!str", "!!timestamp", "!!binary":
+		return JSONStr(n.Value), nil
+	default:
+		return nil, fmt.Errorf("line %d: unsupported YAML tag %s", n.Line, tag)
+	}
+}
+
+func yamlKindName(k yaml.Kind) string {
+	switch k {
+	case yaml.SequenceNode:
+		return "sequence"
+	case yaml.MappingNode:
+		return "mapping"
+	default:
+		return fmt.Sprintf("node of kind %v", k)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonutil
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+)
+
+func TestUnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want json.RawMessage
+	}{
+		{
+			name: "empty",
+			in:   ``,
+			want: json.RawMessage(`null`),
+		},
+		{
+			name: "scalars",
+			in: `
+str: foo
+int: 10
+negative: -10
+float: 10.5
+hex: 0x1F
+true: true
+false: false
+null: ~
+empty:
+`,
+			want: json.RawMessage(`{"str": "foo", "int": 10, "negative": -10, "float": 10.5, "hex": 31, "true": true, "false": false, "null": null, "empty": null}`),
+		},
+		{
+			name: "yaml 1.1 booleans are strings",
+			in: `
+yes: yes
+no: no
+on: on
+off: off
+y: y
+`,
+			want: json.RawMessage(`{"yes": "yes", "no": "no", "on": "on", "off": "off", "y": "y"}`),
+		},
+		{
+			name: "timestamps are strings as written",
+			in: `
+date: 2020-01-02
+time: 2020-01-02T03:04:05Z
+`,
+			want: json.RawMessage(`{"date": "2020-01-02", "time": "2020-01-02T03:04:05Z"}`),
+		},
+		{
+			name: "quoted scalars are strings",
+			in: `
+zip: "02134"
+bool: 'true'
+num: "10"
+`,
+			want: json.RawMessage(`{"zip": "02134", "bool": "true", "num": "10"}`),
+		},
+		{
+			name: "non string keys are stringified",
+			in: `
+1: one
+true: yes
+2020-01-02: date
+`,
+			want: json.RawMessage(`{"1": "one", "true": "yes", "2020-01-02": "date"}`),
+		},
+		{
+			name: "nested",
+			in: `
+patient:
+  name:
+  - given: [Jane, Q]
+    family: Doe
+  tags: []
+  meta: {}
+`,
+			want: json.RawMessage(`{"patient": {"name": [{"given": ["Jane", "Q"], "family": "Doe"}], "tags": [], "meta": {}}}`),
+		},
+		{
+			name: "anchors and aliases",
+			in: `
+system: &loinc http://loinc.org
+coding: &coding
+  system: *loinc
+  code: "123"
+codings: [*coding, *coding]
+`,
+			want: json.RawMessage(`{"system": "http://loinc.org", "coding": {"system": "http://loinc.org", "code": "123"}, "codings": [{"system": "http://loinc.org", "code": "123"}, {"system": "http://loinc.org", "code": "123"}]}`),
+		},
+		{
+			name: "merge keys",
+			in: `
+base: &base
+  a: 1
+  b: 2
+other: &other
+  b: 3
+  c: 4
+merged:
+  <<: [*base, *other]
+  a: 0
+`,
+			want: json.RawMessage(`{"base": {"a": 1, "b": 2}, "other": {"b": 3, "c": 4}, "merged": {"a": 0, "b": 2, "c": 4}}`),
+		},
+		{
+			name: "only the first document",
+			in: `
+first: 1
+---
+second: 2
+`,
+			want: json.RawMessage(`{"first": 1}`),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := UnmarshalYAML([]byte(test.in))
+			if err != nil {
+				t.Fatalf("UnmarshalYAML(%q) returned unexpected error %v", test.in, err)
+			}
+			want := mustParseJSON(t, test.want)
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("UnmarshalYAML(%q) got diff (-want +got):\n%s", test.in, diff)
+			}
+		})
+	}
+}
+
+func TestUnmarshalYAML_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{
+			name: "invalid yaml",
+			in:   "a: [1, 2",
+		},
+		{
+			name: "sequence key",
+			in:   "? [a, b]\n: c\n",
+		},
+		{
+			name: "mapping key",
+			in:   "? {a: b}\n: c\n",
+		},
+		{
+			name: "duplicate key",
+			in:   "a: 1\na: 2\n",
+		},
+		{
+			name: "infinity",
+			in:   "a: .inf\n",
+		},
+		{
+			name: "unknown tag",
+			in:   "a: !custom foo\n",
+		},
+		{
+			name: "merge of scalar",
+			in:   "a:\n  <<: foo\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, err := UnmarshalYAML([]byte(test.in)); err == nil {
+				t.Errorf("UnmarshalYAML(%q) = %v, want error", test.in, got)
+			}
+		})
+	}
+}
@@ -51,6 +51,10 @@ ROOT_INPUT
     : '$root'
 ;
 
+GLOBAL
+    : '$global'
+;
+
 ROOT
     : 'root'
 ;
@@ -142,10 +146,19 @@ REQUIRED
     : 'required'
 ;
 
+SPREAD
+    : '...'
+;
+
 DELIM
     : '.'
 ;
 
+// Separates the namespace of a projector from its name, e.g. acme::$ChecksumMRN.
+NAMESPACE_SEP
+    : '::'
+;
+
 TOKEN
     : TOKENINITCHAR TOKENCHAR*
     | ESCAPED_TOKEN
@@ -180,13 +193,34 @@ fragment COMMENTCHAR
     : ~[\r\n]
 ;
 
+// Block comments may span lines, and do not nest.
+BLOCK_COMMENT
+    : '/*' .*? '*/' -> channel(HIDDEN)
+;
+
+// Only matches a block comment that is never closed (as BLOCK_COMMENT is longer otherwise), which
+// is then reported by the transpiler before parsing.
+UNTERMINATED_BLOCK_COMMENT
+    : '/*'
+;
+
+// Triple quoted strings may span lines, and are taken verbatim (no escapes).
+MULTILINE_STRING
+    : '"""' .*? '"""'
+;
+
 STRING
     : '"' STRINGCHAR* '"'
 ;
 
 fragment STRINGCHAR
     : ~["\\]
-    | '\\' ["\\]
+    | '\\' ["\\/bfnrt]
+    | '\\u' HEXDIGIT HEXDIGIT HEXDIGIT HEXDIGIT
+;
+
+fragment HEXDIGIT
+    : [0-9a-fA-F]
 ;
 
 WS
@@ -233,11 +267,34 @@ floatingPoint
 ;
 
 root
-    : (mapping | comment | projectorDef | NEWLINE)* postProcess? NEWLINE* EOF
+    : (mapping | comment | projectorDef | rootInputs | useNamespace | NEWLINE)* postProcess? NEWLINE* EOF
   ;
 
+// Declares the named inputs of the root mappings, e.g. root(msg, roster).
+rootInputs
+    : ROOT '(' TOKEN (',' TOKEN)* ')' (NEWLINE | EOF)
+;
+
+// Brings the projectors of a namespace into scope by their unqualified names, e.g. use "acme". The
+// TOKEN must be "use", which is not a keyword so that fields can still be named use.
+useNamespace
+    : TOKEN STRING (NEWLINE | EOF)
+;
+
 projectorDef
-    : DEF TOKEN '(' (argAlias (',' argAlias)*)? ')' NEWLINE? block NEWLINE?
+    : projectorModifier? DEF TOKEN '(' (argAlias (',' argAlias)*)? ')' ensures? NEWLINE? block NEWLINE?
+;
+
+// A post-condition on the result of the projector, which it reads as $this, e.g.
+// ensures $IsNotNil($this.code). TOKEN must be "ensures", which is not a keyword so that fields can
+// still be named ensures.
+ensures
+    : TOKEN expression
+;
+
+// TOKEN must be "pure", which is not a keyword so that fields can still be named pure.
+projectorModifier
+    : TOKEN
 ;
 
 argAlias
@@ -272,11 +329,22 @@ arrayMod
     : LISTOPEN LISTCLOSE
 ;
 block
-    : '{' NEWLINE? (mapping | comment | conditionBlock | NEWLINE)* '}'
+    : '{' NEWLINE? (mapping | callStatement | comment | conditionBlock | NEWLINE)* '}'
 ;
 
 mapping
-    : target inlineCondition? ':' expression (
+    : REQUIRED? target inlineCondition? ':' expression (
+        ';'
+        | comment
+        | NEWLINE
+        | EOF
+    )
+;
+
+// A call to a projector for its side effects only (e.g. checks that fail on invalid inputs), whose
+// result is discarded, e.g. CheckRequiredFields(input);
+callStatement
+    : projectorName arrayMod? '(' (argument (',' argument)* ','?)? ')' (
         ';'
         | comment
         | NEWLINE
@@ -298,32 +366,56 @@ filter
 
 expression
     : // Operator precedence is determined by order of alternatives.
-    source                                                    # ExprSource
-    | block                                                   # ExprAnonBlock
-    | TOKEN arrayMod? '(' (expression (',' expression)*)? ')' # ExprProjection
-    | LISTOPEN (expression (',' expression)*)? LISTCLOSE      # ListInitialization
-    | expression postunoperator                               # ExprPostOp
-    | preunoperator expression                                # ExprPreOp
-    | expression bioperator1 expression                       # ExprBiOp
-    | expression bioperator2 expression                       # ExprBiOp
-    | expression bioperator3 expression                       # ExprBiOp
-    | expression bioperator4 expression                       # ExprBiOp
+    source                                                             # ExprSource
+    | block                                                            # ExprAnonBlock
+    | projectorName arrayMod? '(' (argument (',' argument)* ','?)? ')' # ExprProjection
+    | LISTOPEN (expression (',' expression)* ','?)? LISTCLOSE          # ListInitialization
+    | expression postunoperator                                        # ExprPostOp
+    | preunoperator expression                                         # ExprPreOp
+    | expression bioperator1 expression                                # ExprBiOp
+    | expression bioperator2 expression                                # ExprBiOp
+    | expression bioperator3 expression                                # ExprBiOp
+    | expression bioperator4 expression                                # ExprBiOp
+;
+
+// The name of a called projector, qualified with its namespace if it has one, e.g.
+// acme::$ChecksumMRN.
+projectorName
+    : (TOKEN NAMESPACE_SEP)? TOKEN
+;
+
+// An iterated argument can be filtered with a where clause, e.g. Build(obx[] where $.value ~= ""),
+// in which $ is the element.
+argument
+    : lambda
+    | expression (SPREAD | filter)?
+;
+
+lambda
+    : lambdaParams '=>' NEWLINE? expression
+;
+
+lambdaParams
+    : TOKEN
+    | '(' (TOKEN (',' TOKEN)*)? ')'
 ;
 
 source
     : floatingPoint                                    # SourceConstNum
     | (VAR | DEST)? sourcePath inlineFilter? arrayMod? # SourceInput
-    | STRING                                           # SourceConstStr
+    | (STRING | MULTILINE_STRING)                      # SourceConstStr
     | BOOL                                             # SourceConstBool
     | '(' expression ')' arrayMod?                     # SourceProjection
 ;
 
 target
-    : VAR targetPath  # TargetVar
-    | ROOT targetPath # TargetRootField
-    | OBJ TOKEN       # TargetObj
-    | THIS            # TargetThis
-    | targetPath      # TargetField
+    : VAR targetPath         # TargetVar
+    | ROOT targetPath        # TargetRootField
+    | GLOBAL DELIM TOKEN     # TargetGlobal
+    | OBJ TOKEN              # TargetObj
+    | OBJ '(' expression ')' # TargetDynamicObj
+    | THIS OWMOD?            # TargetThis
+    | targetPath             # TargetField
 ;
 
 targetPath
@@ -344,6 +436,13 @@ targetPathSegment
     | DELIM INTEGER
     | index
     | arrayMod
+    | keyedArrayMod
+;
+
+// Appends to the array, or writes to the element appended earlier with the same key, e.g.
+// allergy[@a.id].severity.
+keyedArrayMod
+    : LISTOPEN '@' expression LISTCLOSE
 ;
 
 sourcePath
@@ -353,14 +452,29 @@ sourcePath
 sourcePathHead
     : ROOT_INPUT
     | ROOT // Deprecated: b/148939976
+    | GLOBAL
+    | THIS // Only in ensures.
     | TOKEN
 ;
 
 sourcePathSegment
-    : DELIM TOKEN
-    | DELIM INTEGER
-    | WILDCARD
-    | index
+    : NOTNIL? DELIM TOKEN
+    | NOTNIL? DELIM INTEGER
+    | NOTNIL? WILDCARD
+    | NOTNIL? index
+    | pathPredicate
+;
+
+// Selects the first element of an array whose field matches a constant, e.g. [?type.code = "MR"],
+// or with a * all matching elements, e.g. [*?type.code ~= "MR"].
+pathPredicate
+    : LISTOPEN MUL? NOTNIL TOKEN sourcePathSegment* (EQ | NEQ) predicateValue LISTCLOSE
+;
+
+predicateValue
+    : STRING
+    | floatingPoint
+    | BOOL
 ;
 
 postProcess
@@ -0,0 +1,224 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/transform" /* copybara-comment: transform */
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/transpiler" /* copybara-comment: transpiler */
+
+	dhpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: data_harmonization_go_proto */
+	hpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: harmonization_go_proto */
+)
+
+// benchmarkWhistle is a mid-size config exercising the common parts of a real mapping: iteration,
+// nested projectors, conditions, local vars and the hot builtins.
+const benchmarkWhistle = `
+out Patient: Patient_Patient($root.patients[])
+out Observation: Observation_Observation($root.observations[])
+
+def Patient_Patient(p) {
+  var hashedMRN: $Hash(p.mrn)
+  resourceType: "Patient"
+  id: hashedMRN
+  identifier[]: Identifier("urn:oid:2.16.840.1.113883.19.5", p.mrn)
+  name[]: HumanName(p)
+  gender (if p.sex = "M"): "male"
+  gender (if p.sex = "F"): "female"
+  birthDate: $ParseTime("2006/01/02", p.dob)
+  telecom: ContactPoint(p.phones[])
+  address[]: Address(p.address)
+  active: true
+}
+
+def Identifier(system, value) {
+  system: system
+  value: value
+}
+
+def HumanName(p) {
+  family: p.last_name
+  given[]: p.first_name
+  given[]: p.middle_name
+  text: $StrCat(p.first_name, " ", p.last_name)
+}
+
+def ContactPoint(phone) {
+  system: "phone"
+  value: $StrCat("+1-", phone)
+  use: "home"
+}
+
+def Address(a) {
+  line[]: a.street
+  city: a.city
+  postalCode: a.zip
+  country: "US"
+}
+
+def Observation_Observation(o) {
+  resourceType: "Observation"
+  status: "final"
+  code.coding[]: Coding("http://loinc.org", o.code, o.display)
+  subject.reference: $StrCat("Patient/", $Hash(o.mrn))
+  valueQuantity.value: o.value
+  valueQuantity.unit: o.unit
+  if o.value > 100 {
+    interpretation[].text: "high"
+  } else {
+    interpretation[].text: "normal"
+  }
+  effectiveDateTime: $ParseTime("2006-01-02 15:04:05", o.time)
+  meta: $MergeJSON($ListOf(Meta("lab"), Meta(o.source)), false)
+}
+
+def Coding(system, code, display) {
+  system: system
+  code: code
+  display: display
+}
+
+def Meta(source) {
+  source: source
+  tag[]: source
+}
+`
+
+// syntheticCorpus returns a deterministic input with the given number of patients, each with a few
+// observations.
+func syntheticCorpus(patients int) json.RawMessage {
+	var ps, obs []interface{}
+	for i := 0; i < patients; i++ {
+		mrn := fmt.Sprintf("MRN%06d", i)
+		sex := "M"
+		if i%2 == 0 {
+			sex = "F"
+		}
+		ps = append(ps, map[string]interface{}{
+			"mrn":         mrn,
+			"first_name":  fmt.Sprintf("First%d", i),
+			"middle_name": "Q",
+			"last_name":   fmt.Sprintf("Last%d", i),
+			"sex":         sex,
+			"dob":         fmt.Sprintf("19%02d/%02d/%02d", 50+i%50, 1+i%12, 1+i%28),
+			"phones":      []string{fmt.Sprintf("555-%04d", i), fmt.Sprintf("555-%04d", i+1)},
+			"address": map[string]interface{}{
+				"street": fmt.Sprintf("%d Main St", i),
+				"city":   "Springfield",
+				"zip":    fmt.Sprintf("%05d", i),
+			},
+		})
+
+		for j := 0; j < 3; j++ {
+			obs = append(obs, map[string]interface{}{
+				"mrn":     mrn,
+				"code":    fmt.Sprintf("%d-%d", 8000+j, i%10),
+				"display": "Vital sign",
+				"value":   60 + (i*7+j*13)%80,
+				"unit":    "bpm",
+				"time":    fmt.Sprintf("2020-03-%02d 13:%02d:00", 1+i%28, j),
+				"source":  fmt.Sprintf("device-%d", j),
+			})
+		}
+	}
+
+	corpus, err := json.Marshal(map[string]interface{}{
+		"patients":     ps,
+		"observations": obs,
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal synthetic corpus: %v", err))
+	}
+	return corpus
+}
+
+func newBenchmarkTransformer(b *testing.B) *transform.DefaultTransformer {
+	b.Helper()
+
+	config, _, err := transpiler.Transpile(benchmarkWhistle, transpiler.Options{})
+	if err != nil {
+		b.Fatalf("transpiler.Transpile(...) yielded unexpected error: %v", err)
+	}
+
+	tr, err := transform.NewDefaultTransformer(
+		context.TODO(),
+		&dhpb.DataHarmonizationConfig{
+			StructureMappingConfig: &hpb.StructureMappingConfig{
+				Mapping: &hpb.StructureMappingConfig_MappingConfig{MappingConfig: config},
+			},
+		},
+		transform.TransformationConfig{})
+	if err != nil {
+		b.Fatalf("failed to initialize transformer: %v", err)
+	}
+	return tr
+}
+
+func BenchmarkTranspile(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := transpiler.Transpile(benchmarkWhistle, transpiler.Options{}); err != nil {
+			b.Fatalf("transpiler.Transpile(...) yielded unexpected error: %v", err)
+		}
+	}
+}
+
+func BenchmarkTransform(b *testing.B) {
+	tr := newBenchmarkTransformer(b)
+
+	for _, patients := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("%d patients", patients), func(b *testing.B) {
+			input, err := tr.ParseJSON(syntheticCorpus(patients))
+			if err != nil {
+				b.Fatalf("error unmarshaling benchmark input: %v", err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := tr.Transform(input); err != nil {
+					b.Fatalf("Transform(...) yielded unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkTransformWithLineage measures the overhead of recording lineage, compared to
+// BenchmarkTransform.
+func BenchmarkTransformWithLineage(b *testing.B) {
+	tr := newBenchmarkTransformer(b)
+
+	for _, patients := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("%d patients", patients), func(b *testing.B) {
+			input, err := tr.ParseJSON(syntheticCorpus(patients))
+			if err != nil {
+				b.Fatalf("error unmarshaling benchmark input: %v", err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := tr.TransformWithLineage(input); err != nil {
+					b.Fatalf("TransformWithLineage(...) yielded unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
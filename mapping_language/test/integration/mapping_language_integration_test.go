@@ -34,6 +34,7 @@ import (
 func TestTranspile(t *testing.T) {
 	type valueTest struct {
 		rootMappings, wantJSON, inputJSON string
+		wantErr                           bool
 	}
 	tests := []struct {
 		name      string
@@ -1414,24 +1415,291 @@ func TestTranspile(t *testing.T) {
 									 }`,
 			},
 		},
+		{
+			name: "this merges with field mappings",
+			whistle: `def projector(arg) {
+									id: arg
+									tags[]: "first"
+									$this: Extra(arg)
+									after: "after"
+								}
+
+								def Extra(arg) {
+									extra: arg
+									tags[]: "second"
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector("one")`,
+				wantJSON: `{
+										 "result": {
+										   "id": "one",
+										   "extra": "one",
+										   "tags": ["first", "second"],
+										   "after": "after"
+										 }
+									 }`,
+			},
+		},
+		{
+			name: "this merge conflict on primitive",
+			whistle: `def projector(arg) {
+									id: arg
+									$this: Conflict()
+								}
+
+								def Conflict() {
+									id: "other"
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector("one")`,
+				wantErr:      true,
+			},
+		},
+		{
+			name: "this overwrite replaces field mappings",
+			whistle: `def projector(arg) {
+									id: arg
+									tags[]: "first"
+									$this!: Extra(arg)
+									after: "after"
+								}
+
+								def Extra(arg) {
+									extra: arg
+									tags[]: "second"
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector("one")`,
+				wantJSON: `{
+										 "result": {
+										   "extra": "one",
+										   "tags": ["second"],
+										   "after": "after"
+										 }
+									 }`,
+			},
+		},
+		{
+			name: "spread into variadic builtin",
+			whistle: `def projector(first, middle, last) {
+									var parts: $ListOf(first, middle, last)
+									name: $StrJoin(" ", parts...)
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector("Jane", "Q", "Doe")`,
+				wantJSON: `{
+										 "result": {"name": "Jane Q Doe"}
+									 }`,
+			},
+		},
+		{
+			name: "spread empty array",
+			whistle: `def projector(parts) {
+									count: $Sum(parts...)
+									joined: $StrCat("prefix", parts...)
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector($root.parts)`,
+				inputJSON:    `{"parts": []}`,
+				wantJSON: `{
+										 "result": {"count": 0, "joined": "prefix"}
+									 }`,
+			},
+		},
+		{
+			name: "spread into user defined projector",
+			whistle: `def Name(first, last) {
+									first: first
+									last: last
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: Name($root.parts...)`,
+				inputJSON:    `{"parts": ["Jane", "Doe"]}`,
+				wantJSON: `{
+										 "result": {"first": "Jane", "last": "Doe"}
+									 }`,
+			},
+		},
+		{
+			name: "spread too many args into user defined projector",
+			whistle: `def Name(first, last) {
+									first: first
+									last: last
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: Name($root.parts...)`,
+				inputJSON:    `{"parts": ["Jane", "Q", "Doe"]}`,
+				wantErr:      true,
+			},
+		},
+		{
+			name: "spread too few args into non-variadic builtin",
+			whistle: `def projector(parts) {
+									sub: $Sub(parts...)
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector($ListOf(1))`,
+				wantErr:      true,
+			},
+		},
+		{
+			name: "spread non-array",
+			whistle: `def projector(part) {
+									name: $StrCat(part...)
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector("Jane")`,
+				wantErr:      true,
+			},
+		},
+		{
+			name: "string escapes",
+			whistle: `def function() {
+									unicode: "caf\u00e9 \ud83d\ude00"
+									whitespace: "a\tb\nc"
+									path: "C:\\temp\\new"
+								}`,
+			wantValue: valueTest{
+				rootMappings: `out myOut: function()`,
+				wantJSON: `{
+										 "myOut": [
+										   {
+										     "unicode": "café 😀",
+										     "whitespace": "a\tb\nc",
+										     "path": "C:\\temp\\new"
+										   }
+										 ]
+									 }`,
+			},
+		},
+		{
+			name: "multi-line string",
+			whistle: `def function() {
+									text: """Dear "patient",
+no escapes\n here.
+"""
+								}`,
+			wantValue: valueTest{
+				rootMappings: `out myOut: function()`,
+				wantJSON: `{
+										 "myOut": [
+										   {"text": "Dear \"patient\",\nno escapes\\n here.\n"}
+										 ]
+									 }`,
+			},
+		},
+		{
+			name: "optional access through mismatched types",
+			whistle: `def projector(msg) {
+									family: msg.PID?.patientName?[0]?.family
+									given: msg.PID.patientName?[*]?.given
+									kind: "name"
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector($root)`,
+				inputJSON:    `{"PID": {"patientName": {"family": "Doe", "given": "Jane"}}}`,
+				wantJSON: `{
+										 "result": {"kind": "name"}
+									 }`,
+			},
+		},
+		{
+			name: "optional access when present",
+			whistle: `def projector(msg) {
+									family: msg.PID?.patientName?[0]?.family
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector($root)`,
+				inputJSON:    `{"PID": {"patientName": [{"family": "Doe"}]}}`,
+				wantJSON: `{
+										 "result": {"family": "Doe"}
+									 }`,
+			},
+		},
+		{
+			name: "non-optional access through mismatched types",
+			whistle: `def projector(msg) {
+									family: msg.PID.patientName[0].family
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: projector($root)`,
+				inputJSON:    `{"PID": {"patientName": {"family": "Doe"}}}`,
+				wantErr:      true,
+			},
+		},
+		{
+			name: "forward reference",
+			whistle: `def First(x) {
+									a: Second(x)
+								}
+
+								def Second(x) {
+									b: x
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: First($root.value)`,
+				inputJSON:    `{"value": 1}`,
+				wantJSON: `{
+										 "result": {"a": {"b": 1}}
+									 }`,
+			},
+		},
+		{
+			name: "mutual recursion over a tree",
+			whistle: `def Section(s) {
+									title: s.title
+									children: Sections(s.section)
+								}
+
+								def Sections(sections) {
+									section: Section(sections[])
+								}`,
+			wantValue: valueTest{
+				rootMappings: `result: Section($root)`,
+				inputJSON: `{
+											"title": "Document",
+											"section": [
+												{"title": "Problems", "section": [{"title": "Active"}, {"title": "Resolved"}]},
+												{"title": "Medications"}
+											]
+										}`,
+				wantJSON: `{
+										 "result": {
+											 "title": "Document",
+											 "children": {
+												 "section": [
+													 {"title": "Problems", "children": {"section": [{"title": "Active"}, {"title": "Resolved"}]}},
+													 {"title": "Medications"}
+												 ]
+											 }
+										 }
+									 }`,
+			},
+		},
 		// TODO: Add more tests.
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			// Just test bare compilation
-			_, err := transpiler.Transpile(test.whistle)
+			_, _, err := transpiler.Transpile(test.whistle, transpiler.Options{})
 			if err != nil {
 				t.Fatalf("Transpile(...) yielded unexpected error\nwhistle code:\n%s\nerror: %v", test.whistle, err)
 			}
 
-			if test.wantValue.wantJSON != "" {
+			if test.wantValue.wantJSON != "" || test.wantValue.wantErr {
 				full := test.wantValue.rootMappings + "\n" + test.whistle
-				compiled, err := transpiler.Transpile(full)
+				compiled, _, err := transpiler.Transpile(full, transpiler.Options{})
 				if err != nil {
 					t.Fatalf("transpiler.Transpile(...) yielded unexpected error\nwhistle code:\n%s\nerror: %v", full, err)
 				}
 
 				got, err := exec(t, compiled, test.wantValue.inputJSON)
+				if test.wantValue.wantErr {
+					if err == nil {
+						t.Fatalf("executing whistle code yielded %v, want error\nwhistle code:\n%s", got, full)
+					}
+					return
+				}
 				if err != nil {
 					m, _ := prototext.Marshal(compiled)
 					t.Fatalf("executing whistle code yielded unexpected error\nwhistle code:\n%s\nerror: %v\nwhistler: %s", full, err, string(m))
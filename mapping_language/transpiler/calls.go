@@ -0,0 +1,76 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transpiler
+
+import (
+	"fmt"
+	"strings"
+
+	"bitbucket.org/creachadair/stringset" /* copybara-comment: stringset */
+	"github.com/antlr/antlr4/runtime/Go/antlr" /* copybara-comment: antlr */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/types" /* copybara-comment: types */
+)
+
+// projectorCall is a call to a (possibly not yet defined) projector, along with its location.
+type projectorCall struct {
+	name         string
+	line, column int
+}
+
+// recordCall records a call to the given projector, to be checked once all projectors are defined.
+func (t *transpiler) recordCall(ctx antlr.ParserRuleContext, name string) {
+	t.calls = append(t.calls, projectorCall{
+		name:   strings.TrimSuffix(name, "[]"),
+		line:   ctx.GetStart().GetLine(),
+		column: ctx.GetStart().GetColumn(),
+	})
+}
+
+// checkCalls adds a warning for each recorded call to a projector that is neither defined in the
+// Whistle, nor known, nor in scope through a used namespace. Calls to builtins are only checked if
+// the known builtins are given.
+func (t *transpiler) checkCalls(known, builtins []string, inScope map[string]string) {
+	defined := stringset.New(known...)
+	defined.Add(builtins...)
+	for _, c := range t.calls {
+		if (strings.HasPrefix(c.name, "$") && len(builtins) == 0) || defined.Contains(c.name) || t.projectorNames[c.name] || inScope[c.name] != "" {
+			continue
+		}
+
+		msg := fmt.Sprintf("projector %q is not defined", c.name)
+		if similar := types.SimilarNames(c.name, t.callableNames(defined, inScope), 3); len(similar) > 0 {
+			msg += fmt.Sprintf(" (did you mean one of %q?)", similar)
+		}
+		t.warnings = append(t.warnings, Warning{
+			Line:    c.line,
+			Column:  c.column,
+			Message: msg,
+		})
+	}
+}
+
+// callableNames returns the names of all the projectors the Whistle can call, given the known ones
+// and those in scope through used namespaces.
+func (t *transpiler) callableNames(known stringset.Set, inScope map[string]string) []string {
+	names := known.Elements()
+	for name := range t.projectorNames {
+		names = append(names, name)
+	}
+	for name := range inScope {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,163 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transpiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/util/jsonutil" /* copybara-comment: jsonutil */
+	"github.com/antlr/antlr4/runtime/Go/antlr" /* copybara-comment: antlr */
+
+	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// rootTarget is a path in the root output written to by a mapping, along with the location of the
+// mapping and the arms of the conditional blocks it is in.
+type rootTarget struct {
+	path         string
+	segs         []string
+	line, column int
+	branches     []branch
+}
+
+// branch is an arm (if or else) of a conditional block, identified by the order of the block in the
+// Whistle.
+type branch struct {
+	block int
+	then  bool
+}
+
+// enterBranch records that the mappings visited next are in the given arm of the given conditional
+// block, until exitBranch is called.
+func (t *transpiler) enterBranch(block int, then bool) {
+	t.branches = append(t.branches, branch{block: block, then: then})
+}
+
+func (t *transpiler) exitBranch() {
+	t.branches = t.branches[:len(t.branches)-1]
+}
+
+// exclusive returns true iff the given targets are written in opposite arms of the same conditional
+// block, so that at most one of them is written.
+func exclusive(a, b rootTarget) bool {
+	for _, x := range a.branches {
+		for _, y := range b.branches {
+			if x.block == y.block && x.then != y.then {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recordRootTarget checks whether the given mapping target writes to a path of the root output that
+// has already been written to (or is a parent or child of such a path) by another mapping, and if
+// so adds a warning. Such writes are resolved by declaration order at runtime, which is rarely what
+// was intended. Overwrites (!) and array appends ([]) are expected to be repeated so are ignored,
+// and so are targets written in the if and else arms of the same conditional block.
+func (t *transpiler) recordRootTarget(ctx antlr.ParserRuleContext, target interface{}) {
+	var path string
+	switch tt := target.(type) {
+	case *mpb.FieldMapping_TargetField:
+		// Only root mappings write fields directly into the root output.
+		if t.environment == nil || t.environment.name != "" {
+			return
+		}
+		path = tt.TargetField
+	case *mpb.FieldMapping_TargetRootField:
+		path = tt.TargetRootField
+	case *mpb.FieldMapping_TargetDynamicObject:
+		dt := rootTarget{
+			line:     ctx.GetStart().GetLine(),
+			column:   ctx.GetStart().GetColumn(),
+			branches: append([]branch(nil), t.branches...),
+		}
+		for _, prev := range t.rootTargets {
+			t.warnDynamicCollision(dt, prev)
+		}
+		t.dynamicTargets = append(t.dynamicTargets, dt)
+		return
+	default:
+		return
+	}
+
+	if path == jsonThis || strings.HasSuffix(path, "!") {
+		return
+	}
+	segs, err := jsonutil.SegmentPath(path)
+	if err != nil || len(segs) == 0 {
+		return
+	}
+	for _, s := range segs {
+		if s == "[]" || s == "[*]" {
+			return
+		}
+	}
+
+	rt := rootTarget{
+		path:     path,
+		segs:     segs,
+		line:     ctx.GetStart().GetLine(),
+		column:   ctx.GetStart().GetColumn(),
+		branches: append([]branch(nil), t.branches...),
+	}
+
+	for _, prev := range t.rootTargets {
+		if (!isSegmentPrefix(prev.segs, rt.segs) && !isSegmentPrefix(rt.segs, prev.segs)) || exclusive(prev, rt) {
+			continue
+		}
+		t.warnings = append(t.warnings, Warning{
+			Line:   rt.line,
+			Column: rt.column,
+			Message: fmt.Sprintf("target %q collides with target %q written at [line %d col %d]; "+
+				"the value written last will win (use ! to overwrite explicitly)", rt.path, prev.path, prev.line, prev.column),
+		})
+	}
+
+	for _, dt := range t.dynamicTargets {
+		t.warnDynamicCollision(dt, rt)
+	}
+
+	t.rootTargets = append(t.rootTargets, rt)
+}
+
+// warnDynamicCollision adds a warning (in strict mode only) that the given dynamic output object may
+// collide with the given root target. The name of a dynamic output object is only known at runtime,
+// so it may collide with any root target.
+func (t *transpiler) warnDynamicCollision(dynamic, target rootTarget) {
+	if !t.strict || exclusive(dynamic, target) {
+		return
+	}
+	t.warnings = append(t.warnings, Warning{
+		Line:   dynamic.line,
+		Column: dynamic.column,
+		Message: fmt.Sprintf("dynamic output object may collide with target %q written at [line %d col %d], "+
+			"since its name is only known at runtime", target.path, target.line, target.column),
+	})
+}
+
+// isSegmentPrefix returns true iff prefix is equal to, or a parent path of, path.
+func isSegmentPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
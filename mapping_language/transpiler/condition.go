@@ -22,9 +22,15 @@ import (
 
 func (t *transpiler) VisitConditionBlock(ctx *parser.ConditionBlockContext) interface{} {
 	// Condition block is a composite of an If and optionally an else, with corresponding blocks.
+	block := t.conditionalBlocks
+	t.conditionalBlocks++
+	t.enterBranch(block, true)
 	ctx.IfBlock().Accept(t)
+	t.exitBranch()
 	if ctx.ElseBlock() != nil {
+		t.enterBranch(block, false)
 		ctx.ElseBlock().Accept(t)
+		t.exitBranch()
 	}
 
 	// IfBlock below pushes a condition (with its awareness of the condition subtree).
@@ -29,11 +29,19 @@ type env struct {
 	name   string
 	parent *env
 
+	// enclosing is the environment a lambda is written in. Unlike parent, inputs can not be read from
+	// it, since the lambda is called by name (e.g. by $CallFn) rather than from its enclosing
+	// environment. It is only used to explain why such reads fail.
+	enclosing *env
+
 	vars             stringset.Set
 	targets          stringset.Set
 	args             map[string]int
 	inputsFromParent map[string]int
 
+	// varTypes are the types of the values assigned to the vars so far, if type checking.
+	varTypes map[string]valueType
+
 	// requiredArgs stores the names of arguments that are required for the projector. It is a subset of the projector arguments.
 	requiredArgs []string
 
@@ -137,6 +145,28 @@ func (n *env) readInput(input, field string) *mpb.ValueSource {
 	return nil
 }
 
+// binds returns true iff the given input is bound in this environment or any of its parents. Unlike
+// readInput, it does not record the input as read from the parents.
+func (n *env) binds(input string) bool {
+	for e := n; e != nil; e = e.parent {
+		if _, ok := e.args[input]; ok || e.vars.Contains(input) || e.targets.Contains(input) {
+			return true
+		}
+	}
+	return false
+}
+
+// lambda returns the environment of the lambda this environment is (or is nested in), or nil if it
+// is not in one.
+func (n *env) lambda() *env {
+	for e := n; e != nil; e = e.parent {
+		if e.enclosing != nil {
+			return e
+		}
+	}
+	return nil
+}
+
 // generateProjector creates a ProjectorDefinition from the current environment.
 func (n *env) generateProjector() *mpb.ProjectorDefinition {
 	result := &mpb.ProjectorDefinition{
@@ -157,6 +187,9 @@ func (n *env) generateProjector() *mpb.ProjectorDefinition {
 		}
 	}
 
+	// This needs to match the arguments passed by generateCallsite.
+	result.ArgCount = int32(len(n.args) + len(n.inputsFromParent))
+
 	return result
 }
 
@@ -16,6 +16,7 @@ package transpiler
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
 	"github.com/antlr/antlr4/runtime/Go/antlr" /* copybara-comment: antlr */
@@ -107,24 +108,41 @@ func (t *transpiler) VisitExprBiOp(ctx *parser.ExprBiOpContext) interface{} {
 	rhs := ctx.Expression(1).Accept(t).(*mpb.ValueSource)
 
 	// Simplify if possible, and return the ValueSource.
-	return projectAndSimplify(proj, lhs, rhs)
+	vs := projectAndSimplify(proj, lhs, rhs)
+	t.checkTypes(ctx, vs)
+	return vs
 }
 
 func (t *transpiler) VisitExprProjection(ctx *parser.ExprProjectionContext) interface{} {
+	return t.projection(ctx, ctx.ProjectorName(), ctx.ArrayMod(), ctx.AllArgument())
+}
+
+// projection transpiles a call of the named projector (iterated if arrayMod is not nil) with the
+// given arguments, either in an expression or as a statement (see VisitCallStatement).
+func (t *transpiler) projection(ctx antlr.ParserRuleContext, name parser.IProjectorNameContext, arrayMod parser.IArrayModContext, args []parser.IArgumentContext) *mpb.ValueSource {
 	arrMod := ""
-	if ctx.ArrayMod() != nil {
-		arrMod = ctx.ArrayMod().GetText()
+	if arrayMod != nil {
+		arrMod = arrayMod.GetText()
 	}
 
 	vs := &mpb.ValueSource{
-		Projector: getTokenText(ctx.TOKEN()) + arrMod,
+		Projector: name.Accept(t).(string) + arrMod,
 	}
+	t.recordCall(ctx, vs.Projector)
 
-	for i := range ctx.AllExpression() {
-		source := ctx.Expression(i).Accept(t).(*mpb.ValueSource)
+	filtered, iterated := false, 0
+	for i, arg := range args {
+		source := arg.Accept(t).(*mpb.ValueSource)
+		if arg.(*parser.ArgumentContext).Filter() != nil {
+			filtered = true
+		}
+		if isIterated(source) {
+			iterated++
+		}
 
 		if i == 0 {
-			if source.Projector == "" {
+			// Spread sources are always wrapped, so that the flag is not lost.
+			if source.Projector == "" && !source.Spread {
 				vs.Source = source.Source
 			} else {
 				vs.Source = &mpb.ValueSource_ProjectedValue{
@@ -136,10 +154,47 @@ func (t *transpiler) VisitExprProjection(ctx *parser.ExprProjectionContext) inte
 
 		vs.AdditionalArg = append(vs.AdditionalArg, source)
 	}
+	if filtered && iterated > 1 {
+		// The elements of the other iterated arguments would no longer line up with the filtered ones.
+		t.fail(ctx, fmt.Errorf("where can only filter the iterated argument of a call that iterates no other argument, since their elements would no longer line up"))
+	}
+	t.checkTypes(ctx, vs)
 
 	return vs
 }
 
+// VisitProjectorName returns the name of a called projector, qualified with its namespace (e.g.
+// acme::$ChecksumMRN) if it has one.
+func (t *transpiler) VisitProjectorName(ctx *parser.ProjectorNameContext) interface{} {
+	var parts []string
+	for _, tok := range ctx.AllTOKEN() {
+		parts = append(parts, getTokenText(tok))
+	}
+	return strings.Join(parts, namespaceSeparator)
+}
+
+// VisitArgument transpiles a single argument at a call site. A spread argument (followed by ...)
+// is marked so that the engine passes its items as individual arguments. An iterated argument with
+// a where clause is filtered (see filterIterated). A lambda argument is passed as the name of the
+// projector generated for it.
+func (t *transpiler) VisitArgument(ctx *parser.ArgumentContext) interface{} {
+	if ctx.Lambda() != nil {
+		return ctx.Lambda().Accept(t)
+	}
+
+	source := ctx.Expression().Accept(t).(*mpb.ValueSource)
+
+	if ctx.SPREAD() != nil && ctx.SPREAD().GetText() != "" {
+		source.Spread = true
+	}
+
+	if ctx.Filter() != nil {
+		return t.filterIterated(ctx, source)
+	}
+
+	return source
+}
+
 func (t *transpiler) VisitListInitialization(ctx *parser.ListInitializationContext) interface{} {
 	vs := &mpb.ValueSource{
 		Projector: listInitializationProjector,
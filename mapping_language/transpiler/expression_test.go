@@ -84,6 +84,37 @@ func TestVisitExprProjection(t *testing.T) {
 				Projector: "Function",
 			},
 		},
+		{
+			name:  "multi arg call with trailing comma",
+			input: "Function(arg1, 3.14,)",
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg: 1,
+					},
+				},
+				AdditionalArg: []*mpb.ValueSource{
+					{
+						Source: &mpb.ValueSource_ConstFloat{
+							ConstFloat: 3.14,
+						},
+					},
+				},
+				Projector: "Function",
+			},
+		},
+		{
+			name:  "call with block comment",
+			input: "Function(arg1 /* , 3.14 */)",
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg: 1,
+					},
+				},
+				Projector: "Function",
+			},
+		},
 		{
 			name:  "chained call with brackets",
 			input: "OtherFunc(Function(arg1, 3.14))",
@@ -108,6 +139,61 @@ func TestVisitExprProjection(t *testing.T) {
 				Projector: "OtherFunc",
 			},
 		},
+		{
+			name:  "spread first arg",
+			input: "Function(arg1...)",
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_ProjectedValue{
+					ProjectedValue: &mpb.ValueSource{
+						Source: &mpb.ValueSource_FromInput{
+							FromInput: &mpb.ValueSource_InputSource{
+								Arg: 1,
+							},
+						},
+						Spread: true,
+					},
+				},
+				Projector: "Function",
+			},
+		},
+		{
+			name:  "spread additional arg",
+			input: `Function(" ", arg1...)`,
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_ConstString{
+					ConstString: " ",
+				},
+				AdditionalArg: []*mpb.ValueSource{
+					{
+						Source: &mpb.ValueSource_FromInput{
+							FromInput: &mpb.ValueSource_InputSource{
+								Arg: 1,
+							},
+						},
+						Spread: true,
+					},
+				},
+				Projector: "Function",
+			},
+		},
+		{
+			name:  "spread call result",
+			input: "Function(Other(arg1)...)",
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_ProjectedValue{
+					ProjectedValue: &mpb.ValueSource{
+						Source: &mpb.ValueSource_FromInput{
+							FromInput: &mpb.ValueSource_InputSource{
+								Arg: 1,
+							},
+						},
+						Projector: "Other",
+						Spread:    true,
+					},
+				},
+				Projector: "Function",
+			},
+		},
 	}
 
 	tp := &transpiler{}
@@ -164,6 +250,20 @@ func TestVisitListInitialization(t *testing.T) {
 				Projector: listInitializationProjector,
 			},
 		},
+		{
+			name:  "list with trailing comma",
+			input: "[3,]",
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_ProjectedValue{
+					ProjectedValue: &mpb.ValueSource{
+						Source: &mpb.ValueSource_ConstFloat{
+							ConstFloat: 3,
+						},
+					},
+				},
+				Projector: listInitializationProjector,
+			},
+		},
 		{
 			name:  "list with arg and const",
 			input: "[arg1, 3.14]",
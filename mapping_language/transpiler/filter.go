@@ -15,6 +15,9 @@
 package transpiler
 
 import (
+	"fmt"
+	"strings"
+
 	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
 )
@@ -26,3 +29,55 @@ func (t *transpiler) VisitInlineFilter(ctx *parser.InlineFilterContext) interfac
 func (t *transpiler) VisitFilter(ctx *parser.FilterContext) interface{} {
 	return ctx.Expression().Accept(t).(*mpb.ValueSource)
 }
+
+// filterIterated returns the given iterated argument of a call (e.g. obx[]) filtered by the where
+// clause of the argument (e.g. obx[] where $IsNotNil($.value)), so that the call is skipped for the
+// elements that do not match. It is transpiled like the inline filter obx[where ...][], and the
+// element is read as $ in the clause.
+func (t *transpiler) filterIterated(ctx *parser.ArgumentContext, arg *mpb.ValueSource) *mpb.ValueSource {
+	if !isIterated(arg) {
+		t.fail(ctx, fmt.Errorf("where can only filter an iterated argument, e.g. Build(obx[] where $.value ~= \"\")"))
+	}
+
+	filter := ctx.Filter()
+	filterEnv := t.environment.newChild(fmt.Sprintf("$filter_%d_%d", filter.GetStart().GetLine(), filter.GetStart().GetColumn()), []string{foreachElementInputName}, []string{})
+	t.pushEnv(filterEnv)
+	t.environment.addMapping(&mpb.FieldMapping{
+		Condition: filter.Accept(t).(*mpb.ValueSource),
+		Target: &mpb.FieldMapping_TargetField{
+			TargetField: ".",
+		},
+		ValueSource: t.environment.readInput(foreachElementInputName, ""),
+	})
+	t.projectors = append(t.projectors, t.environment.generateProjector())
+	t.popEnv()
+
+	cs, err := filterEnv.generateCallsite(arg)
+	if err != nil {
+		t.fail(ctx, fmt.Errorf("unable to generate filter callsite: %v", err))
+	}
+	// Iterate the filtered elements.
+	cs.Projector += "[]"
+
+	return cs
+}
+
+// isIterated returns true iff the given argument of a call is iterated (e.g. obx[] or Build(x)[]).
+func isIterated(arg *mpb.ValueSource) bool {
+	if arg.GetProjector() != "" {
+		return strings.HasSuffix(arg.GetProjector(), "[]")
+	}
+
+	var selector string
+	switch s := arg.GetSource().(type) {
+	case *mpb.ValueSource_FromInput:
+		selector = s.FromInput.GetField()
+	case *mpb.ValueSource_FromLocalVar:
+		selector = s.FromLocalVar
+	case *mpb.ValueSource_FromDestination:
+		selector = s.FromDestination
+	case *mpb.ValueSource_FromGlobal:
+		selector = s.FromGlobal
+	}
+	return strings.HasSuffix(selector, "[]")
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transpiler
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
+	"bitbucket.org/creachadair/stringset" /* copybara-comment: stringset */
+
+	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// lambdaNameFormat is the format of the names of the projectors of lambdas, from the file name (if
+// any) and the line and column of the lambda, so that the lambdas of different files loaded into one
+// registry do not collide. Unlike builtins, the names do not start with $, and unlike the names of
+// projectors, they are not identifiers, so they can not collide with either.
+const lambdaNameFormat = "lambda<%s%d:%d>"
+
+// VisitLambda transpiles a lambda argument, e.g. $x => $x.system = "MRN", into a projector of its own
+// with the lambda's parameters as arguments, returning its name. Since the name is what is passed,
+// the projector is called by whichever function it is passed to, not from where it is written, so
+// the lambda can only read its parameters (and $global), not the inputs or vars around it.
+func (t *transpiler) VisitLambda(ctx *parser.LambdaContext) interface{} {
+	var params []string
+	seen := stringset.New()
+	for _, p := range ctx.LambdaParams().(*parser.LambdaParamsContext).AllTOKEN() {
+		name := getTokenText(p)
+		if seen.Contains(name) {
+			t.fail(ctx, fmt.Errorf("lambda parameter %q is declared more than once", name))
+		}
+		seen.Add(name)
+		params = append(params, name)
+	}
+
+	file := ""
+	if t.fileName != "" {
+		file = t.fileName + ":"
+	}
+	name := fmt.Sprintf(lambdaNameFormat, file, ctx.GetStart().GetLine(), ctx.GetStart().GetColumn())
+	lambdaEnv := newEnv(name, params, nil)
+	lambdaEnv.enclosing = t.environment
+
+	outer := t.environment
+	t.pushEnv(lambdaEnv)
+
+	t.environment.addMapping(&mpb.FieldMapping{
+		Target: &mpb.FieldMapping_TargetField{
+			TargetField: ".",
+		},
+		ValueSource: ctx.Expression().Accept(t).(*mpb.ValueSource),
+	})
+	t.projectors = append(t.projectors, t.environment.generateProjector())
+
+	t.popEnv()
+	t.environment = outer
+
+	return &mpb.ValueSource{
+		Source: &mpb.ValueSource_ConstString{
+			ConstString: name,
+		},
+	}
+}
@@ -15,6 +15,8 @@
 package transpiler
 
 import (
+	"fmt"
+
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
 
 	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
@@ -23,7 +25,9 @@ import (
 func (t *transpiler) VisitMapping(ctx *parser.MappingContext) interface{} {
 	// Mapping rule has 3 components: target, condition, source. Parse each with their rules and
 	// combine into a FieldMapping.
-	target := ctx.Target().Accept(t).(*mpb.FieldMapping).Target
+	tm := ctx.Target().Accept(t).(*mpb.FieldMapping)
+	target := tm.Target
+	t.recordRootTarget(ctx, target)
 
 	// If there is an existing condition stack, we first have to combine them with _And, then add
 	// the inline condition from this mapping if it exists.
@@ -39,11 +43,21 @@ func (t *transpiler) VisitMapping(ctx *parser.MappingContext) interface{} {
 	}
 
 	source := ctx.Expression().Accept(t).(*mpb.ValueSource)
+	if v, ok := target.(*mpb.FieldMapping_TargetLocalVar); ok {
+		t.recordVarType(v.TargetLocalVar, source)
+	}
+
+	// Globals are declared after their source, which can therefore not read them.
+	if g, ok := target.(*mpb.FieldMapping_TargetGlobal); ok {
+		t.declareGlobal(ctx, g.TargetGlobal, condition)
+	}
 
 	f := &mpb.FieldMapping{
 		Target:      target,
 		Condition:   condition,
 		ValueSource: source,
+		Required:    ctx.REQUIRED() != nil,
+		TargetKey:   tm.TargetKey,
 	}
 
 	// Register the mapping in the environment if applicable.
@@ -53,3 +67,46 @@ func (t *transpiler) VisitMapping(ctx *parser.MappingContext) interface{} {
 
 	return f
 }
+
+// discardProjector is the builtin that the results of call statements are passed to, which
+// returns null whatever its arguments are, so that nothing is written to the target of the mapping.
+const discardProjector = "$Void"
+
+// VisitCallStatement transpiles a call to a projector whose result is discarded, e.g.
+// CheckRequiredFields(input);, into a mapping of $Void of the call to $this. The call is still
+// evaluated (under the conditions of the enclosing blocks), but nothing is written.
+func (t *transpiler) VisitCallStatement(ctx *parser.CallStatementContext) interface{} {
+	call := t.projection(ctx, ctx.ProjectorName(), ctx.ArrayMod(), ctx.AllArgument())
+
+	f := &mpb.FieldMapping{
+		Target: &mpb.FieldMapping_TargetField{
+			TargetField: jsonThis,
+		},
+		Condition: t.conditionStackTop().and(),
+		ValueSource: &mpb.ValueSource{
+			Source: &mpb.ValueSource_ProjectedValue{
+				ProjectedValue: call,
+			},
+			Projector: discardProjector,
+		},
+	}
+
+	if t.environment != nil {
+		t.environment.addMapping(f)
+	}
+
+	return f
+}
+
+// declareGlobal declares the given global, which is assigned by a root mapping with the given
+// condition. Globals are assigned exactly once per record, so they can not be conditional or
+// assigned by more than one mapping.
+func (t *transpiler) declareGlobal(ctx *parser.MappingContext, name string, condition *mpb.ValueSource) {
+	if condition != nil {
+		t.fail(ctx, fmt.Errorf("global %s can not be assigned conditionally, use $If in its value instead", name))
+	}
+	if t.globals[name] {
+		t.fail(ctx, fmt.Errorf("global %s is already assigned, globals can only be assigned once", name))
+	}
+	t.globals[name] = true
+}
@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transpiler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
+)
+
+// namespaceSeparator separates the namespace of a projector from its name, as in the engine's
+// registry.
+const namespaceSeparator = "::"
+
+// useKeyword declares a used namespace. It is not a keyword of the grammar, so that fields can still
+// be named use.
+const useKeyword = "use"
+
+// usedNamespace is a namespace brought into scope with use "namespace", along with the declaration.
+type usedNamespace struct {
+	name string
+	ctx  *parser.UseNamespaceContext
+}
+
+// usedNamespaces returns the names of the namespaces declared as used in the given root. Each may
+// only be declared once.
+func (t *transpiler) usedNamespaces(ctx *parser.RootContext) []string {
+	var names []string
+	for _, d := range ctx.AllUseNamespace() {
+		decl := d.(*parser.UseNamespaceContext)
+		if kw := getTokenText(decl.TOKEN()); kw != useKeyword {
+			t.fail(decl, fmt.Errorf("unexpected %s, expected %s \"namespace\" or a mapping", kw, useKeyword))
+		}
+
+		raw := decl.STRING().GetText()
+		name, err := unescapeString(raw[1 : len(raw)-1])
+		if err != nil {
+			t.fail(decl, err)
+		}
+		if name == "" || strings.Contains(name, namespaceSeparator) {
+			t.fail(decl, fmt.Errorf("invalid namespace %q: it must be non-empty and can not contain %s", name, namespaceSeparator))
+		}
+		for _, u := range t.namespaces {
+			if u.name == name {
+				t.fail(decl, fmt.Errorf("namespace %q is already used on line %d", name, u.ctx.GetStart().GetLine()))
+			}
+		}
+
+		t.namespaces = append(t.namespaces, usedNamespace{name: name, ctx: decl})
+		names = append(names, name)
+	}
+	return names
+}
+
+// checkNamespaces fails if a projector of a used namespace, as listed in the given known projectors,
+// collides with a projector of another used namespace, a projector defined in the Whistle, or a
+// known projector without a namespace, as calls to it would be ambiguous. It returns the qualified
+// names of the projectors in scope through the used namespaces, by unqualified name.
+func (t *transpiler) checkNamespaces(known []string) map[string]string {
+	sorted := append([]string(nil), known...)
+	sort.Strings(sorted)
+
+	unqualified := make(map[string]bool)
+	byNamespace := make(map[string][]string)
+	for _, k := range sorted {
+		if i := strings.Index(k, namespaceSeparator); i >= 0 {
+			byNamespace[k[:i]] = append(byNamespace[k[:i]], k[i+len(namespaceSeparator):])
+		} else {
+			unqualified[k] = true
+		}
+	}
+
+	inScope := make(map[string]string)
+	origins := make(map[string]usedNamespace)
+	for _, u := range t.namespaces {
+		if len(byNamespace[u.name]) == 0 && len(known) > 0 {
+			t.warnings = append(t.warnings, Warning{
+				Line:    u.ctx.GetStart().GetLine(),
+				Column:  u.ctx.GetStart().GetColumn(),
+				Message: fmt.Sprintf("namespace %q has no known projectors", u.name),
+			})
+		}
+
+		for _, name := range byNamespace[u.name] {
+			qualified := u.name + namespaceSeparator + name
+			if prev, ok := origins[name]; ok {
+				t.fail(u.ctx, fmt.Errorf("projector %s collides with %s: namespaces %q (used on line %d) and %q (used on line %d) both bring %s into scope",
+					qualified, inScope[name], prev.name, prev.ctx.GetStart().GetLine(), u.name, u.ctx.GetStart().GetLine(), name))
+			}
+			if t.projectorNames[name] {
+				t.fail(u.ctx, fmt.Errorf("projector %s collides with the projector %s defined in this file, since namespace %q is used", qualified, name, u.name))
+			}
+			if unqualified[name] {
+				t.fail(u.ctx, fmt.Errorf("projector %s collides with the known projector %s, since namespace %q is used", qualified, name, u.name))
+			}
+			origins[name] = u
+			inScope[name] = qualified
+		}
+	}
+	return inScope
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transpiler
+
+import "fmt"
+
+// Options configure a call to Transpile. The zero value is valid, and transpiles a standalone
+// Whistle file without any strictness.
+type Options struct {
+	// FileName is the name of the file the Whistle came from. If set, it is included in errors and
+	// warnings.
+	FileName string
+
+	// ImportResolver loads other Whistle files referenced by the one being transpiled. Imports are
+	// not part of the language yet; this exists so that embedders can provide a resolver ahead of
+	// them, and is otherwise unused.
+	ImportResolver ImportResolver
+
+	// KnownProjectors are the names of projectors that are not defined in the Whistle being
+	// transpiled, but will be available when it runs (e.g. from libraries, or registered by the
+	// embedder). Calls to any other projector not defined in the Whistle produce a warning, which
+	// suggests the defined or known projectors the name may be a typo of. Names starting with $ are
+	// reserved for builtins and are only reported if KnownBuiltins is set.
+	KnownProjectors []string
+
+	// KnownBuiltins are the names of the builtins (starting with $) that will be available when the
+	// Whistle runs, e.g. types.Registry.Names of the registry it runs with. If set, calls to any
+	// other builtin produce a warning like calls to unknown projectors.
+	KnownBuiltins []string
+
+	// StrictMode makes warnings fail transpilation. This is intended for CI.
+	StrictMode bool
+
+	// TypeCheck adds warnings for comparisons and arithmetic whose arguments are of known types that
+	// can never work, e.g. $Eq(dob, 19700101) where dob was assigned a string, which is always false.
+	// Types are inferred from constants, calls to builtins (see BuiltinResultTypes) and the variables
+	// that are only assigned values of one such type; values of unknown type (like inputs) are never
+	// reported. A warning can be suppressed with a "// typecheck:ignore" comment at the end of its
+	// line or on the line before it.
+	TypeCheck bool
+
+	// BuiltinResultTypes are the types of the results of the builtins ("string", "number", "bool",
+	// "array" or "object") by name, e.g. types.Registry.ResultTypes of the registry the Whistle runs
+	// with. They are only used by TypeCheck; the results of the builtins not in it are of unknown
+	// type.
+	BuiltinResultTypes map[string]string
+}
+
+// ImportResolver returns the Whistle source for the given import path.
+type ImportResolver func(path string) (string, error)
+
+// Warning is a problem found in Whistle code that does not prevent it from being transpiled, but is
+// likely to be a mistake.
+type Warning struct {
+	// File is the Options.FileName of the transpiled Whistle.
+	File string
+
+	// Line and Column locate the offending code in the Whistle source, as in TranspilationError.
+	Line, Column int
+
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.File != "" {
+		return fmt.Sprintf("%s: [line %d col %d] %s", w.File, w.Line, w.Column, w.Message)
+	}
+	return fmt.Sprintf("[line %d col %d] %s", w.Line, w.Column, w.Message)
+}
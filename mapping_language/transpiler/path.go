@@ -17,10 +17,13 @@ package transpiler
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
 	"github.com/antlr/antlr4/runtime/Go/antlr" /* copybara-comment: antlr */
+
+	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
 )
 
 // identifierEscape is the quote escape character to use to indicate that an indentifier has special
@@ -29,13 +32,38 @@ const identifierEscape = "'"
 
 type pathSpec struct {
 	arg, field, index string
+
+	// optional holds the indices of the segments of field that are accessed optionally (e.g.
+	// foo?.bar), see InputSource.optional_segment.
+	optional []int32
+
+	// predicates select elements of the arrays along field (e.g. foo[?bar = "x"]), see
+	// InputSource.predicate.
+	predicates []*mpb.PathPredicate
+
+	// key is the key of the keyed append of a target path (e.g. foo[@bar.id]), whose [] it is in
+	// field, see FieldMapping.target_key.
+	key *mpb.ValueSource
 }
 
 // VisitTargetPath returns a pathSpec for the given TargetPathContext.
 func (t *transpiler) VisitTargetPath(ctx *parser.TargetPathContext) interface{} {
 	p := ctx.TargetPathHead().Accept(t).(pathSpec)
-	for i := range ctx.AllTargetPathSegment() {
-		p.field += ctx.TargetPathSegment(i).Accept(t).(string)
+	for _, s := range ctx.AllTargetPathSegment() {
+		seg := s.(*parser.TargetPathSegmentContext)
+		if k := seg.KeyedArrayMod(); k != nil {
+			if p.key != nil {
+				t.fail(seg, fmt.Errorf("a target can only have one keyed append ([@...])"))
+			}
+			// The engine keys the first [] of the target.
+			if strings.Contains(p.index+p.field, "[]") {
+				t.fail(seg, fmt.Errorf("a keyed append ([@...]) can not come after an append ([]) in the same target"))
+			}
+			p.key = k.(*parser.KeyedArrayModContext).Expression().Accept(t).(*mpb.ValueSource)
+			p.field += "[]"
+			continue
+		}
+		p.field += seg.Accept(t).(string)
 	}
 
 	if ctx.OWMOD() != nil && ctx.OWMOD().GetText() != "" {
@@ -111,9 +139,7 @@ func (t *transpiler) VisitTargetPathSegment(ctx *parser.TargetPathSegmentContext
 // VisitSourcePath returns a pathSpec for the given SourcePathContext.
 func (t *transpiler) VisitSourcePath(ctx *parser.SourcePathContext) interface{} {
 	p := ctx.SourcePathHead().Accept(t).(pathSpec)
-	for i := range ctx.AllSourcePathSegment() {
-		p.field += ctx.SourcePathSegment(i).Accept(t).(string)
-	}
+	p.field, p.optional, p.predicates = t.sourcePathSegments(ctx.AllSourcePathSegment(), 0)
 
 	// Only one of p.arg and p.index can be filled.
 	if (p.arg == "") == (p.index == "") {
@@ -147,11 +173,26 @@ func (t *transpiler) VisitSourcePathHead(ctx *parser.SourcePathHeadContext) inte
 		}
 	}
 
+	// THIS can only be read by the post-condition of a projector (see VisitEnsures).
+	if ctx.THIS() != nil && ctx.THIS().GetText() != "" {
+		return pathSpec{
+			arg: thisInputName,
+		}
+	}
+
+	// GLOBAL is read by readGlobal.
+	if ctx.GLOBAL() != nil && ctx.GLOBAL().GetText() != "" {
+		return pathSpec{
+			arg: ctx.GLOBAL().GetText(),
+		}
+	}
+
 	t.fail(ctx, fmt.Errorf("invalid source path head - no token or %s", rootEnvInputName))
 	return nil
 }
 
-// VisitSourcePathSegment returns a string of the SourcePathSegmentContext contents.
+// VisitSourcePathSegment returns a string of the SourcePathSegmentContext contents, without the
+// optional access marker (?).
 func (t *transpiler) VisitSourcePathSegment(ctx *parser.SourcePathSegmentContext) interface{} {
 	if ctx.TOKEN() != nil && ctx.TOKEN().GetText() != "" {
 		delim := ""
@@ -160,7 +201,69 @@ func (t *transpiler) VisitSourcePathSegment(ctx *parser.SourcePathSegmentContext
 		}
 		return delim + getTokenText(ctx.TOKEN())
 	}
-	return ctx.GetText()
+	return strings.TrimPrefix(ctx.GetText(), "?")
+}
+
+// sourcePathSegments returns the field made up of the given source path segments, along with the
+// indices of its segments that are accessed optionally and the predicates along it. The segments of
+// the field are numbered from the given one.
+func (t *transpiler) sourcePathSegments(segs []parser.ISourcePathSegmentContext, n int32) (string, []int32, []*mpb.PathPredicate) {
+	var field string
+	var optional []int32
+	var predicates []*mpb.PathPredicate
+	for _, s := range segs {
+		seg := s.(*parser.SourcePathSegmentContext)
+		// A predicate applies to the value read so far, and is not a segment of the field itself.
+		if seg.PathPredicate() != nil {
+			p := seg.PathPredicate().Accept(t).(*mpb.PathPredicate)
+			p.Segment = n
+			predicates = append(predicates, p)
+			continue
+		}
+
+		// Each other source path segment is exactly one segment of the field.
+		field += seg.Accept(t).(string)
+		if seg.NOTNIL() != nil {
+			optional = append(optional, n)
+		}
+		n++
+	}
+	return field, optional, predicates
+}
+
+// VisitPathPredicate returns a PathPredicate for the given PathPredicateContext, without its
+// segment, which is filled in by sourcePathSegments. The compared field is always read optionally,
+// so any optional access markers in it are ignored.
+func (t *transpiler) VisitPathPredicate(ctx *parser.PathPredicateContext) interface{} {
+	field, _, predicates := t.sourcePathSegments(ctx.AllSourcePathSegment(), 1)
+	p := &mpb.PathPredicate{
+		Field:     getTokenText(ctx.TOKEN()) + field,
+		Predicate: predicates,
+		All:       ctx.MUL() != nil,
+	}
+	if ctx.NEQ() != nil {
+		p.Op = mpb.PathPredicate_NEQ
+	}
+
+	v := ctx.PredicateValue().(*parser.PredicateValueContext)
+	switch {
+	case v.STRING() != nil:
+		raw := v.STRING().GetText()
+		s, err := unescapeString(raw[1 : len(raw)-1])
+		if err != nil {
+			t.fail(ctx, err)
+		}
+		p.Value = &mpb.PathPredicate_ConstString{ConstString: s}
+	case v.BOOL() != nil:
+		p.Value = &mpb.PathPredicate_ConstBool{ConstBool: v.BOOL().GetText() == "true"}
+	default:
+		f, err := strconv.ParseFloat(v.GetText(), 64)
+		if err != nil {
+			t.fail(ctx, err)
+		}
+		p.Value = &mpb.PathPredicate_ConstNum{ConstNum: f}
+	}
+	return p
 }
 
 var anyChar = regexp.MustCompile(".")
@@ -15,9 +15,46 @@
 package transpiler
 
 import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/mapping" /* copybara-comment: mapping */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
+
+	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
 )
 
+// pureKeyword declares a projector side-effect-free, as in pure def Name(...). It is not a keyword of
+// the grammar, so that fields can still be named pure.
+const pureKeyword = "pure"
+
+// ensuresKeyword introduces the post-condition of a projector, as in def Name(...) ensures $this.id.
+// It is not a keyword of the grammar, so that fields can still be named ensures.
+const ensuresKeyword = "ensures"
+
+// thisInputName is the input the post-condition of a projector reads its result from.
+const thisInputName = "$this"
+
+// declareProjectors records the names of all projectors defined in the given root (including an
+// inline post process projector) before any of them are transpiled, so that projectors can be
+// called before they are defined, and can call each other. A name can only be defined once.
+func (t *transpiler) declareProjectors(ctx *parser.RootContext) {
+	var defs []parser.IProjectorDefContext
+	if pp, ok := ctx.PostProcess().(*parser.PostProcessInlineContext); ok {
+		defs = append(defs, pp.ProjectorDef())
+	}
+	defs = append(defs, ctx.AllProjectorDef()...)
+
+	lines := make(map[string]int)
+	for _, d := range defs {
+		name := getTokenText(d.(*parser.ProjectorDefContext).TOKEN())
+		if line, ok := lines[name]; ok {
+			t.fail(d, fmt.Errorf("projector %s is already defined on line %d", name, line))
+		}
+		lines[name] = d.GetStart().GetLine()
+		t.projectorNames[name] = true
+	}
+}
+
 func (t *transpiler) VisitProjectorDef(ctx *parser.ProjectorDefContext) interface{} {
 	var aliases []string
 	var requiredArgs []string
@@ -34,8 +71,53 @@ func (t *transpiler) VisitProjectorDef(ctx *parser.ProjectorDefContext) interfac
 	ctx.Block().Accept(t)
 
 	proj := t.environment.generateProjector()
+	if m := ctx.ProjectorModifier(); m != nil {
+		if kw := getTokenText(m.(*parser.ProjectorModifierContext).TOKEN()); kw != pureKeyword {
+			t.fail(m, fmt.Errorf("unexpected %s before def, expected %s", kw, pureKeyword))
+		}
+		proj.Pure = true
+		t.pureProjectors[proj.Name] = ctx
+	}
 
 	t.popEnv()
 
+	if e := ctx.Ensures(); e != nil {
+		proj.Ensures = e.Accept(t).(*mpb.ValueSource)
+		expr := e.(*parser.EnsuresContext).Expression()
+		proj.EnsuresText = expr.GetStart().GetInputStream().GetTextFromTokens(expr.GetStart(), expr.GetStop())
+	}
+
 	return proj
 }
+
+// VisitEnsures returns the post-condition of a projector. It is transpiled in an environment of its
+// own, where the only input is the result of the projector, $this.
+func (t *transpiler) VisitEnsures(ctx *parser.EnsuresContext) interface{} {
+	if kw := getTokenText(ctx.TOKEN()); kw != ensuresKeyword {
+		t.fail(ctx, fmt.Errorf("unexpected %s after the arguments of def, expected %s or a block", kw, ensuresKeyword))
+	}
+
+	outer := t.environment
+	t.pushEnv(newEnv(fmt.Sprintf("$ensures_%d_%d", ctx.GetStart().GetLine(), ctx.GetStart().GetColumn()), []string{thisInputName}, nil))
+	vs := ctx.Expression().Accept(t).(*mpb.ValueSource)
+	t.popEnv()
+	t.environment = outer
+
+	return vs
+}
+
+// checkPurity fails if a projector declared pure writes to anything but its own output and
+// variables, or calls an impure builtin, directly or through the projectors it calls (see
+// mapping.CheckPurity).
+func (t *transpiler) checkPurity(mp *mpb.MappingConfig) {
+	if len(t.pureProjectors) == 0 {
+		return
+	}
+	projectors := append([]*mpb.ProjectorDefinition{}, mp.GetProjector()...)
+	if pp := mp.GetPostProcessProjectorDefinition(); pp != nil {
+		projectors = append(projectors, pp)
+	}
+	if err := mapping.CheckPurity(projectors, nil); err != nil {
+		t.fail(t.pureProjectors[err.(mapping.PurityError).Projector], err)
+	}
+}
@@ -15,6 +15,9 @@
 package transpiler
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
 
 	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
@@ -30,23 +33,34 @@ const (
 func (t *transpiler) VisitRoot(ctx *parser.RootContext) interface{} {
 	program := &mpb.MappingConfig{}
 
+	t.declareProjectors(ctx)
+
 	// Parse each root item with its corresponding rule and add them to the MappingConfig.
 
 	if ctx.PostProcess() != nil {
 		program = ctx.PostProcess().Accept(t).(*mpb.MappingConfig)
 	}
 
-	t.environment = newEnv("", []string{rootEnvInputName}, []string{})
+	inputs := t.rootInputNames(ctx)
+	program.RootInputName = inputs
+	program.UseNamespace = t.usedNamespaces(ctx)
+
+	// The named inputs are passed to the root mappings after the whole input.
+	t.environment = newEnv("", append([]string{rootEnvInputName}, inputs...), []string{})
 
 	// TODO: Remove this env and the callsite after sunset.
 	t.environment.args[legacyRootEnvInputName] = t.environment.args[rootEnvInputName]
 
+	t.inRootMappings = true
 	for i := range ctx.AllMapping() {
 		ctx.Mapping(i).Accept(t)
 	}
+	t.inRootMappings = false
 
+	docs := projectorDocs(ctx)
 	for i := range ctx.AllProjectorDef() {
 		p := ctx.ProjectorDef(i).Accept(t).(*mpb.ProjectorDefinition)
+		p.Description = docs[ctx.ProjectorDef(i)]
 		program.Projector = append(program.Projector, p)
 	}
 
@@ -56,7 +70,56 @@ func (t *transpiler) VisitRoot(ctx *parser.RootContext) interface{} {
 	return program
 }
 
+// rootInputNames returns the names of the named inputs of the root mappings, as declared with
+// root(...). They may only be declared once.
+func (t *transpiler) rootInputNames(ctx *parser.RootContext) []string {
+	decls := ctx.AllRootInputs()
+	if len(decls) == 0 {
+		return nil
+	}
+	if len(decls) > 1 {
+		t.fail(decls[1], fmt.Errorf("the inputs of the root mappings can only be declared once"))
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, tok := range decls[0].(*parser.RootInputsContext).AllTOKEN() {
+		name := tok.GetText()
+		if seen[name] {
+			t.fail(decls[0], fmt.Errorf("input %s is declared more than once", name))
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// projectorDocs returns the doc comments of the projector definitions in the given root, i.e. the
+// lines of the comments directly preceding them (without a blank line in between), with the // and
+// a single space after it removed.
+func projectorDocs(ctx *parser.RootContext) map[parser.IProjectorDefContext]string {
+	docs := make(map[parser.IProjectorDefContext]string)
+	var lines []string
+	for _, c := range ctx.GetChildren() {
+		switch c := c.(type) {
+		case *parser.CommentContext:
+			line := strings.TrimPrefix(c.COMMENT().GetText(), "//")
+			lines = append(lines, strings.TrimRight(strings.TrimPrefix(line, " "), " \t\r"))
+		case *parser.ProjectorDefContext:
+			if len(lines) > 0 {
+				docs[c] = strings.Join(lines, "\n")
+			}
+			lines = nil
+		default:
+			lines = nil
+		}
+	}
+	return docs
+}
+
 func (t *transpiler) VisitPostProcessName(ctx *parser.PostProcessNameContext) interface{} {
+	t.recordCall(ctx, getTokenText(ctx.TOKEN()))
+
 	return &mpb.MappingConfig{
 		PostProcess: &mpb.MappingConfig_PostProcessProjectorName{
 			PostProcessProjectorName: getTokenText(ctx.TOKEN()),
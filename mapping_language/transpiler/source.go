@@ -13,12 +13,21 @@
 // limitations under the License.
 
 // Package transpiler contains an implementation of a Whistle Tree Visitor that produces a Whistler Program.
+//
+// Embedders should use Transpile:
+//
+//   config, warnings, err := transpiler.Transpile(src, transpiler.Options{FileName: "patient.wstl"})
+//
+// Warnings describe code that is valid but likely to be a mistake; Options.StrictMode turns them
+// into an error.
 package transpiler
 
 import (
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
 
@@ -29,6 +38,9 @@ const (
 	// foreachElementVarName is the name of the input that can be used to access the current array item
 	// in an array filter.
 	foreachElementInputName = "$"
+
+	// globalInputName is the name of the input that globals are read from, e.g. $global.patientId.
+	globalInputName = "$global"
 )
 
 func (t *transpiler) VisitSourceConstNum(ctx *parser.SourceConstNumContext) interface{} {
@@ -60,7 +72,9 @@ func (t *transpiler) VisitSourceInput(ctx *parser.SourceInputContext) interface{
 
 	var vs *mpb.ValueSource
 
-	if (p.arg == "" && p.index != "") || ctx.DEST() != nil {
+	if p.arg == globalInputName {
+		vs = t.readGlobal(ctx, p)
+	} else if (p.arg == "" && p.index != "") || ctx.DEST() != nil {
 		// Index targets may not be known in the environment since they are not declared.
 		vs = &mpb.ValueSource{
 			Source: &mpb.ValueSource_FromDestination{
@@ -70,9 +84,29 @@ func (t *transpiler) VisitSourceInput(ctx *parser.SourceInputContext) interface{
 	} else if vs = t.environment.readVar(p.arg+p.index, p.field); ctx.VAR() != nil && vs == nil {
 		t.fail(ctx, fmt.Errorf("unable to find variable %q", p.arg))
 	} else if vs = t.environment.readInput(p.arg+p.index, p.field); vs == nil {
+		if l := t.environment.lambda(); l != nil && l.enclosing.binds(p.arg+p.index) {
+			t.fail(ctx, fmt.Errorf("lambda can not capture %q from the function it is written in, pass it to the lambda as an argument instead", p.arg+p.index))
+		}
+		if p.arg == thisInputName {
+			t.fail(ctx, fmt.Errorf("%s can only be read in the post-condition of a function (def Name(...) ensures ...)", thisInputName))
+		}
 		t.fail(ctx, fmt.Errorf("unable to find input %q", p.arg))
 	}
 
+	if len(p.optional) > 0 {
+		if vs.GetFromInput() == nil {
+			t.fail(ctx, fmt.Errorf("optional access (?. or ?[) is only supported on inputs, not on vars or dest"))
+		}
+		vs.GetFromInput().OptionalSegment = p.optional
+	}
+
+	if len(p.predicates) > 0 {
+		if vs.GetFromInput() == nil {
+			t.fail(ctx, fmt.Errorf("array predicates ([?...]) are only supported on inputs, not on vars, dest or globals"))
+		}
+		vs.GetFromInput().Predicate = p.predicates
+	}
+
 	if ctx.InlineFilter() != nil {
 		lambdaEnv := t.environment.newChild(fmt.Sprintf("$filter_%d_%d", ctx.GetStart().GetLine(), ctx.GetStart().GetColumn()), []string{foreachElementInputName}, []string{})
 		t.pushEnv(lambdaEnv)
@@ -100,13 +134,45 @@ func (t *transpiler) VisitSourceInput(ctx *parser.SourceInputContext) interface{
 	return vs
 }
 
+// readGlobal returns a ValueSource reading the global (and field of it) of the given $global path.
+// Root mappings can only read the globals assigned before them. Projectors can read any global,
+// since they may be called after it is assigned; reading it earlier is an error at runtime.
+func (t *transpiler) readGlobal(ctx *parser.SourceInputContext, p pathSpec) *mpb.ValueSource {
+	if ctx.VAR() != nil || ctx.DEST() != nil {
+		t.fail(ctx, fmt.Errorf("%s can not be read with var or dest", globalInputName))
+	}
+
+	segs := ctx.SourcePath().(*parser.SourcePathContext).AllSourcePathSegment()
+	if len(segs) == 0 || segs[0].(*parser.SourcePathSegmentContext).TOKEN() == nil {
+		t.fail(ctx, fmt.Errorf("expected the name of a global after %s, e.g. %s.patientId", globalInputName, globalInputName))
+	}
+	name := getTokenText(segs[0].(*parser.SourcePathSegmentContext).TOKEN())
+	if t.inRootMappings && !t.globals[name] {
+		t.fail(ctx, fmt.Errorf("global %s is read before it is assigned, root mappings can only read the globals assigned by the root mappings before them", name))
+	}
+
+	return &mpb.ValueSource{
+		Source: &mpb.ValueSource_FromGlobal{
+			FromGlobal: strings.TrimPrefix(p.field, "."),
+		},
+	}
+}
+
 func (t *transpiler) VisitSourceConstStr(ctx *parser.SourceConstStrContext) interface{} {
-	// Strip quotes from string.
-	text := ctx.STRING().GetText()[1 : len(ctx.STRING().GetText())-1]
-	// Replace escaped quotes.
-	text = strings.ReplaceAll(text, `\"`, `"`)
-	// Replace escaped backslashes
-	text = strings.ReplaceAll(text, `\\`, `\`)
+	var text string
+	if ctx.MULTILINE_STRING() != nil {
+		// Strip triple quotes, and normalize line endings so the value does not depend on the OS the
+		// mapping was written on.
+		raw := ctx.MULTILINE_STRING().GetText()
+		text = strings.ReplaceAll(raw[3:len(raw)-3], "\r\n", "\n")
+	} else {
+		// Strip quotes from string.
+		raw := ctx.STRING().GetText()
+		var err error
+		if text, err = unescapeString(raw[1 : len(raw)-1]); err != nil {
+			t.fail(ctx, err)
+		}
+	}
 	return &mpb.ValueSource{
 		Source: &mpb.ValueSource_ConstString{
 			ConstString: text,
@@ -114,6 +180,83 @@ func (t *transpiler) VisitSourceConstStr(ctx *parser.SourceConstStrContext) inte
 	}
 }
 
+// unescapeString decodes the escape sequences allowed in (non triple quoted) string constants.
+// These are the same as in JSON: \" \\ \/ \b \f \n \r \t and \uXXXX, where UTF-16 surrogate
+// pairs like \ud83d\ude00 are combined into a single character.
+func unescapeString(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("string %q ends with an unterminated escape sequence", s)
+		}
+		i++
+		switch s[i] {
+		case '"', '\\', '/':
+			sb.WriteByte(s[i])
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'u':
+			r, n, err := unescapeUnicode(s[i-1:])
+			if err != nil {
+				return "", err
+			}
+			sb.WriteRune(r)
+			i += n - 2
+		default:
+			return "", fmt.Errorf("unknown escape sequence \\%c in string %q", s[i], s)
+		}
+	}
+	return sb.String(), nil
+}
+
+// unescapeUnicode decodes the \uXXXX escape (or surrogate pair of them) at the start of s,
+// returning the rune and the number of bytes of s it took up.
+func unescapeUnicode(s string) (rune, int, error) {
+	hex := func(s string) (rune, error) {
+		if len(s) < 6 || s[0] != '\\' || s[1] != 'u' {
+			return 0, fmt.Errorf("invalid unicode escape sequence %q", s)
+		}
+		v, err := strconv.ParseUint(s[2:6], 16, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid unicode escape sequence %q", s[:6])
+		}
+		return rune(v), nil
+	}
+
+	r, err := hex(s)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !utf16.IsSurrogate(r) {
+		return r, 6, nil
+	}
+
+	low, err := hex(s[6:])
+	if err != nil {
+		return 0, 0, fmt.Errorf("unpaired surrogate in unicode escape sequence %q", s[:6])
+	}
+	if pair := utf16.DecodeRune(r, low); pair != utf8.RuneError {
+		return pair, 12, nil
+	}
+	return 0, 0, fmt.Errorf("invalid surrogate pair in unicode escape sequence %q", s[:12])
+}
+
 func (t *transpiler) VisitSourceConstBool(ctx *parser.SourceConstBoolContext) interface{} {
 	return &mpb.ValueSource{
 		Source: &mpb.ValueSource_ConstBool{
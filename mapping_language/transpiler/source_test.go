@@ -0,0 +1,233 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transpiler
+
+import (
+	"testing"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr" /* copybara-comment: antlr */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
+
+	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+func TestUnescapeString(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "no escapes",
+			in:   `plain text`,
+			want: "plain text",
+		},
+		{
+			name: "quotes and backslashes",
+			in:   `C:\\path\\to \"file\"`,
+			want: `C:\path\to "file"`,
+		},
+		{
+			name: "escaped backslash before letter",
+			in:   `\\n`,
+			want: `\n`,
+		},
+		{
+			name: "control characters",
+			in:   `a\tb\nc\rd\be\ff\/g`,
+			want: "a\tb\nc\rd\be\ff/g",
+		},
+		{
+			name: "unicode",
+			in:   `caf\u00e9 \u00E9`,
+			want: "café é",
+		},
+		{
+			name: "surrogate pair",
+			in:   `\ud83d\ude00!`,
+			want: "😀!",
+		},
+		{
+			name:    "unpaired surrogate",
+			in:      `\ud83d!`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid surrogate pair",
+			in:      `\ud83d\u0041`,
+			wantErr: true,
+		},
+		{
+			name:    "short unicode escape",
+			in:      `\u00e`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown escape",
+			in:      `\q`,
+			wantErr: true,
+		},
+		{
+			name:    "trailing backslash",
+			in:      `abc\`,
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := unescapeString(test.in)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("unescapeString(%q) = %q, want error", test.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unescapeString(%q) returned unexpected error %v", test.in, err)
+			}
+			if got != test.want {
+				t.Errorf("unescapeString(%q) = %q, want %q", test.in, got, test.want)
+			}
+		})
+	}
+}
+
+func TestVisitSourceInput_Optional(t *testing.T) {
+	tests := []transpilerTest{
+		{
+			name:  "no optional segments",
+			input: "arg1.name[0].family",
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg:   1,
+						Field: ".name[0].family",
+					},
+				},
+			},
+		},
+		{
+			name:  "optional field and index",
+			input: "arg1?.name?[0].family",
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg:             1,
+						Field:           ".name[0].family",
+						OptionalSegment: []int32{0, 1},
+					},
+				},
+			},
+		},
+		{
+			name:  "optional wildcard and iteration",
+			input: "arg1.name?[*]?.family[]",
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg:             1,
+						Field:           ".name[*].family[]",
+						OptionalSegment: []int32{1, 2},
+					},
+				},
+			},
+		},
+	}
+
+	tp := &transpiler{}
+	tp.pushEnv(newEnv("", []string{"arg1"}, []string{}))
+	testRule(t, tests, tp, func(p *parser.WhistleParser) (antlr.ParseTree, string) {
+		return p.Expression(), "Expression"
+	})
+}
+
+func TestVisitSourceInput_Predicates(t *testing.T) {
+	tests := []transpilerTest{
+		{
+			name:  "first match",
+			input: `arg1.identifier[?type.coding[0].code = "MR"].value`,
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg:   1,
+						Field: ".identifier.value",
+						Predicate: []*mpb.PathPredicate{{
+							Segment: 1,
+							Field:   "type.coding[0].code",
+							Value:   &mpb.PathPredicate_ConstString{ConstString: "MR"},
+						}},
+					},
+				},
+			},
+		},
+		{
+			name:  "all matches not equal",
+			input: `arg1[*?rank ~= 1]?.value`,
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg:             1,
+						Field:           ".value",
+						OptionalSegment: []int32{0},
+						Predicate: []*mpb.PathPredicate{{
+							Field: "rank",
+							Op:    mpb.PathPredicate_NEQ,
+							Value: &mpb.PathPredicate_ConstNum{ConstNum: 1},
+							All:   true,
+						}},
+					},
+				},
+			},
+		},
+		{
+			name:  "nested predicates",
+			input: `arg1.identifier[*?type.coding[?system = "v2"].code = "MR"].period[?current = true].start`,
+			want: &mpb.ValueSource{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg:   1,
+						Field: ".identifier.period.start",
+						Predicate: []*mpb.PathPredicate{
+							{
+								Segment: 1,
+								Field:   "type.coding.code",
+								Predicate: []*mpb.PathPredicate{{
+									Segment: 2,
+									Field:   "system",
+									Value:   &mpb.PathPredicate_ConstString{ConstString: "v2"},
+								}},
+								Value: &mpb.PathPredicate_ConstString{ConstString: "MR"},
+								All:   true,
+							},
+							{
+								Segment: 2,
+								Field:   "current",
+								Value:   &mpb.PathPredicate_ConstBool{ConstBool: true},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	tp := &transpiler{}
+	tp.pushEnv(newEnv("", []string{"arg1"}, []string{}))
+	testRule(t, tests, tp, func(p *parser.WhistleParser) (antlr.ParseTree, string) {
+		return p.Expression(), "Expression"
+	})
+}
@@ -32,6 +32,9 @@ func (t *transpiler) VisitTargetVar(ctx *parser.TargetVarContext) interface{} {
 	if p.arg == "" {
 		t.fail(ctx, fmt.Errorf("expected a valid variable name (optionally followed by a path), but got %s", p.index+p.field))
 	}
+	if p.key != nil {
+		t.fail(ctx, errors.New("keyed appends ([@...]) can only target fields and root fields, not variables"))
+	}
 
 	if t.environment != nil {
 		if err := t.environment.declareVar(p.arg); err != nil {
@@ -54,6 +57,16 @@ func (t *transpiler) VisitTargetObj(ctx *parser.TargetObjContext) interface{} {
 	}
 }
 
+// VisitTargetDynamicObj returns a mapping to the output object named by the value of the given
+// expression, e.g. out(resourceType). The name is evaluated (and validated) at runtime.
+func (t *transpiler) VisitTargetDynamicObj(ctx *parser.TargetDynamicObjContext) interface{} {
+	return &mpb.FieldMapping{
+		Target: &mpb.FieldMapping_TargetDynamicObject{
+			TargetDynamicObject: ctx.Expression().Accept(t).(*mpb.ValueSource),
+		},
+	}
+}
+
 func (t *transpiler) VisitTargetRootField(ctx *parser.TargetRootFieldContext) interface{} {
 	p := ctx.TargetPath().Accept(t).(pathSpec)
 
@@ -67,13 +80,22 @@ func (t *transpiler) VisitTargetRootField(ctx *parser.TargetRootFieldContext) in
 		Target: &mpb.FieldMapping_TargetRootField{
 			TargetRootField: jsonutil.JoinPath(p.arg, p.index, p.field),
 		},
+		TargetKey: p.key,
 	}
 }
 
+// VisitTargetThis returns a mapping to the whole output of the current projector. Values written
+// to it are merged into the output, unless the overwrite modifier (!) is used, in which case they
+// replace it.
 func (t *transpiler) VisitTargetThis(ctx *parser.TargetThisContext) interface{} {
+	target := jsonThis
+	if ctx.OWMOD() != nil && ctx.OWMOD().GetText() != "" {
+		target += ctx.OWMOD().GetText()
+	}
+
 	return &mpb.FieldMapping{
 		Target: &mpb.FieldMapping_TargetField{
-			TargetField: jsonThis,
+			TargetField: target,
 		},
 	}
 }
@@ -87,5 +109,21 @@ func (t *transpiler) VisitTargetField(ctx *parser.TargetFieldContext) interface{
 		Target: &mpb.FieldMapping_TargetField{
 			TargetField: jsonutil.JoinPath(p.arg, p.index, p.field),
 		},
+		TargetKey: p.key,
+	}
+}
+
+// VisitTargetGlobal returns a mapping to a global of the input record. Only root mappings can
+// assign globals; the global is declared once the mapping is visited (see declareGlobal).
+func (t *transpiler) VisitTargetGlobal(ctx *parser.TargetGlobalContext) interface{} {
+	name := getTokenText(ctx.TOKEN())
+	if t.environment.name != "" {
+		t.fail(ctx, fmt.Errorf("global %s can only be assigned by a root mapping", name))
+	}
+
+	return &mpb.FieldMapping{
+		Target: &mpb.FieldMapping_TargetGlobal{
+			TargetGlobal: name,
+		},
 	}
 }
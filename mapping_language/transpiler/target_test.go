@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transpiler
+
+import (
+	"testing"
+
+	"github.com/antlr/antlr4/runtime/Go/antlr" /* copybara-comment: antlr */
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
+
+	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+func TestVisitTargetThis(t *testing.T) {
+	tests := []transpilerTest{
+		{
+			name:  "this",
+			input: "$this",
+			want: &mpb.FieldMapping{
+				Target: &mpb.FieldMapping_TargetField{
+					TargetField: ".",
+				},
+			},
+		},
+		{
+			name:  "this with overwrite",
+			input: "$this!",
+			want: &mpb.FieldMapping{
+				Target: &mpb.FieldMapping_TargetField{
+					TargetField: ".!",
+				},
+			},
+		},
+		{
+			name:  "deprecated this",
+			input: "<this>",
+			want: &mpb.FieldMapping{
+				Target: &mpb.FieldMapping_TargetField{
+					TargetField: ".",
+				},
+			},
+		},
+	}
+
+	tp := &transpiler{}
+	tp.pushEnv(newEnv("MyProjector", []string{}, []string{}))
+	testRule(t, tests, tp, func(p *parser.WhistleParser) (antlr.ParseTree, string) {
+		return p.Target(), "Target"
+	})
+}
+
+func TestVisitTarget_KeyedAppend(t *testing.T) {
+	tests := []transpilerTest{
+		{
+			name:  "field",
+			input: `allergy[@"a1"].severity`,
+			want: &mpb.FieldMapping{
+				Target: &mpb.FieldMapping_TargetField{
+					TargetField: "allergy[].severity",
+				},
+				TargetKey: &mpb.ValueSource{
+					Source: &mpb.ValueSource_ConstString{ConstString: "a1"},
+				},
+			},
+		},
+		{
+			name:  "root field keyed by argument",
+			input: "root allergy[@arg1.id]",
+			want: &mpb.FieldMapping{
+				Target: &mpb.FieldMapping_TargetRootField{
+					TargetRootField: "allergy[]",
+				},
+				TargetKey: &mpb.ValueSource{
+					Source: &mpb.ValueSource_FromInput{
+						FromInput: &mpb.ValueSource_InputSource{
+							Arg:   1,
+							Field: ".id",
+						},
+					},
+				},
+			},
+		},
+		{
+			name:  "nested array",
+			input: `entry[0].item[@"x"].code[]`,
+			want: &mpb.FieldMapping{
+				Target: &mpb.FieldMapping_TargetField{
+					TargetField: "entry[0].item[].code[]",
+				},
+				TargetKey: &mpb.ValueSource{
+					Source: &mpb.ValueSource_ConstString{ConstString: "x"},
+				},
+			},
+		},
+	}
+
+	tp := &transpiler{}
+	tp.pushEnv(newEnv("MyProjector", []string{"arg1"}, []string{}))
+	testRule(t, tests, tp, func(p *parser.WhistleParser) (antlr.ParseTree, string) {
+		return p.Target(), "Target"
+	})
+}
@@ -17,6 +17,7 @@ package transpiler
 import (
 	"fmt"
 	"runtime/debug"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/errors" /* copybara-comment: errors */
 	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
@@ -29,6 +30,54 @@ type transpiler struct {
 	environment    *env
 	projectors     []*mpb.ProjectorDefinition
 	conditionStack []valueStack
+
+	// rootTargets are the paths in the root output written to so far, used to detect collisions.
+	rootTargets []rootTarget
+
+	// dynamicTargets are the locations of the dynamic output objects (out(expr)) so far, whose names
+	// are only known at runtime.
+	dynamicTargets []rootTarget
+
+	// branches are the arms of the conditional blocks around the mapping being visited, outermost
+	// first, and conditionalBlocks is the number of conditional blocks visited so far.
+	branches          []branch
+	conditionalBlocks int
+
+	// strict is set in StrictMode, which also warns about targets that may collide at runtime.
+	strict bool
+
+	// fileName is Options.FileName, which the names of lambdas include.
+	fileName string
+
+	// calls are the projectors called so far, used to detect calls to unknown projectors.
+	calls []projectorCall
+
+	// pureProjectors are the definitions of the projectors declared pure, by name.
+	pureProjectors map[string]*parser.ProjectorDefContext
+
+	// projectorNames are the names of the projectors defined in the Whistle. They are collected
+	// before anything is transpiled, so that calls can refer to projectors defined further down.
+	projectorNames map[string]bool
+
+	// namespaces are the namespaces brought into scope with use "namespace", in declaration order.
+	namespaces []usedNamespace
+
+	// globals are the globals assigned by the root mappings so far.
+	globals map[string]bool
+
+	// inRootMappings is set while the root mappings are visited, which can only read the globals
+	// assigned by the root mappings before them.
+	inRootMappings bool
+
+	// typeCheck is set by Options.TypeCheck, with the result types of the builtins it uses.
+	typeCheck          bool
+	builtinResultTypes map[string]string
+
+	// typeWarnings are the warnings of the type checks, which can be suppressed by comments and are
+	// therefore only added to warnings once all the comments are known.
+	typeWarnings []Warning
+
+	warnings []Warning
 }
 
 func newTranspiler() *transpiler {
@@ -36,6 +85,9 @@ func newTranspiler() *transpiler {
 		conditionStack: []valueStack{
 			make(valueStack, 0),
 		},
+		globals:        make(map[string]bool),
+		projectorNames: make(map[string]bool),
+		pureProjectors: make(map[string]*parser.ProjectorDefContext),
 	}
 }
 
@@ -53,30 +105,88 @@ func (t *transpiler) conditionStackTop() *valueStack {
 	return &t.conditionStack[len(t.conditionStack)-1]
 }
 
-// Transpile converts the given Whistle into a Whistler mapping config.
-func Transpile(whistle string) (mp *mpb.MappingConfig, err error) {
+// Transpile converts the given Whistle into a Whistler mapping config. Along with the config, it
+// returns warnings about code that is valid but likely to be a mistake; in StrictMode these are
+// returned as an error instead.
+func Transpile(src string, opts Options) (mp *mpb.MappingConfig, warnings []Warning, err error) {
 	defer func() {
 		if rec := recover(); rec != nil {
-			err = fmt.Errorf("%v\n\n%s", rec, debug.Stack())
+			mp, warnings = nil, nil
+			if opts.FileName != "" {
+				err = fmt.Errorf("%s: %v\n\n%s", opts.FileName, rec, debug.Stack())
+			} else {
+				err = fmt.Errorf("%v\n\n%s", rec, debug.Stack())
+			}
 		}
 	}()
 
-	is := antlr.NewInputStream(whistle)
+	is := antlr.NewInputStream(src)
 
 	// Create the Lexer.
 	lexer := parser.NewWhistleLexer(is)
-	lexer.AddErrorListener(&errors.LexerListener{Code: whistle})
+	lexer.AddErrorListener(&errors.LexerListener{Code: src})
 
 	stream := antlr.NewCommonTokenStream(lexer, antlr.TokenDefaultChannel)
+	if err := checkBlockComments(stream); err != nil {
+		if opts.FileName != "" {
+			err = fmt.Errorf("%s: %w", opts.FileName, err)
+		}
+		return nil, nil, err
+	}
 
 	// Create the Parser.
 	p := parser.NewWhistleParser(stream)
-	p.AddErrorListener(&errors.ParserListener{Code: whistle})
+	p.AddErrorListener(&errors.ParserListener{Code: src})
+
+	t := newTranspiler()
+	t.strict = opts.StrictMode
+	t.fileName = opts.FileName
+	t.typeCheck = opts.TypeCheck
+	t.builtinResultTypes = opts.BuiltinResultTypes
 
 	// NOTE: explicitly specifying the type of transpiler is necessary so that the methods of
 	// the appropriate type, that implements the visitor interface, are invoked.
-	var transpiler parser.WhistleVisitor = newTranspiler()
+	var transpiler parser.WhistleVisitor = t
 
 	mp = p.Root().Accept(transpiler).(*mpb.MappingConfig)
-	return
+
+	t.checkCalls(opts.KnownProjectors, opts.KnownBuiltins, t.checkNamespaces(opts.KnownProjectors))
+	t.checkPurity(mp)
+	t.addTypeWarnings(stream.GetAllTokens())
+
+	for i := range t.warnings {
+		t.warnings[i].File = opts.FileName
+	}
+
+	if opts.StrictMode && len(t.warnings) > 0 {
+		var msgs []string
+		for _, w := range t.warnings {
+			msgs = append(msgs, w.String())
+		}
+		return nil, nil, fmt.Errorf("found %d problem(s) in strict mode:\n%s", len(t.warnings), strings.Join(msgs, "\n"))
+	}
+
+	return mp, t.warnings, nil
+}
+
+// checkBlockComments returns an error for the first block comment in the given tokens that is never
+// closed. Terminated block comments are hidden from the parser, so the parser would otherwise only
+// report an unexpected "/*".
+func checkBlockComments(stream *antlr.CommonTokenStream) error {
+	stream.Fill()
+	for _, tok := range stream.GetAllTokens() {
+		if tok.GetTokenType() == parser.WhistleLexerUNTERMINATED_BLOCK_COMMENT {
+			return errors.NewTranspilationError(tok.GetLine(), tok.GetColumn(), fmt.Errorf("unterminated block comment: /* has no matching */"))
+		}
+	}
+	return nil
+}
+
+// TranspileSource converts the given Whistle into a Whistler mapping config, discarding any
+// warnings.
+//
+// Deprecated: Use Transpile instead.
+func TranspileSource(whistle string) (*mpb.MappingConfig, error) {
+	mp, _, err := Transpile(whistle, Options{})
+	return mp, err
 }
@@ -17,7 +17,14 @@ package transpiler
 import (
 	"fmt"
 	"regexp"
+	"strings"
 	"testing"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/errors" /* copybara-comment: errors */
+	"github.com/google/go-cmp/cmp" /* copybara-comment: cmp */
+	"google.golang.org/protobuf/testing/protocmp" /* copybara-comment: protocmp */
+
+	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
 )
 
 func TestTranspileErrors(t *testing.T) {
@@ -46,12 +53,219 @@ func TestTranspileErrors(t *testing.T) {
 			whistle:         `root hello: FooFunc "world"`,
 			wantErrKeywords: []string{"parser error"},
 		},
+		{
+			name: "unterminated block comment",
+			whistle: `hello: "world"
+/* commented: "out"
+bye: "world"`,
+			wantErrKeywords: []string{"line 2 col 0", "unterminated block comment"},
+		},
+		{
+			name:            "double trailing comma in call",
+			whistle:         `hello: $StrCat("a", "b",,)`,
+			wantErrKeywords: []string{"parser error"},
+		},
+		{
+			name:            "only a comma in call",
+			whistle:         `hello: $StrCat(,)`,
+			wantErrKeywords: []string{"parser error"},
+		},
+		{
+			name:            "double trailing comma in list",
+			whistle:         `hello: ["a", "b",,]`,
+			wantErrKeywords: []string{"parser error"},
+		},
+		{
+			name: "duplicate root input",
+			whistle: `root(msg, msg)
+hello: msg.world`,
+			wantErrKeywords: []string{"msg", "more than once"},
+		},
+		{
+			name: "root inputs declared twice",
+			whistle: `root(msg)
+root(roster)
+hello: msg.world`,
+			wantErrKeywords: []string{"declared once"},
+		},
+		{
+			name: "global read before it is assigned",
+			whistle: `id: $global.patientId
+$global.patientId: $root.id`,
+			wantErrKeywords: []string{"patientId", "read before it is assigned"},
+		},
+		{
+			name:            "global read in its own value",
+			whistle:         `$global.patientId: $global.patientId`,
+			wantErrKeywords: []string{"patientId", "read before it is assigned"},
+		},
+		{
+			name: "global assigned twice",
+			whistle: `$global.patientId: $root.id
+$global.patientId: $root.mrn`,
+			wantErrKeywords: []string{"patientId", "already assigned"},
+		},
+		{
+			name:            "conditional global",
+			whistle:         `$global.patientId (if $root.id?): $root.id`,
+			wantErrKeywords: []string{"patientId", "conditionally"},
+		},
+		{
+			name: "global assigned in a function",
+			whistle: `def Patient(p) {
+  $global.patientId: p.id
+}`,
+			wantErrKeywords: []string{"patientId", "root mapping"},
+		},
+		{
+			name:            "global without a name",
+			whistle:         `id: $global`,
+			wantErrKeywords: []string{"name of a global"},
+		},
+		{
+			name: "projector defined twice",
+			whistle: `def Patient(p) {
+  id: p.id
+}
+
+def Patient(p) {
+  id: p.mrn
+}`,
+			wantErrKeywords: []string{"line 5", "Patient", "already defined on line 1"},
+		},
+		{
+			name: "projector and inline post process with the same name",
+			whistle: `post def Fix(result) {
+  fixed: result
+}
+
+def Fix(x) {
+  y: x
+}`,
+			wantErrKeywords: []string{"Fix", "already defined on line 1"},
+		},
+		{
+			name: "lambda capturing an argument",
+			whistle: `out Patient: Patient($root)
+
+def Patient(p) {
+  mrn: $CallFn(i => i.system = p.system, p.identifier)
+}`,
+			wantErrKeywords: []string{"line 4", "lambda", "capture", "p"},
+		},
+		{
+			name: "lambda capturing a var of a block",
+			whistle: `out Patient: {
+  var system: "MRN"
+  mrn: $CallFn((i) => {
+    value: i.value
+    system: system
+  }, $root.identifier)
+}`,
+			wantErrKeywords: []string{"line 5", "lambda", "capture", "system"},
+		},
+		{
+			name:            "lambda capturing the root input",
+			whistle:         `ids: $CallFn(i => $root.id, $root.identifier)`,
+			wantErrKeywords: []string{"lambda", "capture", "root"},
+		},
+		{
+			name:            "lambda with a duplicate parameter",
+			whistle:         `sum: $CallFn((a, a) => a, 1, 2)`,
+			wantErrKeywords: []string{"lambda", "parameter", "a", "more than once"},
+		},
+		{
+			name: "pure projector writing to an output object",
+			whistle: `name: BuildName($root)
+
+pure def BuildName(n) {
+  given: n.first
+  out Audit: n
+}`,
+			wantErrKeywords: []string{"line 3", "BuildName", "pure", "output object Audit"},
+		},
+		{
+			name: "pure projector calling an impure builtin",
+			whistle: `pure def Build(n) {
+  id: $UUID()
+}`,
+			wantErrKeywords: []string{"line 1", "Build", "pure", "UUID"},
+		},
+		{
+			name: "pure projector calling an impure projector",
+			whistle: `pure def Build(n) {
+  id: Stamp(n)
+}
+
+def Stamp(n) {
+  root stamped: n
+}`,
+			wantErrKeywords: []string{"line 1", "Build", "pure", "Stamp", "root field stamped"},
+		},
+		{
+			name:            "where on an argument that is not iterated",
+			whistle:         `x: Build($root.obx where $.value)`,
+			wantErrKeywords: []string{"line 1", "where", "iterated"},
+		},
+		{
+			name:            "where on a call iterating several arguments",
+			whistle:         `x: Build($root.obx[] where $.value, $root.nte[])`,
+			wantErrKeywords: []string{"line 1", "where", "line up"},
+		},
+		{
+			name:            "this read outside of a post-condition",
+			whistle:         `x: $this.code`,
+			wantErrKeywords: []string{"line 1", "this", "post-condition"},
+		},
+		{
+			name: "post-condition reading an argument",
+			whistle: `def Build(n) ensures $this.id = n.id {
+  id: n.id
+}`,
+			wantErrKeywords: []string{"line 1", "unable", "input", "n"},
+		},
+		{
+			name: "unknown keyword after arguments",
+			whistle: `def Build(n) requires $this.id {
+  id: n.id
+}`,
+			wantErrKeywords: []string{"line 1", "unexpected", "requires", "ensures"},
+		},
+		{
+			name: "unknown projector modifier",
+			whistle: `impure def Build(n) {
+  id: n
+}`,
+			wantErrKeywords: []string{"unexpected", "impure", "pure"},
+		},
+		{
+			name: "keyed append to a variable",
+			whistle: `def Build(a) {
+  var v[@a.id]: a
+  x: v
+}`,
+			wantErrKeywords: []string{"line 2", "keyed", "variables"},
+		},
+		{
+			name: "two keyed appends",
+			whistle: `def Build(a) {
+  x[@a.id].y[@a.code]: a
+}`,
+			wantErrKeywords: []string{"line 2", "one", "keyed"},
+		},
+		{
+			name: "keyed append after an append",
+			whistle: `def Build(a) {
+  x[].y[@a.id].z: a
+}`,
+			wantErrKeywords: []string{"line 2", "keyed", "after an append"},
+		},
 		// TODO: Add more tests.
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			// Just test bare compilation
-			got, err := Transpile(test.whistle)
+			got, _, err := Transpile(test.whistle, Options{})
 			if err == nil {
 				t.Fatalf("Transpile(...) got %v\nwant error\nwhistle code:\n%s", got, test.whistle)
 			}
@@ -69,3 +283,986 @@ func TestTranspileErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestTranspileTargetCollisions(t *testing.T) {
+	tests := []struct {
+		name         string
+		whistle      string
+		wantWarnings []Warning
+	}{
+		{
+			name: "identical root targets",
+			whistle: `Patient[0].gender: "male"
+Patient[0].gender: "female"`,
+			wantWarnings: []Warning{{Line: 2, Column: 0}},
+		},
+		{
+			name: "prefix root targets",
+			whistle: `Patient[0]: $root.patient
+Patient[0].gender: "female"`,
+			wantWarnings: []Warning{{Line: 2, Column: 0}},
+		},
+		{
+			name: "root keyword in projectors",
+			whistle: `out foo: Foo()
+out bar: Bar()
+def Foo() {
+  root shared.id: "foo"
+}
+def Bar() {
+  root shared.id: "bar"
+}`,
+			wantWarnings: []Warning{{Line: 7, Column: 2}},
+		},
+		{
+			name: "root target and root keyword",
+			whistle: `shared: $root.shared
+out foo: Foo()
+def Foo() {
+  root shared.id: "foo"
+}`,
+			wantWarnings: []Warning{{Line: 4, Column: 2}},
+		},
+		{
+			name: "overwrite",
+			whistle: `Patient[0].gender: "male"
+Patient[0].gender!: "female"`,
+		},
+		{
+			name: "array append",
+			whistle: `Patient[]: "male"
+Patient[]: "female"`,
+		},
+		{
+			name: "sibling targets",
+			whistle: `Patient[0].gender: "male"
+Patient[0].genderText: "male"
+Patient[1].gender: "female"`,
+		},
+		{
+			name: "projector fields",
+			whistle: `def Foo() {
+  gender: "male"
+  gender: "female"
+}`,
+		},
+		{
+			name: "if and else arms",
+			whistle: `if $root.male {
+  Patient[0].gender: "male"
+} else {
+  Patient[0].gender: "female"
+}`,
+		},
+		{
+			name: "nested if and else arms",
+			whistle: `if $root.known {
+  if $root.male {
+    Patient[0].gender: "male"
+  } else {
+    Patient[0]: $root.patient
+  }
+} else {
+  Patient[0].gender: "unknown"
+}`,
+		},
+		{
+			name: "same arm",
+			whistle: `if $root.male {
+  Patient[0].gender: "male"
+  Patient[0].gender: "female"
+}`,
+			wantWarnings: []Warning{{Line: 3, Column: 2}},
+		},
+		{
+			name: "separate conditional blocks",
+			whistle: `if $root.male {
+  Patient[0].gender: "male"
+}
+if $root.female {
+  Patient[0].gender: "female"
+} else {
+  Patient[0].gender: "unknown"
+}`,
+			wantWarnings: []Warning{{Line: 5, Column: 2}, {Line: 7, Column: 2}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, got, err := Transpile(test.whistle, Options{})
+			if err != nil {
+				t.Fatalf("Transpile(...) returned unexpected error %v", err)
+			}
+
+			if len(got) != len(test.wantWarnings) {
+				t.Fatalf("Transpile(...) got warnings %v, want %d warnings", got, len(test.wantWarnings))
+			}
+			for i, w := range test.wantWarnings {
+				if got[i].Line != w.Line || got[i].Column != w.Column {
+					t.Errorf("Transpile(...) got warning %v, want it at [line %d col %d]", got[i], w.Line, w.Column)
+				}
+			}
+
+			_, _, err = Transpile(test.whistle, Options{StrictMode: true})
+			if wantErr := len(test.wantWarnings) > 0; (err != nil) != wantErr {
+				t.Errorf("Transpile(..., StrictMode) got error %v, want error %v", err, wantErr)
+			}
+		})
+	}
+}
+
+func TestTranspileOptions(t *testing.T) {
+	whistle := `out Patient: Patient_Patient($root)
+out Encounter: LibraryProjector($root)
+
+def Patient_Patient(p) {
+  id: $Hash(p)
+  name: HumanName(p.name)
+  things[]: NotAProjector[](p.things)
+}`
+
+	tests := []struct {
+		name         string
+		opts         Options
+		wantWarnings []string
+		wantErr      bool
+	}{
+		{
+			name: "unknown projectors",
+			opts: Options{},
+			wantWarnings: []string{
+				`[line 2 col 15] projector "LibraryProjector" is not defined`,
+				`[line 6 col 8] projector "HumanName" is not defined`,
+				`[line 7 col 12] projector "NotAProjector" is not defined`,
+			},
+		},
+		{
+			name: "known projectors",
+			opts: Options{KnownProjectors: []string{"LibraryProjector", "HumanName"}},
+			wantWarnings: []string{
+				`[line 7 col 12] projector "NotAProjector" is not defined`,
+			},
+		},
+		{
+			name: "file name",
+			opts: Options{FileName: "patient.wstl", KnownProjectors: []string{"LibraryProjector", "HumanName"}},
+			wantWarnings: []string{
+				`patient.wstl: [line 7 col 12] projector "NotAProjector" is not defined`,
+			},
+		},
+		{
+			name: "known builtins",
+			opts: Options{KnownProjectors: []string{"LibraryProjector", "HumanName", "NotAProjector"}, KnownBuiltins: []string{"$StrCat"}},
+			wantWarnings: []string{
+				`[line 5 col 6] projector "$Hash" is not defined`,
+			},
+		},
+		{
+			name:    "strict mode",
+			opts:    Options{StrictMode: true, KnownProjectors: []string{"LibraryProjector", "HumanName"}},
+			wantErr: true,
+		},
+		{
+			name: "strict mode without warnings",
+			opts: Options{StrictMode: true, KnownProjectors: []string{"LibraryProjector", "HumanName", "NotAProjector"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp, warnings, err := Transpile(whistle, test.opts)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Transpile(..., %+v) returned error %v, want error %v", test.opts, err, test.wantErr)
+			}
+			if test.wantErr {
+				if mp != nil || warnings != nil {
+					t.Errorf("Transpile(..., %+v) returned %v and warnings %v along with an error, want nil", test.opts, mp, warnings)
+				}
+				return
+			}
+
+			var got []string
+			for _, w := range warnings {
+				got = append(got, w.String())
+			}
+			if diff := cmp.Diff(test.wantWarnings, got); diff != "" {
+				t.Errorf("Transpile(..., %+v) got warnings diff -want +got:\n%s", test.opts, diff)
+			}
+		})
+	}
+}
+
+func TestTranspileTypeCheck(t *testing.T) {
+	whistle := `def Patient(p) {
+  var dob: $StrCat(p.year, p.month)
+  var n: 3
+  var s[]: "a"
+  if dob = 19700101 {
+    deceased: true
+  }
+  age: n + "1"
+  unknown: $Eq(p.x, 1)
+  count: s - 1
+  mixed: $NEq(n, true) // typecheck:ignore
+  // typecheck:ignore
+  other: n > "2"
+  var m: 1
+  var m: "1"
+  reassigned: m = 1
+  var o.x: 1
+  field: o = 1
+}`
+
+	tests := []struct {
+		name         string
+		opts         Options
+		wantWarnings []string
+		wantErr      bool
+	}{
+		{
+			name: "no type check",
+			opts: Options{BuiltinResultTypes: map[string]string{"$StrCat": "string"}},
+		},
+		{
+			name: "no builtin result types",
+			opts: Options{TypeCheck: true},
+			wantWarnings: []string{
+				`[line 8 col 7] $Sum expects numbers but argument 2 is a string`,
+				`[line 10 col 9] $Sub expects numbers but argument 1 is an array`,
+			},
+		},
+		{
+			name: "builtin result types",
+			opts: Options{TypeCheck: true, BuiltinResultTypes: map[string]string{"$StrCat": "string"}},
+			wantWarnings: []string{
+				`[line 5 col 5] $Eq compares a string with a number, which is always false`,
+				`[line 8 col 7] $Sum expects numbers but argument 2 is a string`,
+				`[line 10 col 9] $Sub expects numbers but argument 1 is an array`,
+			},
+		},
+		{
+			name:    "strict mode",
+			opts:    Options{TypeCheck: true, StrictMode: true},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, warnings, err := Transpile(whistle, test.opts)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("Transpile(..., %+v) returned error %v, want error %v", test.opts, err, test.wantErr)
+			}
+
+			var got []string
+			for _, w := range warnings {
+				got = append(got, w.String())
+			}
+			if diff := cmp.Diff(test.wantWarnings, got); diff != "" {
+				t.Errorf("Transpile(..., %+v) got warnings diff -want +got:\n%s", test.opts, diff)
+			}
+		})
+	}
+}
+
+func TestTranspileSuggestions(t *testing.T) {
+	whistle := `out Patient: Patient_Patient($root)
+
+def Patient_Patient(p) {
+  id: $StrConcat(p.system, p.value)
+  name: Human_Name(p.name)
+}`
+
+	tests := []struct {
+		name         string
+		opts         Options
+		wantWarnings []string
+	}{
+		{
+			name: "projectors",
+			opts: Options{KnownProjectors: []string{"HumanName"}},
+			wantWarnings: []string{
+				`[line 5 col 8] projector "Human_Name" is not defined (did you mean one of ["HumanName"]?)`,
+			},
+		},
+		{
+			name: "builtins",
+			opts: Options{KnownProjectors: []string{"HumanName"}, KnownBuiltins: []string{"$StrCat", "$StrJoin", "$StrSplit", "$ToUpper"}},
+			wantWarnings: []string{
+				`[line 4 col 6] projector "$StrConcat" is not defined (did you mean one of ["$StrCat" "$StrJoin" "$StrSplit"]?)`,
+				`[line 5 col 8] projector "Human_Name" is not defined (did you mean one of ["HumanName"]?)`,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, warnings, err := Transpile(whistle, test.opts)
+			if err != nil {
+				t.Fatalf("Transpile(..., %+v) returned unexpected error %v", test.opts, err)
+			}
+
+			var got []string
+			for _, w := range warnings {
+				got = append(got, w.String())
+			}
+			if diff := cmp.Diff(test.wantWarnings, got); diff != "" {
+				t.Errorf("Transpile(..., %+v) got warnings diff -want +got:\n%s", test.opts, diff)
+			}
+		})
+	}
+}
+
+func TestTranspileFileNameInErrors(t *testing.T) {
+	_, _, err := Transpile(`root hello: "world"`, Options{FileName: "hello.wstl"})
+	if err == nil || !strings.HasPrefix(err.Error(), "hello.wstl: ") {
+		t.Errorf("Transpile(...) got error %v, want it to start with the file name", err)
+	}
+}
+
+func TestTranspileBlockComments(t *testing.T) {
+	withComments := `/* A header
+   spanning lines. */
+hello: $StrCat("a", /* "b", */ "c") /* trailing */
+/*
+removed: "debugging"
+*/
+list: [1, /* 2, */ 3]
+path: "a/*b*/c" // Not a comment in a string.
+`
+	without := `hello: $StrCat("a", "c")
+list: [1, 3]
+path: "a/*b*/c"
+`
+
+	got, _, err := Transpile(withComments, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(%q) got unexpected error %v", withComments, err)
+	}
+	want, _, err := Transpile(without, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(%q) got unexpected error %v", without, err)
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(%q) returned diff (-want +got):\n%s", withComments, diff)
+	}
+}
+
+func TestTranspileUnterminatedBlockComment(t *testing.T) {
+	whistle := `hello: "world"
+bye: /* "world"`
+
+	_, _, err := Transpile(whistle, Options{})
+	terr, ok := err.(errors.TranspilationError)
+	if !ok {
+		t.Fatalf("Transpile(%q) got error %v, want a TranspilationError", whistle, err)
+	}
+	if terr.Line() != 2 || terr.Col() != 5 {
+		t.Errorf("Transpile(%q) got error at line %d col %d, want line 2 col 5", whistle, terr.Line(), terr.Col())
+	}
+}
+
+func TestTranspileProjectorDescriptions(t *testing.T) {
+	whistle := `// Header comment, separated by a blank line.
+
+// Maps a patient.
+// The name is upper cased.
+def Patient_Patient(p) {
+  // Not a doc comment.
+  name: $ToUpper(p.name)
+}
+
+def Undocumented(x) {
+  y: x
+}
+//Without a space.
+def NoSpace(x) {
+  y: x
+}
+
+// Separated by a blank line.
+
+def Separated(x) {
+  y: x
+}
+
+out Patient: Patient_Patient($root) // Not a doc comment either.
+def AfterMapping(x) {
+  y: x
+}`
+
+	got, _, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	want := map[string]string{
+		"Patient_Patient": "Maps a patient.\nThe name is upper cased.",
+		"Undocumented":    "",
+		"NoSpace":         "Without a space.",
+		"Separated":       "",
+		"AfterMapping":    "",
+	}
+	descriptions := make(map[string]string)
+	for _, p := range got.GetProjector() {
+		descriptions[p.GetName()] = p.GetDescription()
+	}
+	if diff := cmp.Diff(want, descriptions); diff != "" {
+		t.Errorf("Transpile(...) returned projector descriptions diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranspilePureProjectors(t *testing.T) {
+	whistle := `pure: Name($root)
+
+// Builds a name.
+pure def Name(p) {
+  var given: $StrSplit(p.given, " ")
+  given: given
+  family: Family(p)
+}
+
+def Family(p) {
+  $this: $ToUpper(p.family)
+}`
+
+	got, _, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	want := map[string]bool{"Name": true, "Family": false}
+	pure := make(map[string]bool)
+	for _, p := range got.GetProjector() {
+		pure[p.GetName()] = p.GetPure()
+		if p.GetName() == "Name" && p.GetDescription() != "Builds a name." {
+			t.Errorf("Transpile(...) returned description %q for Name, want %q", p.GetDescription(), "Builds a name.")
+		}
+	}
+	if diff := cmp.Diff(want, pure); diff != "" {
+		t.Errorf("Transpile(...) returned pure projectors diff (-want +got):\n%s", diff)
+	}
+	if target := got.GetRootMapping()[0].GetTargetField(); target != "pure" {
+		t.Errorf("Transpile(...) returned root mapping to %q, want a field named pure", target)
+	}
+}
+
+func TestTranspileEnsures(t *testing.T) {
+	whistle := `coding: BuildCoding($root)
+
+def BuildCoding(c) ensures $IsNotNil($this.code) and $this.system ~= "" {
+  code: c.id
+  system: "urn:x"
+}
+
+def Unchecked(c) {
+  ensures: c
+}`
+
+	got, _, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	this := func(field string) *mpb.ValueSource {
+		return &mpb.ValueSource{Source: &mpb.ValueSource_FromInput{FromInput: &mpb.ValueSource_InputSource{Arg: 1, Field: field}}}
+	}
+	want := map[string]*mpb.ProjectorDefinition{
+		"BuildCoding": {
+			Ensures: &mpb.ValueSource{
+				Projector: "$And",
+				Source: &mpb.ValueSource_ProjectedValue{ProjectedValue: &mpb.ValueSource{
+					Projector: "$IsNotNil",
+					Source:    this(".code").Source,
+				}},
+				AdditionalArg: []*mpb.ValueSource{{
+					Projector:     "$NEq",
+					Source:        this(".system").Source,
+					AdditionalArg: []*mpb.ValueSource{{Source: &mpb.ValueSource_ConstString{ConstString: ""}}},
+				}},
+			},
+			EnsuresText: `$IsNotNil($this.code) and $this.system ~= ""`,
+		},
+		"Unchecked": {},
+	}
+	ensures := make(map[string]*mpb.ProjectorDefinition)
+	for _, p := range got.GetProjector() {
+		ensures[p.GetName()] = &mpb.ProjectorDefinition{Ensures: p.GetEnsures(), EnsuresText: p.GetEnsuresText()}
+	}
+	if diff := cmp.Diff(want, ensures, protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(...) returned post-conditions diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranspileIteratedCallFilters(t *testing.T) {
+	whistle := `def Observations(msg) {
+  filtered: Build(msg.obx[] where $.type = "NM")
+  inline: Build(msg.obx[where $.type = "NM"][])
+  nested: Build(msg.obx[] where $IsNotNil(Part($.parts[] where $.ok)))
+}
+
+def Build(obx) {
+  value: obx.value
+}
+
+def Part(p) {
+  id: p.id
+}
+`
+
+	got, _, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	projectors := make(map[string]*mpb.ProjectorDefinition)
+	for _, p := range got.GetProjector() {
+		projectors[p.GetName()] = p
+	}
+
+	// The where clause is transpiled like the inline filter, followed by [].
+	callsite := func(filter string) *mpb.ValueSource {
+		return &mpb.ValueSource{
+			Source: &mpb.ValueSource_ProjectedValue{
+				ProjectedValue: &mpb.ValueSource{
+					Source: &mpb.ValueSource_FromInput{
+						FromInput: &mpb.ValueSource_InputSource{
+							Arg:   1,
+							Field: ".obx[]",
+						},
+					},
+					Projector: filter + "[]",
+				},
+			},
+			Projector: "Build",
+		}
+	}
+	mappings := projectors["Observations"].GetMapping()
+	if diff := cmp.Diff(callsite("$filter_2_28"), mappings[0].GetValueSource(), protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(...) returned filtered call diff (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(callsite("$filter_3_16"), mappings[1].GetValueSource(), protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(...) returned inline filter call diff (-want +got):\n%s", diff)
+	}
+
+	where, inline := projectors["$filter_2_28"], projectors["$filter_3_16"]
+	if where == nil || inline == nil {
+		t.Fatalf("Transpile(...) returned projectors %v, want $filter_2_28 and $filter_3_16", projectors)
+	}
+	if diff := cmp.Diff(inline.GetMapping(), where.GetMapping(), protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(...) returned where clause diff from the inline filter (-inline +where):\n%s", diff)
+	}
+
+	// In nested where clauses, $ is the element of the innermost iteration.
+	inner := projectors["$filter_4_57"]
+	if inner == nil {
+		t.Fatalf("Transpile(...) returned projectors %v, want $filter_4_57", projectors)
+	}
+	wantCondition := &mpb.ValueSource{
+		Source: &mpb.ValueSource_FromInput{
+			FromInput: &mpb.ValueSource_InputSource{
+				Arg:   1,
+				Field: ".ok",
+			},
+		},
+	}
+	if diff := cmp.Diff(wantCondition, inner.GetMapping()[0].GetCondition(), protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(...) returned nested where clause diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranspileRootInputs(t *testing.T) {
+	whistle := `root(msg, roster)
+name: msg.name
+mrn: roster.mrn
+whole: $root
+`
+
+	got, _, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	if diff := cmp.Diff([]string{"msg", "roster"}, got.GetRootInputName()); diff != "" {
+		t.Errorf("Transpile(...) returned root input names diff (-want +got):\n%s", diff)
+	}
+
+	want := map[string]int32{"name": 2, "mrn": 3, "whole": 1}
+	args := make(map[string]int32)
+	for _, m := range got.GetRootMapping() {
+		args[m.GetTargetField()] = m.GetValueSource().GetFromInput().GetArg()
+	}
+	if diff := cmp.Diff(want, args); diff != "" {
+		t.Errorf("Transpile(...) returned root mapping args diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranspileNamespaces(t *testing.T) {
+	whistle := `use "acme"
+use "beta"
+mrn: $ChecksumMRN($root.mrn)
+qualified: acme::$ChecksumMRN($root.mrn)
+name: Name($root)
+use: "official"
+`
+
+	got, warnings, err := Transpile(whistle, Options{KnownProjectors: []string{"acme::$ChecksumMRN", "beta::Name"}})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+	if len(warnings) > 0 {
+		t.Errorf("Transpile(...) got unexpected warnings %v", warnings)
+	}
+
+	if diff := cmp.Diff([]string{"acme", "beta"}, got.GetUseNamespace()); diff != "" {
+		t.Errorf("Transpile(...) returned used namespaces diff (-want +got):\n%s", diff)
+	}
+
+	want := map[string]string{"mrn": "$ChecksumMRN", "qualified": "acme::$ChecksumMRN", "name": "Name", "use": ""}
+	projectors := make(map[string]string)
+	for _, m := range got.GetRootMapping() {
+		projectors[m.GetTargetField()] = m.GetValueSource().GetProjector()
+	}
+	if diff := cmp.Diff(want, projectors); diff != "" {
+		t.Errorf("Transpile(...) returned root mapping projectors diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranspileNamespacesErrors(t *testing.T) {
+	tests := []struct {
+		name            string
+		whistle         string
+		known           []string
+		wantErrKeywords []string
+	}{
+		{
+			name:            "namespace used twice",
+			whistle:         "use \"acme\"\nuse \"acme\"",
+			wantErrKeywords: []string{"acme", "already used", "line 1"},
+		},
+		{
+			name:            "invalid namespace",
+			whistle:         `use "a::b"`,
+			wantErrKeywords: []string{"invalid namespace"},
+		},
+		{
+			name:            "not a use declaration",
+			whistle:         `import "acme"`,
+			wantErrKeywords: []string{"unexpected import"},
+		},
+		{
+			name:            "two namespaces",
+			whistle:         "use \"acme\"\nuse \"beta\"",
+			known:           []string{"acme::$ChecksumMRN", "beta::$ChecksumMRN"},
+			wantErrKeywords: []string{"beta::\\$ChecksumMRN", "acme::\\$ChecksumMRN", "line 1", "line 2"},
+		},
+		{
+			name: "projector defined in the Whistle",
+			whistle: `use "acme"
+def Name(n) {
+  family: n.family
+}`,
+			known:           []string{"acme::Name"},
+			wantErrKeywords: []string{"acme::Name", "defined in this file"},
+		},
+		{
+			name:            "known projector without a namespace",
+			whistle:         `use "acme"`,
+			known:           []string{"acme::$StrCat", "$StrCat"},
+			wantErrKeywords: []string{"acme::\\$StrCat", "known projector"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, _, err := Transpile(test.whistle, Options{KnownProjectors: test.known})
+			if err == nil {
+				t.Fatalf("Transpile(...) got %v\nwant error\nwhistle code:\n%s", got, test.whistle)
+			}
+
+			str := err.Error()
+			for _, kw := range test.wantErrKeywords {
+				if m, err := regexp.MatchString(kw, str); !m {
+					if err != nil {
+						t.Fatalf("Failed to regexp search for keyword %q: %v", kw, err)
+					}
+					t.Errorf("Transpile(...) got error %q, want keyword %q", str, kw)
+				}
+			}
+		})
+	}
+}
+
+func TestTranspileGlobals(t *testing.T) {
+	whistle := `$global.patient: $root.patient
+out Encounter: Encounter($root.encounter)
+def Encounter(e) {
+  id: e.id
+  subject: $global.patient.id
+  tags: $global.patient.tags[]
+}
+`
+
+	got, _, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	if got, want := got.GetRootMapping()[0].GetTargetGlobal(), "patient"; got != want {
+		t.Errorf("Transpile(...) got first root mapping target global %q, want %q", got, want)
+	}
+
+	want := map[string]string{"subject": "patient.id", "tags": "patient.tags[]"}
+	globals := make(map[string]string)
+	for _, p := range got.GetProjector() {
+		if p.GetName() != "Encounter" {
+			continue
+		}
+		for _, m := range p.GetMapping() {
+			if g := m.GetValueSource().GetFromGlobal(); g != "" {
+				globals[m.GetTargetField()] = g
+			}
+		}
+	}
+	if diff := cmp.Diff(want, globals); diff != "" {
+		t.Errorf("Transpile(...) returned global reads diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranspileRequiredTargets(t *testing.T) {
+	whistle := `required id: $root.id
+out Patient: Patient($root)
+def Patient(p) {
+  required identifier[]: p.ids[]
+  if p.active {
+    required active: p.active
+  }
+  name: p.name
+}
+`
+
+	got, _, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	required := map[string]bool{"id": got.GetRootMapping()[0].GetRequired()}
+	for _, p := range got.GetProjector() {
+		if p.GetName() != "Patient" {
+			continue
+		}
+		for _, m := range p.GetMapping() {
+			required[m.GetTargetField()] = m.GetRequired()
+		}
+	}
+	want := map[string]bool{"id": true, "identifier[]": true, "active": true, "name": false}
+	if diff := cmp.Diff(want, required); diff != "" {
+		t.Errorf("Transpile(...) returned required targets diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestTranspileDynamicObjectTargets(t *testing.T) {
+	whistle := `out($root.resourceType): $root
+Bundle.type: "collection"
+`
+
+	got, warnings, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("Transpile(...) got warnings %v, want none outside of strict mode", warnings)
+	}
+
+	want := &mpb.ValueSource{
+		Source: &mpb.ValueSource_FromInput{
+			FromInput: &mpb.ValueSource_InputSource{
+				Arg:   1,
+				Field: ".resourceType",
+			},
+		},
+	}
+	if diff := cmp.Diff(want, got.GetRootMapping()[0].GetTargetDynamicObject(), protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(...) returned dynamic object target diff (-want +got):\n%s", diff)
+	}
+
+	// The name of the dynamic object may be Bundle at runtime.
+	_, _, err = Transpile(whistle, Options{StrictMode: true})
+	if err == nil || !strings.Contains(err.Error(), "[line 1 col 0]") || !strings.Contains(err.Error(), `"Bundle.type"`) {
+		t.Errorf("Transpile(..., StrictMode) returned error %v, want a collision of the dynamic object with Bundle.type", err)
+	}
+}
+
+func TestTranspileLambdas(t *testing.T) {
+	whistle := `out Patient: Patient($root)
+
+def Patient(p) {
+  mrn: $CallFn(i => i.system = "MRN", p.identifier)
+  sum: $CallFn((a, b) => $Sum(a, b), p.a, p.b)
+  one: $CallFn(() => 1)
+}
+`
+
+	got, _, err := Transpile(whistle, Options{FileName: "patient.wstl"})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	argCounts := make(map[string]int32)
+	for _, p := range got.GetProjector() {
+		argCounts[p.GetName()] = p.GetArgCount()
+	}
+	wantArgCounts := map[string]int32{
+		"Patient":                   1,
+		"lambda<patient.wstl:4:15>": 1,
+		"lambda<patient.wstl:5:15>": 2,
+		"lambda<patient.wstl:6:15>": 0,
+	}
+	if diff := cmp.Diff(wantArgCounts, argCounts); diff != "" {
+		t.Errorf("Transpile(...) returned projector arg counts diff (-want +got):\n%s", diff)
+	}
+
+	// The lambda is passed by name.
+	var mrn *mpb.ValueSource
+	for _, p := range got.GetProjector() {
+		if p.GetName() == "Patient" {
+			mrn = p.GetMapping()[0].GetValueSource()
+		}
+	}
+	want := &mpb.ValueSource{
+		Source: &mpb.ValueSource_ConstString{
+			ConstString: "lambda<patient.wstl:4:15>",
+		},
+		AdditionalArg: []*mpb.ValueSource{
+			{
+				Source: &mpb.ValueSource_FromInput{
+					FromInput: &mpb.ValueSource_InputSource{
+						Arg:   1,
+						Field: ".identifier",
+					},
+				},
+			},
+		},
+		Projector: "$CallFn",
+	}
+	if diff := cmp.Diff(want, mrn, protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(...) returned lambda call diff (-want +got):\n%s", diff)
+	}
+
+	// Without a file name, the names of lambdas only have their positions.
+	got, _, err = Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+	for _, p := range got.GetProjector() {
+		if p.GetName() != "Patient" {
+			continue
+		}
+		if name := p.GetMapping()[0].GetValueSource().GetConstString(); name != "lambda<4:15>" {
+			t.Errorf("Transpile(...) without a file name passed lambda %q, want lambda<4:15>", name)
+		}
+	}
+}
+
+func TestTranspileProjectorReferences(t *testing.T) {
+	// Projectors are called before they are defined, and Section and Sections call each other.
+	whistle := `out Document: Section($root)
+
+def Section(s) {
+  title: s.title
+  children: Sections(s.section)
+}
+
+def Sections(ss) {
+  section: Section(ss[])
+  summary: Summary(ss)
+}
+
+def Summary(ss) {
+  count: $ListLen(ss)
+  missing: Undefined(ss)
+}`
+
+	mp, warnings, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) returned unexpected error %v", err)
+	}
+
+	var got []string
+	for _, w := range warnings {
+		got = append(got, w.String())
+	}
+	want := []string{`[line 15 col 11] projector "Undefined" is not defined`}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Transpile(...) got warnings diff -want +got:\n%s", diff)
+	}
+
+	// Projectors only take their own arguments, regardless of where they are defined.
+	arities := make(map[string]int32)
+	for _, p := range mp.GetProjector() {
+		arities[p.GetName()] = p.GetArgCount()
+	}
+	wantArities := map[string]int32{"Section": 1, "Sections": 1, "Summary": 1}
+	if diff := cmp.Diff(wantArities, arities); diff != "" {
+		t.Errorf("Transpile(...) got projector arities diff -want +got:\n%s", diff)
+	}
+
+	// Undefined projectors still fail in strict mode, with their location.
+	_, _, err = Transpile(whistle, Options{StrictMode: true, FileName: "document.wstl"})
+	if err == nil || !strings.Contains(err.Error(), `document.wstl: [line 15 col 11] projector "Undefined" is not defined`) {
+		t.Errorf("Transpile(..., StrictMode) returned error %v, want the location of the call to Undefined", err)
+	}
+	if _, _, err := Transpile(whistle, Options{StrictMode: true, KnownProjectors: []string{"Undefined"}}); err != nil {
+		t.Errorf("Transpile(..., StrictMode with Undefined known) returned unexpected error %v", err)
+	}
+}
+
+func TestTranspileCallStatements(t *testing.T) {
+	whistle := `out Patient: Patient($root)
+
+def Patient(p) {
+  CheckRequiredFields(p.name);
+  if p.active {
+    Audit[](p.ids[]) // Only active patients are audited.
+  }
+  id: p.id
+}
+`
+
+	got, _, err := Transpile(whistle, Options{})
+	if err != nil {
+		t.Fatalf("Transpile(...) got unexpected error %v\nwhistle code:\n%s", err, whistle)
+	}
+
+	arg := func(field string) *mpb.ValueSource {
+		return &mpb.ValueSource{Source: &mpb.ValueSource_FromInput{FromInput: &mpb.ValueSource_InputSource{Arg: 1, Field: field}}}
+	}
+	discard := func(call *mpb.ValueSource) *mpb.ValueSource {
+		return &mpb.ValueSource{Source: &mpb.ValueSource_ProjectedValue{ProjectedValue: call}, Projector: "$Void"}
+	}
+	want := []*mpb.FieldMapping{
+		{
+			Target:      &mpb.FieldMapping_TargetField{TargetField: "."},
+			ValueSource: discard(&mpb.ValueSource{Source: arg(".name").Source, Projector: "CheckRequiredFields"}),
+		},
+		{
+			Target:      &mpb.FieldMapping_TargetField{TargetField: "."},
+			Condition:   arg(".active"),
+			ValueSource: discard(&mpb.ValueSource{Source: arg(".ids[]").Source, Projector: "Audit[]"}),
+		},
+		{
+			Target:      &mpb.FieldMapping_TargetField{TargetField: "id"},
+			ValueSource: arg(".id"),
+		},
+	}
+	var mappings []*mpb.FieldMapping
+	for _, p := range got.GetProjector() {
+		if p.GetName() == "Patient" {
+			mappings = p.GetMapping()
+		}
+	}
+	if diff := cmp.Diff(want, mappings, protocmp.Transform()); diff != "" {
+		t.Errorf("Transpile(...) returned mappings diff (-want +got):\n%s", diff)
+	}
+
+	// Calls are only statements in projectors.
+	if _, _, err := Transpile(`CheckRequiredFields($root)`, Options{}); err == nil || !strings.Contains(err.Error(), "parser error") {
+		t.Errorf("Transpile(...) of a root call statement returned error %v, want a parser error", err)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transpiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_language/parser" /* copybara-comment: parser */
+	"github.com/antlr/antlr4/runtime/Go/antlr" /* copybara-comment: antlr */
+
+	mpb "github.com/GoogleCloudPlatform/healthcare-data-harmonization/mapping_engine/proto" /* copybara-comment: mapping_go_proto */
+)
+
+// typeCheckIgnoreComment suppresses the type warnings of the line it is on and of the line after it,
+// so that it can either end the offending line or precede it.
+const typeCheckIgnoreComment = "// typecheck:ignore"
+
+// valueType is the coarse type of a value as far as it is known when transpiling. The names match
+// those of Options.BuiltinResultTypes.
+type valueType string
+
+const (
+	unknownType valueType = ""
+	stringType  valueType = "string"
+	numberType  valueType = "number"
+	boolType    valueType = "bool"
+	arrayType   valueType = "array"
+	objectType  valueType = "object"
+)
+
+// withArticle returns the name of the type with an indefinite article, e.g. "an array".
+func (v valueType) withArticle() string {
+	if v == arrayType || v == objectType {
+		return "an " + string(v)
+	}
+	return "a " + string(v)
+}
+
+var (
+	// equalityOperators are the builtins comparing their arguments for equality, which are never
+	// equal if they are of different types, with what the comparison then always evaluates to.
+	equalityOperators = map[string]bool{
+		"$Eq":  false,
+		"$NEq": true,
+	}
+
+	// numericOperators are the builtins (for arithmetic and ordering) whose arguments must all be
+	// numbers.
+	numericOperators = map[string]bool{
+		"$Div":  true,
+		"$Gt":   true,
+		"$GtEq": true,
+		"$Lt":   true,
+		"$LtEq": true,
+		"$Mod":  true,
+		"$Mul":  true,
+		"$Sub":  true,
+		"$Sum":  true,
+	}
+)
+
+// typeOf returns the type of the value of the given value source, or unknownType if it can not be
+// inferred. Types are known for constants, builtins with a known result type, iterated calls and
+// list literals, and the variables of the current environment that were only assigned such values.
+func (t *transpiler) typeOf(vs *mpb.ValueSource) valueType {
+	if vs == nil || vs.Spread {
+		return unknownType
+	}
+	if p := vs.GetProjector(); p != "" {
+		if strings.HasSuffix(p, "[]") || p == listInitializationProjector {
+			return arrayType
+		}
+		return valueType(t.builtinResultTypes[p])
+	}
+
+	switch s := vs.GetSource().(type) {
+	case *mpb.ValueSource_ConstString:
+		return stringType
+	case *mpb.ValueSource_ConstInt, *mpb.ValueSource_ConstFloat:
+		return numberType
+	case *mpb.ValueSource_ConstBool:
+		return boolType
+	case *mpb.ValueSource_ProjectedValue:
+		return t.typeOf(s.ProjectedValue)
+	case *mpb.ValueSource_FromLocalVar:
+		if t.environment != nil {
+			return t.environment.varTypes[s.FromLocalVar]
+		}
+	}
+	return unknownType
+}
+
+// recordVarType records the type of the value assigned to the given variable target (e.g. "x",
+// "x[]" or "x.field"). A variable whose assignments are not all of the same known type, or that has
+// fields assigned, is of unknown type.
+func (t *transpiler) recordVarType(target string, value *mpb.ValueSource) {
+	if !t.typeCheck || t.environment == nil {
+		return
+	}
+	n := t.environment
+	if n.varTypes == nil {
+		n.varTypes = make(map[string]valueType)
+	}
+
+	typ := t.typeOf(value)
+	name := target
+	if strings.HasSuffix(target, "[]") && !strings.ContainsAny(strings.TrimSuffix(target, "[]"), ".[") {
+		name, typ = strings.TrimSuffix(target, "[]"), arrayType
+	} else if i := strings.IndexAny(target, ".["); i >= 0 {
+		name, typ = target[:i], unknownType
+	}
+
+	if prev, ok := n.varTypes[name]; ok && prev != typ {
+		typ = unknownType
+	}
+	n.varTypes[name] = typ
+}
+
+// checkTypes adds a type warning if the given call to a comparison or arithmetic builtin has
+// arguments of known types that can never work, e.g. comparing a string with a number (which is
+// always false) or adding a boolean.
+func (t *transpiler) checkTypes(ctx antlr.ParserRuleContext, vs *mpb.ValueSource) {
+	if !t.typeCheck {
+		return
+	}
+
+	var types []valueType
+	for _, arg := range callArgs(vs) {
+		types = append(types, t.typeOf(arg))
+	}
+
+	name := vs.GetProjector()
+	if always, ok := equalityOperators[name]; ok {
+		for i := 1; i < len(types); i++ {
+			if types[0] != unknownType && types[i] != unknownType && types[0] != types[i] {
+				t.warnType(ctx, fmt.Sprintf("%s compares %s with %s, which is always %t", name, types[0].withArticle(), types[i].withArticle(), always))
+				return
+			}
+		}
+		return
+	}
+	if numericOperators[name] {
+		for i, typ := range types {
+			if typ != unknownType && typ != numberType {
+				t.warnType(ctx, fmt.Sprintf("%s expects numbers but argument %d is %s", name, i+1, typ.withArticle()))
+				return
+			}
+		}
+	}
+}
+
+// callArgs returns the arguments of the given call, in order.
+func callArgs(vs *mpb.ValueSource) []*mpb.ValueSource {
+	var args []*mpb.ValueSource
+	switch s := vs.GetSource().(type) {
+	case nil:
+	case *mpb.ValueSource_ProjectedValue:
+		args = append(args, s.ProjectedValue)
+	default:
+		args = append(args, &mpb.ValueSource{Source: s})
+	}
+	return append(args, vs.GetAdditionalArg()...)
+}
+
+// warnType records a type warning about the given code, to be added unless it is suppressed.
+func (t *transpiler) warnType(ctx antlr.ParserRuleContext, msg string) {
+	t.typeWarnings = append(t.typeWarnings, Warning{
+		Line:    ctx.GetStart().GetLine(),
+		Column:  ctx.GetStart().GetColumn(),
+		Message: msg,
+	})
+}
+
+// addTypeWarnings adds the type warnings that are not suppressed by a typeCheckIgnoreComment among
+// the given tokens of the Whistle.
+func (t *transpiler) addTypeWarnings(tokens []antlr.Token) {
+	ignored := make(map[int]bool)
+	for _, tok := range tokens {
+		if tok.GetTokenType() != parser.WhistleLexerCOMMENT || strings.TrimRight(tok.GetText(), " \t\r") != typeCheckIgnoreComment {
+			continue
+		}
+		ignored[tok.GetLine()] = true
+		ignored[tok.GetLine()+1] = true
+	}
+
+	for _, w := range t.typeWarnings {
+		if !ignored[w.Line] {
+			t.warnings = append(t.warnings, w)
+		}
+	}
+}
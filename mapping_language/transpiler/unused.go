@@ -43,10 +43,26 @@ func (t *transpiler) VisitFloatingPoint(ctx *parser.FloatingPointContext) interf
 	panic("unused rule VisitFloatingPoint entered by visitor - this should never happen")
 }
 
+func (t *transpiler) VisitUseNamespace(ctx *parser.UseNamespaceContext) interface{} {
+	panic("unused rule VisitUseNamespace entered by visitor - this should never happen")
+}
+
+func (t *transpiler) VisitPredicateValue(ctx *parser.PredicateValueContext) interface{} {
+	panic("unused rule VisitPredicateValue entered by visitor - this should never happen")
+}
+
+func (t *transpiler) VisitProjectorModifier(ctx *parser.ProjectorModifierContext) interface{} {
+	panic("unused rule VisitProjectorModifier entered by visitor - this should never happen")
+}
+
 func (t *transpiler) VisitArgAlias(ctx *parser.ArgAliasContext) interface{} {
 	panic("unused rule VisitArgAlias entered by visitor - this should never happen")
 }
 
+func (t *transpiler) VisitLambdaParams(ctx *parser.LambdaParamsContext) interface{} {
+	panic("unused rule VisitLambdaParams entered by visitor - this should never happen")
+}
+
 func (t *transpiler) VisitComment(ctx *parser.CommentContext) interface{} {
 	// No-op
 	return nil
@@ -83,3 +99,7 @@ func (t *transpiler) VisitIndex(ctx *parser.IndexContext) interface{} {
 func (t *transpiler) VisitArrayMod(ctx *parser.ArrayModContext) interface{} {
 	panic("unused rule VisitArrayMod entered by visitor - this should never happen")
 }
+
+func (t *transpiler) VisitKeyedArrayMod(ctx *parser.KeyedArrayModContext) interface{} {
+	panic("unused rule VisitKeyedArrayMod entered by visitor - this should never happen")
+}